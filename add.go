@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	fileModeRegular    = 0100644
+	fileModeExecutable = 0100755
+	fileModeSymlink    = 0120000
+	fileModeGitlink    = 0160000
+	fileModeTree       = 040000
+)
+
+func worktreeFileMode(info os.FileInfo) uint32 {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return fileModeSymlink
+	case info.IsDir():
+		return fileModeGitlink
+	case info.Mode()&0111 != 0:
+		return fileModeExecutable
+	}
+	return fileModeRegular
+}
+
+// worktreeModes says which file modes the filesystem of the worktree
+// cannot record; the zero value is a filesystem that records them all
+type worktreeModes struct {
+	noSymlinks      bool // core.symlinks=false: symlinks are checked out as files holding their target
+	noExecutableBit bool // core.fileMode=false: the executable bit of files means nothing
+}
+
+func (repo *Repository) worktreeModes() worktreeModes {
+	return worktreeModes{
+		noSymlinks:      !repo.config.getBool("core.symlinks", true),
+		noExecutableBit: !repo.config.getBool("core.fileMode", true),
+	}
+}
+
+// entryMode is the mode a worktree file is staged with, given the mode of
+// its entry, 0 for untracked files. A file the filesystem could not check
+// out as what its entry is keeps the entry's mode, and without a
+// trustworthy executable bit new files are taken to be regular ones.
+func (modes worktreeModes) entryMode(info os.FileInfo, indexMode uint32) uint32 {
+	mode := worktreeFileMode(info)
+	isFile := mode == fileModeRegular || mode == fileModeExecutable
+	switch {
+	case modes.noSymlinks && indexMode == fileModeSymlink && isFile:
+		return fileModeSymlink
+	case modes.noExecutableBit && isFile && (indexMode == fileModeRegular || indexMode == fileModeExecutable):
+		return indexMode
+	case modes.noExecutableBit && isFile:
+		return fileModeRegular
+	}
+	return mode
+}
+
+// readWorktreeContent returns the content of a worktree file as it is on
+// disk, or the link target for symlinks
+func readWorktreeContent(filePath string, info os.FileInfo) []byte {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return []byte(target)
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return content
+}
+
+func (repo *Repository) worktreePath(relativePath string) string {
+	return filepath.Join(repo.workTree, filepath.FromSlash(relativePath))
+}
+
+// isUnderPathspec reports whether relativePath is the pathspec itself or
+// lies inside it; the empty pathspec covers the whole worktree
+func isUnderPathspec(relativePath string, pathspec string) bool {
+	return pathspec == "" || relativePath == pathspec || strings.HasPrefix(relativePath, pathspec+"/")
+}
+
+// collectWorktreeFiles walks dir below the worktree and returns the paths of
+// all files that are not ignored, skipping nested repositories
+func (repo *Repository) collectWorktreeFiles(dir string, matcher *ignoreMatcher) []string {
+	files := make([]string, 0)
+	root := repo.worktreePath(dir)
+	err := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(repo.workTree, filePath)
+		if err != nil {
+			return err
+		}
+		relativePath = repo.worktreeName(filepath.ToSlash(relativePath))
+		if entry.IsDir() {
+			if filePath == root {
+				return nil
+			}
+			if entry.Name() == ".git" || matcher.isIgnored(relativePath, true) {
+				return filepath.SkipDir
+			}
+			if _, err := os.Lstat(filepath.Join(filePath, ".git")); err == nil {
+				// nested repository
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Name() != ".git" && !matcher.isIgnored(relativePath, false) {
+			files = append(files, relativePath)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return files
+}
+
+// addOptions narrow what add stages of the files the pathspecs match
+type addOptions struct {
+	update        bool // only update the entries of tracked files, adding no new ones
+	ignoreRemoval bool // keep the entries of files gone from the worktree
+	intentToAdd   bool // only record that untracked files will be added
+}
+
+func (repo *Repository) addPaths(pathspecs []pathspec, jobs int, options addOptions) {
+	index := repo.lockIndex()
+	matcher := newIgnoreMatcher(repo)
+	candidates := make([]string, 0)
+	seen := make(map[string]bool)
+	addCandidate := func(relativePath string) {
+		if !seen[relativePath] && matchesPathspecs(relativePath, pathspecs) {
+			seen[relativePath] = true
+			candidates = append(candidates, relativePath)
+		}
+	}
+	ignoredPaths := make([]string, 0)
+	sparsePaths := make([]string, 0)
+	var worktreeFiles []string // all of them, read once for the patterns
+	for _, spec := range pathspecs {
+		if spec.exclude {
+			continue
+		}
+		pathspec := spec.path
+		matchedTracked := false
+		for _, entry := range index.entries {
+			if entry.skipWorktree() && entry.path == pathspec {
+				sparsePaths = append(sparsePaths, pathspec)
+				matchedTracked = true
+			} else if spec.matches(entry.path) {
+				// tracked files are updated even when they match an ignore pattern
+				matchedTracked = true
+				addCandidate(entry.path)
+			}
+		}
+		if !spec.isPlain() {
+			matched := matchedTracked
+			if !options.update {
+				if worktreeFiles == nil {
+					worktreeFiles = repo.collectWorktreeFiles("", matcher)
+				}
+				for _, file := range worktreeFiles {
+					if spec.matches(file) {
+						matched = true
+						addCandidate(file)
+					}
+				}
+			}
+			if !matched {
+				log.Fatalf("fatal: pathspec '%s' did not match any files", spec.original)
+			}
+			continue
+		}
+		info, err := os.Lstat(repo.worktreePath(pathspec))
+		if os.IsNotExist(err) {
+			if !matchedTracked {
+				log.Fatalf("fatal: pathspec '%s' did not match any files", spec.original)
+			}
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if options.update {
+			// untracked files are left alone
+			continue
+		}
+		if info.IsDir() {
+			for _, file := range repo.collectWorktreeFiles(pathspec, matcher) {
+				addCandidate(file)
+			}
+		} else if matchedTracked {
+			continue
+		} else if matcher.isPathIgnored(pathspec, false) {
+			ignoredPaths = append(ignoredPaths, pathspec)
+		} else {
+			addCandidate(pathspec)
+		}
+	}
+	if len(ignoredPaths) > 0 {
+		fmt.Fprintln(os.Stderr, "The following paths are ignored by one of your .gitignore files:")
+		for _, ignoredPath := range ignoredPaths {
+			fmt.Fprintln(os.Stderr, ignoredPath)
+		}
+		repo.releaseIndex(index)
+		os.Exit(1)
+	}
+
+	invalid := false
+	for _, relativePath := range candidates {
+		if !repo.isValidIndexPath(relativePath) {
+			fmt.Fprintf(os.Stderr, "error: invalid path '%s'\n", relativePath)
+			fmt.Fprintf(os.Stderr, "error: unable to add '%s' to index\n", relativePath)
+			invalid = true
+		}
+	}
+	if invalid {
+		log.Fatal("fatal: adding files failed")
+	}
+
+	// entries the file-system monitor vouches for are not even stat'ed, as
+	// in status
+	useFsmonitor := repo.queryFsmonitor(index)
+	// hash in parallel, results keep the candidate order
+	updated := make([]*indexEntry, len(candidates))
+	removed := make([]bool, len(candidates))
+	warnings := make([]string, len(candidates))
+	runParallel(jobs, len(candidates), func(i int) {
+		relativePath := candidates[i]
+		position, tracked := index.find(relativePath)
+		if tracked && (index.entries[position].ignoresWorktree() || options.intentToAdd) {
+			// neither updated nor removed, whatever the worktree file is
+			return
+		}
+		if tracked && useFsmonitor && index.entries[position].stage() == 0 && index.entries[position].fsmonitorValid {
+			return
+		}
+		info, err := os.Lstat(repo.worktreePath(relativePath))
+		if os.IsNotExist(err) {
+			removed[i] = !options.ignoreRemoval
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tracked && index.entries[position].stage() == 0 && index.isUpToDate(index.entries[position], info) {
+			return
+		}
+		trackedMode := uint32(0)
+		if tracked {
+			trackedMode = index.entries[position].mode
+		}
+		mode := index.modes.entryMode(info, trackedMode)
+		if mode == fileModeGitlink {
+			// gitlinks are staged from the submodule's HEAD, which add does not manage
+			return
+		}
+		if options.intentToAdd {
+			updated[i] = &indexEntry{path: relativePath, hash: repo.writeObject("blob", nil), mode: mode, extendedFlags: indexExtendedIntentToAdd}
+			return
+		}
+		var hash string
+		if info.Mode().IsRegular() && repo.streamsFile(relativePath, info.Size()) {
+			// nothing to convert, and too big to read whole
+			hash = repo.writeBlobFile(repo.worktreePath(relativePath), info.Size())
+		} else {
+			content := readWorktreeContent(repo.worktreePath(relativePath), info)
+			if info.Mode()&os.ModeSymlink == 0 {
+				warnings[i] = repo.lineEndingWarning(relativePath, content)
+				content = repo.convertToGit(relativePath, content)
+			}
+			hash = repo.writeObject("blob", content)
+		}
+		entry := newIndexEntry(relativePath, hash, mode, info)
+		updated[i] = &entry
+	})
+
+	for i, relativePath := range candidates {
+		if warnings[i] != "" {
+			fmt.Fprintln(os.Stderr, warnings[i])
+		}
+		if removed[i] {
+			index.removePath(relativePath)
+		} else if updated[i] != nil {
+			index.addEntry(*updated[i])
+		}
+	}
+	repo.writeIndex(index)
+	if len(sparsePaths) > 0 {
+		fmt.Fprintln(os.Stderr, "The following paths and/or pathspecs matched paths that exist")
+		fmt.Fprintln(os.Stderr, "outside of your sparse-checkout definition, so will not be")
+		fmt.Fprintln(os.Stderr, "updated in the index:")
+		for _, sparsePath := range sparsePaths {
+			fmt.Fprintln(os.Stderr, sparsePath)
+		}
+		os.Exit(1)
+	}
+}
+
+// removePath drops every stage of path from the index
+func (index *gitIndex) removePath(relativePath string) {
+	index.invalidatePath(relativePath)
+	kept := index.entries[:0]
+	for _, entry := range index.entries {
+		if entry.path != relativePath {
+			kept = append(kept, entry)
+		}
+	}
+	index.entries = kept
+}
+
+// addEntry stages entry at stage 0, replacing any conflict stages for its
+// path and entries that clash with it as file versus directory
+func (index *gitIndex) addEntry(entry indexEntry) {
+	index.invalidatePath(entry.path)
+	kept := index.entries[:0]
+	for _, existing := range index.entries {
+		if existing.path == entry.path ||
+			strings.HasPrefix(existing.path, entry.path+"/") ||
+			strings.HasPrefix(entry.path, existing.path+"/") {
+			continue
+		}
+		kept = append(kept, existing)
+	}
+	index.entries = kept
+	position, _ := index.find(entry.path)
+	index.entries = append(index.entries, indexEntry{})
+	copy(index.entries[position+1:], index.entries[position:])
+	index.entries[position] = entry
+}
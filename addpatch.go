@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// patchMode is what add -p, checkout -p and reset -p differ in: the words
+// of their questions and whether the hunks picked are applied to the old
+// side of the changes or undone on the new side
+type patchMode struct {
+	verb    string // "Stage", "Unstage" or "Discard"
+	suffix  string // after what is asked about, as in "Discard this hunk from worktree"
+	help    string // the lines explaining y, n, q, a and d
+	marked  string // what a cleanly edited hunk is marked for
+	reverse bool
+}
+
+var (
+	addPatchMode = patchMode{
+		verb: "Stage",
+		help: "y - stage this hunk\n" +
+			"n - do not stage this hunk\n" +
+			"q - quit; do not stage this hunk or any of the remaining ones\n" +
+			"a - stage this hunk and all later hunks in the file\n" +
+			"d - do not stage this hunk or any of the later hunks in the file\n",
+		marked: "staging",
+	}
+	resetPatchMode = patchMode{
+		verb: "Unstage",
+		help: "y - unstage this hunk\n" +
+			"n - do not unstage this hunk\n" +
+			"q - quit; do not unstage this hunk or any of the remaining ones\n" +
+			"a - unstage this hunk and all later hunks in the file\n" +
+			"d - do not unstage this hunk or any of the later hunks in the file\n",
+		marked:  "unstaging",
+		reverse: true,
+	}
+	checkoutPatchMode = patchMode{
+		verb:   "Discard",
+		suffix: " from worktree",
+		help: "y - discard this hunk from worktree\n" +
+			"n - do not discard this hunk from worktree\n" +
+			"q - quit; do not discard this hunk or any of the remaining ones\n" +
+			"a - discard this hunk and all later hunks in the file\n" +
+			"d - do not discard this hunk or any of the later hunks in the file\n",
+		marked:  "discarding",
+		reverse: true,
+	}
+	stashPatchMode = patchMode{
+		verb: "Stash",
+		help: "y - stash this hunk\n" +
+			"n - do not stash this hunk\n" +
+			"q - quit; do not stash this hunk or any of the remaining ones\n" +
+			"a - stash this hunk and all later hunks in the file\n" +
+			"d - do not stash this hunk or any of the later hunks in the file\n",
+		marked: "stashing",
+	}
+)
+
+// patchHelp explains the other answers; only the lines of the answers a
+// question offers are shown
+const patchHelp = "j - leave this hunk undecided, see next undecided hunk\n" +
+	"J - leave this hunk undecided, see next hunk\n" +
+	"k - leave this hunk undecided, see previous undecided hunk\n" +
+	"K - leave this hunk undecided, see previous hunk\n" +
+	"g - select a hunk to go to\n" +
+	"/ - search for a hunk matching the given regex\n" +
+	"s - split the current hunk into smaller hunks\n" +
+	"e - manually edit the current hunk\n" +
+	"? - print help\n"
+
+// interactiveHunk is one piece of a change the user decides on: a hunk of the
+// content diff, or the mode change, deletion or addition of the file
+type interactiveHunk struct {
+	subject  string // "this hunk", "mode change", "deletion" or "addition"
+	hunk     diffHunk
+	oldIndex int  // where the hunk starts in the old lines, 0-based
+	newIndex int  // and in the new ones
+	use      byte // 'y' or 'n' once decided
+}
+
+// patchResult is a side of a change after picking its hunks, mode 0 for
+// a file that is gone
+type patchResult struct {
+	mode    uint32
+	content []byte
+}
+
+// patchSession reads the answers and writes the questions of one run of
+// patch mode
+type patchSession struct {
+	repo    *Repository
+	mode    patchMode
+	options diffOptions
+	answers *bufio.Reader
+	w       io.Writer
+	color   bool // color the prompts, help and errors
+}
+
+// addPatch stages the hunks of the worktree changes of tracked files the
+// user picks
+func (repo *Repository) addPatch(pathspecs []pathspec) {
+	index := repo.lockIndex()
+	changes := repo.patchChanges(repo.worktreeChanges(index), pathspecs)
+	repo.runPatchMode(addPatchMode, changes, func(change fileChange, result patchResult) {
+		if result.mode == 0 {
+			index.removePath(change.path)
+			return
+		}
+		hash := repo.writeObject("blob", result.content)
+		entry := indexEntry{path: change.path, hash: hash, mode: result.mode}
+		if hash == change.newHash && result.mode == change.newMode {
+			// the whole worktree file, so its stat data can be kept
+			if info, err := os.Lstat(repo.worktreePath(change.path)); err == nil {
+				entry.fillStat(info)
+			}
+		}
+		index.addEntry(entry)
+	})
+	repo.writeIndex(index)
+}
+
+// resetPatch unstages the hunks of the staged changes the user picks,
+// taking them back to HEAD
+func (repo *Repository) resetPatch(pathspecs []pathspec) {
+	index := repo.lockIndex()
+	changes := repo.patchChanges(repo.indexChangesSince(repo.headTree(), index), pathspecs)
+	repo.runPatchMode(resetPatchMode, changes, func(change fileChange, result patchResult) {
+		if result.mode == 0 {
+			index.removePath(change.path)
+			return
+		}
+		index.addEntry(indexEntry{path: change.path, hash: repo.writeObject("blob", result.content), mode: result.mode})
+	})
+	repo.writeIndex(index)
+}
+
+// checkoutPatch discards the hunks of the worktree changes the user picks,
+// taking the files back to the index
+func (repo *Repository) checkoutPatch(pathspecs []pathspec) {
+	index := repo.lockIndex()
+	changes := repo.patchChanges(repo.worktreeChanges(index), pathspecs)
+	repo.runPatchMode(checkoutPatchMode, changes, func(change fileChange, result patchResult) {
+		repo.replaceWorktreeFile(change.path, result.mode, result.content)
+		position, _ := index.find(change.path)
+		entry := &index.entries[position]
+		if info, err := os.Lstat(repo.worktreePath(change.path)); err == nil && entry.mode == result.mode && entry.hash == hashObject("blob", result.content) {
+			// back to what the index has
+			entry.fillStat(info)
+		}
+	})
+	repo.writeIndex(index)
+}
+
+// patchChanges keeps the changes under the pathspecs patch mode can split
+// into hunks, leaving out submodules
+func (repo *Repository) patchChanges(changes []fileChange, pathspecs []pathspec) []fileChange {
+	selected := make([]fileChange, 0, len(changes))
+	for _, change := range changes {
+		if matchesPathspecs(change.path, pathspecs) && change.oldMode != fileModeGitlink && change.newMode != fileModeGitlink {
+			selected = append(selected, change)
+		}
+	}
+	return selected
+}
+
+// replaceWorktreeFile replaces the worktree file at a path, removing it for
+// mode 0
+func (repo *Repository) replaceWorktreeFile(relativePath string, mode uint32, content []byte) {
+	filePath := repo.worktreePath(relativePath)
+	if mode == 0 {
+		repo.removeWorktreeFile(relativePath)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.RemoveAll(filePath); err != nil {
+		log.Fatal(err)
+	}
+	repo.createWorktreeFile(relativePath, mode, content)
+}
+
+// runPatchMode asks about the hunks of each change in turn and hands the
+// side the answers make to apply, for the changes where any hunk was
+// picked. Like git, binary files are left out.
+func (repo *Repository) runPatchMode(mode patchMode, changes []fileChange, apply func(fileChange, patchResult)) {
+	session := &patchSession{
+		repo:    repo,
+		mode:    mode,
+		options: diffOptions{context: 3, colors: repo.diffColors(repo.useColor("diff"))},
+		answers: bufio.NewReader(os.Stdin),
+		w:       os.Stdout,
+		color:   repo.useColor("interactive"),
+	}
+	binaries, asked := 0, 0
+	for _, change := range changes {
+		oldContent, newContent := repo.changeContents(change)
+		if repo.isBinaryDiff(change.path, oldContent, newContent) {
+			binaries++
+			continue
+		}
+		asked++
+		result, picked, quit := session.askFile(change, oldContent, newContent)
+		if picked {
+			apply(change, result)
+		}
+		if quit {
+			return
+		}
+	}
+	if asked == 0 {
+		if binaries > 0 {
+			fmt.Fprintln(os.Stderr, "Only binary files changed.")
+		} else {
+			fmt.Fprintln(os.Stderr, "No changes.")
+		}
+	}
+}
+
+// fileHunks cuts a change into what is asked about one by one
+func (session *patchSession) fileHunks(change fileChange, oldLines []string, newLines []string) []interactiveHunk {
+	if change.oldMode == 0 || change.newMode == 0 {
+		subject := "addition"
+		if change.newMode == 0 {
+			subject = "deletion"
+		}
+		whole := interactiveHunk{subject: subject}
+		if hunks := diffLines(oldLines, newLines).hunks(session.options.context); len(hunks) > 0 {
+			whole.hunk = hunks[0]
+		}
+		return []interactiveHunk{whole}
+	}
+	hunks := make([]interactiveHunk, 0)
+	if change.oldMode != change.newMode {
+		hunks = append(hunks, interactiveHunk{subject: "mode change"})
+	}
+	for _, hunk := range diffLines(oldLines, newLines).hunks(session.options.context) {
+		hunks = append(hunks, newInteractiveHunk(hunk))
+	}
+	return hunks
+}
+
+func newInteractiveHunk(hunk diffHunk) interactiveHunk {
+	piece := interactiveHunk{subject: "this hunk", hunk: hunk, oldIndex: hunk.oldStart, newIndex: hunk.newStart}
+	if hunk.oldCount > 0 {
+		piece.oldIndex--
+	}
+	if hunk.newCount > 0 {
+		piece.newIndex--
+	}
+	return piece
+}
+
+// askFile shows the header of a change and goes through its hunks the
+// way git does, moving on to the next undecided hunk after an answer and
+// starting over from the first one until all are decided. It returns the
+// side made of the picked hunks, whether any was picked and whether the
+// user quit.
+func (session *patchSession) askFile(change fileChange, oldContent []byte, newContent []byte) (patchResult, bool, bool) {
+	w := session.w
+	oldLines, newLines := splitLines(oldContent), splitLines(newContent)
+	hunks := session.fileHunks(change, oldLines, newLines)
+	session.writeHeader(change)
+	quit := false
+	current := 0
+	for {
+		if current >= len(hunks) {
+			current = 0
+		}
+		hunk := &hunks[current]
+		previousUndecided, nextUndecided := -1, -1
+		for i := current - 1; i >= 0 && previousUndecided == -1; i-- {
+			if hunks[i].use == 0 {
+				previousUndecided = i
+			}
+		}
+		for i := current + 1; i < len(hunks) && nextUndecided == -1; i++ {
+			if hunks[i].use == 0 {
+				nextUndecided = i
+			}
+		}
+		if previousUndecided == -1 && nextUndecided == -1 && hunk.use != 0 {
+			break
+		}
+		writeInteractiveHunk(w, change, *hunk, session.options)
+		choices := "y,n,q,a,d"
+		if previousUndecided != -1 {
+			choices += ",k"
+		}
+		if current > 0 {
+			choices += ",K"
+		}
+		if nextUndecided != -1 {
+			choices += ",j"
+		}
+		if current+1 < len(hunks) {
+			choices += ",J"
+		}
+		if len(hunks) > 1 {
+			choices += ",g,/"
+		}
+		pieces := splitInteractiveHunk(*hunk)
+		if len(pieces) > 1 {
+			choices += ",s"
+		}
+		if hunk.subject == "this hunk" {
+			choices += ",e"
+		}
+		choices += ",?"
+		fmt.Fprint(w, colorize(session.color, "\033[1;34m", fmt.Sprintf("(%d/%d) %s %s%s [%s]? ", current+1, len(hunks), session.mode.verb, hunk.subject, session.mode.suffix, choices)))
+		answer, ok := session.readAnswer()
+		if !ok {
+			break
+		}
+		if answer == "" {
+			continue
+		}
+		switch answer[0] {
+		case 'y', 'n':
+			hunk.use = answer[0]
+			current = len(hunks)
+			if nextUndecided != -1 {
+				current = nextUndecided
+			}
+		case 'a', 'd', 'q':
+			use := byte('y')
+			if answer[0] != 'a' {
+				use = 'n'
+			}
+			for ; current < len(hunks); current++ {
+				if hunks[current].use == 0 {
+					hunks[current].use = use
+				}
+			}
+			quit = answer[0] == 'q'
+		case 'j', 'J':
+			switch {
+			case answer[0] == 'j' && nextUndecided != -1:
+				current = nextUndecided
+			case answer[0] == 'J' && current+1 < len(hunks):
+				current++
+			default:
+				session.error("No next hunk")
+			}
+		case 'k', 'K':
+			switch {
+			case answer[0] == 'k' && previousUndecided != -1:
+				current = previousUndecided
+			case answer[0] == 'K' && current > 0:
+				current--
+			default:
+				session.error("No previous hunk")
+			}
+		case 'g':
+			if len(hunks) < 2 {
+				session.error("No other hunks to goto")
+				break
+			}
+			if target, ok := session.askHunkNumber(hunks, current, strings.TrimSpace(answer[1:])); ok {
+				current = target
+			}
+		case '/':
+			if len(hunks) < 2 {
+				session.error("No other hunks to search")
+				break
+			}
+			current = session.searchHunks(change, hunks, current, answer[1:])
+		case 's':
+			if len(pieces) < 2 {
+				session.error("Sorry, cannot split this hunk")
+				break
+			}
+			fmt.Fprintf(w, "Split into %d hunks.\n", len(pieces))
+			hunks = append(hunks[:current], append(pieces, hunks[current+1:]...)...)
+		case 'e':
+			if hunk.subject != "this hunk" {
+				session.error("Sorry, cannot edit this hunk")
+				break
+			}
+			if session.editHunk(hunk, oldLines, newLines) {
+				hunk.use = 'y'
+				current = len(hunks)
+				if nextUndecided != -1 {
+					current = nextUndecided
+				}
+			}
+		default:
+			session.writeHelp(choices)
+		}
+		if quit {
+			break
+		}
+	}
+	fmt.Fprintln(w)
+	result, picked := pickHunks(change, hunks, oldContent, newContent, oldLines, newLines, session.mode.reverse)
+	return result, picked, quit
+}
+
+// pickHunks makes the new side out of the old one and the picked hunks,
+// or in reverse the old side out of the new one by undoing them
+func pickHunks(change fileChange, hunks []interactiveHunk, oldContent []byte, newContent []byte, oldLines []string, newLines []string, reverse bool) (patchResult, bool) {
+	base, other := patchResult{change.oldMode, oldContent}, patchResult{change.newMode, newContent}
+	baseLines := oldLines
+	if reverse {
+		base, other, baseLines = other, base, newLines
+	}
+	picked := make([]interactiveHunk, 0, len(hunks))
+	anyPicked := false
+	for _, hunk := range hunks {
+		if hunk.use != 'y' {
+			continue
+		}
+		anyPicked = true
+		switch hunk.subject {
+		case "addition", "deletion":
+			return other, true
+		case "mode change":
+			base.mode = other.mode
+		default:
+			picked = append(picked, hunk)
+		}
+	}
+	if !anyPicked {
+		return base, false
+	}
+	if len(picked) > 0 {
+		lines, ok := applyInteractiveHunks(baseLines, picked, reverse)
+		if !ok {
+			// edited hunks may no longer fit their neighbours
+			fmt.Fprintf(os.Stderr, "error: the hunks picked for %s do not apply\n", change.path)
+			return base, false
+		}
+		base.content = []byte(strings.Join(lines, ""))
+	}
+	return base, true
+}
+
+// applyInteractiveHunks applies hunks, in order, to the lines they were made
+// against: the old lines, or in reverse the new ones. The pieces of a split
+// hunk share their context with their neighbours, which is only taken once.
+// It fails when the hunks do not match the lines.
+func applyInteractiveHunks(base []string, hunks []interactiveHunk, reverse bool) ([]string, bool) {
+	result := make([]string, 0, len(base))
+	position := 0
+	for _, hunk := range hunks {
+		start, lines := hunk.oldIndex, hunk.hunk.lines
+		if reverse {
+			start = hunk.newIndex
+		}
+		for start < position && len(lines) > 0 && lines[0].op == ' ' {
+			start, lines = start+1, lines[1:]
+		}
+		if start < position || start > len(base) {
+			return nil, false
+		}
+		result = append(result, base[position:start]...)
+		position = start
+		for _, line := range lines {
+			op := line.op
+			if reverse && op != ' ' {
+				op = '+' + '-' - op
+			}
+			if op == '+' {
+				result = append(result, line.text)
+				continue
+			}
+			if position >= len(base) || base[position] != line.text {
+				return nil, false
+			}
+			if op == ' ' {
+				result = append(result, line.text)
+			}
+			position++
+		}
+	}
+	return append(result, base[position:]...), true
+}
+
+// splitInteractiveHunk cuts a hunk at the context between its changes. As in
+// git, every piece keeps all of the context before and after its change,
+// so that neighbours share it; only the first keeps the function name.
+func splitInteractiveHunk(hunk interactiveHunk) []interactiveHunk {
+	lines := hunk.hunk.lines
+	pieces := make([]interactiveHunk, 0)
+	oldIndex, newIndex := hunk.oldIndex, hunk.newIndex
+	start := 0
+	for start < len(lines) {
+		// the context before the change, the change and the context after
+		changeStart := start
+		for changeStart < len(lines) && lines[changeStart].op == ' ' {
+			changeStart++
+		}
+		if changeStart == len(lines) {
+			break
+		}
+		changeEnd := changeStart
+		for changeEnd < len(lines) && lines[changeEnd].op != ' ' {
+			changeEnd++
+		}
+		end := changeEnd
+		for end < len(lines) && lines[end].op == ' ' {
+			end++
+		}
+		piece := interactiveHunk{subject: hunk.subject, oldIndex: oldIndex, newIndex: newIndex}
+		piece.hunk.lines = lines[start:end]
+		for _, line := range lines[start:changeEnd] {
+			if line.op != '+' {
+				oldIndex++
+			}
+			if line.op != '-' {
+				newIndex++
+			}
+		}
+		piece.hunk = countedHunk(piece.hunk.lines, piece.oldIndex, piece.newIndex)
+		if len(pieces) == 0 {
+			piece.hunk.function = hunk.hunk.function
+		}
+		pieces = append(pieces, piece)
+		start = changeEnd
+	}
+	return pieces
+}
+
+// countedHunk makes the header of a hunk from its lines and where it
+// starts
+func countedHunk(lines []diffLine, oldIndex int, newIndex int) diffHunk {
+	hunk := diffHunk{oldStart: oldIndex, newStart: newIndex, lines: lines}
+	for _, line := range lines {
+		if line.op != '+' {
+			hunk.oldCount++
+		}
+		if line.op != '-' {
+			hunk.newCount++
+		}
+	}
+	if hunk.oldCount > 0 {
+		hunk.oldStart++
+	}
+	if hunk.newCount > 0 {
+		hunk.newStart++
+	}
+	return hunk
+}
+
+// writeHeader shows the start of a change as git's patch mode does, the
+// mode change being left for its own question
+func (session *patchSession) writeHeader(change fileChange) {
+	colors := session.options.colors
+	meta := func(format string, arguments ...interface{}) {
+		fmt.Fprintf(session.w, "%s%s%s\n", colors.meta, fmt.Sprintf(format, arguments...), colors.reset)
+	}
+	oldName, newName := quotePath("a/"+change.path), quotePath("b/"+change.path)
+	meta("diff --git %s %s", oldName, newName)
+	switch {
+	case change.oldMode == 0:
+		meta("new file mode %06o", change.newMode)
+		oldName = "/dev/null"
+	case change.newMode == 0:
+		meta("deleted file mode %06o", change.oldMode)
+		newName = "/dev/null"
+	}
+	if change.oldHash == change.newHash {
+		return
+	}
+	if change.oldMode != 0 && change.oldMode == change.newMode {
+		meta("index %s..%s %06o", abbreviateHash(change.oldHash), abbreviateHash(change.newHash), change.oldMode)
+	} else {
+		meta("index %s..%s", abbreviateHash(change.oldHash), abbreviateHash(change.newHash))
+	}
+	meta("--- %s%s", oldName, nameTerminator(oldName))
+	meta("+++ %s%s", newName, nameTerminator(newName))
+}
+
+func writeInteractiveHunk(w io.Writer, change fileChange, hunk interactiveHunk, options diffOptions) {
+	if hunk.subject == "mode change" {
+		fmt.Fprintf(w, "%sold mode %06o%s\n", options.colors.meta, change.oldMode, options.colors.reset)
+		fmt.Fprintf(w, "%snew mode %06o%s\n", options.colors.meta, change.newMode, options.colors.reset)
+		return
+	}
+	if len(hunk.hunk.lines) == 0 {
+		return
+	}
+	options.writeHunkHeader(w, hunk.hunk)
+	writeHunkLines(w, hunk.hunk.lines, options)
+}
+
+// askHunkNumber reads the number of the hunk to go to, listing the hunks
+// twenty at a time around the current one while none is given
+func (session *patchSession) askHunkNumber(hunks []interactiveHunk, current int, answer string) (int, bool) {
+	first := 0
+	if hunks[0].subject == "mode change" {
+		first = 1
+	}
+	next := max(current-10, first)
+	for answer == "" {
+		for end := min(next+20, len(hunks)); next < end; next++ {
+			session.writeHunkSummary(hunks[next], next+1)
+		}
+		if next < len(hunks) {
+			fmt.Fprint(session.w, "go to which hunk (<ret> to see more)? ")
+		} else {
+			fmt.Fprint(session.w, "go to which hunk? ")
+		}
+		line, ok := session.readAnswer()
+		if !ok {
+			break
+		}
+		answer = line
+	}
+	number, err := strconv.Atoi(answer)
+	switch {
+	case err != nil || answer[0] == '+' || answer[0] == '-':
+		session.error(fmt.Sprintf("Invalid number: '%s'", answer))
+	case number < 1 || number > len(hunks):
+		session.error(fmt.Sprintf("Sorry, only %d hunks available.", len(hunks)))
+	default:
+		return number - 1, true
+	}
+	return current, false
+}
+
+// writeHunkSummary lists a hunk for g by its number, its ranges and its
+// first changed line, marked with the answer given for it
+func (session *patchSession) writeHunkSummary(hunk interactiveHunk, number int) {
+	mark := ' '
+	switch hunk.use {
+	case 'y':
+		mark = '+'
+	case 'n':
+		mark = '-'
+	}
+	ranges := fmt.Sprintf(" -%d,%d +%d,%d ", hunk.hunk.oldStart, hunk.hunk.oldCount, hunk.hunk.newStart, hunk.hunk.newCount)
+	first := "\n"
+	for _, line := range hunk.hunk.lines {
+		if line.op != ' ' {
+			first = string(line.op) + line.text
+			if !strings.HasSuffix(first, "\n") {
+				first += "\n"
+			}
+			break
+		}
+	}
+	fmt.Fprintf(session.w, "%c%2d: %-20s%s", mark, number, ranges, first)
+}
+
+// searchHunks finds the first hunk from the current one on, starting over
+// at the first, whose plain text matches a regular expression read after
+// the / or asked for
+func (session *patchSession) searchHunks(change fileChange, hunks []interactiveHunk, current int, pattern string) int {
+	if pattern == "" {
+		fmt.Fprint(session.w, "search for regex? ")
+		line, ok := session.readAnswer()
+		if !ok || line == "" {
+			return current
+		}
+		pattern = line
+	}
+	expression, err := regexp.Compile("(?m)" + pattern)
+	if err != nil {
+		session.error(fmt.Sprintf("Malformed search regexp %s: %s", pattern, strings.TrimPrefix(err.Error(), "error parsing regexp: ")))
+		return current
+	}
+	for i := current; ; {
+		var plain strings.Builder
+		writeInteractiveHunk(&plain, change, hunks[i], diffOptions{context: session.options.context})
+		if expression.MatchString(plain.String()) {
+			return i
+		}
+		if i = (i + 1) % len(hunks); i == current {
+			session.error("No hunk matches the given pattern")
+			return current
+		}
+	}
+}
+
+// writeHunkLines writes the lines of a hunk, marking those without a
+// newline
+func writeHunkLines(w io.Writer, lines []diffLine, options diffOptions) {
+	for _, line := range lines {
+		options.writeDiffLine(w, line, false)
+		if !strings.HasSuffix(line.text, "\n") {
+			fmt.Fprintf(w, "\n%s\\ No newline at end of file%s\n", options.colors.context, options.colors.reset)
+		}
+	}
+}
+
+func (session *patchSession) writeHelp(choices string) {
+	help := session.mode.help
+	for _, line := range strings.SplitAfter(patchHelp, "\n") {
+		if line != "" && (line[0] == '?' || strings.Contains(choices, line[:1])) {
+			help += line
+		}
+	}
+	fmt.Fprint(os.Stderr, colorize(session.color, colorBoldRed, help))
+}
+
+func (session *patchSession) error(message string) {
+	fmt.Fprintln(os.Stderr, colorize(session.color, colorBoldRed, message))
+}
+
+// readAnswer reads a line from the user, ok being false at the end of the
+// input
+func (session *patchSession) readAnswer() (string, bool) {
+	answer, err := session.answers.ReadString('\n')
+	if err != nil && answer == "" {
+		return "", false
+	}
+	return strings.TrimSpace(answer), true
+}
+
+// editHunk lets the user edit a hunk in .git/ADD_EDIT.patch, asking to
+// edit again while the result does not apply. It tells whether the hunk
+// was replaced; removing all of its lines leaves it as it was.
+func (session *patchSession) editHunk(hunk *interactiveHunk, oldLines []string, newLines []string) bool {
+	repo := session.repo
+	editPath := filepath.Join(repo.gitDir, "ADD_EDIT.patch")
+	defer os.Remove(editPath)
+	removed, added := "-", "+"
+	if session.mode.reverse {
+		removed, added = added, removed
+	}
+	edited := *hunk
+	for {
+		var text strings.Builder
+		text.WriteString("# Manual hunk edit mode -- see bottom for a quick guide.\n")
+		text.WriteString(edited.hunk.header() + "\n")
+		for _, line := range edited.hunk.lines {
+			fmt.Fprintf(&text, "%c%s", line.op, line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				text.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		fmt.Fprintf(&text, "# ---\n"+
+			"# To remove '%s' lines, make them ' ' lines (context).\n"+
+			"# To remove '%s' lines, delete them.\n"+
+			"# Lines starting with # will be removed.\n"+
+			"# If the patch applies cleanly, the edited hunk will immediately be marked for %s.\n"+
+			"# If it does not apply cleanly, you will be given an opportunity to\n"+
+			"# edit again.  If all lines of the hunk are removed, then the edit is\n"+
+			"# aborted and the hunk is left unchanged.\n", removed, added, session.mode.marked)
+		if err := os.WriteFile(editPath, []byte(text.String()), 0666); err != nil {
+			log.Fatal(err)
+		}
+		if err := repo.launchEditor(editPath); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return false
+		}
+		content, err := os.ReadFile(editPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lines := parseEditedHunk(string(content))
+		if len(lines) == 0 {
+			return false
+		}
+		edited.hunk = countedHunk(lines, hunk.oldIndex, hunk.newIndex)
+		edited.hunk.function = hunk.hunk.function
+		base := oldLines
+		if session.mode.reverse {
+			base = newLines
+		}
+		if _, ok := applyInteractiveHunks(base, []interactiveHunk{edited}, session.mode.reverse); ok {
+			*hunk = edited
+			return true
+		}
+		fmt.Fprint(session.w, colorize(session.color, "\033[1;34m", `Your edited hunk does not apply. Edit again (saying "no" discards!) [y/n]? `))
+		answer, ok := session.readAnswer()
+		if !ok || answer == "" || answer[0] != 'y' {
+			return false
+		}
+	}
+}
+
+// parseEditedHunk reads the lines of an edited hunk, dropping comments and
+// the header; an empty line is taken for an empty context line
+func parseEditedHunk(content string) []diffLine {
+	lines := make([]diffLine, 0)
+	for _, line := range strings.SplitAfter(content, "\n") {
+		switch {
+		case line == "", line[0] == '#', strings.HasPrefix(line, "@@"):
+		case line[0] == '\\':
+			if len(lines) > 0 {
+				last := &lines[len(lines)-1]
+				last.text = strings.TrimSuffix(last.text, "\n")
+			}
+		case line[0] == ' ' || line[0] == '-' || line[0] == '+':
+			lines = append(lines, diffLine{line[0], line[1:]})
+		case line == "\n":
+			lines = append(lines, diffLine{' ', line})
+		}
+	}
+	return lines
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// expandAlias replaces an alias.<name> command with its definition until
+// a builtin command is reached. Aliases starting with "!" run through the
+// shell from the top of the worktree and exit with its status.
+func expandAlias(gitDir string, args []string) []string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if gitDir == "" {
+		gitDir, _ = discoverGitDir(cwd)
+	}
+	config := loadConfig(gitDir)
+	seen := make(map[string]bool)
+	for {
+		if _, ok := findCommand(args[0]); ok {
+			return args
+		}
+		name := args[0]
+		value, ok := config.get("alias." + name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: '%s' is not a %s command. See '%s --help'.\n", programName(), name, programName(), programName())
+			os.Exit(1)
+		}
+		if seen[name] {
+			log.Fatalf("fatal: alias loop detected: expansion of '%s' does not terminate", name)
+		}
+		seen[name] = true
+		if strings.HasPrefix(value, "!") {
+			runShellAlias(gitDir, cwd, value[1:], args[1:])
+		}
+		expansion, ok := splitCommandLine(value)
+		if !ok {
+			log.Fatalf("fatal: bad alias.%s string: unclosed quote", name)
+		}
+		if len(expansion) == 0 {
+			log.Fatalf("fatal: empty alias for %s", name)
+		}
+		trace("alias expansion: %s => %s", name, quoteCommandLine(expansion))
+		args = append(expansion, args[1:]...)
+	}
+}
+
+func runShellAlias(gitDir string, cwd string, script string, args []string) {
+	// like git, arguments are appended to the script through "$@"
+	if len(args) > 0 {
+		script += ` "$@"`
+	}
+	argv := append([]string{"sh", "-c", script, script}, args...)
+	traceRunCommand(argv)
+	shell := exec.Command(argv[0], argv[1:]...)
+	shell.Stdin, shell.Stdout, shell.Stderr = os.Stdin, os.Stdout, os.Stderr
+	shell.Env = os.Environ()
+	if gitDir != "" && filepath.Base(gitDir) == ".git" {
+		workTree := filepath.Dir(gitDir)
+		shell.Dir = workTree
+		if prefix, err := filepath.Rel(workTree, cwd); err == nil && prefix != "." {
+			shell.Env = append(shell.Env, "GIT_PREFIX="+filepath.ToSlash(prefix)+"/")
+		} else {
+			shell.Env = append(shell.Env, "GIT_PREFIX=")
+		}
+	}
+	if err := shell.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+// splitCommandLine splits an alias definition into words, honoring single
+// and double quotes and backslash escapes; ok is false for an unclosed quote
+func splitCommandLine(line string) ([]string, bool) {
+	words := make([]string, 0)
+	var word strings.Builder
+	inWord := false
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(line):
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, false
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxAlternateDepth is how deep alternates of alternates are followed,
+// the same limit git uses
+const maxAlternateDepth = 5
+
+// objectDirectories returns the repository's own object directory followed
+// by every alternate object directory, so lookups fall back in that order
+func (repo *Repository) objectDirectories() []string {
+	repo.alternatesOnce.Do(repo.loadAlternates)
+	return repo.objectDirs
+}
+
+func (repo *Repository) loadAlternates() {
+	primary := filepath.Join(repo.gitDir, "objects")
+	repo.objectDirs = []string{primary}
+	seen := map[string]bool{primary: true}
+	var add func(dir string, depth int)
+	add = func(dir string, depth int) {
+		dir = filepath.Clean(dir)
+		if seen[dir] {
+			return
+		}
+		if depth > maxAlternateDepth {
+			fmt.Fprintf(os.Stderr, "error: %s: ignoring alternate object stores, nesting too deep\n", dir)
+			return
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "error: object directory %s does not exist; check .git/objects/info/alternates\n", dir)
+			return
+		}
+		seen[dir] = true
+		repo.objectDirs = append(repo.objectDirs, dir)
+		for _, alternate := range readAlternatesFile(dir) {
+			add(alternate, depth+1)
+		}
+	}
+	// GIT_ALTERNATE_OBJECT_DIRECTORIES uses the PATH list separator and
+	// is relative to the current directory
+	for _, dir := range filepath.SplitList(os.Getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES")) {
+		if dir != "" {
+			add(dir, 1)
+		}
+	}
+	for _, alternate := range readAlternatesFile(primary) {
+		add(alternate, 1)
+	}
+}
+
+// readAlternatesFile reads objects/info/alternates of an object directory:
+// one directory per line, relative ones are relative to objectDir
+func readAlternatesFile(objectDir string) []string {
+	content, err := os.ReadFile(filepath.Join(objectDir, "info", "alternates"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	dirs := make([]string, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objectDir, line)
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs
+}
+
+// looseObjectPath finds the file of a loose object in the object
+// directories, ok is false when none of them has it
+func (repo *Repository) looseObjectPath(hash string) (string, bool) {
+	for _, dir := range repo.objectDirectories() {
+		path := filepath.Join(dir, hash[0:2], hash[2:])
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
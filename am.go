@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mailPatch is one message of a mailbox split into the parts am uses
+type mailPatch struct {
+	author  identity
+	subject string
+	message string // commit message: the subject and the text before "---"
+	patch   string // everything from the first "diff --git" line on
+}
+
+// mboxSeparator matches the "From <sha> Mon Sep 17 00:00:00 2001" line
+// format-patch starts every message with, and the "From <address> <date>"
+// lines of other mbox writers
+var mboxSeparator = regexp.MustCompile(`^From \S+ +\S+ \S+ +\d+ \d+:\d+:\d+ \d{4}`)
+
+// splitMailbox cuts an mbox into messages; content without a separator is
+// taken as a single message
+func splitMailbox(content string) []string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	messages := make([]string, 0)
+	var current strings.Builder
+	for _, line := range splitLines([]byte(content)) {
+		if mboxSeparator.MatchString(line) {
+			if strings.TrimSpace(current.String()) != "" {
+				messages = append(messages, current.String())
+			}
+			current.Reset()
+			continue
+		}
+		current.WriteString(line)
+	}
+	if strings.TrimSpace(current.String()) != "" {
+		messages = append(messages, current.String())
+	}
+	return messages
+}
+
+// encodedWord matches RFC 2047 "=?charset?q|b?text?=" words
+var encodedWord = regexp.MustCompile(`=\?([^?]+)\?([qQbB])\?([^?]*)\?=`)
+
+var encodedWordGap = regexp.MustCompile(`\?=\s+=\?`)
+
+// decodeMailHeader undoes RFC 2047 encoding; whitespace between two
+// encoded words is dropped
+func decodeMailHeader(value string) string {
+	value = encodedWordGap.ReplaceAllString(value, "?==?")
+	return encodedWord.ReplaceAllStringFunc(value, func(word string) string {
+		parts := encodedWord.FindStringSubmatch(word)
+		if strings.EqualFold(parts[2], "b") {
+			decoded, err := base64.StdEncoding.DecodeString(parts[3])
+			if err != nil {
+				return word
+			}
+			return string(decoded)
+		}
+		var decoded bytes.Buffer
+		text := parts[3]
+		for i := 0; i < len(text); i++ {
+			switch {
+			case text[i] == '_':
+				decoded.WriteByte(' ')
+			case text[i] == '=' && i+2 < len(text):
+				if value, err := strconv.ParseUint(text[i+1:i+3], 16, 8); err == nil {
+					decoded.WriteByte(byte(value))
+					i += 2
+					continue
+				}
+				decoded.WriteByte('=')
+			default:
+				decoded.WriteByte(text[i])
+			}
+		}
+		return decoded.String()
+	})
+}
+
+// cleanPatchSubject drops the "Re:" and "[PATCH ...]" prefixes of a mail
+// subject
+func cleanPatchSubject(subject string) string {
+	for {
+		subject = strings.TrimSpace(subject)
+		switch {
+		case len(subject) >= 3 && strings.EqualFold(subject[:3], "re:"):
+			subject = subject[3:]
+		case strings.HasPrefix(subject, "["):
+			end := strings.IndexByte(subject, ']')
+			if end == -1 {
+				return subject
+			}
+			subject = subject[end+1:]
+		default:
+			return subject
+		}
+	}
+}
+
+// parseMailAddress reads "Name <email>", with the name possibly quoted
+func parseMailAddress(value string) identity {
+	var person identity
+	start, end := strings.LastIndex(value, "<"), strings.LastIndex(value, ">")
+	if start == -1 || end < start {
+		person.email = strings.TrimSpace(value)
+		person.name = person.email
+		return person
+	}
+	person.email = value[start+1 : end]
+	person.name = strings.Trim(strings.TrimSpace(value[:start]), "\"")
+	if person.name == "" {
+		person.name = person.email
+	}
+	return person
+}
+
+var mailDateFormats = []string{mailDateFormat, "Mon, 2 Jan 2006 15:04:05 -0700 (MST)", "2 Jan 2006 15:04:05 -0700", time.RFC1123Z}
+
+// parseMail splits a message into headers, commit message and patch
+func parseMail(message string) (mailPatch, error) {
+	var mail mailPatch
+	headerText, body, _ := strings.Cut(message, "\n\n")
+	headers := make(map[string]string)
+	var lastHeader string
+	for _, line := range strings.Split(headerText, "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && lastHeader != "" {
+			headers[lastHeader] += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		lastHeader = strings.ToLower(name)
+		headers[lastHeader] = strings.TrimSpace(value)
+	}
+	from, ok := headers["from"]
+	if !ok {
+		return mail, fmt.Errorf("missing author line")
+	}
+	mail.author = parseMailAddress(decodeMailHeader(from))
+	mail.author.when = time.Now()
+	for _, format := range mailDateFormats {
+		if when, err := time.Parse(format, headers["date"]); err == nil {
+			mail.author.when = when
+			break
+		}
+	}
+	mail.subject = cleanPatchSubject(decodeMailHeader(headers["subject"]))
+
+	description := body
+	if start := strings.Index(body, "diff --git "); start != -1 && (start == 0 || body[start-1] == '\n') {
+		description, mail.patch = body[:start], body[start:]
+	}
+	// the commit message ends at the "---" line above the diffstat
+	lines := strings.Split(description, "\n")
+	for i, line := range lines {
+		if line == "---" || strings.HasPrefix(line, "--- ") {
+			lines = lines[:i]
+			break
+		}
+	}
+	mail.message = cleanupMessage(mail.subject + "\n\n" + strings.Join(lines, "\n"))
+	return mail, nil
+}
+
+// cleanupMessage strips trailing whitespace, collapses blank lines and
+// ends the message with a single newline, as "git stripspace" does
+func cleanupMessage(message string) string {
+	lines := strings.Split(message, "\n")
+	cleaned := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" && (len(cleaned) == 0 || cleaned[len(cleaned)-1] == "") {
+			continue
+		}
+		cleaned = append(cleaned, line)
+	}
+	for len(cleaned) > 0 && cleaned[len(cleaned)-1] == "" {
+		cleaned = cleaned[:len(cleaned)-1]
+	}
+	if len(cleaned) == 0 {
+		return ""
+	}
+	return strings.Join(cleaned, "\n") + "\n"
+}
+
+// applyToIndex applies a patch to the index and the worktree. Nothing is
+// written unless every file applies and matches the index.
+func (repo *Repository) applyToIndex(index *gitIndex, patches []filePatch) error {
+	type result struct {
+		path    string
+		content []byte
+		mode    uint32
+	}
+	results := make([]result, 0, len(patches))
+	removed := make([]string, 0)
+	for _, patch := range patches {
+		var content []byte
+		mode := patch.newMode
+		if patch.oldPath != "" {
+			position, ok := index.find(patch.oldPath)
+			if !ok {
+				return fmt.Errorf("%s: does not exist in index", patch.oldPath)
+			}
+			entry := index.entries[position]
+			if !repo.isWorktreeClean(index, entry) {
+				return fmt.Errorf("%s: does not match index", patch.oldPath)
+			}
+			_, content = repo.readObject(entry.hash)
+			if mode == 0 {
+				mode = entry.mode
+			}
+		} else if _, exists := index.find(patch.newPath); exists {
+			return fmt.Errorf("%s: already exists in index", patch.newPath)
+		}
+		var applied []byte
+		var err error
+		if patch.binary {
+			if applied, err = repo.applyBinaryPatch(patch, content); err != nil {
+				return err
+			}
+		} else if applied, err = applyHunks(content, patch.hunks); err != nil {
+			fmt.Fprintf(os.Stderr, "error: patch failed: %s:%s\n", patch.oldPath, err)
+			return fmt.Errorf("%s: patch does not apply", patch.oldPath)
+		}
+		if patch.oldPath != "" && patch.oldPath != patch.newPath {
+			removed = append(removed, patch.oldPath)
+		}
+		if patch.newPath != "" {
+			if mode == 0 {
+				mode = fileModeRegular
+			}
+			results = append(results, result{patch.newPath, applied, mode})
+		}
+	}
+	for _, path := range removed {
+		index.removePath(path)
+		index.invalidatePath(path)
+		repo.removeWorktreeFile(path)
+	}
+	for _, file := range results {
+		hash := repo.writeObject("blob", file.content)
+		entry := repo.checkoutEntry(file.path, treeEntry{mode: fmt.Sprintf("%o", file.mode), name: file.path, hash: hash})
+		index.addEntry(entry)
+		index.invalidatePath(file.path)
+	}
+	return nil
+}
+
+// applyMailbox applies every patch of the mailboxes on top of HEAD and
+// commits it with the author and message of its mail
+func (repo *Repository) applyMailbox(messages []string, quiet bool) {
+	index := repo.lockIndex()
+	head, hasHead := repo.resolveRef("HEAD")
+	if hasHead {
+		if dirty := repo.stagedChanges(index, head); len(dirty) > 0 {
+			paths := make([]string, len(dirty))
+			for i, change := range dirty {
+				paths[i] = change.path
+			}
+			log.Fatalf("error: Dirty index: cannot apply patches (dirty: %s)", strings.Join(paths, " "))
+		}
+	}
+	for i, message := range messages {
+		mail, err := parseMail(message)
+		if err != nil {
+			log.Fatalf("Patch is empty or could not be parsed: %s", err)
+		}
+		if !quiet {
+			fmt.Printf("Applying: %s\n", mail.subject)
+		}
+		patches, err := parsePatch(mail.patch)
+		if err == nil && len(patches) == 0 {
+			err = fmt.Errorf("patch is empty")
+		}
+		if err == nil {
+			err = repo.applyToIndex(index, patches)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			log.Fatalf("Patch failed at %04d %s", i+1, mail.subject)
+		}
+		var parents []string
+		if hasHead {
+			parents = []string{head}
+		}
+		head = repo.createCommitAs(mail.author, repo.writeTree(index), parents, mail.message)
+		hasHead = true
+		repo.updateHead(head, "am: "+mail.subject)
+		repo.writeIndexKeepingLock(index)
+	}
+	repo.releaseIndex(index)
+}
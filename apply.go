@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// filePatch is the part of a patch changing one file, as produced by
+// writePatch
+type filePatch struct {
+	oldPath string // empty for new files
+	newPath string // empty for deleted files
+	oldMode uint32
+	newMode uint32
+	oldHash string // as far as the index line gives it
+	newHash string
+	binary  bool
+	// binaryHunk is the data of a "GIT binary patch", nil when the patch
+	// only says that binary files differ
+	binaryHunk *binaryHunk
+	hunks      []patchHunk
+}
+
+type patchHunk struct {
+	oldStart int
+	oldCount int
+	newStart int
+	newCount int
+	lines    []diffLine
+}
+
+// parsePatch reads the "diff --git" sections of a patch; anything before
+// the first section is ignored
+func parsePatch(text string) ([]filePatch, error) {
+	lines := splitLines([]byte(text))
+	patches := make([]filePatch, 0)
+	for i := 0; i < len(lines); {
+		if !strings.HasPrefix(lines[i], "diff --git ") {
+			i++
+			continue
+		}
+		patch, next, err := parseFilePatch(lines, i)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, patch)
+		i = next
+	}
+	return patches, nil
+}
+
+// parseGitDiffPaths splits the "a/<old> b/<new>" part of a "diff --git"
+// line, which is ambiguous for paths with spaces unless both are equal
+func parseGitDiffPaths(value string) (string, string) {
+	if strings.HasPrefix(value, "\"") {
+		oldPath, rest, ok := unquoteCPath(value)
+		if ok {
+			newPath, _, _ := unquoteCPath(strings.TrimPrefix(rest, " "))
+			if !strings.HasPrefix(rest, " \"") {
+				newPath = strings.TrimPrefix(rest, " ")
+			}
+			return strings.TrimPrefix(oldPath, "a/"), strings.TrimPrefix(newPath, "b/")
+		}
+	}
+	// "a/x b/x": the middle is where both halves name the same path
+	if len(value)%2 == 1 {
+		half := len(value) / 2
+		if value[half] == ' ' && strings.HasPrefix(value, "a/") && value[half+1:half+3] == "b/" && value[2:half] == value[half+3:] {
+			return value[2:half], value[half+3:]
+		}
+	}
+	if space := strings.Index(value, " b/"); space != -1 {
+		return strings.TrimPrefix(value[:space], "a/"), value[space+3:]
+	}
+	return "", ""
+}
+
+// unquoteCPath reads a C-style quoted path from the start of value and
+// returns it with the rest of value
+func unquoteCPath(value string) (string, string, bool) {
+	var path strings.Builder
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"':
+			return path.String(), value[i+1:], true
+		case c == '\\' && i+1 < len(value):
+			i++
+			switch escaped := value[i]; escaped {
+			case 'a':
+				path.WriteByte('\a')
+			case 'b':
+				path.WriteByte('\b')
+			case 't':
+				path.WriteByte('\t')
+			case 'n':
+				path.WriteByte('\n')
+			case 'v':
+				path.WriteByte('\v')
+			case 'f':
+				path.WriteByte('\f')
+			case 'r':
+				path.WriteByte('\r')
+			case '0', '1', '2', '3':
+				if i+2 < len(value) {
+					if octal, err := strconv.ParseUint(value[i:i+3], 8, 8); err == nil {
+						path.WriteByte(byte(octal))
+						i += 2
+						continue
+					}
+				}
+				return "", value, false
+			default:
+				path.WriteByte(escaped)
+			}
+		default:
+			path.WriteByte(c)
+		}
+	}
+	return "", value, false
+}
+
+// patchPath reads the path of a "--- a/<path>" or "+++ b/<path>" line,
+// empty for /dev/null
+func patchPath(value string) string {
+	value = strings.TrimRight(value, "\n")
+	if tab := strings.IndexByte(value, '\t'); tab != -1 {
+		value = value[:tab]
+	}
+	if value == "/dev/null" {
+		return ""
+	}
+	if strings.HasPrefix(value, "\"") {
+		if unquoted, _, ok := unquoteCPath(value); ok {
+			value = unquoted
+		}
+	}
+	if slash := strings.IndexByte(value, '/'); slash != -1 {
+		return value[slash+1:]
+	}
+	return value
+}
+
+func parseFileMode8(value string) uint32 {
+	mode, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(mode)
+}
+
+func parseFilePatch(lines []string, start int) (filePatch, int, error) {
+	var patch filePatch
+	patch.oldPath, patch.newPath = parseGitDiffPaths(strings.TrimSuffix(strings.TrimPrefix(lines[start], "diff --git "), "\n"))
+	isNew, isDeleted := false, false
+	i := start + 1
+	for ; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\n")
+		switch {
+		case strings.HasPrefix(line, "new file mode "):
+			isNew = true
+			patch.newMode = parseFileMode8(strings.TrimPrefix(line, "new file mode "))
+		case strings.HasPrefix(line, "deleted file mode "):
+			isDeleted = true
+			patch.oldMode = parseFileMode8(strings.TrimPrefix(line, "deleted file mode "))
+		case strings.HasPrefix(line, "old mode "):
+			patch.oldMode = parseFileMode8(strings.TrimPrefix(line, "old mode "))
+		case strings.HasPrefix(line, "new mode "):
+			patch.newMode = parseFileMode8(strings.TrimPrefix(line, "new mode "))
+		case strings.HasPrefix(line, "rename from "), strings.HasPrefix(line, "copy from "):
+			patch.oldPath = line[strings.Index(line, "from ")+5:]
+		case strings.HasPrefix(line, "rename to "), strings.HasPrefix(line, "copy to "):
+			patch.newPath = line[strings.Index(line, "to ")+3:]
+		case strings.HasPrefix(line, "index "):
+			fields := strings.Fields(line)
+			patch.oldHash, patch.newHash, _ = strings.Cut(fields[1], "..")
+			if len(fields) == 3 {
+				mode := parseFileMode8(fields[2])
+				patch.oldMode, patch.newMode = mode, mode
+			}
+		case strings.HasPrefix(line, "similarity index "), strings.HasPrefix(line, "dissimilarity index "):
+		case strings.HasPrefix(line, "Binary files "):
+			patch.binary = true
+		case line == "GIT binary patch":
+			patch.binary = true
+			forward, next, err := parseBinaryHunk(lines, i+1)
+			if err != nil {
+				return patch, 0, err
+			}
+			patch.binaryHunk = &forward
+			// the reverse half is optional
+			if next < len(lines) && (strings.HasPrefix(lines[next], "literal ") || strings.HasPrefix(lines[next], "delta ")) {
+				if _, next, err = parseBinaryHunk(lines, next); err != nil {
+					return patch, 0, err
+				}
+			}
+			i = next - 1
+		case strings.HasPrefix(line, "--- "):
+			if path := patchPath(line[4:]); path != "" {
+				patch.oldPath = path
+			}
+		case strings.HasPrefix(line, "+++ "):
+			if path := patchPath(line[4:]); path != "" {
+				patch.newPath = path
+			}
+		case strings.HasPrefix(line, "@@ "):
+			hunk, next, err := parsePatchHunk(lines, i)
+			if err != nil {
+				return patch, 0, err
+			}
+			patch.hunks = append(patch.hunks, hunk)
+			i = next - 1
+		default:
+			if isNew {
+				patch.oldPath, patch.oldMode = "", 0
+			}
+			if isDeleted {
+				patch.newPath, patch.newMode = "", 0
+			}
+			return patch, i, nil
+		}
+	}
+	if isNew {
+		patch.oldPath, patch.oldMode = "", 0
+	}
+	if isDeleted {
+		patch.newPath, patch.newMode = "", 0
+	}
+	return patch, i, nil
+}
+
+// parseHunkRange reads "<start>[,<count>]"
+func parseHunkRange(value string) (int, int, bool) {
+	startText, countText, hasCount := strings.Cut(value, ",")
+	start, err := strconv.Atoi(startText)
+	if err != nil {
+		return 0, 0, false
+	}
+	count := 1
+	if hasCount {
+		if count, err = strconv.Atoi(countText); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, count, true
+}
+
+func parsePatchHunk(lines []string, start int) (patchHunk, int, error) {
+	var hunk patchHunk
+	fields := strings.Fields(lines[start])
+	if len(fields) < 4 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return hunk, 0, fmt.Errorf("corrupt patch at line %d", start+1)
+	}
+	var oldOk, newOk bool
+	hunk.oldStart, hunk.oldCount, oldOk = parseHunkRange(fields[1][1:])
+	hunk.newStart, hunk.newCount, newOk = parseHunkRange(fields[2][1:])
+	if !oldOk || !newOk {
+		return hunk, 0, fmt.Errorf("corrupt patch at line %d", start+1)
+	}
+	oldLeft, newLeft := hunk.oldCount, hunk.newCount
+	i := start + 1
+	for ; i < len(lines) && (oldLeft > 0 || newLeft > 0 || strings.HasPrefix(lines[i], "\\")); i++ {
+		line := lines[i]
+		if line == "\n" {
+			// blank context lines lose their space in some mail clients
+			line = " \n"
+		}
+		switch line[0] {
+		case ' ':
+			oldLeft--
+			newLeft--
+		case '-':
+			oldLeft--
+		case '+':
+			newLeft--
+		case '\\':
+			// "\ No newline at end of file" belongs to the previous line
+			if len(hunk.lines) > 0 {
+				last := &hunk.lines[len(hunk.lines)-1]
+				last.text = strings.TrimSuffix(last.text, "\n")
+			}
+			continue
+		default:
+			return hunk, 0, fmt.Errorf("corrupt patch at line %d", i+1)
+		}
+		hunk.lines = append(hunk.lines, diffLine{line[0], line[1:]})
+	}
+	if oldLeft != 0 || newLeft != 0 {
+		return hunk, 0, fmt.Errorf("corrupt patch at line %d", i)
+	}
+	return hunk, i, nil
+}
+
+// applyHunks applies the hunks of a patch to content. A hunk whose
+// preimage is not at the expected line is looked for further away, the
+// way "git apply" tolerates offsets; the error names the failing line.
+func applyHunks(content []byte, hunks []patchHunk) ([]byte, error) {
+	lines := splitLines(content)
+	result := make([]string, 0, len(lines))
+	position, offset := 0, 0
+	for _, hunk := range hunks {
+		preimage := make([]string, 0, hunk.oldCount)
+		postimage := make([]string, 0, hunk.newCount)
+		for _, line := range hunk.lines {
+			if line.op != '+' {
+				preimage = append(preimage, line.text)
+			}
+			if line.op != '-' {
+				postimage = append(postimage, line.text)
+			}
+		}
+		expected := hunk.oldStart - 1 + offset
+		if hunk.oldCount == 0 {
+			expected = hunk.oldStart + offset
+		}
+		found := -1
+		for distance := 0; found == -1 && (expected-distance >= position || expected+distance <= len(lines)); distance++ {
+			for _, candidate := range []int{expected - distance, expected + distance} {
+				if candidate >= position && candidate+len(preimage) <= len(lines) && matchesLines(lines[candidate:], preimage) {
+					found = candidate
+					break
+				}
+			}
+		}
+		if found == -1 {
+			return nil, fmt.Errorf("%d", hunk.oldStart)
+		}
+		result = append(result, lines[position:found]...)
+		result = append(result, postimage...)
+		position = found + len(preimage)
+		offset += found - expected
+	}
+	result = append(result, lines[position:]...)
+	return []byte(strings.Join(result, "")), nil
+}
+
+func matchesLines(lines []string, expected []string) bool {
+	for i, line := range expected {
+		if lines[i] != line {
+			return false
+		}
+	}
+	return true
+}
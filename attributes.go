@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// attributeAssignment is one attribute of a .gitattributes line: "true"
+// for "attr", "false" for "-attr", the value of "attr=value", and "" for
+// "!attr", which leaves it unspecified again
+type attributeAssignment struct {
+	name  string
+	value string
+}
+
+type attributeLine struct {
+	pattern     ignorePattern
+	assignments []attributeAssignment
+}
+
+// builtinAttributeMacros are defined before any file is read
+var builtinAttributeMacros = map[string][]attributeAssignment{
+	"binary": {{"diff", "false"}, {"merge", "false"}, {"text", "false"}},
+}
+
+// attributeMatcher finds the attributes of paths from core.attributesFile,
+// the .gitattributes files of the worktree and .git/info/attributes, in
+// increasing precedence
+type attributeMatcher struct {
+	repo   *Repository
+	global []attributeLine
+	info   []attributeLine
+	macros map[string][]attributeAssignment
+	lock   sync.Mutex
+	perDir map[string][]attributeLine
+}
+
+func newAttributeMatcher(repo *Repository) *attributeMatcher {
+	matcher := &attributeMatcher{repo: repo, macros: make(map[string][]attributeAssignment), perDir: make(map[string][]attributeLine)}
+	for name, assignments := range builtinAttributeMacros {
+		matcher.macros[name] = assignments
+	}
+	attributesFile, ok := repo.config.get("core.attributesFile")
+	if !ok {
+		if xdgHome := os.Getenv("XDG_CONFIG_HOME"); xdgHome != "" {
+			attributesFile = filepath.Join(xdgHome, "git", "attributes")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			attributesFile = filepath.Join(home, ".config", "git", "attributes")
+		}
+	} else if strings.HasPrefix(attributesFile, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			attributesFile = filepath.Join(home, attributesFile[2:])
+		}
+	}
+	if attributesFile != "" {
+		matcher.global = matcher.readAttributesFile(attributesFile, "", true)
+	}
+	// macros of the root .gitattributes apply everywhere
+	matcher.perDir[""] = matcher.readAttributesFile(filepath.Join(repo.workTree, ".gitattributes"), "", true)
+	matcher.info = matcher.readAttributesFile(filepath.Join(repo.gitDir, "info", "attributes"), "", true)
+	return matcher
+}
+
+// readAttributesFile reads the lines of an attributes file whose patterns
+// are relative to base; macros are only defined by top level files
+func (matcher *attributeMatcher) readAttributesFile(filePath string, base string, topLevel bool) []attributeLine {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) || isNotDirectoryError(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	lines := make([]attributeLine, 0)
+	bufScanner := bufio.NewScanner(file)
+	for number := 1; bufScanner.Scan(); number++ {
+		text := strings.TrimLeft(bufScanner.Text(), " \t\r")
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		var pattern string
+		if text[0] == '"' {
+			unquoted, rest, ok := unquoteCPath(text)
+			if !ok {
+				continue
+			}
+			pattern, text = unquoted, rest
+		} else {
+			end := strings.IndexAny(text, " \t\r")
+			if end == -1 {
+				end = len(text)
+			}
+			pattern, text = text[:end], text[end:]
+		}
+		assignments := parseAttributeAssignments(text)
+		if macro, ok := strings.CutPrefix(pattern, "[attr]"); ok {
+			if !topLevel {
+				fmt.Fprintf(os.Stderr, "%s not allowed: %s:%d\n", pattern, filePath, number)
+				continue
+			}
+			matcher.macros[macro] = assignments
+			continue
+		}
+		if strings.HasPrefix(pattern, "!") {
+			fmt.Fprintln(os.Stderr, "Negative patterns are ignored in git attributes\nUse '\\!' for literal leading exclamation.")
+			continue
+		}
+		if parsed, ok := parseIgnorePattern(pattern, base); ok {
+			lines = append(lines, attributeLine{parsed, assignments})
+		}
+	}
+	if err := bufScanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return lines
+}
+
+func parseAttributeAssignments(text string) []attributeAssignment {
+	assignments := make([]attributeAssignment, 0)
+	for _, field := range strings.Fields(text) {
+		switch {
+		case strings.HasPrefix(field, "-"):
+			assignments = append(assignments, attributeAssignment{field[1:], "false"})
+		case strings.HasPrefix(field, "!"):
+			assignments = append(assignments, attributeAssignment{field[1:], ""})
+		default:
+			name, value, hasValue := strings.Cut(field, "=")
+			if !hasValue {
+				value = "true"
+			}
+			assignments = append(assignments, attributeAssignment{name, value})
+		}
+	}
+	return assignments
+}
+
+func (matcher *attributeMatcher) directoryLines(dir string) []attributeLine {
+	matcher.lock.Lock()
+	defer matcher.lock.Unlock()
+	lines, ok := matcher.perDir[dir]
+	if !ok {
+		lines = matcher.readAttributesFile(filepath.Join(matcher.repo.workTree, filepath.FromSlash(dir), ".gitattributes"), dir, false)
+		matcher.perDir[dir] = lines
+	}
+	return lines
+}
+
+// attributes returns the attributes of a path, slash-separated and
+// relative to the worktree root. Later lines and deeper files take
+// precedence; a macro set also sets the attributes it stands for.
+func (matcher *attributeMatcher) attributes(relativePath string) map[string]string {
+	attributes := make(map[string]string)
+	var assign func(assignment attributeAssignment)
+	assign = func(assignment attributeAssignment) {
+		if assignment.value == "" {
+			delete(attributes, assignment.name)
+			return
+		}
+		attributes[assignment.name] = assignment.value
+		if macro, ok := matcher.macros[assignment.name]; ok && assignment.value == "true" {
+			for _, expanded := range macro {
+				assign(expanded)
+			}
+		}
+	}
+	apply := func(lines []attributeLine) {
+		for _, line := range lines {
+			if line.pattern.matches(relativePath, false) {
+				for _, assignment := range line.assignments {
+					assign(assignment)
+				}
+			}
+		}
+	}
+	apply(matcher.global)
+	apply(matcher.directoryLines(""))
+	dir := ""
+	components := strings.Split(relativePath, "/")
+	for _, component := range components[:len(components)-1] {
+		dir = path.Join(dir, component)
+		apply(matcher.directoryLines(dir))
+	}
+	apply(matcher.info)
+	return attributes
+}
+
+// pathAttributes returns the attributes of a path, reading the attribute
+// files on first use
+func (repo *Repository) pathAttributes(relativePath string) map[string]string {
+	repo.attributesOnce.Do(func() {
+		repo.attributeMatcher = newAttributeMatcher(repo)
+	})
+	return repo.attributeMatcher.attributes(relativePath)
+}
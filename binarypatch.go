@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// base85Alphabet is the encoding of the data lines of binary patches
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// binaryPatchLineBytes is the most data one line of a binary patch holds
+const binaryPatchLineBytes = 52
+
+// encodeBase85 encodes data in groups of four bytes, the last one padded
+// with zeros, as five characters each
+func encodeBase85(data []byte) string {
+	var encoded strings.Builder
+	for len(data) > 0 {
+		var group uint32
+		for i := 0; i < 4; i++ {
+			group <<= 8
+			if i < len(data) {
+				group |= uint32(data[i])
+			}
+		}
+		var characters [5]byte
+		for i := 4; i >= 0; i-- {
+			characters[i] = base85Alphabet[group%85]
+			group /= 85
+		}
+		encoded.Write(characters[:])
+		if len(data) < 4 {
+			break
+		}
+		data = data[4:]
+	}
+	return encoded.String()
+}
+
+// decodeBase85 decodes length bytes from text, false when text is not
+// base85 for them
+func decodeBase85(text string, length int) ([]byte, bool) {
+	if len(text) != (length+3)/4*5 {
+		return nil, false
+	}
+	decoded := make([]byte, 0, len(text)/5*4)
+	for ; text != ""; text = text[5:] {
+		var group uint64
+		for i := 0; i < 5; i++ {
+			value := strings.IndexByte(base85Alphabet, text[i])
+			if value == -1 {
+				return nil, false
+			}
+			group = group*85 + uint64(value)
+		}
+		if group > 0xffffffff {
+			return nil, false
+		}
+		decoded = append(decoded, byte(group>>24), byte(group>>16), byte(group>>8), byte(group))
+	}
+	return decoded[:length], true
+}
+
+// writeBinaryPatch writes a "GIT binary patch" from old to new content:
+// the new content whole, deflated and in base85, then the old one to apply
+// it in reverse. Deltas are never written, apply takes whole contents
+// just as well.
+func writeBinaryPatch(w io.Writer, oldContent []byte, newContent []byte) {
+	fmt.Fprintln(w, "GIT binary patch")
+	writeBinaryHunk(w, newContent)
+	writeBinaryHunk(w, oldContent)
+}
+
+func writeBinaryHunk(w io.Writer, content []byte) {
+	var deflated bytes.Buffer
+	deflater := zlib.NewWriter(&deflated)
+	deflater.Write(content)
+	deflater.Close()
+	fmt.Fprintf(w, "literal %d\n", len(content))
+	data := deflated.Bytes()
+	for len(data) > 0 {
+		count := len(data)
+		if count > binaryPatchLineBytes {
+			count = binaryPatchLineBytes
+		}
+		// the length is "A" to "Z" for 1 to 26 bytes, "a" to "z" up to 52
+		length := byte('A' + count - 1)
+		if count > 26 {
+			length = byte('a' + count - 27)
+		}
+		fmt.Fprintf(w, "%c%s\n", length, encodeBase85(data[:count]))
+		data = data[count:]
+	}
+	fmt.Fprintln(w)
+}
+
+// binaryHunk is the forward half of a binary patch: the new content, or
+// a delta making it from the old content
+type binaryHunk struct {
+	delta bool
+	data  []byte
+}
+
+// parseBinaryHunk reads a "literal <size>" or "delta <size>" block and the
+// data lines up to the blank line ending it
+func parseBinaryHunk(lines []string, start int) (binaryHunk, int, error) {
+	var hunk binaryHunk
+	corrupt := func(line int) (binaryHunk, int, error) {
+		return binaryHunk{}, 0, fmt.Errorf("corrupt binary patch at line %d: %s", line+1, strings.TrimSuffix(lines[line], "\n"))
+	}
+	if start >= len(lines) {
+		return binaryHunk{}, 0, fmt.Errorf("unrecognized binary patch at line %d", start)
+	}
+	kind, sizeText, _ := strings.Cut(strings.TrimSuffix(lines[start], "\n"), " ")
+	size, err := strconv.Atoi(sizeText)
+	if kind != "literal" && kind != "delta" || err != nil {
+		return binaryHunk{}, 0, fmt.Errorf("unrecognized binary patch at line %d", start+1)
+	}
+	hunk.delta = kind == "delta"
+	var deflated []byte
+	i := start + 1
+	for ; i < len(lines) && lines[i] != "\n"; i++ {
+		line := strings.TrimSuffix(lines[i], "\n")
+		if line == "" {
+			return corrupt(i)
+		}
+		var length int
+		switch c := line[0]; {
+		case c >= 'A' && c <= 'Z':
+			length = int(c-'A') + 1
+		case c >= 'a' && c <= 'z':
+			length = int(c-'a') + 27
+		default:
+			return corrupt(i)
+		}
+		data, ok := decodeBase85(line[1:], length)
+		if !ok {
+			return corrupt(i)
+		}
+		deflated = append(deflated, data...)
+	}
+	if i == len(lines) {
+		return corrupt(i - 1)
+	}
+	inflater, err := zlib.NewReader(bytes.NewReader(deflated))
+	if err == nil {
+		hunk.data, err = io.ReadAll(inflater)
+	}
+	if err != nil || len(hunk.data) != size {
+		return corrupt(start)
+	}
+	return hunk, i + 1, nil
+}
+
+// applyBinaryPatch makes the new content of a binary patch from the old
+// one. Like git, it asks for the full object names on the index line and
+// checks both contents against them; a patch without data applies when
+// the new object is in the repository already.
+func (repo *Repository) applyBinaryPatch(patch filePatch, content []byte) ([]byte, error) {
+	name := patch.newPath
+	if patch.oldPath != "" {
+		name = patch.oldPath
+	}
+	if !isFullHash(patch.oldHash) || !isFullHash(patch.newHash) {
+		return nil, fmt.Errorf("cannot apply binary patch to '%s' without full index line", name)
+	}
+	if patch.oldPath != "" {
+		if hash := hashObject("blob", content); hash != patch.oldHash {
+			return nil, fmt.Errorf("the patch applies to '%s' (%s), which does not match the current contents.", name, hash)
+		}
+	} else if len(content) > 0 {
+		return nil, fmt.Errorf("the patch applies to an empty '%s' but it is not empty", name)
+	}
+	if isNullHash(patch.newHash) {
+		return nil, nil
+	}
+	if repo.hasObject(patch.newHash) {
+		_, result := repo.readObject(patch.newHash)
+		return result, nil
+	}
+	if patch.binaryHunk == nil {
+		return nil, fmt.Errorf("binary patch does not apply to '%s'", name)
+	}
+	result := patch.binaryHunk.data
+	if patch.binaryHunk.delta {
+		if baseSize, _ := readDeltaSize(result, 0); baseSize != len(content) {
+			return nil, fmt.Errorf("binary patch does not apply to '%s'", name)
+		}
+		result = applyDelta(content, result)
+	}
+	if hash := hashObject("blob", result); hash != patch.newHash {
+		return nil, fmt.Errorf("binary patch to '%s' creates incorrect result (expecting %s, got %s)", name, patch.newHash, hash)
+	}
+	return result, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"strings"
+)
+
+// changed-path Bloom filter settings, those git writes
+const (
+	bloomHashCount       = 7
+	bloomBitsPerEntry    = 10
+	bloomMaxChangedPaths = 512
+)
+
+// murmur3 is MurmurHash3 (x86, 32-bit) with a seed. Version 1 filters hash
+// the bytes of paths as signed chars, a bug of git kept for the filters
+// already written; version 2 hashes them as they are.
+func murmur3(version int, seed uint32, data []byte) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	value := func(b byte) uint32 {
+		if version == 1 {
+			return uint32(int32(int8(b)))
+		}
+		return uint32(b)
+	}
+	mix := func(k uint32) uint32 {
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		return k * c2
+	}
+	hash := seed
+	blocks := len(data) / 4
+	for i := 0; i < blocks; i++ {
+		block := data[i*4:]
+		hash ^= mix(value(block[0]) | value(block[1])<<8 | value(block[2])<<16 | value(block[3])<<24)
+		hash = bits.RotateLeft32(hash, 13)*5 + 0xe6546b64
+	}
+	tail := data[blocks*4:]
+	var k uint32
+	switch len(tail) {
+	case 3:
+		k ^= value(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= value(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= value(tail[0])
+		hash ^= mix(k)
+	}
+	hash ^= uint32(len(data))
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
+
+// bloomKey is the bit positions a path sets in a filter, before they are
+// reduced to its size: double hashing of two seeded murmur3 hashes
+func bloomKey(version int, hashCount int, path string) []uint32 {
+	hash0 := murmur3(version, 0x293ae76f, []byte(path))
+	hash1 := murmur3(version, 0x7e646e2c, []byte(path))
+	key := make([]uint32, hashCount)
+	for i := range key {
+		key[i] = hash0 + uint32(i)*hash1
+	}
+	return key
+}
+
+// bloomFilter is the changed-path filter of a commit
+type bloomFilter []byte
+
+func (filter bloomFilter) add(key []uint32) {
+	size := uint64(len(filter)) * 8
+	for _, hash := range key {
+		position := uint64(hash) % size
+		filter[position/8] |= 1 << (position % 8)
+	}
+}
+
+// mayContain is false when the path of key is certainly not in the filter
+func (filter bloomFilter) mayContain(key []uint32) bool {
+	size := uint64(len(filter)) * 8
+	if size == 0 {
+		return true
+	}
+	for _, hash := range key {
+		position := uint64(hash) % size
+		if filter[position/8]&(1<<(position%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// changedPathFilter computes the filter of the paths a commit changes from
+// its first parent, the files and the directories they are in. Commits
+// changing too many files get a filter of all ones, which rules nothing out.
+func (repo *Repository) changedPathFilter(commit commitObject, version int) bloomFilter {
+	parentTree := ""
+	if len(commit.parents) > 0 {
+		parentTree = repo.readCommitObject(commit.parents[0]).tree
+	}
+	changes := repo.diffTrees(parentTree, commit.tree)
+	if len(changes) > bloomMaxChangedPaths {
+		return bloomFilter{0xff}
+	}
+	paths := make(map[string]bool)
+	for _, change := range changes {
+		for changed := change.path; changed != "" && !paths[changed]; {
+			paths[changed] = true
+			slash := strings.LastIndexByte(changed, '/')
+			if slash < 0 {
+				break
+			}
+			changed = changed[:slash]
+		}
+	}
+	size := (len(paths)*bloomBitsPerEntry + 7) / 8
+	if size == 0 {
+		size = 1
+	}
+	filter := make(bloomFilter, size)
+	for changed := range paths {
+		filter.add(bloomKey(version, bloomHashCount, changed))
+	}
+	return filter
+}
+
+// changedPathsVersion is the version of the filters written:
+// commitGraph.changedPathsVersion when it is 1 or 2, otherwise that of the
+// existing filters, and 1 as git writes by default
+func (repo *Repository) changedPathsVersion() int {
+	switch version := repo.config.getInt("commitGraph.changedPathsVersion", -1); version {
+	case 1, 2:
+		return int(version)
+	}
+	if graph := repo.loadCommitGraph(); graph.bloomVersion != 0 {
+		return graph.bloomVersion
+	}
+	return 1
+}
+
+// pathspecBloomKeys returns the keys telling that a commit may change what
+// the pathspecs select: for each of them the keys of its path and the
+// directories it is in, all of which the filter must have. ok is false when
+// filters cannot tell, for pathspecs with wildcards or magic.
+func pathspecBloomKeys(specs []pathspec, version int, hashCount int) ([][][]uint32, bool) {
+	if len(specs) == 0 {
+		return nil, false
+	}
+	keys := make([][][]uint32, 0, len(specs))
+	for _, spec := range specs {
+		path := strings.TrimRight(spec.path, "/")
+		if !spec.literal || spec.icase || spec.exclude || path == "" {
+			return nil, false
+		}
+		specKeys := make([][]uint32, 0)
+		for {
+			specKeys = append(specKeys, bloomKey(version, hashCount, path))
+			slash := strings.LastIndexByte(path, '/')
+			if slash < 0 {
+				break
+			}
+			path = path[:slash]
+		}
+		keys = append(keys, specKeys)
+	}
+	return keys, true
+}
+
+// changedPathsOutside tells from the commit-graph filter of a commit that
+// it certainly changes none of the paths of keys from its first parent;
+// false when it may, or when it has no filter
+func (repo *Repository) changedPathsOutside(hash string, keys [][][]uint32) bool {
+	filter, ok := repo.loadCommitGraph().filters[hash]
+	if !ok {
+		return false
+	}
+	for _, specKeys := range keys {
+		contained := true
+		for _, key := range specKeys {
+			contained = contained && filter.mayContain(key)
+		}
+		if contained {
+			return false
+		}
+	}
+	return true
+}
+
+// readBloomChunks reads the filters of the commits of the lookup chunk
+// from the BIDX and BDAT chunks, with their version and hash count; nil
+// when there are none or they are damaged
+func readBloomChunks(lookup []byte, indexes []byte, data []byte) (map[string]bloomFilter, int, int) {
+	count := len(lookup) / ObjectShaLength
+	if len(indexes) < count*4 || len(data) < 12 {
+		return nil, 0, 0
+	}
+	version := int(binary.BigEndian.Uint32(data))
+	hashCount := int(binary.BigEndian.Uint32(data[4:]))
+	if version != 1 && version != 2 || hashCount == 0 {
+		return nil, 0, 0
+	}
+	filters := make(map[string]bloomFilter, count)
+	start := uint32(0)
+	for i := 0; i < count; i++ {
+		end := binary.BigEndian.Uint32(indexes[i*4:])
+		if end < start || 12+uint64(end) > uint64(len(data)) {
+			return nil, 0, 0
+		}
+		filters[hex.EncodeToString(lookup[i*ObjectShaLength:(i+1)*ObjectShaLength])] = bloomFilter(data[12+start : 12+end])
+		start = end
+	}
+	return filters, version, hashCount
+}
+
+// writeBloomChunks computes the filters of the commits of a commit-graph,
+// in parallel, reusing those the existing commit-graph has of the same
+// version, and returns the content of its BIDX and BDAT chunks
+func (repo *Repository) writeBloomChunks(hashes []string, commits map[string]commitObject) ([]byte, []byte) {
+	version := repo.changedPathsVersion()
+	existing := repo.loadCommitGraph()
+	filters := make([]bloomFilter, len(hashes))
+	runParallel(repo.jobCount(0), len(hashes), func(i int) {
+		if filter, ok := existing.filters[hashes[i]]; ok && existing.bloomVersion == version && existing.bloomHashCount == bloomHashCount {
+			filters[i] = filter
+		} else {
+			filters[i] = repo.changedPathFilter(commits[hashes[i]], version)
+		}
+	})
+	var indexes, data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, [3]uint32{uint32(version), bloomHashCount, bloomBitsPerEntry})
+	end := uint32(0)
+	for _, filter := range filters {
+		end += uint32(len(filter))
+		binary.Write(&indexes, binary.BigEndian, end)
+		data.Write(filter)
+	}
+	return indexes.Bytes(), data.Bytes()
+}
+
+// hasChangedPaths tells whether the commit-graph has changed-path filters,
+// which writing it again keeps unless told otherwise
+func (repo *Repository) hasChangedPaths() bool {
+	return repo.loadCommitGraph().bloomVersion != 0
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type branchInfo struct {
+	name    string
+	hash    string
+	current bool
+}
+
+// branches returns the local branches the filter passes sorted by name
+func (repo *Repository) branches(filter *refFilter) []branchInfo {
+	currentBranch, _ := repo.headBranch()
+	branches := make([]branchInfo, 0)
+	for _, ref := range repo.listRefs("refs/heads/") {
+		hash, ok := repo.resolveRef(ref)
+		if !ok || !repo.matchesRefFilter(filter, hash) {
+			continue
+		}
+		name := strings.TrimPrefix(ref, "refs/heads/")
+		branches = append(branches, branchInfo{name, hash, name == currentBranch})
+	}
+	return branches
+}
+
+func (repo *Repository) listBranches(filter *refFilter, color bool) {
+	for _, branch := range repo.branches(filter) {
+		branchDescriptionPrefix := " "
+		name := branch.name
+		if branch.current {
+			branchDescriptionPrefix = "*"
+			name = colorize(color, colorGreen, name)
+		}
+		fmt.Printf("%s %s: %s\n", branchDescriptionPrefix, name, branch.hash)
+	}
+}
+
+type jsonBranch struct {
+	Name     string        `json:"name"`
+	Commit   string        `json:"commit"`
+	Current  bool          `json:"current"`
+	Tracking *jsonTracking `json:"tracking,omitempty"`
+}
+
+func (repo *Repository) branchesJSON(filter *refFilter) []jsonBranch {
+	branches := make([]jsonBranch, 0)
+	for _, branch := range repo.branches(filter) {
+		entry := jsonBranch{Name: branch.name, Commit: branch.hash, Current: branch.current}
+		if info, ok := repo.tracking(branch.name); ok {
+			entry.Tracking = &jsonTracking{shortRefName(info.upstream), info.gone, info.ahead, info.behind}
+		}
+		branches = append(branches, entry)
+	}
+	return branches
+}
+
+// upstreamOf returns the ref a branch tracks according to its
+// branch.<name>.remote and branch.<name>.merge settings, mapped through the
+// fetch refspecs of the remote
+func (repo *Repository) upstreamOf(branch string) (string, bool) {
+	remote, hasRemote := repo.config.get("branch." + branch + ".remote")
+	merge, hasMerge := repo.config.get("branch." + branch + ".merge")
+	if !hasRemote || !hasMerge {
+		return "", false
+	}
+	if remote == "." {
+		// tracking another local branch
+		return merge, true
+	}
+	for _, refspec := range repo.fetchRefspecs(remote) {
+		if destination, ok := mapRefspec(refspec, merge); ok {
+			return destination, true
+		}
+	}
+	return "", false
+}
+
+// setUpstream records that branch tracks the remote-tracking ref upstream,
+// or another local branch when upstream is under refs/heads/
+func (repo *Repository) setUpstream(branch string, upstream string) {
+	remote, merge := ".", upstream
+	if strings.HasPrefix(upstream, "refs/remotes/") {
+		remote, _, _ = strings.Cut(strings.TrimPrefix(upstream, "refs/remotes/"), "/")
+		merge = "refs/heads/" + strings.TrimPrefix(upstream, "refs/remotes/"+remote+"/")
+	} else if !strings.HasPrefix(upstream, "refs/heads/") {
+		log.Fatalf("fatal: the requested upstream branch '%s' does not exist", shortRefName(upstream))
+	}
+	repo.setConfig("branch."+branch+".remote", remote)
+	repo.setConfig("branch."+branch+".merge", merge)
+	fmt.Printf("branch '%s' set up to track '%s'.\n", branch, shortRefName(upstream))
+}
+
+type trackingInfo struct {
+	upstream string // full ref name
+	gone     bool   // configured, but the ref does not exist
+	ahead    int
+	behind   int
+}
+
+// tracking compares a branch with its upstream, ok is false for branches
+// without one
+func (repo *Repository) tracking(branch string) (trackingInfo, bool) {
+	upstream, ok := repo.upstreamOf(branch)
+	if !ok {
+		return trackingInfo{}, false
+	}
+	info := trackingInfo{upstream: upstream}
+	upstreamHash, ok := repo.resolveRef(upstream)
+	if !ok {
+		info.gone = true
+		return info, true
+	}
+	if branchHash, ok := repo.resolveRef("refs/heads/" + branch); ok {
+		info.ahead, info.behind = repo.aheadBehind(branchHash, upstreamHash)
+	}
+	return info, true
+}
+
+// aheadBehind counts the commits reachable from only one of the two sides,
+// like git rev-list --left-right --count local...upstream
+func (repo *Repository) aheadBehind(local string, upstream string) (int, int) {
+	fromLocal, fromUpstream := repo.reachableCommits(local), repo.reachableCommits(upstream)
+	ahead, behind := 0, 0
+	for hash := range fromLocal {
+		if !fromUpstream[hash] {
+			ahead++
+		}
+	}
+	for hash := range fromUpstream {
+		if !fromLocal[hash] {
+			behind++
+		}
+	}
+	return ahead, behind
+}
+
+// describeTracking gives the "Your branch is ..." summary of status and
+// checkout
+func describeTracking(info trackingInfo) string {
+	upstream := shortRefName(info.upstream)
+	commits := func(count int) string {
+		if count == 1 {
+			return "1 commit"
+		}
+		return fmt.Sprintf("%d commits", count)
+	}
+	switch {
+	case info.gone:
+		return fmt.Sprintf("Your branch is based on '%s', but the upstream is gone.", upstream)
+	case info.ahead > 0 && info.behind > 0:
+		return fmt.Sprintf("Your branch and '%s' have diverged,\nand have %d and %d different commits each, respectively.", upstream, info.ahead, info.behind)
+	case info.ahead > 0:
+		return fmt.Sprintf("Your branch is ahead of '%s' by %s.", upstream, commits(info.ahead))
+	case info.behind > 0:
+		return fmt.Sprintf("Your branch is behind '%s' by %s, and can be fast-forwarded.", upstream, commits(info.behind))
+	}
+	return fmt.Sprintf("Your branch is up to date with '%s'.", upstream)
+}
+
+// listBranchesVerbose prints the -v and -vv formats of git branch: aligned
+// names, the abbreviated commit, tracking state and subject
+func (repo *Repository) listBranchesVerbose(filter *refFilter, verbosity int, color bool) {
+	branches := repo.branches(filter)
+	width := 0
+	for _, branch := range branches {
+		if len(branch.name) > width {
+			width = len(branch.name)
+		}
+	}
+	for _, branch := range branches {
+		prefix := " "
+		name := fmt.Sprintf("%-*s", width, branch.name)
+		if branch.current {
+			prefix = "*"
+			name = colorize(color, colorGreen, name)
+		}
+		trackingSummary := ""
+		if info, ok := repo.tracking(branch.name); ok {
+			trackingSummary = formatBranchTracking(info, verbosity, color)
+		}
+		subject := strings.SplitN(repo.readCommitObject(branch.hash).commitMessage, "\n", 2)[0]
+		fmt.Printf("%s %s %s %s%s\n", prefix, name, branch.hash[:7], trackingSummary, subject)
+	}
+}
+
+func formatBranchTracking(info trackingInfo, verbosity int, color bool) string {
+	var state []string
+	if info.gone {
+		state = append(state, "gone")
+	} else {
+		if info.ahead > 0 {
+			state = append(state, fmt.Sprintf("ahead %d", info.ahead))
+		}
+		if info.behind > 0 {
+			state = append(state, fmt.Sprintf("behind %d", info.behind))
+		}
+	}
+	if verbosity < 2 {
+		if len(state) == 0 {
+			return ""
+		}
+		return "[" + strings.Join(state, ", ") + "] "
+	}
+	upstream := colorize(color, colorBlue, shortRefName(info.upstream))
+	if len(state) == 0 {
+		return "[" + upstream + "] "
+	}
+	return "[" + upstream + ": " + strings.Join(state, ", ") + "] "
+}
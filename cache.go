@@ -0,0 +1,64 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+const DefaultObjectCacheLimit = 32 << 20
+
+// objectCache keeps recently read objects in memory, evicting the least
+// recently used ones once the total content size exceeds the limit. It is
+// safe for concurrent use.
+type objectCache struct {
+	lock    sync.Mutex
+	limit   int64
+	size    int64
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type cachedObject struct {
+	hash    string
+	header  objectHeader
+	content []byte
+}
+
+func newObjectCache(limit int64) *objectCache {
+	return &objectCache{limit: limit, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (cache *objectCache) get(hash string) (objectHeader, []byte, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[hash]
+	if !ok {
+		return objectHeader{}, nil, false
+	}
+	cache.order.MoveToFront(element)
+	object := element.Value.(*cachedObject)
+	return object.header, object.content, true
+}
+
+func (cache *objectCache) add(hash string, header objectHeader, content []byte) {
+	size := int64(len(content))
+	if size > cache.limit {
+		// never let a single object flush everything else
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.entries[hash]; ok {
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[hash] = cache.order.PushFront(&cachedObject{hash, header, content})
+	cache.size += size
+	for cache.size > cache.limit {
+		oldest := cache.order.Back()
+		object := oldest.Value.(*cachedObject)
+		cache.order.Remove(oldest)
+		delete(cache.entries, object.hash)
+		cache.size -= int64(len(object.content))
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cacheTree mirrors the TREE index extension: the tree object each
+// directory of the index would produce, so unchanged directories need
+// neither re-hashing in write-tree nor comparing in status
+type cacheTree struct {
+	name       string
+	entryCount int // index entries covered, -1 when invalidated
+	hash       string
+	subtrees   []*cacheTree
+}
+
+func parseCacheTree(data []byte) *cacheTree {
+	root, _ := parseCacheTreeNode(data, 0)
+	return root
+}
+
+func parseCacheTreeNode(data []byte, position int) (*cacheTree, int) {
+	// format: <path>\0<entry count> <subtree count>\n[<20-byte sha>]
+	// followed by the subtrees; the sha is absent for invalidated entries
+	nameEnd := bytes.IndexByte(data[position:], 0)
+	lineEnd := bytes.IndexByte(data[position:], '\n')
+	if nameEnd == -1 || lineEnd == -1 || lineEnd < nameEnd {
+		log.Fatal("fatal: index file corrupt: bad cache-tree entry")
+	}
+	node := &cacheTree{name: string(data[position : position+nameEnd])}
+	counts := strings.Split(string(data[position+nameEnd+1:position+lineEnd]), " ")
+	if len(counts) != 2 {
+		log.Fatal("fatal: index file corrupt: bad cache-tree counts")
+	}
+	entryCount, err1 := strconv.Atoi(counts[0])
+	subtreeCount, err2 := strconv.Atoi(counts[1])
+	if err1 != nil || err2 != nil {
+		log.Fatal("fatal: index file corrupt: bad cache-tree counts")
+	}
+	node.entryCount = entryCount
+	position += lineEnd + 1
+	if entryCount >= 0 {
+		node.hash = hex.EncodeToString(data[position : position+ObjectShaLength])
+		position += ObjectShaLength
+	}
+	for i := 0; i < subtreeCount; i++ {
+		var subtree *cacheTree
+		subtree, position = parseCacheTreeNode(data, position)
+		node.subtrees = append(node.subtrees, subtree)
+	}
+	return node, position
+}
+
+func (node *cacheTree) serialize(buffer []byte) []byte {
+	buffer = append(buffer, node.name...)
+	buffer = append(buffer, 0)
+	buffer = append(buffer, strconv.Itoa(node.entryCount)+" "+strconv.Itoa(len(node.subtrees))+"\n"...)
+	if node.entryCount >= 0 {
+		hashBytes, _ := hex.DecodeString(node.hash)
+		buffer = append(buffer, hashBytes...)
+	}
+	for _, subtree := range node.subtrees {
+		buffer = subtree.serialize(buffer)
+	}
+	return buffer
+}
+
+func (node *cacheTree) isValid() bool {
+	return node != nil && node.entryCount >= 0
+}
+
+func (node *cacheTree) subtree(name string) *cacheTree {
+	if node == nil {
+		return nil
+	}
+	for _, subtree := range node.subtrees {
+		if subtree.name == name {
+			return subtree
+		}
+	}
+	return nil
+}
+
+// invalidatePath marks every directory containing path as changed in both
+// the cache-tree and the untracked cache
+func (index *gitIndex) invalidatePath(relativePath string) {
+	components := strings.Split(relativePath, "/")
+	node := index.cacheTree
+	for i := 0; node != nil; i++ {
+		node.entryCount = -1
+		if i == len(components)-1 {
+			break
+		}
+		node = node.subtree(components[i])
+	}
+	if index.untrackedCache != nil {
+		index.untrackedCache.invalidatePath(components)
+	}
+}
+
+// writeTree stores the index as tree objects and returns the root tree,
+// reusing cache-tree entries that are still valid. Intent-to-add entries
+// are not written.
+func (repo *Repository) writeTree(index *gitIndex) string {
+	entries := make([]indexEntry, 0, len(index.entries))
+	for _, entry := range index.entries {
+		if entry.stage() != 0 {
+			log.Fatalf("error: %s: unmerged (%s)\nfatal: write-tree: error building trees", entry.path, entry.hash)
+		}
+		if entry.intentToAdd() {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if index.cacheTree == nil {
+		index.cacheTree = &cacheTree{entryCount: -1}
+	}
+	return repo.writeTreeLevel(entries, "", index.cacheTree)
+}
+
+func (repo *Repository) writeTreeLevel(entries []indexEntry, prefix string, node *cacheTree) string {
+	if node.isValid() && node.entryCount == len(entries) && repo.hasObject(node.hash) {
+		return node.hash
+	}
+	treeEntries := make([]treeEntry, 0)
+	subtrees := make([]*cacheTree, 0)
+	for i := 0; i < len(entries); {
+		name := entries[i].path[len(prefix):]
+		slash := strings.IndexByte(name, '/')
+		if slash == -1 {
+			treeEntries = append(treeEntries, treeEntry{strconv.FormatUint(uint64(entries[i].mode), 8), name, entries[i].hash})
+			i++
+			continue
+		}
+		// the index is sorted, so a directory's entries are contiguous
+		dirName := name[:slash]
+		dirPrefix := prefix + dirName + "/"
+		end := i
+		for end < len(entries) && strings.HasPrefix(entries[end].path, dirPrefix) {
+			end++
+		}
+		subtree := node.subtree(dirName)
+		if subtree == nil {
+			subtree = &cacheTree{name: dirName, entryCount: -1}
+		}
+		hash := repo.writeTreeLevel(entries[i:end], dirPrefix, subtree)
+		treeEntries = append(treeEntries, treeEntry{"40000", dirName, hash})
+		subtrees = append(subtrees, subtree)
+		i = end
+	}
+	sort.Slice(subtrees, func(i, j int) bool {
+		// git orders subtrees by name length first
+		if len(subtrees[i].name) != len(subtrees[j].name) {
+			return len(subtrees[i].name) < len(subtrees[j].name)
+		}
+		return subtrees[i].name < subtrees[j].name
+	})
+	node.hash = repo.writeObject("tree", serializeTree(treeEntries))
+	node.entryCount = len(entries)
+	node.subtrees = subtrees
+	return node.hash
+}
+
+func serializeTree(entries []treeEntry) []byte {
+	// format: <file-mode-in-string> <file-name>\0<20-bytes-of-hash-in-binary>
+	// entries are sorted by name, directories as if their name ended in "/"
+	sortKey := func(entry treeEntry) string {
+		if entry.mode == "40000" {
+			return entry.name + "/"
+		}
+		return entry.name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortKey(entries[i]) < sortKey(entries[j]) })
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		buffer.WriteString(entry.mode + " " + entry.name + "\x00")
+		hashBytes, err := hex.DecodeString(entry.hash)
+		if err != nil {
+			log.Fatal(err)
+		}
+		buffer.Write(hashBytes)
+	}
+	return buffer.Bytes()
+}
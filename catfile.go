@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// resolveBlobPath resolves "<tree-ish>:<path>" and ":<path>", the index
+// entry of a path, to the blob or tree there with its mode and path; ok
+// is false for names without a path
+func (repo *Repository) resolveBlobPath(name string) (string, uint32, string, bool) {
+	rev, entryPath, ok := splitRevisionPath(name)
+	if !ok {
+		return "", 0, "", false
+	}
+	hash, mode, entryPath, found := repo.lookupRevisionPath(rev, entryPath)
+	if !found {
+		if rev == "" {
+			log.Fatalf("fatal: path '%s' does not exist (neither on disk nor in the index)", entryPath)
+		}
+		repo.resolveRevision(rev)
+		log.Fatalf("fatal: path '%s' does not exist in '%s'", entryPath, rev)
+	}
+	return hash, mode, entryPath, true
+}
+
+// lookupRevisionPath finds what is at a path of the tree of rev, or with
+// no rev in the index, at stage 0 unless the path starts with "<n>:". It
+// returns the object with its mode and the path without a leading slash
+// or stage; ok is false when there is nothing there.
+func (repo *Repository) lookupRevisionPath(rev string, entryPath string) (string, uint32, string, bool) {
+	if rev == "" {
+		stage := 0
+		if len(entryPath) >= 2 && entryPath[0] >= '0' && entryPath[0] <= '3' && entryPath[1] == ':' {
+			stage, entryPath = int(entryPath[0]-'0'), entryPath[2:]
+		}
+		entryPath = strings.TrimPrefix(entryPath, "/")
+		for _, entry := range repo.readIndex().entries {
+			if entry.path == entryPath && entry.stage() == stage {
+				return entry.hash, entry.mode, entryPath, true
+			}
+		}
+		return "", 0, entryPath, false
+	}
+	entryPath = strings.TrimSuffix(strings.TrimPrefix(entryPath, "/"), "/")
+	hash, ok := repo.lookupRevision(rev)
+	if !ok {
+		return "", 0, entryPath, false
+	}
+	tree, ok := repo.peelObject(hash, "tree")
+	if !ok {
+		return "", 0, entryPath, false
+	}
+	if entryPath == "" {
+		return tree, fileModeTree, "", true
+	}
+	dir, base := "", entryPath
+	if slash := strings.LastIndexByte(entryPath, '/'); slash >= 0 {
+		dir, base = entryPath[:slash], entryPath[slash+1:]
+	}
+	if dir != "" {
+		tree = repo.treeAtPath(tree, dir)
+	}
+	if tree != "" {
+		for _, entry := range repo.readTreeEntries(tree) {
+			if entry.name == base {
+				return entry.hash, parseFileMode(entry.mode), entryPath, true
+			}
+		}
+	}
+	return "", 0, entryPath, false
+}
+
+// catFileConverted prints a blob as cat-file --textconv or --filters do:
+// through the textconv command of the diff driver of its path, as it is
+// when there is none, or as checkout writes it to the worktree, with line
+// endings converted and the smudge filter applied. Only regular files are
+// converted.
+func (repo *Repository) catFileConverted(name string, forcedPath string, option string) {
+	hash, mode, objectPath, withPath := repo.resolveBlobPath(name)
+	if !withPath {
+		hash, mode = repo.resolveRevision(name), fileModeRegular
+	}
+	if forcedPath != "" {
+		objectPath, withPath = forcedPath, true
+	}
+	if !withPath {
+		log.Fatalf("fatal: <object>:<path> required, only <object> '%s' given", name)
+	}
+	header, content := repo.readObject(hash)
+	if objectPath == "" {
+		// the root tree, for which there are no attributes
+		os.Stdout.Write(content)
+		return
+	}
+	regular := mode == fileModeRegular || mode == fileModeExecutable
+	switch option {
+	case "textconv":
+		if driver, command, ok := repo.textconvDriver(objectPath); ok && regular && header.objectType == "blob" {
+			content = repo.convertText(driver, command, objectPath, hash, content)
+		}
+	case "filters":
+		if header.objectType != "blob" {
+			log.Fatalf("fatal: blob expected for %s", objectPath)
+		}
+		if regular {
+			content = repo.convertToWorktree(objectPath, content)
+		}
+	}
+	repo.setupPager("cat-file")
+	os.Stdout.Write(content)
+}
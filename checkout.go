@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// flattenTree maps the path of every non-tree entry below treeHash to its
+// entry, an empty hash gives an empty map (e.g. for an unborn HEAD)
+func (repo *Repository) flattenTree(treeHash string) map[string]treeEntry {
+	entries := make(map[string]treeEntry)
+	if treeHash == "" {
+		return entries
+	}
+	walker := newTreeWalker(repo, treeHash)
+	for {
+		entryPath, entry, ok := walker.next()
+		if !ok {
+			return entries
+		}
+		if entry.mode != "40000" {
+			entries[entryPath] = entry
+		}
+	}
+}
+
+func parseFileMode(mode string) uint32 {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		log.Fatalf("fatal: invalid file mode %s", mode)
+	}
+	return uint32(value)
+}
+
+func (repo *Repository) headTree() string {
+	headHash, ok := repo.resolveRef("HEAD")
+	if !ok {
+		// unborn branch
+		return ""
+	}
+	return repo.readCommitObject(headHash).tree
+}
+
+// isWorktreeClean reports whether the worktree file still has the content
+// recorded in the index entry; a missing file counts as clean
+func (repo *Repository) isWorktreeClean(index *gitIndex, entry indexEntry) bool {
+	info, err := os.Lstat(repo.worktreePath(entry.path))
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if index.isUpToDate(entry, info) {
+		return true
+	}
+	if index.modes.entryMode(info, entry.mode) != entry.mode {
+		return false
+	}
+	return repo.worktreeBlobHash(entry.path, info) == entry.hash
+}
+
+func (repo *Repository) checkout(target string, jobs int, quiet bool, progress Progress) {
+	targetBranch := ""
+	trackedRemote := ""
+	var targetCommit string
+	if hash, ok := repo.resolveRef("refs/heads/" + target); ok {
+		targetBranch = target
+		targetCommit = hash
+	} else if remoteRef, ok := repo.uniqueRemoteBranch(target); ok {
+		// like git, "checkout x" creates x from the only remote having it
+		targetBranch = target
+		trackedRemote = remoteRef
+		targetCommit = repo.peelToCommit(repo.resolveRevision(remoteRef))
+	} else {
+		targetCommit = repo.peelToCommit(repo.resolveRevision(target))
+	}
+	oldTree := repo.flattenTree(repo.headTree())
+	newTree := repo.flattenTree(repo.readCommitObject(targetCommit).tree)
+	index := repo.lockIndex()
+	indexed := make(map[string]indexEntry)
+	for _, entry := range index.entries {
+		if entry.stage() != 0 {
+			log.Fatal("error: you need to resolve your current index first")
+		}
+		indexed[entry.path] = entry
+	}
+
+	changedPaths := make([]string, 0)
+	for entryPath, entry := range newTree {
+		if oldTree[entryPath] != entry {
+			changedPaths = append(changedPaths, entryPath)
+		}
+	}
+	for entryPath := range oldTree {
+		if _, ok := newTree[entryPath]; !ok {
+			changedPaths = append(changedPaths, entryPath)
+		}
+	}
+	sort.Strings(changedPaths)
+	invalid := false
+	for _, entryPath := range changedPaths {
+		if _, ok := newTree[entryPath]; ok && !repo.isValidIndexPath(entryPath) {
+			fmt.Fprintf(os.Stderr, "error: invalid path '%s'\n", entryPath)
+			invalid = true
+		}
+	}
+	if invalid {
+		repo.releaseIndex(index)
+		os.Exit(1)
+	}
+
+	// a sparse checkout leaves the files of skip-worktree entries out of the
+	// worktree, they are neither written, removed nor looked at. With cones
+	// the paths outside of them are left out after the switch, otherwise
+	// the entries keep their bits.
+	sparse := repo.config.getBool("core.sparseCheckout", false)
+	cones, coned := repo.readSparseCones()
+	wasLeftOut := func(entryPath string) bool {
+		entry, ok := indexed[entryPath]
+		return sparse && ok && entry.skipWorktree()
+	}
+	leftOut := func(entryPath string) bool {
+		if coned {
+			return !cones.includes(entryPath)
+		}
+		return wasLeftOut(entryPath)
+	}
+
+	// refuse to switch when that would lose staged, modified or untracked content
+	matcher := newIgnoreMatcher(repo)
+	overwritten := make([]string, 0)
+	untracked := make([]string, 0)
+	for _, entryPath := range changedPaths {
+		oldEntry, inOld := oldTree[entryPath]
+		newEntry, inNew := newTree[entryPath]
+		indexEntry, inIndex := indexed[entryPath]
+		if !inIndex {
+			if inOld {
+				// staged deletion, fine unless the target brings the path back
+				if inNew {
+					overwritten = append(overwritten, entryPath)
+				}
+				continue
+			}
+			if _, err := os.Lstat(repo.worktreePath(entryPath)); err == nil && !matcher.isPathIgnored(entryPath, false) {
+				untracked = append(untracked, entryPath)
+			}
+			continue
+		}
+		matchesOld := inOld && indexEntry.hash == oldEntry.hash && indexEntry.mode == parseFileMode(oldEntry.mode)
+		matchesNew := inNew && indexEntry.hash == newEntry.hash && indexEntry.mode == parseFileMode(newEntry.mode)
+		if (!matchesOld && !matchesNew) || !wasLeftOut(entryPath) && !repo.isWorktreeClean(index, indexEntry) {
+			overwritten = append(overwritten, entryPath)
+		}
+	}
+	if len(overwritten) > 0 || len(untracked) > 0 {
+		if len(overwritten) > 0 {
+			fmt.Fprintln(os.Stderr, "error: Your local changes to the following files would be overwritten by checkout:")
+			for _, entryPath := range overwritten {
+				fmt.Fprintf(os.Stderr, "\t%s\n", entryPath)
+			}
+			fmt.Fprintln(os.Stderr, "Please commit your changes or stash them before you switch branches.")
+		}
+		if len(untracked) > 0 {
+			fmt.Fprintln(os.Stderr, "error: The following untracked working tree files would be overwritten by checkout:")
+			for _, entryPath := range untracked {
+				fmt.Fprintf(os.Stderr, "\t%s\n", entryPath)
+			}
+			fmt.Fprintln(os.Stderr, "Please move or remove them before you switch branches.")
+		}
+		fmt.Fprintln(os.Stderr, "Aborting")
+		repo.releaseIndex(index)
+		os.Exit(1)
+	}
+
+	toWrite := make([]string, 0)
+	for _, entryPath := range changedPaths {
+		if _, ok := newTree[entryPath]; ok {
+			if leftOut(entryPath) && !wasLeftOut(entryPath) {
+				repo.removeWorktreeFile(entryPath)
+			}
+			toWrite = append(toWrite, entryPath)
+		} else {
+			if !wasLeftOut(entryPath) {
+				repo.removeWorktreeFile(entryPath)
+			}
+			index.removePath(entryPath)
+		}
+	}
+	// inflate and write in parallel, index updates are applied in order afterwards
+	written := make([]indexEntry, len(toWrite))
+	progress.Start("Updating files", len(toWrite))
+	runParallel(jobs, len(toWrite), func(i int) {
+		entryPath := toWrite[i]
+		if leftOut(entryPath) {
+			written[i] = indexEntry{path: entryPath, hash: newTree[entryPath].hash, mode: parseFileMode(newTree[entryPath].mode)}
+		} else {
+			written[i] = repo.checkoutEntry(entryPath, newTree[entryPath])
+		}
+		// the skip-worktree bit stays, assume-unchanged goes with the update
+		if leftOut(entryPath) || !coned && indexed[entryPath].skipWorktree() {
+			written[i].extendedFlags |= indexExtendedSkipWorktree
+		}
+		progress.Add(1, int64(written[i].size))
+	})
+	progress.Stop()
+	for _, entry := range written {
+		index.addEntry(entry)
+	}
+	repo.writeIndex(index)
+	if repo.config.getBool("core.ignoreCase", false) && !quiet {
+		// on a filesystem that ignores case, paths differing only in case
+		// were written to the same file
+		paths := make([]string, 0, len(newTree))
+		for entryPath := range newTree {
+			paths = append(paths, entryPath)
+		}
+		warnCaseCollisions(paths)
+	}
+
+	currentBranch, _ := repo.headBranch()
+	oldHead, hasHead := repo.resolveRef("HEAD")
+	from := currentBranch
+	if !hasHead {
+		oldHead = nullHash
+	} else if from == "" {
+		from = oldHead
+	}
+	moving := "checkout: moving from " + from + " to " + target
+	if targetBranch != "" {
+		if trackedRemote != "" {
+			repo.updateRefLogged("refs/heads/"+targetBranch, targetCommit, "branch: Created from "+shortRefName(trackedRemote))
+			repo.setUpstream(targetBranch, trackedRemote)
+		}
+		repo.updateSymbolicRef("HEAD", "refs/heads/"+targetBranch)
+		repo.logRefUpdate("HEAD", oldHead, targetCommit, moving)
+		if quiet {
+			return
+		}
+		switch {
+		case trackedRemote != "":
+			fmt.Fprintf(os.Stderr, "Switched to a new branch '%s'\n", targetBranch)
+		case currentBranch == targetBranch:
+			fmt.Fprintf(os.Stderr, "Already on '%s'\n", targetBranch)
+		default:
+			fmt.Fprintf(os.Stderr, "Switched to branch '%s'\n", targetBranch)
+		}
+		if info, ok := repo.tracking(targetBranch); ok && trackedRemote == "" {
+			fmt.Println(describeTracking(info))
+		}
+		return
+	}
+	repo.updateRef("HEAD", targetCommit)
+	repo.logRefUpdate("HEAD", oldHead, targetCommit, moving)
+	if quiet {
+		return
+	}
+	subject := strings.SplitN(repo.readCommitObject(targetCommit).commitMessage, "\n", 2)[0]
+	fmt.Fprintf(os.Stderr, "HEAD is now at %s %s\n", targetCommit[:7], subject)
+}
+
+func (repo *Repository) removeWorktreeFile(relativePath string) {
+	if err := os.Remove(repo.worktreePath(relativePath)); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	// drop directories that became empty, up to the worktree root
+	dir := filepath.Dir(repo.worktreePath(relativePath))
+	for dir != filepath.Clean(repo.workTree) {
+		if os.Remove(dir) != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (repo *Repository) checkoutEntry(relativePath string, entry treeEntry) indexEntry {
+	filePath := repo.worktreePath(relativePath)
+	mode := parseFileMode(entry.mode)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.RemoveAll(filePath); err != nil {
+		log.Fatal(err)
+	}
+	if mode == fileModeGitlink {
+		// submodules are not cloned, only their directory is created
+		if err := os.Mkdir(filePath, 0777); err != nil {
+			log.Fatal(err)
+		}
+		return indexEntry{path: relativePath, hash: entry.hash, mode: mode}
+	}
+	if !repo.checkoutBlobStream(relativePath, mode, entry.hash) {
+		_, content := repo.readObject(entry.hash)
+		repo.createWorktreeFile(relativePath, mode, content)
+	}
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return newIndexEntry(relativePath, entry.hash, mode, info)
+}
+
+// createWorktreeFile creates a file of the given mode that does not exist
+// yet, converting the line endings of blobs. Without core.symlinks a
+// symlink is written as a file holding its target, which add then keeps
+// staging as a symlink.
+func (repo *Repository) createWorktreeFile(relativePath string, mode uint32, content []byte) {
+	filePath := repo.worktreePath(relativePath)
+	if mode == fileModeSymlink {
+		if !repo.worktreeModes().noSymlinks {
+			if err := os.Symlink(string(content), filePath); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	} else {
+		content = repo.convertToWorktree(relativePath, content)
+	}
+	permissions := os.FileMode(0666)
+	if mode == fileModeExecutable {
+		permissions = 0777
+	}
+	if err := ioutil.WriteFile(filePath, content, permissions); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkoutPaths writes the files the pathspecs select from the index back
+// to the worktree, or with a tree-ish from that tree to both the index and
+// the worktree. Like git, nothing is written when a pathspec matches no
+// file or, from the index, a selected path has conflicts.
+func (repo *Repository) checkoutPaths(treeish string, pathspecs []pathspec) {
+	index := repo.lockIndex()
+	sources := make(map[string]treeEntry)
+	if treeish != "" {
+		for entryPath, entry := range repo.flattenTree(repo.resolveTreeish(treeish)) {
+			if matchesPathspecs(entryPath, pathspecs) {
+				sources[entryPath] = entry
+			}
+		}
+	}
+	failed := false
+	unmerged := make(map[string]bool)
+	for _, entry := range index.entries {
+		if treeish != "" || !matchesPathspecs(entry.path, pathspecs) || entry.skipWorktree() {
+			continue
+		}
+		if entry.stage() != 0 {
+			if !unmerged[entry.path] {
+				fmt.Fprintf(os.Stderr, "error: path '%s' is unmerged\n", entry.path)
+			}
+			unmerged[entry.path], failed = true, true
+			continue
+		}
+		sources[entry.path] = treeEntry{mode: fmt.Sprintf("%o", entry.mode), name: path.Base(entry.path), hash: entry.hash}
+	}
+	for _, spec := range pathspecs {
+		if spec.exclude {
+			continue
+		}
+		matched := false
+		for sourcePath := range sources {
+			matched = matched || spec.matches(sourcePath)
+		}
+		for unmergedPath := range unmerged {
+			matched = matched || spec.matches(unmergedPath)
+		}
+		if !matched {
+			fmt.Fprintf(os.Stderr, "error: pathspec '%s' did not match any file(s) known to git\n", spec.original)
+			failed = true
+		}
+	}
+	if failed {
+		repo.releaseIndex(index)
+		os.Exit(1)
+	}
+	sourcePaths := make([]string, 0, len(sources))
+	for sourcePath := range sources {
+		sourcePaths = append(sourcePaths, sourcePath)
+	}
+	sort.Strings(sourcePaths)
+	for _, sourcePath := range sourcePaths {
+		if position, ok := index.find(sourcePath); ok && index.entries[position].hash == sources[sourcePath].hash {
+			if info, err := os.Lstat(repo.worktreePath(sourcePath)); err == nil && index.isUpToDate(index.entries[position], info) {
+				continue
+			}
+		}
+		index.addEntry(repo.checkoutEntry(sourcePath, sources[sourcePath]))
+	}
+	repo.writeIndex(index)
+}
+
+// checkoutOrphan points HEAD at a new unborn branch, first checking out
+// startPoint when given; the index and worktree are kept so they can
+// become the first commit of the branch
+func (repo *Repository) checkoutOrphan(branch string, startPoint string, jobs int, quiet bool, progress Progress) {
+	if !isValidBranchName(branch) {
+		log.Fatalf("fatal: '%s' is not a valid branch name", branch)
+	}
+	if _, exists := repo.resolveRef("refs/heads/" + branch); exists {
+		log.Fatalf("fatal: a branch named '%s' already exists", branch)
+	}
+	if startPoint != "" {
+		repo.checkout(startPoint, jobs, true, progress)
+	}
+	repo.updateSymbolicRef("HEAD", "refs/heads/"+branch)
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Switched to a new branch '%s'\n", branch)
+	}
+}
+
+// uniqueRemoteBranch finds refs/remotes/<remote>/<name> when target is not a
+// revision already and exactly one remote has such a branch
+func (repo *Repository) uniqueRemoteBranch(name string) (string, bool) {
+	if _, ok := repo.lookupRevision(name); ok {
+		return "", false
+	}
+	found := ""
+	for _, ref := range repo.listRefs("refs/remotes/") {
+		remote, branch, ok := strings.Cut(strings.TrimPrefix(ref, "refs/remotes/"), "/")
+		if !ok || branch != name || remote == "" {
+			continue
+		}
+		if found != "" {
+			return "", false
+		}
+		found = ref
+	}
+	return found, found != ""
+}
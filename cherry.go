@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+type cherryOptions struct {
+	verbose bool
+	abbrev  int // 0 for full object names
+}
+
+// cherry lists the commits of head missing from upstream, oldest first.
+// Commits whose change upstream already has under another commit, as told
+// by their patch ids, are marked "-", the others "+". Commits reachable
+// from limit are left out.
+func (repo *Repository) cherry(w io.Writer, upstream string, head string, limit string, options cherryOptions) {
+	upstreamHash := repo.peelToCommit(repo.resolveRevision(upstream))
+	headHash := repo.peelToCommit(repo.resolveRevision(head))
+	if upstreamHash == headHash {
+		return
+	}
+	inHead := repo.reachableCommits(headHash)
+	inUpstream := repo.reachableCommits(upstreamHash)
+
+	patchOptions := patchIDOptions{}
+	upstreamIDs := make(map[string]bool)
+	iter := newCommitIter(repo, []string{upstreamHash}, commitOrderDate, false)
+	for {
+		hash, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		if inHead[hash] || len(commit.parents) > 1 {
+			continue
+		}
+		upstreamIDs[repo.commitPatchID(hash, patchOptions)] = true
+	}
+
+	exclude := inUpstream
+	if limit != "" {
+		exclude = make(map[string]bool)
+		for hash := range inUpstream {
+			exclude[hash] = true
+		}
+		for hash := range repo.reachableCommits(repo.peelToCommit(repo.resolveRevision(limit))) {
+			exclude[hash] = true
+		}
+	}
+	commits := make([]string, 0)
+	iter = newCommitIter(repo, []string{headHash}, commitOrderDate, false)
+	for {
+		hash, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		if !exclude[hash] && len(commit.parents) <= 1 {
+			commits = append(commits, hash)
+		}
+	}
+	reverseHashes(commits)
+
+	for _, hash := range commits {
+		sign := '+'
+		if upstreamIDs[repo.commitPatchID(hash, patchOptions)] {
+			sign = '-'
+		}
+		name := hash
+		if options.abbrev > 0 && options.abbrev < len(hash) {
+			name = hash[:options.abbrev]
+		}
+		if options.verbose {
+			subject, _ := splitCommitMessage(repo.readCommitObject(hash).commitMessage)
+			fmt.Fprintf(w, "%c %s %s\n", sign, name, subject)
+		} else {
+			fmt.Fprintf(w, "%c %s\n", sign, name)
+		}
+	}
+}
+
+// defaultCherryUpstream is the upstream of the current branch
+func (repo *Repository) defaultCherryUpstream() string {
+	if branch, ok := repo.headBranch(); ok {
+		if upstream, ok := repo.upstreamOf(branch); ok {
+			return upstream
+		}
+	}
+	log.Fatal("Could not find a tracked remote branch, please specify <upstream> manually.")
+	return ""
+}
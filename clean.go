@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+type cleanIgnoreMode int
+
+const (
+	// ignored files are kept
+	cleanUntrackedOnly cleanIgnoreMode = iota
+	// -x: ignore rules are not used, ignored files are removed too
+	cleanIgnoredToo
+	// -X: only ignored files are removed
+	cleanIgnoredOnly
+)
+
+type cleanOptions struct {
+	directories bool      // -d: remove untracked directories as a whole
+	force       countFlag // -f given twice also removes nested repositories
+	ignoreMode  cleanIgnoreMode
+	pathspecs   []pathspec
+}
+
+// cleanCandidates lists the untracked paths clean would remove, with
+// directories carrying a trailing "/", following the rules of git clean
+func (repo *Repository) cleanCandidates(options cleanOptions) []string {
+	index := repo.readIndex()
+	trackedFiles := make(map[string]bool)
+	trackedDirs := make(map[string]bool)
+	for _, entry := range index.entries {
+		trackedFiles[entry.path] = true
+		for dir := path.Dir(entry.path); dir != "."; dir = path.Dir(dir) {
+			trackedDirs[dir] = true
+		}
+	}
+	matcher := newIgnoreMatcher(repo)
+	candidates := make([]string, 0)
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := os.ReadDir(repo.worktreePath(dir))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entry := range entries {
+			entryPath := path.Join(dir, repo.worktreeName(entry.Name()))
+			if trackedFiles[entryPath] || entry.Name() == ".git" {
+				continue
+			}
+			ignored := options.ignoreMode != cleanIgnoredToo && matcher.isIgnored(entryPath, entry.IsDir())
+			if !entry.IsDir() {
+				if ignored == (options.ignoreMode == cleanIgnoredOnly) || options.ignoreMode == cleanIgnoredToo {
+					candidates = append(candidates, entryPath)
+				}
+				continue
+			}
+			if trackedDirs[entryPath] {
+				walk(entryPath)
+				continue
+			}
+			if _, err := os.Lstat(repo.worktreePath(entryPath + "/.git")); err == nil {
+				// nested repositories need -ff
+				if options.directories && options.force > 1 && options.ignoreMode != cleanIgnoredOnly {
+					candidates = append(candidates, entryPath+"/")
+				}
+				continue
+			}
+			if repo.isCleanedWhole(entryPath, ignored, options, matcher) {
+				candidates = append(candidates, entryPath+"/")
+				continue
+			}
+			if pathspecsLeadInto(entryPath, options.pathspecs) || repo.isCleanedInParts(entryPath, ignored, options, matcher) {
+				walk(entryPath)
+			}
+		}
+	}
+	walk("")
+	selected := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if matchesPathspecs(strings.TrimSuffix(candidate, "/"), options.pathspecs) {
+			selected = append(selected, candidate)
+		}
+	}
+	return selected
+}
+
+// isCleanedWhole decides whether clean -d removes an untracked directory
+// in one go: always with -x, when it holds nothing ignored by default and
+// when everything in it is ignored with -X
+func (repo *Repository) isCleanedWhole(dir string, ignored bool, options cleanOptions, matcher *ignoreMatcher) bool {
+	if !options.directories {
+		return false
+	}
+	switch options.ignoreMode {
+	case cleanIgnoredToo:
+		return true
+	case cleanIgnoredOnly:
+		if ignored {
+			return true
+		}
+		hasIgnored, hasUntracked := repo.summarizeUntrackedDir(dir, matcher)
+		return hasIgnored && !hasUntracked
+	}
+	if ignored {
+		return false
+	}
+	hasIgnored, _ := repo.summarizeUntrackedDir(dir, matcher)
+	return !hasIgnored
+}
+
+// isCleanedInParts decides whether clean descends into an untracked
+// directory it does not remove whole: with -d to remove everything around
+// the ignored files kept, and with -X to reach the ignored files, unless
+// the directory holds nothing else
+func (repo *Repository) isCleanedInParts(dir string, ignored bool, options cleanOptions, matcher *ignoreMatcher) bool {
+	if ignored {
+		return false
+	}
+	switch options.ignoreMode {
+	case cleanUntrackedOnly:
+		return options.directories
+	case cleanIgnoredOnly:
+		hasIgnored, hasUntracked := repo.summarizeUntrackedDir(dir, matcher)
+		return !hasIgnored || hasUntracked
+	}
+	return false
+}
+
+// summarizeUntrackedDir reports whether an untracked directory contains
+// ignored and not ignored files
+func (repo *Repository) summarizeUntrackedDir(dir string, matcher *ignoreMatcher) (hasIgnored bool, hasUntracked bool) {
+	entries, err := os.ReadDir(repo.worktreePath(dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, entry := range entries {
+		entryPath := path.Join(dir, repo.worktreeName(entry.Name()))
+		switch {
+		case matcher.isIgnored(entryPath, entry.IsDir()):
+			hasIgnored = true
+		case entry.IsDir():
+			childIgnored, childUntracked := repo.summarizeUntrackedDir(entryPath, matcher)
+			hasIgnored = hasIgnored || childIgnored
+			hasUntracked = hasUntracked || childUntracked
+		default:
+			hasUntracked = true
+		}
+	}
+	return hasIgnored, hasUntracked
+}
+
+// clean removes the candidates, or only lists them for a dry run; in
+// interactive mode every path is confirmed on the terminal first
+func (repo *Repository) clean(candidates []string, dryRun bool, interactive bool, quiet bool) {
+	var answers *bufio.Reader
+	if interactive {
+		answers = bufio.NewReader(os.Stdin)
+	}
+	for _, candidate := range candidates {
+		displayed := quotePath(candidate)
+		if dryRun {
+			if !quiet {
+				fmt.Printf("Would remove %s\n", displayed)
+			}
+			continue
+		}
+		if interactive {
+			fmt.Printf("Remove %s [y/N]? ", displayed)
+			answer, err := answers.ReadString('\n')
+			if err != nil && answer == "" {
+				fmt.Println()
+				return
+			}
+			if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+				continue
+			}
+		}
+		if err := os.RemoveAll(repo.worktreePath(strings.TrimSuffix(candidate, "/"))); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to remove %s: %s\n", displayed, err)
+			continue
+		}
+		if !quiet {
+			fmt.Printf("Removing %s\n", displayed)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	colorReset       = "\033[m"
+	colorRed         = "\033[31m"
+	colorGreen       = "\033[32m"
+	colorYellow      = "\033[33m"
+	colorBlue        = "\033[34m"
+	colorMagenta     = "\033[35m"
+	colorCyan        = "\033[36m"
+	colorBoldRed     = "\033[1;31m"
+	colorBoldGreen   = "\033[1;32m"
+	colorBoldYellow  = "\033[1;33m"
+	colorBoldBlue    = "\033[1;34m"
+	colorBoldMagenta = "\033[1;35m"
+	colorBoldCyan    = "\033[1;36m"
+)
+
+// colorOption is the value of the global --color option: "always",
+// "never", "auto" or empty when not given
+var colorOption string
+
+// useColor decides whether output of a command is colored: the --color
+// option wins, then NO_COLOR, then color.<command> and color.ui from the
+// config; "auto" colors only when stdout is a terminal
+func (repo *Repository) useColor(command string) bool {
+	setting := colorOption
+	if setting == "" && os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if setting == "" && repo != nil {
+		var ok bool
+		if setting, ok = repo.config.get("color." + command); !ok {
+			setting, _ = repo.config.get("color.ui")
+		}
+	}
+	switch strings.ToLower(setting) {
+	case "always":
+		return true
+	case "never", "false", "no", "off", "0":
+		return false
+	case "", "auto", "true", "yes", "on", "1":
+		// the pager only runs when stdout was a terminal
+		return pagerProcess != nil || isTerminal(os.Stdout)
+	}
+	log.Fatalf("fatal: invalid color value: %s", setting)
+	return false
+}
+
+// colorize wraps text in an ANSI color when enabled
+func colorize(enabled bool, color string, text string) string {
+	if !enabled || text == "" {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// parseColorSpec turns a color setting such as "bold red", "ul #ff0010" or
+// "reverse 208 blue" into its ANSI sequence: attributes, then the
+// foreground and the background color
+func parseColorSpec(spec string) (string, bool) {
+	names := []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+	attributes := map[string]string{"bold": "1", "dim": "2", "italic": "3", "ul": "4", "blink": "5", "reverse": "7", "strike": "9"}
+	codes := make([]string, 0)
+	colors := make([]string, 0, 2)
+	for _, word := range strings.Fields(strings.ToLower(spec)) {
+		if code, ok := attributes[strings.TrimPrefix(word, "no")]; ok {
+			if strings.HasPrefix(word, "no") {
+				// "nobold" and friends reset the attribute
+				code = "2" + code
+				if code == "21" {
+					code = "22"
+				}
+			}
+			codes = append(codes, code)
+			continue
+		}
+		if word == "reset" {
+			codes = append(codes, "")
+			continue
+		}
+		if len(colors) == 2 {
+			return "", false
+		}
+		// 3x are foreground colors, 4x background ones
+		base := 30 + 10*len(colors)
+		color := ""
+		switch {
+		case word == "normal", word == "default":
+			if word == "default" {
+				color = strconv.Itoa(base + 9)
+			}
+		case strings.HasPrefix(word, "#") && len(word) == 7:
+			rgb, err := strconv.ParseUint(word[1:], 16, 32)
+			if err != nil {
+				return "", false
+			}
+			color = fmt.Sprintf("%d;2;%d;%d;%d", base+8, rgb>>16, rgb>>8&0xff, rgb&0xff)
+		default:
+			if number, err := strconv.Atoi(word); err == nil && number >= 0 && number < 256 {
+				color = fmt.Sprintf("%d;5;%d", base+8, number)
+				break
+			}
+			found := false
+			for i, name := range names {
+				if word == name {
+					color, found = strconv.Itoa(base+i), true
+				} else if word == "bright"+name {
+					color, found = strconv.Itoa(base+60+i), true
+				}
+			}
+			if !found {
+				return "", false
+			}
+		}
+		colors = append(colors, color)
+	}
+	for _, color := range colors {
+		if color != "" {
+			codes = append(codes, color)
+		}
+	}
+	if len(codes) == 0 {
+		return "", true
+	}
+	return "\033[" + strings.Join(codes, ";") + "m", true
+}
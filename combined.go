@@ -0,0 +1,528 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// mergeChanges lists the paths of a merge commit that differ from every
+// parent, each as its changes from the parents in order
+func (repo *Repository) mergeChanges(commit commitObject) [][]fileChange {
+	var first []fileChange
+	others := make([]map[string]fileChange, 0, len(commit.parents)-1)
+	for i, parent := range commit.parents {
+		changes := repo.diffTrees(repo.readCommitObject(parent).tree, commit.tree)
+		if i == 0 {
+			first = changes
+			continue
+		}
+		byPath := make(map[string]fileChange, len(changes))
+		for _, change := range changes {
+			byPath[change.path] = change
+		}
+		others = append(others, byPath)
+	}
+	merged := make([][]fileChange, 0)
+	for _, change := range first {
+		changes := []fileChange{change}
+		for _, byPath := range others {
+			other, ok := byPath[change.path]
+			if !ok {
+				break
+			}
+			changes = append(changes, other)
+		}
+		if len(changes) == len(commit.parents) {
+			merged = append(merged, changes)
+		}
+	}
+	return merged
+}
+
+// combinedLost is a line some parents have where the result has none
+type combinedLost struct {
+	text    string
+	parents uint // bit n set for parent n
+}
+
+// combinedLine is a line of the merge result, as combine-diff.c of git
+// keeps it: the parents lacking it, the parent lines lost before it and
+// where every parent is at it. Two more lines follow the result: one
+// holding the lines lost at the end of the file, one where the parents end.
+type combinedLine struct {
+	text        string
+	added       uint // bit n set when parent n lacks the line
+	lost        []combinedLost
+	parentLines []int // the line of each parent shown first when a hunk starts here
+	shown       bool  // part of a hunk
+	noPreDelete bool  // context before a hunk, whose lost lines belong to no hunk
+}
+
+// coalesceLost merges the lines lost from parent n into those lost from
+// the earlier parents, lines lost from both being told once via their
+// longest common subsequence
+func coalesceLost(base []combinedLost, lost []string, n int) []combinedLost {
+	if len(lost) == 0 {
+		return base
+	}
+	const (
+		fromBase = iota
+		fromLost
+		matched
+	)
+	lengths := make([][]int, len(base)+1)
+	directions := make([][]int, len(base)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(lost)+1)
+		directions[i] = make([]int, len(lost)+1)
+		directions[i][0] = fromBase
+	}
+	for j := 1; j <= len(lost); j++ {
+		directions[0][j] = fromLost
+	}
+	for i := 1; i <= len(base); i++ {
+		for j := 1; j <= len(lost); j++ {
+			switch {
+			case base[i-1].text == lost[j-1]:
+				lengths[i][j], directions[i][j] = lengths[i-1][j-1]+1, matched
+			case lengths[i][j-1] >= lengths[i-1][j]:
+				lengths[i][j], directions[i][j] = lengths[i][j-1], fromLost
+			default:
+				lengths[i][j], directions[i][j] = lengths[i-1][j], fromBase
+			}
+		}
+	}
+	reversed := make([]combinedLost, 0, len(base)+len(lost))
+	for i, j := len(base), len(lost); i != 0 || j != 0; {
+		switch directions[i][j] {
+		case matched:
+			reversed = append(reversed, combinedLost{base[i-1].text, base[i-1].parents | 1<<n})
+			i, j = i-1, j-1
+		case fromLost:
+			reversed = append(reversed, combinedLost{lost[j-1], 1 << n})
+			j--
+		default:
+			reversed = append(reversed, base[i-1])
+			i--
+		}
+	}
+	coalesced := make([]combinedLost, len(reversed))
+	for i, line := range reversed {
+		coalesced[len(reversed)-1-i] = line
+	}
+	return coalesced
+}
+
+// combineParent records how parent n differs from the result
+func combineParent(lines []combinedLine, result []string, parent []string, n int) {
+	pending := make([][]string, len(lines))
+	for _, hunk := range diffLines(parent, result).hunks(0) {
+		// lost lines hang on the line after them
+		bucket := hunk.newStart - 1
+		if hunk.newCount == 0 {
+			bucket = hunk.newStart
+		}
+		added := hunk.newStart - 1
+		for _, line := range hunk.lines {
+			switch line.op {
+			case '-':
+				pending[bucket] = append(pending[bucket], strings.TrimSuffix(line.text, "\n"))
+			case '+':
+				lines[added].added |= 1 << n
+				added++
+			}
+		}
+	}
+	parentLine := 1
+	for i := range lines[:len(lines)-1] {
+		line := &lines[i]
+		line.parentLines[n] = parentLine
+		line.lost = coalesceLost(line.lost, pending[i], n)
+		for _, lost := range line.lost {
+			if lost.parents&(1<<n) != 0 {
+				parentLine++
+			}
+		}
+		if i < len(result) && line.added&(1<<n) == 0 {
+			parentLine++
+		}
+	}
+	lines[len(lines)-1].parentLines[n] = parentLine
+}
+
+// reuseCombinedParent copies what parent j was found to differ in to
+// parent i, which has the same content
+func reuseCombinedParent(lines []combinedLine, i int, j int) {
+	for k := range lines {
+		line := &lines[k]
+		line.parentLines[i] = line.parentLines[j]
+		for l := range line.lost {
+			if line.lost[l].parents&(1<<j) != 0 {
+				line.lost[l].parents |= 1 << i
+			}
+		}
+		if line.added&(1<<j) != 0 {
+			line.added |= 1 << i
+		}
+	}
+}
+
+// hunkTail is where the context after a hunk ending before end starts: a
+// last line shown only for the lines lost before it is context already
+func hunkTail(lines []combinedLine, begin int, end int) int {
+	if begin+1 <= end && lines[end-1].added == 0 {
+		return end - 1
+	}
+	return end
+}
+
+// markCombinedHunks decides which lines are shown: the changed ones and
+// the context around them. Dense, as --cc asks, hunks where the result
+// takes one side as it is are left out.
+func markCombinedHunks(lines []combinedLine, parents int, dense bool, context int) bool {
+	all := uint(1)<<parents - 1
+	last := len(lines) - 2
+	for i := range lines[:last+1] {
+		lines[i].shown = lines[i].added&all != 0 || len(lines[i].lost) > 0
+	}
+	if !dense {
+		return giveCombinedContext(lines, context)
+	}
+	for i := 0; i <= last; {
+		for i <= last && !lines[i].shown {
+			i++
+		}
+		if i > last {
+			break
+		}
+		begin := i
+		end := i + 1
+		for ; end <= last; end++ {
+			if lines[end].shown {
+				continue
+			}
+			// an interesting line within context goes on with the hunk
+			lookahead := hunkTail(lines, begin, end) + context
+			if lookahead > last+1 {
+				lookahead = last + 1
+			}
+			continued := false
+			for lookahead > 0 {
+				lookahead--
+				if lookahead < end {
+					break
+				}
+				if lines[lookahead].shown {
+					continued = true
+					break
+				}
+			}
+			if !continued {
+				break
+			}
+			end = lookahead
+		}
+		// the hunk counts when the parents the lines differ from are not
+		// the same everywhere, or are all of them
+		var sameParents uint
+		interesting := false
+		for j := begin; j < end && !interesting; j++ {
+			parentSets := []uint{lines[j].added & all}
+			for _, lost := range lines[j].lost {
+				parentSets = append(parentSets, lost.parents)
+			}
+			for _, parentSet := range parentSets {
+				switch {
+				case parentSet == 0:
+				case sameParents == 0:
+					sameParents = parentSet
+				case sameParents != parentSet:
+					interesting = true
+				}
+			}
+		}
+		if !interesting && sameParents != all {
+			for j := begin; j < end; j++ {
+				lines[j].shown = false
+			}
+		}
+		i = end
+	}
+	return giveCombinedContext(lines, context)
+}
+
+// giveCombinedContext shows context lines around the shown ones, joining
+// hunks less than a context apart, and tells whether any line is shown
+func giveCombinedContext(lines []combinedLine, context int) bool {
+	last := len(lines) - 2
+	next := func(i int, shown bool) int {
+		for i <= last && lines[i].shown != shown {
+			i++
+		}
+		return i
+	}
+	i := next(0, true)
+	if i > last {
+		return false
+	}
+	for i <= last {
+		j := i - context
+		if j < 0 {
+			j = 0
+		}
+		for ; j < i; j++ {
+			if !lines[j].shown {
+				lines[j].noPreDelete = true
+			}
+			lines[j].shown = true
+		}
+		for {
+			j = next(i, false)
+			if j > last {
+				return true
+			}
+			k := next(j, true)
+			j = hunkTail(lines, i, j)
+			if k < j+context {
+				for ; j < k; j++ {
+					lines[j].shown = true
+				}
+				i = k
+				continue
+			}
+			i = k
+			k = j + context
+			if k > last+1 {
+				k = last + 1
+			}
+			for ; j < k; j++ {
+				lines[j].shown = true
+			}
+			break
+		}
+	}
+	return true
+}
+
+// isHunkCommentLine tells a line combined diffs may show after a hunk
+// header: one starting with a letter, "_" or "$"
+func isHunkCommentLine(line string) bool {
+	if line == "" {
+		return false
+	}
+	c := line[0]
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$'
+}
+
+// writeCombinedLine writes a line after its parent columns, a carriage
+// return at its end left uncolored
+func writeCombinedLine(w io.Writer, color string, columns string, text string, reset string) {
+	if strings.HasSuffix(text, "\r") {
+		fmt.Fprintf(w, "%s%s%s%s\r\n", color, columns, strings.TrimSuffix(text, "\r"), reset)
+		return
+	}
+	fmt.Fprintf(w, "%s%s%s%s\n", color, columns, text, reset)
+}
+
+// writeCombinedHunks writes the shown lines in hunks, one column per parent
+// telling whether the line is added ("+") to it or removed ("-") from it
+func writeCombinedHunks(w io.Writer, lines []combinedLine, parents int, options diffOptions) {
+	colors := options.colors
+	last := len(lines) - 2
+	marker := strings.Repeat("@", parents+1)
+	for line := 0; ; {
+		comment := ""
+		for line <= last && !lines[line].shown {
+			if isHunkCommentLine(lines[line].text) {
+				comment = lines[line].text
+			}
+			line++
+		}
+		if line > last {
+			return
+		}
+		end := line + 1
+		for end <= last && lines[end].shown {
+			end++
+		}
+		resultCount := end - line
+		if end > last {
+			// the line after the result only holds lost lines
+			resultCount--
+		}
+		emptyContext := 0
+		if options.context == 0 {
+			for j := line; j < end; j++ {
+				if lines[j].added == 0 {
+					emptyContext++
+				}
+			}
+			resultCount -= emptyContext
+		}
+		fmt.Fprint(w, colors.frag, marker)
+		for n := 0; n < parents; n++ {
+			start := lines[line].parentLines[n]
+			fmt.Fprintf(w, " -%d,%d", start, lines[end].parentLines[n]-start-emptyContext)
+		}
+		fmt.Fprintf(w, " +%d,%d %s", line+1, resultCount, marker)
+		// like git, up to 40 bytes of the comment are shown, without the
+		// last non-space one
+		commentEnd := 0
+		for i := 0; i < 40 && i < len(comment); i++ {
+			if !isSpaceByte(comment[i]) {
+				commentEnd = i
+			}
+		}
+		if commentEnd > 0 {
+			fmt.Fprint(w, colors.reset, colors.context, " ", colors.reset, colors.function)
+		}
+		fmt.Fprint(w, comment[:commentEnd], colors.reset, "\n")
+
+		for line < end {
+			current := &lines[line]
+			line++
+			if !current.noPreDelete {
+				for _, lost := range current.lost {
+					columns := make([]byte, parents)
+					for n := range columns {
+						columns[n] = ' '
+						if lost.parents&(1<<n) != 0 {
+							columns[n] = '-'
+						}
+					}
+					writeCombinedLine(w, colors.old, string(columns), lost.text, colors.reset)
+				}
+			}
+			if line > last {
+				break
+			}
+			color := colors.new
+			if current.added == 0 {
+				// the line is only here for the lost lines before it
+				if options.context == 0 {
+					continue
+				}
+				color = colors.context
+			}
+			columns := make([]byte, parents)
+			for n := range columns {
+				columns[n] = ' '
+				if current.added&(1<<n) != 0 {
+					columns[n] = '+'
+				}
+			}
+			writeCombinedLine(w, color, string(columns), current.text, colors.reset)
+		}
+	}
+}
+
+// writeCombinedDiff writes the "diff --combined" section of a path of a
+// merge, or the "diff --cc" one when dense, from its changes from every
+// parent
+func (repo *Repository) writeCombinedDiff(w io.Writer, changes []fileChange, dense bool, options diffOptions) {
+	colors := options.colors
+	meta := func(format string, arguments ...interface{}) {
+		fmt.Fprintf(w, "%s%s%s\n", colors.meta, fmt.Sprintf(format, arguments...), colors.reset)
+	}
+	result := changes[0]
+	resultContent := repo.sideContent(result.newMode, result.newHash)
+	modeDiffers := false
+	parentContents := make([][]byte, len(changes))
+	for i, change := range changes {
+		parentContents[i] = repo.sideContent(change.oldMode, change.oldHash)
+		modeDiffers = modeDiffers || change.oldMode != result.newMode
+	}
+	var binary bool
+	if driver, command, ok := repo.textconvDriver(result.path); ok && options.textconv {
+		convert := func(mode uint32, hash string, content []byte) []byte {
+			if mode&0170000 != 0100000 {
+				return content
+			}
+			return repo.convertText(driver, command, result.path, hash, content)
+		}
+		resultContent = convert(result.newMode, result.newHash, resultContent)
+		for i, change := range changes {
+			parentContents[i] = convert(change.oldMode, change.oldHash, parentContents[i])
+		}
+	} else {
+		binary = repo.isBinaryDiff(result.path, append(parentContents, resultContent)...)
+	}
+
+	writeHeader := func(fileHeader bool) {
+		if dense {
+			meta("diff --cc %s", quotePath(result.path))
+		} else {
+			meta("diff --combined %s", quotePath(result.path))
+		}
+		names := make([]string, len(changes))
+		for i, change := range changes {
+			names[i] = abbreviateHash(change.oldHash)
+		}
+		meta("index %s..%s", strings.Join(names, ","), abbreviateHash(result.newHash))
+		deleted := result.newMode == 0
+		// added when no parent had it
+		added := !deleted
+		for _, change := range changes {
+			added = added && change.oldMode == 0
+		}
+		if modeDiffers {
+			if added {
+				meta("new file mode %06o", result.newMode)
+			} else {
+				modes := make([]string, len(changes))
+				for i, change := range changes {
+					modes[i] = fmt.Sprintf("%06o", change.oldMode)
+				}
+				if deleted {
+					meta("deleted file mode %s", strings.Join(modes, ","))
+				} else {
+					// like git, the color is only reset on this line
+					fmt.Fprintf(w, "mode %s..%06o%s\n", strings.Join(modes, ","), result.newMode, colors.reset)
+				}
+			}
+		}
+		if !fileHeader {
+			return
+		}
+		if added {
+			meta("--- /dev/null")
+		} else {
+			meta("--- %s", quotePath("a/"+result.path))
+		}
+		if deleted {
+			meta("+++ /dev/null")
+		} else {
+			meta("+++ %s", quotePath("b/"+result.path))
+		}
+	}
+	if binary {
+		writeHeader(false)
+		fmt.Fprintln(w, "Binary files differ")
+		return
+	}
+
+	resultLines := splitLines(resultContent)
+	lines := make([]combinedLine, len(resultLines)+2)
+	for i := range lines {
+		lines[i].parentLines = make([]int, len(changes))
+		if i < len(resultLines) {
+			lines[i].text = strings.TrimSuffix(resultLines[i], "\n")
+		}
+	}
+combining:
+	for i, change := range changes {
+		for j := 0; j < i; j++ {
+			if changes[j].oldHash == change.oldHash {
+				reuseCombinedParent(lines, i, j)
+				continue combining
+			}
+		}
+		combineParent(lines, resultLines, splitLines(parentContents[i]), i)
+	}
+	if !markCombinedHunks(lines, len(changes), dense, options.context) && !modeDiffers {
+		return
+	}
+	writeHeader(true)
+	writeCombinedHunks(w, lines, len(changes), options)
+}
@@ -0,0 +1,2524 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type command struct {
+	name         string
+	arguments    string // usage synopsis after the command name
+	summary      string
+	noRepository bool // runs without discovering a repository
+	hidden       bool // not listed in the usage text
+	// completesRefs makes shell completion offer branch and tag names for
+	// the command's arguments
+	completesRefs bool
+	// autoMaintenance runs "maintenance run --auto" after the command, for
+	// commands that can leave many loose objects or packs behind
+	autoMaintenance bool
+	// setup defines the command's flags and returns the function running
+	// it with the remaining arguments once they are parsed
+	setup func(flags *flag.FlagSet) commandRunner
+}
+
+type commandRunner func(repo *Repository, args []string)
+
+var commands []command
+
+// jsonOutput is set by the global --json option for commands that can
+// report structured data instead of text
+var jsonOutput bool
+
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func init() {
+	// assigned in init as the help command refers back to the table
+	commands = []command{
+		{name: "add", arguments: "[<options>] [-u | -A] [--no-all] [-N] [--] <pathspec>...", summary: "Add file contents to the index", autoMaintenance: true, setup: setupAdd},
+		{name: "am", arguments: "[-q] [<mbox>...]", summary: "Apply a series of patches from a mailbox", autoMaintenance: true, setup: setupAm},
+		{name: "__complete", arguments: "<word>...", summary: "Print completion candidates", noRepository: true, hidden: true, setup: setupComplete},
+		{name: "branch", arguments: "[-v | -vv] | (-u | --set-upstream-to) <upstream> [<branch>]", completesRefs: true, summary: "List branches", setup: setupBranch},
+		{name: "cat-file", arguments: "[-t | -s | -e | -p] <object> | (--textconv | --filters) [--path=<path>] <object>", summary: "Provide content or type and size information for repository objects", completesRefs: true, setup: setupCatFile},
+		{name: "check-ref-format", arguments: "[--normalize] [--allow-onelevel] [--refspec-pattern] <refname> | --branch <name>", summary: "Ensure that a reference name is well formed", noRepository: true, setup: setupCheckRefFormat},
+		{name: "checkout", arguments: "[<options>] <branch> | --orphan <new-branch> [<start-point>] | [<tree-ish>] [--] <pathspec>... | -p [--] [<pathspec>...]", summary: "Switch branches or move to a commit", completesRefs: true, setup: setupCheckout},
+		{name: "cherry", arguments: "[-v] [--abbrev[=<n>]] [<upstream> [<head> [<limit>]]]", summary: "Find commits yet to be applied to upstream", completesRefs: true, setup: setupCherry},
+		{name: "clean", arguments: "[-d] [-f] [-i] [-n] [-q] [-x | -X] [--] [<pathspec>...]", summary: "Remove untracked files from the working tree", setup: setupClean},
+		{name: "commit-graph", arguments: "write [--reachable] [--[no-]changed-paths] [-q]", summary: "Write the commit-graph file", setup: setupCommitGraph},
+		{name: "commit", arguments: "[-m <msg>]... [-F <file>] [-e] [--allow-empty] [--allow-empty-message] [-s] [--author=<author>] [--date=<date>] [-q]", summary: "Record changes to the repository", autoMaintenance: true, setup: setupCommit},
+		{name: "completion", arguments: "bash | zsh | fish", summary: "Print a shell completion script", noRepository: true, setup: setupCompletion},
+		{name: "diff", arguments: "[<options>] [--cached] [<commit> [<commit>]] [--] [<path>...]", summary: "Show changes between commits, commit and working tree, etc", completesRefs: true, setup: setupDiff},
+		{name: "difftool", arguments: "[-t <tool> | -x <command>] [-d [--no-symlinks]] [-y | --prompt] [--[no-]trust-exit-code] [--cached] [<commit> [<commit>]] [--] [<path>...]", summary: "Show changes using common diff tools", completesRefs: true, setup: setupDifftool},
+		{name: "env", arguments: "--list", summary: "Show how the repository, its config and environment were resolved", setup: setupEnv},
+		{name: "format-patch", arguments: "[-o <dir> | --stdout] [-n | -N] [--start-number <n>] [--subject-prefix <prefix>] [--base <commit>] [-<n>] [<since> | <revision-range>]", summary: "Prepare patches for e-mail submission", completesRefs: true, setup: setupFormatPatch},
+		{name: "gc", arguments: "[--auto] [--prune=<date>] [--quiet]", summary: "Cleanup unnecessary files and optimize the local repository", setup: setupGc},
+		{name: "grep", arguments: "[<options>] [-e] <pattern> [<tree-ish>...] [[--] <pathspec>...]", summary: "Print lines matching a pattern", completesRefs: true, setup: setupGrep},
+		{name: "help", arguments: "[<command>]", summary: "Display help information", noRepository: true, setup: setupHelp},
+		{name: "index-pack", arguments: "[-v] [-o <index-file>] [--fix-thin] (<pack-file> | --stdin)", summary: "Build pack index file for an existing packed archive", autoMaintenance: true, setup: setupIndexPack},
+		{name: "interpret-trailers", arguments: "[--in-place] [--trim-empty] [(--trailer <token>[(=|:)<value>])...] [--parse] [<file>...]", summary: "Add or parse structured information in commit messages", setup: setupInterpretTrailers},
+		{name: "log", arguments: "[-n <n>] [--pretty=<format>] [--oneline] [--decorate[=<style>]] [--topo-order | --date-order] [--reverse] [--date=<format>] [--since=<date>] [--until=<date>] [-p] [--stat] [--raw] [-M[<n>] | --no-renames] [--follow] [-c | --cc] [--all] [--branches[=<pattern>]] [--tags[=<pattern>]] [--remotes[=<pattern>]] [--glob=<pattern>] [<revision>...] [[--] <path>...]", summary: "Show commit logs", completesRefs: true, setup: setupLog},
+		{name: "ls-files", arguments: "[-s] [-t] [-v] [-z] [--] [<path>...]", summary: "Show information about files in the index", setup: setupLsFiles},
+		{name: "ls-tree", arguments: "[-r] [-t] [--name-only] [-z] <tree-ish> [<path>...]", summary: "List the contents of a tree object", completesRefs: true, setup: setupLsTree},
+		{name: "maintenance", arguments: "run [--auto] [--quiet] [--task=<task>]...", summary: "Run tasks to optimize Git repository data", setup: setupMaintenance},
+		{name: "merge", arguments: "[--no-commit] [--squash] [--ff | --no-ff | --ff-only] [-m <msg>] [-q] <commit>...", summary: "Join two or more development histories together", setup: setupMerge},
+		{name: "mergetool", arguments: "[--tool=<tool>] [-y | --prompt] [<file>...]", summary: "Run merge conflict resolution tools to resolve merge conflicts", setup: setupMergetool},
+		{name: "name-rev", arguments: "[<options>] (<commit>... | --all | --annotate-stdin)", summary: "Find symbolic names for given revs", completesRefs: true, setup: setupNameRev},
+		{name: "notes", arguments: "[--ref <notes-ref>] (add [-f] [-m <message>]... | show | remove | list) [<object>]", summary: "Add or inspect object notes", completesRefs: true, setup: setupNotes},
+		{name: "pack-refs", arguments: "[--all] [--no-prune]", summary: "Pack heads and tags for efficient repository access", setup: setupPackRefs},
+		{name: "patch-id", arguments: "[--stable | --unstable | --verbatim] < <patch>", summary: "Compute unique ID for a patch", setup: setupPatchID},
+		{name: "prune", arguments: "[-n] [-v] [--expire <time>] [<head>...]", summary: "Prune all unreachable objects from the object database", setup: setupPrune},
+		{name: "pull", arguments: "[-r | --rebase | --no-rebase] [--ff-only | --ff | --no-ff] [--[no-]autostash] [-q] [<remote> [<branch>]]", summary: "Fetch from and integrate with another repository or a local branch", setup: setupPull},
+		{name: "range-diff", arguments: "[--creation-factor=<percent>] [-s] (<range1> <range2> | <rev1>...<rev2> | <base> <rev1> <rev2>)", summary: "Compare two commit ranges (e.g. two versions of a branch)", completesRefs: true, setup: setupRangeDiff},
+		{name: "rebase", arguments: "[--[no-]autostash] [-q] [<upstream>]", summary: "Reapply commits on top of another base tip", completesRefs: true, setup: setupRebase},
+		{name: "reflog", arguments: "expire [--expire=<time>] [--expire-unreachable=<time>] [--dry-run] [--verbose] (--all | <ref>...)", summary: "Manage reflog information", setup: setupReflog},
+		{name: "replace", arguments: "[-f] <object> <replacement> | -d <object>... | -l [<pattern>]", summary: "Create, list and delete refs to replace objects", completesRefs: true, setup: setupReplace},
+		{name: "rerere", arguments: "[clear | forget <pathspec>... | status]", summary: "Reuse recorded resolutions of conflicted merges", setup: setupRerere},
+		{name: "reset", arguments: "-p [--] [<pathspec>...]", summary: "Reset current HEAD to the specified state", setup: setupReset},
+		{name: "rev-list", arguments: "[--objects [--no-object-names]] [--all] <commit>... [^<commit>...] [<commit>..<commit>]", summary: "Lists commit objects in reverse chronological order", completesRefs: true, setup: setupRevList},
+		{name: "rewrite", arguments: "[--remove-path <path>]... [--subdirectory-filter <directory>] [--path-rename <old>:<new>]... [--replace-message <file>] [--mailmap <file>] [--keep-empty]", summary: "Rewrite the whole history, filtering paths, messages and identities", setup: setupRewrite},
+		{name: "send-email", arguments: "[--to <address>]... [--cc <address>]... [--from <address>] [--in-reply-to <id>] [--smtp-server <host>] [--dry-run] <file | directory>...", summary: "Send a collection of patches as emails", setup: setupSendEmail},
+		{name: "show-branch", arguments: "[-a | -r] [--current] [--topo-order | --date-order] [--sparse] [--more=<n> | --list | --independent | --merge-base] [--no-name | --sha1-name] [--topics] [<rev> | <glob>]...", summary: "Show branches and their commits", completesRefs: true, setup: setupShowBranch},
+		{name: "show-ref", arguments: "[-q] [-s] [-d] [--head] [--heads] [--tags] [<pattern>...] | --verify <ref>...", summary: "List references in the repository", completesRefs: true, setup: setupShowRef},
+		{name: "sparse-checkout", arguments: "(init [--cone] | set <directory>... | add <directory>... | list)", summary: "Reduce your working tree to a subset of tracked files", setup: setupSparseCheckout},
+		{name: "stash", arguments: "[push [-k | --no-keep-index] [-u] [-p] [-q] [-m <message>]] | list | show [-p] [-u] [<stash>] | (apply | pop) [--index] [-q] [<stash>] | drop [-q] [<stash>] | clear", summary: "Stash the changes in a dirty working directory away", setup: setupStash},
+		{name: "status", arguments: "[<options>] [--] [<pathspec>...]", summary: "Show the working tree status", setup: setupStatus},
+		{name: "subtree", arguments: "(add | merge | pull) -P <prefix> [-m <message>] (<commit> | <repository> <ref>) | split -P <prefix> [-b <branch>] [--rejoin] [<commit>]", summary: "Merge subtrees together and split repository into subtrees", completesRefs: true, setup: setupSubtree},
+		{name: "symbolic-ref", arguments: "[-q] [--short] <name> [<ref>] | -d <name>", summary: "Read, modify and delete symbolic refs", completesRefs: true, setup: setupSymbolicRef},
+		{name: "tag", arguments: "[-l] [--contains <commit>] [--no-contains <commit>] [--merged <commit>] [--no-merged <commit>] [<pattern>...]", summary: "List tags", completesRefs: true, setup: setupTag},
+		{name: "unpack-objects", arguments: "[-n] [-q] < <pack-file>", summary: "Unpack objects from a packed archive", autoMaintenance: true, setup: setupUnpackObjects},
+		{name: "update-index", arguments: "[--add] [--remove | --force-remove] [--chmod=(+|-)x] [--[no-]assume-unchanged] [--[no-]skip-worktree] [--cacheinfo <mode>,<object>,<path>]... [--refresh [-q]] [--] [<file>...]", summary: "Register file contents in the working tree to the index", setup: setupUpdateIndex},
+		{name: "var", arguments: "(-l | <variable>)", summary: "Show a Git logical variable", setup: setupVar},
+		{name: "verify-pack", arguments: "[-v | -s] <pack>.idx...", summary: "Validate packed Git archive files", setup: setupVerifyPack},
+		{name: "whatchanged", arguments: "[<log-options>] [<revision>...] [[--] <path>...]", summary: "Show logs with differences each commit introduces", completesRefs: true, setup: setupWhatchanged},
+		{name: "worktree", arguments: "prune [-n] [-v] [-f] [--expire <expire>]", summary: "Manage multiple working trees", setup: setupWorktree},
+		{name: "write-tree", arguments: "", summary: "Create a tree object from the current index", setup: setupWriteTree},
+	}
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage() {
+	fmt.Printf("usage: %s [-C <path>] [--git-dir=<path>] [-p | -P] [--no-replace-objects] [--json] [--color[=<when>]] <command> [<args>]\n\n", programName())
+	fmt.Println("These are the available commands:")
+	for _, cmd := range commands {
+		if !cmd.hidden {
+			fmt.Printf("   %-12s %s\n", cmd.name, cmd.summary)
+		}
+	}
+	fmt.Printf("\nSee '%s help <command>' to read about a specific command.\n", programName())
+}
+
+// newCommandFlags creates the flag set of a command with usage text built
+// from its synopsis
+func newCommandFlags(cmd command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s %s %s\n\n", programName(), cmd.name, cmd.arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// argumentsBeforeDashDash is how many of the arguments of the command came
+// before "--", -1 when it was not given, for the commands that tell
+// revisions from paths by it
+var argumentsBeforeDashDash = -1
+
+// parseCommandFlags allows flags and arguments to be interleaved as git
+// does; everything after "--" is an argument. Unknown flags and -h show
+// the usage and exit with 129, as in git.
+func parseCommandFlags(flags *flag.FlagSet, args []string) []string {
+	args = expandShortFlags(flags, args)
+	positional := make([]string, 0)
+	for {
+		if err := flags.Parse(args); err != nil {
+			os.Exit(129)
+		}
+		remaining := flags.Args()
+		consumed := len(args) - len(remaining)
+		if consumed > 0 && args[consumed-1] == "--" {
+			argumentsBeforeDashDash = len(positional)
+			return append(positional, remaining...)
+		}
+		if len(remaining) == 0 {
+			return positional
+		}
+		positional = append(positional, remaining[0])
+		args = remaining[1:]
+	}
+}
+
+// expandShortFlags splits bundled single letter flags the way git accepts
+// them: "-fdx" becomes "-f -d -x" and "-n5" becomes "-n 5"
+func expandShortFlags(flags *flag.FlagSet, args []string) []string {
+	expanded := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(expanded, args[i:]...)
+		}
+		if strings.HasPrefix(arg, "--") && !strings.Contains(arg, "=") && i+1 < len(args) && args[i+1] != "--" {
+			if defined := flags.Lookup(arg[2:]); defined != nil {
+				if _, ok := defined.Value.(*lastArgDefaultFlag); ok {
+					// takes the next argument, only defaulting when last
+					i++
+					expanded = append(expanded, arg+"="+args[i])
+					continue
+				}
+			}
+		}
+		if len(arg) < 2 || arg[0] != '-' || arg[1] == '-' {
+			expanded = append(expanded, arg)
+			continue
+		}
+		if defined := flags.Lookup(strings.SplitN(arg[1:], "=", 2)[0]); defined != nil {
+			expanded = append(expanded, arg)
+			if !isBoolFlag(defined) && !strings.Contains(arg, "=") && i+1 < len(args) {
+				// keep the value of the flag as it is
+				i++
+				expanded = append(expanded, args[i])
+			}
+			continue
+		}
+		split := make([]string, 0)
+		for j := 1; j < len(arg); j++ {
+			letter := flags.Lookup(arg[j : j+1])
+			if letter == nil {
+				// leave it to the flag package to report
+				split = []string{arg}
+				break
+			}
+			if _, ok := letter.Value.(*optionalValueFlag); ok && j+1 < len(arg) {
+				// the rest is its value, as for "-M50%"
+				split = append(split, "-"+arg[j:j+1]+"="+arg[j+1:])
+				break
+			}
+			split = append(split, "-"+arg[j:j+1])
+			if !isBoolFlag(letter) {
+				if j+1 < len(arg) {
+					split = append(split, arg[j+1:])
+				}
+				break
+			}
+		}
+		expanded = append(expanded, split...)
+	}
+	return expanded
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
+
+// countFlag is a boolean flag counting how often it was given, as for
+// "clean -ff"
+type countFlag int
+
+func (count *countFlag) String() string {
+	if count == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*count))
+}
+
+func (count *countFlag) Set(string) error {
+	*count++
+	return nil
+}
+
+func (count *countFlag) IsBoolFlag() bool {
+	return true
+}
+
+// stringListFlag collects every value of a repeatable option, as for
+// "maintenance run --task=gc --task=commit-graph"
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	if list == nil {
+		return ""
+	}
+	return strings.Join(*list, ",")
+}
+
+func (list *stringListFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// lastArgDefaultFlag is a repeatable option taking the next argument as
+// its value unless it is the last argument, when the value is fallback, as
+// for "branch --merged [<commit>]"
+type lastArgDefaultFlag struct {
+	values   []string
+	fallback string
+}
+
+func (value *lastArgDefaultFlag) String() string {
+	if value == nil {
+		return ""
+	}
+	return strings.Join(value.values, ",")
+}
+
+func (value *lastArgDefaultFlag) Set(text string) error {
+	if text == "true" {
+		// given last, without a value
+		text = value.fallback
+	}
+	value.values = append(value.values, text)
+	return nil
+}
+
+func (value *lastArgDefaultFlag) IsBoolFlag() bool {
+	return true
+}
+
+// optionalValueFlag is an option whose value may be left out, as for
+// "--decorate" next to "--decorate=full"; it is "true" when it was
+type optionalValueFlag string
+
+func (value *optionalValueFlag) String() string {
+	if value == nil {
+		return ""
+	}
+	return string(*value)
+}
+
+func (value *optionalValueFlag) Set(text string) error {
+	*value = optionalValueFlag(text)
+	return nil
+}
+
+func (value *optionalValueFlag) IsBoolFlag() bool {
+	return true
+}
+
+func runCommandLine(args []string) {
+	// global options: -C <path> (repeatable) and --git-dir=<path>
+	gitDir := os.Getenv("GIT_DIR")
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		option := args[0]
+		switch {
+		case option == "-C" && len(args) > 1:
+			if err := os.Chdir(args[1]); err != nil {
+				log.Fatalf("fatal: cannot change to '%s': %s", args[1], err)
+			}
+			args = args[2:]
+		case option == "--git-dir" && len(args) > 1:
+			gitDir = args[1]
+			args = args[2:]
+		case strings.HasPrefix(option, "--git-dir="):
+			gitDir = strings.TrimPrefix(option, "--git-dir=")
+			args = args[1:]
+		case option == "--color":
+			colorOption = "always"
+			args = args[1:]
+		case strings.HasPrefix(option, "--color="):
+			colorOption = strings.TrimPrefix(option, "--color=")
+			args = args[1:]
+		case option == "--no-color":
+			colorOption = "never"
+			args = args[1:]
+		case option == "-p" || option == "--paginate":
+			pagerOption = 1
+			args = args[1:]
+		case option == "-P" || option == "--no-pager":
+			pagerOption = -1
+			args = args[1:]
+		case option == "--no-replace-objects":
+			// exported so hooks and aliases see the same objects
+			os.Setenv("GIT_NO_REPLACE_OBJECTS", "1")
+			args = args[1:]
+		case option == "--json":
+			jsonOutput = true
+			args = args[1:]
+		case option == "-h" || option == "--help":
+			printUsage()
+			return
+		default:
+			fmt.Fprintf(os.Stderr, "unknown option: %s\n", option)
+			printUsage()
+			os.Exit(129)
+		}
+	}
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(1)
+	}
+	args = expandAlias(gitDir, args)
+	cmd, _ := findCommand(args[0])
+	trace("built-in: %s", quoteCommandLine(append([]string{programName()}, args...)))
+	traceEvent("cmd_name", map[string]interface{}{"name": cmd.name})
+	endCommand := traceRegion(programName() + " command: " + quoteCommandLine(args))
+	var repo *Repository
+	if !cmd.noRepository {
+		repo = openRepositoryFromEnvironment(gitDir)
+	}
+	if pagerOption > 0 {
+		repo.setupPager(cmd.name)
+	}
+	flags := newCommandFlags(cmd)
+	run := cmd.setup(flags)
+	commandArgs := args[1:]
+	switch cmd.name {
+	case "log", "whatchanged":
+		commandArgs = expandCountShorthand(commandArgs, "n")
+	case "format-patch":
+		commandArgs = expandCountShorthand(commandArgs, "max-count")
+	}
+	run(repo, parseCommandFlags(flags, commandArgs))
+	if cmd.autoMaintenance {
+		repo.autoMaintenance()
+	}
+	finishPager()
+	endCommand()
+	traceEvent("exit", map[string]interface{}{"code": 0, "t_abs": time.Since(traceStart).Seconds()})
+}
+
+func setupAdd(flags *flag.FlagSet) commandRunner {
+	jobs := flags.Int("jobs", 0, "number of parallel workers (default core.threads, 0 for one per CPU)")
+	patch := flags.Bool("p", false, "pick the hunks of the changes to stage interactively")
+	flags.BoolVar(patch, "patch", false, "pick the hunks of the changes to stage interactively")
+	var options addOptions
+	flags.BoolVar(&options.update, "u", false, "update tracked files only")
+	flags.BoolVar(&options.update, "update", false, "update tracked files only")
+	all := flags.Bool("A", false, "add changes from all tracked and untracked files")
+	flags.BoolVar(all, "all", false, "add changes from all tracked and untracked files")
+	flags.BoolVar(&options.ignoreRemoval, "ignore-removal", false, "ignore paths removed in the working tree (same as --no-all)")
+	flags.BoolVar(&options.ignoreRemoval, "no-all", false, "ignore paths removed in the working tree (same as --ignore-removal)")
+	flags.BoolVar(&options.intentToAdd, "N", false, "record only the fact that the path will be added later")
+	flags.BoolVar(&options.intentToAdd, "intent-to-add", false, "record only the fact that the path will be added later")
+	return func(repo *Repository, pathspecs []string) {
+		if *all && options.update {
+			log.Fatal("fatal: options '-A' and '-u' cannot be used together")
+		}
+		if *patch {
+			repo.addPatch(repo.parsePathspecs(pathspecs))
+			return
+		}
+		if len(pathspecs) == 0 {
+			if !*all && !options.update {
+				fmt.Println("Nothing specified, nothing added.")
+				return
+			}
+			// -A and -u without pathspecs cover the whole worktree, not
+			// only the current directory
+			repo.addPaths([]pathspec{{original: "."}}, repo.jobCount(*jobs), options)
+			return
+		}
+		repo.addPaths(repo.parsePathspecs(pathspecs), repo.jobCount(*jobs), options)
+	}
+}
+
+func setupAm(flags *flag.FlagSet) commandRunner {
+	quiet := flags.Bool("q", false, "be quiet")
+	flags.BoolVar(quiet, "quiet", false, "be quiet")
+	return func(repo *Repository, mailboxes []string) {
+		var content strings.Builder
+		if len(mailboxes) == 0 {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				log.Fatal(err)
+			}
+			content.Write(data)
+		}
+		for _, mailbox := range mailboxes {
+			data, err := os.ReadFile(mailbox)
+			if err != nil {
+				log.Fatalf("fatal: could not open '%s' for reading: %s", mailbox, err)
+			}
+			content.Write(data)
+		}
+		messages := splitMailbox(content.String())
+		if len(messages) == 0 {
+			log.Fatal("Patch format detection failed.")
+		}
+		repo.applyMailbox(messages, *quiet)
+	}
+}
+
+func setupBranch(flags *flag.FlagSet) commandRunner {
+	var verbose countFlag
+	flags.Var(&verbose, "v", "show hash and subject, give twice for the upstream branch")
+	flags.Var(&verbose, "verbose", "show hash and subject, give twice for the upstream branch")
+	setUpstream := flags.String("set-upstream-to", "", "set the `upstream` of the current or given branch")
+	flags.StringVar(setUpstream, "u", "", "set the `upstream` of the current or given branch")
+	contains, noContains, merged, noMerged := refFilterFlags(flags, "branches")
+	return func(repo *Repository, args []string) {
+		if *setUpstream != "" {
+			branch, ok := repo.headBranch()
+			if len(args) == 1 {
+				branch, ok = args[0], true
+			}
+			if !ok || len(args) > 1 {
+				log.Fatal("fatal: could not set upstream of HEAD when it does not point to any branch")
+			}
+			if _, exists := repo.resolveRef("refs/heads/" + branch); !exists {
+				log.Fatalf("fatal: branch '%s' does not exist", branch)
+			}
+			upstream := ""
+			for _, candidate := range []string{*setUpstream, "refs/remotes/" + *setUpstream, "refs/heads/" + *setUpstream} {
+				if _, exists := repo.resolveRef(candidate); exists && strings.HasPrefix(candidate, "refs/") {
+					upstream = candidate
+					break
+				}
+			}
+			if upstream == "" {
+				log.Fatalf("fatal: the requested upstream branch '%s' does not exist", *setUpstream)
+			}
+			repo.setUpstream(branch, upstream)
+			return
+		}
+		if len(args) > 0 {
+			// only listing is supported, which takes no arguments
+			flags.Usage()
+			os.Exit(129)
+		}
+		filter := repo.newRefFilter(contains.values, noContains.values, merged.values, noMerged.values)
+		if jsonOutput {
+			printJSON(repo.branchesJSON(filter))
+			return
+		}
+		if verbose > 0 {
+			repo.listBranchesVerbose(filter, int(verbose), repo.useColor("branch"))
+			return
+		}
+		repo.listBranches(filter, repo.useColor("branch"))
+	}
+}
+
+// refFilterFlags defines the options of refFilter for listing the kind
+// of refs given
+func refFilterFlags(flags *flag.FlagSet, kind string) (contains, noContains, merged, noMerged *lastArgDefaultFlag) {
+	contains, noContains = &lastArgDefaultFlag{fallback: "HEAD"}, &lastArgDefaultFlag{fallback: "HEAD"}
+	merged, noMerged = &lastArgDefaultFlag{fallback: "HEAD"}, &lastArgDefaultFlag{fallback: "HEAD"}
+	flags.Var(contains, "contains", "only list "+kind+" which contain the `commit` (HEAD if not given)")
+	flags.Var(noContains, "no-contains", "only list "+kind+" which don't contain the `commit` (HEAD if not given)")
+	flags.Var(merged, "merged", "only list "+kind+" reachable from the `commit` (HEAD if not given)")
+	flags.Var(noMerged, "no-merged", "only list "+kind+" not reachable from the `commit` (HEAD if not given)")
+	return contains, noContains, merged, noMerged
+}
+
+func setupCatFile(flags *flag.FlagSet) commandRunner {
+	showType := flags.Bool("t", false, "show the object type")
+	showSize := flags.Bool("s", false, "show the object size")
+	exists := flags.Bool("e", false, "exit with zero status if the object exists")
+	flags.Bool("p", false, "pretty-print the object content (default)")
+	textconv := flags.Bool("textconv", false, "show the blob through the textconv command of the diff driver of its path")
+	filters := flags.Bool("filters", false, "show the blob as checked out, with line endings converted and the smudge filter applied")
+	forcedPath := flags.String("path", "", "take the attributes of `path` for --textconv and --filters")
+	return func(repo *Repository, objects []string) {
+		if len(objects) != 1 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		if *forcedPath != "" && !*textconv && !*filters {
+			fmt.Fprintln(os.Stderr, "fatal: '--path=<path|tree-ish>' needs '--filters' or '--textconv'")
+			fmt.Fprintln(os.Stderr)
+			flags.Usage()
+			os.Exit(129)
+		}
+		switch {
+		case *textconv && *filters:
+			log.Fatal("fatal: options '--textconv' and '--filters' cannot be used together")
+		case *textconv:
+			repo.catFileConverted(objects[0], *forcedPath, "textconv")
+			return
+		case *filters:
+			repo.catFileConverted(objects[0], *forcedPath, "filters")
+			return
+		}
+		hash := repo.resolveRevision(objects[0])
+		if *exists {
+			if !repo.hasObject(hash) {
+				os.Exit(1)
+			}
+			return
+		}
+		header, content := repo.readObject(hash)
+		switch {
+		case *showType:
+			fmt.Println(header.objectType)
+		case *showSize:
+			fmt.Println(header.length)
+		default:
+			repo.setupPager("cat-file")
+			printObjectFileContent(header, content)
+		}
+	}
+}
+
+func setupCheckRefFormat(flags *flag.FlagSet) commandRunner {
+	var options refFormatOptions
+	flags.BoolVar(&options.normalize, "normalize", false, "print the normalized name if it is valid")
+	flags.BoolVar(&options.allowOneLevel, "allow-onelevel", false, "allow names with a single component")
+	flags.BoolVar(&options.refspecPattern, "refspec-pattern", false, "allow a single * wildcard")
+	branch := flags.Bool("branch", false, "check a branch name, printing it if valid")
+	return func(repo *Repository, args []string) {
+		if len(args) != 1 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		if *branch {
+			name := args[0]
+			if !isValidBranchName(name) {
+				log.Fatalf("fatal: '%s' is not a valid branch name", name)
+			}
+			fmt.Println(name)
+			return
+		}
+		name, ok := checkRefFormat(args[0], options)
+		if !ok {
+			os.Exit(1)
+		}
+		if options.normalize {
+			fmt.Println(name)
+		}
+	}
+}
+
+func setupCheckout(flags *flag.FlagSet) commandRunner {
+	jobs := flags.Int("jobs", 0, "number of parallel workers (default core.threads, 0 for one per CPU)")
+	quiet := flags.Bool("q", false, "suppress feedback messages")
+	flags.BoolVar(quiet, "quiet", false, "suppress feedback messages")
+	noProgress := flags.Bool("no-progress", false, "do not report progress")
+	orphan := flags.String("orphan", "", "create a new unborn `branch`, optionally starting from the given commit's tree")
+	patch := flags.Bool("p", false, "pick the hunks of the worktree changes to discard interactively")
+	flags.BoolVar(patch, "patch", false, "pick the hunks of the worktree changes to discard interactively")
+	return func(repo *Repository, targets []string) {
+		if *patch {
+			repo.checkoutPatch(repo.parsePathspecs(targets))
+			return
+		}
+		progress := newProgress(*quiet || *noProgress)
+		if *orphan != "" && len(targets) <= 1 {
+			startPoint := ""
+			if len(targets) == 1 {
+				startPoint = targets[0]
+			}
+			repo.checkoutOrphan(*orphan, startPoint, repo.jobCount(*jobs), *quiet, progress)
+			return
+		}
+		if len(targets) == 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		// a revision first switches to it when alone and otherwise names
+		// the tree the paths after it come from
+		_, isRevision := repo.lookupRevision(targets[0])
+		if _, isRemote := repo.uniqueRemoteBranch(targets[0]); len(targets) == 1 && (isRevision || isRemote) {
+			repo.checkout(targets[0], repo.jobCount(*jobs), *quiet, progress)
+			return
+		}
+		if isRevision {
+			repo.checkoutPaths(targets[0], repo.parsePathspecs(targets[1:]))
+			return
+		}
+		repo.checkoutPaths("", repo.parsePathspecs(targets))
+	}
+}
+
+func setupCherry(flags *flag.FlagSet) commandRunner {
+	var options cherryOptions
+	flags.BoolVar(&options.verbose, "v", false, "show the commit subjects next to the names")
+	flags.BoolVar(&options.verbose, "verbose", false, "show the commit subjects next to the names")
+	flags.IntVar(&options.abbrev, "abbrev", 0, "show only the first `n` digits of object names")
+	return func(repo *Repository, args []string) {
+		if len(args) > 3 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		upstream, head, limit := "", "HEAD", ""
+		if len(args) > 0 {
+			upstream = args[0]
+		} else {
+			upstream = repo.defaultCherryUpstream()
+		}
+		if len(args) > 1 {
+			head = args[1]
+		}
+		if len(args) > 2 {
+			limit = args[2]
+		}
+		repo.cherry(os.Stdout, upstream, head, limit, options)
+	}
+}
+
+func setupClean(flags *flag.FlagSet) commandRunner {
+	var options cleanOptions
+	flags.BoolVar(&options.directories, "d", false, "remove whole untracked directories")
+	dryRun := flags.Bool("n", false, "only show what would be removed")
+	flags.BoolVar(dryRun, "dry-run", false, "only show what would be removed")
+	interactive := flags.Bool("i", false, "confirm every removal")
+	quiet := flags.Bool("q", false, "do not print the names of removed files")
+	removeIgnored := flags.Bool("x", false, "remove ignored files too")
+	onlyIgnored := flags.Bool("X", false, "remove only ignored files")
+	flags.Var(&options.force, "f", "force the removal, twice to remove nested repositories")
+	return func(repo *Repository, pathspecs []string) {
+		if *removeIgnored && *onlyIgnored {
+			log.Fatal("fatal: -x and -X cannot be used together")
+		}
+		if *removeIgnored {
+			options.ignoreMode = cleanIgnoredToo
+		} else if *onlyIgnored {
+			options.ignoreMode = cleanIgnoredOnly
+		}
+		if options.force == 0 && !*dryRun && !*interactive && repo.config.getBool("clean.requireForce", true) {
+			log.Fatal("fatal: clean.requireForce defaults to true and neither -i, -n, nor -f given; refusing to clean")
+		}
+		options.pathspecs = repo.parsePathspecs(pathspecs)
+		repo.clean(repo.cleanCandidates(options), *dryRun, *interactive, *quiet)
+	}
+}
+
+func setupCommitGraph(flags *flag.FlagSet) commandRunner {
+	flags.Bool("reachable", false, "write the commits the refs reach (the only mode)")
+	changedPaths := flags.Bool("changed-paths", false, "write changed-path Bloom filters (default when the commit-graph has them)")
+	noChangedPaths := flags.Bool("no-changed-paths", false, "write no changed-path Bloom filters")
+	quiet := flags.Bool("q", false, "do not report the commits written")
+	flags.BoolVar(quiet, "quiet", false, "do not report the commits written")
+	return func(repo *Repository, args []string) {
+		if len(args) != 1 || args[0] != "write" {
+			flags.Usage()
+			os.Exit(129)
+		}
+		filters := *changedPaths || repo.hasChangedPaths() && !*noChangedPaths
+		count := repo.writeCommitGraph(repo.refTipCommits(), filters)
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Wrote commit-graph with %d commits\n", count)
+		}
+	}
+}
+
+func setupCommit(flags *flag.FlagSet) commandRunner {
+	var options commitOptions
+	var messages stringListFlag
+	flags.Var(&messages, "m", "use the given `message` as a paragraph of the commit message")
+	flags.Var(&messages, "message", "use the given `message` as a paragraph of the commit message")
+	flags.StringVar(&options.messageFile, "F", "", "read the commit message from `file` (\"-\" for standard input)")
+	flags.StringVar(&options.messageFile, "file", "", "read the commit message from `file` (\"-\" for standard input)")
+	flags.BoolVar(&options.edit, "e", false, "edit the message given with -m or -F")
+	flags.BoolVar(&options.edit, "edit", false, "edit the message given with -m or -F")
+	flags.BoolVar(&options.allowEmpty, "allow-empty", false, "allow a commit that changes nothing")
+	flags.BoolVar(&options.allowEmptyMessage, "allow-empty-message", false, "allow a commit with an empty message")
+	flags.BoolVar(&options.quiet, "q", false, "suppress the commit summary")
+	flags.BoolVar(&options.quiet, "quiet", false, "suppress the commit summary")
+	flags.BoolVar(&options.signoff, "s", false, "add a Signed-off-by trailer")
+	flags.BoolVar(&options.signoff, "signoff", false, "add a Signed-off-by trailer")
+	flags.StringVar(&options.author, "author", "", "override the commit `author`, \"Name <e-mail>\" or a pattern matching an existing author")
+	flags.StringVar(&options.date, "date", "", "override the author `date`")
+	return func(repo *Repository, args []string) {
+		if len(args) != 0 {
+			log.Fatal("fatal: committing paths is not supported, add them to the index first")
+		}
+		options.messages = messages
+		if len(options.messages) > 0 && options.messageFile != "" {
+			log.Fatal("fatal: options '-m' and '-F' cannot be used together")
+		}
+		repo.commitIndex(options)
+	}
+}
+
+func setupDiff(flags *flag.FlagSet) commandRunner {
+	var options diffCommandOptions
+	flags.BoolVar(&options.cached, "cached", false, "compare the index against HEAD or the given commit")
+	flags.BoolVar(&options.cached, "staged", false, "compare the index against HEAD or the given commit")
+	context := flags.Int("U", DefaultDiffContext, "show `n` lines of context")
+	flags.IntVar(context, "unified", DefaultDiffContext, "show `n` lines of context")
+	stat := flags.Bool("stat", false, "show a diffstat instead of a patch")
+	nameOnly := flags.Bool("name-only", false, "show only the names of changed files")
+	nameStatus := flags.Bool("name-status", false, "show the names and status of changed files")
+	check := flags.Bool("check", false, "warn about whitespace problems and leftover conflict markers the changes add")
+	flags.BoolVar(&options.exitCode, "exit-code", false, "exit with 1 if there are changes")
+	flags.BoolVar(&options.quiet, "quiet", false, "show nothing, implies --exit-code")
+	flags.BoolVar(&options.printer.nulTerminated, "z", false, "terminate names with NUL for --name-only and --name-status")
+	var wordDiff optionalValueFlag
+	flags.Var(&wordDiff, "word-diff", "show changed words, `mode` plain, color, porcelain or none")
+	wordRegex := flags.String("word-diff-regex", "", "use `regex` to find words, implies --word-diff (default diff.wordRegex)")
+	var colorWords optionalValueFlag
+	flags.Var(&colorWords, "color-words", "show changed words in color, found with `regex` if given")
+	binary := flags.Bool("binary", false, "write binary patches that apply, naming objects in full")
+	noTextconv := flags.Bool("no-textconv", false, "diff contents as they are, not through diff.<driver>.textconv")
+	noExtDiff := flags.Bool("no-ext-diff", false, "do not run external diff commands")
+	var submodule optionalValueFlag
+	flags.Var(&submodule, "submodule", "show submodule changes in `format` short or log, log if not given (default diff.submodule)")
+	highlight := flags.String("ws-error-highlight", "", "highlight whitespace problems of the `kind` of lines: old, new, context, all, none or default (default diff.wsErrorHighlight)")
+	return func(repo *Repository, args []string) {
+		var ok bool
+		options.revisions, args, ok = repo.diffRevisions(args)
+		if !ok || options.cached && len(options.revisions) > 1 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		options.pathspecs = repo.parsePathspecs(args)
+		switch {
+		case *check:
+			options.output = "check"
+		case *nameOnly:
+			options.output = "name-only"
+		case *nameStatus:
+			options.output = "name-status"
+		case *stat:
+			options.output = "stat"
+		default:
+			options.output = "patch"
+		}
+		if options.quiet {
+			options.exitCode = true
+		} else {
+			repo.setupPager("diff")
+		}
+		if *highlight == "" {
+			*highlight, _ = repo.config.get("diff.wsErrorHighlight")
+		}
+		options.patch = diffOptions{
+			context:    *context,
+			colors:     repo.diffColors(repo.useColor("diff")),
+			whitespace: repo.whitespaceRule(),
+			highlight:  "+",
+			binary:     *binary,
+			textconv:   !*noTextconv,
+			external:   !*noExtDiff,
+			submodule:  repo.submoduleFormat(string(submodule)),
+		}
+		if *highlight != "" {
+			options.patch.highlight = parseWhitespaceHighlight(*highlight)
+		}
+		switch {
+		case wordDiff != "":
+			options.patch.wordDiff = parseWordDiffMode(string(wordDiff))
+		case colorWords != "":
+			options.patch.wordDiff = "color"
+			if colorWords != "true" {
+				*wordRegex = string(colorWords)
+			}
+		case *wordRegex != "":
+			options.patch.wordDiff = "plain"
+		}
+		if *wordRegex == "" {
+			*wordRegex, _ = repo.config.get("diff.wordRegex")
+		}
+		if options.patch.wordDiff != "" && *wordRegex != "" {
+			options.patch.wordRegex = compileWordRegex(*wordRegex)
+		}
+		if status := repo.diff(os.Stdout, options); status != 0 {
+			finishPager()
+			os.Exit(status)
+		}
+	}
+}
+
+// diffRevisions splits the arguments of diff into the leading ones naming
+// revisions to compare, a range standing for its two ends, and the rest
+// limiting paths; ok is false for more than two revisions
+func (repo *Repository) diffRevisions(args []string) ([]string, []string, bool) {
+	revisions, paths := repo.splitRevisionArguments(args)
+	if len(revisions) == 1 {
+		if from, to, isRange := strings.Cut(revisions[0], ".."); isRange {
+			if from == "" {
+				from = "HEAD"
+			}
+			if to == "" {
+				to = "HEAD"
+			}
+			revisions = []string{from, to}
+		}
+	}
+	for _, revision := range revisions {
+		if strings.Contains(revision, "..") || strings.HasPrefix(revision, "^") {
+			return nil, nil, false
+		}
+	}
+	return revisions, paths, len(revisions) <= 2
+}
+
+func setupDifftool(flags *flag.FlagSet) commandRunner {
+	var options difftoolOptions
+	flags.StringVar(&options.tool, "t", "", "use the diff `tool` (default diff.tool, then merge.tool)")
+	flags.StringVar(&options.tool, "tool", "", "use the diff `tool` (default diff.tool, then merge.tool)")
+	flags.StringVar(&options.extcmd, "x", "", "run `command` with the two sides of each file instead of a tool")
+	flags.StringVar(&options.extcmd, "extcmd", "", "run `command` with the two sides of each file instead of a tool")
+	flags.BoolVar(&options.diff.cached, "cached", false, "compare the index against HEAD or the given commit")
+	flags.BoolVar(&options.diff.cached, "staged", false, "compare the index against HEAD or the given commit")
+	flags.BoolVar(&options.dirDiff, "d", false, "run the tool once on two trees holding the sides of all changed files")
+	flags.BoolVar(&options.dirDiff, "dir-diff", false, "run the tool once on two trees holding the sides of all changed files")
+	noSymlinks := flags.Bool("no-symlinks", false, "with --dir-diff, copy worktree files into the tree instead of linking them")
+	noPrompt := flags.Bool("y", false, "do not prompt before launching the tool")
+	flags.BoolVar(noPrompt, "no-prompt", false, "do not prompt before launching the tool")
+	prompt := flags.Bool("prompt", false, "prompt before each launch of the tool (default difftool.prompt)")
+	trustExitCode := flags.Bool("trust-exit-code", false, "stop and exit with the code of a tool that fails (default difftool.trustExitCode)")
+	noTrustExitCode := flags.Bool("no-trust-exit-code", false, "go on after a tool fails")
+	return func(repo *Repository, args []string) {
+		var ok bool
+		options.diff.revisions, args, ok = repo.diffRevisions(args)
+		if !ok || options.diff.cached && len(options.diff.revisions) > 1 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		options.diff.pathspecs = repo.parsePathspecs(args)
+		options.prompt = repo.config.getBool("difftool.prompt", true)
+		switch {
+		case *prompt:
+			options.prompt = true
+		case *noPrompt:
+			options.prompt = false
+		}
+		options.trustExitCode = (repo.config.getBool("difftool.trustExitCode", false) || *trustExitCode) && !*noTrustExitCode
+		options.symlinks = !*noSymlinks
+		os.Exit(repo.difftool(options))
+	}
+}
+
+func setupEnv(flags *flag.FlagSet) commandRunner {
+	list := flags.Bool("list", false, "list the resolved paths, object format, config sources and environment")
+	return func(repo *Repository, args []string) {
+		if !*list || len(args) != 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		repo.printEnvironment(os.Stdout)
+	}
+}
+
+func setupFormatPatch(flags *flag.FlagSet) commandRunner {
+	var options formatPatchOptions
+	flags.StringVar(&options.outputDir, "o", "", "store resulting files in `dir`")
+	flags.StringVar(&options.outputDir, "output-directory", "", "store resulting files in `dir`")
+	flags.BoolVar(&options.stdout, "stdout", false, "print patches to standard out")
+	flags.BoolVar(&options.numbered, "n", false, "use [PATCH n/m] even with a single patch")
+	flags.BoolVar(&options.numbered, "numbered", false, "use [PATCH n/m] even with a single patch")
+	flags.BoolVar(&options.noNumbered, "N", false, "use [PATCH] even with multiple patches")
+	flags.BoolVar(&options.noNumbered, "no-numbered", false, "use [PATCH] even with multiple patches")
+	flags.IntVar(&options.startNumber, "start-number", 1, "start numbering patches at `n` instead of 1")
+	subjectPrefix := flags.String("subject-prefix", "", "use `prefix` instead of [PATCH] (default format.subjectPrefix)")
+	flags.StringVar(&options.base, "base", "", "add a base-commit trailer naming `commit`")
+	signature := flags.String("signature", "", "add a `signature` (default format.signature)")
+	noSignature := flags.Bool("no-signature", false, "do not print a signature")
+	maxCount := flags.Int("max-count", -1, "limit the number of patches to prepare")
+	flags.BoolVar(&options.noBinary, "no-binary", false, "only say that binary files differ rather than writing binary patches")
+	return func(repo *Repository, revisions []string) {
+		options.subjectPrefix = *subjectPrefix
+		if options.subjectPrefix == "" {
+			options.subjectPrefix = "PATCH"
+			if configured, ok := repo.config.get("format.subjectPrefix"); ok {
+				options.subjectPrefix = configured
+			}
+		}
+		options.signature = *signature
+		if options.signature == "" {
+			options.signature = DefaultPatchSignature
+			if configured, ok := repo.config.get("format.signature"); ok {
+				options.signature = configured
+			}
+		}
+		if *noSignature {
+			options.signature = ""
+		}
+		if options.stdout && options.outputDir != "" {
+			log.Fatal("fatal: options '--stdout' and '--output-directory' cannot be used together")
+		}
+		repo.formatPatches(repo.patchSeries(revisions, *maxCount), options)
+	}
+}
+
+func setupGc(flags *flag.FlagSet) commandRunner {
+	var options gcOptions
+	flags.BoolVar(&options.auto, "auto", false, "only run when gc.auto says the repository needs it")
+	flags.StringVar(&options.pruneExpire, "prune", "", "prune unreachable loose objects older than `date` (default gc.pruneExpire)")
+	flags.BoolVar(&options.aggressive, "aggressive", false, "search harder for deltas, with gc.aggressiveWindow and gc.aggressiveDepth")
+	flags.BoolVar(&options.force, "force", false, "run even if another gc appears to be running")
+	var windows, depths stringListFlag
+	flags.Var(&windows, "window", "try `n` objects as delta bases of each (default pack.window); may be repeated with --benchmark")
+	flags.Var(&depths, "depth", "let delta chains be `n` long at most (default pack.depth); may be repeated with --benchmark")
+	benchmark := flags.Bool("benchmark", false, "compare the size of packs at each --window and --depth instead of collecting garbage")
+	flags.BoolVar(&options.quiet, "quiet", false, "suppress progress reporting")
+	flags.BoolVar(&options.quiet, "q", false, "suppress progress reporting")
+	return func(repo *Repository, args []string) {
+		if len(args) != 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		parseCounts := func(option string, values []string) []int {
+			counts := make([]int, 0, len(values))
+			for _, value := range values {
+				count, err := strconv.Atoi(value)
+				if err != nil || count < 0 {
+					log.Fatalf("fatal: invalid --%s value '%s'", option, value)
+				}
+				counts = append(counts, count)
+			}
+			return counts
+		}
+		windowCounts, depthCounts := parseCounts("window", windows), parseCounts("depth", depths)
+		if *benchmark {
+			if len(windowCounts) == 0 {
+				windowCounts = []int{0, 10, 50, 250}
+			}
+			if len(depthCounts) == 0 {
+				depthCounts = []int{10, 50}
+			}
+			repo.benchmarkPacking(windowCounts, depthCounts, repo.deltaOptions().threads)
+			return
+		}
+		if len(windowCounts) > 0 {
+			options.window = &windowCounts[len(windowCounts)-1]
+		}
+		if len(depthCounts) > 0 {
+			options.depth = &depthCounts[len(depthCounts)-1]
+		}
+		repo.gc(options)
+	}
+}
+
+func setupGrep(flags *flag.FlagSet) commandRunner {
+	var options grepOptions
+	flags.BoolVar(&options.lineNumbers, "n", false, "prefix matching lines with their line number")
+	flags.BoolVar(&options.filesOnly, "l", false, "show only the names of matching files")
+	flags.BoolVar(&options.countOnly, "c", false, "show the number of matching lines per file")
+	flags.BoolVar(&options.invert, "v", false, "select non-matching lines")
+	ignoreCase := flags.Bool("i", false, "ignore case differences")
+	fixedStrings := flags.Bool("F", false, "interpret the pattern as a fixed string")
+	flags.Bool("E", false, "use extended regular expressions; patterns are always read as RE2 ones, which extend them")
+	var patterns stringListFlag
+	flags.Var(&patterns, "e", "a `pattern` to search for, can be given several times to match lines matching any")
+	cached := flags.Bool("cached", false, "search the blobs registered in the index")
+	threads := flags.Int("threads", 0, "number of parallel workers (default grep.threads, then core.threads)")
+	return func(repo *Repository, args []string) {
+		if len(patterns) == 0 {
+			if len(args) == 0 {
+				flags.Usage()
+				os.Exit(129)
+			}
+			patterns, args = stringListFlag{args[0]}, args[1:]
+		}
+		alternatives := make([]string, len(patterns))
+		for i, pattern := range patterns {
+			alternatives[i] = pattern
+			if *fixedStrings {
+				alternatives[i] = regexp.QuoteMeta(pattern)
+			}
+			if _, err := regexp.Compile(alternatives[i]); err != nil {
+				log.Fatalf("fatal: invalid pattern '%s': %s", pattern, err)
+			}
+			alternatives[i] = "(?:" + alternatives[i] + ")"
+		}
+		expression := strings.Join(alternatives, "|")
+		if *ignoreCase {
+			expression = "(?i)" + expression
+		}
+		options.pattern = regexp.MustCompile(expression)
+		// leading arguments naming revisions are searched, the rest limit paths
+		treeishes := make([]string, 0)
+		for len(args) > 0 {
+			if _, ok := repo.lookupRevision(args[0]); !ok {
+				break
+			}
+			treeishes = append(treeishes, args[0])
+			args = args[1:]
+		}
+		pathspecs := repo.parsePathspecs(args)
+		if *threads == 0 {
+			*threads = int(repo.config.getInt("grep.threads", 0))
+		}
+		repo.setupPager("grep")
+		options.color = repo.useColor("grep")
+		targets := make([]grepTarget, 0)
+		if len(treeishes) == 0 {
+			targets = repo.grepTargets("", *cached, pathspecs)
+		}
+		for _, treeish := range treeishes {
+			targets = append(targets, repo.grepTargets(treeish, false, pathspecs)...)
+		}
+		if !grep(targets, options, repo.jobCount(*threads)) {
+			finishPager()
+			os.Exit(1)
+		}
+	}
+}
+
+func setupHelp(flags *flag.FlagSet) commandRunner {
+	return func(repo *Repository, args []string) {
+		if len(args) == 0 {
+			printUsage()
+			return
+		}
+		cmd, ok := findCommand(args[0])
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: '%s' is not a %s command. See '%s --help'.\n", programName(), args[0], programName(), programName())
+			os.Exit(1)
+		}
+		commandFlags := newCommandFlags(cmd)
+		cmd.setup(commandFlags)
+		commandFlags.SetOutput(os.Stdout)
+		commandFlags.Usage()
+	}
+}
+
+func setupIndexPack(flags *flag.FlagSet) commandRunner {
+	verbose := flags.Bool("v", false, "report progress")
+	indexPath := flags.String("o", "", "write the index to `index-file` instead of next to the pack")
+	fromStdin := flags.Bool("stdin", false, "read the pack from stdin and store it in the repository")
+	fixThin := flags.Bool("fix-thin", false, "append missing delta bases from the repository, requires --stdin")
+	return func(repo *Repository, args []string) {
+		if *fixThin && !*fromStdin {
+			log.Fatal("fatal: --fix-thin cannot be used without --stdin")
+		}
+		if *fromStdin == (len(args) == 1) || len(args) > 1 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		progress := newProgress(!*verbose)
+		var data []byte
+		var err error
+		if *fromStdin {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			if !strings.HasSuffix(args[0], ".pack") && *indexPath == "" {
+				log.Fatalf("fatal: packfile name '%s' does not end with '.pack'", args[0])
+			}
+			data, err = os.ReadFile(args[0])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		stream := parsePackStream(data, progress)
+		repo.indexPackStream(stream, *fixThin, progress)
+		if !*fromStdin {
+			if *indexPath == "" {
+				*indexPath = strings.TrimSuffix(args[0], ".pack") + ".idx"
+			}
+			writePackIndex(*indexPath, stream)
+			fmt.Println(stream.checksum())
+			return
+		}
+		checksum := repo.keepPack(stream)
+		if *indexPath != "" {
+			writePackIndex(*indexPath, stream)
+		}
+		fmt.Printf("pack\t%s\n", checksum)
+	}
+}
+
+func setupInterpretTrailers(flags *flag.FlagSet) commandRunner {
+	var options trailerOptions
+	// --where, --if-exists and --if-missing apply to the --trailer options
+	// after them, so each trailer takes the values set when it is parsed
+	var where, ifExists, ifMissing string
+	var arguments []trailerArgument
+	var texts []string
+	flags.Func("trailer", "add a `trailer`, \"token=value\" or \"token: value\"", func(text string) error {
+		texts = append(texts, text)
+		arguments = append(arguments, trailerArgument{where: where, ifExists: ifExists, ifMissing: ifMissing})
+		return nil
+	})
+	flags.Func("where", "place the next trailers at the end, start, after or before the trailers with the same token", func(value string) error {
+		switch value {
+		case "end", "start", "after", "before":
+			where = value
+			return nil
+		}
+		return fmt.Errorf("unknown value '%s' for key 'where'", value)
+	})
+	flags.Func("if-exists", "addIfDifferentNeighbor, addIfDifferent, add, replace or doNothing when the next trailers' token exists", func(value string) error {
+		switch value {
+		case "addIfDifferentNeighbor", "addIfDifferent", "add", "replace", "doNothing":
+			ifExists = value
+			return nil
+		}
+		return fmt.Errorf("unknown value '%s' for key 'ifexists'", value)
+	})
+	flags.Func("if-missing", "add or doNothing when the next trailers' token is missing", func(value string) error {
+		switch value {
+		case "add", "doNothing":
+			ifMissing = value
+			return nil
+		}
+		return fmt.Errorf("unknown value '%s' for key 'ifmissing'", value)
+	})
+	inPlace := flags.Bool("in-place", false, "edit the files in place")
+	flags.BoolVar(&options.trimEmpty, "trim-empty", false, "leave out trailers with an empty value")
+	flags.BoolVar(&options.onlyTrailers, "only-trailers", false, "output only the trailers")
+	flags.BoolVar(&options.onlyInput, "only-input", false, "do not add trailers, only format the existing ones")
+	flags.BoolVar(&options.unfold, "unfold", false, "join the continuation lines of trailers")
+	parse := flags.Bool("parse", false, "short for --only-trailers --only-input --unfold")
+	return func(repo *Repository, files []string) {
+		if *parse {
+			options.onlyTrailers, options.onlyInput, options.unfold = true, true, true
+		}
+		if *inPlace && len(files) == 0 {
+			log.Fatal("fatal: no input file given for in-place editing")
+		}
+		for i := range arguments {
+			arguments[i].item = repo.trailerArgumentItem(texts[i])
+			defaults := []struct {
+				value    *string
+				key      string
+				fallback string
+			}{
+				{&arguments[i].where, "where", "end"},
+				{&arguments[i].ifExists, "ifexists", "addIfDifferentNeighbor"},
+				{&arguments[i].ifMissing, "ifmissing", "add"},
+			}
+			for _, setting := range defaults {
+				if *setting.value != "" {
+					continue
+				}
+				*setting.value = setting.fallback
+				if value, ok := repo.config.get("trailer." + setting.key); ok {
+					*setting.value = value
+				}
+			}
+		}
+		options.trailers = arguments
+
+		if len(files) == 0 {
+			input, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Print(repo.interpretTrailers(string(input), options))
+			return
+		}
+		for _, file := range files {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				log.Fatalf("fatal: could not open '%s' for reading: %s", file, err)
+			}
+			output := repo.interpretTrailers(string(input), options)
+			if !*inPlace {
+				fmt.Print(output)
+			} else if err := os.WriteFile(file, []byte(output), 0666); err != nil {
+				log.Fatalf("fatal: could not write to '%s': %s", file, err)
+			}
+		}
+	}
+}
+
+func setupLog(flags *flag.FlagSet) commandRunner {
+	return setupLogCommand(flags, false)
+}
+
+// setupWhatchanged sets up log showing the raw changes of each commit,
+// leaving out the commits without any
+func setupWhatchanged(flags *flag.FlagSet) commandRunner {
+	return setupLogCommand(flags, true)
+}
+
+func setupLogCommand(flags *flag.FlagSet, whatchanged bool) commandRunner {
+	maxCount := flags.Int("n", -1, "limit the number of commits to output")
+	noNotes := flags.Bool("no-notes", false, "do not show notes")
+	prettyValue := flags.String("pretty", "", "show commits in `format`: oneline, short, medium, full, fuller, raw, or format:<string> (default format.pretty)")
+	flags.StringVar(prettyValue, "format", "", "show commits in `format`, like --pretty")
+	oneline := flags.Bool("oneline", false, "short for --pretty=oneline --abbrev-commit")
+	abbrevCommit := flags.Bool("abbrev-commit", false, "show abbreviated commit names")
+	var decorate optionalValueFlag
+	flags.Var(&decorate, "decorate", "show the refs pointing at commits, `style` short, full or no (default log.decorate)")
+	noDecorate := flags.Bool("no-decorate", false, "do not show the refs pointing at commits")
+	dateStyle := flags.String("date", "", "show dates in `format`: default, relative, local, iso, iso-strict, rfc, short, raw or unix (default log.date)")
+	var since, until string
+	flags.StringVar(&since, "since", "", "show commits more recent than `date`")
+	flags.StringVar(&since, "after", "", "show commits more recent than `date`")
+	flags.StringVar(&until, "until", "", "show commits older than `date`")
+	flags.StringVar(&until, "before", "", "show commits older than `date`")
+	topoOrder := flags.Bool("topo-order", false, "show no parent before all its children, without intermixing lines of history")
+	dateOrder := flags.Bool("date-order", false, "show no parent before all its children, otherwise by commit date")
+	authorDateOrder := flags.Bool("author-date-order", false, "show no parent before all its children, otherwise by author date")
+	reverse := flags.Bool("reverse", false, "show the selected commits oldest first")
+	var logDiff logDiffOptions
+	flags.BoolFunc("c", "show the changes of commits, merges as combined diffs against all parents", func(string) error {
+		logDiff.patch, logDiff.combined = true, "combined"
+		return nil
+	})
+	flags.BoolFunc("cc", "show the changes of commits, merges as combined diffs without the hunks where the result takes one parent's side", func(string) error {
+		logDiff.patch, logDiff.combined = true, "cc"
+		return nil
+	})
+	flags.BoolVar(&logDiff.patch, "p", false, "show the changes of each commit as a patch")
+	flags.BoolVar(&logDiff.patch, "u", false, "show the changes of each commit as a patch, like -p")
+	flags.BoolVar(&logDiff.patch, "patch", false, "show the changes of each commit as a patch, like -p")
+	flags.BoolVar(&logDiff.stat, "stat", false, "show a diffstat of the changes of each commit")
+	flags.BoolVar(&logDiff.raw, "raw", false, "show the changes of each commit in the raw format")
+	var findRenames optionalValueFlag
+	flags.Var(&findRenames, "M", "detect renames of files at least `n` similar, 50% if not given (default diff.renames)")
+	flags.Var(&findRenames, "find-renames", "detect renames of files at least `n` similar, like -M")
+	noRenames := flags.Bool("no-renames", false, "do not detect renames")
+	flags.BoolVar(&logDiff.follow, "follow", false, "continue listing the history of a single file beyond renames")
+	noTextconv := flags.Bool("no-textconv", false, "diff contents as they are, not through diff.<driver>.textconv")
+	extDiff := flags.Bool("ext-diff", false, "let external diff commands show the changes")
+	// ref selections start the walk from every ref they match, "" standing
+	// for --all
+	var refGlobs []string
+	all := flags.Bool("all", false, "start from all refs and HEAD")
+	selectRefs := func(namespace string) func(string) error {
+		return func(value string) error {
+			if value == "true" {
+				value = ""
+			}
+			refGlobs = append(refGlobs, path.Join(namespace, value))
+			return nil
+		}
+	}
+	flags.BoolFunc("branches", "start from the branches, those matching `pattern` if given", selectRefs("refs/heads"))
+	flags.BoolFunc("tags", "start from the tags, those matching `pattern` if given", selectRefs("refs/tags"))
+	flags.BoolFunc("remotes", "start from the remote-tracking branches, those matching `pattern` if given", selectRefs("refs/remotes"))
+	flags.Func("glob", "start from the refs matching `pattern`, relative to refs/ unless it starts with refs/", func(value string) error {
+		refGlobs = append(refGlobs, value)
+		return nil
+	})
+	return func(repo *Repository, revisions []string) {
+		// the revisions come first, what follows limits the paths
+		revisions, paths := repo.splitRevisionArguments(revisions)
+		logDiff.paths = repo.parsePathspecs(paths)
+		if logDiff.follow && len(logDiff.paths) != 1 {
+			log.Fatal("fatal: --follow requires exactly one pathspec")
+		}
+		if *dateStyle == "" {
+			*dateStyle = "default"
+			if style, ok := repo.config.get("log.date"); ok {
+				*dateStyle = style
+			}
+		}
+		checkDateStyle(*dateStyle)
+		if *oneline {
+			*prettyValue, *abbrevCommit = "oneline", true
+		}
+		// notes only show unless a format is given on the command line
+		showNotes := *prettyValue == ""
+		if *prettyValue == "" {
+			*prettyValue, _ = repo.config.get("format.pretty")
+		}
+		pretty := parsePrettyFormat(*prettyValue)
+		if whatchanged && !logDiff.patch && !logDiff.stat {
+			logDiff.raw = true
+		}
+		// renames are detected unless diff.renames is off, which
+		// "copies" is not
+		switch {
+		case *noRenames:
+		case findRenames == "" || findRenames == "true":
+			renames, _ := repo.config.get("diff.renames")
+			if findRenames == "true" || strings.EqualFold(renames, "copies") || strings.EqualFold(renames, "copy") || repo.config.getBool("diff.renames", true) {
+				logDiff.renameScore = defaultRenameScore
+			}
+		default:
+			score, ok := parseRenameScore(string(findRenames))
+			if !ok {
+				fmt.Fprintln(os.Stderr, "error: invalid argument to find-renames")
+				os.Exit(129)
+			}
+			logDiff.renameScore = score
+		}
+		if logDiff.shows() && pretty.preset == "" {
+			// with diffs, format strings end in a newline as tformat ones
+			pretty.terminator = true
+		}
+		decorateValue := string(decorate)
+		if *noDecorate {
+			decorateValue = "no"
+		} else if decorateValue == "" {
+			decorateValue, _ = repo.config.get("log.decorate")
+		}
+		decorateStyle := parseDecorateStyle(decorateValue)
+		now := time.Now()
+		var sinceTime, untilTime time.Time
+		for _, limit := range []struct {
+			value string
+			when  *time.Time
+		}{{since, &sinceTime}, {until, &untilTime}} {
+			if limit.value == "" {
+				continue
+			}
+			var ok bool
+			if *limit.when, ok = parseDate(limit.value, now); !ok {
+				log.Fatalf("fatal: invalid date format: %s", limit.value)
+			}
+		}
+		selectedRefs := make([]string, 0)
+		if *all {
+			if _, ok := repo.resolveRef("HEAD"); ok {
+				selectedRefs = append(selectedRefs, "HEAD")
+			}
+			selectedRefs = append(selectedRefs, repo.listRefs("refs/")...)
+		}
+		for _, glob := range refGlobs {
+			selectedRefs = append(selectedRefs, repo.globRefs(glob)...)
+		}
+		if len(revisions) == 0 && !*all && len(refGlobs) == 0 {
+			revisions = []string{"HEAD"}
+		}
+		heads := make([]string, 0)
+		for _, ref := range selectedRefs {
+			// refs to trees and blobs have no history
+			hash, _ := repo.resolveRef(ref)
+			target, _ := repo.peelTags(hash)
+			if header, _ := repo.readObject(target); header.objectType == "commit" {
+				heads = append(heads, target)
+			}
+		}
+		if len(revisions) == 1 && revisions[0] == "HEAD" {
+			if _, ok := repo.resolveRef("HEAD"); !ok {
+				branch, _ := repo.headBranch()
+				log.Fatalf("fatal: your current branch '%s' does not have any commits yet", branch)
+			}
+		}
+		walk := repo.parseRevisionArgs(revisions)
+		for _, object := range walk.included {
+			heads = append(heads, repo.peelToCommit(object.hash))
+		}
+		// the history of "^<rev>" and "<rev>.." is left out
+		excluded := make(map[string]bool)
+		excludedCommits := newCommitIter(repo, walk.excluded, commitOrderDate, false)
+		for {
+			hash, _, ok := excludedCommits.next()
+			if !ok {
+				break
+			}
+			excluded[hash] = true
+		}
+		if !jsonOutput && whatchanged {
+			repo.setupPager("whatchanged")
+		} else if !jsonOutput {
+			repo.setupPager("log")
+		}
+		color := repo.useColor("diff")
+		logDiff.diff = diffOptions{
+			context:    DefaultDiffContext,
+			colors:     repo.diffColors(color),
+			whitespace: repo.whitespaceRule(),
+			highlight:  "+",
+			textconv:   !*noTextconv,
+			external:   *extDiff,
+			submodule:  repo.submoduleFormat(""),
+		}
+		notesRef := repo.notesRef("")
+		notes := make(map[string]string)
+		if !*noNotes {
+			notes = repo.readNotes(notesRef)
+		}
+		var decorations refDecorations
+		if decorateStyle != "no" || pretty.preset == "" {
+			decorations = repo.loadDecorations()
+		}
+		order := commitOrderDate
+		switch {
+		case *topoOrder:
+			order = commitOrderTopo
+		case *dateOrder:
+			order = commitOrderTopoDate
+		case *authorDateOrder:
+			order = commitOrderTopoAuthorDate
+		}
+		// --reverse reverses the commits -n picks, so it applies after it
+		var follow func(hash string, commit commitObject) []string
+		var changing map[string]bool
+		var followedPaths map[string]string
+		if logDiff.follow {
+			// renames are followed even when not shown
+			renameScore := logDiff.renameScore
+			if renameScore == 0 {
+				renameScore = defaultRenameScore
+			}
+			follow, changing, followedPaths = repo.followRenames(logDiff.paths[0].path, renameScore)
+		} else if len(logDiff.paths) > 0 {
+			follow, changing = repo.simplifyHistory(logDiff.paths)
+		}
+		if len(excluded) > 0 {
+			simplify := follow
+			follow = func(hash string, commit commitObject) []string {
+				parents := commit.parents
+				if simplify != nil {
+					parents = simplify(hash, commit)
+				}
+				kept := make([]string, 0, len(parents))
+				for _, parent := range parents {
+					if !excluded[parent] {
+						kept = append(kept, parent)
+					}
+				}
+				return kept
+			}
+		}
+		iter := newSimplifiedCommitIter(repo, heads, order, false, follow)
+		var selected []queuedCommit
+		for *maxCount < 0 || len(selected) < *maxCount {
+			hash, commit, ok := iter.next()
+			if !ok {
+				break
+			}
+			if excluded[hash] || changing != nil && !changing[hash] {
+				continue
+			}
+			if followedPaths != nil {
+				logDiff.paths = []pathspec{literalPathspec(followedPaths[hash])}
+			}
+			if whatchanged && (len(commit.parents) > 1 && logDiff.combined == "" || len(commit.parents) < 2 && len(repo.commitChanges(commit, logDiff)) == 0) {
+				continue
+			}
+			committed := commit.committer.when
+			if !sinceTime.IsZero() && committed.Before(sinceTime) || !untilTime.IsZero() && committed.After(untilTime) {
+				continue
+			}
+			selected = append(selected, queuedCommit{hash: hash, commit: commit})
+		}
+		if *reverse {
+			for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+				selected[i], selected[j] = selected[j], selected[i]
+			}
+		}
+
+		commits := make([]jsonCommit, 0)
+		for shown, item := range selected {
+			hash, commit := item.hash, item.commit
+			note, _ := repo.noteFor(notes, hash)
+			if jsonOutput {
+				entry := newJSONCommit(hash, commit)
+				entry.Notes = note
+				commits = append(commits, entry)
+				continue
+			}
+			if shown > 0 && !pretty.terminator {
+				fmt.Println()
+			}
+			repo.writePrettyCommit(os.Stdout, hash, commit, pretty, prettyOptions{
+				color:        color,
+				dateStyle:    *dateStyle,
+				abbrevCommit: *abbrevCommit,
+				note:         note,
+				notesName:    notesDisplayName(notesRef),
+				showNotes:    showNotes,
+				decoration:   decorations.format(hash, decorateStyle, color),
+				decorate:     decorateStyle != "no",
+			})
+			if followedPaths != nil {
+				logDiff.paths = []pathspec{literalPathspec(followedPaths[hash])}
+			}
+			repo.writeLogDiff(os.Stdout, commit, pretty, logDiff)
+		}
+		if jsonOutput {
+			printJSON(commits)
+		}
+	}
+}
+
+// expandCountShorthand rewrites git's "-<n>" form into "-<countFlag> <n>",
+// and "-n<n>" too when the count flag is -n
+func expandCountShorthand(args []string, countFlag string) []string {
+	expanded := make([]string, 0, len(args))
+	for i, arg := range args {
+		count := strings.TrimPrefix(arg, "-")
+		if countFlag == "n" {
+			count = strings.TrimPrefix(count, "n")
+		}
+		if strings.HasPrefix(arg, "-") && count != "" && strings.Trim(count, "0123456789") == "" {
+			expanded = append(expanded, "-"+countFlag, count)
+			continue
+		}
+		if arg == "--" {
+			return append(expanded, args[i:]...)
+		}
+		expanded = append(expanded, arg)
+	}
+	return expanded
+}
+
+func setupLsFiles(flags *flag.FlagSet) commandRunner {
+	var options lsFilesOptions
+	flags.BoolVar(&options.showStage, "s", false, "show mode, object name and stage of each entry")
+	flags.BoolVar(&options.showTags, "t", false, "tag each entry with its status: H cached, S skip-worktree, M unmerged")
+	lowercase := flags.Bool("v", false, "like -t, with lowercase tags for assume-unchanged entries")
+	nulTerminated := flags.Bool("z", false, "terminate entries with NUL and do not quote paths")
+	return func(repo *Repository, pathspecs []string) {
+		if *lowercase {
+			options.showTags, options.lowercaseAssumeUnchanged = true, true
+		}
+		repo.listIndexFiles(repo.parsePathspecs(pathspecs), options, pathPrinter{*nulTerminated})
+	}
+}
+
+func setupLsTree(flags *flag.FlagSet) commandRunner {
+	var options lsTreeOptions
+	flags.BoolVar(&options.recursive, "r", false, "recurse into subtrees")
+	flags.BoolVar(&options.showTrees, "t", false, "show trees when recursing")
+	flags.BoolVar(&options.nameOnly, "name-only", false, "list only file names")
+	nulTerminated := flags.Bool("z", false, "terminate entries with NUL and do not quote paths")
+	return func(repo *Repository, arguments []string) {
+		if len(arguments) == 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		options.pathspecs = repo.pathspecsFromPrefix(arguments[1:])
+		for i, pathspec := range arguments[1:] {
+			// a trailing slash asks for the contents of a directory
+			if strings.HasSuffix(pathspec, "/") && options.pathspecs[i] != "." {
+				options.pathspecs[i] += "/"
+			}
+		}
+		repo.listTree(repo.resolveTreeish(arguments[0]), options, pathPrinter{*nulTerminated})
+	}
+}
+
+func setupMaintenance(flags *flag.FlagSet) commandRunner {
+	var options maintenanceOptions
+	var tasks stringListFlag
+	flags.BoolVar(&options.auto, "auto", false, "only run the tasks whose thresholds are reached")
+	flags.BoolVar(&options.quiet, "quiet", false, "do not report progress")
+	flags.Var(&tasks, "task", "run the named `task` (loose-objects, incremental-repack, gc or commit-graph), can be repeated")
+	return func(repo *Repository, args []string) {
+		if len(args) != 1 || args[0] != "run" {
+			flags.Usage()
+			os.Exit(129)
+		}
+		repo.runMaintenance(tasks, options)
+	}
+}
+
+func setupMerge(flags *flag.FlagSet) commandRunner {
+	var options mergeOptions
+	commit := flags.Bool("commit", false, "commit the merge (default)")
+	noCommit := flags.Bool("no-commit", false, "stop before committing a merge that is not a fast-forward")
+	flags.BoolVar(&options.squash, "squash", false, "stage the merged changes without recording a merge or moving HEAD")
+	ffOnly := flags.Bool("ff-only", false, "refuse to merge a commit the branch has diverged from (default merge.ff)")
+	ff := flags.Bool("ff", false, "fast-forward when the branch has not diverged, merge otherwise")
+	noFF := flags.Bool("no-ff", false, "create a merge commit even when a fast-forward is possible")
+	flags.StringVar(&options.message, "m", "", "use `message` for the merge commit")
+	flags.StringVar(&options.message, "message", "", "use `message` for the merge commit")
+	flags.BoolVar(&options.quiet, "q", false, "suppress feedback messages")
+	flags.BoolVar(&options.quiet, "quiet", false, "suppress feedback messages")
+	return func(repo *Repository, args []string) {
+		if len(args) == 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		switch {
+		case options.squash && *noFF:
+			log.Fatal("fatal: options '--squash' and '--no-ff' cannot be used together")
+		case options.squash && *commit:
+			log.Fatal("fatal: options '--squash' and '--commit' cannot be used together")
+		}
+		options.commit = !*noCommit
+		switch {
+		case *ffOnly:
+			options.ff = "only"
+		case *noFF:
+			options.ff = "false"
+		case *ff:
+			options.ff = "true"
+		}
+		if !repo.merge(args, options) {
+			os.Exit(1)
+		}
+	}
+}
+
+func setupMergetool(flags *flag.FlagSet) commandRunner {
+	var options mergetoolOptions
+	flags.StringVar(&options.tool, "t", "", "use the merge resolution `tool` (default merge.tool)")
+	flags.StringVar(&options.tool, "tool", "", "use the merge resolution `tool` (default merge.tool)")
+	noPrompt := flags.Bool("y", false, "do not prompt before launching the tool")
+	flags.BoolVar(noPrompt, "no-prompt", false, "do not prompt before launching the tool")
+	prompt := flags.Bool("prompt", false, "prompt before each launch of the tool (default mergetool.prompt)")
+	return func(repo *Repository, pathspecs []string) {
+		options.prompt = repo.config.getBool("mergetool.prompt", false)
+		switch {
+		case *prompt:
+			options.prompt = true
+		case *noPrompt:
+			options.prompt = false
+		}
+		repo.mergetool(repo.parsePathspecs(pathspecs), options)
+	}
+}
+
+func setupNameRev(flags *flag.FlagSet) commandRunner {
+	options := nameRevOptions{undefined: true}
+	var refPatterns, excludePatterns stringListFlag
+	flags.BoolVar(&options.nameOnly, "name-only", false, "print only ref-based names (no object names)")
+	flags.BoolVar(&options.tagsOnly, "tags", false, "only use tags to name the commits")
+	flags.Var(&refPatterns, "refs", "only use refs matching `pattern`, can be repeated")
+	flags.Var(&excludePatterns, "exclude", "ignore refs matching `pattern`, can be repeated")
+	all := flags.Bool("all", false, "list all commits reachable from all refs")
+	stdin := flags.Bool("stdin", false, "deprecated: use --annotate-stdin instead")
+	annotateStdin := flags.Bool("annotate-stdin", false, "annotate text from stdin")
+	noUndefined := flags.Bool("no-undefined", false, "fail instead of printing `undefined` names")
+	undefined := flags.Bool("undefined", true, "allow to print `undefined` names (default)")
+	flags.BoolVar(&options.always, "always", false, "show abbreviated commit object as fallback")
+	return func(repo *Repository, args []string) {
+		options.undefined = *undefined && !*noUndefined
+		options.refPatterns, options.excludePatterns = refPatterns, excludePatterns
+		if *stdin {
+			fmt.Fprintln(os.Stderr, "warning: --stdin is deprecated. Please use --annotate-stdin instead, which is functionally equivalent.")
+			fmt.Fprintln(os.Stderr, "This option will be removed in a future release.")
+			*annotateStdin = true
+		}
+		switch {
+		case *all && *annotateStdin:
+			log.Fatal("fatal: --all and --annotate-stdin are incompatible")
+		case *all || *annotateStdin:
+			if len(args) > 0 {
+				flags.Usage()
+				os.Exit(129)
+			}
+			namer := repo.newRevNamer(options)
+			if *all {
+				namer.showAll(os.Stdout)
+			} else {
+				namer.annotate(os.Stdout, os.Stdin)
+			}
+		case len(args) == 0:
+			flags.Usage()
+			os.Exit(129)
+		default:
+			repo.nameRevisions(os.Stdout, args, options)
+		}
+	}
+}
+
+func setupNotes(flags *flag.FlagSet) commandRunner {
+	ref := flags.String("ref", "", "use notes from this ref (default core.notesRef, then refs/notes/commits)")
+	force := flags.Bool("f", false, "add: overwrite existing notes")
+	messages := make([]string, 0)
+	flags.Func("m", "add: use the given note message, paragraphs of several -m are joined", func(message string) error {
+		messages = append(messages, message)
+		return nil
+	})
+	return func(repo *Repository, args []string) {
+		subcommand := "list"
+		if len(args) > 0 {
+			subcommand, args = args[0], args[1:]
+		}
+		notesRef := repo.notesRef(*ref)
+		switch subcommand {
+		case "add":
+			if len(messages) == 0 {
+				log.Fatal("fatal: a note message is required, use -m <message>")
+			}
+			repo.addNote(notesRef, repo.resolveNotesObject(args), formatNoteMessage(messages), *force)
+		case "show":
+			object := repo.resolveNotesObject(args)
+			note, ok := repo.noteFor(repo.readNotes(notesRef), object)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "error: no note found for object %s.\n", object)
+				os.Exit(1)
+			}
+			fmt.Print(note)
+		case "remove":
+			repo.removeNote(notesRef, repo.resolveNotesObject(args))
+		case "list":
+			object := ""
+			if len(args) > 0 {
+				object = repo.resolveNotesObject(args)
+			}
+			repo.listNotes(notesRef, object)
+		default:
+			flags.Usage()
+			os.Exit(129)
+		}
+	}
+}
+
+func setupPackRefs(flags *flag.FlagSet) commandRunner {
+	all := flags.Bool("all", false, "pack everything")
+	noPrune := flags.Bool("no-prune", false, "do not remove the loose refs that were packed")
+	return func(repo *Repository, args []string) {
+		if len(args) != 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		repo.packRefs(*all, !*noPrune)
+	}
+}
+
+func setupPatchID(flags *flag.FlagSet) commandRunner {
+	stable := flags.Bool("stable", false, "use the stable patch id algorithm")
+	unstable := flags.Bool("unstable", false, "use the unstable patch id algorithm")
+	verbatim := flags.Bool("verbatim", false, "do not ignore whitespace when computing the id")
+	return func(repo *Repository, args []string) {
+		if len(args) != 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		options := repo.patchIDOptionsFromConfig()
+		if *stable {
+			options.stable = true
+		}
+		if *unstable {
+			options = patchIDOptions{}
+		}
+		if *verbatim {
+			options = patchIDOptions{stable: true, verbatim: true}
+		}
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writePatchIDs(os.Stdout, string(data), options)
+	}
+}
+
+func setupPrune(flags *flag.FlagSet) commandRunner {
+	var options pruneOptions
+	flags.BoolVar(&options.dryRun, "n", false, "do not remove anything, only report what would be removed")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "do not remove anything, only report what would be removed")
+	flags.BoolVar(&options.verbose, "v", false, "report all removed objects")
+	flags.BoolVar(&options.verbose, "verbose", false, "report all removed objects")
+	expire := flags.String("expire", "now", "only expire loose objects older than `time`")
+	return func(repo *Repository, heads []string) {
+		now := time.Now()
+		options.expire = repo.expiryOption(*expire, "", "now", now)
+		extraHeads := make([]string, 0, len(heads))
+		for _, head := range heads {
+			extraHeads = append(extraHeads, repo.resolveRevision(head))
+		}
+		repo.prune(repo.reachableObjects(extraHeads), options)
+	}
+}
+
+func setupPull(flags *flag.FlagSet) commandRunner {
+	var options pullOptions
+	rebase := flags.Bool("r", false, "rebase the current branch on the upstream instead of merging it")
+	flags.BoolVar(rebase, "rebase", false, "rebase the current branch on the upstream instead of merging it")
+	noRebase := flags.Bool("no-rebase", false, "merge the upstream even when pull.rebase is set")
+	ffOnly := flags.Bool("ff-only", false, "refuse to integrate an upstream the branch has diverged from (default pull.ff)")
+	ff := flags.Bool("ff", false, "fast-forward when the branch has not diverged, merge otherwise")
+	noFF := flags.Bool("no-ff", false, "create a merge commit even when a fast-forward is possible")
+	autostash := flags.Bool("autostash", false, "stash local changes before and reapply them after (default rebase.autoStash or merge.autoStash)")
+	noAutostash := flags.Bool("no-autostash", false, "do not stash local changes, whatever the config says")
+	flags.BoolVar(&options.quiet, "q", false, "suppress feedback messages")
+	flags.BoolVar(&options.quiet, "quiet", false, "suppress feedback messages")
+	return func(repo *Repository, args []string) {
+		switch {
+		case *rebase:
+			options.rebase = "true"
+		case *noRebase:
+			options.rebase = "false"
+		}
+		switch {
+		case *ffOnly:
+			options.ff = "only"
+		case *noFF:
+			options.ff = "false"
+		case *ff:
+			options.ff = "true"
+		}
+		switch {
+		case *autostash:
+			options.autostash = "true"
+		case *noAutostash:
+			options.autostash = "false"
+		}
+		repo.pull(args, options)
+	}
+}
+
+func setupRangeDiff(flags *flag.FlagSet) commandRunner {
+	var options rangeDiffOptions
+	flags.IntVar(&options.creationFactor, "creation-factor", DefaultCreationFactor, "percentage by which creation is weighted")
+	flags.BoolVar(&options.noPatch, "s", false, "do not show the diff between matching commits")
+	flags.BoolVar(&options.noPatch, "no-patch", false, "do not show the diff between matching commits")
+	return func(repo *Repository, args []string) {
+		oldRange, newRange := rangeDiffRanges(args)
+		repo.rangeDiff(os.Stdout, oldRange, newRange, options)
+	}
+}
+
+func setupRebase(flags *flag.FlagSet) commandRunner {
+	var options rebaseOptions
+	autostash := flags.Bool("autostash", false, "stash local changes before and reapply them after (default rebase.autoStash)")
+	noAutostash := flags.Bool("no-autostash", false, "do not stash local changes, whatever the config says")
+	flags.BoolVar(&options.quiet, "q", false, "suppress feedback messages")
+	flags.BoolVar(&options.quiet, "quiet", false, "suppress feedback messages")
+	return func(repo *Repository, args []string) {
+		if len(args) > 1 {
+			log.Fatal("fatal: rebasing another branch than the current one is not supported")
+		}
+		upstream := ""
+		if len(args) > 0 {
+			upstream = args[0]
+		}
+		options.autostash = *autostash || !*noAutostash && repo.config.getBool("rebase.autoStash", false)
+		repo.rebase(upstream, options)
+	}
+}
+
+func setupReflog(flags *flag.FlagSet) commandRunner {
+	var options reflogExpireOptions
+	expire := flags.String("expire", "", "prune entries older than `time` (default gc.reflogExpire or 90 days)")
+	expireUnreachable := flags.String("expire-unreachable", "", "prune entries older than `time` that are not reachable from the ref (default gc.reflogExpireUnreachable or 30 days)")
+	all := flags.Bool("all", false, "process the reflogs of all refs")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "do not prune anything, only report")
+	flags.BoolVar(&options.verbose, "verbose", false, "print every entry that is kept or pruned")
+	return func(repo *Repository, args []string) {
+		if len(args) == 0 || args[0] != "expire" {
+			flags.Usage()
+			os.Exit(129)
+		}
+		refs := args[1:]
+		if *all {
+			refs = repo.listReflogs()
+		} else if len(refs) == 0 {
+			log.Fatal("fatal: no reflog specified to expire")
+		}
+		now := time.Now()
+		options.expire = repo.expiryOption(*expire, "gc.reflogExpire", "90.days.ago", now)
+		options.expireUnreachable = repo.expiryOption(*expireUnreachable, "gc.reflogExpireUnreachable", "30.days.ago", now)
+		for _, ref := range refs {
+			if ref != "HEAD" && !strings.HasPrefix(ref, "refs/") {
+				if repo.hasReflog("refs/heads/" + ref) {
+					ref = "refs/heads/" + ref
+				}
+			}
+			if !repo.hasReflog(ref) {
+				fmt.Fprintf(os.Stderr, "error: reflog could not be found: '%s'\n", ref)
+				continue
+			}
+			repo.expireReflog(ref, options)
+		}
+	}
+}
+
+func setupReplace(flags *flag.FlagSet) commandRunner {
+	force := flags.Bool("f", false, "overwrite an existing replacement")
+	remove := flags.Bool("d", false, "delete the replacements of the given objects")
+	list := flags.Bool("l", false, "list replaced objects matching the pattern")
+	return func(repo *Repository, args []string) {
+		switch {
+		case *remove:
+			for _, object := range args {
+				repo.deleteReplacement(repo.resolveRevision(object))
+			}
+		case *list || len(args) == 0:
+			pattern := ""
+			if len(args) > 0 {
+				pattern = args[0]
+			}
+			repo.listReplacements(pattern)
+		case len(args) == 2:
+			repo.replaceObject(repo.resolveRevision(args[0]), repo.resolveRevision(args[1]), *force)
+		default:
+			flags.Usage()
+			os.Exit(129)
+		}
+	}
+}
+
+func setupRerere(flags *flag.FlagSet) commandRunner {
+	return func(repo *Repository, args []string) {
+		if len(args) == 0 {
+			repo.rerere()
+			return
+		}
+		switch args[0] {
+		case "status":
+			repo.rerereStatus()
+		case "forget":
+			if len(args) < 2 {
+				log.Fatal("fatal: 'git rerere forget' without paths is deprecated")
+			}
+			repo.rerereForget(repo.parsePathspecs(args[1:]))
+		case "clear":
+			repo.rerereClear()
+		default:
+			flags.Usage()
+			os.Exit(129)
+		}
+	}
+}
+
+func setupReset(flags *flag.FlagSet) commandRunner {
+	patch := flags.Bool("p", false, "pick the hunks of the staged changes to unstage interactively")
+	flags.BoolVar(patch, "patch", false, "pick the hunks of the staged changes to unstage interactively")
+	return func(repo *Repository, pathspecs []string) {
+		if !*patch {
+			flags.Usage()
+			os.Exit(129)
+		}
+		repo.resetPatch(repo.parsePathspecs(pathspecs))
+	}
+}
+
+func setupRevList(flags *flag.FlagSet) commandRunner {
+	objects := flags.Bool("objects", false, "list the trees and blobs the commits need too, with their paths")
+	noObjectNames := flags.Bool("no-object-names", false, "list the objects without their paths")
+	all := flags.Bool("all", false, "walk from all refs and HEAD")
+	return func(repo *Repository, args []string) {
+		walk := repo.parseRevisionArgs(args)
+		if *all {
+			names := repo.listRefs("refs/")
+			if _, ok := repo.resolveRef("HEAD"); ok {
+				names = append(names, "HEAD")
+			}
+			walk.included = append(walk.included, repo.parseRevisionArgs(names).included...)
+		}
+		repo.revList(walk, *objects, !*noObjectNames)
+	}
+}
+
+func setupRewrite(flags *flag.FlagSet) commandRunner {
+	var removePaths, renames stringListFlag
+	flags.Var(&removePaths, "remove-path", "leave the file or directory out of every commit")
+	subdirectory := flags.String("subdirectory-filter", "", "keep only the directory, as the root")
+	flags.Var(&renames, "path-rename", "rename <old>:<new> paths, or directories holding them")
+	replaceMessage := flags.String("replace-message", "", "replace the text matching the expressions in the file in messages")
+	mailmap := flags.String("mailmap", "", "rewrite authors, committers and taggers by the mailmap file")
+	keepEmpty := flags.Bool("keep-empty", false, "keep the commits left without changes")
+	return func(repo *Repository, args []string) {
+		if len(args) > 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		rewrite := &historyRewrite{removePaths: removePaths, subdirectory: *subdirectory, keepEmpty: *keepEmpty}
+		for _, rename := range renames {
+			old, new, ok := strings.Cut(rename, ":")
+			if !ok {
+				log.Fatalf("fatal: --path-rename expects <old>:<new>, not '%s'", rename)
+			}
+			rewrite.renames = append(rewrite.renames, [2]string{old, new})
+		}
+		if *replaceMessage != "" {
+			rewrite.message = messageReplacements(*replaceMessage)
+		}
+		if *mailmap != "" {
+			rewrite.identity = readMailmap(*mailmap)
+		}
+		repo.rewriteHistory(rewrite)
+	}
+}
+
+func setupSendEmail(flags *flag.FlagSet) commandRunner {
+	options := sendEmailOptions{thread: true}
+	flags.StringVar(&options.from, "from", "", "the sender `address` (default sendemail.from or the committer)")
+	to := stringListFlag{}
+	cc := stringListFlag{}
+	flags.Var(&to, "to", "send to `address`, can be repeated (default sendemail.to)")
+	flags.Var(&cc, "cc", "copy `address`, can be repeated")
+	flags.StringVar(&options.inReplyTo, "in-reply-to", "", "make the first mail a reply to message `id`")
+	flags.StringVar(&options.server, "smtp-server", "", "SMTP `host`, or the path of a sendmail program (default sendemail.smtpServer)")
+	flags.IntVar(&options.port, "smtp-server-port", 0, "SMTP `port` (default sendemail.smtpServerPort)")
+	flags.StringVar(&options.user, "smtp-user", "", "SMTP user name (default sendemail.smtpUser)")
+	flags.StringVar(&options.password, "smtp-pass", "", "SMTP password (default sendemail.smtpPass)")
+	flags.StringVar(&options.encryption, "smtp-encryption", "", "ssl or tls (default sendemail.smtpEncryption)")
+	noThread := flags.Bool("no-thread", false, "do not add In-Reply-To and References headers")
+	flags.BoolVar(&options.chainReplyTo, "chain-reply-to", false, "make every mail a reply to the previous one")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "do everything except actually send the mails")
+	flags.BoolVar(&options.quiet, "quiet", false, "only print errors")
+	return func(repo *Repository, arguments []string) {
+		if len(arguments) == 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		options.to, options.cc = to, cc
+		options.thread = !*noThread
+		repo.sendEmailConfig(&options)
+		repo.sendEmails(patchFiles(arguments), options)
+	}
+}
+
+func setupShowBranch(flags *flag.FlagSet) commandRunner {
+	var options showBranchOptions
+	all := flags.Bool("all", false, "show remote-tracking and local branches")
+	flags.BoolVar(all, "a", false, "show remote-tracking and local branches")
+	remotes := flags.Bool("remotes", false, "show remote-tracking branches")
+	flags.BoolVar(remotes, "r", false, "show remote-tracking branches")
+	current := flags.Bool("current", false, "include the current branch")
+	var more optionalValueFlag
+	flags.Var(&more, "more", "show `n` more commits after the common ancestor, 1 if not given")
+	list := flags.Bool("list", false, "only list the branches, as --more=-1")
+	flags.BoolVar(&options.noName, "no-name", false, "do not name the commits")
+	flags.BoolVar(&options.sha1Name, "sha1-name", false, "name the commits by their object names")
+	flags.Bool("topo-order", true, "show commits in topological order")
+	flags.BoolVar(&options.dateOrder, "date-order", false, "show commits in date order where possible")
+	flags.BoolVar(&options.sparse, "sparse", false, "show merges reachable from only one branch")
+	flags.BoolVar(&options.topics, "topics", false, "show only the commits not on the first branch")
+	flags.BoolVar(&options.mergeBase, "merge-base", false, "show the possible merge bases")
+	flags.BoolVar(&options.independent, "independent", false, "show the refs not reachable from any other")
+	return func(repo *Repository, args []string) {
+		switch more {
+		case "":
+		case "true":
+			options.more = 1
+		default:
+			n, err := strconv.Atoi(string(more))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error: option `more' expects a numerical value")
+				flags.Usage()
+				os.Exit(129)
+			}
+			options.more = n
+		}
+		if *list {
+			options.more = -1
+		}
+		if options.more < 0 && (options.mergeBase || options.independent) {
+			log.Fatal("fatal: --more, --list, --merge-base and --independent cannot be used together")
+		}
+		if len(args) == 0 && !*all && !*remotes {
+			args = repo.config.getAll("showbranch.default")
+		}
+		refs := &showBranchRefs{repo: repo}
+		if *all || !*remotes && (len(args) == 0 || options.topics && len(args) == 1) {
+			refs.addAll("refs/heads/")
+		}
+		if *remotes || *all {
+			refs.addAll("refs/remotes/")
+		}
+		for _, arg := range args {
+			refs.addArgument(arg)
+		}
+		if *current {
+			if branch, ok := repo.headBranch(); ok {
+				found := false
+				for _, name := range refs.names {
+					found = found || showBranchIsHead("refs/heads/"+branch, name)
+				}
+				if !found {
+					refs.add(branch)
+				}
+			}
+		}
+		options.color = repo.useColor("showBranch")
+		os.Exit(repo.showBranch(refs.names, options))
+	}
+}
+
+func setupShowRef(flags *flag.FlagSet) commandRunner {
+	var options showRefOptions
+	flags.BoolVar(&options.heads, "heads", false, "only show branches")
+	flags.BoolVar(&options.tags, "tags", false, "only show tags")
+	flags.BoolVar(&options.head, "head", false, "show HEAD as well")
+	flags.BoolVar(&options.dereference, "d", false, "dereference tags into object IDs")
+	flags.BoolVar(&options.dereference, "dereference", false, "dereference tags into object IDs")
+	flags.BoolVar(&options.hashOnly, "s", false, "only show the object names")
+	flags.BoolVar(&options.hashOnly, "hash", false, "only show the object names")
+	verify := flags.Bool("verify", false, "require an exact ref path match")
+	quiet := flags.Bool("q", false, "do not print results, only set the exit status")
+	flags.BoolVar(quiet, "quiet", false, "do not print results, only set the exit status")
+	return func(repo *Repository, args []string) {
+		var entries []refEntry
+		if *verify {
+			if len(args) == 0 {
+				log.Fatal("fatal: --verify requires a reference")
+			}
+			var invalid string
+			entries, invalid = repo.verifyRefs(args, options)
+			if invalid != "" {
+				if *quiet {
+					os.Exit(1)
+				}
+				log.Fatalf("fatal: '%s' - not a valid ref", invalid)
+			}
+		} else {
+			entries = repo.showRefs(args, options)
+		}
+		if *quiet {
+			// nothing to print, only the exit status below
+		} else if jsonOutput {
+			printJSON(refEntriesJSON(entries))
+		} else {
+			printRefEntries(entries, options)
+		}
+		if len(entries) == 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+func setupSparseCheckout(flags *flag.FlagSet) commandRunner {
+	// cone mode is the only one, --cone is taken for compatibility
+	flags.Bool("cone", true, "init: select directories rather than patterns")
+	return func(repo *Repository, args []string) {
+		if len(args) == 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		subcommand, args := args[0], args[1:]
+		switch subcommand {
+		case "init":
+			repo.initSparseCheckout()
+		case "set", "add":
+			repo.setSparseCheckout(repo.pathspecsFromPrefix(args), subcommand == "add")
+		case "list":
+			repo.listSparseCheckout(os.Stdout)
+		default:
+			flags.Usage()
+			os.Exit(129)
+		}
+	}
+}
+
+func setupStash(flags *flag.FlagSet) commandRunner {
+	var options stashOptions
+	keepIndex := flags.Bool("k", false, "push: keep the staged changes in the index and the worktree")
+	flags.BoolVar(keepIndex, "keep-index", false, "push: keep the staged changes in the index and the worktree")
+	noKeepIndex := flags.Bool("no-keep-index", false, "push: take the index back to HEAD too, also with -p")
+	flags.BoolVar(&options.includeUntracked, "u", false, "push: stash untracked files too and remove them; show: show them")
+	flags.BoolVar(&options.includeUntracked, "include-untracked", false, "push: stash untracked files too and remove them; show: show them")
+	flags.BoolVar(&options.patch, "p", false, "push: pick the hunks to stash interactively, implies -k; show: show the changes as a patch")
+	flags.BoolVar(&options.patch, "patch", false, "push: pick the hunks to stash interactively, implies -k; show: show the changes as a patch")
+	flags.BoolVar(&options.quiet, "q", false, "suppress feedback messages")
+	flags.BoolVar(&options.quiet, "quiet", false, "suppress feedback messages")
+	flags.StringVar(&options.message, "m", "", "push: describe the stash with `message`")
+	flags.StringVar(&options.message, "message", "", "push: describe the stash with `message`")
+	restoreIndex := flags.Bool("index", false, "apply, pop: restore the staged changes to the index too")
+	return func(repo *Repository, args []string) {
+		subcommand := "push"
+		if len(args) > 0 {
+			subcommand, args = args[0], args[1:]
+		}
+		switch subcommand {
+		case "push":
+			if len(args) > 0 {
+				log.Fatal("fatal: stashing paths is not supported")
+			}
+			if options.patch && options.includeUntracked {
+				fmt.Fprintln(os.Stderr, "Can't use --patch and --include-untracked or --all at the same time")
+				os.Exit(1)
+			}
+			options.keepIndex = *keepIndex || options.patch && !*noKeepIndex
+			repo.stashPush(options)
+		case "list":
+			repo.stashList()
+		case "show":
+			repo.stashShow(repo.findStash(args), options.patch, options.includeUntracked)
+		case "apply":
+			if !repo.stashApply(repo.findStash(args), *restoreIndex, options.quiet) {
+				os.Exit(1)
+			}
+		case "pop":
+			stash := repo.findStash(args)
+			if !repo.stashApply(stash, *restoreIndex, options.quiet) {
+				fmt.Fprintln(os.Stderr, "The stash entry is kept in case you need it again.")
+				os.Exit(1)
+			}
+			repo.stashDrop(stash, options.quiet)
+		case "drop":
+			repo.stashDrop(repo.findStash(args), options.quiet)
+		case "clear":
+			repo.stashClear()
+		default:
+			log.Fatalf("fatal: subcommand wasn't specified; 'push' can't be assumed due to unexpected token '%s'", subcommand)
+		}
+	}
+}
+
+func setupStatus(flags *flag.FlagSet) commandRunner {
+	jobs := flags.Int("jobs", 0, "number of parallel workers (default core.threads, 0 for one per CPU)")
+	short := flags.Bool("s", false, "show the status in short format")
+	flags.BoolVar(short, "short", false, "show the status in short format")
+	porcelain := flags.Bool("porcelain", false, "show the status in a stable, script-friendly format")
+	nulTerminated := flags.Bool("z", false, "terminate entries with NUL and do not quote paths, implies --porcelain")
+	return func(repo *Repository, args []string) {
+		status := repo.computeStatus(repo.jobCount(*jobs))
+		status.limitTo(repo.parsePathspecs(args))
+		if jsonOutput {
+			printJSON(newJSONStatus(status))
+		} else if *short || *porcelain || *nulTerminated {
+			repo.printShortStatus(status, pathPrinter{*nulTerminated})
+		} else {
+			repo.printStatus(os.Stdout, status, repo.useColor("status"))
+		}
+	}
+}
+
+func setupSubtree(flags *flag.FlagSet) commandRunner {
+	prefix := flags.String("P", "", "the `prefix` of the subtree, its directory")
+	flags.StringVar(prefix, "prefix", "", "the `prefix` of the subtree, its directory")
+	message := flags.String("m", "", "add, merge, pull, split --rejoin: use the `message` for the merge commit")
+	flags.StringVar(message, "message", "", "add, merge, pull, split --rejoin: use the `message` for the merge commit")
+	branch := flags.String("b", "", "split: create or move forward the `branch` to the split history")
+	flags.StringVar(branch, "branch", "", "split: create or move forward the `branch` to the split history")
+	rejoin := flags.Bool("rejoin", false, "split: merge the split history back in, for later splits to go on from")
+	quiet := flags.Bool("q", false, "suppress feedback messages")
+	flags.BoolVar(quiet, "quiet", false, "suppress feedback messages")
+	return func(repo *Repository, args []string) {
+		if len(args) == 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		subcommand, args := args[0], args[1:]
+		dir := subtreeDirectory(*prefix)
+		// the commit to add or merge, fetched first for <repository> <ref>
+		fetched := func() string {
+			switch len(args) {
+			case 1:
+				return repo.peelToCommit(repo.resolveRevision(args[0]))
+			case 2:
+				if subcommand == "add" {
+					fmt.Println("git fetch " + quoteCommandLine(args))
+				}
+				return repo.fetch(args[0], "refs/heads/"+strings.TrimPrefix(args[1], "refs/heads/"), true, *quiet)
+			}
+			flags.Usage()
+			os.Exit(129)
+			return ""
+		}
+		switch subcommand {
+		case "add":
+			repo.subtreeAdd(dir, fetched(), *message, false)
+		case "merge", "pull":
+			if subcommand == "pull" && len(args) != 2 {
+				flags.Usage()
+				os.Exit(129)
+			}
+			if !repo.subtreeMerge(dir, fetched(), *message, *quiet) {
+				os.Exit(1)
+			}
+		case "split":
+			if len(args) > 1 {
+				flags.Usage()
+				os.Exit(129)
+			}
+			rev := "HEAD"
+			if len(args) == 1 {
+				rev = args[0]
+			}
+			latestNew, latestOld := repo.subtreeSplit(dir, repo.peelToCommit(repo.resolveRevision(rev)))
+			if latestNew == "" {
+				log.Fatal("fatal: no new revisions were found")
+			}
+			if *rejoin {
+				rejoinMessage := *message
+				if rejoinMessage == "" {
+					rejoinMessage = fmt.Sprintf("Split '%s/' into commit '%s'", dir, latestNew)
+				}
+				rejoinMessage = subtreeMessage(rejoinMessage, dir, latestOld, latestNew)
+				if len(repo.subtreeSplits(dir, repo.resolveRevision("HEAD"))) == 0 {
+					repo.subtreeAdd(dir, latestNew, rejoinMessage, true)
+				} else if !repo.subtreeMerge(dir, latestNew, rejoinMessage, true) {
+					os.Exit(1)
+				}
+			}
+			if *branch != "" {
+				repo.subtreeSplitBranch(*branch, latestNew)
+			}
+			fmt.Println(latestNew)
+		default:
+			flags.Usage()
+			os.Exit(129)
+		}
+	}
+}
+
+func setupSymbolicRef(flags *flag.FlagSet) commandRunner {
+	quiet := flags.Bool("q", false, "do not complain about refs that are not symbolic")
+	short := flags.Bool("short", false, "shorten the printed ref name")
+	remove := flags.Bool("d", false, "delete the symbolic ref")
+	return func(repo *Repository, args []string) {
+		switch {
+		case *remove && len(args) == 1:
+			if _, ok := repo.readSymbolicRef(args[0]); !ok {
+				if *quiet {
+					os.Exit(1)
+				}
+				log.Fatalf("fatal: Cannot delete %s, not a symbolic ref", args[0])
+			}
+			if args[0] == "HEAD" {
+				log.Fatal("fatal: deleting 'HEAD' is not allowed")
+			}
+			repo.deleteRef(args[0])
+		case len(args) == 1:
+			target, ok := repo.readSymbolicRef(args[0])
+			if !ok {
+				if *quiet {
+					os.Exit(1)
+				}
+				log.Fatalf("fatal: ref %s is not a symbolic ref", args[0])
+			}
+			// print the end of the chain, like git does
+			for depth := 0; depth < 5; depth++ {
+				next, ok := repo.readSymbolicRef(target)
+				if !ok {
+					break
+				}
+				target = next
+			}
+			if *short {
+				target = shortRefName(target)
+			}
+			fmt.Println(target)
+		case len(args) == 2:
+			if args[0] == "HEAD" && !strings.HasPrefix(args[1], "refs/") {
+				log.Fatalf("fatal: Refusing to point HEAD outside of refs/")
+			}
+			repo.updateSymbolicRef(args[0], args[1])
+		default:
+			flags.Usage()
+			os.Exit(129)
+		}
+	}
+}
+
+func setupTag(flags *flag.FlagSet) commandRunner {
+	list := flags.Bool("l", false, "list tag names matching the patterns")
+	flags.BoolVar(list, "list", false, "list tag names matching the patterns")
+	contains, noContains, merged, noMerged := refFilterFlags(flags, "tags")
+	return func(repo *Repository, args []string) {
+		filtered := len(contains.values)+len(noContains.values)+len(merged.values)+len(noMerged.values) > 0
+		if len(args) > 0 && !*list && !filtered {
+			// only listing is supported, which patterns need -l for
+			flags.Usage()
+			os.Exit(129)
+		}
+		filter := repo.newRefFilter(contains.values, noContains.values, merged.values, noMerged.values)
+		repo.listTags(os.Stdout, args, filter)
+	}
+}
+
+func setupUnpackObjects(flags *flag.FlagSet) commandRunner {
+	dryRun := flags.Bool("n", false, "check the pack without writing any objects")
+	quiet := flags.Bool("q", false, "do not report progress")
+	return func(repo *Repository, args []string) {
+		if len(args) != 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		progress := newProgress(*quiet)
+		repo.unpackStream(parsePackStream(data, noProgress{}), *dryRun, progress)
+	}
+}
+
+func setupVar(flags *flag.FlagSet) commandRunner {
+	list := flags.Bool("l", false, "list the config variables and all logical variables")
+	return func(repo *Repository, args []string) {
+		if *list && len(args) == 0 {
+			repo.listVariables(os.Stdout)
+			return
+		}
+		if *list || len(args) != 1 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		value, ok := repo.logicalVariable(args[0])
+		if !ok {
+			flags.Usage()
+			os.Exit(129)
+		}
+		fmt.Println(value)
+	}
+}
+
+func setupVerifyPack(flags *flag.FlagSet) commandRunner {
+	verbose := flags.Bool("v", false, "list the objects in the pack")
+	flags.BoolVar(verbose, "verbose", false, "list the objects in the pack")
+	statOnly := flags.Bool("s", false, "only show the delta chain histogram")
+	flags.BoolVar(statOnly, "stat-only", false, "only show the delta chain histogram")
+	return func(repo *Repository, packs []string) {
+		if len(packs) == 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		failed := false
+		for _, pack := range packs {
+			if !repo.verifyPack(pack, *verbose, *statOnly) {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	}
+}
+
+func setupUpdateIndex(flags *flag.FlagSet) commandRunner {
+	var options updateIndexOptions
+	flags.BoolVar(&options.add, "add", false, "add paths that are not in the index yet")
+	flags.BoolVar(&options.remove, "remove", false, "remove the entries of paths missing from the worktree")
+	flags.BoolVar(&options.forceRemove, "force-remove", false, "remove the entries of paths even if they are in the worktree")
+	flags.Func("chmod", "set (+x) or clear (-x) the executable bit of the paths' entries", func(value string) error {
+		if value != "+x" && value != "-x" {
+			return fmt.Errorf("option 'chmod' expects \"+x\" or \"-x\"")
+		}
+		options.chmod = value[0]
+		return nil
+	})
+	flags.Func("cacheinfo", "stage the object with the mode at the path, given as `<mode>,<object>,<path>`", func(value string) error {
+		info, ok := parseIndexCacheInfo(value)
+		if !ok {
+			return fmt.Errorf("option 'cacheinfo' expects <mode>,<sha1>,<path>")
+		}
+		options.cacheInfo = append(options.cacheInfo, info)
+		return nil
+	})
+	markFlag := func(name string, bit *byte, usage string) {
+		flags.BoolFunc(name, "set the "+usage, func(string) error {
+			*bit = '+'
+			return nil
+		})
+		flags.BoolFunc("no-"+name, "clear the "+usage, func(string) error {
+			*bit = '-'
+			return nil
+		})
+	}
+	markFlag("assume-unchanged", &options.assumeUnchanged, "bit taking the paths' entries to match their worktree files")
+	markFlag("skip-worktree", &options.skipWorktree, "bit leaving the worktree files of the paths' entries alone")
+	flags.BoolVar(&options.refresh, "refresh", false, "take in the stat data of unchanged files and list the entries that need an update")
+	flags.BoolVar(&options.quiet, "q", false, "do not list the entries --refresh finds needing an update")
+	return func(repo *Repository, paths []string) {
+		if status := repo.updateIndex(os.Stdout, repo.pathspecsFromPrefix(paths), options); status != 0 {
+			os.Exit(status)
+		}
+	}
+}
+
+func setupWorktree(flags *flag.FlagSet) commandRunner {
+	var options worktreePruneOptions
+	flags.BoolVar(&options.dryRun, "n", false, "prune: do not remove anything, only report what would be removed")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "prune: do not remove anything, only report what would be removed")
+	flags.BoolVar(&options.verbose, "v", false, "prune: report all removals")
+	flags.BoolVar(&options.verbose, "verbose", false, "prune: report all removals")
+	flags.BoolVar(&options.removeLocks, "f", false, "prune: also remove lock files over an hour old, which a running command may still hold")
+	flags.BoolVar(&options.removeLocks, "force", false, "prune: also remove lock files over an hour old, which a running command may still hold")
+	expire := flags.String("expire", "", "prune: only prune missing worktrees whose administrative files are older than `time`")
+	return func(repo *Repository, args []string) {
+		if len(args) != 1 || args[0] != "prune" {
+			flags.Usage()
+			os.Exit(129)
+		}
+		options.expire = repo.expiryOption(*expire, "", "now", time.Now())
+		repo.pruneWorktrees(options)
+	}
+}
+
+func setupWriteTree(flags *flag.FlagSet) commandRunner {
+	return func(repo *Repository, args []string) {
+		if len(args) != 0 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		index := repo.lockIndex()
+		fmt.Println(repo.writeTree(index))
+		repo.writeIndex(index)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serializeCommit builds the content of a commit object
+func serializeCommit(commit commitObject) []byte {
+	var content strings.Builder
+	writeHeader := func(key string, value string) {
+		content.WriteString(key + " " + strings.ReplaceAll(value, "\n", "\n ") + "\n")
+	}
+	writeHeader("tree", commit.tree)
+	for _, parent := range commit.parents {
+		writeHeader("parent", parent)
+	}
+	writeHeader("author", commit.author.String())
+	writeHeader("committer", commit.committer.String())
+	for _, header := range commit.extraHeaders {
+		writeHeader(header.key, header.value)
+	}
+	if commit.gpgSignature != "" {
+		writeHeader("gpgsig", commit.gpgSignature)
+	}
+	content.WriteString("\n" + commit.commitMessage)
+	return []byte(content.String())
+}
+
+// createCommit writes a commit of tree on top of parents, authored and
+// committed by the current identity
+func (repo *Repository) createCommit(tree string, parents []string, message string) string {
+	return repo.createCommitAs(repo.currentIdentity("AUTHOR"), tree, parents, message)
+}
+
+// createCommitAs is createCommit keeping the given author, e.g. the sender
+// of a patch
+func (repo *Repository) createCommitAs(author identity, tree string, parents []string, message string) string {
+	commit := commitObject{
+		tree:          tree,
+		parents:       parents,
+		author:        author,
+		committer:     repo.currentIdentity("COMMITTER"),
+		commitMessage: message,
+	}
+	return repo.writeObject("commit", serializeCommit(commit))
+}
+
+// updateHead moves the branch HEAD points at to hash, or HEAD itself when
+// it is detached, with message in the reflogs of both
+func (repo *Repository) updateHead(hash string, message string) {
+	if branch, ok := repo.headBranch(); ok {
+		old, ok := repo.resolveRef("HEAD")
+		if !ok {
+			old = nullHash
+		}
+		repo.updateRefLogged("refs/heads/"+branch, hash, message)
+		repo.logRefUpdate("HEAD", old, hash, message)
+		return
+	}
+	repo.updateRefLogged("HEAD", hash, message)
+}
+
+// splitCommitMessage returns the subject, the first paragraph joined into
+// one line, and the body after it without surrounding blank lines
+func splitCommitMessage(message string) (string, string) {
+	message = strings.TrimLeft(message, "\n")
+	paragraph, body, _ := strings.Cut(message, "\n\n")
+	lines := strings.Split(strings.TrimRight(paragraph, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, " "), strings.Trim(body, "\n")
+}
+
+type commitOptions struct {
+	messages          []string // -m values, one paragraph each
+	messageFile       string
+	edit              bool
+	allowEmpty        bool
+	allowEmptyMessage bool
+	quiet             bool
+	signoff           bool   // add a Signed-off-by trailer with the committer identity
+	author            string // "Name <e-mail>" or a pattern matching an existing author
+	date              string // the author date
+}
+
+const commitEditHelp = `Please enter the commit message for your changes. Lines starting
+with '#' will be ignored, and an empty message aborts the commit.
+`
+
+// commentLines prefixes every line of text with "# ", or with a bare "#"
+// when the line is empty or starts with a tab
+func commentLines(text string) string {
+	var commented strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		switch {
+		case line == "":
+			commented.WriteString("#\n")
+		case strings.HasPrefix(line, "\t"):
+			commented.WriteString("#" + line + "\n")
+		default:
+			commented.WriteString("# " + line + "\n")
+		}
+	}
+	return commented.String()
+}
+
+// stripCommentLines drops the lines starting with "#"
+func stripCommentLines(message string) string {
+	kept := make([]string, 0)
+	for _, line := range strings.SplitAfter(message, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "")
+}
+
+// commitTemplate reads the file commit.template names, "~/" meaning the
+// home directory
+func (repo *Repository) commitTemplate() (string, bool) {
+	path, ok := repo.config.get("commit.template")
+	if !ok || path == "" {
+		return "", false
+	}
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("fatal: could not read '%s': %s", path, err)
+	}
+	return string(content), true
+}
+
+// editCommitMessage has the user write the message in COMMIT_EDITMSG,
+// which starts out with initial and the status of the commit as comments
+func (repo *Repository) editCommitMessage(initial string) string {
+	var status bytes.Buffer
+	repo.printStatus(&status, repo.computeStatus(repo.jobCount(0)), false)
+	var content strings.Builder
+	content.WriteString(initial)
+	if initial != "" && !strings.HasSuffix(initial, "\n") {
+		content.WriteString("\n")
+	}
+	content.WriteString("\n" + commentLines(commitEditHelp+"\n"+status.String()))
+
+	path := filepath.Join(repo.gitDir, "COMMIT_EDITMSG")
+	if err := os.WriteFile(path, []byte(content.String()), 0666); err != nil {
+		log.Fatalf("fatal: could not write commit template: %s", err)
+	}
+	if err := repo.launchEditor(path); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s.\n", err)
+		log.Fatal("Please supply the message using either -m or -F option.")
+	}
+	edited, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("fatal: could not read '%s': %s", path, err)
+	}
+	return string(edited)
+}
+
+// commitIndex records the index as a new commit on top of HEAD
+func (repo *Repository) commitIndex(options commitOptions) {
+	repo.requireResolved(repo.readIndex(), "Committing")
+	index := repo.lockIndex()
+	head, hasHead := repo.resolveRef("HEAD")
+	tree := repo.writeTree(index)
+	var parents []string
+	if hasHead {
+		parents = []string{head}
+	}
+	// a merge stopped before committing is concluded by this commit
+	mergeHeads := repo.readMergeHeads()
+	parents = append(parents, mergeHeads...)
+	isEmpty := true
+	for _, entry := range index.entries {
+		isEmpty = isEmpty && entry.intentToAdd()
+	}
+	if hasHead {
+		isEmpty = repo.readCommitObject(head).tree == tree
+	}
+	if isEmpty && !options.allowEmpty && len(mergeHeads) == 0 {
+		repo.releaseIndex(index)
+		repo.printStatus(os.Stdout, repo.computeStatus(repo.jobCount(0)), repo.useColor("status"))
+		os.Exit(1)
+	}
+
+	message := ""
+	for _, paragraph := range options.messages {
+		if message != "" {
+			message += "\n"
+		}
+		message += strings.TrimSuffix(paragraph, "\n") + "\n"
+	}
+	if options.messageFile != "" {
+		var content []byte
+		var err error
+		if options.messageFile == "-" {
+			content, err = io.ReadAll(os.Stdin)
+		} else {
+			content, err = os.ReadFile(options.messageFile)
+		}
+		if err != nil {
+			log.Fatalf("fatal: could not read log file '%s': %s", options.messageFile, err)
+		}
+		message = string(content)
+	}
+	if len(options.messages) == 0 && options.messageFile == "" {
+		template, hasTemplate := repo.commitTemplate()
+		if pending, merging := repo.pendingMergeMessage(); merging {
+			// the message a merge or squash prepared need not be edited
+			template, hasTemplate = pending, false
+		}
+		if options.signoff {
+			template = repo.appendSignoff(template)
+		}
+		message = cleanupMessage(stripCommentLines(repo.editCommitMessage(template)))
+		if hasTemplate && message != "" && message == cleanupMessage(stripCommentLines(template)) {
+			log.Fatal("Aborting commit; you did not edit the message.")
+		}
+	} else if options.edit {
+		if options.signoff {
+			message = repo.appendSignoff(message)
+		}
+		message = cleanupMessage(stripCommentLines(repo.editCommitMessage(message)))
+	} else {
+		message = cleanupMessage(message)
+		if options.signoff {
+			message = repo.appendSignoff(message)
+		}
+	}
+	if message == "" && !options.allowEmptyMessage {
+		log.Fatal("Aborting commit due to empty commit message.")
+	}
+
+	author := repo.currentIdentity("AUTHOR")
+	if options.author != "" {
+		author = repo.findAuthor(options.author)
+	}
+	if options.date != "" {
+		var ok bool
+		if author.when, ok = parseDate(options.date, time.Now()); !ok {
+			log.Fatalf("fatal: invalid date format: %s", options.date)
+		}
+	}
+	hash := repo.createCommitAs(author, tree, parents, message)
+	action := "commit"
+	switch {
+	case !hasHead:
+		action = "commit (initial)"
+	case len(mergeHeads) > 0:
+		action = "commit (merge)"
+	}
+	subject, _ := splitCommitMessage(message)
+	repo.updateHead(hash, action+": "+subject)
+	repo.writeIndex(index)
+	// the conflicts this commit resolved are remembered for the next time
+	repo.rerere()
+	repo.removeMergeState()
+	if !options.quiet {
+		repo.printCommitSummary(hash)
+	}
+}
+
+// printCommitSummary prints the "[main 1a2b3c4] subject" line and the
+// diffstat summary commit shows after committing
+func (repo *Repository) printCommitSummary(hash string) {
+	commit := repo.readCommitObject(hash)
+	where := "detached HEAD"
+	if branch, ok := repo.headBranch(); ok {
+		where = branch
+	}
+	parentTree := ""
+	if len(commit.parents) == 0 {
+		where += " (root-commit)"
+	} else {
+		parentTree = repo.readCommitObject(commit.parents[0]).tree
+	}
+	subject, _ := splitCommitMessage(commit.commitMessage)
+	fmt.Printf("[%s %s] %s\n", where, abbreviateHash(hash), subject)
+	author, committer := commit.author, commit.committer
+	if author.nameAndEmail() != committer.nameAndEmail() {
+		fmt.Printf(" Author: %s\n", author.nameAndEmail())
+	}
+	if !author.when.Equal(committer.when) {
+		fmt.Printf(" Date: %s\n", formatDate(author.when, "default", time.Now()))
+	}
+
+	changes := repo.diffTrees(parentTree, commit.tree)
+	insertions, deletions := 0, 0
+	for _, change := range changes {
+		stat := repo.diffStat(change)
+		insertions += stat.added
+		deletions += stat.deleted
+	}
+	if len(changes) > 0 {
+		fmt.Println(diffStatSummary(len(changes), insertions, deletions))
+	}
+	writeDiffSummary(os.Stdout, changes)
+}
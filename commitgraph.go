@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// commit-graph chunk ids
+const (
+	commitGraphFanout     = 0x4f494446 // "OIDF"
+	commitGraphLookup     = 0x4f49444c // "OIDL"
+	commitGraphData       = 0x43444154 // "CDAT"
+	commitGraphExtraEdges = 0x45444745 // "EDGE"
+	// generation data: corrected commit dates as offsets from the commit
+	// dates, the larger ones in the overflow chunk
+	commitGraphGenerationData     = 0x47444132 // "GDA2"
+	commitGraphGenerationOverflow = 0x47444f32 // "GDO2"
+	// changed-path Bloom filters: where the filter of each commit ends,
+	// and the settings followed by the filters
+	commitGraphBloomIndexes = 0x42494458 // "BIDX"
+	commitGraphBloomData    = 0x42444154 // "BDAT"
+)
+
+const (
+	commitGraphNoParent    = 0x70000000
+	commitGraphOctopusEdge = 0x80000000
+	// marks a generation offset that is an index into the overflow chunk
+	commitGraphOffsetOverflow = 0x80000000
+)
+
+// generationInfinity is the generation of commits the commit-graph does not
+// have; as the graph has all ancestors of its commits, none of them can
+// reach such a commit
+const generationInfinity = math.MaxUint64
+
+func (repo *Repository) commitGraphPath() string {
+	return filepath.Join(repo.gitDir, "objects", "info", "commit-graph")
+}
+
+// readCommitGraphChunks reads the commit-graph file into its chunks by
+// id, nil when there is none or it cannot be read
+func (repo *Repository) readCommitGraphChunks() map[uint32][]byte {
+	content, err := os.ReadFile(repo.commitGraphPath())
+	if err != nil || len(content) < 8 || !bytes.HasPrefix(content, []byte("CGPH")) {
+		return nil
+	}
+	chunks := make(map[uint32][]byte)
+	chunkCount := int(content[6])
+	for i := 0; i < chunkCount; i++ {
+		entry := 8 + i*12
+		if entry+24 > len(content) {
+			return nil
+		}
+		start := binary.BigEndian.Uint64(content[entry+4:])
+		end := binary.BigEndian.Uint64(content[entry+16:])
+		if start > end || end > uint64(len(content)) {
+			return nil
+		}
+		chunks[binary.BigEndian.Uint32(content[entry:])] = content[start:end]
+	}
+	return chunks
+}
+
+// commitGraphCommits returns the commits listed in the existing
+// commit-graph file, nil when there is none or it cannot be read
+func (repo *Repository) commitGraphCommits() map[string]bool {
+	lookup, ok := repo.readCommitGraphChunks()[commitGraphLookup]
+	if !ok {
+		return nil
+	}
+	commits := make(map[string]bool)
+	for position := 0; position+ObjectShaLength <= len(lookup); position += ObjectShaLength {
+		commits[hex.EncodeToString(lookup[position:position+ObjectShaLength])] = true
+	}
+	return commits
+}
+
+// commitGraph has the generation numbers of the commits of the
+// commit-graph file: corrected commit dates when it has generation data,
+// topological levels otherwise. Either way a commit's generation is above
+// those of its parents. With changed paths it also has the Bloom filters
+// of the commits, unless commitGraph.readChangedPaths is false.
+type commitGraph struct {
+	generations    map[string]uint64
+	filters        map[string]bloomFilter
+	bloomVersion   int // 0 without filters
+	bloomHashCount int
+}
+
+// loadCommitGraph reads the commit-graph file on first use; without one
+// every commit has generationInfinity
+func (repo *Repository) loadCommitGraph() *commitGraph {
+	repo.commitGraphOnce.Do(func() {
+		graph := &commitGraph{generations: make(map[string]uint64)}
+		repo.commitGraph = graph
+		chunks := repo.readCommitGraphChunks()
+		lookup, data := chunks[commitGraphLookup], chunks[commitGraphData]
+		count := len(lookup) / ObjectShaLength
+		if chunks == nil || len(data) < count*(ObjectShaLength+16) {
+			return
+		}
+		if repo.config.getBool("commitGraph.readChangedPaths", true) {
+			graph.filters, graph.bloomVersion, graph.bloomHashCount = readBloomChunks(lookup, chunks[commitGraphBloomIndexes], chunks[commitGraphBloomData])
+		}
+		generationData, corrected := chunks[commitGraphGenerationData]
+		overflow := chunks[commitGraphGenerationOverflow]
+		if corrected && len(generationData) < count*4 || repo.config.getInt("commitGraph.generationVersion", 2) < 2 {
+			corrected = false
+		}
+		for i := 0; i < count; i++ {
+			hash := hex.EncodeToString(lookup[i*ObjectShaLength : (i+1)*ObjectShaLength])
+			entry := data[i*(ObjectShaLength+16)+ObjectShaLength+8:]
+			levelAndTime := binary.BigEndian.Uint32(entry)
+			commitTime := uint64(levelAndTime&3)<<32 | uint64(binary.BigEndian.Uint32(entry[4:]))
+			if !corrected {
+				graph.generations[hash] = uint64(levelAndTime >> 2)
+				continue
+			}
+			offset := uint64(binary.BigEndian.Uint32(generationData[i*4:]))
+			if offset&commitGraphOffsetOverflow != 0 {
+				index := int(offset &^ commitGraphOffsetOverflow)
+				if (index+1)*8 > len(overflow) {
+					// a damaged file is as good as none
+					*graph = commitGraph{generations: make(map[string]uint64)}
+					return
+				}
+				offset = binary.BigEndian.Uint64(overflow[index*8:])
+			}
+			graph.generations[hash] = commitTime + offset
+		}
+	})
+	return repo.commitGraph
+}
+
+// generation returns the generation of a commit, generationInfinity for
+// commits the commit-graph does not have
+func (repo *Repository) generation(hash string) uint64 {
+	if generation, ok := repo.loadCommitGraph().generations[hash]; ok {
+		return generation
+	}
+	return generationInfinity
+}
+
+// isAncestor reports whether ancestor is reachable from descendant. The
+// walk leaves out commits of lower generation than ancestor, which cannot
+// reach it, so with a commit-graph it stays close to the two commits.
+func (repo *Repository) isAncestor(ancestor string, descendant string) bool {
+	minimum := repo.generation(ancestor)
+	seen := make(map[string]bool)
+	pending := []string{descendant}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if hash == ancestor {
+			return true
+		}
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		if minimum != generationInfinity && repo.generation(hash) < minimum {
+			continue
+		}
+		pending = append(pending, repo.readCommitObject(hash).parents...)
+	}
+	return false
+}
+
+// writeCommitGraph writes objects/info/commit-graph for the given commits
+// and all their ancestors, with topological levels as generation numbers
+// and, unless commitGraph.generationVersion is 1, corrected commit dates
+// as generation data. With changedPaths it has the changed-path Bloom
+// filters of the commits, those of the existing file kept when they are
+// of the version written.
+func (repo *Repository) writeCommitGraph(heads []string, changedPaths bool) int {
+	// format:
+	// "CGPH" <version 1> <hash version 1> <chunk count> <base graph count 0>
+	// <chunk table: (4-byte id, 8-byte offset)... terminated by id 0>
+	// OIDF <256 x 4-byte fan-out>
+	// OIDL <N x sorted commit ids>
+	// CDAT <N x (tree id, 4-byte parent 1, 4-byte parent 2, 8-byte generation and commit time)>
+	// GDA2 <N x 4-byte corrected commit date offsets, with the top bit an index into GDO2>
+	// GDO2 <8-byte offsets too large for GDA2> (only when there are any)
+	// EDGE <4-byte positions of the third and later parents> (octopus merges only)
+	// BIDX <N x 4-byte end offsets of the filters in BDAT> (with changed paths only)
+	// BDAT <4-byte version, hash count and bits per entry> <filters> (with changed paths only)
+	// <sha1 checksum>
+	commits := make(map[string]commitObject)
+	pending := append([]string{}, heads...)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := commits[hash]; ok {
+			continue
+		}
+		commit := repo.readCommitObject(hash)
+		commits[hash] = commit
+		pending = append(pending, commit.parents...)
+	}
+	hashes := make([]string, 0, len(commits))
+	for hash := range commits {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	positions := make(map[string]uint32, len(hashes))
+	for i, hash := range hashes {
+		positions[hash] = uint32(i)
+	}
+
+	levels := make(map[string]uint32, len(hashes))
+	var level func(hash string) uint32
+	level = func(hash string) uint32 {
+		if value, ok := levels[hash]; ok {
+			return value
+		}
+		value := uint32(1)
+		for _, parent := range commits[hash].parents {
+			if parentLevel := level(parent) + 1; parentLevel > value {
+				value = parentLevel
+			}
+		}
+		levels[hash] = value
+		return value
+	}
+
+	// the corrected commit date of a commit is its commit date, or one more
+	// than the latest corrected date of its parents when that is later
+	correctedDates := make(map[string]uint64, len(hashes))
+	var correctedDate func(hash string) uint64
+	correctedDate = func(hash string) uint64 {
+		if value, ok := correctedDates[hash]; ok {
+			return value
+		}
+		value := uint64(commits[hash].committer.when.Unix())
+		for _, parent := range commits[hash].parents {
+			if parentDate := correctedDate(parent) + 1; parentDate > value {
+				value = parentDate
+			}
+		}
+		correctedDates[hash] = value
+		return value
+	}
+
+	var fanout, lookup, data, generationData, generationOverflow, edges bytes.Buffer
+	var counts [256]uint32
+	for _, hash := range hashes {
+		raw, _ := hex.DecodeString(hash)
+		counts[raw[0]]++
+		lookup.Write(raw)
+	}
+	total := uint32(0)
+	for _, count := range counts {
+		total += count
+		binary.Write(&fanout, binary.BigEndian, total)
+	}
+	for _, hash := range hashes {
+		commit := commits[hash]
+		tree, _ := hex.DecodeString(commit.tree)
+		data.Write(tree)
+		parentPositions := [2]uint32{commitGraphNoParent, commitGraphNoParent}
+		for i, parent := range commit.parents {
+			if i < 2 {
+				parentPositions[i] = positions[parent]
+			}
+		}
+		if len(commit.parents) > 2 {
+			parentPositions[1] = commitGraphOctopusEdge | uint32(edges.Len()/4)
+			for i, parent := range commit.parents[1:] {
+				position := positions[parent]
+				if i == len(commit.parents)-2 {
+					position |= commitGraphOctopusEdge
+				}
+				binary.Write(&edges, binary.BigEndian, position)
+			}
+		}
+		binary.Write(&data, binary.BigEndian, parentPositions)
+		commitTime := uint64(commit.committer.when.Unix())
+		binary.Write(&data, binary.BigEndian, level(hash)<<2|uint32(commitTime>>32)&3)
+		binary.Write(&data, binary.BigEndian, uint32(commitTime))
+		offset := correctedDate(hash) - commitTime
+		if offset >= commitGraphOffsetOverflow {
+			binary.Write(&generationData, binary.BigEndian, uint32(commitGraphOffsetOverflow|generationOverflow.Len()/8))
+			binary.Write(&generationOverflow, binary.BigEndian, offset)
+		} else {
+			binary.Write(&generationData, binary.BigEndian, uint32(offset))
+		}
+	}
+
+	type chunk struct {
+		id      uint32
+		content []byte
+	}
+	chunks := []chunk{{commitGraphFanout, fanout.Bytes()}, {commitGraphLookup, lookup.Bytes()}, {commitGraphData, data.Bytes()}}
+	if repo.config.getInt("commitGraph.generationVersion", 2) >= 2 {
+		chunks = append(chunks, chunk{commitGraphGenerationData, generationData.Bytes()})
+		if generationOverflow.Len() > 0 {
+			chunks = append(chunks, chunk{commitGraphGenerationOverflow, generationOverflow.Bytes()})
+		}
+	}
+	if edges.Len() > 0 {
+		chunks = append(chunks, chunk{commitGraphExtraEdges, edges.Bytes()})
+	}
+	if changedPaths {
+		indexes, filters := repo.writeBloomChunks(hashes, commits)
+		chunks = append(chunks, chunk{commitGraphBloomIndexes, indexes}, chunk{commitGraphBloomData, filters})
+	}
+	var graph bytes.Buffer
+	graph.WriteString("CGPH")
+	graph.Write([]byte{1, 1, byte(len(chunks)), 0})
+	offset := uint64(8 + (len(chunks)+1)*12)
+	for _, chunk := range chunks {
+		binary.Write(&graph, binary.BigEndian, chunk.id)
+		binary.Write(&graph, binary.BigEndian, offset)
+		offset += uint64(len(chunk.content))
+	}
+	binary.Write(&graph, binary.BigEndian, uint32(0))
+	binary.Write(&graph, binary.BigEndian, offset)
+	for _, chunk := range chunks {
+		graph.Write(chunk.content)
+	}
+	checksum := sha1.Sum(graph.Bytes())
+	graph.Write(checksum[:])
+
+	path := repo.commitGraphPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		log.Fatal(err)
+	}
+	writeFileAtomically(path, graph.Bytes())
+	return len(hashes)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const bashCompletionScript = `# bash completion for %[1]s
+_%[2]s() {
+	local IFS=$'\n'
+	COMPREPLY=($(%[1]s __complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _%[2]s %[1]s
+`
+
+const zshCompletionScript = `#compdef %[1]s
+_%[2]s() {
+	local -a candidates
+	candidates=(${(f)"$(%[1]s __complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+	if (( ${#candidates} )); then
+		compadd -a candidates
+	else
+		_files
+	fi
+}
+compdef _%[2]s %[1]s
+`
+
+const fishCompletionScript = `# fish completion for %[1]s
+function __%[2]s_complete
+	set -l words (commandline -opc)
+	set -e words[1]
+	%[1]s __complete -- $words (commandline -ct) 2>/dev/null
+end
+complete -c %[1]s -a '(__%[2]s_complete)'
+`
+
+func setupCompletion(flags *flag.FlagSet) commandRunner {
+	return func(repo *Repository, args []string) {
+		if len(args) != 1 {
+			flags.Usage()
+			os.Exit(129)
+		}
+		scripts := map[string]string{
+			"bash": bashCompletionScript,
+			"zsh":  zshCompletionScript,
+			"fish": fishCompletionScript,
+		}
+		script, ok := scripts[args[0]]
+		if !ok {
+			log.Fatalf("fatal: unsupported shell '%s', expected bash, zsh or fish", args[0])
+		}
+		// shell function names cannot contain dashes
+		functionName := strings.NewReplacer("-", "_", ".", "_").Replace(programName())
+		fmt.Printf(script, programName(), functionName)
+	}
+}
+
+// setupComplete implements the hidden command called by the completion
+// scripts: given the words typed so far, the last being the one under the
+// cursor, it prints the matching candidates one per line
+func setupComplete(flags *flag.FlagSet) commandRunner {
+	return func(repo *Repository, words []string) {
+		current := ""
+		if len(words) > 0 {
+			current = words[len(words)-1]
+			words = words[:len(words)-1]
+		}
+		gitDir := os.Getenv("GIT_DIR")
+		// skip global options to find the command being completed
+		for len(words) > 0 && strings.HasPrefix(words[0], "-") {
+			if (words[0] == "-C" || words[0] == "--git-dir") && len(words) > 1 {
+				if words[0] == "-C" {
+					os.Chdir(words[1])
+				} else {
+					gitDir = words[1]
+				}
+				words = words[2:]
+				continue
+			}
+			if strings.HasPrefix(words[0], "--git-dir=") {
+				gitDir = strings.TrimPrefix(words[0], "--git-dir=")
+			}
+			words = words[1:]
+		}
+		candidates := make([]string, 0)
+		if len(words) == 0 {
+			candidates = commandCandidates(gitDir)
+		} else if cmd, ok := findCommand(words[0]); ok {
+			if strings.HasPrefix(current, "-") {
+				candidates = flagCandidates(cmd)
+			} else if cmd.completesRefs {
+				candidates = refCandidates(gitDir)
+			}
+		}
+		for _, candidate := range candidates {
+			if strings.HasPrefix(candidate, current) {
+				fmt.Println(candidate)
+			}
+		}
+	}
+}
+
+func commandCandidates(gitDir string) []string {
+	candidates := make([]string, 0)
+	for _, cmd := range commands {
+		if !cmd.hidden {
+			candidates = append(candidates, cmd.name)
+		}
+	}
+	if gitDir == "" {
+		if cwd, err := os.Getwd(); err == nil {
+			gitDir, _ = discoverGitDir(cwd)
+		}
+	}
+	for _, entry := range loadConfig(gitDir).entries {
+		if strings.HasPrefix(entry.key, "alias.") {
+			candidates = append(candidates, strings.TrimPrefix(entry.key, "alias."))
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+func flagCandidates(cmd command) []string {
+	flags := newCommandFlags(cmd)
+	cmd.setup(flags)
+	candidates := make([]string, 0)
+	flags.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) == 1 {
+			candidates = append(candidates, "-"+f.Name)
+		} else {
+			candidates = append(candidates, "--"+f.Name)
+		}
+	})
+	return candidates
+}
+
+// refCandidates lists HEAD and the short names of branches, tags and
+// remote-tracking branches, or nothing outside of a repository
+func refCandidates(gitDir string) []string {
+	if gitDir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil
+		}
+		var ok bool
+		if gitDir, ok = discoverGitDir(cwd); !ok {
+			return nil
+		}
+	}
+	repo := OpenRepository(gitDir, RepositoryOptions{})
+	candidates := []string{"HEAD"}
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		for _, ref := range repo.listRefs(prefix) {
+			candidates = append(candidates, strings.TrimPrefix(ref, prefix))
+		}
+	}
+	return candidates
+}
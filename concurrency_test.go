@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// writeTestHistory commits count versions of a file on main and returns
+// the commits, oldest first, and every object they reach with its content
+func writeTestHistory(repo *Repository, count int) ([]string, map[string][]byte) {
+	objects := make(map[string][]byte)
+	commits := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		content := bytes.Repeat([]byte(fmt.Sprintf("line %d of version %d\n", i, i)), 50+i)
+		blob := repo.writeObject("blob", content)
+		objects[blob] = content
+		treeContent := serializeTree([]treeEntry{{"100644", "file", blob}})
+		tree := repo.writeObject("tree", treeContent)
+		objects[tree] = treeContent
+		commit := repo.createCommit(tree, commits[len(commits)-min(len(commits), 1):], fmt.Sprintf("version %d\n", i))
+		_, objects[commit] = repo.readObject(commit)
+		commits = append(commits, commit)
+	}
+	repo.updateRef("refs/heads/main", commits[len(commits)-1])
+	return commits, objects
+}
+
+// TestConcurrentUseDuringGc reads objects, updates and deletes refs and
+// writes the index from several goroutines while gc and incremental
+// repacks replace the packs they read from; run it with -race.
+func TestConcurrentUseDuringGc(t *testing.T) {
+	// with caches too small to keep anything, every read goes to the packs
+	repo := newTestRepository(t, RepositoryOptions{ObjectCacheLimit: 1, DeltaBaseCacheLimit: 1})
+	commits, objects := writeTestHistory(repo, 40)
+	repo.gc(gcOptions{quiet: true, pruneExpire: "now"})
+
+	var maintenance, users sync.WaitGroup
+	done := make(chan struct{})
+	running := func() bool {
+		select {
+		case <-done:
+			return false
+		default:
+			return true
+		}
+	}
+	maintenance.Add(1)
+	go func() {
+		defer maintenance.Done()
+		for i := 0; i < 5; i++ {
+			// each gc leaves a pack the next repacks away
+			repo.gc(gcOptions{quiet: true, force: true, pruneExpire: "now"})
+			repo.incrementalRepack(maintenanceOptions{quiet: true})
+		}
+	}()
+	errors := make(chan error, 16)
+	for reader := 0; reader < 4; reader++ {
+		users.Add(1)
+		go func() {
+			defer users.Done()
+			for running() {
+				for hash, want := range objects {
+					if _, content := repo.readObject(hash); !bytes.Equal(content, want) {
+						errors <- fmt.Errorf("object %s read back differently", hash)
+						return
+					}
+				}
+			}
+		}()
+	}
+	users.Add(1)
+	go func() {
+		defer users.Done()
+		for i := 0; running(); i++ {
+			name := fmt.Sprintf("refs/heads/topic-%d", i%8)
+			repo.updateRef(name, commits[i%len(commits)])
+			if hash, ok := repo.resolveRef(name); !ok || hash != commits[i%len(commits)] {
+				errors <- fmt.Errorf("%s is %q after updating it to %s", name, hash, commits[i%len(commits)])
+				return
+			}
+			if i%3 == 0 {
+				repo.deleteRef(name)
+				if _, ok := repo.resolveRef(name); ok {
+					errors <- fmt.Errorf("%s is still there after deleting it", name)
+					return
+				}
+			}
+		}
+	}()
+	users.Add(1)
+	go func() {
+		defer users.Done()
+		for i := 0; running(); i++ {
+			commit := repo.readCommitObject(commits[i%len(commits)])
+			index := repo.lockIndex()
+			index.entries = []indexEntry{{mode: 0100644, hash: repo.readTreeEntries(commit.tree)[0].hash, path: "file"}}
+			repo.writeIndex(index)
+		}
+	}()
+	maintenance.Wait()
+	close(done)
+	users.Wait()
+	close(errors)
+	for err := range errors {
+		t.Error(err)
+	}
+	for hash, want := range objects {
+		if _, content := repo.readObject(hash); !bytes.Equal(content, want) {
+			t.Errorf("object %s read back differently after gc", hash)
+		}
+	}
+}
+
+// TestConcurrentIndexWriters stages files from several goroutines while
+// others commit and check files out, each writing the index as it goes;
+// no staged change may be lost to a writer that read the index before it.
+func TestConcurrentIndexWriters(t *testing.T) {
+	repo := newTestRepository(t, RepositoryOptions{})
+	commitWorktreeFile(t, repo, "base", "base\n", "base")
+
+	const adders, versions = 3, 20
+	var writers sync.WaitGroup
+	for adder := 0; adder < adders; adder++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			name := fmt.Sprintf("staged-%d", adder)
+			for version := 0; version < versions; version++ {
+				writeWorktreeFile(t, repo, name, fmt.Sprintf("version %d\n", version))
+				repo.addPaths(repo.parsePathspecs([]string{name}), 1, addOptions{})
+			}
+		}()
+	}
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 0; i < versions; i++ {
+			repo.commitIndex(commitOptions{messages: []string{fmt.Sprintf("commit %d", i)}, allowEmpty: true, quiet: true})
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		for i := 0; i < versions; i++ {
+			repo.checkoutPaths("HEAD", repo.parsePathspecs([]string{"base"}))
+		}
+	}()
+	writers.Wait()
+
+	index := repo.readIndex()
+	for adder := 0; adder < adders; adder++ {
+		name := fmt.Sprintf("staged-%d", adder)
+		want := hashObject("blob", []byte(fmt.Sprintf("version %d\n", versions-1)))
+		if position, ok := index.find(name); !ok {
+			t.Errorf("%s is not in the index", name)
+		} else if index.entries[position].hash != want {
+			t.Errorf("%s is staged as %s, want %s", name, index.entries[position].hash, want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type configEntry struct {
+	key    string // "<section>[.<subsection>].<name>", section and name lower-cased
+	value  string
+	source string
+}
+
+type gitConfig struct {
+	lock    *sync.RWMutex // guards entries, which setConfig adds to
+	entries []configEntry
+}
+
+func configFilePaths(gitDir string) []string {
+	// later files override earlier ones: global, then repository
+	paths := make([]string, 0)
+	if xdgHome := os.Getenv("XDG_CONFIG_HOME"); xdgHome != "" {
+		paths = append(paths, filepath.Join(xdgHome, "git", "config"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "git", "config"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".gitconfig"))
+	}
+	if gitDir == "" {
+		// outside of a repository only the global files apply
+		return paths
+	}
+	return append(paths, filepath.Join(gitDir, "config"))
+}
+
+func loadConfig(gitDir string) gitConfig {
+	config := gitConfig{lock: &sync.RWMutex{}}
+	for _, path := range configFilePaths(gitDir) {
+		config.entries = append(config.entries, readConfigFile(path)...)
+	}
+	return config
+}
+
+func readConfigFile(path string) []configEntry {
+	// format:
+	// [section]
+	//     name = value
+	// [section "subsection"]
+	//     name = "quoted value" ; comment
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	entries := make([]configEntry, 0)
+	section := ""
+	lineNumber := 0
+	bufScanner := bufio.NewScanner(file)
+	for bufScanner.Scan() {
+		lineNumber++
+		line := bufScanner.Text()
+		for strings.HasSuffix(line, "\\") && bufScanner.Scan() {
+			// backslash at end of line continues the value on the next line
+			lineNumber++
+			line = line[:len(line)-1] + bufScanner.Text()
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			closing := strings.LastIndex(line, "]")
+			if closing == -1 {
+				log.Fatalf("bad config line %d in file %s", lineNumber, path)
+			}
+			section = parseConfigSection(line[1:closing])
+			if section == "" {
+				log.Fatalf("bad config line %d in file %s", lineNumber, path)
+			}
+			// a variable may follow the section header on the same line
+			line = strings.TrimSpace(line[closing+1:])
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+		}
+		if section == "" {
+			log.Fatalf("bad config line %d in file %s", lineNumber, path)
+		}
+		name, value := line, "true" // a bare name is a boolean true
+		if separator := strings.Index(line, "="); separator != -1 {
+			name = strings.TrimSpace(line[:separator])
+			value = parseConfigValue(line[separator+1:])
+		}
+		entries = append(entries, configEntry{section + "." + strings.ToLower(name), value, path})
+	}
+	if err := bufScanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return entries
+}
+
+func parseConfigSection(header string) string {
+	// `section "subsection"` keeps the subsection's case, the legacy
+	// `section.subsection` form is case-insensitive
+	quote := strings.Index(header, "\"")
+	if quote == -1 {
+		return strings.ToLower(strings.TrimSpace(header))
+	}
+	section := strings.ToLower(strings.TrimSpace(header[:quote]))
+	subsection := strings.TrimSuffix(header[quote+1:], "\"")
+	subsection = strings.NewReplacer("\\\"", "\"", "\\\\", "\\").Replace(subsection)
+	return section + "." + subsection
+}
+
+func parseConfigValue(raw string) string {
+	var value strings.Builder
+	inQuotes := false
+	pendingSpace := ""
+	raw = strings.TrimSpace(raw)
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			continue
+		case !inQuotes && (c == '#' || c == ';'):
+			return value.String()
+		case !inQuotes && (c == ' ' || c == '\t'):
+			// internal whitespace is kept, trailing whitespace is dropped
+			pendingSpace += string(c)
+			continue
+		case c == '\\' && i+1 < len(raw):
+			i++
+			switch raw[i] {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			default:
+				c = raw[i]
+			}
+		}
+		value.WriteString(pendingSpace)
+		pendingSpace = ""
+		value.WriteByte(c)
+	}
+	return value.String()
+}
+
+func normalizeConfigKey(key string) string {
+	// section and variable name are case-insensitive, the subsection is not
+	firstDot := strings.Index(key, ".")
+	lastDot := strings.LastIndex(key, ".")
+	if firstDot == -1 {
+		return strings.ToLower(key)
+	}
+	return strings.ToLower(key[:firstDot]) + key[firstDot:lastDot] + strings.ToLower(key[lastDot:])
+}
+
+func (config *gitConfig) get(key string) (string, bool) {
+	// the last definition wins
+	key = normalizeConfigKey(key)
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+	for i := len(config.entries) - 1; i >= 0; i-- {
+		if config.entries[i].key == key {
+			return config.entries[i].value, true
+		}
+	}
+	return "", false
+}
+
+func (config *gitConfig) getAll(key string) []string {
+	key = normalizeConfigKey(key)
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+	values := make([]string, 0)
+	for _, entry := range config.entries {
+		if entry.key == key {
+			values = append(values, entry.value)
+		}
+	}
+	return values
+}
+
+// allEntries returns the entries in the order they were read
+func (config *gitConfig) allEntries() []configEntry {
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+	return append([]configEntry(nil), config.entries...)
+}
+
+func (config *gitConfig) getBool(key string, defaultValue bool) bool {
+	value, ok := config.get(key)
+	if !ok {
+		return defaultValue
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0", "":
+		return false
+	}
+	log.Fatalf("bad boolean config value '%s' for '%s'", value, key)
+	return false
+}
+
+func (config *gitConfig) getInt(key string, defaultValue int64) int64 {
+	// integers may carry a k, m or g suffix
+	value, ok := config.get(key)
+	if !ok {
+		return defaultValue
+	}
+	if value == "" {
+		log.Fatalf("bad numeric config value '' for '%s'", key)
+	}
+	multiplier := int64(1)
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("bad numeric config value '%s' for '%s'", value, key)
+	}
+	return number * multiplier
+}
+
+// setConfig writes key = value to the repository config file, replacing the
+// last existing definition or adding the variable to the end of its section,
+// and updates the loaded config to match
+func (repo *Repository) setConfig(key string, value string) {
+	key = normalizeConfigKey(key)
+	lastDot := strings.LastIndex(key, ".")
+	if lastDot <= 0 {
+		log.Fatalf("error: key does not contain a section: %s", key)
+	}
+	section, name := key[:lastDot], key[lastDot+1:]
+	path := filepath.Join(repo.gitDir, "config")
+	// config.lock is taken before reading, so that settings written at the
+	// same time are not lost
+	lock := acquireLock(path)
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		lock.fail(err)
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	// position of the variable to replace, or the line after which to add it
+	variableLine, sectionEnd := -1, -1
+	currentSection := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			if closing := strings.LastIndex(trimmed, "]"); closing != -1 {
+				currentSection = parseConfigSection(trimmed[1:closing])
+			}
+		} else if currentSection == section && trimmed != "" && trimmed[0] != '#' && trimmed[0] != ';' {
+			variableName := trimmed
+			if separator := strings.Index(trimmed, "="); separator != -1 {
+				variableName = strings.TrimSpace(trimmed[:separator])
+			}
+			if strings.ToLower(variableName) == name {
+				variableLine = i
+			}
+		}
+		if currentSection == section {
+			sectionEnd = i
+		}
+	}
+	newLine := "\t" + name + " = " + quoteConfigValue(value) + "\n"
+	switch {
+	case variableLine != -1:
+		lines[variableLine] = newLine
+	case sectionEnd != -1:
+		lines = append(lines[:sectionEnd+1], append([]string{newLine}, lines[sectionEnd+1:]...)...)
+	default:
+		if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			lines[len(lines)-1] += "\n"
+		}
+		lines = append(lines, formatConfigSection(section)+"\n", newLine)
+	}
+	if _, err := lock.Write([]byte(strings.Join(lines, ""))); err != nil {
+		lock.fail(err)
+	}
+	lock.commit()
+	repo.config.lock.Lock()
+	repo.config.entries = append(repo.config.entries, configEntry{key, value, path})
+	repo.config.lock.Unlock()
+}
+
+func formatConfigSection(section string) string {
+	dot := strings.Index(section, ".")
+	if dot == -1 {
+		return "[" + section + "]"
+	}
+	subsection := strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(section[dot+1:])
+	return "[" + section[:dot] + " \"" + subsection + "\"]"
+}
+
+func quoteConfigValue(value string) string {
+	// quote values that would otherwise lose whitespace or be cut off by a
+	// comment character when read back
+	escaped := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t").Replace(value)
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;") {
+		return "\"" + escaped + "\""
+	}
+	return escaped
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// corruptionHint follows every report of a damaged object
+const corruptionHint = "hint: run \"git fsck --full\" to find out what else is damaged; a good copy\n" +
+	"hint: of a damaged object can be fetched from another clone of the repository"
+
+// parseLooseObject inflates the file of a loose object and splits it into
+// header and content, explaining what is wrong with a damaged one
+func parseLooseObject(compressed []byte) (objectHeader, []byte, error) {
+	contentReader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return objectHeader{}, nil, fmt.Errorf("inflate: %s", err)
+	}
+	defer contentReader.Close()
+	data, err := io.ReadAll(contentReader)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return objectHeader{}, nil, errors.New("object file is truncated")
+	}
+	if err != nil {
+		return objectHeader{}, nil, fmt.Errorf("inflate: %s", err)
+	}
+	// header format: "<object-type-string> <length-in-string>\0"
+	end := bytes.IndexByte(data, 0)
+	if end == -1 {
+		return objectHeader{}, nil, errors.New("object header is not terminated")
+	}
+	objectType, length, ok := bytes.Cut(data[:end], []byte(" "))
+	if !ok {
+		return objectHeader{}, nil, fmt.Errorf("invalid object header %q", data[:end])
+	}
+	switch string(objectType) {
+	case "blob", "tree", "commit", "tag":
+	default:
+		return objectHeader{}, nil, fmt.Errorf("invalid object type %q", objectType)
+	}
+	size, err := strconv.Atoi(string(length))
+	if err != nil || size < 0 {
+		return objectHeader{}, nil, fmt.Errorf("invalid object size %q", length)
+	}
+	content := data[end+1:]
+	switch {
+	case len(content) < size:
+		return objectHeader{}, nil, fmt.Errorf("object is %d bytes long, its header says %d", len(content), size)
+	case len(content) > size:
+		return objectHeader{}, nil, errors.New("garbage at end of loose object")
+	}
+	return objectHeader{string(objectType), size}, content, nil
+}
+
+// fatalCorruptLoose reports a damaged loose object and exits
+func fatalCorruptLoose(hash string, path string, reason error) {
+	fmt.Fprintf(os.Stderr, "error: %s\n", reason)
+	fmt.Fprintln(os.Stderr, corruptionHint)
+	log.Fatalf("fatal: loose object %s (stored in %s) is corrupt", hash, path)
+}
+
+// fatalCorruptIndex reports a damaged pack index and exits
+func fatalCorruptIndex(path string, reason string) {
+	fmt.Fprintf(os.Stderr, "error: %s\n", reason)
+	fmt.Fprintln(os.Stderr, corruptionHint)
+	log.Fatalf("fatal: pack index %s is corrupt", path)
+}
+
+// readVerifiedObject reads a packed object and checks that its content
+// has the id it is listed under. Damaged pack data is reported, together
+// with whether the crc32 the index recorded for the entry still matches,
+// instead of crashing the command.
+func (pack *packFile) readVerifiedObject(repo *Repository, hash string, offset int64) (objectType string, content []byte) {
+	defer func() {
+		if failure := recover(); failure != nil {
+			pack.fatalCorrupt(hash, offset, fmt.Sprint(failure))
+		}
+	}()
+	objectType, content = pack.readObjectAt(repo, offset)
+	if hashObject(objectType, content) != hash {
+		pack.fatalCorrupt(hash, offset, "hash mismatch "+hash)
+	}
+	return objectType, content
+}
+
+func (pack *packFile) fatalCorrupt(hash string, offset int64, reason string) {
+	if !pack.entryCRCMatches(hash, offset) {
+		fmt.Fprintf(os.Stderr, "error: bad packed object CRC for %s\n", hash)
+	}
+	fmt.Fprintf(os.Stderr, "error: failed to read object %s at offset %d from %s.pack: %s\n", hash, offset, pack.path, reason)
+	fmt.Fprintln(os.Stderr, corruptionHint)
+	log.Fatalf("fatal: packed object %s (stored in %s.pack) is corrupt", hash, pack.path)
+}
+
+// entryCRCMatches checks the raw bytes of a packed entry, up to the next
+// entry or the pack trailer, against the crc32 in the index; without one
+// there is nothing to tell and it reports a match
+func (pack *packFile) entryCRCMatches(hash string, offset int64) bool {
+	position, ok := pack.index.findPosition(hash)
+	if !ok {
+		return true
+	}
+	expected, ok := pack.index.crcAt(position)
+	if !ok {
+		return true
+	}
+	end := pack.data.size - ObjectShaLength
+	for _, other := range pack.index.offsets {
+		if other > offset && other < end {
+			end = other
+		}
+	}
+	if end <= offset {
+		return false
+	}
+	entry := make([]byte, end-offset)
+	if _, err := pack.data.ReadAt(entry, offset); err != nil {
+		return false
+	}
+	return crc32.ChecksumIEEE(entry) == expected
+}
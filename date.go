@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gitDateFormat = "Mon Jan 2 15:04:05 2006 -0700"
+
+// absoluteDateFormats are the layouts parseDate accepts besides git's
+// internal "<unix timestamp> <timezone>" and relative dates
+var absoluteDateFormats = []string{
+	mailDateFormat,
+	"Mon, 2 Jan 2006 15:04:05 -0700 (MST)",
+	"2 Jan 2006 15:04:05 -0700",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006.01.02",
+	"1/2/2006",
+	"2/1/2006",
+	"Jan 2 2006",
+	"2 Jan 2006",
+	gitDateFormat,
+}
+
+// parseDate parses the dates of GIT_*_DATE, --date, --since and --until:
+// "<unix timestamp> <timezone>", "@<unix timestamp>", an RFC 2822 or an
+// ISO 8601 date, or a date relative to now like git's approxidate, e.g.
+// "yesterday", "noon" or "2.weeks.ago". Dates without a timezone are local
+// time.
+func parseDate(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if timestamp, zone, ok := strings.Cut(strings.TrimPrefix(value, "@"), " "); ok {
+		if seconds, err := strconv.ParseInt(timestamp, 10, 64); err == nil && len(zone) == 5 && (zone[0] == '+' || zone[0] == '-') {
+			return time.Unix(seconds, 0).In(parseTimezone(zone)), true
+		}
+	} else if seconds, err := strconv.ParseInt(strings.TrimPrefix(value, "@"), 10, 64); err == nil && (value[0] == '@' || seconds >= 100000000) {
+		return time.Unix(seconds, 0).In(time.UTC), true
+	}
+	for _, layout := range absoluteDateFormats {
+		if when, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return when, true
+		}
+	}
+	return parseRelativeDate(value, now)
+}
+
+// parseRelativeDate parses the approxidate words git understands: counts
+// of units, "ago" being optional, "a" and "last" counting one, and the
+// special times "now", "today", "yesterday", "midnight", "noon" and "tea".
+// A counted weekday, as in "last friday" or "2 fridays ago", goes back to
+// that many of them before today; one alone, which git takes for one to
+// come, changes nothing.
+func parseRelativeDate(value string, now time.Time) (time.Time, bool) {
+	words := strings.FieldsFunc(strings.ToLower(value), func(c rune) bool {
+		return c == ' ' || c == '.' || c == ',' || c == '_'
+	})
+	if len(words) == 0 {
+		return time.Time{}, false
+	}
+	when := now
+	// atHour moves to the last time of day hour was, today or yesterday
+	atHour := func(hour int) {
+		moved := time.Date(when.Year(), when.Month(), when.Day(), hour, 0, 0, 0, when.Location())
+		if moved.After(when) {
+			moved = moved.AddDate(0, 0, -1)
+		}
+		when = moved
+	}
+	count := -1
+	for _, word := range words {
+		if number, err := strconv.Atoi(word); err == nil {
+			count = number
+			continue
+		}
+		switch word {
+		case "a", "an", "last":
+			count = 1
+			continue
+		case "ago", "now", "today":
+			continue
+		case "yesterday":
+			when = when.AddDate(0, 0, -1)
+			continue
+		case "midnight":
+			atHour(0)
+			continue
+		case "noon":
+			atHour(12)
+			continue
+		case "tea":
+			atHour(17)
+			continue
+		}
+		if weekday, ok := parseWeekday(word); ok {
+			if count > 0 {
+				days := (int(when.Weekday()-weekday)+6)%7 + 1
+				when = when.AddDate(0, 0, -days-7*(count-1))
+			}
+			count = -1
+			continue
+		}
+		if count < 0 {
+			return time.Time{}, false
+		}
+		switch strings.TrimSuffix(word, "s") {
+		case "second":
+			when = when.Add(-time.Duration(count) * time.Second)
+		case "minute":
+			when = when.Add(-time.Duration(count) * time.Minute)
+		case "hour":
+			when = when.Add(-time.Duration(count) * time.Hour)
+		case "day":
+			when = when.AddDate(0, 0, -count)
+		case "week":
+			when = when.AddDate(0, 0, -7*count)
+		case "month":
+			when = when.AddDate(0, -count, 0)
+		case "year":
+			when = when.AddDate(-count, 0, 0)
+		default:
+			return time.Time{}, false
+		}
+		count = -1
+	}
+	return when, count < 0
+}
+
+// parseWeekday reads a weekday by at least the first three letters of
+// its name, "fri" to "fridays"
+func parseWeekday(word string) (time.Weekday, bool) {
+	for _, prefix := range []string{word, strings.TrimSuffix(word, "s")} {
+		for weekday := time.Sunday; weekday <= time.Saturday && len(prefix) >= 3; weekday++ {
+			if strings.HasPrefix(strings.ToLower(weekday.String()), prefix) {
+				return weekday, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// dateStyles are the values of --date and log.date; each but relative
+// may end in "-local" to show dates in the local timezone
+var dateStyles = map[string]bool{
+	"default": true, "local": true, "relative": true, "iso": true, "iso8601": true, "iso-strict": true,
+	"iso8601-strict": true, "rfc": true, "rfc2822": true, "short": true, "raw": true, "unix": true,
+}
+
+// checkDateStyle fails on a --date value formatDate does not know
+func checkDateStyle(style string) {
+	if !dateStyles[strings.TrimSuffix(style, "-local")] {
+		log.Fatalf("fatal: unknown date format %s", style)
+	}
+}
+
+// formatDate shows a date in one of the dateStyles, in the timezone it was
+// recorded in
+func formatDate(when time.Time, style string, now time.Time) string {
+	trimmed := strings.TrimSuffix(style, "-local")
+	local := trimmed != style || style == "local"
+	if local {
+		when = when.Local()
+		style = trimmed
+	}
+	switch style {
+	case "relative":
+		return relativeDate(when, now)
+	case "iso", "iso8601":
+		return when.Format("2006-01-02 15:04:05 -0700")
+	case "iso-strict", "iso8601-strict":
+		return when.Format("2006-01-02T15:04:05-07:00")
+	case "rfc", "rfc2822":
+		return when.Format(mailDateFormat)
+	case "short":
+		return when.Format("2006-01-02")
+	case "raw":
+		return strconv.FormatInt(when.Unix(), 10) + " " + when.Format("-0700")
+	case "unix":
+		return strconv.FormatInt(when.Unix(), 10)
+	}
+	if local {
+		// local dates go without their timezone
+		return when.Format("Mon Jan 2 15:04:05 2006")
+	}
+	return when.Format(gitDateFormat)
+}
+
+// relativeDate rounds the age of a date the way git shows it, e.g.
+// "3 hours ago" or "2 years, 1 month ago"
+func relativeDate(when time.Time, now time.Time) string {
+	plural := func(count int64, unit string) string {
+		if count == 1 {
+			return fmt.Sprintf("%d %s", count, unit)
+		}
+		return fmt.Sprintf("%d %ss", count, unit)
+	}
+	diff := now.Unix() - when.Unix()
+	if diff < 0 {
+		return "in the future"
+	}
+	if diff < 90 {
+		return plural(diff, "second") + " ago"
+	}
+	diff = (diff + 30) / 60
+	if diff < 90 {
+		return plural(diff, "minute") + " ago"
+	}
+	diff = (diff + 30) / 60
+	if diff < 36 {
+		return plural(diff, "hour") + " ago"
+	}
+	diff = (diff + 12) / 24
+	if diff < 14 {
+		return plural(diff, "day") + " ago"
+	}
+	if diff < 70 {
+		return plural((diff+3)/7, "week") + " ago"
+	}
+	if diff < 365 {
+		return plural((diff+15)/30, "month") + " ago"
+	}
+	if diff < 1825 {
+		totalMonths := (diff*12*2 + 365) / (365 * 2)
+		years, months := totalMonths/12, totalMonths%12
+		if months > 0 {
+			return plural(years, "year") + ", " + plural(months, "month") + " ago"
+		}
+		return plural(years, "year") + " ago"
+	}
+	return plural((diff+183)/365, "year") + " ago"
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseDate checks the date formats of --since and --until against
+// what git makes of them on a Wednesday morning
+func TestParseDate(t *testing.T) {
+	now := time.Date(2026, 10, 14, 10, 0, 0, 0, time.Local)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2026-10-14T06:00", time.Date(2026, 10, 14, 6, 0, 0, 0, time.Local)},
+		{"2026-10-14T06:00:30", time.Date(2026, 10, 14, 6, 0, 30, 0, time.Local)},
+		{"2026-10-14 06:00", time.Date(2026, 10, 14, 6, 0, 0, 0, time.Local)},
+		{"2026-10-14", time.Date(2026, 10, 14, 0, 0, 0, 0, time.Local)},
+		{"10/14/2026", time.Date(2026, 10, 14, 0, 0, 0, 0, time.Local)},
+		{"2/1/2026", time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local)},
+		{"14/10/2026", time.Date(2026, 10, 14, 0, 0, 0, 0, time.Local)},
+		{"1760425200 +0200", time.Unix(1760425200, 0)},
+		{"last friday", time.Date(2026, 10, 9, 10, 0, 0, 0, time.Local)},
+		{"last Wednesday", time.Date(2026, 10, 7, 10, 0, 0, 0, time.Local)},
+		{"last sunday", time.Date(2026, 10, 11, 10, 0, 0, 0, time.Local)},
+		{"last fri", time.Date(2026, 10, 9, 10, 0, 0, 0, time.Local)},
+		{"2 fridays ago", time.Date(2026, 10, 2, 10, 0, 0, 0, time.Local)},
+		{"3 friday", time.Date(2026, 9, 25, 10, 0, 0, 0, time.Local)},
+		{"last friday noon", time.Date(2026, 10, 8, 12, 0, 0, 0, time.Local)},
+		{"friday", now},
+		{"last week", time.Date(2026, 10, 7, 10, 0, 0, 0, time.Local)},
+		{"2.weeks.ago", time.Date(2026, 9, 30, 10, 0, 0, 0, time.Local)},
+		{"yesterday", time.Date(2026, 10, 13, 10, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		if when, ok := parseDate(test.value, now); !ok || !when.Equal(test.want) {
+			t.Errorf("%q parses to %v, %v, want %v", test.value, when, ok, test.want)
+		}
+	}
+	for _, value := range []string{"13/13/2026", "fr", "last", "sometime"} {
+		if when, ok := parseDate(value, now); ok {
+			t.Errorf("%q parses to %v, want an error", value, when)
+		}
+	}
+}
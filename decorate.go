@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// decorationPrefixes are the refs log decorates commits with, along with
+// HEAD
+var decorationPrefixes = []string{"refs/heads/", "refs/remotes/", "refs/tags/", "refs/stash"}
+
+// refDecorations maps the objects refs point at to the names of those
+// refs, in the order git shows them. Annotated tags also decorate the
+// objects they peel to.
+type refDecorations struct {
+	refs       map[string][]string
+	headTarget string // the branch HEAD points at, empty when detached
+}
+
+func (repo *Repository) loadDecorations() refDecorations {
+	decorations := refDecorations{refs: make(map[string][]string)}
+	decorate := func(name string, hash string) {
+		for {
+			decorations.refs[hash] = append(decorations.refs[hash], name)
+			header, content := repo.readObject(hash)
+			if header.objectType != "tag" {
+				return
+			}
+			firstLine, _, _ := strings.Cut(string(content), "\n")
+			hash = strings.TrimPrefix(firstLine, "object ")
+		}
+	}
+	if hash, ok := repo.resolveRef("HEAD"); ok {
+		decorate("HEAD", hash)
+	}
+	decorations.headTarget, _ = repo.readSymbolicRef("HEAD")
+	// git lists the refs of an object latest name first
+	names := repo.listRefs("refs/")
+	for i := len(names) - 1; i >= 0; i-- {
+		for _, prefix := range decorationPrefixes {
+			if !strings.HasPrefix(names[i], prefix) {
+				continue
+			}
+			if hash, ok := repo.resolveRef(names[i]); ok {
+				decorate(names[i], hash)
+			}
+			break
+		}
+	}
+	return decorations
+}
+
+// parseDecorateStyle reads a --decorate or log.decorate value: "short",
+// "full", "no", or "auto" which decorates short when output goes to a
+// terminal
+func parseDecorateStyle(value string) string {
+	switch strings.ToLower(value) {
+	case "short", "true", "yes", "on", "1":
+		return "short"
+	case "full":
+		return "full"
+	case "no", "false", "off", "0":
+		return "no"
+	case "auto", "":
+		if pagerProcess != nil || isTerminal(os.Stdout) {
+			return "short"
+		}
+		return "no"
+	}
+	log.Fatalf("fatal: invalid --decorate option: %s", value)
+	return ""
+}
+
+// format lists the refs decorating hash, "HEAD -> main, tag: v1.0,
+// origin/main", with the short names of the refs unless style is "full"
+func (decorations refDecorations) format(hash string, style string, color bool) string {
+	refs := decorations.refs[hash]
+	if len(refs) == 0 {
+		return ""
+	}
+	shortName := func(name string) string {
+		if style == "full" {
+			return name
+		}
+		for _, prefix := range []string{"refs/heads/", "refs/remotes/", "refs/tags/"} {
+			if strings.HasPrefix(name, prefix) {
+				return strings.TrimPrefix(name, prefix)
+			}
+		}
+		return name
+	}
+	items := make([]string, 0, len(refs))
+	// HEAD decorates the commit its branch is on, shown as "HEAD -> main"
+	headOnBranch := false
+	for _, name := range refs {
+		headOnBranch = headOnBranch || name == decorations.headTarget
+	}
+	for _, name := range refs {
+		switch {
+		case name == "HEAD" && headOnBranch:
+			items = append(items, colorize(color, colorBoldCyan, "HEAD -> ")+colorize(color, colorBoldGreen, shortName(decorations.headTarget)))
+		case name == "HEAD":
+			items = append(items, colorize(color, colorBoldCyan, "HEAD"))
+		case headOnBranch && name == decorations.headTarget:
+			// shown along with HEAD
+		case strings.HasPrefix(name, "refs/heads/"):
+			items = append(items, colorize(color, colorBoldGreen, shortName(name)))
+		case strings.HasPrefix(name, "refs/remotes/"):
+			items = append(items, colorize(color, colorBoldRed, shortName(name)))
+		case strings.HasPrefix(name, "refs/tags/"):
+			items = append(items, colorize(color, colorBoldYellow, "tag: "+shortName(name)))
+		default:
+			items = append(items, colorize(color, colorBoldMagenta, shortName(name)))
+		}
+	}
+	return strings.Join(items, colorize(color, colorYellow, ", "))
+}
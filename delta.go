@@ -0,0 +1,175 @@
+package main
+
+import "bytes"
+
+// deltaBlockSize is the length of the blocks of a delta base that are
+// looked up in targets; matches shorter than that are inserted instead
+const deltaBlockSize = 16
+
+// deltaIndex finds where blocks of a base occur in it, built once per base
+// for all the targets it is tried against
+type deltaIndex struct {
+	base   []byte
+	blocks map[uint32][]int // rolling hash of a block to its offsets
+}
+
+// deltaRollingBase is the multiplier of the rolling hash of blocks; the
+// hash of a block is sum(c[i] * base^(15-i)) in uint32 arithmetic
+const deltaRollingBase = 0x01000193
+
+// deltaRollingOut is what the byte leaving a block weighs in its hash
+var deltaRollingOut = func() uint32 {
+	weight := uint32(1)
+	for i := 1; i < deltaBlockSize; i++ {
+		weight *= deltaRollingBase
+	}
+	return weight
+}()
+
+func deltaBlockHash(block []byte) uint32 {
+	var hash uint32
+	for _, c := range block {
+		hash = hash*deltaRollingBase + uint32(c)
+	}
+	return hash
+}
+
+// newDeltaIndex indexes the blocks of base at every multiple of the block
+// size, keeping a few offsets per hash so that repetitive content does not
+// make lookups slow
+func newDeltaIndex(base []byte) *deltaIndex {
+	const maxOffsetsPerHash = 8
+	index := &deltaIndex{base: base, blocks: make(map[uint32][]int, len(base)/deltaBlockSize)}
+	for offset := 0; offset+deltaBlockSize <= len(base); offset += deltaBlockSize {
+		hash := deltaBlockHash(base[offset : offset+deltaBlockSize])
+		if offsets := index.blocks[hash]; len(offsets) < maxOffsetsPerHash {
+			index.blocks[hash] = append(offsets, offset)
+		}
+	}
+	return index
+}
+
+// deltaWriter builds the instructions of a delta, giving up once they
+// are longer than a limit
+type deltaWriter struct {
+	data    bytes.Buffer
+	pending []byte // literal bytes not yet inserted
+	maxSize int
+}
+
+func (writer *deltaWriter) writeSize(size int) {
+	for size >= 0x80 {
+		writer.data.WriteByte(byte(size) | 0x80)
+		size >>= 7
+	}
+	writer.data.WriteByte(byte(size))
+}
+
+func (writer *deltaWriter) flushInsert() {
+	for len(writer.pending) > 0 {
+		count := len(writer.pending)
+		if count > 0x7f {
+			count = 0x7f
+		}
+		writer.data.WriteByte(byte(count))
+		writer.data.Write(writer.pending[:count])
+		writer.pending = writer.pending[count:]
+	}
+}
+
+// writeCopy adds the instructions copying size bytes of the base from
+// offset, 64KiB at most per instruction as git writes them
+func (writer *deltaWriter) writeCopy(offset int, size int) {
+	writer.flushInsert()
+	for size > 0 {
+		count := size
+		if count > 0x10000 {
+			count = 0x10000
+		}
+		instruction := byte(0x80)
+		var operands [7]byte
+		length := 0
+		for i := uint(0); i < 4; i++ {
+			if b := byte(offset >> (8 * i)); b != 0 {
+				instruction |= 1 << i
+				operands[length] = b
+				length++
+			}
+		}
+		// a size of 0x10000 is written as none at all
+		for i := uint(0); i < 3; i++ {
+			if b := byte(count >> (8 * i)); b != 0 && count != 0x10000 {
+				instruction |= 0x10 << i
+				operands[length] = b
+				length++
+			}
+		}
+		writer.data.WriteByte(instruction)
+		writer.data.Write(operands[:length])
+		offset += count
+		size -= count
+	}
+}
+
+func (writer *deltaWriter) tooBig() bool {
+	return writer.maxSize > 0 && writer.data.Len()+len(writer.pending) > writer.maxSize
+}
+
+// createDelta returns the delta turning the base of index into target, in
+// the format applyDelta reads: copies of the runs of target found in the
+// base, with what is left inserted. ok is false when the delta would be
+// longer than maxSize, no limit when it is 0.
+func (index *deltaIndex) createDelta(target []byte, maxSize int) ([]byte, bool) {
+	writer := &deltaWriter{maxSize: maxSize}
+	writer.writeSize(len(index.base))
+	writer.writeSize(len(target))
+	position := 0
+	var hash uint32
+	if len(target) >= deltaBlockSize {
+		hash = deltaBlockHash(target[:deltaBlockSize])
+	}
+	for position < len(target) {
+		if writer.tooBig() {
+			return nil, false
+		}
+		if position+deltaBlockSize > len(target) {
+			writer.pending = append(writer.pending, target[position:]...)
+			break
+		}
+		bestOffset, bestLength := 0, 0
+		for _, offset := range index.blocks[hash] {
+			length := 0
+			for offset+length < len(index.base) && position+length < len(target) && index.base[offset+length] == target[position+length] {
+				length++
+			}
+			if length > bestLength {
+				bestOffset, bestLength = offset, length
+			}
+		}
+		if bestLength < deltaBlockSize {
+			writer.pending = append(writer.pending, target[position])
+			if position+deltaBlockSize < len(target) {
+				hash = (hash-uint32(target[position])*deltaRollingOut)*deltaRollingBase + uint32(target[position+deltaBlockSize])
+			}
+			position++
+			continue
+		}
+		matched := bestLength
+		// the match may start within the bytes waiting to be inserted
+		for bestOffset > 0 && len(writer.pending) > 0 && index.base[bestOffset-1] == writer.pending[len(writer.pending)-1] {
+			bestOffset--
+			bestLength++
+			writer.pending = writer.pending[:len(writer.pending)-1]
+		}
+		writer.writeCopy(bestOffset, bestLength)
+		position += matched
+		if position+deltaBlockSize <= len(target) {
+			hash = deltaBlockHash(target[position : position+deltaBlockSize])
+		}
+	}
+	writer.flushInsert()
+	if writer.tooBig() {
+		return nil, false
+	}
+	return writer.data.Bytes(), true
+}
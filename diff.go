@@ -0,0 +1,1352 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultDiffContext is the number of unchanged lines around each hunk
+const DefaultDiffContext = 3
+
+// fileChange is one path that differs between two trees; the mode of the
+// missing side is 0 for added and deleted files
+type fileChange struct {
+	path     string
+	oldMode  uint32
+	newMode  uint32
+	oldHash  string
+	newHash  string
+	worktree bool // the new side is the worktree file, newHash only naming its content
+	dirty    bool // the new side is a worktree submodule with modified content
+	// for renames the path the file had and how similar the content
+	// stayed, in percent
+	oldPath    string
+	similarity int
+}
+
+func (change fileChange) status() byte {
+	switch {
+	case change.oldPath != "":
+		return 'R'
+	case change.oldMode == 0:
+		return 'A'
+	case change.newMode == 0:
+		return 'D'
+	case change.oldMode&0170000 != change.newMode&0170000:
+		return 'T'
+	}
+	return 'M'
+}
+
+// diffTrees lists the files that differ between two trees in path order,
+// an empty hash stands for the empty tree
+func (repo *Repository) diffTrees(oldTree string, newTree string) []fileChange {
+	oldEntries := repo.flattenTree(oldTree)
+	newEntries := repo.flattenTree(newTree)
+	changes := make([]fileChange, 0)
+	for entryPath, oldEntry := range oldEntries {
+		change := fileChange{path: entryPath, oldMode: parseFileMode(oldEntry.mode), oldHash: oldEntry.hash}
+		if newEntry, ok := newEntries[entryPath]; ok {
+			change.newMode, change.newHash = parseFileMode(newEntry.mode), newEntry.hash
+			if change.oldMode == change.newMode && change.oldHash == change.newHash {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	for entryPath, newEntry := range newEntries {
+		if _, ok := oldEntries[entryPath]; !ok {
+			changes = append(changes, fileChange{path: entryPath, newMode: parseFileMode(newEntry.mode), newHash: newEntry.hash})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	return changes
+}
+
+// splitLines cuts content into lines that keep their "\n", so that a
+// missing newline at the end of a file shows up as a difference
+func splitLines(content []byte) []string {
+	lines := make([]string, 0)
+	for len(content) > 0 {
+		end := bytes.IndexByte(content, '\n') + 1
+		if end == 0 {
+			end = len(content)
+		}
+		lines = append(lines, string(content[:end]))
+		content = content[end:]
+	}
+	return lines
+}
+
+// isBinaryContent applies git's heuristic: a NUL byte in the first 8000
+// bytes makes a file binary
+func isBinaryContent(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) != -1
+}
+
+// isBinaryDiff tells whether the contents of path are diffed as binary.
+// As in git, the diff attribute decides when set or unset, as the binary
+// macro unsets it, and diff.<driver>.binary for a diff=<driver>; otherwise
+// a side with a NUL byte early on is binary.
+func (repo *Repository) isBinaryDiff(path string, contents ...[]byte) bool {
+	switch repo.pathAttributes(path)["diff"] {
+	case "true":
+		return false
+	case "false":
+		return true
+	}
+	if driver := repo.diffDriver(path); driver != "" {
+		if _, ok := repo.config.get("diff." + driver + ".binary"); ok {
+			return repo.config.getBool("diff."+driver+".binary", false)
+		}
+	}
+	// like git, huge blobs are not diffed line by line
+	threshold := repo.bigFileThreshold()
+	for _, content := range contents {
+		if int64(len(content)) > threshold || isBinaryContent(content) {
+			return true
+		}
+	}
+	return false
+}
+
+// lineDiff marks the lines of old that are deleted and the lines of new
+// that are inserted. The edit script is found the way xdiff, git's diff
+// library, finds it so that patches come out the same as git's.
+type lineDiff struct {
+	old      []string
+	new      []string
+	deleted  []bool
+	inserted []bool
+}
+
+// xdiff tuning constants
+const (
+	diffMaxEqualLimit     = 1024 // XDL_MAX_EQLIMIT
+	diffSimilarScanWindow = 100  // XDL_SIMSCAN_WINDOW
+	diffKeepDiscardRun    = 4    // XDL_KPDIS_RUN
+	diffMaxCostMin        = 256  // XDL_MAX_COST_MIN
+	diffHeuristicMinCost  = 256  // XDL_HEUR_MIN_COST
+	diffSnakeCount        = 20   // XDL_SNAKE_CNT
+	diffHeuristicFactor   = 4    // XDL_K_HEUR
+	diffLineMax           = int(^uint(0) >> 1)
+)
+
+func diffLines(old []string, new []string) *lineDiff {
+	return diffSequences(old, new, true)
+}
+
+// diffSequences diffs any sequences of tokens, lines or words; the indent
+// heuristic only makes sense for lines
+func diffSequences(old []string, new []string, indentHeuristic bool) *lineDiff {
+	diff := &lineDiff{old, new, make([]bool, len(old)), make([]bool, len(new))}
+	classes := make(map[string]int)
+	classify := func(lines []string) []int {
+		ids := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := classes[line]
+			if !ok {
+				id = len(classes)
+				classes[line] = id
+			}
+			ids[i] = id
+		}
+		return ids
+	}
+	oldIDs, newIDs := classify(old), classify(new)
+	oldCounts, newCounts := make([]int, len(classes)), make([]int, len(classes))
+	for _, id := range oldIDs {
+		oldCounts[id]++
+	}
+	for _, id := range newIDs {
+		newCounts[id]++
+	}
+
+	// the common head and tail never take part in the search
+	start, shorter := 0, len(old)
+	if len(new) < shorter {
+		shorter = len(new)
+	}
+	for start < shorter && oldIDs[start] == newIDs[start] {
+		start++
+	}
+	tail := 0
+	for tail < shorter-start && oldIDs[len(old)-1-tail] == newIDs[len(new)-1-tail] {
+		tail++
+	}
+	search := &diffSearch{}
+	search.oldIndex, search.oldIDs = discardUnmatched(oldIDs, newCounts, start, len(old)-tail, diff.deleted)
+	search.newIndex, search.newIDs = discardUnmatched(newIDs, oldCounts, start, len(new)-tail, diff.inserted)
+	search.deleted, search.inserted = diff.deleted, diff.inserted
+	search.run()
+
+	compactChanges(old, oldIDs, diff.deleted, diff.inserted, indentHeuristic)
+	compactChanges(new, newIDs, diff.inserted, diff.deleted, indentHeuristic)
+	return diff
+}
+
+// integerSqrt is xdiff's rough square root by shifts
+func integerSqrt(n int) int {
+	i := 1
+	for ; n > 0; n >>= 2 {
+		i <<= 1
+	}
+	return i
+}
+
+// discardUnmatched marks lines without a match in the other file as
+// changed right away, as well as lines with many matches inside runs of
+// such lines, and returns the remaining lines with their positions
+func discardUnmatched(ids []int, otherCounts []int, start int, end int, changed []bool) ([]int, []int) {
+	limit := integerSqrt(len(ids))
+	if limit > diffMaxEqualLimit {
+		limit = diffMaxEqualLimit
+	}
+	// 0: no match, 1: some matches, 2: too many matches
+	discard := make([]byte, len(ids)+1)
+	for i := start; i < end; i++ {
+		switch matches := otherCounts[ids[i]]; {
+		case matches == 0:
+			discard[i] = 0
+		case matches >= limit:
+			discard[i] = 2
+		default:
+			discard[i] = 1
+		}
+	}
+	index, kept := make([]int, 0, end-start), make([]int, 0, end-start)
+	for i := start; i < end; i++ {
+		if discard[i] == 1 || (discard[i] == 2 && !isDiscardedMultimatch(discard, i, start, end-1)) {
+			index = append(index, i)
+			kept = append(kept, ids[i])
+		} else {
+			changed[i] = true
+		}
+	}
+	return index, kept
+}
+
+// isDiscardedMultimatch reports whether a line with many matches sits in
+// the middle of lines with none, where it is unlikely to be useful
+func isDiscardedMultimatch(discard []byte, i int, start int, end int) bool {
+	if i-start > diffSimilarScanWindow {
+		start = i - diffSimilarScanWindow
+	}
+	if end-i > diffSimilarScanWindow {
+		end = i + diffSimilarScanWindow
+	}
+	unmatchedBefore, multimatchBefore := 0, 1
+	for r := 1; i-r >= start; r++ {
+		if discard[i-r] == 0 {
+			unmatchedBefore++
+		} else if discard[i-r] == 2 {
+			multimatchBefore++
+		} else {
+			break
+		}
+	}
+	if unmatchedBefore == 0 {
+		return false
+	}
+	unmatchedAfter, multimatchAfter := 0, 1
+	for r := 1; i+r <= end; r++ {
+		if discard[i+r] == 0 {
+			unmatchedAfter++
+		} else if discard[i+r] == 2 {
+			multimatchAfter++
+		} else {
+			break
+		}
+	}
+	if unmatchedAfter == 0 {
+		return false
+	}
+	unmatched, multimatch := unmatchedBefore+unmatchedAfter, multimatchBefore+multimatchAfter
+	return multimatch*diffKeepDiscardRun < multimatch+unmatched
+}
+
+// diffSearch runs Myers' algorithm on the lines left after discarding,
+// splitting at the middle snake and giving up on a minimal script for
+// expensive inputs like xdiff does
+type diffSearch struct {
+	oldIDs, newIDs     []int
+	oldIndex, newIndex []int
+	deleted, inserted  []bool
+	forward, backward  []int
+	diagonalBase       int
+	maxCost            int
+}
+
+type diffSplit struct {
+	oldSplit, newSplit int
+	minimalLow         bool
+	minimalHigh        bool
+}
+
+func (search *diffSearch) run() {
+	diagonals := len(search.oldIDs) + len(search.newIDs) + 3
+	search.forward = make([]int, diagonals)
+	search.backward = make([]int, diagonals)
+	search.diagonalBase = len(search.newIDs) + 1
+	search.maxCost = integerSqrt(diagonals)
+	if search.maxCost < diffMaxCostMin {
+		search.maxCost = diffMaxCostMin
+	}
+	search.compare(0, len(search.oldIDs), 0, len(search.newIDs), false)
+}
+
+func (search *diffSearch) compare(oldStart, oldEnd, newStart, newEnd int, needMinimal bool) {
+	for oldStart < oldEnd && newStart < newEnd && search.oldIDs[oldStart] == search.newIDs[newStart] {
+		oldStart++
+		newStart++
+	}
+	for oldStart < oldEnd && newStart < newEnd && search.oldIDs[oldEnd-1] == search.newIDs[newEnd-1] {
+		oldEnd--
+		newEnd--
+	}
+	switch {
+	case oldStart == oldEnd:
+		for ; newStart < newEnd; newStart++ {
+			search.inserted[search.newIndex[newStart]] = true
+		}
+	case newStart == newEnd:
+		for ; oldStart < oldEnd; oldStart++ {
+			search.deleted[search.oldIndex[oldStart]] = true
+		}
+	default:
+		split := search.split(oldStart, oldEnd, newStart, newEnd, needMinimal)
+		search.compare(oldStart, split.oldSplit, newStart, split.newSplit, split.minimalLow)
+		search.compare(split.oldSplit, oldEnd, split.newSplit, newEnd, split.minimalHigh)
+	}
+}
+
+// split finds where the forward and backward searches meet, diagonal d
+// holding the furthest old line reached on the diagonal old - new = d
+func (search *diffSearch) split(off1, lim1, off2, lim2 int, needMinimal bool) diffSplit {
+	ha1, ha2 := search.oldIDs, search.newIDs
+	base := search.diagonalBase
+	kvdf := func(d int) *int { return &search.forward[base+d] }
+	kvdb := func(d int) *int { return &search.backward[base+d] }
+	dmin, dmax := off1-lim2, lim1-off2
+	fmid, bmid := off1-off2, lim1-lim2
+	odd := (fmid-bmid)&1 != 0
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+	*kvdf(fmid) = off1
+	*kvdb(bmid) = lim1
+
+	for cost := 1; ; cost++ {
+		gotSnake := false
+		// widen the diagonal range, turning back at the box boundaries
+		if fmin > dmin {
+			fmin--
+			*kvdf(fmin - 1) = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			*kvdf(fmax + 1) = -1
+		} else {
+			fmax--
+		}
+		for d := fmax; d >= fmin; d -= 2 {
+			var i1 int
+			if *kvdf(d - 1) >= *kvdf(d + 1) {
+				i1 = *kvdf(d - 1) + 1
+			} else {
+				i1 = *kvdf(d + 1)
+			}
+			previous := i1
+			i2 := i1 - d
+			for i1 < lim1 && i2 < lim2 && ha1[i1] == ha2[i2] {
+				i1++
+				i2++
+			}
+			if i1-previous > diffSnakeCount {
+				gotSnake = true
+			}
+			*kvdf(d) = i1
+			if odd && bmin <= d && d <= bmax && *kvdb(d) <= i1 {
+				return diffSplit{i1, i2, true, true}
+			}
+		}
+
+		if bmin > dmin {
+			bmin--
+			*kvdb(bmin - 1) = diffLineMax
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			*kvdb(bmax + 1) = diffLineMax
+		} else {
+			bmax--
+		}
+		for d := bmax; d >= bmin; d -= 2 {
+			var i1 int
+			if *kvdb(d - 1) < *kvdb(d + 1) {
+				i1 = *kvdb(d - 1)
+			} else {
+				i1 = *kvdb(d + 1) - 1
+			}
+			previous := i1
+			i2 := i1 - d
+			for i1 > off1 && i2 > off2 && ha1[i1-1] == ha2[i2-1] {
+				i1--
+				i2--
+			}
+			if previous-i1 > diffSnakeCount {
+				gotSnake = true
+			}
+			*kvdb(d) = i1
+			if !odd && fmin <= d && d <= fmax && i1 <= *kvdf(d) {
+				return diffSplit{i1, i2, true, true}
+			}
+		}
+
+		if needMinimal {
+			continue
+		}
+
+		// past the heuristic threshold a diagonal that got far along a long
+		// snake is good enough
+		if gotSnake && cost > diffHeuristicMinCost {
+			best := 0
+			var split diffSplit
+			for d := fmax; d >= fmin; d -= 2 {
+				distance := d - fmid
+				if distance < 0 {
+					distance = -distance
+				}
+				i1 := *kvdf(d)
+				i2 := i1 - d
+				value := (i1 - off1) + (i2 - off2) - distance
+				if value > diffHeuristicFactor*cost && value > best &&
+					off1+diffSnakeCount <= i1 && i1 < lim1 && off2+diffSnakeCount <= i2 && i2 < lim2 {
+					for k := 1; ha1[i1-k] == ha2[i2-k]; k++ {
+						if k == diffSnakeCount {
+							best = value
+							split = diffSplit{i1, i2, true, false}
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return split
+			}
+			for d := bmax; d >= bmin; d -= 2 {
+				distance := d - bmid
+				if distance < 0 {
+					distance = -distance
+				}
+				i1 := *kvdb(d)
+				i2 := i1 - d
+				value := (lim1 - i1) + (lim2 - i2) - distance
+				if value > diffHeuristicFactor*cost && value > best &&
+					off1 < i1 && i1 <= lim1-diffSnakeCount && off2 < i2 && i2 <= lim2-diffSnakeCount {
+					for k := 0; ha1[i1+k] == ha2[i2+k]; k++ {
+						if k == diffSnakeCount-1 {
+							best = value
+							split = diffSplit{i1, i2, false, true}
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return split
+			}
+		}
+
+		// enough is enough: take the path that got furthest
+		if cost >= search.maxCost {
+			forwardBest, forwardBestOld := -1, -1
+			for d := fmax; d >= fmin; d -= 2 {
+				i1 := *kvdf(d)
+				if i1 > lim1 {
+					i1 = lim1
+				}
+				i2 := i1 - d
+				if lim2 < i2 {
+					i1, i2 = lim2+d, lim2
+				}
+				if forwardBest < i1+i2 {
+					forwardBest, forwardBestOld = i1+i2, i1
+				}
+			}
+			backwardBest, backwardBestOld := diffLineMax, diffLineMax
+			for d := bmax; d >= bmin; d -= 2 {
+				i1 := *kvdb(d)
+				if i1 < off1 {
+					i1 = off1
+				}
+				i2 := i1 - d
+				if i2 < off2 {
+					i1, i2 = off2+d, off2
+				}
+				if i1+i2 < backwardBest {
+					backwardBest, backwardBestOld = i1+i2, i1
+				}
+			}
+			if (lim1+lim2)-backwardBest < forwardBest-(off1+off2) {
+				return diffSplit{forwardBestOld, forwardBest - forwardBestOld, true, false}
+			}
+			return diffSplit{backwardBestOld, backwardBest - backwardBestOld, false, true}
+		}
+	}
+}
+
+// changeGroup is a run of changed lines [start, end) of one file, the
+// runs being numbered through the unchanged lines between them so that
+// the groups of both files correspond
+type changeGroup struct {
+	start, end int
+}
+
+func newChangeGroup(changed []bool) changeGroup {
+	group := changeGroup{}
+	for group.end < len(changed) && changed[group.end] {
+		group.end++
+	}
+	return group
+}
+
+func (group *changeGroup) next(changed []bool) bool {
+	if group.end == len(changed) {
+		return false
+	}
+	group.start = group.end + 1
+	group.end = group.start
+	for group.end < len(changed) && changed[group.end] {
+		group.end++
+	}
+	return true
+}
+
+func (group *changeGroup) previous(changed []bool) bool {
+	if group.start == 0 {
+		return false
+	}
+	group.end = group.start - 1
+	group.start = group.end
+	for group.start > 0 && changed[group.start-1] {
+		group.start--
+	}
+	return true
+}
+
+func (group *changeGroup) slideDown(ids []int, changed []bool) bool {
+	if group.end < len(ids) && ids[group.start] == ids[group.end] {
+		changed[group.start], changed[group.end] = false, true
+		group.start++
+		group.end++
+		for group.end < len(changed) && changed[group.end] {
+			group.end++
+		}
+		return true
+	}
+	return false
+}
+
+func (group *changeGroup) slideUp(ids []int, changed []bool) bool {
+	if group.start > 0 && ids[group.start-1] == ids[group.end-1] {
+		group.start--
+		group.end--
+		changed[group.start], changed[group.end] = true, false
+		for group.start > 0 && changed[group.start-1] {
+			group.start--
+		}
+		return true
+	}
+	return false
+}
+
+// compactChanges moves every group of changed lines as far as it slides:
+// next to a change of the other file when possible, else where the indent
+// heuristic finds the most natural split
+func compactChanges(lines []string, ids []int, changed []bool, otherChanged []bool, indentHeuristic bool) {
+	group, other := newChangeGroup(changed), newChangeGroup(otherChanged)
+	for {
+		if group.end != group.start {
+			var size, earliestEnd, endMatchingOther int
+			for {
+				size = group.end - group.start
+				endMatchingOther = -1
+				for group.slideUp(ids, changed) {
+					other.previous(otherChanged)
+				}
+				earliestEnd = group.end
+				if other.end > other.start {
+					endMatchingOther = group.end
+				}
+				for group.slideDown(ids, changed) {
+					other.next(otherChanged)
+					if other.end > other.start {
+						endMatchingOther = group.end
+					}
+				}
+				if size == group.end-group.start {
+					break
+				}
+			}
+			switch {
+			case group.end == earliestEnd:
+			case endMatchingOther != -1:
+				for other.end == other.start {
+					group.slideUp(ids, changed)
+					other.previous(otherChanged)
+				}
+			case indentHeuristic:
+				bestShift := bestIndentShift(lines, group.end, size, earliestEnd)
+				for group.end > bestShift {
+					group.slideUp(ids, changed)
+					other.previous(otherChanged)
+				}
+			}
+		}
+		if !group.next(changed) {
+			return
+		}
+		other.next(otherChanged)
+	}
+}
+
+// indent heuristic weights, tuned by xdiff on a corpus of human-made diffs
+const (
+	indentMaxIndent                = 200
+	indentMaxBlanks                = 20
+	indentStartOfFilePenalty       = 1
+	indentEndOfFilePenalty         = 21
+	indentTotalBlankWeight         = -30
+	indentPostBlankWeight          = 6
+	indentRelativeIndentPenalty    = -4
+	indentRelativeIndentWithBlank  = 10
+	indentRelativeOutdentPenalty   = 24
+	indentRelativeOutdentWithBlank = 17
+	indentRelativeDedentPenalty    = 23
+	indentRelativeDedentWithBlank  = 17
+	indentWeight                   = 60
+	indentHeuristicMaxSliding      = 100
+)
+
+// lineIndent counts the columns of leading whitespace with tabs to the
+// next multiple of 8, -1 for a blank line
+func lineIndent(line string) int {
+	indent := 0
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case ' ':
+			indent++
+		case '\t':
+			indent += 8 - indent%8
+		case '\n', '\v', '\f', '\r':
+		default:
+			return indent
+		}
+		if indent >= indentMaxIndent {
+			return indentMaxIndent
+		}
+	}
+	return -1
+}
+
+// splitMeasurement describes the lines around a split between lines
+// split-1 and split
+type splitMeasurement struct {
+	endOfFile  bool
+	indent     int // of the line after the split, -1 if blank
+	preBlank   int // blank lines right above the split
+	preIndent  int // of the nearest non-blank line above, -1 if none
+	postBlank  int // blank lines after the line following the split
+	postIndent int // of the nearest non-blank line after that, -1 if none
+}
+
+func measureSplit(lines []string, split int) splitMeasurement {
+	var m splitMeasurement
+	if split >= len(lines) {
+		m.endOfFile, m.indent = true, -1
+	} else {
+		m.indent = lineIndent(lines[split])
+	}
+	m.preIndent = -1
+	for i := split - 1; i >= 0; i-- {
+		if m.preIndent = lineIndent(lines[i]); m.preIndent != -1 {
+			break
+		}
+		if m.preBlank++; m.preBlank == indentMaxBlanks {
+			m.preIndent = 0
+			break
+		}
+	}
+	m.postIndent = -1
+	for i := split + 1; i < len(lines); i++ {
+		if m.postIndent = lineIndent(lines[i]); m.postIndent != -1 {
+			break
+		}
+		if m.postBlank++; m.postBlank == indentMaxBlanks {
+			m.postIndent = 0
+			break
+		}
+	}
+	return m
+}
+
+type splitScore struct {
+	effectiveIndent int
+	penalty         int
+}
+
+func (score *splitScore) add(m splitMeasurement) {
+	if m.preIndent == -1 && m.preBlank == 0 {
+		score.penalty += indentStartOfFilePenalty
+	}
+	if m.endOfFile {
+		score.penalty += indentEndOfFilePenalty
+	}
+	postBlank := 0
+	if m.indent == -1 {
+		postBlank = 1 + m.postBlank
+	}
+	totalBlank := m.preBlank + postBlank
+	score.penalty += indentTotalBlankWeight * totalBlank
+	score.penalty += indentPostBlankWeight * postBlank
+	indent := m.indent
+	if indent == -1 {
+		indent = m.postIndent
+	}
+	anyBlanks := totalBlank != 0
+	score.effectiveIndent += indent
+	switch {
+	case indent == -1 || m.preIndent == -1 || indent == m.preIndent:
+	case indent > m.preIndent:
+		score.penalty += pick(anyBlanks, indentRelativeIndentWithBlank, indentRelativeIndentPenalty)
+	case m.postIndent != -1 && m.postIndent > indent:
+		score.penalty += pick(anyBlanks, indentRelativeOutdentWithBlank, indentRelativeOutdentPenalty)
+	default:
+		score.penalty += pick(anyBlanks, indentRelativeDedentWithBlank, indentRelativeDedentPenalty)
+	}
+}
+
+func pick(condition bool, ifTrue int, ifFalse int) int {
+	if condition {
+		return ifTrue
+	}
+	return ifFalse
+}
+
+func compareSplitScores(a splitScore, b splitScore) int {
+	indents := 0
+	if a.effectiveIndent > b.effectiveIndent {
+		indents = 1
+	} else if a.effectiveIndent < b.effectiveIndent {
+		indents = -1
+	}
+	return indentWeight*indents + (a.penalty - b.penalty)
+}
+
+// bestIndentShift picks the end of a group of size lines, currently ending
+// at end, whose surrounding indentation looks most like a human's choice
+func bestIndentShift(lines []string, end int, size int, earliestEnd int) int {
+	shift := earliestEnd
+	if end-size-1 > shift {
+		shift = end - size - 1
+	}
+	if end-indentHeuristicMaxSliding > shift {
+		shift = end - indentHeuristicMaxSliding
+	}
+	bestShift := -1
+	var bestScore splitScore
+	for ; shift <= end; shift++ {
+		var score splitScore
+		score.add(measureSplit(lines, shift))
+		score.add(measureSplit(lines, shift-size))
+		if bestShift == -1 || compareSplitScores(score, bestScore) <= 0 {
+			bestScore, bestShift = score, shift
+		}
+	}
+	return bestShift
+}
+
+// diffLine is one line of a hunk with its ' ', '-' or '+' prefix
+type diffLine struct {
+	op   byte
+	text string
+}
+
+type diffHunk struct {
+	oldStart int // 1-based, the line before the hunk when oldCount is 0
+	oldCount int
+	newStart int
+	newCount int
+	function string // the line before the hunk matching the funcname pattern
+	lines    []diffLine
+}
+
+// edits returns the whole edit script, deletions before insertions at
+// every change
+func (diff *lineDiff) edits() []diffLine {
+	edits := make([]diffLine, 0, len(diff.old)+len(diff.new))
+	i, j := 0, 0
+	for i < len(diff.old) || j < len(diff.new) {
+		switch {
+		case i < len(diff.old) && diff.deleted[i]:
+			edits = append(edits, diffLine{'-', diff.old[i]})
+			i++
+		case j < len(diff.new) && diff.inserted[j]:
+			edits = append(edits, diffLine{'+', diff.new[j]})
+			j++
+		default:
+			edits = append(edits, diffLine{' ', diff.old[i]})
+			i++
+			j++
+		}
+	}
+	return edits
+}
+
+// hunks groups the changes with context lines around them; changes less
+// than two contexts apart share a hunk
+func (diff *lineDiff) hunks(context int) []diffHunk {
+	edits := diff.edits()
+	hunks := make([]diffHunk, 0)
+	oldLine, newLine := 0, 0
+	oldPositions := make([]int, len(edits))
+	newPositions := make([]int, len(edits))
+	for i, edit := range edits {
+		oldPositions[i], newPositions[i] = oldLine, newLine
+		if edit.op != '+' {
+			oldLine++
+		}
+		if edit.op != '-' {
+			newLine++
+		}
+	}
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for {
+			for end < len(edits) && edits[end].op != ' ' {
+				end++
+			}
+			next := end
+			for next < len(edits) && edits[next].op == ' ' {
+				next++
+			}
+			if next == len(edits) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+		hunk := diffHunk{oldStart: oldPositions[start] + 1, newStart: newPositions[start] + 1, lines: edits[start:stop]}
+		for _, line := range hunk.lines {
+			if line.op != '+' {
+				hunk.oldCount++
+			}
+			if line.op != '-' {
+				hunk.newCount++
+			}
+		}
+		if hunk.oldCount == 0 {
+			hunk.oldStart--
+		}
+		if hunk.newCount == 0 {
+			hunk.newStart--
+		}
+		hunk.function = functionContext(diff.old, oldPositions[start])
+		hunks = append(hunks, hunk)
+		i = stop
+	}
+	return hunks
+}
+
+// functionContext finds the line shown after a hunk header with xdiff's
+// default pattern: the closest line before the hunk starting with a
+// letter, "_" or "$"
+func functionContext(lines []string, before int) string {
+	for i := before - 1; i >= 0; i-- {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+		if c := line[0]; c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' {
+			if len(line) > 80 {
+				line = line[:80]
+			}
+			return strings.TrimRight(line, " \t\r\n")
+		}
+	}
+	return ""
+}
+
+func formatHunkRange(start int, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func (hunk diffHunk) header() string {
+	header := fmt.Sprintf("@@ -%s +%s @@", formatHunkRange(hunk.oldStart, hunk.oldCount), formatHunkRange(hunk.newStart, hunk.newCount))
+	if hunk.function != "" {
+		header += " " + hunk.function
+	}
+	return header
+}
+
+// diffOptions controls how patches are written
+type diffOptions struct {
+	context    int
+	colors     diffColors     // all empty for plain output
+	whitespace whitespaceRule // the problems highlighted in colored output
+	highlight  string         // the ops ('+', '-', ' ') of the lines whose whitespace problems are highlighted
+	wordDiff   string         // "plain", "color" or "porcelain" to show changed words rather than lines
+	wordRegex  *regexp.Regexp // what makes a word, nil for runs of non-whitespace
+	binary     bool           // write binary changes as patches apply can apply
+	textconv   bool           // diff the text diff.<driver>.textconv makes of contents
+	external   bool           // let external diff commands show changes
+	submodule  string         // "log" to show submodule changes as the commits they add and remove
+}
+
+// diffColors are the colors of the parts of a patch, set from
+// color.diff.<slot>
+type diffColors struct {
+	meta       string
+	frag       string
+	function   string
+	context    string
+	old        string
+	new        string
+	whitespace string
+	reset      string
+}
+
+func (repo *Repository) diffColors(enabled bool) diffColors {
+	if !enabled {
+		return diffColors{}
+	}
+	colors := diffColors{meta: "\033[1m", frag: colorCyan, old: colorRed, new: colorGreen, whitespace: "\033[41m", reset: colorReset}
+	for _, slot := range []struct {
+		names []string
+		color *string
+	}{
+		{[]string{"context", "plain"}, &colors.context},
+		{[]string{"meta"}, &colors.meta},
+		{[]string{"frag"}, &colors.frag},
+		{[]string{"func"}, &colors.function},
+		{[]string{"old"}, &colors.old},
+		{[]string{"new"}, &colors.new},
+		{[]string{"whitespace"}, &colors.whitespace},
+	} {
+		for _, name := range slot.names {
+			spec, ok := repo.config.get("color.diff." + name)
+			if !ok {
+				continue
+			}
+			code, valid := parseColorSpec(spec)
+			if !valid {
+				log.Fatalf("fatal: invalid color value: %s", spec)
+			}
+			*slot.color = code
+		}
+	}
+	return colors
+}
+
+// abbreviateHash shortens an object name for "index" lines
+func abbreviateHash(hash string) string {
+	if hash == "" {
+		return "0000000"
+	}
+	return hash[:7]
+}
+
+func (repo *Repository) blobContent(hash string) []byte {
+	if hash == "" {
+		return nil
+	}
+	_, content := repo.readObject(hash)
+	return content
+}
+
+// sideContent is what a side of a diff compares, a gitlink being shown
+// by the commit it names
+func (repo *Repository) sideContent(mode uint32, hash string) []byte {
+	if mode == fileModeGitlink {
+		return gitlinkContent(hash, false)
+	}
+	return repo.blobContent(hash)
+}
+
+// changeContents reads both sides of a change, the new one from the
+// worktree when the change compares against it
+func (repo *Repository) changeContents(change fileChange) ([]byte, []byte) {
+	oldContent := repo.sideContent(change.oldMode, change.oldHash)
+	if change.newMode == fileModeGitlink {
+		return oldContent, gitlinkContent(change.newHash, change.dirty)
+	}
+	if !change.worktree || change.newMode == 0 {
+		return oldContent, repo.blobContent(change.newHash)
+	}
+	info, err := os.Lstat(repo.worktreePath(change.path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return oldContent, repo.worktreeBlob(change.path, info)
+}
+
+// writePatch writes the "diff --git" section of one change; a change of
+// file type is shown as a deletion followed by an addition
+func (repo *Repository) writePatch(w io.Writer, change fileChange, options diffOptions) {
+	if options.external {
+		if command := repo.externalDiffCommand(change.path); command != "" {
+			repo.runExternalDiff(w, command, change)
+			return
+		}
+	}
+	if options.submodule == "log" && (change.oldMode == 0 || change.oldMode == fileModeGitlink) && (change.newMode == 0 || change.newMode == fileModeGitlink) {
+		// gitlinks added, removed or changed get a summary instead
+		repo.writeSubmoduleSummary(w, change, options)
+		return
+	}
+	if change.status() == 'T' {
+		repo.writePatch(w, fileChange{path: change.path, oldMode: change.oldMode, oldHash: change.oldHash}, options)
+		repo.writePatch(w, fileChange{path: change.path, newMode: change.newMode, newHash: change.newHash, worktree: change.worktree, dirty: change.dirty}, options)
+		return
+	}
+	colors := options.colors
+	meta := func(format string, arguments ...interface{}) {
+		fmt.Fprintf(w, "%s%s%s\n", colors.meta, fmt.Sprintf(format, arguments...), colors.reset)
+	}
+	oldPath := change.path
+	if change.oldPath != "" {
+		oldPath = change.oldPath
+	}
+	oldName, newName := quotePath("a/"+oldPath), quotePath("b/"+change.path)
+	meta("diff --git %s %s", oldName, newName)
+	switch {
+	case change.oldMode == 0:
+		meta("new file mode %06o", change.newMode)
+		oldName = "/dev/null"
+	case change.newMode == 0:
+		meta("deleted file mode %06o", change.oldMode)
+		newName = "/dev/null"
+	case change.oldMode != change.newMode:
+		meta("old mode %06o", change.oldMode)
+		meta("new mode %06o", change.newMode)
+	}
+	if change.oldPath != "" {
+		meta("similarity index %d%%", change.similarity)
+		meta("rename from %s", quotePath(change.oldPath))
+		meta("rename to %s", quotePath(change.path))
+	}
+	if change.oldHash == change.newHash && !change.dirty {
+		return
+	}
+	oldContent, newContent := repo.changeContents(change)
+	var binary bool
+	if driver, command, ok := repo.textconvDriver(change.path); ok && options.textconv {
+		// converted text is never binary
+		oldContent, newContent = repo.convertChangeText(driver, command, change, oldContent, newContent)
+	} else {
+		binary = repo.isBinaryDiff(change.path, oldContent, newContent)
+	}
+	oldIndexName, newIndexName := abbreviateHash(change.oldHash), abbreviateHash(change.newHash)
+	if binary && options.binary {
+		// a binary patch names the objects in full for apply to check them
+		oldIndexName, newIndexName = change.oldHash, change.newHash
+		if oldIndexName == "" {
+			oldIndexName = strings.Repeat("0", 2*ObjectShaLength)
+		}
+		if newIndexName == "" {
+			newIndexName = strings.Repeat("0", 2*ObjectShaLength)
+		}
+	}
+	switch {
+	case change.oldHash == change.newHash:
+		// a dirty submodule at the recorded commit
+	case change.oldMode != 0 && change.oldMode == change.newMode:
+		meta("index %s..%s %06o", oldIndexName, newIndexName, change.oldMode)
+	default:
+		meta("index %s..%s", oldIndexName, newIndexName)
+	}
+	if binary && options.binary {
+		writeBinaryPatch(w, oldContent, newContent)
+		return
+	}
+	if binary {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return
+	}
+	oldLines, newLines := splitLines(oldContent), splitLines(newContent)
+	hunks := diffLines(oldLines, newLines).hunks(options.context)
+	if len(hunks) == 0 {
+		return
+	}
+	// names with spaces get a tab so that patch tools find their end
+	meta("--- %s%s", oldName, nameTerminator(oldName))
+	meta("+++ %s%s", newName, nameTerminator(newName))
+	oldBlankAtEOF, newBlankAtEOF := 0, 0
+	if options.whitespace&whitespaceBlankAtEOF != 0 {
+		oldBlankAtEOF, newBlankAtEOF = blankLinesAtEOF(oldLines, newLines)
+	}
+	for _, hunk := range hunks {
+		options.writeHunkHeader(w, hunk)
+		if options.wordDiff != "" {
+			options.writeWordDiffHunk(w, hunk)
+			continue
+		}
+		// git counts the lines from the hunk start on, one ahead
+		oldLine, newLine := hunk.oldStart, hunk.newStart
+		for _, line := range hunk.lines {
+			if line.op != '+' {
+				oldLine++
+			}
+			if line.op != '-' {
+				newLine++
+			}
+			blankAtEOF := line.op == '+' && oldBlankAtEOF != 0 && oldBlankAtEOF <= oldLine && newBlankAtEOF <= newLine && isBlankLine(line.text)
+			options.writeDiffLine(w, line, blankAtEOF)
+			if !strings.HasSuffix(line.text, "\n") {
+				fmt.Fprintf(w, "\n%s\\ No newline at end of file%s\n", colors.context, colors.reset)
+			}
+		}
+	}
+}
+
+func (options diffOptions) writeHunkHeader(w io.Writer, hunk diffHunk) {
+	colors := options.colors
+	if colors.reset == "" {
+		fmt.Fprintln(w, hunk.header())
+		return
+	}
+	header := hunk.header()
+	if hunk.function != "" {
+		header = strings.TrimSuffix(header, " "+hunk.function)
+	}
+	fmt.Fprint(w, colors.frag, header, colors.reset)
+	if hunk.function != "" {
+		fmt.Fprint(w, colors.context, " ", colors.reset, colors.function, hunk.function, colors.reset)
+	}
+	fmt.Fprintln(w)
+}
+
+// writeDiffLine writes a line of a hunk without its missing newline. With
+// colors, whitespace problems are highlighted on the lines asked for; a
+// blank line the change adds at the end of the file is highlighted whole.
+func (options diffOptions) writeDiffLine(w io.Writer, line diffLine, blankAtEOF bool) {
+	colors := options.colors
+	if colors.reset == "" {
+		fmt.Fprintf(w, "%c%s", line.op, line.text)
+		return
+	}
+	set := colors.context
+	switch line.op {
+	case '+':
+		set = colors.new
+	case '-':
+		set = colors.old
+	}
+	if colors.whitespace == "" || strings.IndexByte(options.highlight, line.op) == -1 {
+		writeColoredLine(w, set, line.op, line.text, colors.reset)
+	} else if blankAtEOF {
+		writeColoredLine(w, colors.whitespace, line.op, line.text, colors.reset)
+	} else {
+		fmt.Fprintf(w, "%s%c%s", set, line.op, colors.reset)
+		checkWhitespace(line.text, options.whitespace, w, set, colors.reset, colors.whitespace)
+	}
+}
+
+// writeColoredLine writes an op and its text in one color, the line end
+// and a carriage return before it left uncolored
+func writeColoredLine(w io.Writer, color string, op byte, text string, reset string) {
+	end := len(text)
+	if strings.HasSuffix(text[:end], "\n") {
+		end--
+	}
+	if strings.HasSuffix(text[:end], "\r") {
+		end--
+	}
+	fmt.Fprintf(w, "%s%c%s%s%s", color, op, text[:end], reset, text[end:])
+}
+
+func nameTerminator(name string) string {
+	if strings.Contains(name, " ") {
+		return "\t"
+	}
+	return ""
+}
+
+// fileStat counts the changed lines of one file for --stat
+type fileStat struct {
+	path    string
+	added   int
+	deleted int
+	binary  bool
+	oldSize int
+	newSize int
+}
+
+func (repo *Repository) diffStat(change fileChange) fileStat {
+	stat := fileStat{path: change.path}
+	if change.oldPath != "" {
+		stat.path = renameDisplayName(change.oldPath, change.path)
+	}
+	oldContent, newContent := repo.changeContents(change)
+	stat.oldSize, stat.newSize = len(oldContent), len(newContent)
+	if repo.isBinaryDiff(change.path, oldContent, newContent) {
+		stat.binary = true
+		if change.oldHash == change.newHash {
+			// a binary file renamed as it is shows no sizes
+			stat.oldSize, stat.newSize = 0, 0
+		}
+		return stat
+	}
+	diff := diffLines(splitLines(oldContent), splitLines(newContent))
+	for _, deleted := range diff.deleted {
+		if deleted {
+			stat.deleted++
+		}
+	}
+	for _, inserted := range diff.inserted {
+		if inserted {
+			stat.added++
+		}
+	}
+	return stat
+}
+
+// scaleLinear maps a change count onto a graph of width columns, never
+// letting a non-zero count vanish
+func scaleLinear(count int, width int, maxChange int) int {
+	if count == 0 {
+		return 0
+	}
+	return 1 + count*(width-1)/maxChange
+}
+
+func decimalWidth(value int) int {
+	return len(fmt.Sprint(value))
+}
+
+// writeDiffStat prints the "path | count +++--" lines and the summary in
+// at most width columns, fitting names and graph the way git does
+func writeDiffStat(w io.Writer, stats []fileStat, width int, colors diffColors) {
+	maxLength, maxChange, numberWidth := 0, 0, 0
+	for _, stat := range stats {
+		if length := len(quotePath(stat.path)); length > maxLength {
+			maxLength = length
+		}
+		if stat.binary {
+			// counts are aligned with "Bin"
+			numberWidth = 3
+			continue
+		}
+		if change := stat.added + stat.deleted; change > maxChange {
+			maxChange = change
+		}
+	}
+	if decimalWidth(maxChange) > numberWidth {
+		numberWidth = decimalWidth(maxChange)
+	}
+	if width < 16+6+numberWidth {
+		width = 16 + 6 + numberWidth
+	}
+	graphWidth, nameWidth := maxChange, maxLength
+	if nameWidth+numberWidth+6+graphWidth > width {
+		if graphWidth > width*3/8-numberWidth-6 {
+			graphWidth = width*3/8 - numberWidth - 6
+			if graphWidth < 6 {
+				graphWidth = 6
+			}
+		}
+		if nameWidth > width-numberWidth-6-graphWidth {
+			nameWidth = width - numberWidth - 6 - graphWidth
+		} else {
+			graphWidth = width - numberWidth - 6 - nameWidth
+		}
+	}
+
+	insertions, deletions := 0, 0
+	for _, stat := range stats {
+		name := quotePath(stat.path)
+		if len(name) > nameWidth {
+			name = "..." + name[len(name)-nameWidth+3:]
+			if slash := strings.IndexByte(name, '/'); slash != -1 {
+				name = "..." + name[slash:]
+			}
+		}
+		if stat.binary {
+			fmt.Fprintf(w, " %-*s | %*s", nameWidth, name, numberWidth, "Bin")
+			if stat.oldSize != 0 || stat.newSize != 0 {
+				fmt.Fprintf(w, " %d -> %d bytes", stat.oldSize, stat.newSize)
+			}
+			fmt.Fprintln(w)
+			continue
+		}
+		insertions += stat.added
+		deletions += stat.deleted
+		added, deleted := stat.added, stat.deleted
+		if graphWidth <= maxChange {
+			total := scaleLinear(added+deleted, graphWidth, maxChange)
+			if total < 2 && added > 0 && deleted > 0 {
+				total = 2
+			}
+			if added < deleted {
+				added = scaleLinear(added, graphWidth, maxChange)
+				deleted = total - added
+			} else {
+				deleted = scaleLinear(deleted, graphWidth, maxChange)
+				added = total - deleted
+			}
+		}
+		line := fmt.Sprintf(" %-*s | %*d", nameWidth, name, numberWidth, stat.added+stat.deleted)
+		if added+deleted > 0 {
+			line += " " + colorize(colors.reset != "", colors.new, strings.Repeat("+", added)) + colorize(colors.reset != "", colors.old, strings.Repeat("-", deleted))
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, diffStatSummary(len(stats), insertions, deletions))
+}
+
+func plural(count int, singular string, pluralForm string) string {
+	if count == 1 {
+		return singular
+	}
+	return pluralForm
+}
+
+// diffStatSummary is the " N files changed, X insertions(+), Y deletions(-)"
+// line; a side with no changes is left out unless both are empty
+func diffStatSummary(files int, insertions int, deletions int) string {
+	summary := fmt.Sprintf(" %d %s changed", files, plural(files, "file", "files"))
+	if insertions > 0 || deletions == 0 {
+		summary += fmt.Sprintf(", %d %s(+)", insertions, plural(insertions, "insertion", "insertions"))
+	}
+	if deletions > 0 || insertions == 0 {
+		summary += fmt.Sprintf(", %d %s(-)", deletions, plural(deletions, "deletion", "deletions"))
+	}
+	return summary
+}
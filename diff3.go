@@ -0,0 +1,280 @@
+package main
+
+import (
+	"strings"
+)
+
+// mergeLabels name the sides of a merge in the conflict markers: ours
+// after "<<<<<<<", theirs after ">>>>>>>" and, in the diff3 style, the
+// base after "|||||||"
+type mergeLabels struct {
+	base   string
+	ours   string
+	theirs string
+}
+
+// conflictMarkerSize is how many characters each conflict marker has
+const conflictMarkerSize = 7
+
+// lineChange is a run of lines of the old side of a diff replaced by a
+// run of lines of the new side, either of them possibly empty
+type lineChange struct {
+	oldStart, oldCount int
+	newStart, newCount int
+}
+
+// changes lists the runs of changed lines of the diff, in order
+func (diff *lineDiff) changes() []lineChange {
+	changes := make([]lineChange, 0)
+	i, j := 0, 0
+	for i < len(diff.old) || j < len(diff.new) {
+		if (i >= len(diff.old) || !diff.deleted[i]) && (j >= len(diff.new) || !diff.inserted[j]) {
+			i++
+			j++
+			continue
+		}
+		change := lineChange{oldStart: i, newStart: j}
+		for i < len(diff.old) && diff.deleted[i] {
+			i++
+		}
+		for j < len(diff.new) && diff.inserted[j] {
+			j++
+		}
+		change.oldCount, change.newCount = i-change.oldStart, j-change.newStart
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// what a merge region takes, as xdiff numbers it
+const (
+	mergeConflict  = 0 // both sides changed the lines differently
+	mergeOurs      = 1 // only ours changed them
+	mergeTheirs    = 2 // only theirs changed them
+	mergeIdentical = 4 // both made the same change, found when refining a conflict
+)
+
+// mergeRegion is a stretch of lines a three-way merge has to settle, with
+// where it is in the base, in ours and in theirs
+type mergeRegion struct {
+	mode                     int
+	baseStart, baseCount     int
+	oursStart, oursCount     int
+	theirsStart, theirsCount int
+}
+
+// appendMergeRegion adds a region after the last one, the two becoming one
+// conflict when they touch and came from different sides
+func appendMergeRegion(regions []mergeRegion, region mergeRegion) []mergeRegion {
+	if len(regions) > 0 {
+		last := &regions[len(regions)-1]
+		if region.oursStart <= last.oursStart+last.oursCount || region.theirsStart <= last.theirsStart+last.theirsCount {
+			if region.mode != last.mode {
+				last.mode = mergeConflict
+			}
+			last.baseCount = region.baseStart + region.baseCount - last.baseStart
+			last.oursCount = region.oursStart + region.oursCount - last.oursStart
+			last.theirsCount = region.theirsStart + region.theirsCount - last.theirsStart
+			return regions
+		}
+	}
+	return append(regions, region)
+}
+
+// mergeLines finds the regions of a three-way merge of lines the way
+// xdiff's xdl_merge does: changes of one side only are taken, the same
+// change on both sides is taken once, and changes that overlap or touch
+// conflict. With refine, as in git's default merge style, a conflict is
+// cut down to the lines where the two sides still differ and conflicts
+// at most three lines apart are joined again.
+func mergeLines(base []string, ours []string, theirs []string, refine bool) []mergeRegion {
+	oursChanges := diffSequences(base, ours, false).changes()
+	theirsChanges := diffSequences(base, theirs, false).changes()
+	regions := make([]mergeRegion, 0)
+	for len(oursChanges) > 0 && len(theirsChanges) > 0 {
+		our, their := oursChanges[0], theirsChanges[0]
+		switch {
+		case our.oldStart+our.oldCount < their.oldStart:
+			regions = appendMergeRegion(regions, mergeRegion{
+				mode:      mergeOurs,
+				baseStart: our.oldStart, baseCount: our.oldCount,
+				oursStart: our.newStart, oursCount: our.newCount,
+				theirsStart: their.newStart - their.oldStart + our.oldStart, theirsCount: our.oldCount,
+			})
+			oursChanges = oursChanges[1:]
+			continue
+		case their.oldStart+their.oldCount < our.oldStart:
+			regions = appendMergeRegion(regions, mergeRegion{
+				mode:      mergeTheirs,
+				baseStart: their.oldStart, baseCount: their.oldCount,
+				oursStart: our.newStart - our.oldStart + their.oldStart, oursCount: their.oldCount,
+				theirsStart: their.newStart, theirsCount: their.newCount,
+			})
+			theirsChanges = theirsChanges[1:]
+			continue
+		}
+		if our.oldStart != their.oldStart || our.oldCount != their.oldCount || our.newCount != their.newCount ||
+			!equalLines(ours[our.newStart:our.newStart+our.newCount], theirs[their.newStart:their.newStart+their.newCount]) {
+			// the conflict spans both changes, each side taking the base
+			// lines the other changed
+			region := mergeRegion{mode: mergeConflict, baseStart: our.oldStart, oursStart: our.newStart, theirsStart: their.newStart}
+			if offset := our.oldStart - their.oldStart; offset > 0 {
+				region.baseStart -= offset
+				region.oursStart -= offset
+			} else {
+				region.theirsStart += offset
+			}
+			region.baseCount = our.oldStart + our.oldCount - region.baseStart
+			region.oursCount = our.newStart + our.newCount - region.oursStart
+			region.theirsCount = their.newStart + their.newCount - region.theirsStart
+			if offset := our.oldStart + our.oldCount - their.oldStart - their.oldCount; offset < 0 {
+				region.baseCount -= offset
+				region.oursCount -= offset
+			} else {
+				region.theirsCount += offset
+			}
+			regions = appendMergeRegion(regions, region)
+		}
+		ourEnd, theirEnd := our.oldStart+our.oldCount, their.oldStart+their.oldCount
+		if ourEnd >= theirEnd {
+			theirsChanges = theirsChanges[1:]
+		}
+		if theirEnd >= ourEnd {
+			oursChanges = oursChanges[1:]
+		}
+	}
+	for _, our := range oursChanges {
+		regions = appendMergeRegion(regions, mergeRegion{
+			mode:      mergeOurs,
+			baseStart: our.oldStart, baseCount: our.oldCount,
+			oursStart: our.newStart, oursCount: our.newCount,
+			theirsStart: our.oldStart + len(theirs) - len(base), theirsCount: our.oldCount,
+		})
+	}
+	for _, their := range theirsChanges {
+		regions = appendMergeRegion(regions, mergeRegion{
+			mode:      mergeTheirs,
+			baseStart: their.oldStart, baseCount: their.oldCount,
+			oursStart: their.oldStart + len(ours) - len(base), oursCount: their.oldCount,
+			theirsStart: their.newStart, theirsCount: their.newCount,
+		})
+	}
+	if refine {
+		regions = joinNearbyConflicts(refineConflicts(regions, ours, theirs))
+	}
+	return regions
+}
+
+// refineConflicts diffs the two sides of each conflict, which keeps
+// conflicting only where they differ; sides that turn out the same are
+// no conflict at all
+func refineConflicts(regions []mergeRegion, ours []string, theirs []string) []mergeRegion {
+	refined := make([]mergeRegion, 0, len(regions))
+	for _, region := range regions {
+		if region.mode != mergeConflict || region.oursCount == 0 || region.theirsCount == 0 {
+			refined = append(refined, region)
+			continue
+		}
+		changes := diffSequences(ours[region.oursStart:region.oursStart+region.oursCount], theirs[region.theirsStart:region.theirsStart+region.theirsCount], false).changes()
+		if len(changes) == 0 {
+			region.mode = mergeIdentical
+			refined = append(refined, region)
+			continue
+		}
+		for i, change := range changes {
+			part := mergeRegion{
+				mode:      mergeConflict,
+				oursStart: region.oursStart + change.oldStart, oursCount: change.oldCount,
+				theirsStart: region.theirsStart + change.newStart, theirsCount: change.newCount,
+			}
+			if i == 0 {
+				part.baseStart, part.baseCount = region.baseStart, region.baseCount
+			}
+			refined = append(refined, part)
+		}
+	}
+	return refined
+}
+
+// joinNearbyConflicts makes one conflict of two with at most three lines
+// between them, which read better as one
+func joinNearbyConflicts(regions []mergeRegion) []mergeRegion {
+	joined := make([]mergeRegion, 0, len(regions))
+	for _, region := range regions {
+		if len(joined) > 0 {
+			last := &joined[len(joined)-1]
+			if last.mode == mergeConflict && region.mode == mergeConflict && region.oursStart-(last.oursStart+last.oursCount) <= 3 {
+				last.baseCount = region.baseStart + region.baseCount - last.baseStart
+				last.oursCount = region.oursStart + region.oursCount - last.oursStart
+				last.theirsCount = region.theirsStart + region.theirsCount - last.theirsStart
+				continue
+			}
+		}
+		joined = append(joined, region)
+	}
+	return joined
+}
+
+func equalLines(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeContents merges the changes from base to ours and from base to
+// theirs line by line. Conflicts are left between markers, with the base
+// in between in the diff3 style, and counted.
+func mergeContents(base []byte, ours []byte, theirs []byte, labels mergeLabels, diff3 bool) ([]byte, int) {
+	baseLines, oursLines, theirsLines := splitLines(base), splitLines(ours), splitLines(theirs)
+	var merged strings.Builder
+	writeLines := func(lines []string, completeLast bool) {
+		for _, line := range lines {
+			merged.WriteString(line)
+		}
+		if completeLast && len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			merged.WriteString("\n")
+		}
+	}
+	writeMarker := func(marker string, label string) {
+		merged.WriteString(strings.Repeat(marker, conflictMarkerSize))
+		if label != "" {
+			merged.WriteString(" " + label)
+		}
+		merged.WriteString("\n")
+	}
+	conflicts := 0
+	position := 0 // in ours, up to which the merge is written
+	for _, region := range mergeLines(baseLines, oursLines, theirsLines, !diff3) {
+		switch region.mode {
+		case mergeConflict:
+			conflicts++
+			writeLines(oursLines[position:region.oursStart], false)
+			writeMarker("<", labels.ours)
+			writeLines(oursLines[region.oursStart:region.oursStart+region.oursCount], true)
+			if diff3 {
+				writeMarker("|", labels.base)
+				writeLines(baseLines[region.baseStart:region.baseStart+region.baseCount], true)
+			}
+			writeMarker("=", "")
+			writeLines(theirsLines[region.theirsStart:region.theirsStart+region.theirsCount], true)
+			writeMarker(">", labels.theirs)
+		case mergeOurs:
+			writeLines(oursLines[position:region.oursStart+region.oursCount], false)
+		case mergeTheirs:
+			writeLines(oursLines[position:region.oursStart], false)
+			writeLines(theirsLines[region.theirsStart:region.theirsStart+region.theirsCount], false)
+		default:
+			// ours has it already
+			continue
+		}
+		position = region.oursStart + region.oursCount
+	}
+	writeLines(oursLines[position:], false)
+	return []byte(merged.String()), conflicts
+}
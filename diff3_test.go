@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestMergeContents checks line merges against what git makes of the
+// same files
+func TestMergeContents(t *testing.T) {
+	labels := mergeLabels{base: "base", ours: "ours", theirs: "theirs"}
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		diff3              bool
+		merged             string
+		conflicts          int
+	}{
+		{
+			name:   "nearby edits",
+			base:   "1\n2\n3\n4\n5\n",
+			ours:   "1\ntwo\n3\n4\n5\n",
+			theirs: "1\n2\n3\n4\nfive\n",
+			merged: "1\ntwo\n3\n4\nfive\n",
+		},
+		{
+			name:   "the same change on both sides",
+			base:   "a\nb\nc\n",
+			ours:   "a\nB\nc\n",
+			theirs: "a\nB\nc\n",
+			merged: "a\nB\nc\n",
+		},
+		{
+			name:   "additions at both ends",
+			base:   "a\nb\nc\n",
+			ours:   "start\na\nb\nc\n",
+			theirs: "a\nb\nc\nend\n",
+			merged: "start\na\nb\nc\nend\n",
+		},
+		{
+			name:      "changes of the same line",
+			base:      "a\nb\nc\n",
+			ours:      "a\nours\nc\n",
+			theirs:    "a\ntheirs\nc\n",
+			merged:    "a\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\nc\n",
+			conflicts: 1,
+		},
+		{
+			name:      "changes of adjacent lines",
+			base:      "a\nb\nc\nd\n",
+			ours:      "a\nB\nc\nd\n",
+			theirs:    "a\nb\nC\nd\n",
+			merged:    "a\n<<<<<<< ours\nB\nc\n=======\nb\nC\n>>>>>>> theirs\nd\n",
+			conflicts: 1,
+		},
+		{
+			name:      "common lines refined out of a conflict",
+			base:      "a\nb\nc\n",
+			ours:      "a\nx\nsame\ny\nc\n",
+			theirs:    "a\nz\nsame\nw\nc\n",
+			merged:    "a\n<<<<<<< ours\nx\nsame\ny\n=======\nz\nsame\nw\n>>>>>>> theirs\nc\n",
+			conflicts: 1,
+		},
+		{
+			name:      "refined conflicts far apart",
+			base:      "a\nb\nc\n",
+			ours:      "a\nx\n1\n2\n3\n4\ny\nc\n",
+			theirs:    "a\nz\n1\n2\n3\n4\nw\nc\n",
+			merged:    "a\n<<<<<<< ours\nx\n=======\nz\n>>>>>>> theirs\n1\n2\n3\n4\n<<<<<<< ours\ny\n=======\nw\n>>>>>>> theirs\nc\n",
+			conflicts: 2,
+		},
+		{
+			name:      "no final newline",
+			base:      "a\nb",
+			ours:      "a\nours",
+			theirs:    "a\ntheirs",
+			merged:    "a\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\n",
+			conflicts: 1,
+		},
+		{
+			name:      "diff3 style",
+			base:      "a\nb\nc\n",
+			ours:      "a\nours\nc\n",
+			theirs:    "a\ntheirs\nc\n",
+			diff3:     true,
+			merged:    "a\n<<<<<<< ours\nours\n||||||| base\nb\n=======\ntheirs\n>>>>>>> theirs\nc\n",
+			conflicts: 1,
+		},
+		{
+			name:      "added on both sides",
+			ours:      "ours\n",
+			theirs:    "theirs\n",
+			merged:    "<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\n",
+			conflicts: 1,
+		},
+	}
+	for _, test := range tests {
+		merged, conflicts := mergeContents([]byte(test.base), []byte(test.ours), []byte(test.theirs), labels, test.diff3)
+		if string(merged) != test.merged || conflicts != test.conflicts {
+			t.Errorf("%s: merged to %q with %d conflicts, want %q with %d", test.name, merged, conflicts, test.merged, test.conflicts)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+type diffCommandOptions struct {
+	patch     diffOptions
+	cached    bool   // compare the index instead of the worktree
+	output    string // "patch", "stat", "name-only", "name-status" or "check"
+	exitCode  bool
+	quiet     bool
+	pathspecs []pathspec
+	revisions []string    // at most two, the worktree or index being the other side of one
+	printer   pathPrinter // for --name-only and --name-status
+}
+
+// parseWhitespaceHighlight reads a --ws-error-highlight value into the ops
+// of the lines whose whitespace problems are highlighted
+func parseWhitespaceHighlight(value string) string {
+	highlight := ""
+	for _, kind := range strings.Split(value, ",") {
+		switch strings.TrimSpace(kind) {
+		case "old":
+			highlight += "-"
+		case "new":
+			highlight += "+"
+		case "context":
+			highlight += " "
+		case "all":
+			highlight = "-+ "
+		case "default":
+			highlight = "+"
+		case "none":
+			highlight = ""
+		default:
+			log.Fatalf("fatal: unknown value after ws-error-highlight=%s", kind)
+		}
+	}
+	return highlight
+}
+
+// indexChangesSince compares a tree against the index, entries with conflict
+// stages and intent-to-add ones being left out
+func (repo *Repository) indexChangesSince(tree string, index *gitIndex) []fileChange {
+	treeEntries := repo.flattenTree(tree)
+	changes := make([]fileChange, 0)
+	for _, entry := range index.entries {
+		if entry.stage() != 0 || entry.intentToAdd() {
+			continue
+		}
+		change := fileChange{path: entry.path, newMode: entry.mode, newHash: entry.hash}
+		if treeEntry, ok := treeEntries[entry.path]; ok {
+			change.oldMode, change.oldHash = parseFileMode(treeEntry.mode), treeEntry.hash
+			if change.oldMode == change.newMode && change.oldHash == change.newHash {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	for treePath, treeEntry := range treeEntries {
+		if _, ok := index.find(treePath); !ok {
+			changes = append(changes, fileChange{path: treePath, oldMode: parseFileMode(treeEntry.mode), oldHash: treeEntry.hash})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	return changes
+}
+
+// worktreeSide fills in the new side of a change from the worktree file
+// at its path, leaving it deleted when the file is gone
+func (repo *Repository) worktreeSide(change fileChange) fileChange {
+	change.newMode, change.newHash, change.worktree = 0, "", true
+	info, err := os.Lstat(repo.worktreePath(change.path))
+	if os.IsNotExist(err) || isNotDirectoryError(err) {
+		return change
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	change.newMode = repo.worktreeModes().entryMode(info, change.oldMode)
+	if change.newMode == fileModeGitlink {
+		// a submodule is compared by the commit it has checked out
+		change.newHash = change.oldHash
+		if state := repo.submoduleState(change.path, change.oldHash); state.head != "" {
+			change.newHash, change.dirty = state.head, state.modified
+		} else if change.oldMode != fileModeGitlink {
+			change.newMode = change.oldMode
+		}
+		return change
+	}
+	change.newHash = repo.worktreeBlobHash(change.path, info)
+	return change
+}
+
+// worktreeChanges compares the index against the worktree. As in git,
+// untracked files in a submodule do not make it differ, and the file of an
+// intent-to-add entry shows up as added.
+func (repo *Repository) worktreeChanges(index *gitIndex) []fileChange {
+	changes := make([]fileChange, 0)
+	for _, entry := range index.entries {
+		if entry.stage() != 0 || entry.ignoresWorktree() {
+			continue
+		}
+		if entry.mode == fileModeGitlink {
+			change := repo.worktreeSide(fileChange{path: entry.path, oldMode: entry.mode, oldHash: entry.hash})
+			if change.newMode != entry.mode || change.newHash != entry.hash || change.dirty {
+				changes = append(changes, change)
+			}
+			continue
+		}
+		if change, changed := repo.worktreeChange(index, entry); changed {
+			if change.label == "new file" {
+				changes = append(changes, repo.worktreeSide(fileChange{path: entry.path}))
+				continue
+			}
+			changes = append(changes, repo.worktreeSide(fileChange{path: entry.path, oldMode: entry.mode, oldHash: entry.hash}))
+		}
+	}
+	return changes
+}
+
+// worktreeChangesSince compares a tree against the worktree files of the
+// paths in the tree or the index
+func (repo *Repository) worktreeChangesSince(tree string, index *gitIndex) []fileChange {
+	treeEntries := repo.flattenTree(tree)
+	paths := make(map[string]bool)
+	for treePath := range treeEntries {
+		paths[treePath] = true
+	}
+	for _, entry := range index.entries {
+		if entry.stage() == 0 {
+			paths[entry.path] = true
+		}
+	}
+	changes := make([]fileChange, 0)
+	for changePath := range paths {
+		change := fileChange{path: changePath}
+		if treeEntry, ok := treeEntries[changePath]; ok {
+			change.oldMode, change.oldHash = parseFileMode(treeEntry.mode), treeEntry.hash
+		}
+		if position, tracked := index.find(changePath); tracked && index.entries[position].ignoresWorktree() {
+			// the index stands in for the worktree file
+			change.newMode, change.newHash = index.entries[position].mode, index.entries[position].hash
+		} else if tracked {
+			change = repo.worktreeSide(change)
+		} else {
+			change.worktree = true
+		}
+		if change.oldMode != change.newMode || change.oldHash != change.newHash || change.dirty {
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	return changes
+}
+
+// diffCommandChanges picks the sides to compare after the revisions given:
+// none compares the index against the worktree, or HEAD against the index
+// with --cached; one compares that commit instead; two compare commits
+func (repo *Repository) diffCommandChanges(options diffCommandOptions) ([]fileChange, []string) {
+	var changes []fileChange
+	unmerged := make([]string, 0)
+	switch len(options.revisions) {
+	case 2:
+		changes = repo.diffTrees(repo.resolveTreeish(options.revisions[0]), repo.resolveTreeish(options.revisions[1]))
+	default:
+		index := repo.readIndex()
+		for _, change := range unmergedChanges(index) {
+			unmerged = append(unmerged, change.path)
+		}
+		tree := ""
+		if len(options.revisions) == 1 {
+			tree = repo.resolveTreeish(options.revisions[0])
+		} else if options.cached {
+			if head, ok := repo.resolveRef("HEAD"); ok {
+				tree = repo.readCommitObject(head).tree
+			}
+		}
+		switch {
+		case options.cached:
+			changes = repo.indexChangesSince(tree, index)
+		case len(options.revisions) == 1:
+			changes = repo.worktreeChangesSince(tree, index)
+		default:
+			changes = repo.worktreeChanges(index)
+		}
+	}
+	selected := make([]fileChange, 0, len(changes))
+	for _, change := range changes {
+		if matchesPathspecs(change.path, options.pathspecs) {
+			selected = append(selected, change)
+		}
+	}
+	selectedUnmerged := make([]string, 0, len(unmerged))
+	for _, unmergedPath := range unmerged {
+		if matchesPathspecs(unmergedPath, options.pathspecs) {
+			selectedUnmerged = append(selectedUnmerged, unmergedPath)
+		}
+	}
+	return selected, selectedUnmerged
+}
+
+// diff shows the changes between the sides options select and returns
+// the exit code: 1 for changes with --exit-code, 2 for whitespace
+// problems with --check
+func (repo *Repository) diff(w io.Writer, options diffCommandOptions) int {
+	changes, unmerged := repo.diffCommandChanges(options)
+	status := 0
+	if options.exitCode && len(changes)+len(unmerged) > 0 {
+		status = 1
+	}
+	if options.quiet {
+		return status
+	}
+	switch options.output {
+	case "name-only", "name-status":
+		writeChangeNames(changes, unmerged, options)
+	case "stat":
+		if jsonOutput {
+			printJSON(repo.diffStatJSON(changes))
+			break
+		}
+		if len(changes) == 0 {
+			break
+		}
+		stats := make([]fileStat, len(changes))
+		for i, change := range changes {
+			stats[i] = repo.diffStat(change)
+		}
+		writeDiffStat(w, stats, 80, options.patch.colors)
+	case "check":
+		writeUnmergedPaths(w, unmerged)
+		for _, change := range changes {
+			if repo.checkChange(w, change, options.patch) {
+				status |= 2
+			}
+		}
+	default:
+		writeUnmergedPaths(w, unmerged)
+		for _, change := range changes {
+			repo.writePatch(w, change, options.patch)
+		}
+	}
+	return status
+}
+
+type jsonFileStat struct {
+	Path    string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"`
+	Status  string `json:"status"`
+	Added   int    `json:"added"`
+	Deleted int    `json:"deleted"`
+	Binary  bool   `json:"binary,omitempty"`
+	OldSize *int   `json:"oldSize,omitempty"` // bytes, for binary files only
+	NewSize *int   `json:"newSize,omitempty"`
+}
+
+// diffStatJSON is what --json diff --stat prints, a stat per changed file
+func (repo *Repository) diffStatJSON(changes []fileChange) []jsonFileStat {
+	stats := make([]jsonFileStat, 0, len(changes))
+	for _, change := range changes {
+		stat := repo.diffStat(change)
+		entry := jsonFileStat{
+			Path:    change.path,
+			OldPath: change.oldPath,
+			Status:  string(change.status()),
+			Added:   stat.added,
+			Deleted: stat.deleted,
+			Binary:  stat.binary,
+		}
+		if stat.binary {
+			entry.OldSize, entry.NewSize = &stat.oldSize, &stat.newSize
+		}
+		stats = append(stats, entry)
+	}
+	return stats
+}
+
+func writeUnmergedPaths(w io.Writer, unmerged []string) {
+	for _, unmergedPath := range unmerged {
+		fmt.Fprintf(w, "* Unmerged path %s\n", quotePath(unmergedPath))
+	}
+}
+
+// writeChangeNames lists the changed paths for --name-only and
+// --name-status, unmerged paths among them with status "U"
+func writeChangeNames(changes []fileChange, unmerged []string, options diffCommandOptions) {
+	statuses := make(map[string]byte)
+	paths := make([]string, 0, len(changes)+len(unmerged))
+	for _, change := range changes {
+		statuses[change.path] = change.status()
+		paths = append(paths, change.path)
+	}
+	for _, unmergedPath := range unmerged {
+		statuses[unmergedPath] = 'U'
+		paths = append(paths, unmergedPath)
+	}
+	sort.Strings(paths)
+	for _, changePath := range paths {
+		switch {
+		case options.output == "name-only":
+			options.printer.printRecord(options.printer.path(changePath))
+		case options.printer.nulTerminated:
+			options.printer.printRecord(string(statuses[changePath]))
+			options.printer.printRecord(changePath)
+		default:
+			options.printer.printRecord(fmt.Sprintf("%c\t%s", statuses[changePath], quotePath(changePath)))
+		}
+	}
+}
+
+// checkChange reports the whitespace problems and leftover conflict
+// markers the lines a change adds have, as "git diff --check" does, and
+// tells whether it found any
+func (repo *Repository) checkChange(w io.Writer, change fileChange, options diffOptions) bool {
+	if change.newMode == 0 || change.newMode == fileModeGitlink {
+		return false
+	}
+	if change.status() == 'T' {
+		change.oldMode, change.oldHash = 0, ""
+	}
+	oldContent, newContent := repo.changeContents(change)
+	if repo.isBinaryDiff(change.path, oldContent, newContent) {
+		return false
+	}
+	colors := options.colors
+	oldLines, newLines := splitLines(oldContent), splitLines(newContent)
+	found := false
+	for _, hunk := range diffLines(oldLines, newLines).hunks(0) {
+		line := hunk.newStart
+		if hunk.newCount == 0 {
+			continue
+		}
+		for _, diffLine := range hunk.lines {
+			if diffLine.op != '+' {
+				continue
+			}
+			if isConflictMarker(diffLine.text) {
+				found = true
+				fmt.Fprintf(w, "%s:%d: leftover conflict marker\n", change.path, line)
+			}
+			problems := checkWhitespace(diffLine.text, options.whitespace, nil, "", "", "")
+			if problems != 0 {
+				found = true
+				fmt.Fprintf(w, "%s:%d: %s.\n", change.path, line, whitespaceErrorString(problems))
+				fmt.Fprintf(w, "%s+%s", colors.new, colors.reset)
+				checkWhitespace(diffLine.text, options.whitespace, w, colors.new, colors.reset, colors.whitespace)
+				if !strings.HasSuffix(diffLine.text, "\n") {
+					fmt.Fprintln(w)
+				}
+			}
+			line++
+		}
+	}
+	if options.whitespace&whitespaceBlankAtEOF != 0 {
+		if _, blankLine := blankLinesAtEOF(oldLines, newLines); blankLine != 0 {
+			found = true
+			fmt.Fprintf(w, "%s:%d: %s.\n", change.path, blankLine, whitespaceErrorString(whitespaceBlankAtEOF))
+		}
+	}
+	return found
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// diffDriver returns the driver the diff attribute of a path names, empty
+// when it is set, unset or not given
+func (repo *Repository) diffDriver(path string) string {
+	switch driver := repo.pathAttributes(path)["diff"]; driver {
+	case "true", "false":
+		return ""
+	default:
+		return driver
+	}
+}
+
+// textconvRef is where the converted text of blobs is cached for a driver
+// with diff.<driver>.cachetextconv, as notes on the blobs
+func textconvRef(driver string) string {
+	return "refs/notes/textconv/" + driver
+}
+
+// textconvDriver returns the diff driver of a path and the
+// diff.<driver>.textconv command converting its contents for diffs, ok
+// being false when there is none
+func (repo *Repository) textconvDriver(path string) (string, string, bool) {
+	driver := repo.diffDriver(path)
+	if driver == "" {
+		return "", "", false
+	}
+	command, ok := repo.config.get("diff." + driver + ".textconv")
+	return driver, command, ok && command != ""
+}
+
+// convertText runs the textconv command of a driver on one side of a
+// diff. With diff.<driver>.cachetextconv the text of a blob is kept in the
+// notes of textconvRef; like git, the notes commit carries the command so
+// that changing it drops what was cached.
+func (repo *Repository) convertText(driver string, command string, filePath string, hash string, content []byte) []byte {
+	cache := hash != "" && repo.config.getBool("diff."+driver+".cachetextconv", false)
+	var notes map[string]string
+	if cache {
+		notes = repo.readTextconvCache(driver, command)
+		if blob, ok := notes[hash]; ok {
+			_, text := repo.readObject(blob)
+			return text
+		}
+	}
+	temporary := writeDiffTemporary(filePath, content)
+	defer removeDiffTemporary(temporary)
+	argv := []string{"sh", "-c", command + ` "$@"`, command, temporary}
+	traceRunCommand(argv)
+	process := exec.Command(argv[0], argv[1:]...)
+	process.Stderr = os.Stderr
+	text, err := process.Output()
+	if err != nil {
+		log.Fatal("fatal: unable to read files to diff")
+	}
+	if cache {
+		notes[hash] = repo.writeObject("blob", text)
+		entries := make([]treeEntry, 0, len(notes))
+		for object, blob := range notes {
+			entries = append(entries, treeEntry{mode: "100644", name: object, hash: blob})
+		}
+		tree := repo.writeObject("tree", serializeTree(entries))
+		repo.updateRef(textconvRef(driver), repo.createCommit(tree, nil, command))
+	}
+	return text
+}
+
+// readTextconvCache returns the cached conversions of a driver, none when
+// they were made by another command
+func (repo *Repository) readTextconvCache(driver string, command string) map[string]string {
+	if commitHash, ok := repo.resolveRef(textconvRef(driver)); ok {
+		if strings.TrimSpace(repo.readCommitObject(commitHash).commitMessage) == command {
+			return repo.readNotes(textconvRef(driver))
+		}
+	}
+	return make(map[string]string)
+}
+
+// writeDiffTemporary writes content to a temporary file for commands that
+// diff or convert files. As in git, it gets a directory of its own so that
+// it keeps the name of the path it comes from.
+func writeDiffTemporary(filePath string, content []byte) string {
+	dir, err := os.MkdirTemp("", "git-blob-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	temporary := filepath.Join(dir, path.Base(filePath))
+	if err := os.WriteFile(temporary, content, 0600); err != nil {
+		log.Fatal(err)
+	}
+	return temporary
+}
+
+func removeDiffTemporary(temporary string) {
+	os.RemoveAll(filepath.Dir(temporary))
+}
+
+// externalDiffCommand returns the command that diffs a path in place of
+// the built-in diff: GIT_EXTERNAL_DIFF, diff.external, then the
+// diff.<driver>.command of its diff driver
+func (repo *Repository) externalDiffCommand(path string) string {
+	if command := os.Getenv("GIT_EXTERNAL_DIFF"); command != "" {
+		return command
+	}
+	if command, ok := repo.config.get("diff.external"); ok && command != "" {
+		return command
+	}
+	if driver := repo.diffDriver(path); driver != "" {
+		command, _ := repo.config.get("diff." + driver + ".command")
+		return command
+	}
+	return ""
+}
+
+// runExternalDiff runs an external diff command on a change the way git
+// does, from the top of the worktree with seven arguments: the path, then
+// the file, object name and mode of the old and the new side. A missing
+// side is /dev/null with "." for name and mode, a worktree file is given
+// as it is with a null object name.
+func (repo *Repository) runExternalDiff(w io.Writer, command string, change fileChange) {
+	oldContent, newContent := repo.changeContents(change)
+	args := []string{change.path}
+	temporaries := make([]string, 0, 2)
+	side := func(mode uint32, hash string, content []byte, worktree bool) {
+		switch {
+		case mode == 0:
+			args = append(args, "/dev/null", ".", ".")
+		case worktree:
+			args = append(args, change.path, strings.Repeat("0", 2*ObjectShaLength), fmt.Sprintf("%06o", mode))
+		default:
+			temporary := writeDiffTemporary(change.path, content)
+			temporaries = append(temporaries, temporary)
+			args = append(args, temporary, hash, fmt.Sprintf("%06o", mode))
+		}
+	}
+	side(change.oldMode, change.oldHash, oldContent, false)
+	side(change.newMode, change.newHash, newContent, change.worktree)
+	defer func() {
+		for _, temporary := range temporaries {
+			removeDiffTemporary(temporary)
+		}
+	}()
+	argv := append([]string{"sh", "-c", command + ` "$@"`, command}, args...)
+	traceRunCommand(argv)
+	process := exec.Command(argv[0], argv[1:]...)
+	process.Dir = repo.workTree
+	var output bytes.Buffer
+	process.Stdout, process.Stderr = &output, os.Stderr
+	err := process.Run()
+	w.Write(output.Bytes())
+	if err != nil {
+		log.Fatalf("fatal: external diff died, stopping at %s", change.path)
+	}
+}
+
+// convertChangeText converts both sides of a change with a textconv
+// command. Like git, only regular files are converted and a worktree file
+// is never cached.
+func (repo *Repository) convertChangeText(driver string, command string, change fileChange, oldContent []byte, newContent []byte) ([]byte, []byte) {
+	if change.oldMode&0170000 == 0100000 {
+		oldContent = repo.convertText(driver, command, change.path, change.oldHash, oldContent)
+	}
+	if change.newMode&0170000 == 0100000 {
+		newHash := change.newHash
+		if change.worktree {
+			newHash = ""
+		}
+		newContent = repo.convertText(driver, command, change.path, newHash, newContent)
+	}
+	return oldContent, newContent
+}
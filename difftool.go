@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type difftoolOptions struct {
+	tool          string // defaults to diff.tool, then merge.tool
+	extcmd        string // a command run with the two sides as arguments instead of a tool
+	prompt        bool   // ask before starting the tool on each file
+	dirDiff       bool   // run the tool once on two trees holding both sides of all files
+	symlinks      bool   // put the worktree files in the trees as symlinks rather than copies
+	trustExitCode bool   // stop at the first file the tool fails on
+	diff          diffCommandOptions
+}
+
+// difftoolCommand returns the command of the diff tool, the cmd of its
+// difftool section or else of its mergetool one, and the name to show
+func (repo *Repository) difftoolCommand(options difftoolOptions) (string, string) {
+	if options.extcmd != "" {
+		return options.extcmd + ` "$LOCAL" "$REMOTE"`, options.extcmd
+	}
+	tool := options.tool
+	if tool == "" {
+		tool, _ = repo.config.get("diff.tool")
+	}
+	if tool == "" {
+		tool, _ = repo.config.get("merge.tool")
+	}
+	if tool == "" {
+		log.Fatal("fatal: diff.tool is not configured, set it or use --tool=<tool>")
+	}
+	if command, ok := repo.config.get("difftool." + tool + ".cmd"); ok {
+		return command, tool
+	}
+	if command, ok := repo.config.get("mergetool." + tool + ".cmd"); ok {
+		return command, tool
+	}
+	log.Fatalf("fatal: unknown diff tool '%s', difftool.%s.cmd is not set", tool, tool)
+	return "", ""
+}
+
+// difftool runs the diff tool on the changes between the sides the diff
+// options select, file by file or, with dirDiff, once on two trees of
+// them. It returns the exit code: that of a failing tool when its exit
+// code is trusted, for dirDiff always.
+func (repo *Repository) difftool(options difftoolOptions) int {
+	command, name := repo.difftoolCommand(options)
+	changes, _ := repo.diffCommandChanges(options.diff)
+	if options.dirDiff {
+		return repo.difftoolDirDiff(command, changes, options)
+	}
+	answers := bufio.NewReader(os.Stdin)
+	for i, change := range changes {
+		if options.prompt {
+			fmt.Printf("\nViewing (%d/%d): '%s'\n", i+1, len(changes), change.path)
+			fmt.Printf("Launch '%s' [Y/n]? ", name)
+			answer, err := answers.ReadString('\n')
+			if err != nil && answer == "" || strings.TrimSpace(answer) == "n" {
+				continue
+			}
+		}
+		if status := repo.runDiffTool(command, change); status != 0 && options.trustExitCode {
+			return status
+		}
+	}
+	return 0
+}
+
+// runDiffTool runs the tool on one change with LOCAL naming a temporary
+// copy of the old side and REMOTE one of the new side, or the worktree
+// file itself, /dev/null for a missing side, and MERGED and BASE the path
+func (repo *Repository) runDiffTool(command string, change fileChange) int {
+	oldContent, newContent := repo.changeContents(change)
+	temporaries := make([]string, 0, 2)
+	side := func(mode uint32, content []byte, worktree bool) string {
+		switch {
+		case mode == 0:
+			return "/dev/null"
+		case worktree:
+			return change.path
+		}
+		temporary := writeDiffTemporary(change.path, content)
+		temporaries = append(temporaries, temporary)
+		return temporary
+	}
+	local := side(change.oldMode, oldContent, false)
+	remote := side(change.newMode, newContent, change.worktree)
+	defer func() {
+		for _, temporary := range temporaries {
+			removeDiffTemporary(temporary)
+		}
+	}()
+	return runDiffToolCommand(command, map[string]string{"LOCAL": local, "REMOTE": remote, "MERGED": change.path, "BASE": change.path})
+}
+
+func runDiffToolCommand(command string, sides map[string]string) int {
+	argv := []string{"sh", "-c", command}
+	traceRunCommand(argv)
+	process := exec.Command(argv[0], argv[1:]...)
+	process.Stdin, process.Stdout, process.Stderr = os.Stdin, os.Stdout, os.Stderr
+	process.Env = os.Environ()
+	for _, variable := range []string{"LOCAL", "REMOTE", "MERGED", "BASE"} {
+		process.Env = append(process.Env, variable+"="+sides[variable])
+	}
+	err := process.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
+
+// difftoolDirDiff writes the old sides of the changed files to a "left"
+// tree and their new sides to a "right" one, both in a temporary
+// directory, and runs the tool once on the two. Worktree files go into the
+// right tree as symlinks to them, so that the tool edits them in place, or
+// without symlinks as copies, the edits to which are copied back to the
+// worktree when it is done.
+func (repo *Repository) difftoolDirDiff(command string, changes []fileChange, options difftoolOptions) int {
+	if len(changes) == 0 {
+		return 0
+	}
+	dir, err := os.MkdirTemp("", "git-difftool.")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	left, right := filepath.Join(dir, "left"), filepath.Join(dir, "right")
+	copies := make(map[string][]byte) // worktree files copied into the right tree
+	for _, change := range changes {
+		oldContent, newContent := repo.changeContents(change)
+		writeDirDiffFile(filepath.Join(left, change.path), change.oldMode, oldContent)
+		rightPath := filepath.Join(right, change.path)
+		switch {
+		case change.worktree && change.newMode != 0 && options.symlinks:
+			makeParentDirectories(rightPath)
+			if err := os.Symlink(repo.worktreePath(change.path), rightPath); err != nil {
+				log.Fatal(err)
+			}
+		case change.worktree && change.newMode != 0:
+			content, err := os.ReadFile(repo.worktreePath(change.path))
+			if err != nil {
+				log.Fatal(err)
+			}
+			writeDirDiffFile(rightPath, change.newMode, content)
+			copies[change.path] = content
+		default:
+			writeDirDiffFile(rightPath, change.newMode, newContent)
+		}
+	}
+	for _, side := range []string{left, right} {
+		if err := os.MkdirAll(side, 0777); err != nil {
+			log.Fatal(err)
+		}
+	}
+	status := runDiffToolCommand(command, map[string]string{"LOCAL": left, "REMOTE": right, "MERGED": right, "BASE": right})
+	for copiedPath, copied := range copies {
+		edited, err := os.ReadFile(filepath.Join(right, copiedPath))
+		if err != nil || bytes.Equal(edited, copied) {
+			continue
+		}
+		current, err := os.ReadFile(repo.worktreePath(copiedPath))
+		if err != nil || !bytes.Equal(current, copied) {
+			// like git, edits made in both places are not merged
+			fmt.Fprintf(os.Stderr, "warning: both files modified: '%s' and '%s'.\n", repo.worktreePath(copiedPath), filepath.Join(right, copiedPath))
+			fmt.Fprintln(os.Stderr, "warning: working tree file has been left.")
+			continue
+		}
+		if err := os.WriteFile(repo.worktreePath(copiedPath), edited, 0666); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return status
+}
+
+// writeDirDiffFile writes a side of a change into a dir-diff tree as the
+// mode says, a symlink as a symlink, nothing for a missing side
+func writeDirDiffFile(filePath string, mode uint32, content []byte) {
+	if mode == 0 {
+		return
+	}
+	makeParentDirectories(filePath)
+	var err error
+	switch mode {
+	case fileModeSymlink:
+		err = os.Symlink(string(content), filePath)
+	case fileModeExecutable:
+		err = os.WriteFile(filePath, content, 0777)
+	default:
+		err = os.WriteFile(filePath, content, 0666)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func makeParentDirectories(filePath string) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// editorCommand returns the editor to run, looked up like git does in
+// GIT_EDITOR, core.editor, VISUAL and EDITOR. VISUAL is ignored and vi is
+// no fallback on a dumb terminal.
+func (repo *Repository) editorCommand() string {
+	if editor, ok := os.LookupEnv("GIT_EDITOR"); ok {
+		return editor
+	}
+	if editor, ok := repo.config.get("core.editor"); ok {
+		return editor
+	}
+	isDumb := os.Getenv("TERM") == "" || os.Getenv("TERM") == "dumb"
+	if editor, ok := os.LookupEnv("VISUAL"); ok && !isDumb {
+		return editor
+	}
+	if editor, ok := os.LookupEnv("EDITOR"); ok {
+		return editor
+	}
+	if isDumb {
+		log.Fatal("error: Terminal is dumb, but EDITOR unset")
+	}
+	return "vi"
+}
+
+// launchEditor lets the user edit the file at path. The editor runs
+// through the shell so that core.editor may carry arguments.
+func (repo *Repository) launchEditor(path string) error {
+	editor := repo.editorCommand()
+	if editor == ":" {
+		return nil
+	}
+	argv := []string{"sh", "-c", editor + ` "$@"`, editor, path}
+	traceRunCommand(argv)
+	process := exec.Command(argv[0], argv[1:]...)
+	process.Stdin, process.Stdout, process.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := process.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s'", editor)
+	}
+	return nil
+}
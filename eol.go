@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// textConversion is how the line endings of a path are converted between
+// the repository, which keeps LF, and the worktree
+type textConversion struct {
+	text bool // the path is text, or with auto it is when it does not look binary
+	auto bool
+	crlf bool // LF is written to the worktree as CRLF
+}
+
+// textConversionOf works out the conversion of a path from its text and
+// eol attributes, then core.autocrlf and core.eol. Like git, a path without
+// a text attribute is only converted when core.autocrlf is set.
+func (repo *Repository) textConversionOf(relativePath string) textConversion {
+	attributes := repo.pathAttributes(relativePath)
+	// core.autocrlf is a boolean or "input"
+	autocrlf, _ := repo.config.get("core.autocrlf")
+	input := strings.EqualFold(autocrlf, "input")
+	crlf := !input && repo.config.getBool("core.autocrlf", false)
+	conversion := textConversion{}
+	switch attributes["text"] {
+	case "true":
+		conversion.text = true
+	case "false":
+		return conversion
+	case "auto":
+		conversion.text, conversion.auto = true, true
+	default:
+		if _, ok := attributes["eol"]; ok {
+			conversion.text = true
+		} else if input || crlf {
+			conversion.text, conversion.auto = true, true
+		}
+	}
+	switch attributes["eol"] {
+	case "crlf":
+		conversion.crlf = true
+	case "lf":
+	default:
+		switch {
+		case crlf:
+			conversion.crlf = true
+		case input:
+		default:
+			eol, _ := repo.config.get("core.eol")
+			conversion.crlf = eol == "crlf" || (eol == "" || eol == "native") && runtime.GOOS == "windows"
+		}
+	}
+	return conversion
+}
+
+// looksBinary is what auto takes for binary: a NUL byte or a CR that does
+// not end a line
+func looksBinary(content []byte) bool {
+	if isBinaryContent(content) {
+		return true
+	}
+	for i, c := range content {
+		if c == '\r' && (i+1 == len(content) || content[i+1] != '\n') {
+			return true
+		}
+	}
+	return false
+}
+
+// convertToGit turns the content of a worktree file into what is stored
+// in its blob: through the clean filter, then with CRLF line endings
+// turned into LF
+func (repo *Repository) convertToGit(relativePath string, content []byte) []byte {
+	content = repo.applyFilter(relativePath, "clean", content)
+	conversion := repo.textConversionOf(relativePath)
+	if !conversion.text || conversion.auto && looksBinary(content) || !bytes.Contains(content, []byte("\r\n")) {
+		return content
+	}
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+}
+
+// lineEndingWarning tells, unless core.safecrlf is off, when the line
+// endings of a worktree file change once it is checked out again after
+// being staged; "" when they stay as they are
+func (repo *Repository) lineEndingWarning(relativePath string, content []byte) string {
+	if safecrlf, ok := repo.config.get("core.safecrlf"); ok && !strings.EqualFold(safecrlf, "warn") && !repo.config.getBool("core.safecrlf", true) {
+		return ""
+	}
+	conversion := repo.textConversionOf(relativePath)
+	if !conversion.text || conversion.auto && looksBinary(content) {
+		return ""
+	}
+	crlfCount := bytes.Count(content, []byte("\r\n"))
+	loneLFCount := bytes.Count(content, []byte("\n")) - crlfCount
+	switch {
+	case !conversion.crlf && crlfCount > 0:
+		return fmt.Sprintf("warning: in the working copy of '%s', CRLF will be replaced by LF the next time Git touches it", relativePath)
+	case conversion.crlf && loneLFCount > 0:
+		return fmt.Sprintf("warning: in the working copy of '%s', LF will be replaced by CRLF the next time Git touches it", relativePath)
+	}
+	return ""
+}
+
+// convertToWorktree turns the content of a blob into what is written to
+// the worktree, with LF line endings turned into CRLF where they are
+// wanted and then through the smudge filter. With auto a blob already
+// holding a CR was committed that way on purpose and is left alone.
+func (repo *Repository) convertToWorktree(relativePath string, content []byte) []byte {
+	conversion := repo.textConversionOf(relativePath)
+	if !conversion.text || !conversion.crlf || !bytes.Contains(content, []byte("\n")) {
+		return repo.applyFilter(relativePath, "smudge", content)
+	}
+	if conversion.auto && (isBinaryContent(content) || bytes.Contains(content, []byte("\r"))) {
+		return repo.applyFilter(relativePath, "smudge", content)
+	}
+	converted := make([]byte, 0, len(content)+bytes.Count(content, []byte("\n")))
+	for i, c := range content {
+		if c == '\n' && (i == 0 || content[i-1] != '\r') {
+			converted = append(converted, '\r')
+		}
+		converted = append(converted, c)
+	}
+	return repo.applyFilter(relativePath, "smudge", converted)
+}
+
+// worktreeBlob returns what gets stored in the blob of a worktree path:
+// its content with the line endings converted, or the link target for
+// symlinks
+func (repo *Repository) worktreeBlob(relativePath string, info os.FileInfo) []byte {
+	content := readWorktreeContent(repo.worktreePath(relativePath), info)
+	if info.Mode()&os.ModeSymlink != 0 {
+		return content
+	}
+	return repo.convertToGit(relativePath, content)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+)
+
+// EWAH compressed bitmaps as used by index extensions:
+// <4-byte bit count> <4-byte word count> <word count x 8-byte words>
+// <4-byte position of the last run-length word>
+// A run-length word holds the running bit (bit 0), the run length in
+// 64-bit words (bits 1-32) and the number of literal words that follow it
+// (bits 33-63).
+
+// readEwahBitmap returns the positions of all set bits and the position
+// after the bitmap
+func readEwahBitmap(data []byte, position int) ([]int, int) {
+	if position+8 > len(data) {
+		log.Fatal("fatal: index file corrupt: truncated ewah bitmap")
+	}
+	wordCount := int(binary.BigEndian.Uint32(data[position+4:]))
+	position += 8
+	if position+wordCount*8+4 > len(data) {
+		log.Fatal("fatal: index file corrupt: truncated ewah bitmap")
+	}
+	words := make([]uint64, wordCount)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint64(data[position+i*8:])
+	}
+	position += wordCount*8 + 4
+	bits := make([]int, 0)
+	bit := 0
+	for i := 0; i < len(words); {
+		runningBit := words[i] & 1
+		runLength := int((words[i] >> 1) & 0xffffffff)
+		literalCount := int(words[i] >> 33)
+		if runningBit == 1 {
+			for j := 0; j < runLength*64; j++ {
+				bits = append(bits, bit+j)
+			}
+		}
+		bit += runLength * 64
+		for j := 1; j <= literalCount && i+j < len(words); j++ {
+			for k := 0; k < 64; k++ {
+				if words[i+j]&(1<<uint(k)) != 0 {
+					bits = append(bits, bit+k)
+				}
+			}
+			bit += 64
+		}
+		i += 1 + literalCount
+	}
+	return bits, position
+}
+
+// appendEwahBitmap encodes the set bits as one run-length word followed by
+// literal words, which is valid if not maximally compressed
+func appendEwahBitmap(buffer []byte, bits []int) []byte {
+	bitCount := 0
+	for _, bit := range bits {
+		if bit+1 > bitCount {
+			bitCount = bit + 1
+		}
+	}
+	literals := make([]uint64, (bitCount+63)/64)
+	for _, bit := range bits {
+		literals[bit/64] |= 1 << uint(bit%64)
+	}
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(bitCount))
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(1+len(literals)))
+	buffer = binary.BigEndian.AppendUint64(buffer, uint64(len(literals))<<33)
+	for _, literal := range literals {
+		buffer = binary.BigEndian.AppendUint64(buffer, literal)
+	}
+	return binary.BigEndian.AppendUint32(buffer, 0)
+}
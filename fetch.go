@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mapRefspec maps a ref through a fetch refspec such as
+// "+refs/heads/*:refs/remotes/origin/*"; ok is false when the refspec does
+// not take the ref
+func mapRefspec(refspec string, ref string) (string, bool) {
+	source, destination, ok := strings.Cut(strings.TrimPrefix(refspec, "+"), ":")
+	if !ok {
+		return "", false
+	}
+	if source == ref {
+		return destination, true
+	}
+	if strings.HasSuffix(source, "*") && strings.HasSuffix(destination, "*") && strings.HasPrefix(ref, strings.TrimSuffix(source, "*")) {
+		return strings.TrimSuffix(destination, "*") + strings.TrimPrefix(ref, strings.TrimSuffix(source, "*")), true
+	}
+	return "", false
+}
+
+// fetchRefspecs returns the fetch refspecs of a remote, those clone sets
+// up when it has none
+func (repo *Repository) fetchRefspecs(remote string) []string {
+	refspecs := repo.config.getAll("remote." + remote + ".fetch")
+	if len(refspecs) == 0 {
+		refspecs = []string{"+refs/heads/*:refs/remotes/" + remote + "/*"}
+	}
+	return refspecs
+}
+
+// remoteURL returns the URL of a remote; a name that is no remote is
+// taken as the URL itself
+func (repo *Repository) remoteURL(remote string) string {
+	if url, ok := repo.config.get("remote." + remote + ".url"); ok {
+		return url
+	}
+	return remote
+}
+
+// openRemote opens the repository a remote, or a URL given in its place,
+// points at. Only repositories on the local filesystem can be reached.
+func (repo *Repository) openRemote(remote string) *Repository {
+	url := repo.remoteURL(remote)
+	dir := strings.TrimPrefix(url, "file://")
+	if strings.Contains(dir, "://") || !filepath.IsAbs(dir) && strings.Contains(strings.SplitN(dir, "/", 2)[0], ":") {
+		log.Fatalf("fatal: unable to access '%s': only repositories on the local filesystem can be fetched from", url)
+	}
+	gitDir, ok := dotGitDir(dir)
+	if !ok {
+		if !isGitDir(dir) {
+			log.Fatalf("fatal: '%s' does not appear to be a git repository", url)
+		}
+		gitDir = dir
+	}
+	return OpenRepository(gitDir, RepositoryOptions{})
+}
+
+// fetch copies the branches of a remote, and the objects they need, into
+// the remote-tracking refs its fetch refspecs map them to. FETCH_HEAD
+// lists them with mergeRef, the branch to merge, marked for merging; its
+// commit is returned. named says mergeRef was given on the command line,
+// which is then reported as fetched into FETCH_HEAD.
+func (repo *Repository) fetch(remote string, mergeRef string, named bool, quiet bool) string {
+	source, url := repo.openRemote(remote), repo.remoteURL(remote)
+	refspecs := []string(nil)
+	if _, ok := repo.config.get("remote." + remote + ".url"); ok {
+		refspecs = repo.fetchRefspecs(remote)
+	}
+	type refUpdate struct {
+		summary     string // "[new branch]" or the range it moved over
+		flag        byte
+		name        string
+		destination string
+		forced      bool
+	}
+	updates := make([]refUpdate, 0)
+	var fetchHead strings.Builder
+	mergeHash := ""
+	for _, ref := range source.listRefs("refs/heads/") {
+		hash, ok := source.resolveRef(ref)
+		if !ok {
+			continue
+		}
+		repo.copyObjects(source, hash)
+		note := "not-for-merge"
+		if ref == mergeRef {
+			note, mergeHash = "", hash
+			if named {
+				updates = append(updates, refUpdate{summary: "branch", flag: '*', name: strings.TrimPrefix(ref, "refs/heads/"), destination: "FETCH_HEAD"})
+			}
+		}
+		fmt.Fprintf(&fetchHead, "%s\t%s\tbranch '%s' of %s\n", hash, note, strings.TrimPrefix(ref, "refs/heads/"), url)
+		for _, refspec := range refspecs {
+			destination, ok := mapRefspec(refspec, ref)
+			if !ok {
+				continue
+			}
+			update := refUpdate{flag: ' ', name: strings.TrimPrefix(ref, "refs/heads/"), destination: strings.TrimPrefix(destination, "refs/remotes/")}
+			old, existed := repo.resolveRef(destination)
+			how := "fast-forward"
+			switch {
+			case !existed:
+				update.summary, update.flag = "[new branch]", '*'
+				how = "storing head"
+			case old == hash:
+				continue
+			case repo.isAncestor(old, hash):
+				update.summary = old[:7] + ".." + hash[:7]
+			case !strings.HasPrefix(refspec, "+"):
+				fmt.Fprintf(os.Stderr, " ! [rejected]        %s -> %s  (non-fast-forward)\n", update.name, update.destination)
+				continue
+			default:
+				update.summary, update.flag, update.forced = old[:7]+"..."+hash[:7], '+', true
+				how = "forced-update"
+			}
+			repo.updateRefLogged(destination, hash, "fetch "+remote+": "+how)
+			updates = append(updates, update)
+		}
+	}
+	if mergeHash == "" && mergeRef != "" {
+		log.Fatalf("fatal: couldn't find remote ref %s", mergeRef)
+	}
+	writeFileAtomically(filepath.Join(repo.gitDir, "FETCH_HEAD"), []byte(fetchHead.String()))
+	if quiet || len(updates) == 0 {
+		return mergeHash
+	}
+	width := 10
+	for _, update := range updates {
+		if len(update.name) > width {
+			width = len(update.name)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "From %s\n", url)
+	for _, update := range updates {
+		line := fmt.Sprintf(" %c %-17s %-*s -> %s", update.flag, update.summary, width, update.name, update.destination)
+		if update.forced {
+			line += "  (forced update)"
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+	return mergeHash
+}
+
+// copyObjects copies the objects reachable from a commit of another
+// repository that are missing here; commits already here are taken to
+// have all of their history. Objects are written after those they point
+// at, so that an interrupted copy leaves no commit without its history.
+func (repo *Repository) copyObjects(source *Repository, tip string) {
+	type object struct {
+		objectType string
+		content    []byte
+	}
+	missing := make([]object, 0)
+	seen := make(map[string]bool)
+	pending := []string{tip}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[hash] || repo.hasObject(hash) {
+			continue
+		}
+		seen[hash] = true
+		header, content := source.readOriginalObject(hash)
+		switch header.objectType {
+		case "commit":
+			commit := parseCommitObject(content)
+			pending = append(pending, commit.tree)
+			pending = append(pending, commit.parents...)
+		case "tree":
+			for _, entry := range source.readTreeEntries(hash) {
+				if entry.mode != "160000" {
+					// submodule commits live in another repository
+					pending = append(pending, entry.hash)
+				}
+			}
+		}
+		missing = append(missing, object{header.objectType, content})
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		repo.writeObject(missing[i].objectType, missing[i].content)
+	}
+}
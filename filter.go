@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// filterDriver returns the filter attribute of a path, the driver whose
+// filter.<driver>.clean and filter.<driver>.smudge commands convert it
+// between worktree and blob; "" for none
+func (repo *Repository) filterDriver(relativePath string) string {
+	switch driver := repo.pathAttributes(relativePath)["filter"]; driver {
+	case "true", "false":
+		return ""
+	default:
+		return driver
+	}
+}
+
+// applyFilter runs content through the clean or smudge command of a path's
+// filter driver, "%f" in it standing for the path. A driver without the
+// command leaves the content alone, except for lfs which git-lfs need not
+// be installed for. A failing command is fatal with
+// filter.<driver>.required and leaves the content alone otherwise.
+func (repo *Repository) applyFilter(relativePath string, kind string, content []byte) []byte {
+	driver := repo.filterDriver(relativePath)
+	if driver == "" {
+		return content
+	}
+	command, ok := repo.config.get("filter." + driver + "." + kind)
+	if !ok || command == "" {
+		if driver == "lfs" {
+			return repo.builtinLFSFilter(relativePath, kind, content)
+		}
+		if repo.config.getBool("filter."+driver+".required", false) {
+			log.Fatalf("fatal: %s: %s filter '%s' failed", relativePath, kind, driver)
+		}
+		return content
+	}
+	command = strings.ReplaceAll(command, "%f", quoteCommandLine([]string{relativePath}))
+	argv := []string{"sh", "-c", command}
+	traceRunCommand(argv)
+	process := exec.Command(argv[0], argv[1:]...)
+	process.Dir = repo.workTree
+	process.Stdin = bytes.NewReader(content)
+	process.Stderr = os.Stderr
+	filtered, err := process.Output()
+	if err == nil {
+		return filtered
+	}
+	if repo.config.getBool("filter."+driver+".required", false) {
+		log.Fatalf("fatal: %s: %s filter '%s' failed", relativePath, kind, driver)
+	}
+	fmt.Fprintf(os.Stderr, "error: external filter '%s' failed\n", command)
+	return content
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mailDateFormat is the RFC 2822 date of the "Date:" header
+const mailDateFormat = "Mon, 2 Jan 2006 15:04:05 -0700"
+
+// DefaultPatchNameMax limits the length of patch file names, including
+// the ".patch" suffix
+const DefaultPatchNameMax = 64
+
+const patchSuffix = ".patch"
+
+// DefaultPatchSignature ends every patch unless format.signature is set
+const DefaultPatchSignature = "git-from-scratch"
+
+type formatPatchOptions struct {
+	outputDir     string
+	stdout        bool
+	numbered      bool
+	noNumbered    bool
+	startNumber   int
+	subjectPrefix string
+	base          string
+	signature     string
+	noBinary      bool // say that binary files differ instead of writing binary patches
+}
+
+// patchSeries returns the commits format-patch writes, oldest first:
+// "<since>" and "<since>..<until>" select the commits of until (HEAD by
+// default) missing from since, and maxCount alone takes the last commits
+// of HEAD. Merges are left out as they have no single patch.
+func (repo *Repository) patchSeries(revisions []string, maxCount int) []string {
+	if len(revisions) > 1 {
+		log.Fatal("fatal: format-patch takes a single revision or range")
+	}
+	until := "HEAD"
+	exclude := make(map[string]bool)
+	if len(revisions) == 1 {
+		since := revisions[0]
+		if before, after, isRange := strings.Cut(since, ".."); isRange {
+			since = before
+			if after != "" {
+				until = after
+			}
+		}
+		if since != "" {
+			exclude = repo.reachableCommits(repo.peelToCommit(repo.resolveRevision(since)))
+		}
+	} else if maxCount < 0 {
+		return nil
+	}
+	head := repo.peelToCommit(repo.resolveRevision(until))
+	series := make([]string, 0)
+	iter := newCommitIter(repo, []string{head}, commitOrderDate, false)
+	for maxCount < 0 || len(series) < maxCount {
+		hash, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		if exclude[hash] || len(commit.parents) > 1 {
+			continue
+		}
+		series = append(series, hash)
+	}
+	reverseHashes(series)
+	return series
+}
+
+// sanitizedSubject turns a subject into the file name part git uses:
+// runs of anything but letters, digits, "." and "_" become one "-"
+func sanitizedSubject(subject string) string {
+	var name strings.Builder
+	pendingDash := false
+	for i := 0; i < len(subject); i++ {
+		c := subject[i]
+		isTitleChar := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_'
+		if !isTitleChar {
+			pendingDash = name.Len() > 0
+			continue
+		}
+		if c == '.' && i > 0 && subject[i-1] == '.' {
+			continue
+		}
+		if pendingDash {
+			name.WriteByte('-')
+			pendingDash = false
+		}
+		name.WriteByte(c)
+	}
+	return strings.TrimRight(name.String(), ".-")
+}
+
+func patchFileName(number int, subject string) string {
+	name := fmt.Sprintf("%04d-%s", number, sanitizedSubject(subject))
+	if maxLength := DefaultPatchNameMax - len(patchSuffix) - 1; len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	return name + patchSuffix
+}
+
+func isASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeMailHeader writes a header line of prefix followed by value,
+// RFC 2047 encoded when it is not plain ASCII and folded to 78 columns
+// otherwise. Addresses encode more characters than other headers do.
+func encodeMailHeader(prefix string, value string, address bool) string {
+	var header strings.Builder
+	header.WriteString(prefix)
+	column := len(prefix)
+	if isASCII(value) && !strings.Contains(value, "=?") {
+		for i, word := range strings.Split(value, " ") {
+			if i > 0 {
+				if column+1+len(word) > 78 {
+					header.WriteString("\n")
+					column = 0
+				}
+				header.WriteString(" ")
+				column++
+			}
+			header.WriteString(word)
+			column += len(word)
+		}
+		return header.String()
+	}
+	header.WriteString("=?UTF-8?q?")
+	column += len("=?UTF-8?q?")
+	for i := 0; i < len(value); {
+		size := 1
+		for i+size < len(value) && value[i] >= 0xc0 && value[i+size]&0xc0 == 0x80 {
+			size++
+		}
+		encoded := value[i : i+size]
+		if size > 1 || isMailSpecial(value[i], address) {
+			encoded = ""
+			for _, c := range []byte(value[i : i+size]) {
+				encoded += fmt.Sprintf("=%02X", c)
+			}
+		}
+		// an encoded word must fit its closing "?=" within 76 columns
+		if column+len(encoded)+2 > 76 {
+			header.WriteString("?=\n =?UTF-8?q?")
+			column = 1 + len("=?UTF-8?q?")
+		}
+		header.WriteString(encoded)
+		column += len(encoded)
+		i += size
+	}
+	header.WriteString("?=")
+	return header.String()
+}
+
+// isMailSpecial tells the characters that cannot appear as themselves in
+// an RFC 2047 encoded word
+func isMailSpecial(c byte, address bool) bool {
+	if c >= 0x80 || c <= ' ' || c == 0x7f || c == '=' || c == '?' || c == '_' {
+		return true
+	}
+	if !address {
+		return false
+	}
+	isSafe := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!*+-/", c) != -1
+	return !isSafe
+}
+
+// encodeMailAddress is the "From:" line, encoding or quoting the name as
+// needed
+func encodeMailAddress(person identity) string {
+	if !isASCII(person.name) || strings.Contains(person.name, "=?") {
+		return encodeMailHeader("From: ", person.name, true) + " <" + person.email + ">"
+	}
+	name := person.name
+	if strings.ContainsAny(name, "()<>@,;:\\\".[]") {
+		name = "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(name) + "\""
+	}
+	return "From: " + name + " <" + person.email + ">"
+}
+
+// writeFormattedPatch writes one commit as a mail in mbox format, with the
+// diffstat below the "---" line and the signature at the end
+func (repo *Repository) writeFormattedPatch(w io.Writer, hash string, number int, total int, options formatPatchOptions) {
+	commit := repo.readCommitObject(hash)
+	subject, body := splitCommitMessage(commit.commitMessage)
+
+	prefix := options.subjectPrefix
+	if (total > 1 || options.numbered) && !options.noNumbered {
+		prefix = fmt.Sprintf("%s %d/%d", prefix, number, total)
+	}
+	fmt.Fprintf(w, "From %s Mon Sep 17 00:00:00 2001\n", hash)
+	fmt.Fprintln(w, encodeMailAddress(commit.author))
+	fmt.Fprintf(w, "Date: %s\n", commit.author.when.Format(mailDateFormat))
+	fmt.Fprintln(w, encodeMailHeader("Subject: ["+prefix+"] ", subject, false))
+	if !isASCII(commit.commitMessage) {
+		fmt.Fprint(w, "MIME-Version: 1.0\nContent-Type: text/plain; charset=UTF-8\nContent-Transfer-Encoding: 8bit\n")
+	}
+	fmt.Fprintln(w)
+	if body != "" {
+		fmt.Fprintln(w, body)
+	}
+	fmt.Fprintln(w, "---")
+
+	parentTree := ""
+	if len(commit.parents) > 0 {
+		parentTree = repo.readCommitObject(commit.parents[0]).tree
+	}
+	changes := repo.diffTrees(parentTree, commit.tree)
+	stats := make([]fileStat, len(changes))
+	for i, change := range changes {
+		stats[i] = repo.diffStat(change)
+	}
+	writeDiffStat(w, stats, 72, diffColors{})
+	writeDiffSummary(w, changes)
+	fmt.Fprintln(w)
+	for _, change := range changes {
+		repo.writePatch(w, change, diffOptions{context: DefaultDiffContext, binary: !options.noBinary})
+	}
+	if options.base != "" {
+		fmt.Fprintf(w, "\nbase-commit: %s\n", options.base)
+	}
+	if options.signature != "" {
+		fmt.Fprintf(w, "-- \n%s\n\n", options.signature)
+	}
+}
+
+// writeDiffSummary lists created and deleted files and mode changes below
+// the diffstat
+func writeDiffSummary(w io.Writer, changes []fileChange) {
+	for _, change := range changes {
+		name := quotePath(change.path)
+		switch {
+		case change.oldMode == 0:
+			fmt.Fprintf(w, " create mode %06o %s\n", change.newMode, name)
+		case change.newMode == 0:
+			fmt.Fprintf(w, " delete mode %06o %s\n", change.oldMode, name)
+		case change.oldMode != change.newMode:
+			fmt.Fprintf(w, " mode change %06o => %06o %s\n", change.oldMode, change.newMode, name)
+		}
+	}
+}
+
+func (repo *Repository) formatPatches(series []string, options formatPatchOptions) {
+	if options.base != "" {
+		base := repo.peelToCommit(repo.resolveRevision(options.base))
+		for _, hash := range series {
+			if hash == base {
+				log.Fatal("fatal: base commit shouldn't be in revision list")
+			}
+		}
+		options.base = base
+	}
+	for i, hash := range series {
+		number := options.startNumber + i
+		if options.stdout {
+			if i > 0 {
+				fmt.Println()
+			}
+			repo.writeFormattedPatch(os.Stdout, hash, number, options.startNumber+len(series)-1, options)
+			continue
+		}
+		var patch bytes.Buffer
+		repo.writeFormattedPatch(&patch, hash, number, options.startNumber+len(series)-1, options)
+		subject, _ := splitCommitMessage(repo.readCommitObject(hash).commitMessage)
+		path := filepath.Join(options.outputDir, patchFileName(number, subject))
+		if options.outputDir != "" {
+			if err := os.MkdirAll(options.outputDir, 0777); err != nil {
+				log.Fatalf("fatal: could not create directory '%s'", options.outputDir)
+			}
+		}
+		if err := os.WriteFile(path, patch.Bytes(), 0666); err != nil {
+			log.Fatalf("fatal: cannot open patch file %s", path)
+		}
+		fmt.Println(path)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fsmonitorState mirrors the FSMN index extension: the token of the last
+// file-system monitor query, with every entry not flagged dirty since then
+// known to be unchanged up to that point
+type fsmonitorState struct {
+	version uint32 // 0 until the first query of a new extension
+	token   string // opaque for version 2, nanoseconds since the epoch for version 1
+	changed bool   // the token or valid flags changed, so the index is worth writing
+}
+
+func parseFsmonitorExtension(data []byte, entries []indexEntry) *fsmonitorState {
+	// format: <4-byte version> version 1: <8-byte time in ns>, version 2: <token>\0
+	// followed by <4-byte bitmap size> <ewah bitmap of entries that are not valid>
+	state := &fsmonitorState{version: binary.BigEndian.Uint32(data)}
+	position := 4
+	switch state.version {
+	case 1:
+		state.token = strconv.FormatUint(binary.BigEndian.Uint64(data[position:]), 10)
+		position += 8
+	case 2:
+		tokenEnd := bytes.IndexByte(data[position:], 0)
+		if tokenEnd == -1 {
+			log.Fatal("fatal: index file corrupt: bad fsmonitor token")
+		}
+		state.token = string(data[position : position+tokenEnd])
+		position += tokenEnd + 1
+	default:
+		log.Fatalf("fatal: index file corrupt: bad fsmonitor version %d", state.version)
+	}
+	position += 4
+	dirtyBits, _ := readEwahBitmap(data, position)
+	for i := range entries {
+		entries[i].fsmonitorValid = true
+	}
+	for _, bit := range dirtyBits {
+		if bit < len(entries) {
+			entries[bit].fsmonitorValid = false
+		}
+	}
+	return state
+}
+
+func (state *fsmonitorState) serialize(entries []indexEntry) []byte {
+	buffer := binary.BigEndian.AppendUint32(nil, state.version)
+	if state.version == 1 {
+		timestamp, _ := strconv.ParseUint(state.token, 10, 64)
+		buffer = binary.BigEndian.AppendUint64(buffer, timestamp)
+	} else {
+		buffer = append(buffer, state.token...)
+		buffer = append(buffer, 0)
+	}
+	dirtyBits := make([]int, 0)
+	for i, entry := range entries {
+		if !entry.fsmonitorValid {
+			dirtyBits = append(dirtyBits, i)
+		}
+	}
+	bitmap := appendEwahBitmap(nil, dirtyBits)
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(bitmap)))
+	return append(buffer, bitmap...)
+}
+
+// fsmonitorHook returns the configured core.fsmonitor hook; the builtin
+// daemon (core.fsmonitor=true) is not supported and behaves as if unset
+func (repo *Repository) fsmonitorHook() string {
+	value, ok := repo.config.get("core.fsmonitor")
+	if !ok {
+		return ""
+	}
+	switch strings.ToLower(value) {
+	case "", "false", "no", "off", "0", "true", "yes", "on", "1":
+		return ""
+	}
+	return value
+}
+
+// queryFsmonitor asks the hook which paths changed since the index's token
+// and clears the valid flag of the affected entries, taking the token of
+// this query for the next one. An index without the FSMN extension gets
+// one, all of its entries to be checked first. It returns false when the
+// answer cannot be trusted, in which case every entry must be checked;
+// the entries found unchanged are then marked valid again.
+func (repo *Repository) queryFsmonitor(index *gitIndex) bool {
+	hook := repo.fsmonitorHook()
+	if hook == "" {
+		return false
+	}
+	state := index.fsmonitor
+	if state == nil {
+		state = &fsmonitorState{}
+		for i := range index.entries {
+			index.entries[i].fsmonitorValid = false
+		}
+		index.fsmonitor = state
+	}
+	versions := []uint32{2, 1}
+	if configured := repo.config.getInt("core.fsmonitorHookVersion", 0); configured == 1 || configured == 2 {
+		versions = []uint32{uint32(configured)}
+	}
+	// changes made while the hook runs are reported by the next query
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, version := range versions {
+		if state.version != 0 && version != state.version {
+			// tokens of one protocol version mean nothing to the other
+			continue
+		}
+		if state.version == 0 && version == 1 {
+			// a first timestamp needs no query, nothing is valid yet
+			state.version, state.token, state.changed = 1, now, true
+			return false
+		}
+		argv := []string{"sh", "-c", hook + ` "$@"`, hook, strconv.Itoa(int(version)), state.token}
+		traceRunCommand(argv)
+		hookCommand := exec.Command(argv[0], argv[1:]...)
+		hookCommand.Dir = repo.workTree
+		hookCommand.Stderr = os.Stderr
+		output, err := hookCommand.Output()
+		if err != nil {
+			continue
+		}
+		// version 2 output starts with the new token, paths are NUL-separated
+		paths := strings.Split(string(output), "\x00")
+		token := now
+		if version == 2 {
+			if token = paths[0]; token == "" {
+				fmt.Fprintln(os.Stderr, "warning: Empty last update token.")
+				continue
+			}
+			paths = paths[1:]
+		}
+		fresh := state.version == 0
+		state.version, state.token, state.changed = version, token, true
+		if fresh {
+			return false
+		}
+		for _, changedPath := range paths {
+			if changedPath == "/" {
+				// the monitor lost track and asks for a full scan
+				state.invalidate(index)
+				return false
+			}
+		}
+		for _, changedPath := range paths {
+			if changedPath == "" {
+				continue
+			}
+			// a reported directory covers everything below it, which the
+			// sorted index keeps in one run
+			changedPath = strings.TrimSuffix(changedPath, "/")
+			position, _ := index.find(changedPath)
+			for ; position < len(index.entries); position++ {
+				entryPath := index.entries[position].path
+				if entryPath != changedPath && !strings.HasPrefix(entryPath, changedPath+"/") {
+					break
+				}
+				index.entries[position].fsmonitorValid = false
+			}
+		}
+		return true
+	}
+	state.invalidate(index)
+	return false
+}
+
+// invalidate clears the valid flag of every entry, for a query whose
+// answer cannot be trusted; the token stays, as the entries checked now
+// only need the changes since then
+func (state *fsmonitorState) invalidate(index *gitIndex) {
+	for i := range index.entries {
+		if index.entries[i].fsmonitorValid {
+			index.entries[i].fsmonitorValid = false
+			state.changed = true
+		}
+	}
+}
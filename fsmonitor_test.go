@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFsmonitorExtensionOnFirstUse checks that status adds the FSMN
+// extension to an index that has none, with the token of the hook and the
+// entries it checked marked valid, and that the next status asks for the
+// changes since that token
+func TestFsmonitorExtensionOnFirstUse(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	repo := newTestRepository(t, RepositoryOptions{})
+	commitWorktreeFile(t, repo, "file", "first\n", "first")
+	calls := filepath.Join(repo.gitDir, "fsmonitor-calls")
+	hook := filepath.Join(repo.gitDir, "fsmonitor-hook")
+	// each query answers with a token of its own and reports "file" changed
+	script := "#!/bin/sh\necho \"$1 $2\" >>" + calls + "\nprintf 'token-%s\\0file\\0' $(wc -l <" + calls + ")\n"
+	if err := os.WriteFile(hook, []byte(script), 0777); err != nil {
+		t.Fatal(err)
+	}
+	repo.setConfig("core.fsmonitor", hook)
+
+	repo.computeStatus(1)
+	index := repo.readIndex()
+	if index.fsmonitor == nil {
+		t.Fatal("status left the index without the FSMN extension")
+	}
+	if index.fsmonitor.version != 2 || index.fsmonitor.token != "token-1" {
+		t.Errorf("FSMN has version %d and token %q, want 2 and \"token-1\"", index.fsmonitor.version, index.fsmonitor.token)
+	}
+	if position, _ := index.find("file"); !index.entries[position].fsmonitorValid {
+		t.Error("the entry status found unchanged is not marked valid")
+	}
+
+	writeWorktreeFile(t, repo, "file", "second version\n")
+	if status := repo.computeStatus(1); len(status.unstaged) != 1 || status.unstaged[0].path != "file" {
+		t.Errorf("status after a reported change lists %+v as unstaged, want file", status.unstaged)
+	}
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n"), []string{"2 ", "2 token-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the hook was called with %q, want %q", got, want)
+	}
+	if index := repo.readIndex(); index.fsmonitor.token != "token-2" {
+		t.Errorf("the token after the second status is %q, want \"token-2\"", index.fsmonitor.token)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+type grepOptions struct {
+	pattern     *regexp.Regexp
+	lineNumbers bool
+	filesOnly   bool
+	countOnly   bool
+	invert      bool
+	color       bool
+}
+
+// grepTarget is one blob to search: name is how matches are reported,
+// content is loaded lazily by the worker scanning it
+type grepTarget struct {
+	name    string
+	content func() ([]byte, bool)
+}
+
+// grepTargets lists the files to search: tracked files in the worktree,
+// the staged blobs with cached, or the blobs of a tree
+func (repo *Repository) grepTargets(treeish string, cached bool, pathspecs []pathspec) []grepTarget {
+	targets := make([]grepTarget, 0)
+	if treeish != "" {
+		tree := repo.flattenTree(repo.resolveTreeish(treeish))
+		paths := make([]string, 0, len(tree))
+		for entryPath, entry := range tree {
+			if parseFileMode(entry.mode) != fileModeGitlink && matchesPathspecs(entryPath, pathspecs) {
+				paths = append(paths, entryPath)
+			}
+		}
+		sort.Strings(paths)
+		for _, entryPath := range paths {
+			hash := tree[entryPath].hash
+			targets = append(targets, grepTarget{treeish + ":" + entryPath, func() ([]byte, bool) {
+				_, content := repo.readObject(hash)
+				return content, true
+			}})
+		}
+		return targets
+	}
+	index := repo.readIndex()
+	for i, entry := range index.entries {
+		// a conflicted path is searched once
+		if entry.mode == fileModeGitlink || !matchesPathspecs(entry.path, pathspecs) ||
+			(i > 0 && index.entries[i-1].path == entry.path) {
+			continue
+		}
+		entry := entry
+		// like git, skip-worktree entries are searched in the index
+		if cached || entry.skipWorktree() {
+			targets = append(targets, grepTarget{entry.path, func() ([]byte, bool) {
+				_, content := repo.readObject(entry.hash)
+				return content, true
+			}})
+			continue
+		}
+		targets = append(targets, grepTarget{entry.path, func() ([]byte, bool) {
+			filePath := repo.worktreePath(entry.path)
+			info, err := os.Lstat(filePath)
+			if err != nil {
+				// deleted in the worktree
+				return nil, false
+			}
+			return readWorktreeContent(filePath, info), true
+		}})
+	}
+	return targets
+}
+
+// grepContent returns the output lines for one searched file
+func grepContent(name string, content []byte, options grepOptions) []string {
+	output := make([]string, 0)
+	coloredName := colorize(options.color, colorMagenta, name)
+	separator := colorize(options.color, colorCyan, ":")
+	// like git, content with a NUL in the first 8000 bytes is binary
+	binary := bytes.IndexByte(content[:min(len(content), 8000)], 0) != -1
+	count := 0
+	lines := bytes.Split(content, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		if options.pattern.Match(line) == options.invert {
+			continue
+		}
+		count++
+		if options.filesOnly || options.countOnly || binary {
+			continue
+		}
+		text := string(line)
+		if options.color && !options.invert {
+			text = options.pattern.ReplaceAllStringFunc(text, func(match string) string {
+				return colorize(true, colorBoldRed, match)
+			})
+		}
+		prefix := coloredName + separator
+		if options.lineNumbers {
+			prefix += colorize(options.color, colorGreen, strconv.Itoa(i+1)) + separator
+		}
+		output = append(output, prefix+text)
+	}
+	switch {
+	case count == 0:
+	case options.filesOnly:
+		output = append(output, coloredName)
+	case options.countOnly:
+		output = append(output, fmt.Sprintf("%s%s%d", coloredName, separator, count))
+	case binary:
+		output = append(output, fmt.Sprintf("Binary file %s matches", name))
+	}
+	return output
+}
+
+// grep searches the targets on up to jobs goroutines and prints the
+// results in target order; it reports whether anything matched
+func grep(targets []grepTarget, options grepOptions, jobs int) bool {
+	results := make([][]string, len(targets))
+	runParallel(jobs, len(targets), func(i int) {
+		if content, ok := targets[i].content(); ok {
+			results[i] = grepContent(targets[i].name, content, options)
+		}
+	})
+	matched := false
+	for _, lines := range results {
+		for _, line := range lines {
+			fmt.Println(line)
+			matched = true
+		}
+	}
+	return matched
+}
@@ -2,22 +2,29 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/zlib"
+	"crypto/sha1"
 	"encoding/hex"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 )
 
 // constants
 const (
 	ObjectShaLength = 20
-	TruncatedSize   = 3072
+)
+
+// the ids of the empty tree and the empty blob, which every repository is
+// taken to have whether or not they are stored in it
+const (
+	emptyTreeHash = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	emptyBlobHash = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
 )
 
 type objectHeader struct {
@@ -25,13 +32,29 @@ type objectHeader struct {
 	length     int
 }
 
+type treeEntry struct {
+	mode string
+	name string
+	hash string
+}
+
 type commitObject struct {
 	tree          string
-	parent        string
-	author        string
+	parents       []string
+	author        identity
+	committer     identity
+	gpgSignature  string         // the armored signature of a signed commit, empty if unsigned
+	extraHeaders  []commitHeader // headers such as encoding or mergetag, in their order
 	commitMessage string
 }
 
+// commitHeader is a "<key> <value>" header line of a commit object; lines
+// starting with a space continue the value of the header before them
+type commitHeader struct {
+	key   string
+	value string
+}
+
 func scanSingleByte(bufScanner *bufio.Scanner, throwOnEOF bool) (byte, bool) {
 	readSuccess := bufScanner.Scan()
 	if !readSuccess {
@@ -73,21 +96,6 @@ func scanCountBytes(bufScanner *bufio.Scanner, byteCount int, throwOnEOF bool) [
 	return scannedBytes
 }
 
-func parseObjectHeader(bufScanner *bufio.Scanner) objectHeader {
-	// header format: "<object-type-string> <length-in-string>\0"
-	headerBytes := scanBytesUntilDelimiter(bufScanner, 0, true) // '\0' character in ascii is same as 0
-	headerString := string(headerBytes[:len(headerBytes)-1])
-	headerComponents := strings.Split(headerString, " ")
-	if len(headerComponents) != 2 {
-		panic(fmt.Sprintf("Invalid header: %s", headerComponents))
-	}
-	objectLen, err := strconv.Atoi(headerComponents[1])
-	if err != nil {
-		panic(err)
-	}
-	return objectHeader{headerComponents[0], objectLen}
-}
-
 func printCommitContent(bufScanner *bufio.Scanner, byteCount int) {
 	//format:
 	// tree <tree sha>
@@ -107,31 +115,22 @@ func printBlobContent(bufScanner *bufio.Scanner, byteCount int) {
 	//format:
 	// <content>
 	// ...
-	// print 3KB size (atmax) of object content
-	var count int
-	if byteCount > TruncatedSize {
-		count = TruncatedSize
-	} else {
-		count = byteCount
-	}
-	fileMetadataBytes := scanCountBytes(bufScanner, count, true)
-	fileMetadataString := string(fileMetadataBytes)
-	fmt.Print(fileMetadataString)
-	if byteCount > TruncatedSize {
-		fmt.Printf("\n\n(... truncated to 3KB)\n")
-	}
+	// long blobs are left to the pager rather than truncated
+	fileMetadataBytes := scanCountBytes(bufScanner, byteCount, true)
+	fmt.Print(string(fileMetadataBytes))
 }
 
-func printTreeContent(bufScanner *bufio.Scanner) {
+func parseTreeEntries(bufScanner *bufio.Scanner) []treeEntry {
 	// format:
 	// <file-mode-in-string> <file-name>\0<20-bytes-of-hash-in-binary>
 	// <file-mode-in-string> <file-name>\0<20-bytes-of-hash-in-binary>
 	// ...
+	entries := make([]treeEntry, 0)
 	for {
 		fileMetadataBytes := scanBytesUntilDelimiter(bufScanner, 0, false)
 		if len(fileMetadataBytes) == 0 {
 			// end of tree contents
-			return
+			return entries
 		}
 		fileMetadataBytesLen := len(fileMetadataBytes)
 		if fileMetadataBytes[fileMetadataBytesLen-1] != 0 {
@@ -139,20 +138,66 @@ func printTreeContent(bufScanner *bufio.Scanner) {
 		}
 		fileMetadataBytes = fileMetadataBytes[:fileMetadataBytesLen-1] // remove trailing '\0'
 		fileMetadataString := string(fileMetadataBytes)
-		fileMetadataComponents := strings.Split(fileMetadataString, " ")
+		// file names may contain spaces, only the first one separates the mode
+		fileMetadataComponents := strings.SplitN(fileMetadataString, " ", 2)
 		if len(fileMetadataComponents) != 2 {
 			panic("fileMetadataComponents len must be 2")
 		}
 		objectShaBytes := scanCountBytes(bufScanner, ObjectShaLength, true)
 		objectShaString := hex.EncodeToString(objectShaBytes)
-		fmt.Printf("fileMode: %s, filename: %s, SHA: %s\n", fileMetadataComponents[0], fileMetadataComponents[1], objectShaString)
+		entries = append(entries, treeEntry{fileMetadataComponents[0], fileMetadataComponents[1], objectShaString})
+	}
+}
+
+func printTreeContent(bufScanner *bufio.Scanner) {
+	for _, entry := range parseTreeEntries(bufScanner) {
+		fmt.Printf("fileMode: %s, type: %s, filename: %s, SHA: %s\n", entry.mode, treeEntryType(entry.mode), entry.name, entry.hash)
 	}
 }
 
-func printObjectFileContent(contentReader io.Reader) {
-	bufScanner := bufio.NewScanner(contentReader)
+func parseCommitObject(content []byte) commitObject {
+	// headers are "<key> <value>" lines, terminated by an empty line
+	// followed by the commit message
+	var commit commitObject
+	headerText, message, found := strings.Cut(string(content), "\n\n")
+	if !found {
+		if !bytes.HasSuffix(content, []byte("\n")) {
+			panic("Invalid commit: missing message separator")
+		}
+		headerText = strings.TrimSuffix(headerText, "\n")
+	}
+	commit.commitMessage = message
+	headers := make([]commitHeader, 0)
+	for _, line := range strings.Split(headerText, "\n") {
+		if strings.HasPrefix(line, " ") && len(headers) > 0 {
+			headers[len(headers)-1].value += "\n" + line[1:]
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		headers = append(headers, commitHeader{key, value})
+	}
+	for _, header := range headers {
+		switch header.key {
+		case "tree":
+			commit.tree = header.value
+		case "parent":
+			commit.parents = append(commit.parents, header.value)
+		case "author":
+			commit.author = parseIdentity(header.value)
+		case "committer":
+			commit.committer = parseIdentity(header.value)
+		case "gpgsig":
+			commit.gpgSignature = header.value
+		default:
+			commit.extraHeaders = append(commit.extraHeaders, header)
+		}
+	}
+	return commit
+}
+
+func printObjectFileContent(header objectHeader, content []byte) {
+	bufScanner := bufio.NewScanner(bytes.NewReader(content))
 	bufScanner.Split(bufio.ScanBytes) // read byte by byte
-	header := parseObjectHeader(bufScanner)
 	fmt.Printf("Type: %s, len: %d\n", header.objectType, header.length)
 	if header.objectType == "tree" {
 		printTreeContent(bufScanner)
@@ -177,50 +222,242 @@ func readFile(path string) string {
 	return fileMetadataString
 }
 
-func listBranches() {
-	path := ".git/refs/heads"
-	branches, err := ioutil.ReadDir(path)
+func (repo *Repository) readObject(hash string) (objectHeader, []byte) {
+	return repo.readOriginalObject(repo.replacementFor(hash))
+}
+
+// readOriginalObject reads an object without applying replace refs
+func (repo *Repository) readOriginalObject(hash string) (objectHeader, []byte) {
+	// the returned content may be shared with the object cache, callers must not modify it
+	if header, content, ok := repo.objectCache.get(hash); ok {
+		return header, content
+	}
+	header, content, ok := repo.readLooseObject(hash)
+	if !ok {
+		header, content, ok = repo.readPackedObject(hash)
+	}
+	if !ok {
+		header, content, ok = wellKnownObject(hash)
+	}
+	if !ok {
+		log.Fatalf("fatal: object %s not found", hash)
+	}
+	repo.objectCache.add(hash, header, content)
+	return header, content
+}
+
+func (repo *Repository) readLooseObject(hash string) (objectHeader, []byte, bool) {
+	// object files are stored zlib-compressed at .git/objects/<first-2-hex>/<remaining-38-hex>
+	if len(hash) != 2*ObjectShaLength {
+		log.Fatalf("fatal: not a valid object name %s", hash)
+	}
+	path, ok := repo.looseObjectPath(hash)
+	if !ok {
+		return objectHeader{}, nil, false
+	}
+	compressed, err := os.ReadFile(path)
 	if err != nil {
 		log.Fatal(err)
 	}
-	currentBranch := readFile(".git/HEAD")
-	currentBranch = strings.Split(currentBranch, "/")[2]
-	// current-branch format
-	// .git/HEAD => ref: refs/heads/<branch-name>
-	for _, branch := range branches {
-		// format : each branch resides in path => .git/refs/heads/<branch-name>
-		branchHash := readFile(path + "/" + branch.Name())
-		branchDescriptionPrefix := " "
-		if branch.Name() == currentBranch {
-			branchDescriptionPrefix = "*"
+	header, content, err := parseLooseObject(compressed)
+	if err == nil && hashObject(header.objectType, content) != hash {
+		err = fmt.Errorf("hash mismatch %s", hash)
+	}
+	if err != nil {
+		fatalCorruptLoose(hash, path, err)
+	}
+	return header, content, true
+}
+
+func (repo *Repository) hasObject(hash string) bool {
+	if _, _, ok := repo.objectCache.get(hash); ok {
+		return true
+	}
+	if _, ok := repo.looseObjectPath(hash); ok {
+		return true
+	}
+	packs := repo.packFiles()
+	defer repo.releasePacks(packs)
+	for _, pack := range packs {
+		if _, ok := pack.index.findOffset(hash); ok {
+			return true
 		}
-		fmt.Printf("%s %s: %s\n", branchDescriptionPrefix, branch.Name(), branchHash)
 	}
+	_, _, ok := wellKnownObject(hash)
+	return ok
 }
 
-func parseObjectFile(hash string) {
-	path := ".git/objects/"
-	objectFile, err := os.Open(path + hash[0:2] + "/" + hash[2:])
+// objectsWithPrefix lists the objects, loose and packed, whose names start
+// with prefix, a lowercase hex string of at least two digits
+func (repo *Repository) objectsWithPrefix(prefix string) []string {
+	found := make(map[string]bool)
+	for _, dir := range repo.objectDirectories() {
+		files, err := os.ReadDir(filepath.Join(dir, prefix[:2]))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if hash := prefix[:2] + file.Name(); isFullHash(hash) && strings.HasPrefix(hash, prefix) {
+				found[hash] = true
+			}
+		}
+	}
+	packs := repo.packFiles()
+	defer repo.releasePacks(packs)
+	for _, pack := range packs {
+		for _, hash := range pack.index.hashesWithPrefix(prefix) {
+			found[hash] = true
+		}
+	}
+	hashes := make([]string, 0, len(found))
+	for hash := range found {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// wellKnownObject returns the empty tree or the empty blob for their ids
+func wellKnownObject(hash string) (objectHeader, []byte, bool) {
+	switch hash {
+	case emptyTreeHash:
+		return objectHeader{"tree", 0}, []byte{}, true
+	case emptyBlobHash:
+		return objectHeader{"blob", 0}, []byte{}, true
+	}
+	return objectHeader{}, nil, false
+}
+
+func hashObject(objectType string, content []byte) string {
+	// the object id is the sha1 of "<object-type-string> <length-in-string>\0<content>"
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "%s %d\x00", objectType, len(content))
+	hasher.Write(content)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (repo *Repository) writeObject(objectType string, content []byte) string {
+	hash := hashObject(objectType, content)
+	if _, ok := repo.looseObjectPath(hash); ok {
+		// objects are immutable, an existing file already has this content,
+		// also when it lives in an alternate object directory
+		return hash
+	}
+	repo.storeLooseObject(hash, func(w io.Writer) error {
+		fmt.Fprintf(w, "%s %d\x00", objectType, len(content))
+		_, err := w.Write(content)
+		return err
+	})
+	return hash
+}
+
+// storeLooseObject writes the loose object file of hash, write giving the
+// header and content to compress
+func (repo *Repository) storeLooseObject(hash string, write func(w io.Writer) error) {
+	dir := filepath.Join(repo.gitDir, "objects", hash[0:2])
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	// write a temporary file and rename it into place, so that a crash
+	// leaves a tmp_obj_ file for prune rather than a truncated object
+	tempFile, err := ioutil.TempFile(dir, "tmp_obj_")
 	if err != nil {
 		log.Fatal(err)
 	}
-	contentReader, err := zlib.NewReader(objectFile)
+	buffered := bufio.NewWriter(tempFile)
+	contentWriter := zlib.NewWriter(buffered)
+	err = write(contentWriter)
+	if closeErr := contentWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if flushErr := buffered.Flush(); err == nil {
+		err = flushErr
+	}
+	if err == nil && repo.fsyncLooseObjects() {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempFile.Name(), 0444)
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), filepath.Join(dir, hash[2:]))
+	}
 	if err != nil {
+		os.Remove(tempFile.Name())
+		if _, ok := repo.looseObjectPath(hash); ok {
+			// another process wrote the same object meanwhile
+			return
+		}
 		log.Fatal(err)
 	}
-	printObjectFileContent(contentReader)
-	contentReader.Close() // close reader when done
 }
 
-func main() {
-	branch := flag.Bool("branch", false, "list all branches")
-	hash := flag.String("hash", "", "hash of the object file")
-	flag.Parse()
-	if *branch == true { // git branch -l
-		listBranches()
-	} else if *hash != "" { // git cat-file -p <hash>
-		parseObjectFile(*hash)
-	} else {
-		flag.Usage()
+// fsyncLooseObjects says whether loose objects are flushed to disk before
+// they are renamed into place, as core.fsync or the older
+// core.fsyncObjectFiles ask
+func (repo *Repository) fsyncLooseObjects() bool {
+	fsync := repo.config.getBool("core.fsyncObjectFiles", false)
+	components, ok := repo.config.get("core.fsync")
+	if !ok {
+		return fsync
+	}
+	for _, component := range strings.Split(components, ",") {
+		switch strings.TrimSpace(component) {
+		case "loose-object", "objects", "added", "committed", "all":
+			fsync = true
+		case "-loose-object", "-objects", "-added", "-committed", "-all", "none":
+			fsync = false
+		}
+	}
+	return fsync
+}
+
+func (repo *Repository) readTreeEntries(hash string) []treeEntry {
+	header, content := repo.readObject(hash)
+	if header.objectType != "tree" {
+		panic(fmt.Sprintf("%s is a %s, not a tree", hash, header.objectType))
+	}
+	bufScanner := bufio.NewScanner(bytes.NewReader(content))
+	bufScanner.Split(bufio.ScanBytes) // read byte by byte
+	return parseTreeEntries(bufScanner)
+}
+
+func (repo *Repository) readCommitObject(hash string) commitObject {
+	header, content := repo.readObject(hash)
+	if header.objectType != "commit" {
+		panic(fmt.Sprintf("%s is a %s, not a commit", hash, header.objectType))
 	}
+	return parseCommitObject(content)
+}
+
+func (repo *Repository) parseObjectFile(hash string) {
+	header, content := repo.readObject(hash)
+	printObjectFileContent(header, content)
+}
+
+// exitFatal is the exit code of a command dying on an error, that of
+// die() in git; 1 is left for the failures commands report themselves,
+// like diff --exit-code finding changes, and 129 for bad command lines
+const exitFatal = 128
+
+// fatalOutput is where the log package writes. It is only used to die, so
+// the message goes to stderr as it is, the locks held are removed, a
+// pager started gets the end of its input and is waited for, and the
+// program exits with exitFatal, before log.Fatal gets to exit with 1.
+type fatalOutput struct{}
+
+func (fatalOutput) Write(message []byte) (int, error) {
+	os.Stderr.Write(message)
+	removeHeldLocks()
+	finishPager()
+	os.Exit(exitFatal)
+	return len(message), nil
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetOutput(fatalOutput{})
+	runCommandLine(os.Args[1:])
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// identity is the "<name> <e-mail> <timestamp> <timezone>" value of author,
+// committer and tagger lines
+type identity struct {
+	name  string
+	email string
+	when  time.Time
+}
+
+func parseIdentity(value string) identity {
+	var person identity
+	emailStart := strings.LastIndex(value, "<")
+	emailEnd := strings.LastIndex(value, ">")
+	if emailStart == -1 || emailEnd < emailStart {
+		person.name = value
+		return person
+	}
+	person.name = strings.TrimSpace(value[:emailStart])
+	person.email = value[emailStart+1 : emailEnd]
+	dateComponents := strings.Fields(value[emailEnd+1:])
+	if len(dateComponents) != 2 {
+		return person
+	}
+	timestamp, err := strconv.ParseInt(dateComponents[0], 10, 64)
+	if err != nil {
+		return person
+	}
+	person.when = time.Unix(timestamp, 0).In(parseTimezone(dateComponents[1]))
+	return person
+}
+
+// parseTimezone turns a "+hhmm" or "-hhmm" offset into a fixed location
+func parseTimezone(zone string) *time.Location {
+	if len(zone) != 5 || (zone[0] != '+' && zone[0] != '-') {
+		return time.UTC
+	}
+	hours, hoursErr := strconv.Atoi(zone[1:3])
+	minutes, minutesErr := strconv.Atoi(zone[3:5])
+	if hoursErr != nil || minutesErr != nil {
+		return time.UTC
+	}
+	offset := hours*3600 + minutes*60
+	if zone[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone("", offset)
+}
+
+// nameAndEmail formats the identity as "<name> <<e-mail>>"
+func (person identity) nameAndEmail() string {
+	return person.name + " <" + person.email + ">"
+}
+
+// String returns the "<name> <e-mail> <timestamp> <timezone>"
+// form stored in objects
+func (person identity) String() string {
+	return person.nameAndEmail() + " " + strconv.FormatInt(person.when.Unix(), 10) + " " + person.when.Format("-0700")
+}
+
+// currentIdentity returns the author or committer (role "AUTHOR" or
+// "COMMITTER") from GIT_<role>_NAME, GIT_<role>_EMAIL and GIT_<role>_DATE,
+// falling back to <role>.name and <role>.email, then user.name and
+// user.email, dated now
+func (repo *Repository) currentIdentity(role string) identity {
+	person := identity{when: time.Now()}
+	section := strings.ToLower(role)
+	var ok bool
+	if person.name, ok = os.LookupEnv("GIT_" + role + "_NAME"); !ok {
+		if person.name, ok = repo.config.get(section + ".name"); !ok {
+			person.name, _ = repo.config.get("user.name")
+		}
+	}
+	if person.email, ok = os.LookupEnv("GIT_" + role + "_EMAIL"); !ok {
+		if person.email, ok = repo.config.get(section + ".email"); !ok {
+			person.email, _ = repo.config.get("user.email")
+		}
+	}
+	if person.name == "" || person.email == "" {
+		log.Fatalf("%s identity unknown\n\n*** Please tell me who you are.\n\nRun\n\n"+
+			"  git config --global user.email \"you@example.com\"\n"+
+			"  git config --global user.name \"Your Name\"\n\n"+
+			"to set your account's default identity.", role[:1]+strings.ToLower(role[1:]))
+	}
+	if date, ok := os.LookupEnv("GIT_" + role + "_DATE"); ok {
+		if person.when, ok = parseDate(date, time.Now()); !ok {
+			log.Fatalf("fatal: invalid date format: %s", date)
+		}
+	}
+	return person
+}
+
+// findAuthor resolves the --author value of commit: "Name <e-mail>", or
+// else a pattern matching the author of an existing commit
+func (repo *Repository) findAuthor(value string) identity {
+	if strings.Contains(value, "<") && strings.HasSuffix(value, ">") {
+		author := parseIdentity(value)
+		author.when = repo.currentIdentity("AUTHOR").when
+		return author
+	}
+	pattern, err := regexp.Compile("(?i)" + value)
+	if err != nil {
+		log.Fatalf("fatal: invalid --author pattern '%s': %s", value, err)
+	}
+	heads := make([]string, 0)
+	for _, name := range append(repo.listRefs("refs/"), "HEAD") {
+		if hash, ok := repo.resolveRef(name); ok {
+			heads = append(heads, repo.peelToCommit(hash))
+		}
+	}
+	iter := newCommitIter(repo, heads, commitOrderDate, false)
+	for {
+		_, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		if pattern.MatchString(commit.author.nameAndEmail()) {
+			author := commit.author
+			author.when = repo.currentIdentity("AUTHOR").when
+			return author
+		}
+	}
+	log.Fatalf("fatal: --author '%s' is not 'Name <email>' and matches no existing author", value)
+	return identity{}
+}
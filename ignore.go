@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type ignorePattern struct {
+	pattern  string
+	base     string // directory of the file the pattern came from, "" for the root
+	negate   bool
+	dirOnly  bool
+	anchored bool // matched against the path below base instead of the basename
+}
+
+// ignoreMatcher decides whether worktree paths are excluded by
+// core.excludesFile, .git/info/exclude and per-directory .gitignore files
+type ignoreMatcher struct {
+	repo         *Repository
+	excludesFile string
+	global       []ignorePattern
+	lock         sync.Mutex
+	perDir       map[string][]ignorePattern
+	ignored      map[string]bool // memoized directory results
+}
+
+func newIgnoreMatcher(repo *Repository) *ignoreMatcher {
+	matcher := &ignoreMatcher{repo: repo, perDir: make(map[string][]ignorePattern), ignored: make(map[string]bool)}
+	excludesFile, ok := repo.config.get("core.excludesFile")
+	if !ok {
+		if xdgHome := os.Getenv("XDG_CONFIG_HOME"); xdgHome != "" {
+			excludesFile = filepath.Join(xdgHome, "git", "ignore")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			excludesFile = filepath.Join(home, ".config", "git", "ignore")
+		}
+	} else if strings.HasPrefix(excludesFile, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			excludesFile = filepath.Join(home, excludesFile[2:])
+		}
+	}
+	matcher.excludesFile = excludesFile
+	if excludesFile != "" {
+		matcher.global = append(matcher.global, readIgnoreFile(excludesFile, "")...)
+	}
+	matcher.global = append(matcher.global, readIgnoreFile(filepath.Join(repo.gitDir, "info", "exclude"), "")...)
+	return matcher
+}
+
+func readIgnoreFile(filePath string, base string) []ignorePattern {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	patterns := make([]ignorePattern, 0)
+	bufScanner := bufio.NewScanner(file)
+	for bufScanner.Scan() {
+		if pattern, ok := parseIgnorePattern(bufScanner.Text(), base); ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if err := bufScanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return patterns
+}
+
+func parseIgnorePattern(line string, base string) (ignorePattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return ignorePattern{}, false
+	}
+	pattern := ignorePattern{base: base}
+	if line[0] == '!' {
+		pattern.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' && len(line) > 1 && (line[1] == '!' || line[1] == '#') {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		pattern.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignorePattern{}, false
+	}
+	pattern.pattern = line
+	return pattern, true
+}
+
+func (matcher *ignoreMatcher) directoryPatterns(dir string) []ignorePattern {
+	matcher.lock.Lock()
+	defer matcher.lock.Unlock()
+	patterns, ok := matcher.perDir[dir]
+	if !ok {
+		patterns = readIgnoreFile(filepath.Join(matcher.repo.workTree, filepath.FromSlash(dir), ".gitignore"), dir)
+		matcher.perDir[dir] = patterns
+	}
+	return patterns
+}
+
+func (pattern ignorePattern) matches(relativePath string, isDir bool) bool {
+	if pattern.dirOnly && !isDir {
+		return false
+	}
+	if pattern.base != "" {
+		if !strings.HasPrefix(relativePath, pattern.base+"/") {
+			return false
+		}
+		relativePath = relativePath[len(pattern.base)+1:]
+	}
+	if pattern.anchored {
+		return wildmatch(pattern.pattern, relativePath, false)
+	}
+	return wildmatch(pattern.pattern, path.Base(relativePath), false)
+}
+
+// isIgnored checks path (slash-separated, relative to the worktree root)
+// against the patterns that apply to it; the last matching pattern wins and
+// deeper .gitignore files take precedence. Parent directories are not
+// checked, callers walking the tree prune ignored directories themselves.
+func (matcher *ignoreMatcher) isIgnored(relativePath string, isDir bool) bool {
+	ignored := false
+	check := func(patterns []ignorePattern) {
+		for _, pattern := range patterns {
+			if pattern.matches(relativePath, isDir) {
+				ignored = !pattern.negate
+			}
+		}
+	}
+	check(matcher.global)
+	check(matcher.directoryPatterns(""))
+	dir := ""
+	components := strings.Split(relativePath, "/")
+	for _, component := range components[:len(components)-1] {
+		dir = path.Join(dir, component)
+		check(matcher.directoryPatterns(dir))
+	}
+	return ignored
+}
+
+// isPathIgnored is like isIgnored but also reports paths inside an ignored
+// directory, whose contents can never be re-included
+func (matcher *ignoreMatcher) isPathIgnored(relativePath string, isDir bool) bool {
+	components := strings.Split(relativePath, "/")
+	dir := ""
+	for _, component := range components[:len(components)-1] {
+		dir = path.Join(dir, component)
+		matcher.lock.Lock()
+		ignored, ok := matcher.ignored[dir]
+		matcher.lock.Unlock()
+		if !ok {
+			ignored = matcher.isIgnored(dir, true)
+			matcher.lock.Lock()
+			matcher.ignored[dir] = ignored
+			matcher.lock.Unlock()
+		}
+		if ignored {
+			return true
+		}
+	}
+	return matcher.isIgnored(relativePath, isDir)
+}
+
+// wildmatch matches text against a shell glob where "*" and "?" never match
+// "/", "[...]" is a character class and "**" spans directories when it forms
+// a whole path component
+func wildmatch(pattern string, text string, ignoreCase bool) bool {
+	if ignoreCase {
+		pattern, text = strings.ToLower(pattern), strings.ToLower(text)
+	}
+	return wildmatchAt(pattern, 0, text, 0)
+}
+
+func wildmatchAt(pattern string, patternPosition int, text string, textPosition int) bool {
+	for patternPosition < len(pattern) {
+		c := pattern[patternPosition]
+		switch c {
+		case '*':
+			isDoubleStar := patternPosition+1 < len(pattern) && pattern[patternPosition+1] == '*'
+			startsComponent := patternPosition == 0 || pattern[patternPosition-1] == '/'
+			endsComponent := patternPosition+2 == len(pattern) || (patternPosition+2 < len(pattern) && pattern[patternPosition+2] == '/')
+			if isDoubleStar && startsComponent && endsComponent {
+				if patternPosition+2 == len(pattern) {
+					// trailing "**" matches everything below
+					return true
+				}
+				// "**/" matches zero or more leading directories
+				rest := patternPosition + 3
+				if wildmatchAt(pattern, rest, text, textPosition) {
+					return true
+				}
+				for i := textPosition; i < len(text); i++ {
+					if text[i] == '/' && wildmatchAt(pattern, rest, text, i+1) {
+						return true
+					}
+				}
+				return false
+			}
+			for patternPosition < len(pattern) && pattern[patternPosition] == '*' {
+				patternPosition++
+			}
+			for i := textPosition; i <= len(text); i++ {
+				if wildmatchAt(pattern, patternPosition, text, i) {
+					return true
+				}
+				if i < len(text) && text[i] == '/' {
+					return false
+				}
+			}
+			return false
+		case '?':
+			if textPosition >= len(text) || text[textPosition] == '/' {
+				return false
+			}
+		case '[':
+			if textPosition >= len(text) || text[textPosition] == '/' {
+				return false
+			}
+			matched, next, ok := matchCharClass(pattern, patternPosition, text[textPosition])
+			if !ok {
+				// an unterminated class is a literal "["
+				if text[textPosition] != '[' {
+					return false
+				}
+			} else {
+				if !matched {
+					return false
+				}
+				patternPosition = next - 1
+			}
+		case '\\':
+			if patternPosition+1 < len(pattern) {
+				patternPosition++
+				c = pattern[patternPosition]
+			}
+			fallthrough
+		default:
+			if textPosition >= len(text) || text[textPosition] != c {
+				return false
+			}
+		}
+		patternPosition++
+		textPosition++
+	}
+	return textPosition == len(text)
+}
+
+func matchCharClass(pattern string, position int, c byte) (bool, int, bool) {
+	// returns whether c is in the class starting at position, the position
+	// after the closing "]" and whether the class was well formed
+	position++
+	negate := false
+	if position < len(pattern) && (pattern[position] == '!' || pattern[position] == '^') {
+		negate = true
+		position++
+	}
+	matched := false
+	first := true
+	for position < len(pattern) {
+		low := pattern[position]
+		if low == ']' && !first {
+			return matched != negate, position + 1, true
+		}
+		first = false
+		if low == '[' && strings.HasPrefix(pattern[position:], "[:") {
+			end := strings.Index(pattern[position+2:], ":]")
+			if end != -1 {
+				if matchNamedClass(pattern[position+2:position+2+end], c) {
+					matched = true
+				}
+				position += end + 4
+				continue
+			}
+		}
+		if low == '\\' && position+1 < len(pattern) {
+			position++
+			low = pattern[position]
+		}
+		high := low
+		if position+2 < len(pattern) && pattern[position+1] == '-' && pattern[position+2] != ']' {
+			high = pattern[position+2]
+			if high == '\\' && position+3 < len(pattern) {
+				position++
+				high = pattern[position+2]
+			}
+			position += 2
+		}
+		if low <= c && c <= high {
+			matched = true
+		}
+		position++
+	}
+	return false, position, false
+}
+
+func matchNamedClass(name string, c byte) bool {
+	switch name {
+	case "alnum":
+		return isAsciiLetter(c) || isAsciiDigit(c)
+	case "alpha":
+		return isAsciiLetter(c)
+	case "digit":
+		return isAsciiDigit(c)
+	case "lower":
+		return 'a' <= c && c <= 'z'
+	case "upper":
+		return 'A' <= c && c <= 'Z'
+	case "space":
+		return c == ' ' || ('\t' <= c && c <= '\r')
+	case "xdigit":
+		return isAsciiDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+	case "punct":
+		return c > ' ' && c < 0x7f && !isAsciiLetter(c) && !isAsciiDigit(c)
+	}
+	return false
+}
+
+func isAsciiLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isAsciiDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	indexFlagAssumeValid = 0x8000
+	indexFlagExtended    = 0x4000
+	indexFlagStageMask   = 0x3000
+	indexFlagNameMask    = 0x0fff
+
+	// extended flags, which only version 3 indexes and later have
+	indexExtendedSkipWorktree = 0x4000
+	indexExtendedIntentToAdd  = 0x2000
+)
+
+type indexEntry struct {
+	ctimeSeconds     uint32
+	ctimeNanoseconds uint32
+	mtimeSeconds     uint32
+	mtimeNanoseconds uint32
+	dev              uint32
+	ino              uint32
+	mode             uint32
+	uid              uint32
+	gid              uint32
+	size             uint32
+	hash             string
+	flags            uint16
+	extendedFlags    uint16
+	path             string
+	fsmonitorValid   bool // unchanged as of the FSMN token
+}
+
+type gitIndex struct {
+	version        uint32
+	entries        []indexEntry
+	modTime        time.Time       // when the index file was last written
+	cacheTree      *cacheTree      // TREE extension, nil when absent
+	untrackedCache *untrackedCache // UNTR extension, nil when absent
+	fsmonitor      *fsmonitorState // FSMN extension, nil when absent
+	modes          worktreeModes   // what the worktree's filesystem records, from the config
+	lock           *lockFile       // index.lock when read with lockIndex, written through on writeIndex
+}
+
+func (entry indexEntry) stage() int {
+	return int(entry.flags&indexFlagStageMask) >> 12
+}
+
+// assumeUnchanged tells whether the entry is taken to match its worktree
+// file without looking at it, as update-index --assume-unchanged marks it
+func (entry indexEntry) assumeUnchanged() bool {
+	return entry.flags&indexFlagAssumeValid != 0
+}
+
+// skipWorktree tells whether the worktree file of the entry is left alone,
+// its content being read from the index instead; sparse checkouts mark the
+// paths outside of them so
+func (entry indexEntry) skipWorktree() bool {
+	return entry.extendedFlags&indexExtendedSkipWorktree != 0
+}
+
+// intentToAdd tells whether the entry only records that its path will be
+// added, as add -N stages it: its content is that of the empty blob and
+// it is left out of the trees written from the index
+func (entry indexEntry) intentToAdd() bool {
+	return entry.extendedFlags&indexExtendedIntentToAdd != 0
+}
+
+// ignoresWorktree tells whether the worktree file of the entry is never
+// compared with it
+func (entry indexEntry) ignoresWorktree() bool {
+	return entry.assumeUnchanged() || entry.skipWorktree()
+}
+
+func (repo *Repository) indexPath() string {
+	return filepath.Join(repo.gitDir, "index")
+}
+
+func (repo *Repository) readIndex() *gitIndex {
+	return repo.readIndexFile(repo.indexPath())
+}
+
+// readIndexFile reads an index other than that of the worktree, like those
+// of linked worktrees
+func (repo *Repository) readIndexFile(indexPath string) *gitIndex {
+	// header format: "DIRC" <4-byte version> <4-byte entry count>
+	// followed by the entries, optional extensions and a trailing sha1
+	content, err := ioutil.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		// no index yet, e.g. before the first add
+		return &gitIndex{version: 2, entries: make([]indexEntry, 0), modes: repo.worktreeModes()}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(content) < 12+ObjectShaLength || !bytes.HasPrefix(content, []byte("DIRC")) {
+		log.Fatal("fatal: index file corrupt: bad signature")
+	}
+	checksum := sha1.Sum(content[:len(content)-ObjectShaLength])
+	if !bytes.Equal(checksum[:], content[len(content)-ObjectShaLength:]) {
+		log.Fatal("fatal: index file corrupt: bad checksum")
+	}
+	index := &gitIndex{version: binary.BigEndian.Uint32(content[4:8]), modes: repo.worktreeModes()}
+	if info, err := os.Stat(indexPath); err == nil {
+		index.modTime = info.ModTime()
+	}
+	if index.version < 2 || index.version > 4 {
+		log.Fatalf("fatal: index file has unsupported version %d", index.version)
+	}
+	entryCount := int(binary.BigEndian.Uint32(content[8:12]))
+	index.entries = make([]indexEntry, 0, entryCount)
+	position := 12
+	previousPath := ""
+	for i := 0; i < entryCount; i++ {
+		var entry indexEntry
+		entry, position = parseIndexEntry(content, position, index.version, previousPath)
+		previousPath = entry.path
+		index.entries = append(index.entries, entry)
+	}
+	// extension format: <4-byte signature> <4-byte size> <data>
+	for position+8 <= len(content)-ObjectShaLength {
+		signature := string(content[position : position+4])
+		size := int(binary.BigEndian.Uint32(content[position+4 : position+8]))
+		data := content[position+8 : position+8+size]
+		switch {
+		case signature == "TREE":
+			index.cacheTree = parseCacheTree(data)
+		case signature == "UNTR":
+			index.untrackedCache = parseUntrackedCache(data)
+		case signature == "FSMN":
+			index.fsmonitor = parseFsmonitorExtension(data, index.entries)
+		case signature[0] < 'A' || signature[0] > 'Z':
+			// extensions starting with a lower-case letter are required to understand the index
+			log.Fatalf("fatal: index uses %s extension, which we do not understand", signature)
+		}
+		position += 8 + size
+	}
+	return index
+}
+
+func parseIndexEntry(content []byte, position int, version uint32, previousPath string) (indexEntry, int) {
+	// entry format: <10 x 4-byte stat fields> <20-byte sha> <2-byte flags>
+	// [<2-byte extended flags> in v3+] <path>
+	// v2/v3 paths are NUL-padded to a multiple of 8 bytes, v4 paths are
+	// prefix-compressed against the previous entry and NUL-terminated
+	start := position
+	fields := make([]uint32, 10)
+	for i := range fields {
+		fields[i] = binary.BigEndian.Uint32(content[position:])
+		position += 4
+	}
+	entry := indexEntry{
+		ctimeSeconds: fields[0], ctimeNanoseconds: fields[1],
+		mtimeSeconds: fields[2], mtimeNanoseconds: fields[3],
+		dev: fields[4], ino: fields[5], mode: fields[6],
+		uid: fields[7], gid: fields[8], size: fields[9],
+	}
+	entry.hash = hex.EncodeToString(content[position : position+ObjectShaLength])
+	position += ObjectShaLength
+	entry.flags = binary.BigEndian.Uint16(content[position:])
+	position += 2
+	if entry.flags&indexFlagExtended != 0 {
+		if version < 3 {
+			log.Fatal("fatal: index file corrupt: extended flags in a version 2 index")
+		}
+		entry.extendedFlags = binary.BigEndian.Uint16(content[position:])
+		position += 2
+	}
+	if version == 4 {
+		// <varint count of bytes to strip from the previous path> <suffix>\0
+		var stripCount int
+		stripCount, position = readVarint(content, position)
+		pathEnd := bytes.IndexByte(content[position:], 0)
+		entry.path = previousPath[:len(previousPath)-stripCount] + string(content[position:position+pathEnd])
+		return entry, position + pathEnd + 1
+	}
+	pathEnd := bytes.IndexByte(content[position:], 0)
+	entry.path = string(content[position : position+pathEnd])
+	position += pathEnd
+	entryLength := position - start
+	return entry, start + (entryLength+8)/8*8
+}
+
+// lockIndex takes index.lock and then reads the index, so that nobody
+// changes it before writeIndex writes it back through the lock; an index
+// that is not written must be given to releaseIndex
+func (repo *Repository) lockIndex() *gitIndex {
+	lock := acquireLock(repo.indexPath())
+	index := repo.readIndex()
+	index.lock = lock
+	return index
+}
+
+// releaseIndex gives up the lock of an index read with lockIndex without
+// writing it
+func (repo *Repository) releaseIndex(index *gitIndex) {
+	if index.lock != nil {
+		index.lock.rollback()
+		index.lock = nil
+	}
+}
+
+func (repo *Repository) writeIndex(index *gitIndex) {
+	content := repo.serializeIndex(index)
+	if index.lock == nil {
+		writeFileAtomically(repo.indexPath(), content)
+		return
+	}
+	if _, err := index.lock.Write(content); err != nil {
+		index.lock.fail(err)
+	}
+	index.lock.commit()
+	index.lock = nil
+}
+
+// writeIndexKeepingLock writes an index read with lockIndex for others to
+// see while keeping it locked for the changes still to come, which a
+// later writeIndex or releaseIndex concludes; an index that is not
+// locked is simply written
+func (repo *Repository) writeIndexKeepingLock(index *gitIndex) {
+	if index.lock == nil {
+		writeFileAtomically(repo.indexPath(), repo.serializeIndex(index))
+		return
+	}
+	index.lock.replaceKeepingLock(repo.serializeIndex(index))
+}
+
+func (repo *Repository) serializeIndex(index *gitIndex) []byte {
+	// entries are written as version 2, or version 3 when any entry needs
+	// extended flags; the TREE, UNTR and FSMN extensions are kept, others
+	// are dropped as they may be stale
+	sort.SliceStable(index.entries, func(i, j int) bool {
+		if index.entries[i].path != index.entries[j].path {
+			return index.entries[i].path < index.entries[j].path
+		}
+		return index.entries[i].stage() < index.entries[j].stage()
+	})
+	version := uint32(2)
+	for _, entry := range index.entries {
+		if entry.extendedFlags != 0 {
+			version = 3
+		}
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("DIRC")
+	binary.Write(&buffer, binary.BigEndian, version)
+	binary.Write(&buffer, binary.BigEndian, uint32(len(index.entries)))
+	for _, entry := range index.entries {
+		start := buffer.Len()
+		binary.Write(&buffer, binary.BigEndian, []uint32{
+			entry.ctimeSeconds, entry.ctimeNanoseconds,
+			entry.mtimeSeconds, entry.mtimeNanoseconds,
+			entry.dev, entry.ino, entry.mode,
+			entry.uid, entry.gid, entry.size,
+		})
+		hashBytes, err := hex.DecodeString(entry.hash)
+		if err != nil {
+			log.Fatal(err)
+		}
+		buffer.Write(hashBytes)
+		flags := entry.flags &^ (indexFlagNameMask | indexFlagExtended)
+		if len(entry.path) < indexFlagNameMask {
+			flags |= uint16(len(entry.path))
+		} else {
+			flags |= indexFlagNameMask
+		}
+		if entry.extendedFlags != 0 {
+			flags |= indexFlagExtended
+		}
+		binary.Write(&buffer, binary.BigEndian, flags)
+		if entry.extendedFlags != 0 {
+			binary.Write(&buffer, binary.BigEndian, entry.extendedFlags)
+		}
+		buffer.WriteString(entry.path)
+		entryLength := buffer.Len() - start
+		buffer.Write(make([]byte, (entryLength+8)/8*8-entryLength))
+	}
+	writeExtension := func(signature string, data []byte) {
+		buffer.WriteString(signature)
+		binary.Write(&buffer, binary.BigEndian, uint32(len(data)))
+		buffer.Write(data)
+	}
+	if index.cacheTree != nil {
+		writeExtension("TREE", index.cacheTree.serialize(nil))
+	}
+	if index.untrackedCache != nil {
+		writeExtension("UNTR", index.untrackedCache.serialize())
+	}
+	if index.fsmonitor != nil && index.fsmonitor.version != 0 && repo.fsmonitorHook() != "" {
+		writeExtension("FSMN", index.fsmonitor.serialize(index.entries))
+	}
+	checksum := sha1.Sum(buffer.Bytes())
+	buffer.Write(checksum[:])
+	index.version = version
+	return buffer.Bytes()
+}
+
+func writeFileAtomically(path string, content []byte) {
+	// write through "<path>.lock" and rename it into place, an existing lock
+	// means another process is updating the same file
+	lock := acquireLock(path)
+	if _, err := lock.Write(content); err != nil {
+		lock.fail(err)
+	}
+	lock.commit()
+}
+
+func (index *gitIndex) find(path string) (int, bool) {
+	// position of the stage-0 entry for path, or where it would be inserted
+	position := sort.Search(len(index.entries), func(i int) bool {
+		return index.entries[i].path >= path
+	})
+	return position, position < len(index.entries) && index.entries[position].path == path
+}
+
+func readVarint(content []byte, position int) (int, int) {
+	// big-endian 7 bits per byte, every continuation adds one before shifting
+	b := content[position]
+	position++
+	value := int(b & 0x7f)
+	for b&0x80 != 0 {
+		b = content[position]
+		position++
+		value = ((value + 1) << 7) | int(b&0x7f)
+	}
+	return value, position
+}
+
+func appendVarint(buffer []byte, value int) []byte {
+	encoded := []byte{byte(value & 0x7f)}
+	for value >>= 7; value > 0; value >>= 7 {
+		value--
+		encoded = append([]byte{byte(0x80 | (value & 0x7f))}, encoded...)
+	}
+	return append(buffer, encoded...)
+}
+
+func newIndexEntry(path string, hash string, mode uint32, info os.FileInfo) indexEntry {
+	entry := indexEntry{path: path, hash: hash, mode: mode}
+	entry.fillStat(info)
+	return entry
+}
+
+func (entry *indexEntry) fillStat(info os.FileInfo) {
+	// only the low 32 bits of each field are kept, as git does
+	modTime := info.ModTime()
+	entry.mtimeSeconds = uint32(modTime.Unix())
+	entry.mtimeNanoseconds = uint32(modTime.Nanosecond())
+	entry.size = uint32(info.Size())
+	fillPlatformStat(entry, info)
+}
+
+// isStatClean reports whether the file still matches the stat data recorded
+// in the index, in which case its content need not be re-hashed
+func (entry indexEntry) isStatClean(info os.FileInfo, modes worktreeModes) bool {
+	var current indexEntry
+	current.fillStat(info)
+	return entry.mtimeSeconds == current.mtimeSeconds &&
+		entry.mtimeNanoseconds == current.mtimeNanoseconds &&
+		entry.ctimeSeconds == current.ctimeSeconds &&
+		entry.ctimeNanoseconds == current.ctimeNanoseconds &&
+		entry.size == current.size &&
+		entry.ino == current.ino &&
+		entry.mode == modes.entryMode(info, entry.mode)
+}
+
+// isUpToDate is isStatClean guarded against racy entries: a file modified
+// within the same timestamp granularity as the index write may have changed
+// without its stat data showing it, so its content must be compared
+func (index *gitIndex) isUpToDate(entry indexEntry, info os.FileInfo) bool {
+	if !entry.isStatClean(info, index.modes) {
+		return false
+	}
+	if index.modTime.IsZero() {
+		return true
+	}
+	indexSeconds := uint32(index.modTime.Unix())
+	indexNanoseconds := uint32(index.modTime.Nanosecond())
+	return entry.mtimeSeconds < indexSeconds ||
+		(entry.mtimeSeconds == indexSeconds && entry.mtimeNanoseconds < indexNanoseconds)
+}
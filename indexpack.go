@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const DefaultUnpackLimit = 100
+
+// packStreamEntry is one entry of a pack read front to back, before the
+// pack has an index to look objects up by
+type packStreamEntry struct {
+	offset       int64
+	packType     int   // pack entry type, deltas included
+	dataSize     int   // inflated size of the entry data
+	dataPosition int64 // start of the zlib data
+	packedSize   int64 // header, base reference and compressed data
+	crc          uint32
+	baseOffset   int64  // for ofs deltas
+	baseHash     string // for ref deltas
+	// filled in once the delta chain is resolved
+	hash       string
+	objectType string
+	size       int
+	depth      int
+	base       string // object the entry is a delta against
+}
+
+func (entry *packStreamEntry) isDelta() bool {
+	return entry.packType == packObjectOfsDelta || entry.packType == packObjectRefDelta
+}
+
+// packStream holds a whole pack in memory while it is indexed or unpacked
+type packStream struct {
+	data    []byte
+	entries []packStreamEntry
+}
+
+func inflatePackData(data []byte, position int64, size int) ([]byte, int64) {
+	// bytes.Reader is an io.ByteReader, so the decompressor does not read
+	// past the end of the zlib stream and the consumed length is exact
+	reader := bytes.NewReader(data[position:])
+	contentReader, err := zlib.NewReader(reader)
+	if err != nil {
+		log.Fatalf("fatal: pack has bad object at offset %d: %s", position, err)
+	}
+	content := make([]byte, size)
+	if _, err := io.ReadFull(contentReader, content); err != nil {
+		log.Fatalf("fatal: pack has bad object at offset %d: %s", position, err)
+	}
+	// reading to the end checks the adler32 trailer of the stream
+	if extra, err := io.Copy(io.Discard, contentReader); err != nil || extra != 0 {
+		log.Fatalf("fatal: pack has bad object at offset %d: inflated size mismatch", position)
+	}
+	return content, int64(len(data)-int(position)) - int64(reader.Len())
+}
+
+// parsePackStream checks the header and trailing checksum of a pack and
+// lists its entries
+func parsePackStream(data []byte, progress Progress) *packStream {
+	// format: "PACK" <4-byte version> <4-byte object count> <entries> <sha1 of everything before>
+	if len(data) < 12+ObjectShaLength || !bytes.HasPrefix(data, []byte("PACK")) {
+		log.Fatal("fatal: pack signature mismatch")
+	}
+	if version := binary.BigEndian.Uint32(data[4:8]); version != 2 && version != 3 {
+		log.Fatalf("fatal: pack version %d unsupported", version)
+	}
+	content := data[:len(data)-ObjectShaLength]
+	if checksum := sha1.Sum(content); !bytes.Equal(checksum[:], data[len(content):]) {
+		log.Fatal("fatal: pack is corrupted (SHA1 mismatch)")
+	}
+	objectCount := int(binary.BigEndian.Uint32(data[8:12]))
+	stream := &packStream{data: data, entries: make([]packStreamEntry, 0, objectCount)}
+	position := int64(12)
+	progress.Start("Indexing objects", objectCount)
+	for i := 0; i < objectCount; i++ {
+		if position >= int64(len(content)) {
+			log.Fatal("fatal: premature end of pack file")
+		}
+		entry := packStreamEntry{offset: position}
+		// same varint header as packFile.readEntryHeader
+		b := content[position]
+		position++
+		entry.packType = int(b>>4) & 7
+		entry.dataSize = int(b & 0x0f)
+		for shift := uint(4); b&0x80 != 0; shift += 7 {
+			if position >= int64(len(content)) {
+				log.Fatal("fatal: premature end of pack file")
+			}
+			b = content[position]
+			position++
+			entry.dataSize |= int(b&0x7f) << shift
+		}
+		switch entry.packType {
+		case packObjectOfsDelta:
+			b = content[position]
+			position++
+			relativeOffset := int64(b & 0x7f)
+			for b&0x80 != 0 {
+				b = content[position]
+				position++
+				relativeOffset = ((relativeOffset + 1) << 7) | int64(b&0x7f)
+			}
+			entry.baseOffset = entry.offset - relativeOffset
+			if relativeOffset <= 0 || entry.baseOffset < 12 {
+				log.Fatalf("fatal: delta base offset out of bound for entry at %d", entry.offset)
+			}
+		case packObjectRefDelta:
+			entry.baseHash = hex.EncodeToString(content[position : position+ObjectShaLength])
+			position += ObjectShaLength
+		default:
+			if _, ok := packObjectTypeNames[entry.packType]; !ok {
+				log.Fatalf("fatal: unknown object type %d at offset %d", entry.packType, entry.offset)
+			}
+		}
+		entry.dataPosition = position
+		_, consumed := inflatePackData(content, position, entry.dataSize)
+		position += consumed
+		entry.packedSize = position - entry.offset
+		entry.crc = crc32.ChecksumIEEE(content[entry.offset:position])
+		stream.entries = append(stream.entries, entry)
+		progress.Add(1, entry.packedSize)
+	}
+	progress.Stop()
+	if position != int64(len(content)) {
+		log.Fatal("fatal: pack has junk at the end")
+	}
+	return stream
+}
+
+// resolve computes the id of every entry, applying deltas from their bases
+// down; visit, when not nil, sees every object once with its content.
+// Ref deltas against objects outside the pack are resolved through
+// externalBase, and unresolved ones are returned by base hash.
+func (stream *packStream) resolve(externalBase func(hash string) (string, []byte, bool), visit func(entry *packStreamEntry, content []byte), progress Progress) map[string][]int {
+	childrenByOffset := make(map[int64][]int)
+	childrenByHash := make(map[string][]int)
+	deltaCount := 0
+	for i := range stream.entries {
+		entry := &stream.entries[i]
+		switch entry.packType {
+		case packObjectOfsDelta:
+			childrenByOffset[entry.baseOffset] = append(childrenByOffset[entry.baseOffset], i)
+			deltaCount++
+		case packObjectRefDelta:
+			childrenByHash[entry.baseHash] = append(childrenByHash[entry.baseHash], i)
+			deltaCount++
+		}
+	}
+	progress.Start("Resolving deltas", deltaCount)
+	var resolveChildren func(base *packStreamEntry, content []byte)
+	resolveChildren = func(base *packStreamEntry, content []byte) {
+		children := append(childrenByOffset[base.offset], childrenByHash[base.hash]...)
+		delete(childrenByHash, base.hash)
+		for _, childIndex := range children {
+			child := &stream.entries[childIndex]
+			if child.hash != "" {
+				continue
+			}
+			delta, _ := inflatePackData(stream.data, child.dataPosition, child.dataSize)
+			result := applyDelta(content, delta)
+			child.objectType = base.objectType
+			child.size = len(result)
+			child.hash = hashObject(child.objectType, result)
+			child.depth = base.depth + 1
+			child.base = base.hash
+			progress.Add(1, child.packedSize)
+			if visit != nil {
+				visit(child, result)
+			}
+			resolveChildren(child, result)
+		}
+	}
+	for i := range stream.entries {
+		entry := &stream.entries[i]
+		if entry.isDelta() {
+			continue
+		}
+		content, _ := inflatePackData(stream.data, entry.dataPosition, entry.dataSize)
+		entry.objectType = packObjectTypeNames[entry.packType]
+		entry.size = len(content)
+		entry.hash = hashObject(entry.objectType, content)
+		if visit != nil {
+			visit(entry, content)
+		}
+		resolveChildren(entry, content)
+	}
+	if externalBase != nil {
+		baseHashes := make([]string, 0, len(childrenByHash))
+		for baseHash := range childrenByHash {
+			baseHashes = append(baseHashes, baseHash)
+		}
+		sort.Strings(baseHashes)
+		for _, baseHash := range baseHashes {
+			objectType, content, ok := externalBase(baseHash)
+			if !ok {
+				continue
+			}
+			// the base only exists to resolve the children, it is not one
+			// of the pack's entries
+			base := &packStreamEntry{offset: -1, hash: baseHash, objectType: objectType, size: len(content)}
+			resolveChildren(base, content)
+		}
+	}
+	progress.Stop()
+	unresolved := make(map[string][]int)
+	for i := range stream.entries {
+		if entry := &stream.entries[i]; entry.hash == "" {
+			unresolved[entry.baseHash] = append(unresolved[entry.baseHash], i)
+		}
+	}
+	return unresolved
+}
+
+// encodePackEntry stores a whole object as a pack entry: the type and size
+// header followed by the zlib-compressed content
+// packTypeFor returns the pack entry type of an object type
+func packTypeFor(objectType string) int {
+	for packType, name := range packObjectTypeNames {
+		if name == objectType {
+			return packType
+		}
+	}
+	return 0
+}
+
+func encodePackEntry(objectType string, content []byte) (int, []byte) {
+	packType := packTypeFor(objectType)
+	var entryData bytes.Buffer
+	entryData.Write(packEntryHeader(packType, len(content)))
+	contentWriter := zlib.NewWriter(&entryData)
+	contentWriter.Write(content)
+	contentWriter.Close()
+	return packType, entryData.Bytes()
+}
+
+// appendObject adds a whole object to the end of the pack, updating the
+// object count and trailing checksum; used to complete thin packs
+func (stream *packStream) appendObject(objectType string, content []byte) {
+	packType, entryData := encodePackEntry(objectType, content)
+	offset := int64(len(stream.data) - ObjectShaLength)
+	data := append(stream.data[:offset:offset], entryData...)
+	binary.BigEndian.PutUint32(data[8:12], uint32(len(stream.entries)+1))
+	checksum := sha1.Sum(data)
+	stream.data = append(data, checksum[:]...)
+	stream.entries = append(stream.entries, packStreamEntry{
+		offset:     offset,
+		packType:   packType,
+		dataSize:   len(content),
+		packedSize: int64(len(entryData)),
+		crc:        crc32.ChecksumIEEE(entryData),
+		hash:       hashObject(objectType, content),
+		objectType: objectType,
+		size:       len(content),
+	})
+}
+
+func (stream *packStream) checksum() string {
+	return hex.EncodeToString(stream.data[len(stream.data)-ObjectShaLength:])
+}
+
+// indexPackStream resolves every entry of the pack; fixThin completes a
+// thin pack by appending the missing delta bases from the repository
+func (repo *Repository) indexPackStream(stream *packStream, fixThin bool, progress Progress) {
+	var externalBase func(hash string) (string, []byte, bool)
+	if fixThin {
+		externalBase = func(hash string) (string, []byte, bool) {
+			if !repo.hasObject(hash) {
+				return "", nil, false
+			}
+			header, content := repo.readOriginalObject(hash)
+			return header.objectType, content, true
+		}
+	}
+	unresolved := stream.resolve(externalBase, nil, progress)
+	if len(unresolved) > 0 {
+		count := 0
+		for _, children := range unresolved {
+			count += len(children)
+		}
+		log.Fatalf("fatal: pack has %d unresolved deltas", count)
+	}
+	if !fixThin {
+		return
+	}
+	// every ref delta whose base is not an entry of the pack gets that base
+	// appended, so the pack stands on its own again
+	inPack := make(map[string]bool, len(stream.entries))
+	for _, entry := range stream.entries {
+		inPack[entry.hash] = true
+	}
+	missing := make([]string, 0)
+	for _, entry := range stream.entries {
+		if entry.packType == packObjectRefDelta && !inPack[entry.baseHash] {
+			inPack[entry.baseHash] = true
+			missing = append(missing, entry.baseHash)
+		}
+	}
+	sort.Strings(missing)
+	for _, baseHash := range missing {
+		header, content := repo.readOriginalObject(baseHash)
+		stream.appendObject(header.objectType, content)
+	}
+}
+
+// writePackIndex writes a version 2 .idx for the resolved entries
+func writePackIndex(path string, stream *packStream) {
+	entries := make([]*packStreamEntry, len(stream.entries))
+	for i := range stream.entries {
+		entries[i] = &stream.entries[i]
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+	var buffer bytes.Buffer
+	buffer.WriteString("\377tOc")
+	binary.Write(&buffer, binary.BigEndian, uint32(2))
+	var fanout [256]uint32
+	for _, entry := range entries {
+		first, _ := hex.DecodeString(entry.hash[:2])
+		fanout[first[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&buffer, binary.BigEndian, fanout)
+	for _, entry := range entries {
+		hash, _ := hex.DecodeString(entry.hash)
+		buffer.Write(hash)
+	}
+	for _, entry := range entries {
+		binary.Write(&buffer, binary.BigEndian, entry.crc)
+	}
+	largeOffsets := make([]uint64, 0)
+	for _, entry := range entries {
+		if entry.offset < 0x80000000 {
+			binary.Write(&buffer, binary.BigEndian, uint32(entry.offset))
+			continue
+		}
+		binary.Write(&buffer, binary.BigEndian, uint32(0x80000000|len(largeOffsets)))
+		largeOffsets = append(largeOffsets, uint64(entry.offset))
+	}
+	binary.Write(&buffer, binary.BigEndian, largeOffsets)
+	buffer.Write(stream.data[len(stream.data)-ObjectShaLength:])
+	checksum := sha1.Sum(buffer.Bytes())
+	buffer.Write(checksum[:])
+	writeFileAtomically(path, buffer.Bytes())
+}
+
+// keepPack stores a received pack and its index under objects/pack and
+// returns the pack checksum naming them
+func (repo *Repository) keepPack(stream *packStream) string {
+	checksum := stream.checksum()
+	packPath := filepath.Join(repo.gitDir, "objects", "pack", "pack-"+checksum)
+	if err := os.MkdirAll(filepath.Dir(packPath), 0777); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stat(packPath + ".pack"); err != nil {
+		writeFileAtomically(packPath+".pack", stream.data)
+	}
+	writePackIndex(packPath+".idx", stream)
+	return checksum
+}
+
+// unpackStream writes every object of the pack as a loose object, ref
+// deltas may use bases that already exist in the repository
+func (repo *Repository) unpackStream(stream *packStream, dryRun bool, progress Progress) {
+	externalBase := func(hash string) (string, []byte, bool) {
+		if !repo.hasObject(hash) {
+			return "", nil, false
+		}
+		header, content := repo.readOriginalObject(hash)
+		return header.objectType, content, true
+	}
+	progress.Start("Unpacking objects", len(stream.entries))
+	unresolved := stream.resolve(externalBase, func(entry *packStreamEntry, content []byte) {
+		if !dryRun {
+			repo.writeObject(entry.objectType, content)
+		}
+		progress.Add(1, entry.packedSize)
+	}, noProgress{})
+	progress.Stop()
+	if len(unresolved) > 0 {
+		count := 0
+		for _, children := range unresolved {
+			count += len(children)
+		}
+		log.Fatalf("fatal: unresolved deltas left after unpacking: %d", count)
+	}
+}
+
+// storeReceivedPack is how fetch and push keep what they receive: packs
+// with fewer objects than fetch.unpackLimit or transfer.unpackLimit are
+// exploded into loose objects, bigger ones are kept and indexed
+func (repo *Repository) storeReceivedPack(data []byte, progress Progress) {
+	limit := repo.config.getInt("transfer.unpackLimit", DefaultUnpackLimit)
+	limit = repo.config.getInt("fetch.unpackLimit", limit)
+	stream := parsePackStream(data, noProgress{})
+	if int64(len(stream.entries)) < limit {
+		repo.unpackStream(stream, false, progress)
+		return
+	}
+	repo.indexPackStream(stream, true, progress)
+	repo.keepPack(stream)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"container/heap"
+)
+
+// treeWalker walks a tree object depth-first, descending into nested trees
+// and accumulating the path of every entry relative to the root tree.
+type treeWalker struct {
+	repo  *Repository
+	stack []treeWalkerFrame
+}
+
+type treeWalkerFrame struct {
+	prefix  string
+	entries []treeEntry
+	next    int
+}
+
+func newTreeWalker(repo *Repository, treeHash string) *treeWalker {
+	return &treeWalker{repo, []treeWalkerFrame{{"", repo.readTreeEntries(treeHash), 0}}}
+}
+
+// next returns the next entry along with its full path. A tree entry is
+// returned before any of its children; ok is false once the walk is done.
+func (walker *treeWalker) next() (path string, entry treeEntry, ok bool) {
+	for len(walker.stack) > 0 {
+		frame := &walker.stack[len(walker.stack)-1]
+		if frame.next == len(frame.entries) {
+			walker.stack = walker.stack[:len(walker.stack)-1]
+			continue
+		}
+		entry = frame.entries[frame.next]
+		frame.next++
+		path = frame.prefix + entry.name
+		if entry.mode == "40000" {
+			walker.stack = append(walker.stack, treeWalkerFrame{path + "/", walker.repo.readTreeEntries(entry.hash), 0})
+		}
+		return path, entry, true
+	}
+	return "", treeEntry{}, false
+}
+
+type commitOrder int
+
+const (
+	// newest committer date first
+	commitOrderDate commitOrder = iota
+	// children always before their parents, without intermixing lines of
+	// history
+	commitOrderTopo
+	// children always before their parents, newest committer date first
+	commitOrderTopoDate
+	// children always before their parents, newest author date first
+	commitOrderTopoAuthorDate
+)
+
+// commitIter walks the history reachable from a set of commits, visiting
+// every commit once in the configured order.
+type commitIter struct {
+	repo    *Repository
+	queue   commitQueue
+	seen    map[string]bool
+	ordered []string // precomputed order for topo and reverse walks
+	commits map[string]commitObject
+	follow  func(hash string, commit commitObject) []string // the parents to go on to, nil for all
+}
+
+type queuedCommit struct {
+	hash     string
+	commit   commitObject
+	sequence int // ties go to the commit queued first, as in git
+}
+
+// commitQueue is a max-heap on committer time
+type commitQueue []queuedCommit
+
+func (queue commitQueue) Len() int { return len(queue) }
+func (queue commitQueue) Less(i, j int) bool {
+	if !queue[i].commit.committer.when.Equal(queue[j].commit.committer.when) {
+		return queue[i].commit.committer.when.After(queue[j].commit.committer.when)
+	}
+	return queue[i].sequence < queue[j].sequence
+}
+func (queue commitQueue) Swap(i, j int)       { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *commitQueue) Push(x interface{}) { *queue = append(*queue, x.(queuedCommit)) }
+func (queue *commitQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return item
+}
+
+func newCommitIter(repo *Repository, heads []string, order commitOrder, reverse bool) *commitIter {
+	return newSimplifiedCommitIter(repo, heads, order, reverse, nil)
+}
+
+// newSimplifiedCommitIter walks like newCommitIter but goes on from each
+// commit only to the parents follow returns, as history simplification
+// does for path limited logs
+func newSimplifiedCommitIter(repo *Repository, heads []string, order commitOrder, reverse bool, follow func(hash string, commit commitObject) []string) *commitIter {
+	iter := &commitIter{repo: repo, seen: make(map[string]bool), follow: follow}
+	for _, hash := range heads {
+		iter.push(hash)
+	}
+	if order == commitOrderDate && !reverse {
+		// date order can be produced lazily
+		return iter
+	}
+	iter.commits = make(map[string]commitObject)
+	var ordered []string
+	for {
+		hash, commit, ok := iter.nextByDate()
+		if !ok {
+			break
+		}
+		iter.commits[hash] = commit
+		ordered = append(ordered, hash)
+	}
+	if order != commitOrderDate {
+		ordered = iter.sortTopologically(ordered, order)
+	}
+	if reverse {
+		reverseHashes(ordered)
+	}
+	iter.ordered = ordered
+	return iter
+}
+
+func reverseHashes(hashes []string) {
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+}
+
+func (iter *commitIter) push(hash string) {
+	if iter.seen[hash] {
+		return
+	}
+	iter.seen[hash] = true
+	heap.Push(&iter.queue, queuedCommit{hash, iter.repo.readCommitObject(hash), len(iter.seen)})
+}
+
+func (iter *commitIter) nextByDate() (string, commitObject, bool) {
+	if iter.queue.Len() == 0 {
+		return "", commitObject{}, false
+	}
+	item := heap.Pop(&iter.queue).(queuedCommit)
+	parents := item.commit.parents
+	if iter.follow != nil {
+		parents = iter.follow(item.hash, item.commit)
+	}
+	for _, parent := range parents {
+		iter.push(parent)
+	}
+	return item.hash, item.commit, true
+}
+
+// sortTopologically orders walked commits so that every commit follows
+// all of its children, as git's sort_in_topological_order does: a commit
+// is ready once its last child is out, and of the ready commits the one
+// made ready last is next for topo order, the newest one for the date
+// orders. Commits ready at the same time keep the order of the walk.
+func (iter *commitIter) sortTopologically(walked []string, order commitOrder) []string {
+	// the in-degree is 1 plus the number of children still to come out
+	indegree := make(map[string]int, len(walked))
+	for _, hash := range walked {
+		indegree[hash] = 1
+	}
+	for _, hash := range walked {
+		for _, parent := range iter.commits[hash].parents {
+			if indegree[parent] > 0 {
+				indegree[parent]++
+			}
+		}
+	}
+
+	queue := &readyQueue{}
+	switch order {
+	case commitOrderTopoDate:
+		queue.newer = func(a, b commitObject) bool { return a.committer.when.After(b.committer.when) }
+	case commitOrderTopoAuthorDate:
+		queue.newer = func(a, b commitObject) bool { return a.author.when.After(b.author.when) }
+	}
+	tips := make([]string, 0)
+	for _, hash := range walked {
+		if indegree[hash] == 1 {
+			tips = append(tips, hash)
+		}
+	}
+	if queue.newer == nil {
+		// the stack pops the last tip first but tips show in walk order
+		reverseHashes(tips)
+	}
+	for _, hash := range tips {
+		queue.put(hash, iter.commits[hash])
+	}
+
+	ordered := make([]string, 0, len(walked))
+	for queue.Len() > 0 {
+		item := queue.get()
+		for _, parent := range item.commit.parents {
+			if indegree[parent] == 0 {
+				// not part of the walk
+				continue
+			}
+			indegree[parent]--
+			if indegree[parent] == 1 {
+				queue.put(parent, iter.commits[parent])
+			}
+		}
+		indegree[item.hash] = 0
+		ordered = append(ordered, item.hash)
+	}
+	return ordered
+}
+
+// readyQueue holds the commits sortTopologically may show next: a stack
+// when newer is nil, otherwise a heap on newer, ties going to the commit
+// queued first
+type readyQueue struct {
+	items []queuedCommit
+	newer func(a, b commitObject) bool
+	count int
+}
+
+func (queue *readyQueue) Len() int { return len(queue.items) }
+func (queue *readyQueue) Less(i, j int) bool {
+	a, b := queue.items[i], queue.items[j]
+	if queue.newer(a.commit, b.commit) {
+		return true
+	}
+	if queue.newer(b.commit, a.commit) {
+		return false
+	}
+	return a.sequence < b.sequence
+}
+func (queue *readyQueue) Swap(i, j int) {
+	queue.items[i], queue.items[j] = queue.items[j], queue.items[i]
+}
+func (queue *readyQueue) Push(x interface{}) { queue.items = append(queue.items, x.(queuedCommit)) }
+func (queue *readyQueue) Pop() interface{} {
+	item := queue.items[len(queue.items)-1]
+	queue.items = queue.items[:len(queue.items)-1]
+	return item
+}
+
+func (queue *readyQueue) put(hash string, commit commitObject) {
+	item := queuedCommit{hash, commit, queue.count}
+	queue.count++
+	if queue.newer == nil {
+		queue.items = append(queue.items, item)
+		return
+	}
+	heap.Push(queue, item)
+}
+
+func (queue *readyQueue) get() queuedCommit {
+	if queue.newer == nil {
+		return queue.Pop().(queuedCommit)
+	}
+	return heap.Pop(queue).(queuedCommit)
+}
+
+// next returns the next commit in the walk; ok is false once every
+// reachable commit has been visited.
+func (iter *commitIter) next() (hash string, commit commitObject, ok bool) {
+	if iter.commits == nil {
+		return iter.nextByDate()
+	}
+	if len(iter.ordered) == 0 {
+		return "", commitObject{}, false
+	}
+	hash = iter.ordered[0]
+	iter.ordered = iter.ordered[1:]
+	return hash, iter.commits[hash], true
+}
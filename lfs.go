@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lfsPointerVersion is the first line of the pointer files git-lfs stores
+// in blobs in place of the content it keeps outside the repository
+const lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+
+// lfsPointer names the content a pointer file stands for by its sha256
+type lfsPointer struct {
+	oid  string
+	size int64
+}
+
+func (pointer lfsPointer) String() string {
+	return fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, pointer.oid, pointer.size)
+}
+
+// parseLFSPointer recognizes a pointer file: small, its first line the
+// version, "key value" lines with at least an oid and a size after it
+func parseLFSPointer(content []byte) (lfsPointer, bool) {
+	if len(content) >= 1024 || !bytes.HasSuffix(content, []byte("\n")) {
+		return lfsPointer{}, false
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if lines[0] != lfsPointerVersion && lines[0] != "version https://hawser.github.com/spec/v1" {
+		return lfsPointer{}, false
+	}
+	var pointer lfsPointer
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			return lfsPointer{}, false
+		}
+		switch key {
+		case "oid":
+			oid := strings.TrimPrefix(value, "sha256:")
+			if len(oid) != 64 || !isHexString(oid) {
+				return lfsPointer{}, false
+			}
+			pointer.oid = oid
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return lfsPointer{}, false
+			}
+			pointer.size = size
+		}
+	}
+	return pointer, pointer.oid != ""
+}
+
+// lfsObjectPath is where the content of a pointer is kept,
+// lfs/objects/<oid[0:2]>/<oid[2:4]>/<oid> as git-lfs keeps it
+func (repo *Repository) lfsObjectPath(oid string) string {
+	return filepath.Join(repo.gitDir, "lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+// builtinLFSFilter stands in for git-lfs when it is not set up: clean
+// keeps the content in the lfs object store and stores its pointer, smudge
+// puts the content back in place of the pointer, from the store or else
+// downloaded from the lfs server. Content that cannot be had leaves the
+// pointer in the worktree.
+func (repo *Repository) builtinLFSFilter(relativePath string, kind string, content []byte) []byte {
+	if kind == "clean" {
+		if _, ok := parseLFSPointer(content); ok {
+			return content
+		}
+		sum := sha256.Sum256(content)
+		pointer := lfsPointer{hex.EncodeToString(sum[:]), int64(len(content))}
+		objectPath := repo.lfsObjectPath(pointer.oid)
+		if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+			if err := repo.writeLFSObject(pointer, bytes.NewReader(content)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return []byte(pointer.String())
+	}
+	pointer, ok := parseLFSPointer(content)
+	if !ok || os.Getenv("GIT_LFS_SKIP_SMUDGE") == "1" {
+		return content
+	}
+	object, err := os.ReadFile(repo.lfsObjectPath(pointer.oid))
+	if os.IsNotExist(err) {
+		if err = repo.downloadLFSObject(pointer); err == nil {
+			object, err = os.ReadFile(repo.lfsObjectPath(pointer.oid))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s: cannot get the Git LFS object %s: %s\n", relativePath, pointer.oid, err)
+		return content
+	}
+	return object
+}
+
+// writeLFSObject adds content to the lfs object store, through a
+// temporary file so that only content matching its oid gets there
+func (repo *Repository) writeLFSObject(pointer lfsPointer, content io.Reader) error {
+	objectPath := repo.lfsObjectPath(pointer.oid)
+	tempDir := filepath.Join(repo.gitDir, "lfs", "tmp")
+	for _, dir := range []string{filepath.Dir(objectPath), tempDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			log.Fatal(err)
+		}
+	}
+	tempFile, err := ioutil.TempFile(tempDir, pointer.oid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hasher), content)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if oid := hex.EncodeToString(hasher.Sum(nil)); oid != pointer.oid || size != pointer.size {
+		return fmt.Errorf("got %d bytes with oid %s", size, oid)
+	}
+	return os.Rename(tempFile.Name(), objectPath)
+}
+
+// lfsEndpoint returns the url of the lfs server: lfs.url, then the lfsurl
+// of the remote, or else the one git-lfs derives from the remote's url,
+// "<url>.git/info/lfs". Only http and https servers are reached.
+func (repo *Repository) lfsEndpoint() (string, bool) {
+	if url, ok := repo.config.get("lfs.url"); ok {
+		return url, true
+	}
+	remote := "origin"
+	if branch, ok := repo.headBranch(); ok {
+		if name, ok := repo.config.get("branch." + branch + ".remote"); ok {
+			remote = name
+		}
+	}
+	if url, ok := repo.config.get("remote." + remote + ".lfsurl"); ok {
+		return url, true
+	}
+	url, ok := repo.config.get("remote." + remote + ".url")
+	if !ok || !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return "", false
+	}
+	url = strings.TrimSuffix(url, "/")
+	if !strings.HasSuffix(url, ".git") {
+		url += ".git"
+	}
+	return url + "/info/lfs", true
+}
+
+// lfsBatchResponse is what the batch api of an lfs server answers, the
+// way to get each object or why it cannot be had
+type lfsBatchResponse struct {
+	Objects []struct {
+		Oid     string `json:"oid"`
+		Size    int64  `json:"size"`
+		Actions struct {
+			Download *struct {
+				Href   string            `json:"href"`
+				Header map[string]string `json:"header"`
+			} `json:"download"`
+		} `json:"actions"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"objects"`
+	Message string `json:"message"`
+}
+
+// downloadLFSObject gets the content of a pointer from the lfs server with
+// the basic transfer adapter: the batch api says where to download it
+// from, and what was downloaded goes to the object store once it matches
+// the pointer
+func (repo *Repository) downloadLFSObject(pointer lfsPointer) error {
+	endpoint, ok := repo.lfsEndpoint()
+	if !ok {
+		return fmt.Errorf("no Git LFS server is known")
+	}
+	request, err := json.Marshal(map[string]interface{}{
+		"operation": "download",
+		"transfers": []string{"basic"},
+		"objects":   []map[string]interface{}{{"oid": pointer.oid, "size": pointer.size}},
+	})
+	if err != nil {
+		return err
+	}
+	batch, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+"/objects/batch", bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	batch.Header.Set("Accept", "application/vnd.git-lfs+json")
+	batch.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+	response, err := http.DefaultClient.Do(batch)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var answer lfsBatchResponse
+	if err := json.NewDecoder(response.Body).Decode(&answer); err != nil {
+		return fmt.Errorf("batch request failed: %s", response.Status)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("batch request failed: %s %s", response.Status, answer.Message)
+	}
+	for _, object := range answer.Objects {
+		if object.Oid != pointer.oid {
+			continue
+		}
+		if object.Error != nil {
+			return fmt.Errorf("%d %s", object.Error.Code, object.Error.Message)
+		}
+		if object.Actions.Download == nil {
+			return fmt.Errorf("the server has no download for it")
+		}
+		download, err := http.NewRequest("GET", object.Actions.Download.Href, nil)
+		if err != nil {
+			return err
+		}
+		for key, value := range object.Actions.Download.Header {
+			download.Header.Set(key, value)
+		}
+		content, err := http.DefaultClient.Do(download)
+		if err != nil {
+			return err
+		}
+		defer content.Body.Close()
+		if content.StatusCode != http.StatusOK {
+			return fmt.Errorf("download failed: %s", content.Status)
+		}
+		return repo.writeLFSObject(pointer, content.Body)
+	}
+	return fmt.Errorf("the server did not answer for it")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// lockFile is the "<path>.lock" file through which a file is replaced: its
+// new content is written there and renamed into place on commit. Creating
+// the lock fails while another process holds it, as in git, while
+// goroutines of this process locking the same path wait in turn for it, so
+// that a Repository can be updated from several goroutines at once.
+type lockFile struct {
+	path  string // the file the lock replaces
+	file  *os.File
+	mutex *sync.Mutex
+}
+
+// heldLocks has a mutex for each path locked by this process, and the
+// locks it holds, which are removed when it dies with the files given to
+// removeAtExit
+var heldLocks struct {
+	sync.Mutex
+	paths       map[string]*sync.Mutex
+	held        map[*lockFile]bool
+	exitRemoved map[string]bool
+}
+
+func pathMutex(path string) *sync.Mutex {
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	if heldLocks.paths == nil {
+		heldLocks.paths = make(map[string]*sync.Mutex)
+	}
+	mutex, ok := heldLocks.paths[path]
+	if !ok {
+		mutex = &sync.Mutex{}
+		heldLocks.paths[path] = mutex
+	}
+	return mutex
+}
+
+func createLockFile(path string, mutex *sync.Mutex) (*lockFile, error) {
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		mutex.Unlock()
+		return nil, err
+	}
+	lock := &lockFile{path: path, file: file, mutex: mutex}
+	heldLocks.Lock()
+	if heldLocks.held == nil {
+		heldLocks.held = make(map[*lockFile]bool)
+	}
+	heldLocks.held[lock] = true
+	heldLocks.Unlock()
+	return lock, nil
+}
+
+// release forgets a lock that was committed or rolled back
+func (lock *lockFile) release() {
+	heldLocks.Lock()
+	delete(heldLocks.held, lock)
+	heldLocks.Unlock()
+	lock.mutex.Unlock()
+}
+
+// removeHeldLocks removes the locks still held when the program dies, so
+// that a failed command does not leave them behind like git
+func removeHeldLocks() {
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	for lock := range heldLocks.held {
+		lock.file.Close()
+		os.Remove(lock.path + ".lock")
+	}
+	for path := range heldLocks.exitRemoved {
+		os.Remove(path)
+	}
+}
+
+// removeAtExit has a file removed if the program dies before it is done
+// with it and calls removeExitFile, like the gc.pid of a running gc
+func removeAtExit(path string) {
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	if heldLocks.exitRemoved == nil {
+		heldLocks.exitRemoved = make(map[string]bool)
+	}
+	heldLocks.exitRemoved[path] = true
+}
+
+func removeExitFile(path string) {
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	delete(heldLocks.exitRemoved, path)
+	os.Remove(path)
+}
+
+// acquireLock locks path, waiting for the goroutines of this process
+// holding it and failing when another process does
+func acquireLock(path string) *lockFile {
+	mutex := pathMutex(path)
+	mutex.Lock()
+	lock, err := createLockFile(path, mutex)
+	if os.IsExist(err) {
+		log.Fatal(lockExistsMessage(path + ".lock"))
+	}
+	if err != nil {
+		log.Fatalf("fatal: Unable to create '%s': %s", path+".lock", err)
+	}
+	return lock
+}
+
+// lockExistsMessage is what git says when a lock is taken, with a word on
+// locks old enough to be stale. A lock file is the new content of the file
+// it locks, so unlike gc.pid it cannot name its owner: its age is all that
+// tells a crashed process from one that is still running.
+func lockExistsMessage(lockPath string) string {
+	message := fmt.Sprintf(`fatal: Unable to create '%s': File exists.
+
+Another git process seems to be running in this repository, e.g.
+an editor opened by 'git commit'. Please make sure all processes
+are terminated then try again. If it still fails, a git process
+may have crashed in this repository earlier:
+remove the file manually to continue.`, lockPath)
+	if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+		message += fmt.Sprintf("\nIt was last modified %s, over an hour ago, so it may be stale:\n'%s worktree prune --force' removes lock files that old.",
+			info.ModTime().Format("2006-01-02 15:04:05"), programName())
+	}
+	return message
+}
+
+// tryLock locks path unless somebody else, in this process or not, holds it
+func tryLock(path string) (*lockFile, bool) {
+	mutex := pathMutex(path)
+	if !mutex.TryLock() {
+		return nil, false
+	}
+	lock, err := createLockFile(path, mutex)
+	return lock, err == nil
+}
+
+func (lock *lockFile) Write(data []byte) (int, error) {
+	return lock.file.Write(data)
+}
+
+// commit replaces the locked file with what was written to the lock
+func (lock *lockFile) commit() {
+	defer lock.release()
+	lockPath := lock.path + ".lock"
+	if err := lock.file.Close(); err != nil {
+		os.Remove(lockPath)
+		log.Fatal(err)
+	}
+	if err := os.Rename(lockPath, lock.path); err != nil {
+		os.Remove(lockPath)
+		log.Fatal(err)
+	}
+}
+
+// replaceKeepingLock replaces the locked file with content while the lock
+// stays held, through "<path>.new" as git does for packed-refs, for changes
+// that must be seen before others may lock the file again
+func (lock *lockFile) replaceKeepingLock(content []byte) {
+	newPath := lock.path + ".new"
+	if err := os.WriteFile(newPath, content, 0666); err != nil {
+		os.Remove(newPath)
+		lock.fail(err)
+	}
+	if err := os.Rename(newPath, lock.path); err != nil {
+		os.Remove(newPath)
+		lock.fail(err)
+	}
+}
+
+// rollback removes the lock, leaving the locked file as it was
+func (lock *lockFile) rollback() {
+	defer lock.release()
+	lock.file.Close()
+	os.Remove(lock.path + ".lock")
+}
+
+// fail rolls the lock back and exits with err
+func (lock *lockFile) fail(err error) {
+	lock.rollback()
+	log.Fatal(err)
+}
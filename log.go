@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type jsonIdentity struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+type jsonCommit struct {
+	Commit    string       `json:"commit"`
+	Tree      string       `json:"tree"`
+	Parents   []string     `json:"parents"`
+	Author    jsonIdentity `json:"author"`
+	Committer jsonIdentity `json:"committer"`
+	Message   string       `json:"message"`
+	Notes     string       `json:"notes,omitempty"`
+}
+
+func newJSONIdentity(person identity) jsonIdentity {
+	return jsonIdentity{person.name, person.email, person.when}
+}
+
+func newJSONCommit(hash string, commit commitObject) jsonCommit {
+	parents := commit.parents
+	if parents == nil {
+		parents = []string{}
+	}
+	return jsonCommit{
+		Commit:    hash,
+		Tree:      commit.tree,
+		Parents:   parents,
+		Author:    newJSONIdentity(commit.author),
+		Committer: newJSONIdentity(commit.committer),
+		Message:   commit.commitMessage,
+	}
+}
+
+// logDiffOptions are the diffs log shows below every commit
+type logDiffOptions struct {
+	patch       bool   // show the changes of each commit
+	stat        bool   // show a diffstat of them
+	raw         bool   // show them in the raw format of whatchanged
+	combined    string // "combined" or "cc" to show merges as combined diffs, empty to show no diff for them
+	renameScore int    // the similarity a rename needs in maxRenameScore units, 0 for no rename detection
+	diff        diffOptions
+	paths       []pathspec // the paths whose changes are shown, all when empty
+	follow      bool       // renames are detected among all changes, to show the one to the file followed
+}
+
+// shows tells whether the options show any diff at all
+func (options logDiffOptions) shows() bool {
+	return options.patch || options.stat || options.raw
+}
+
+// commitChanges lists the changes of a commit other than a merge against
+// its parent, or the empty tree for a root commit, limited to the paths
+// and with renames detected as the options ask
+func (repo *Repository) commitChanges(commit commitObject, options logDiffOptions) []fileChange {
+	parentTree := ""
+	if len(commit.parents) > 0 {
+		parentTree = repo.readCommitObject(commit.parents[0]).tree
+	}
+	all := repo.diffTrees(parentTree, commit.tree)
+	if options.follow && options.renameScore > 0 {
+		all = repo.detectRenames(all, options.renameScore)
+	}
+	changes := make([]fileChange, 0)
+	for _, change := range all {
+		if matchesPathspecs(change.path, options.paths) {
+			changes = append(changes, change)
+		}
+	}
+	if !options.follow && options.renameScore > 0 {
+		changes = repo.detectRenames(changes, options.renameScore)
+	}
+	return changes
+}
+
+// writeRawChange writes a change the way "--raw" does:
+// ":<old mode> <new mode> <old object> <new object> <status>\t<path>",
+// renames with their similarity and both paths
+func writeRawChange(w io.Writer, change fileChange) {
+	fmt.Fprintf(w, ":%06o %06o %s %s %c", change.oldMode, change.newMode, abbreviateHash(change.oldHash), abbreviateHash(change.newHash), change.status())
+	if change.oldPath != "" {
+		fmt.Fprintf(w, "%03d\t%s", change.similarity, quotePath(change.oldPath))
+	}
+	fmt.Fprintf(w, "\t%s\n", quotePath(change.path))
+}
+
+// writeLogDiff shows the changes of a commit below it, against the empty
+// tree for a root commit: raw, then the diffstat, then the patch, each of
+// them when asked for. Like git, a blank line separates them from the
+// message, except after a oneline one when not a merge, and "---" does
+// when a diffstat comes with a patch.
+func (repo *Repository) writeLogDiff(w io.Writer, commit commitObject, pretty prettyFormat, options logDiffOptions) {
+	if !options.shows() {
+		return
+	}
+	separate := pretty.preset != "" || pretty.format != ""
+	if len(commit.parents) > 1 {
+		if options.combined == "" {
+			return
+		}
+		// the blank line shows even when no path differs from every parent
+		if separate {
+			fmt.Fprintln(w)
+		}
+		for _, changes := range repo.mergeChanges(commit) {
+			if matchesPathspecs(changes[0].path, options.paths) {
+				repo.writeCombinedDiff(w, changes, options.combined == "cc", options.diff)
+			}
+		}
+		return
+	}
+	changes := repo.commitChanges(commit, options)
+	if len(changes) == 0 {
+		return
+	}
+	if separate && pretty.preset != "oneline" {
+		if options.stat && options.patch {
+			fmt.Fprintln(w, "---")
+		} else {
+			fmt.Fprintln(w)
+		}
+	}
+	if options.raw {
+		for _, change := range changes {
+			writeRawChange(w, change)
+		}
+	}
+	if options.stat {
+		stats := make([]fileStat, len(changes))
+		for i, change := range changes {
+			stats[i] = repo.diffStat(change)
+		}
+		writeDiffStat(w, stats, 80, options.diff.colors)
+	}
+	if !options.patch {
+		return
+	}
+	if options.raw || options.stat {
+		fmt.Fprintln(w)
+	}
+	for _, change := range changes {
+		repo.writePatch(w, change, options.diff)
+	}
+}
+
+// simplifyHistory follows the history of the paths the pathspecs select the
+// way git does by default: a commit that has the same paths as one of its
+// parents is left out and only that parent is followed. The map tells the
+// commits walked so far which are shown.
+//
+// The changed-path filters of the commit-graph save comparing trees with
+// the first parent for most of the commits not changing literal paths.
+func (repo *Repository) simplifyHistory(specs []pathspec) (func(hash string, commit commitObject) []string, map[string]bool) {
+	shown := make(map[string]bool)
+	graph := repo.loadCommitGraph()
+	var keys [][][]uint32
+	filtered := false
+	if graph.bloomVersion != 0 {
+		keys, filtered = pathspecBloomKeys(specs, graph.bloomVersion, graph.bloomHashCount)
+	}
+	follow := func(hash string, commit commitObject) []string {
+		if len(commit.parents) == 0 {
+			shown[hash] = !(filtered && repo.changedPathsOutside(hash, keys)) && repo.treesDifferIn("", commit.tree, specs)
+			return nil
+		}
+		for i, parent := range commit.parents {
+			if i == 0 && filtered && repo.changedPathsOutside(hash, keys) {
+				return []string{parent}
+			}
+			if !repo.treesDifferIn(repo.readCommitObject(parent).tree, commit.tree, specs) {
+				return []string{parent}
+			}
+		}
+		shown[hash] = true
+		return commit.parents
+	}
+	return follow, shown
+}
+
+// followRenames follows the history of a single file across renames, as
+// --follow does: like simplifyHistory for its path, except that when a
+// parent does not have the file, renames are detected against that parent
+// and the file it was renamed from is followed there. The second map
+// tells the commits walked so far which are shown, the third the path the
+// file has in each of them.
+func (repo *Repository) followRenames(followed string, renameScore int) (func(hash string, commit commitObject) []string, map[string]bool, map[string]string) {
+	shown := make(map[string]bool)
+	paths := make(map[string]string)
+	follow := func(hash string, commit commitObject) []string {
+		file, ok := paths[hash]
+		if !ok {
+			file = followed
+			paths[hash] = file
+		}
+		mode, blob := repo.treeEntryAt(commit.tree, file)
+		if len(commit.parents) == 0 {
+			shown[hash] = blob != ""
+			return nil
+		}
+		parentPaths := make([]string, len(commit.parents))
+		for i, parent := range commit.parents {
+			parentTree := repo.readCommitObject(parent).tree
+			parentPaths[i] = file
+			parentMode, parentBlob := repo.treeEntryAt(parentTree, file)
+			if parentBlob == "" && blob != "" {
+				for _, change := range repo.detectRenames(repo.diffTrees(parentTree, commit.tree), renameScore) {
+					if change.path == file && change.oldPath != "" {
+						parentPaths[i] = change.oldPath
+					}
+				}
+			}
+			if parentPaths[i] == file && parentMode == mode && parentBlob == blob {
+				if _, walked := paths[parent]; !walked {
+					paths[parent] = file
+				}
+				return []string{parent}
+			}
+		}
+		shown[hash] = true
+		for i, parent := range commit.parents {
+			if _, walked := paths[parent]; !walked {
+				paths[parent] = parentPaths[i]
+			}
+		}
+		return commit.parents
+	}
+	return follow, shown, paths
+}
+
+// treeEntryAt returns the mode and object of the entry at a path below
+// tree, empty when there is none
+func (repo *Repository) treeEntryAt(tree string, file string) (string, string) {
+	if slash := strings.LastIndexByte(file, '/'); slash >= 0 {
+		tree = repo.treeAtPath(tree, file[:slash])
+		file = file[slash+1:]
+	}
+	if tree == "" {
+		return "", ""
+	}
+	for _, entry := range repo.readTreeEntries(tree) {
+		if entry.name == file {
+			return entry.mode, entry.hash
+		}
+	}
+	return "", ""
+}
+
+// treesDifferIn tells whether two trees differ in any path the pathspecs
+// select
+func (repo *Repository) treesDifferIn(oldTree string, newTree string, specs []pathspec) bool {
+	for _, change := range repo.diffTrees(oldTree, newTree) {
+		if matchesPathspecs(change.path, specs) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// listIndexFiles prints the paths in the index below the given pathspecs,
+// with mode, hash and stage when showStage is set and after a status tag
+// with showTags
+func (repo *Repository) listIndexFiles(pathspecs []pathspec, options lsFilesOptions, printer pathPrinter) {
+	index := repo.readIndex()
+	for _, entry := range index.entries {
+		if !matchesPathspecs(entry.path, pathspecs) {
+			continue
+		}
+		record := printer.path(entry.path)
+		if options.showStage {
+			record = fmt.Sprintf("%06o %s %d\t%s", entry.mode, entry.hash, entry.stage(), record)
+		}
+		if options.showTags {
+			record = indexEntryTag(entry, options.lowercaseAssumeUnchanged) + " " + record
+		}
+		printer.printRecord(record)
+	}
+}
+
+type lsFilesOptions struct {
+	showStage                bool
+	showTags                 bool
+	lowercaseAssumeUnchanged bool // tag assume-unchanged entries in lowercase
+}
+
+// indexEntryTag is the status ls-files -t shows before an entry
+func indexEntryTag(entry indexEntry, lowercaseAssumeUnchanged bool) string {
+	tag := "H"
+	switch {
+	case entry.stage() != 0:
+		tag = "M"
+	case entry.skipWorktree():
+		tag = "S"
+	}
+	if lowercaseAssumeUnchanged && entry.assumeUnchanged() {
+		return strings.ToLower(tag)
+	}
+	return tag
+}
+
+type lsTreeOptions struct {
+	recursive bool
+	showTrees bool // show trees while recursing
+	nameOnly  bool
+	pathspecs []string
+}
+
+// listTree prints the entries of a tree in ls-tree format; trees are only
+// descended into when recursive is set
+func (repo *Repository) listTree(treeHash string, options lsTreeOptions, printer pathPrinter) {
+	walker := newTreeWalker(repo, treeHash)
+	for {
+		path, entry, ok := walker.next()
+		if !ok {
+			break
+		}
+		isTree := entry.mode == "40000"
+		if !options.isListed(path, isTree) {
+			continue
+		}
+		if options.nameOnly {
+			printer.printRecord(printer.path(path))
+			continue
+		}
+		printer.printRecord(fmt.Sprintf("%06o %s %s\t%s", parseFileMode(entry.mode), treeEntryType(entry.mode), entry.hash, printer.path(path)))
+	}
+}
+
+// treeEntryType is the type of the object a tree entry points at: a
+// submodule's commit for gitlinks, a blob for files and symlinks alike
+func treeEntryType(mode string) string {
+	switch parseFileMode(mode) {
+	case fileModeTree:
+		return "tree"
+	case fileModeGitlink:
+		return "commit"
+	}
+	return "blob"
+}
+
+// isListed applies ls-tree's path rules: without recursion only the top
+// level, an entry named exactly or the contents of a directory named with a
+// trailing slash are shown
+func (options lsTreeOptions) isListed(path string, isTree bool) bool {
+	if options.recursive {
+		if isTree && !options.showTrees {
+			return false
+		}
+		return matchesAnyPathspec(path, options.pathspecs) || (isTree && isPathspecAncestor(path, options.pathspecs))
+	}
+	parent := ""
+	if slash := strings.LastIndex(path, "/"); slash != -1 {
+		parent = path[:slash+1]
+	}
+	if len(options.pathspecs) == 0 {
+		return parent == ""
+	}
+	for _, pathspec := range options.pathspecs {
+		if path == strings.TrimSuffix(pathspec, "/") && !strings.HasSuffix(pathspec, "/") || parent != "" && parent == pathspec {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyPathspec(path string, pathspecs []string) bool {
+	if len(pathspecs) == 0 {
+		return true
+	}
+	for _, pathspec := range pathspecs {
+		if isUnderPathspec(path, strings.TrimSuffix(pathspec, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPathspecAncestor reports whether the directory path leads to one of the
+// pathspecs, so it has to be shown or descended into to reach it
+func isPathspecAncestor(path string, pathspecs []string) bool {
+	for _, pathspec := range pathspecs {
+		if strings.HasPrefix(pathspec, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveTreeish resolves a revision to a tree, peeling tags and commits
+func (repo *Repository) resolveTreeish(revision string) string {
+	hash := repo.resolveRevision(revision)
+	for {
+		header, content := repo.readObject(hash)
+		switch header.objectType {
+		case "tree":
+			return hash
+		case "commit":
+			return parseCommitObject(content).tree
+		case "tag":
+			firstLine := strings.SplitN(string(content), "\n", 2)[0]
+			hash = strings.TrimPrefix(firstLine, "object ")
+		default:
+			log.Fatalf("fatal: not a tree object: %s", revision)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultGcAuto          = 6700
+	DefaultGcAutoPackLimit = 50
+)
+
+type maintenanceOptions struct {
+	auto  bool // only run tasks whose auto condition says they are needed
+	quiet bool
+}
+
+// maintenanceTask is one step of "maintenance run"; needed is the --auto
+// check, defaultAuto the threshold used when maintenance.<name>.auto is
+// not configured
+type maintenanceTask struct {
+	name             string
+	enabledByDefault bool
+	defaultAuto      int64
+	needed           func(repo *Repository, threshold int64) bool
+	run              func(repo *Repository, options maintenanceOptions)
+}
+
+// maintenanceTasks in the order git runs them
+var maintenanceTasks = []maintenanceTask{
+	{"loose-objects", false, 100, (*Repository).needsLooseObjectsTask, (*Repository).packLooseObjects},
+	{"incremental-repack", false, 10, (*Repository).needsIncrementalRepack, (*Repository).incrementalRepack},
+	{"gc", true, 0, func(repo *Repository, threshold int64) bool { return repo.needsGc() }, func(repo *Repository, options maintenanceOptions) {
+		repo.gc(gcOptions{auto: options.auto, quiet: options.quiet})
+	}},
+	{"commit-graph", false, 100, (*Repository).needsCommitGraph, (*Repository).updateCommitGraph},
+}
+
+func findMaintenanceTask(name string) (maintenanceTask, bool) {
+	for _, task := range maintenanceTasks {
+		if task.name == name {
+			return task, true
+		}
+	}
+	return maintenanceTask{}, false
+}
+
+// runMaintenance runs the named tasks, or those enabled through
+// maintenance.<task>.enabled when none are named
+func (repo *Repository) runMaintenance(taskNames []string, options maintenanceOptions) {
+	tasks := make([]maintenanceTask, 0)
+	if len(taskNames) == 0 {
+		for _, task := range maintenanceTasks {
+			if repo.config.getBool("maintenance."+task.name+".enabled", task.enabledByDefault) {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	for _, name := range taskNames {
+		task, ok := findMaintenanceTask(name)
+		if !ok {
+			log.Fatalf("error: '%s' is not a valid task", name)
+		}
+		tasks = append(tasks, task)
+	}
+	// runs at the same time would repack the same objects, the later one
+	// leaves it to the first like git
+	lock, ok := tryLock(filepath.Join(repo.gitDir, "objects", "maintenance"))
+	if !ok {
+		fmt.Fprintf(os.Stderr, "error: lock file '%s' exists, skipping maintenance\n", filepath.Join(repo.gitDir, "objects", "maintenance.lock"))
+		return
+	}
+	defer lock.rollback()
+	for _, task := range tasks {
+		if options.auto {
+			threshold := repo.config.getInt("maintenance."+task.name+".auto", task.defaultAuto)
+			if threshold < 0 || !task.needed(repo, threshold) {
+				continue
+			}
+		}
+		endRegion := traceRegion("maintenance " + task.name)
+		task.run(repo, options)
+		endRegion()
+	}
+}
+
+// autoMaintenance is run after commands that write many loose objects,
+// like git does after commit and fetch; maintenance.auto turns it off
+func (repo *Repository) autoMaintenance() {
+	if !repo.config.getBool("maintenance.auto", true) {
+		return
+	}
+	repo.runMaintenance(nil, maintenanceOptions{auto: true, quiet: !isTerminal(os.Stderr)})
+}
+
+func (repo *Repository) needsLooseObjectsTask(threshold int64) bool {
+	return threshold > 0 && int64(len(repo.looseObjects())) >= threshold
+}
+
+// packLooseObjects is the loose-objects task: loose objects that already
+// are in a pack are removed, the others are collected into a new pack and
+// removed by the next run
+func (repo *Repository) packLooseObjects(options maintenanceOptions) {
+	repo.prunePacked()
+	hashes := repo.looseObjects()
+	if len(hashes) == 0 {
+		return
+	}
+	const batchSize = 50000
+	if len(hashes) > batchSize {
+		hashes = hashes[:batchSize]
+	}
+	repo.keepPack(repo.buildPack(packObjectsFor(hashes), repo.deltaOptions(), newProgress(options.quiet)))
+	repo.reloadPackFiles()
+}
+
+// prunePacked removes loose objects that also exist in a pack
+func (repo *Repository) prunePacked() {
+	for _, hash := range repo.looseObjects() {
+		if repo.isPackedObject(hash) {
+			path := filepath.Join(repo.gitDir, "objects", hash[:2], hash[2:])
+			if err := os.Remove(path); err != nil {
+				log.Fatal(err)
+			}
+			// only succeeds once the fan-out directory is empty
+			os.Remove(filepath.Dir(path))
+		}
+	}
+}
+
+func (repo *Repository) needsIncrementalRepack(threshold int64) bool {
+	packs := repo.repackablePacks()
+	defer repo.releasePacks(packs)
+	return threshold > 0 && int64(len(packs)) >= threshold
+}
+
+// repackablePacks are the packs of the repository that have no .keep file,
+// smallest first, held like packFiles does
+func (repo *Repository) repackablePacks() []*packFile {
+	packs := make([]*packFile, 0)
+	kept := make([]*packFile, 0)
+	for _, pack := range repo.ownPacks() {
+		if !pack.isKept() {
+			packs = append(packs, pack)
+		} else {
+			kept = append(kept, pack)
+		}
+	}
+	repo.releasePacks(kept)
+	sort.SliceStable(packs, func(i, j int) bool { return len(packs[i].index.offsets) < len(packs[j].index.offsets) })
+	return packs
+}
+
+// incrementalRepack is the incremental-repack task. Without a
+// multi-pack-index it combines every pack but the biggest one into a new
+// pack, so the number of packs stays small without rewriting everything.
+func (repo *Repository) incrementalRepack(options maintenanceOptions) {
+	packs := repo.repackablePacks()
+	defer repo.releasePacks(packs)
+	if len(packs) < 3 {
+		return
+	}
+	small := packs[:len(packs)-1]
+	seen := make(map[string]bool)
+	hashes := make([]string, 0)
+	for _, pack := range small {
+		for _, hash := range pack.objectHashes() {
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	checksum := repo.keepPack(repo.buildPack(packObjectsFor(hashes), repo.deltaOptions(), newProgress(options.quiet)))
+	repo.removePacksExcept(small, checksum)
+}
+
+// removePacksExcept deletes packs after their objects were written to the
+// pack named by keptChecksum, and reloads the pack list
+func (repo *Repository) removePacksExcept(packs []*packFile, keptChecksum string) {
+	keptPath := filepath.Join(repo.gitDir, "objects", "pack", "pack-"+keptChecksum)
+	repo.reloadPackFiles()
+	for _, pack := range packs {
+		if pack.path != keptPath {
+			removePack(pack)
+		}
+	}
+	repo.reloadPackFiles()
+}
+
+func (repo *Repository) needsCommitGraph(threshold int64) bool {
+	if threshold == 0 {
+		return true
+	}
+	inGraph := repo.commitGraphCommits()
+	missing := int64(0)
+	for _, head := range repo.refTipCommits() {
+		for hash := range repo.reachableCommits(head) {
+			if !inGraph[hash] {
+				missing++
+			}
+		}
+		if missing >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+func (repo *Repository) updateCommitGraph(options maintenanceOptions) {
+	count := repo.writeCommitGraph(repo.refTipCommits(), repo.hasChangedPaths())
+	if !options.quiet {
+		fmt.Fprintf(os.Stderr, "Wrote commit-graph with %d commits\n", count)
+	}
+}
+
+// refTipCommits returns the commits HEAD and the refs point to, peeling
+// tags and skipping refs to other objects
+func (repo *Repository) refTipCommits() []string {
+	refs := append([]string{"HEAD"}, repo.listRefs("refs/")...)
+	seen := make(map[string]bool)
+	tips := make([]string, 0)
+	for _, ref := range refs {
+		hash, ok := repo.resolveRef(ref)
+		if !ok || !repo.hasObject(hash) {
+			continue
+		}
+		hash, _ = repo.peelTags(hash)
+		if header, _ := repo.readObject(hash); header.objectType != "commit" || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		tips = append(tips, hash)
+	}
+	return tips
+}
+
+type gcOptions struct {
+	auto        bool
+	force       bool   // run even if another gc seems to be running
+	pruneExpire string // --prune value, empty for gc.pruneExpire
+	aggressive  bool   // search deltas harder, with gc.aggressiveWindow and gc.aggressiveDepth
+	window      *int   // --window value, nil for pack.window
+	depth       *int   // --depth value, nil for pack.depth
+	quiet       bool
+}
+
+// gcDeltaOptions are the delta search settings of the repack of gc
+func (repo *Repository) gcDeltaOptions(options gcOptions) packDeltaOptions {
+	deltaOptions := repo.deltaOptions()
+	if options.aggressive {
+		deltaOptions.window = int(repo.config.getInt("gc.aggressiveWindow", 250))
+		deltaOptions.depth = int(repo.config.getInt("gc.aggressiveDepth", 50))
+	}
+	if options.window != nil {
+		deltaOptions.window = *options.window
+	}
+	if options.depth != nil {
+		deltaOptions.depth = *options.depth
+	}
+	return deltaOptions.checked()
+}
+
+// needsGc is the gc.auto check: too many loose objects, estimated from
+// the objects/17 fan-out directory like git does, or too many packs
+func (repo *Repository) needsGc() bool {
+	limit := repo.config.getInt("gc.auto", DefaultGcAuto)
+	if limit <= 0 {
+		return false
+	}
+	files, _ := os.ReadDir(filepath.Join(repo.gitDir, "objects", "17"))
+	looseCount := int64(0)
+	for _, file := range files {
+		if isFullHash("17" + file.Name()) {
+			looseCount++
+		}
+	}
+	if looseCount > (limit+255)/256 {
+		return true
+	}
+	packLimit := repo.config.getInt("gc.autoPackLimit", DefaultGcAutoPackLimit)
+	packs := repo.repackablePacks()
+	defer repo.releasePacks(packs)
+	return packLimit > 0 && int64(len(packs)) > packLimit
+}
+
+// gcPidAge is how long a gc.pid keeps other gc runs out, after which the
+// gc that wrote it is taken to have died, as in git
+const gcPidAge = 12 * time.Hour
+
+// lockForGc writes gc.pid, the process and machine of the gc running,
+// unless another gc is: one of another machine, or a process of this one
+// still alive, that wrote gc.pid less than gcPidAge ago. It returns the
+// machine and process of that gc.
+func (repo *Repository) lockForGc(force bool) (string, int, bool) {
+	path := filepath.Join(repo.gitDir, "gc.pid")
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	lock := acquireLock(path)
+	if info, err := os.Stat(path); err == nil && !force && time.Since(info.ModTime()) <= gcPidAge {
+		content, _ := os.ReadFile(path)
+		var pid int
+		var runningHost string
+		if count, _ := fmt.Sscanf(string(content), "%d %s", &pid, &runningHost); count == 2 && (runningHost != hostname || processExists(pid)) {
+			lock.rollback()
+			return runningHost, pid, false
+		}
+	}
+	fmt.Fprintf(lock, "%d %s", os.Getpid(), hostname)
+	lock.commit()
+	removeAtExit(path)
+	return "", 0, true
+}
+
+// gc packs refs, expires reflogs, repacks everything into one pack and
+// prunes unreachable loose objects older than gc.pruneExpire
+func (repo *Repository) gc(options gcOptions) {
+	if options.auto {
+		if !repo.needsGc() {
+			return
+		}
+		if !options.quiet {
+			fmt.Fprintln(os.Stderr, "Auto packing the repository for optimum performance.")
+			fmt.Fprintln(os.Stderr, "See \"git help gc\" for manual housekeeping.")
+		}
+	}
+	runningHost, pid, ok := repo.lockForGc(options.force)
+	if !ok {
+		if options.auto {
+			// the gc running does what this one would
+			return
+		}
+		log.Fatalf("fatal: gc is already running on machine '%s' pid %d (use --force if not)", runningHost, pid)
+	}
+	defer removeExitFile(filepath.Join(repo.gitDir, "gc.pid"))
+	now := time.Now()
+	pruneExpire := repo.expiryOption(options.pruneExpire, "gc.pruneExpire", "2.weeks.ago", now)
+	if repo.config.getBool("gc.packRefs", true) {
+		repo.packRefs(true, true)
+	}
+	expireOptions := reflogExpireOptions{
+		expire:            repo.expiryOption("", "gc.reflogExpire", "90.days.ago", now),
+		expireUnreachable: repo.expiryOption("", "gc.reflogExpireUnreachable", "30.days.ago", now),
+	}
+	for _, ref := range repo.listReflogs() {
+		repo.expireReflog(ref, expireOptions)
+	}
+	reachable := repo.reachableObjects(nil)
+	repo.repackAll(reachable, pruneExpire, repo.gcDeltaOptions(options), options.quiet)
+	repo.prune(reachable, pruneOptions{expire: pruneExpire})
+	repo.pruneWorktrees(worktreePruneOptions{expire: repo.expiryOption("", "gc.worktreePruneExpire", "3.months.ago", now), quiet: options.quiet})
+	if repo.config.getBool("gc.writeCommitGraph", true) {
+		repo.writeCommitGraph(repo.refTipCommits(), repo.hasChangedPaths())
+	}
+}
+
+// refObjects lists what the refs and HEAD reach in the order of rev-list
+// --objects, with paths
+func (repo *Repository) refObjects() []packObject {
+	// the refs are resolved once, as one deleted meanwhile has to be left out
+	var walk revisionWalk
+	for _, name := range append(repo.listRefs("refs/"), "HEAD") {
+		if hash, ok := repo.resolveRef(name); ok && repo.hasObject(hash) {
+			header, _ := repo.readObject(hash)
+			walk.included = append(walk.included, listedObject{hash, header.objectType, name})
+		}
+	}
+	objects := make([]packObject, 0)
+	for _, object := range repo.listObjects(walk, true) {
+		objects = append(objects, packObject{object.hash, object.path})
+	}
+	return objects
+}
+
+// repackAll writes every reachable object of the repository into a single
+// new pack and removes the old packs, like git repack -a -d -l. Unreachable
+// objects from old packs are written back as loose objects dated like
+// their pack so prune decides about them, unless the pack is already older
+// than expire.
+func (repo *Repository) repackAll(reachable map[string]bool, expire time.Time, deltaOptions packDeltaOptions, quiet bool) {
+	oldPacks := repo.repackablePacks()
+	defer repo.releasePacks(oldPacks)
+	ownPacks := repo.ownPacks()
+	defer repo.releasePacks(ownPacks)
+	keptObjects := make(map[string]bool)
+	for _, pack := range ownPacks {
+		if pack.isKept() {
+			for _, hash := range pack.objectHashes() {
+				keptObjects[hash] = true
+			}
+		}
+	}
+	hashes := make([]string, 0)
+	added := make(map[string]bool)
+	add := func(hash string) {
+		if !added[hash] && !keptObjects[hash] {
+			added[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+	for _, hash := range repo.looseObjects() {
+		if reachable[hash] {
+			add(hash)
+		}
+	}
+	for _, pack := range oldPacks {
+		info, err := os.Stat(pack.path + ".pack")
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, hash := range pack.objectHashes() {
+			if reachable[hash] {
+				add(hash)
+			} else if !keptObjects[hash] && !info.ModTime().Before(expire) {
+				repo.loosenObject(hash, info.ModTime())
+			}
+		}
+	}
+	if len(hashes) == 0 {
+		repo.removePacksExcept(oldPacks, "")
+		return
+	}
+	// in the order rev-list --objects lists what the refs reach, as git
+	// writes packs, with the paths that guide the delta search; what only
+	// reflogs and the index reach comes after it, commits first, then tags,
+	// trees and blobs
+	objects := make([]packObject, 0, len(hashes))
+	listed := make(map[string]bool, len(hashes))
+	for _, object := range repo.refObjects() {
+		if added[object.hash] && !listed[object.hash] {
+			listed[object.hash] = true
+			objects = append(objects, object)
+		}
+	}
+	typeOrder := map[string]int{"commit": 0, "tag": 1, "tree": 2, "blob": 3}
+	types := make(map[string]int, len(hashes))
+	rest := make([]string, 0)
+	for _, hash := range hashes {
+		if !listed[hash] {
+			header, _ := repo.readOriginalObject(hash)
+			types[hash] = typeOrder[header.objectType]
+			rest = append(rest, hash)
+		}
+	}
+	sort.SliceStable(rest, func(i, j int) bool { return types[rest[i]] < types[rest[j]] })
+	objects = append(objects, packObjectsFor(rest)...)
+	checksum := repo.keepPack(repo.buildPack(objects, deltaOptions, newProgress(quiet)))
+	repo.removePacksExcept(oldPacks, checksum)
+}
+
+// loosenObject writes a packed object as a loose object with the given
+// modification time
+func (repo *Repository) loosenObject(hash string, modified time.Time) {
+	if _, ok := repo.looseObjectPath(hash); ok {
+		return
+	}
+	header, content := repo.readOriginalObject(hash)
+	repo.writeObject(header.objectType, content)
+	path := filepath.Join(repo.gitDir, "objects", hash[:2], hash[2:])
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// treeUpdate is the version a merge gives a path, mode 0 removing it
+type treeUpdate struct {
+	path string
+	mode uint32
+	hash string
+}
+
+// treeConflict is a path a merge could not settle: its conflict stages,
+// for whichever of the base, ours and theirs have it, and what the
+// worktree file becomes, nil content leaving it as it is
+type treeConflict struct {
+	path    string
+	stages  []indexEntry
+	mode    uint32
+	content []byte
+}
+
+// treeMerge is what carrying the changes between two trees over to an
+// index comes to, with what git says of the paths merged on the way
+type treeMerge struct {
+	updates   []treeUpdate
+	conflicts []treeConflict
+	messages  []string
+}
+
+// conflictPaths lists the paths of the conflicts, in order
+func (merge treeMerge) conflictPaths() []string {
+	paths := make([]string, len(merge.conflicts))
+	for i, conflict := range merge.conflicts {
+		paths[i] = conflict.path
+	}
+	return paths
+}
+
+// mergeTreeChanges works out how the changes between two trees carry
+// over to the index: a path the index still has as in the old tree takes
+// the new version, one that differs in both is merged line by line, and
+// where that leaves conflicts, or one side deleted what the other changed,
+// the path conflicts. The labels name the sides in conflict markers.
+func (repo *Repository) mergeTreeChanges(index *gitIndex, oldTree string, newTree string, labels mergeLabels) treeMerge {
+	merge := treeMerge{updates: make([]treeUpdate, 0), conflicts: make([]treeConflict, 0)}
+	for _, change := range repo.diffTrees(oldTree, newTree) {
+		var ours indexEntry
+		if position, ok := index.find(change.path); ok {
+			ours = index.entries[position]
+		}
+		conflict := treeConflict{path: change.path, mode: ours.mode}
+		for stage, side := range []indexEntry{{mode: change.oldMode, hash: change.oldHash}, ours, {mode: change.newMode, hash: change.newHash}} {
+			if side.mode != 0 {
+				conflict.stages = append(conflict.stages, indexEntry{path: change.path, mode: side.mode, hash: side.hash, flags: uint16(stage+1) << 12})
+			}
+		}
+		switch {
+		case ours.mode == change.oldMode && ours.hash == change.oldHash:
+			merge.updates = append(merge.updates, treeUpdate{change.path, change.newMode, change.newHash})
+			continue
+		case ours.mode == change.newMode && ours.hash == change.newHash:
+			continue
+		case ours.mode == 0 || change.newMode == 0:
+			deletedBy, modifiedBy := labels.ours, labels.theirs
+			if change.newMode == 0 {
+				deletedBy, modifiedBy = labels.theirs, labels.ours
+			} else {
+				// like git, the version that is still there is left
+				conflict.mode, conflict.content = change.newMode, repo.blobContent(change.newHash)
+			}
+			merge.messages = append(merge.messages, fmt.Sprintf("CONFLICT (modify/delete): %s deleted in %s and modified in %s.  Version %s of %s left in tree.",
+				change.path, deletedBy, modifiedBy, modifiedBy, change.path))
+		case ours.mode == fileModeGitlink || change.newMode == fileModeGitlink:
+			merge.messages = append(merge.messages, "CONFLICT (submodule): Merge conflict in "+change.path)
+		case ours.mode == fileModeSymlink || change.newMode == fileModeSymlink ||
+			change.oldMode != 0 && ours.mode != change.oldMode && change.newMode != change.oldMode && ours.mode != change.newMode:
+			// neither symbolic links nor files whose modes clash are merged,
+			// ours stays
+			merge.messages = append(merge.messages, "CONFLICT (content): Merge conflict in "+change.path)
+		default:
+			kind := "content"
+			if change.oldMode == 0 {
+				kind = "add/add"
+			}
+			merge.messages = append(merge.messages, "Auto-merging "+change.path)
+			base, theirs, ourContent := repo.blobContent(change.oldHash), repo.blobContent(change.newHash), repo.blobContent(ours.hash)
+			if repo.isBinaryDiff(change.path, base, ourContent, theirs) {
+				merge.messages = append(merge.messages,
+					fmt.Sprintf("warning: Cannot merge binary files: %s (%s vs. %s)", change.path, labels.ours, labels.theirs),
+					fmt.Sprintf("CONFLICT (%s): Merge conflict in %s", kind, change.path))
+				break
+			}
+			merged, conflicts := repo.mergeFileContents(base, ourContent, theirs, labels)
+			mode := ours.mode
+			if mode == change.oldMode && change.newMode != 0 {
+				mode = change.newMode
+			}
+			if conflicts == 0 {
+				merge.updates = append(merge.updates, treeUpdate{change.path, mode, repo.writeObject("blob", merged)})
+				continue
+			}
+			merge.messages = append(merge.messages, fmt.Sprintf("CONFLICT (%s): Merge conflict in %s", kind, change.path))
+			conflict.mode, conflict.content = mode, merged
+		}
+		merge.conflicts = append(merge.conflicts, conflict)
+	}
+	return merge
+}
+
+// mergeFileContents merges the changes of two sides of a file in the
+// conflict style merge.conflictStyle asks for
+func (repo *Repository) mergeFileContents(base []byte, ours []byte, theirs []byte, labels mergeLabels) ([]byte, int) {
+	style, _ := repo.config.get("merge.conflictStyle")
+	return mergeContents(base, ours, theirs, labels, style == "diff3" || style == "zdiff3")
+}
+
+// checkTreeUpdates makes sure writing the updates loses no local changes:
+// the files of the paths they change must be as the index has them, and
+// new ones must not be there yet. It explains what is in the way.
+func (repo *Repository) checkTreeUpdates(index *gitIndex, updates []treeUpdate) bool {
+	overwritten := make([]string, 0)
+	untracked := make([]string, 0)
+	for _, update := range updates {
+		if position, tracked := index.find(update.path); tracked {
+			if !repo.isWorktreeClean(index, index.entries[position]) {
+				overwritten = append(overwritten, update.path)
+			}
+		} else if _, err := os.Lstat(repo.worktreePath(update.path)); err == nil {
+			untracked = append(untracked, update.path)
+		}
+	}
+	if len(overwritten) > 0 || len(untracked) > 0 {
+		if len(overwritten) > 0 {
+			fmt.Fprintln(os.Stderr, "error: Your local changes to the following files would be overwritten by merge:")
+			for _, entryPath := range overwritten {
+				fmt.Fprintf(os.Stderr, "\t%s\n", entryPath)
+			}
+			fmt.Fprintln(os.Stderr, "Please commit your changes or stash them before you merge.")
+		}
+		if len(untracked) > 0 {
+			fmt.Fprintln(os.Stderr, "error: The following untracked working tree files would be overwritten by merge:")
+			for _, entryPath := range untracked {
+				fmt.Fprintf(os.Stderr, "\t%s\n", entryPath)
+			}
+			fmt.Fprintln(os.Stderr, "Please move or remove them before you merge.")
+		}
+		fmt.Fprintln(os.Stderr, "Aborting")
+		return false
+	}
+	return true
+}
+
+// writeTreeUpdates writes the updates to the worktree and returns the
+// index entries of the files written
+func (repo *Repository) writeTreeUpdates(updates []treeUpdate) map[string]indexEntry {
+	written := make(map[string]indexEntry)
+	for _, update := range updates {
+		if update.mode == 0 {
+			repo.removeWorktreeFile(update.path)
+			continue
+		}
+		written[update.path] = repo.checkoutEntry(update.path, treeEntry{mode: fmt.Sprintf("%o", update.mode), name: update.path, hash: update.hash})
+	}
+	return written
+}
+
+// stageTreeUpdates records in the index the updates writeTreeUpdates
+// wrote
+func (index *gitIndex) stageTreeUpdates(updates []treeUpdate, written map[string]indexEntry) {
+	for _, update := range updates {
+		if update.mode == 0 {
+			index.removePath(update.path)
+		} else {
+			index.addEntry(written[update.path])
+		}
+	}
+}
+
+// applyTreeMerge carries the changes from baseTree to upstreamTree over
+// to the index and the worktree, without writing the index. A
+// fast-forward has local changes as the only ones on its side, so where
+// they clash it explains that and changes nothing; so it does when local
+// changes are in the way. Otherwise what git says of the paths merged is
+// shown and conflicts are left in the index as stages and in the worktree
+// between conflict markers, which conflicted reports.
+func (repo *Repository) applyTreeMerge(index *gitIndex, baseTree string, upstreamTree string, fastForward bool, labels mergeLabels) (ok bool, conflicted bool) {
+	merge := repo.mergeTreeChanges(index, baseTree, upstreamTree, labels)
+	if fastForward && len(merge.conflicts) > 0 {
+		fmt.Fprintln(os.Stderr, "error: Your local changes to the following files would be overwritten by merge:")
+		for _, conflictPath := range merge.conflictPaths() {
+			fmt.Fprintf(os.Stderr, "\t%s\n", conflictPath)
+		}
+		fmt.Fprintln(os.Stderr, "Aborting")
+		return false, false
+	}
+	written := append([]treeUpdate(nil), merge.updates...)
+	for _, conflict := range merge.conflicts {
+		if conflict.content != nil {
+			written = append(written, treeUpdate{path: conflict.path, mode: conflict.mode})
+		}
+	}
+	if !repo.checkTreeUpdates(index, written) {
+		return false, false
+	}
+	if !fastForward {
+		for _, message := range merge.messages {
+			fmt.Println(message)
+		}
+	}
+	index.stageTreeUpdates(merge.updates, repo.writeTreeUpdates(merge.updates))
+	for _, conflict := range merge.conflicts {
+		if conflict.content != nil {
+			repo.replaceWorktreeFile(conflict.path, conflict.mode, conflict.content)
+		}
+		index.addConflict(conflict.path, conflict.stages)
+	}
+	return true, len(merge.conflicts) > 0
+}
+
+// addConflict replaces the entries of path with its conflict stages
+func (index *gitIndex) addConflict(relativePath string, stages []indexEntry) {
+	index.removePath(relativePath)
+	position, _ := index.find(relativePath)
+	index.entries = append(index.entries[:position], append(append([]indexEntry(nil), stages...), index.entries[position:]...)...)
+}
+
+// conflictsComment lists the conflicted paths at the end of MERGE_MSG for
+// the one who resolves them
+func conflictsComment(paths []string) string {
+	comment := "\n# Conflicts:\n"
+	for _, conflictPath := range paths {
+		comment += "#\t" + conflictPath + "\n"
+	}
+	return comment
+}
+
+// requireResolved stops action, merging or committing, while the index
+// has conflicts
+func (repo *Repository) requireResolved(index *gitIndex, action string) {
+	if len(conflictedPaths(index)) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "error: %s is not possible because you have unmerged files.\n", action)
+	fmt.Fprintf(os.Stderr, "hint: Fix them up in the work tree, and then use '%s add/rm <file>'\n", programName())
+	fmt.Fprintln(os.Stderr, "hint: as appropriate to mark resolution and make a commit.")
+	log.Fatal("fatal: Exiting because of an unresolved conflict.")
+}
+
+type mergeOptions struct {
+	ff      string // "only", "true" or "false" from --ff-only, --ff or --no-ff, else merge.ff
+	commit  bool   // commit the merge, unless --no-commit stops before
+	squash  bool   // stage the merged changes for a commit that records no merge
+	message string // -m, empty for one naming what is merged
+	quiet   bool
+}
+
+// mergeStateFiles are what a merge stopped before committing leaves for
+// commit: the commits merged, how, and the message to start from, or the
+// message of a squash
+var mergeStateFiles = []string{"MERGE_HEAD", "MERGE_MODE", "MERGE_MSG", "SQUASH_MSG"}
+
+// merge merges commits into the current branch like git merge: nothing
+// happens when they are merged already, the branch moves forward to a
+// single one when it has not diverged, as the ff option allows, and
+// otherwise a merge commit is made, with mergeOctopus when there are
+// several. With commit unset a merge that is not a fast-forward is only
+// staged, and MERGE_HEAD, MERGE_MODE and MERGE_MSG let commit finish it;
+// with squash the merged changes are staged but nothing recorded of the
+// merge, SQUASH_MSG listing the commits they come from. It reports
+// whether the merge went well.
+func (repo *Repository) merge(names []string, options mergeOptions) bool {
+	repo.requireResolved(repo.readIndex(), "Merging")
+	if _, err := os.Stat(filepath.Join(repo.gitDir, "MERGE_HEAD")); err == nil {
+		log.Fatal("fatal: You have not concluded your merge (MERGE_HEAD exists).\nPlease, commit your changes before you merge.")
+	}
+	head, ok := repo.resolveRef("HEAD")
+	if !ok {
+		log.Fatal("fatal: merging into an unborn branch is not supported")
+	}
+	upstreams := make([]string, 0, len(names))
+	merging := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		hash, ok := repo.lookupRevision(name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "merge: %s - not something we can merge\n", name)
+			os.Exit(1)
+		}
+		upstream := repo.peelToCommit(hash)
+		if seen[upstream] || repo.isAncestor(upstream, head) {
+			continue
+		}
+		seen[upstream] = true
+		upstreams = append(upstreams, upstream)
+		merging = append(merging, name)
+	}
+	ff := options.ff
+	if ff == "" {
+		ff = "true"
+		if value, ok := repo.config.get("merge.ff"); ok {
+			ff = "only"
+			if strings.ToLower(value) != "only" {
+				ff = strconv.FormatBool(repo.config.getBool("merge.ff", true))
+			}
+		}
+	}
+	message := options.message
+	if message == "" {
+		message = repo.mergeMessage(merging)
+	}
+	message = cleanupMessage(message)
+
+	if len(upstreams) == 0 {
+		if !options.quiet {
+			fmt.Println("Already up to date.")
+		}
+		return true
+	}
+	if len(upstreams) > 1 {
+		if ff == "only" {
+			log.Fatal("fatal: Not possible to fast-forward, aborting.")
+		}
+		return repo.mergeOctopus(head, upstreams, merging, message, options)
+	}
+	upstream := upstreams[0]
+	canFastForward := repo.isAncestor(head, upstream)
+	if !canFastForward && ff == "only" {
+		log.Fatal("fatal: Not possible to fast-forward, aborting.")
+	}
+	repo.writeOrigHead(head)
+	fastForward := canFastForward && ff != "false"
+	index := repo.lockIndex()
+	if !options.squash && (options.commit || fastForward) {
+		return repo.mergeUpstream(index, head, upstream, merging[0], fastForward, false, message, "merge "+strings.Join(names, " "), options.quiet)
+	}
+	headTree := repo.readCommitObject(head).tree
+	upstreamTree := repo.readCommitObject(upstream).tree
+	labels := mergeLabels{ours: "HEAD", theirs: merging[0]}
+	if fastForward {
+		// a squash of commits the branch could move forward to
+		if !options.quiet {
+			fmt.Printf("Updating %s..%s\n", head[:7], upstream[:7])
+		}
+		if applied, _ := repo.applyTreeMerge(index, headTree, upstreamTree, true, labels); !applied {
+			repo.releaseIndex(index)
+			return false
+		}
+		repo.writeIndex(index)
+		if !options.quiet {
+			fmt.Println("Fast-forward")
+		}
+		repo.writeSquashMessage(head, upstreams, options.quiet)
+		if !options.quiet {
+			repo.writeMergeStat(headTree, upstream)
+		}
+		return true
+	}
+	base, ok := repo.mergeBase(head, upstream)
+	if !ok {
+		log.Fatal("fatal: refusing to merge unrelated histories")
+	}
+	if !repo.checkNothingStaged(index, head) {
+		repo.releaseIndex(index)
+		return false
+	}
+	labels.base = abbreviateHash(base)
+	applied, conflicted := repo.applyTreeMerge(index, repo.readCommitObject(base).tree, upstreamTree, false, labels)
+	if !applied {
+		repo.releaseIndex(index)
+		return false
+	}
+	repo.writeIndex(index)
+	if conflicted {
+		conflicts := conflictsComment(conflictedPaths(index))
+		if options.squash {
+			repo.writeSquashMessage(head, upstreams, options.quiet)
+			repo.writeMergeState("MERGE_MSG", conflicts)
+		} else {
+			repo.writeMergeHead(upstream, ff, message+conflicts)
+		}
+		repo.rerere()
+		fmt.Println("Automatic merge failed; fix conflicts and then commit the result.")
+		return false
+	}
+	if !options.quiet {
+		fmt.Println("Automatic merge went well; stopped before committing as requested")
+	}
+	if options.squash {
+		repo.writeSquashMessage(head, upstreams, options.quiet)
+		return true
+	}
+	repo.writeMergeHead(upstream, ff, message)
+	return true
+}
+
+// writeMergeHead leaves what commit needs to conclude a merge of
+// upstream: MERGE_HEAD, MERGE_MODE after ff and MERGE_MSG
+func (repo *Repository) writeMergeHead(upstream string, ff string, message string) {
+	mode := ""
+	if ff == "false" {
+		mode = "no-ff"
+	}
+	repo.writeMergeState("MERGE_HEAD", upstream+"\n")
+	repo.writeMergeState("MERGE_MODE", mode)
+	repo.writeMergeState("MERGE_MSG", message)
+}
+
+// mergeOctopus merges several commits into the current branch in one
+// commit that has them all as parents, each merged in turn with the
+// trees of those before. Its work is done on an index of its own, so
+// when a commit does not merge cleanly with the others nothing has
+// changed yet and, unless the merge is to stop before committing, they
+// are merged one at a time instead, each in a commit of its own.
+func (repo *Repository) mergeOctopus(head string, upstreams []string, names []string, message string, options mergeOptions) bool {
+	index := repo.lockIndex()
+	if !repo.checkNothingStaged(index, head) {
+		repo.releaseIndex(index)
+		return false
+	}
+	repo.writeOrigHead(head)
+	headTree := repo.readCommitObject(head).tree
+	octopus := repo.treeIndex(headTree)
+	for i, upstream := range upstreams {
+		if !options.quiet {
+			fmt.Printf("Trying simple merge with %s\n", names[i])
+		}
+		base := repo.octopusBase(append([]string{head}, upstreams[:i]...), upstream)
+		merge := repo.mergeTreeChanges(octopus, repo.readCommitObject(base).tree, repo.readCommitObject(upstream).tree, mergeLabels{base: abbreviateHash(base), ours: "HEAD", theirs: names[i]})
+		if conflicts := merge.conflictPaths(); len(conflicts) > 0 {
+			if options.squash || !options.commit {
+				fmt.Fprintln(os.Stderr, "error: The following files were changed on both sides and cannot be merged automatically:")
+				for _, conflict := range conflicts {
+					fmt.Fprintf(os.Stderr, "\t%s\n", conflict)
+				}
+				fmt.Fprintln(os.Stderr, "Aborting")
+				repo.releaseIndex(index)
+				return false
+			}
+			// each merge locks the index for itself
+			repo.releaseIndex(index)
+			if !options.quiet {
+				fmt.Println("Simple merge did not work, merging them one at a time.")
+			}
+			for _, name := range names {
+				if !repo.merge([]string{name}, options) {
+					return false
+				}
+			}
+			return true
+		}
+		staged := make(map[string]indexEntry)
+		for _, update := range merge.updates {
+			staged[update.path] = indexEntry{path: update.path, mode: update.mode, hash: update.hash}
+		}
+		octopus.stageTreeUpdates(merge.updates, staged)
+	}
+	if applied, _ := repo.applyTreeMerge(index, headTree, repo.writeTree(octopus), true, mergeLabels{ours: "HEAD"}); !applied {
+		repo.releaseIndex(index)
+		return false
+	}
+	if options.squash || !options.commit {
+		repo.writeIndex(index)
+		if !options.quiet {
+			fmt.Println("Automatic merge went well; stopped before committing as requested")
+		}
+		if options.squash {
+			repo.writeSquashMessage(head, upstreams, options.quiet)
+			return true
+		}
+		repo.writeMergeState("MERGE_HEAD", strings.Join(upstreams, "\n")+"\n")
+		repo.writeMergeState("MERGE_MODE", "")
+		repo.writeMergeState("MERGE_MSG", message)
+		return true
+	}
+	tree := repo.writeTree(index)
+	repo.writeIndex(index)
+	merged := repo.createCommit(tree, append([]string{head}, upstreams...), message)
+	repo.updateHead(merged, "merge "+strings.Join(names, " ")+": Merge made by the 'octopus' strategy.")
+	if !options.quiet {
+		fmt.Println("Merge made by the 'octopus' strategy.")
+		repo.writeMergeStat(headTree, merged)
+	}
+	return true
+}
+
+// octopusBase is the base to merge upstream from into the merge of the
+// commits given: the most recent of its merge bases with each of them
+func (repo *Repository) octopusBase(merged []string, upstream string) string {
+	best := ""
+	for _, commit := range merged {
+		if base, ok := repo.mergeBase(commit, upstream); ok && (best == "" || repo.isAncestor(best, base)) {
+			best = base
+		}
+	}
+	if best == "" {
+		log.Fatal("fatal: refusing to merge unrelated histories")
+	}
+	return best
+}
+
+// mergeMessage is the message of a merge of names as git words it, the
+// branches, tags, remote-tracking branches and other commits each listed
+// together, and naming the branch merged into unless it is main or master
+func (repo *Repository) mergeMessage(names []string) string {
+	kinds := []struct{ prefix, singular, plural string }{
+		{"refs/heads/", "branch", "branches"},
+		{"refs/tags/", "tag", "tags"},
+		{"refs/remotes/", "remote-tracking branch", "remote-tracking branches"},
+		{"", "commit", "commits"},
+	}
+	grouped := make([][]string, len(kinds))
+	for _, name := range names {
+		kind := len(kinds) - 1
+		// a tag wins over a branch of the same name, as in lookups
+		for _, i := range []int{1, 0, 2} {
+			if _, ok := repo.resolveRef(kinds[i].prefix + name); ok {
+				kind = i
+				break
+			}
+		}
+		grouped[kind] = append(grouped[kind], "'"+name+"'")
+	}
+	parts := make([]string, 0, len(kinds))
+	for i, group := range grouped {
+		switch len(group) {
+		case 0:
+		case 1:
+			parts = append(parts, kinds[i].singular+" "+group[0])
+		default:
+			parts = append(parts, kinds[i].plural+" "+strings.Join(group[:len(group)-1], ", ")+" and "+group[len(group)-1])
+		}
+	}
+	message := "Merge " + strings.Join(parts, ", ")
+	if branch, ok := repo.headBranch(); ok && branch != "main" && branch != "master" {
+		message += " into " + branch
+	}
+	return message + "\n"
+}
+
+// writeSquashMessage writes SQUASH_MSG, the commits of the upstreams that
+// head does not have, newest first, as log shows them
+func (repo *Repository) writeSquashMessage(head string, upstreams []string, quiet bool) {
+	if !quiet {
+		fmt.Println("Squash commit -- not updating HEAD")
+	}
+	merged := make(map[string]bool)
+	headCommits := newCommitIter(repo, []string{head}, commitOrderDate, false)
+	for {
+		hash, _, ok := headCommits.next()
+		if !ok {
+			break
+		}
+		merged[hash] = true
+	}
+	var content bytes.Buffer
+	content.WriteString("Squashed commit of the following:\n")
+	commits := newCommitIter(repo, upstreams, commitOrderDate, false)
+	for {
+		hash, commit, ok := commits.next()
+		if !ok {
+			break
+		}
+		if merged[hash] {
+			continue
+		}
+		content.WriteString("\n")
+		repo.writePrettyCommit(&content, hash, commit, prettyFormat{preset: "medium"}, prettyOptions{dateStyle: "default"})
+	}
+	repo.writeMergeState("SQUASH_MSG", content.String())
+}
+
+func (repo *Repository) writeMergeState(name string, content string) {
+	if err := os.WriteFile(filepath.Join(repo.gitDir, name), []byte(content), 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readMergeHeads returns the commits a merge stopped before committing
+// merged, which become parents of the next commit
+func (repo *Repository) readMergeHeads() []string {
+	content, err := os.ReadFile(filepath.Join(repo.gitDir, "MERGE_HEAD"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return strings.Fields(string(content))
+}
+
+// pendingMergeMessage is the message a merge or squash left for commit to
+// start from. A squash that stopped at conflicts leaves both, SQUASH_MSG
+// coming first.
+func (repo *Repository) pendingMergeMessage() (string, bool) {
+	message, found := "", false
+	for _, name := range []string{"SQUASH_MSG", "MERGE_MSG"} {
+		if content, err := os.ReadFile(filepath.Join(repo.gitDir, name)); err == nil {
+			message += string(content)
+			found = true
+		}
+	}
+	return message, found
+}
+
+// removeMergeState forgets a merge once it was committed
+func (repo *Repository) removeMergeState() {
+	for _, name := range mergeStateFiles {
+		if err := os.Remove(filepath.Join(repo.gitDir, name)); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+}
+
+// generationQueue is a max-heap on generation, then committer time, for
+// walks that visit descendants before their ancestors
+type generationQueue []generationQueued
+
+type generationQueued struct {
+	hash       string
+	generation uint64
+	when       int64
+}
+
+func (queue generationQueue) Len() int { return len(queue) }
+func (queue generationQueue) Less(i, j int) bool {
+	if queue[i].generation != queue[j].generation {
+		return queue[i].generation > queue[j].generation
+	}
+	return queue[i].when > queue[j].when
+}
+func (queue generationQueue) Swap(i, j int)       { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *generationQueue) Push(x interface{}) { *queue = append(*queue, x.(generationQueued)) }
+func (queue *generationQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return item
+}
+
+// mergeBase returns the latest common ancestor of two commits, ok being
+// false for unrelated histories. Both histories are painted down together,
+// descendants first, so the walk ends at the first commit both reach
+// instead of listing everything one of them reaches.
+func (repo *Repository) mergeBase(one string, other string) (string, bool) {
+	const fromOne, fromOther = 1, 2
+	painted := make(map[string]int)
+	queue := &generationQueue{}
+	paint := func(hash string, flags int) {
+		if painted[hash]|flags == painted[hash] {
+			return
+		}
+		painted[hash] |= flags
+		when := repo.readCommitObject(hash).committer.when.Unix()
+		heap.Push(queue, generationQueued{hash, repo.generation(hash), when})
+	}
+	paint(one, fromOne)
+	paint(other, fromOther)
+	for queue.Len() > 0 {
+		hash := heap.Pop(queue).(generationQueued).hash
+		flags := painted[hash]
+		if flags == fromOne|fromOther {
+			return hash, true
+		}
+		for _, parent := range repo.readCommitObject(hash).parents {
+			paint(parent, flags)
+		}
+	}
+	return "", false
+}
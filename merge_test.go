@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMergeOfNearbyEditsAndConflicts checks that edits of nearby lines on
+// the two sides merge cleanly, and that edits of the same line leave the
+// three stages in the index, conflict markers in the worktree and
+// MERGE_HEAD for commit to conclude the merge with
+func TestMergeOfNearbyEditsAndConflicts(t *testing.T) {
+	repo := newTestRepository(t, RepositoryOptions{})
+	base := commitWorktreeFile(t, repo, "file", "1\n2\n3\n4\n5\n", "base")
+	repo.updateRef("refs/heads/side", base)
+	commitWorktreeFile(t, repo, "file", "1\ntwo\n3\n4\n5\n", "ours")
+	repo.checkout("side", 1, true, newProgress(true))
+	commitWorktreeFile(t, repo, "file", "1\n2\n3\n4\nfive\n", "theirs")
+	repo.checkout("main", 1, true, newProgress(true))
+
+	if !repo.merge([]string{"side"}, mergeOptions{commit: true, message: "Merge side\n", quiet: true}) {
+		t.Fatal("the merge of edits to lines 2 and 5 failed")
+	}
+	if content, _ := os.ReadFile(repo.worktreePath("file")); string(content) != "1\ntwo\n3\n4\nfive\n" {
+		t.Errorf("the merge left %q, want both edits", content)
+	}
+	head, _ := repo.resolveRef("HEAD")
+	if parents := repo.readCommitObject(head).parents; len(parents) != 2 {
+		t.Errorf("the merge commit has %d parents, want 2", len(parents))
+	}
+
+	commitWorktreeFile(t, repo, "file", "1\nours\n3\n4\nfive\n", "ours again")
+	repo.checkout("side", 1, true, newProgress(true))
+	commitWorktreeFile(t, repo, "file", "1\ntheirs\n3\n4\nfive\n", "theirs again")
+	upstream, _ := repo.resolveRef("HEAD")
+	repo.checkout("main", 1, true, newProgress(true))
+
+	if repo.merge([]string{"side"}, mergeOptions{commit: true, message: "Merge side\n", quiet: true}) {
+		t.Fatal("the merge of edits to the same line went well")
+	}
+	stages := make([]int, 0)
+	for _, entry := range repo.readIndex().entries {
+		if entry.path == "file" {
+			stages = append(stages, entry.stage())
+		}
+	}
+	if len(stages) != 3 || stages[0] != 1 || stages[1] != 2 || stages[2] != 3 {
+		t.Errorf("the index has stages %v of the conflicted file, want [1 2 3]", stages)
+	}
+	want := "1\n<<<<<<< HEAD\nours\n=======\ntheirs\n>>>>>>> side\n3\n4\nfive\n"
+	if content, _ := os.ReadFile(repo.worktreePath("file")); string(content) != want {
+		t.Errorf("the conflicted file is %q, want %q", content, want)
+	}
+	if heads := repo.readMergeHeads(); len(heads) != 1 || heads[0] != upstream {
+		t.Errorf("MERGE_HEAD has %v, want %s", heads, upstream)
+	}
+}
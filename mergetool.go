@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type mergetoolOptions struct {
+	tool   string // defaults to merge.tool
+	prompt bool   // ask before starting the tool on each file
+}
+
+// conflictStages holds the index entries of one conflicted path by stage:
+// the base, ours ("local") and theirs ("remote"), nil when missing
+type conflictStages [4]*indexEntry
+
+func describeConflictSide(stages conflictStages, stage int) string {
+	switch {
+	case stages[stage] == nil:
+		return "deleted"
+	case stages[1] == nil:
+		return "created file"
+	}
+	return "modified file"
+}
+
+// mergetoolTempPath names the temporary copy of a side of path the way git
+// does, e.g. "dir/file_LOCAL_1234.c" next to the merged file
+func mergetoolTempPath(relativePath string, side string) string {
+	dir, name := path.Split(relativePath)
+	if dir == "" {
+		dir = "./"
+	}
+	extension := path.Ext(name)
+	if extension == name {
+		extension = ""
+	}
+	return dir + strings.TrimSuffix(name, extension) + "_" + side + "_" + strconv.Itoa(os.Getpid()) + extension
+}
+
+// mergetool runs the configured merge tool on every conflicted path under
+// pathspecs and stages the paths it resolves. Conflicts where one side
+// deleted the file are resolved by asking which side to keep.
+func (repo *Repository) mergetool(pathspecs []pathspec, options mergetoolOptions) {
+	tool := options.tool
+	if tool == "" {
+		tool, _ = repo.config.get("merge.tool")
+	}
+	if tool == "" {
+		log.Fatal("fatal: merge.tool is not configured, set it or use --tool=<tool>")
+	}
+	command, ok := repo.config.get("mergetool." + tool + ".cmd")
+	if !ok {
+		log.Fatalf("fatal: unknown merge tool '%s', mergetool.%s.cmd is not set", tool, tool)
+	}
+
+	index := repo.readIndex()
+	conflicts := make(map[string]*conflictStages)
+	paths := make([]string, 0)
+	for i, entry := range index.entries {
+		if entry.stage() == 0 || !matchesPathspecs(entry.path, pathspecs) {
+			continue
+		}
+		if conflicts[entry.path] == nil {
+			conflicts[entry.path] = &conflictStages{}
+			paths = append(paths, entry.path)
+		}
+		conflicts[entry.path][entry.stage()] = &index.entries[i]
+	}
+	if len(paths) == 0 {
+		fmt.Println("No files need merging")
+		return
+	}
+	fmt.Println("Merging:")
+	for _, conflictPath := range paths {
+		fmt.Println(quotePath(conflictPath))
+	}
+
+	answers := bufio.NewReader(os.Stdin)
+	ask := func(question string) (string, bool) {
+		fmt.Print(question)
+		answer, err := answers.ReadString('\n')
+		if err != nil && answer == "" {
+			return "", false
+		}
+		return strings.TrimSpace(answer), true
+	}
+	for _, conflictPath := range paths {
+		stages := *conflicts[conflictPath]
+		fmt.Println()
+		if stages[2] == nil || stages[3] == nil {
+			if !repo.resolveDeletedConflict(conflictPath, stages, ask) {
+				os.Exit(1)
+			}
+			continue
+		}
+		fmt.Printf("Normal merge conflict for '%s':\n", conflictPath)
+		fmt.Printf("  {local}: %s\n", describeConflictSide(stages, 2))
+		fmt.Printf("  {remote}: %s\n", describeConflictSide(stages, 3))
+		if options.prompt {
+			if _, ok := ask(fmt.Sprintf("Hit return to start merge resolution tool (%s): ", tool)); !ok {
+				os.Exit(1)
+			}
+		}
+		if !repo.runMergeTool(tool, command, conflictPath, stages, ask) {
+			fmt.Printf("merge of %s failed\n", conflictPath)
+			os.Exit(1)
+		}
+		repo.addPaths([]pathspec{literalPathspec(conflictPath)}, 1, addOptions{})
+	}
+}
+
+// resolveDeletedConflict keeps the modified file or deletes it as the user
+// answers; it reports false when the user aborts
+func (repo *Repository) resolveDeletedConflict(conflictPath string, stages conflictStages, ask func(string) (string, bool)) bool {
+	fmt.Printf("Deleted merge conflict for '%s':\n", conflictPath)
+	fmt.Printf("  {local}: %s\n", describeConflictSide(stages, 2))
+	fmt.Printf("  {remote}: %s\n", describeConflictSide(stages, 3))
+	for {
+		answer, ok := ask("Use (m)odified or (d)eleted file, or (a)bort? ")
+		if !ok {
+			return false
+		}
+		switch strings.ToLower(answer) {
+		case "m", "modified":
+			if content, err := os.ReadFile(repo.worktreePath(conflictPath)); err == nil && repo.config.getBool("mergetool.keepBackup", true) {
+				if err := os.WriteFile(repo.worktreePath(conflictPath+".orig"), content, 0666); err != nil {
+					log.Fatal(err)
+				}
+			}
+			repo.addPaths([]pathspec{literalPathspec(conflictPath)}, 1, addOptions{})
+			return true
+		case "d", "deleted":
+			repo.removeWorktreeFile(conflictPath)
+			repo.addPaths([]pathspec{literalPathspec(conflictPath)}, 1, addOptions{})
+			return true
+		case "a", "abort":
+			return false
+		}
+	}
+}
+
+// runMergeTool writes the base, local and remote versions of a conflicted
+// file next to it, runs the tool with BASE, LOCAL, REMOTE and MERGED set
+// and tells whether the merge succeeded: by the exit code of the tool with
+// mergetool.<tool>.trustExitCode, otherwise by whether the file changed
+func (repo *Repository) runMergeTool(tool string, command string, conflictPath string, stages conflictStages, ask func(string) (string, bool)) bool {
+	merged, err := os.ReadFile(repo.worktreePath(conflictPath))
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	temporaries := map[string]string{"BACKUP": mergetoolTempPath(conflictPath, "BACKUP")}
+	writeTemporary := func(temporary string, content []byte) {
+		if err := os.WriteFile(repo.worktreePath(temporary), content, 0666); err != nil {
+			log.Fatal(err)
+		}
+	}
+	writeTemporary(temporaries["BACKUP"], merged)
+	for stage, side := range map[int]string{1: "BASE", 2: "LOCAL", 3: "REMOTE"} {
+		var content []byte
+		if stages[stage] != nil {
+			_, content = repo.readObject(stages[stage].hash)
+		}
+		temporaries[side] = mergetoolTempPath(conflictPath, side)
+		writeTemporary(temporaries[side], content)
+	}
+
+	argv := []string{"sh", "-c", command}
+	traceRunCommand(argv)
+	process := exec.Command(argv[0], argv[1:]...)
+	process.Stdin, process.Stdout, process.Stderr = os.Stdin, os.Stdout, os.Stderr
+	process.Env = append(os.Environ(),
+		"BASE="+temporaries["BASE"],
+		"LOCAL="+temporaries["LOCAL"],
+		"REMOTE="+temporaries["REMOTE"],
+		"MERGED="+conflictPath,
+	)
+	succeeded := process.Run() == nil
+	if !repo.config.getBool("mergetool."+tool+".trustExitCode", false) {
+		succeeded = repo.mergeToolChanged(conflictPath, merged, ask)
+	}
+	if !succeeded {
+		// like git, the copies stay around for a manual merge
+		return false
+	}
+	keepTemporaries := repo.config.getBool("mergetool.keepTemporaries", false)
+	for side, temporary := range temporaries {
+		switch {
+		case side == "BACKUP" && repo.config.getBool("mergetool.keepBackup", true):
+			if err := os.Rename(repo.worktreePath(temporary), repo.worktreePath(conflictPath+".orig")); err != nil {
+				log.Fatal(err)
+			}
+		case side == "BACKUP" || !keepTemporaries:
+			os.Remove(repo.worktreePath(temporary))
+		}
+	}
+	return true
+}
+
+// mergeToolChanged tells whether a tool whose exit code is not trusted
+// merged the file: when it left the file as it was, the user is asked
+func (repo *Repository) mergeToolChanged(conflictPath string, before []byte, ask func(string) (string, bool)) bool {
+	after, err := os.ReadFile(repo.worktreePath(conflictPath))
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(after, before) {
+		return true
+	}
+	fmt.Printf("%s seems unchanged.\n", conflictPath)
+	for {
+		answer, ok := ask("Was the merge successful [y/n]? ")
+		if !ok {
+			return false
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
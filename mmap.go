@@ -0,0 +1,142 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// window sizes follow git: small windows keep 32-bit address space usable
+var (
+	DefaultPackedGitWindowSize int64 = 1 << 30
+	DefaultPackedGitLimit      int64 = 8 << 30
+)
+
+func init() {
+	if strconv.IntSize == 32 {
+		DefaultPackedGitWindowSize = 32 << 20
+		DefaultPackedGitLimit = 256 << 20
+	}
+}
+
+// mappedFile gives random access to a file through memory-mapped windows,
+// keeping at most limit bytes mapped and unmapping the least recently
+// used window when a new one is needed. It is safe for concurrent use.
+type mappedFile struct {
+	lock       sync.Mutex
+	file       *os.File
+	size       int64
+	windowSize int64
+	maxWindows int
+	order      *list.List // front is the most recently used
+	windows    map[int64]*list.Element
+}
+
+type mappedWindow struct {
+	start int64
+	data  []byte
+}
+
+func openMappedFile(path string, windowSize int64, limit int64) *mappedFile {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// windows must start on a page boundary
+	pageSize := int64(os.Getpagesize())
+	windowSize = (windowSize + pageSize - 1) / pageSize * pageSize
+	maxWindows := int(limit / windowSize)
+	if maxWindows < 1 {
+		maxWindows = 1
+	}
+	return &mappedFile{
+		file:       file,
+		size:       info.Size(),
+		windowSize: windowSize,
+		maxWindows: maxWindows,
+		order:      list.New(),
+		windows:    make(map[int64]*list.Element),
+	}
+}
+
+func (mapped *mappedFile) window(start int64) []byte {
+	if element, ok := mapped.windows[start]; ok {
+		mapped.order.MoveToFront(element)
+		return element.Value.(*mappedWindow).data
+	}
+	if mapped.order.Len() >= mapped.maxWindows {
+		oldest := mapped.order.Back()
+		window := oldest.Value.(*mappedWindow)
+		mapped.order.Remove(oldest)
+		delete(mapped.windows, window.start)
+		unmapRegion(window.data)
+	}
+	length := mapped.windowSize
+	if start+length > mapped.size {
+		length = mapped.size - start
+	}
+	data, err := mapRegion(mapped.file, start, int(length))
+	if err != nil {
+		log.Fatalf("cannot map %s: %s", mapped.file.Name(), err)
+	}
+	mapped.windows[start] = mapped.order.PushFront(&mappedWindow{start, data})
+	return data
+}
+
+func (mapped *mappedFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	// the lock is held while copying so the window cannot be unmapped under us
+	mapped.lock.Lock()
+	defer mapped.lock.Unlock()
+	readCount := 0
+	for readCount < len(buffer) {
+		if offset >= mapped.size {
+			return readCount, io.EOF
+		}
+		start := offset / mapped.windowSize * mapped.windowSize
+		data := mapped.window(start)
+		copied := copy(buffer[readCount:], data[offset-start:])
+		readCount += copied
+		offset += int64(copied)
+	}
+	return readCount, nil
+}
+
+func (mapped *mappedFile) Close() {
+	mapped.lock.Lock()
+	defer mapped.lock.Unlock()
+	for _, element := range mapped.windows {
+		unmapRegion(element.Value.(*mappedWindow).data)
+	}
+	mapped.windows = make(map[int64]*list.Element)
+	mapped.order.Init()
+	mapped.file.Close()
+}
+
+// mapWholeFile maps a file in one piece, used for pack indexes which are
+// only read through direct slicing
+func mapWholeFile(path string) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close() // the mapping stays valid after close
+	info, err := file.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info.Size() == 0 {
+		return []byte{}
+	}
+	data, err := mapRegion(file, 0, int(info.Size()))
+	if err != nil {
+		log.Fatalf("cannot map %s: %s", path, err)
+	}
+	return data
+}
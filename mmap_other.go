@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// without mmap the windows are plain heap buffers filled with one read
+
+func mapRegion(file *os.File, offset int64, length int) ([]byte, error) {
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+func unmapRegion(data []byte) {}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func mapRegion(file *os.File, offset int64, length int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), offset, length, syscall.PROT_READ, syscall.MAP_PRIVATE)
+}
+
+func unmapRegion(data []byte) {
+	syscall.Munmap(data)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// mergeTraversalWeight is what going to a second or later parent adds to
+// the distance of a name, so that names along first parents win
+const mergeTraversalWeight = 65535
+
+// revName is the name of a commit: generation first parents back from
+// the commit tipName names, distance counting the hops from the ref
+type revName struct {
+	tipName    string
+	taggerDate int64
+	generation int
+	distance   int
+	fromTag    bool
+}
+
+// String formats the name as "<tip>~<generation>", leaving out the "^0" a
+// tip named through an annotated tag carries
+func (name *revName) String() string {
+	if name.generation == 0 {
+		return name.tipName
+	}
+	return fmt.Sprintf("%s~%d", strings.TrimSuffix(name.tipName, "^0"), name.generation)
+}
+
+// isBetterThan applies git's preference between two names of a commit:
+// names from tags win and among them those of older tags, then fewer hops
+// and then older tips
+func (name *revName) isBetterThan(other *revName) bool {
+	if name.fromTag && other.fromTag {
+		return other.taggerDate > name.taggerDate || other.taggerDate == name.taggerDate && other.distance > name.distance
+	}
+	if name.fromTag != other.fromTag {
+		return name.fromTag
+	}
+	if name.distance != other.distance {
+		return other.distance > name.distance
+	}
+	return other.taggerDate > name.taggerDate
+}
+
+type nameRevOptions struct {
+	tagsOnly        bool
+	nameOnly        bool
+	refPatterns     []string // only refs matching one of them name commits
+	excludePatterns []string
+	undefined       bool // print "undefined" for what has no name
+	always          bool // print the abbreviated hash instead
+}
+
+// revNamer names commits by walking back from refs
+type revNamer struct {
+	repo    *Repository
+	options nameRevOptions
+	names   map[string]*revName
+	exact   map[string]string // the names of the objects refs point at themselves
+}
+
+// matchSubpath matches the pattern against the ref name and then against
+// what follows each of its slashes, so that "v*" matches refs/tags/v1.0;
+// full tells whether it was the whole name that matched
+func matchSubpath(pattern string, name string) (matched bool, full bool) {
+	for subpath := name; ; {
+		if wildmatch(pattern, subpath, false) {
+			return true, subpath == name
+		}
+		slash := strings.IndexByte(subpath, '/')
+		if slash == -1 {
+			return false, false
+		}
+		subpath = subpath[slash+1:]
+	}
+}
+
+// newRevNamer gives every commit reachable from the refs the options
+// select its best name
+func (repo *Repository) newRevNamer(options nameRevOptions) *revNamer {
+	namer := &revNamer{repo: repo, options: options, names: make(map[string]*revName), exact: make(map[string]string)}
+	type tip struct {
+		commit string
+		name   revName
+	}
+	tips := make([]tip, 0)
+	for _, ref := range repo.listRefs("refs/") {
+		if options.tagsOnly && !strings.HasPrefix(ref, "refs/tags/") {
+			continue
+		}
+		excluded := false
+		for _, pattern := range options.excludePatterns {
+			matched, _ := matchSubpath(pattern, ref)
+			excluded = excluded || matched
+		}
+		// a pattern only matching the end of the ref, as "v*" does, says
+		// that the short name is fine
+		included := len(options.refPatterns) == 0
+		abbreviate := options.tagsOnly && options.nameOnly
+		for _, pattern := range options.refPatterns {
+			matched, full := matchSubpath(pattern, ref)
+			included = included || matched
+			abbreviate = abbreviate || matched && !full
+		}
+		if excluded || !included {
+			continue
+		}
+		hash, ok := repo.resolveRef(ref)
+		if !ok {
+			continue
+		}
+		name := ref
+		switch {
+		case abbreviate:
+			name = shortRefName(ref)
+		case strings.HasPrefix(ref, "refs/heads/"):
+			name = strings.TrimPrefix(ref, "refs/heads/")
+		default:
+			name = strings.TrimPrefix(ref, "refs/")
+		}
+		if _, ok := namer.exact[hash]; !ok {
+			namer.exact[hash] = name
+		}
+		// follow annotated tags, dated by the outermost one
+		var taggerDate int64
+		dereferenced := false
+		header, content := repo.readObject(hash)
+		for header.objectType == "tag" {
+			tag := string(content)
+			if !dereferenced {
+				if start := strings.Index(tag, "\ntagger "); start != -1 {
+					line := strings.SplitN(tag[start+len("\ntagger "):], "\n", 2)[0]
+					taggerDate = parseIdentity(line).when.Unix()
+				}
+			}
+			hash = strings.TrimPrefix(strings.SplitN(tag, "\n", 2)[0], "object ")
+			header, content = repo.readObject(hash)
+			dereferenced = true
+		}
+		if header.objectType != "commit" {
+			continue
+		}
+		if dereferenced {
+			name += "^0"
+		} else {
+			taggerDate = parseCommitObject(content).committer.when.Unix()
+		}
+		tips = append(tips, tip{hash, revName{tipName: name, taggerDate: taggerDate, fromTag: strings.HasPrefix(ref, "refs/tags/")}})
+	}
+	// tags first, the oldest of them first
+	sort.SliceStable(tips, func(i, j int) bool {
+		if tips[i].name.fromTag != tips[j].name.fromTag {
+			return tips[i].name.fromTag
+		}
+		return tips[i].name.taggerDate < tips[j].name.taggerDate
+	})
+	for _, tip := range tips {
+		name := tip.name
+		namer.nameFrom(tip.commit, &name)
+	}
+	return namer
+}
+
+// nameFrom gives the commit the name unless it has a better one, then
+// passes names on to its ancestors, again keeping the better ones
+func (namer *revNamer) nameFrom(commit string, name *revName) {
+	if existing, ok := namer.names[commit]; ok && !name.isBetterThan(existing) {
+		return
+	}
+	namer.names[commit] = name
+	stack := []string{commit}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		name := namer.names[hash]
+		parents := namer.repo.readCommitObject(hash).parents
+		queued := make([]string, 0, len(parents))
+		for i, parent := range parents {
+			parentName := &revName{tipName: name.tipName, taggerDate: name.taggerDate, generation: name.generation + 1, distance: name.distance + 1, fromTag: name.fromTag}
+			if i > 0 {
+				// "<name>^<n>" starts a name of its own
+				tipName := strings.TrimSuffix(name.tipName, "^0")
+				if name.generation > 0 {
+					parentName.tipName = fmt.Sprintf("%s~%d^%d", tipName, name.generation, i+1)
+				} else {
+					parentName.tipName = fmt.Sprintf("%s^%d", tipName, i+1)
+				}
+				parentName.generation = 0
+				parentName.distance = name.distance + mergeTraversalWeight
+			}
+			if existing, ok := namer.names[parent]; ok && !parentName.isBetterThan(existing) {
+				continue
+			}
+			namer.names[parent] = parentName
+			queued = append(queued, parent)
+		}
+		// the first parent is walked first
+		for i := len(queued) - 1; i >= 0; i-- {
+			stack = append(stack, queued[i])
+		}
+	}
+}
+
+// nameOf returns the name of an object: commits get theirs from the walk,
+// other objects only have one when a ref points right at them
+func (namer *revNamer) nameOf(hash string) (string, bool) {
+	if name, ok := namer.names[hash]; ok {
+		return name.String(), true
+	}
+	if header, _ := namer.repo.readObject(hash); header.objectType != "commit" {
+		name, ok := namer.exact[hash]
+		return name, ok
+	}
+	return "", false
+}
+
+// showName prints the name of an object after what was asked for, the
+// object itself when that is left out
+func (namer *revNamer) showName(w io.Writer, hash string, asked string) {
+	if !namer.options.nameOnly {
+		if asked == "" {
+			asked = hash
+		}
+		fmt.Fprintf(w, "%s ", asked)
+	}
+	name, ok := namer.nameOf(hash)
+	switch {
+	case ok:
+		fmt.Fprintln(w, name)
+	case namer.options.undefined:
+		fmt.Fprintln(w, "undefined")
+	case namer.options.always:
+		fmt.Fprintln(w, abbreviateHash(hash))
+	default:
+		log.Fatalf("fatal: cannot describe '%s'", hash)
+	}
+}
+
+// showAll prints the names of all commits the refs reach
+func (namer *revNamer) showAll(w io.Writer) {
+	hashes := make([]string, 0, len(namer.names))
+	for hash := range namer.names {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		namer.showName(w, hash, "")
+	}
+}
+
+// annotate copies text, adding the name of every full commit id in it
+// after the id, or putting it in place of the id with nameOnly
+func (namer *revNamer) annotate(w io.Writer, r io.Reader) {
+	isHex := func(c byte) bool { return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' }
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		start, run := 0, 0
+		for i := 0; i < len(line); i++ {
+			if !isHex(line[i]) {
+				run = 0
+				continue
+			}
+			run++
+			if run != 2*ObjectShaLength || i+1 < len(line) && isHex(line[i+1]) {
+				continue
+			}
+			hash := line[i+1-2*ObjectShaLength : i+1]
+			name, ok := namer.names[hash]
+			if !ok {
+				continue
+			}
+			if namer.options.nameOnly {
+				fmt.Fprintf(w, "%s%s", line[start:i+1-2*ObjectShaLength], name)
+			} else {
+				fmt.Fprintf(w, "%s (%s)", line[start:i+1], name)
+			}
+			start = i + 1
+		}
+		io.WriteString(w, line[start:])
+		if err != nil {
+			break
+		}
+	}
+}
+
+// nameRevisions prints the names of the revisions given on the command line
+func (repo *Repository) nameRevisions(w io.Writer, revisions []string, options nameRevOptions) {
+	hashes := make(map[string]string)
+	for _, revision := range revisions {
+		hash, ok := repo.lookupRevision(revision)
+		if !ok || !repo.hasObject(hash) {
+			fmt.Fprintf(os.Stderr, "Could not get sha1 for %s. Skipping.\n", revision)
+			continue
+		}
+		hashes[revision] = hash
+	}
+	namer := repo.newRevNamer(options)
+	for _, revision := range revisions {
+		if hash, ok := hashes[revision]; ok {
+			namer.showName(w, hash, revision)
+		}
+	}
+}
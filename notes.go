@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const defaultNotesRef = "refs/notes/commits"
+
+// notesRef returns the notes ref to use: an explicit --ref value, then
+// GIT_NOTES_REF and core.notesRef; short names live below refs/notes/
+func (repo *Repository) notesRef(explicit string) string {
+	ref := explicit
+	if ref == "" {
+		ref = os.Getenv("GIT_NOTES_REF")
+	}
+	if ref == "" {
+		ref, _ = repo.config.get("core.notesRef")
+	}
+	if ref == "" {
+		return defaultNotesRef
+	}
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/notes/" + ref
+	}
+	return ref
+}
+
+// readNotes maps annotated object ids to note blob ids. Note trees may
+// spread entries over fanout directories ("ab/cdef..."), the path with the
+// slashes removed is the annotated object.
+func (repo *Repository) readNotes(ref string) map[string]string {
+	notes := make(map[string]string)
+	commitHash, ok := repo.resolveRef(ref)
+	if !ok {
+		return notes
+	}
+	walker := newTreeWalker(repo, repo.readCommitObject(commitHash).tree)
+	for {
+		entryPath, entry, ok := walker.next()
+		if !ok {
+			return notes
+		}
+		name := strings.ReplaceAll(entryPath, "/", "")
+		if entry.mode != "40000" && isFullHash(name) {
+			notes[name] = entry.hash
+		}
+	}
+}
+
+// writeNotes commits a new notes tree on top of the notes ref
+func (repo *Repository) writeNotes(ref string, notes map[string]string, message string) {
+	entries := make([]treeEntry, 0, len(notes))
+	for object, blob := range notes {
+		entries = append(entries, treeEntry{mode: "100644", name: object, hash: blob})
+	}
+	tree := repo.writeObject("tree", serializeTree(entries))
+	parents := make([]string, 0)
+	if parent, ok := repo.resolveRef(ref); ok {
+		parents = append(parents, parent)
+	}
+	subject, _ := splitCommitMessage(message)
+	repo.updateRefLogged(ref, repo.createCommit(tree, parents, message), "notes: "+subject)
+}
+
+// noteFor returns the note attached to an object, ok is false if there is none
+func (repo *Repository) noteFor(notes map[string]string, object string) (string, bool) {
+	blob, ok := notes[object]
+	if !ok {
+		return "", false
+	}
+	_, content := repo.readObject(blob)
+	return string(content), true
+}
+
+func (repo *Repository) addNote(ref string, object string, message string, force bool) {
+	notes := repo.readNotes(ref)
+	if _, exists := notes[object]; exists && !force {
+		fmt.Fprintf(os.Stderr, "error: Cannot add notes. Found existing notes for object %s. Use '-f' to overwrite existing notes\n", object)
+		os.Exit(1)
+	}
+	if strings.TrimSpace(message) == "" {
+		// an empty note removes the existing one
+		if _, exists := notes[object]; exists {
+			fmt.Fprintf(os.Stderr, "Removing note for object %s\n", object)
+			delete(notes, object)
+			repo.writeNotes(ref, notes, "Notes removed by 'git notes add'\n")
+		}
+		return
+	}
+	if _, exists := notes[object]; exists {
+		fmt.Fprintf(os.Stderr, "Overwriting existing notes for object %s\n", object)
+	}
+	notes[object] = repo.writeObject("blob", []byte(message))
+	repo.writeNotes(ref, notes, "Notes added by 'git notes add'\n")
+}
+
+func (repo *Repository) removeNote(ref string, object string) {
+	notes := repo.readNotes(ref)
+	if _, exists := notes[object]; !exists {
+		fmt.Fprintf(os.Stderr, "error: Object %s has no note\n", object)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Removing note for object %s\n", object)
+	delete(notes, object)
+	repo.writeNotes(ref, notes, "Notes removed by 'git notes remove'\n")
+}
+
+// listNotes prints "<note blob> <annotated object>" lines, or only the
+// note of one object
+func (repo *Repository) listNotes(ref string, object string) {
+	notes := repo.readNotes(ref)
+	if object != "" {
+		blob, ok := notes[object]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "error: no note found for object %s.\n", object)
+			os.Exit(1)
+		}
+		fmt.Println(blob)
+		return
+	}
+	objects := make([]string, 0, len(notes))
+	for annotated := range notes {
+		objects = append(objects, annotated)
+	}
+	sort.Strings(objects)
+	for _, annotated := range objects {
+		fmt.Printf("%s %s\n", notes[annotated], annotated)
+	}
+}
+
+// formatNoteMessage joins -m paragraphs like git: separated by a blank
+// line, with trailing whitespace stripped and a final newline
+func formatNoteMessage(paragraphs []string) string {
+	trimmed := make([]string, 0, len(paragraphs))
+	for _, paragraph := range paragraphs {
+		if paragraph = strings.TrimRight(paragraph, " \t\n"); paragraph != "" {
+			trimmed = append(trimmed, paragraph)
+		}
+	}
+	if len(trimmed) == 0 {
+		return ""
+	}
+	return strings.Join(trimmed, "\n\n") + "\n"
+}
+
+// notesDisplayName is the heading used by log: "Notes" for the default
+// ref, "Notes (<name>)" for others
+func notesDisplayName(ref string) string {
+	if ref == defaultNotesRef {
+		return "Notes"
+	}
+	return "Notes (" + strings.TrimPrefix(ref, "refs/notes/") + ")"
+}
+
+func (repo *Repository) resolveNotesObject(args []string) string {
+	revision := "HEAD"
+	if len(args) > 0 {
+		revision = args[0]
+	}
+	if len(args) > 1 {
+		log.Fatal("fatal: too many arguments")
+	}
+	return repo.resolveRevision(revision)
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DefaultDeltaBaseCacheLimit = 96 << 20
+
+// object types as stored in pack entry headers
+const (
+	packObjectCommit   = 1
+	packObjectTree     = 2
+	packObjectBlob     = 3
+	packObjectTag      = 4
+	packObjectOfsDelta = 6
+	packObjectRefDelta = 7
+)
+
+var packObjectTypeNames = map[int]string{
+	packObjectCommit: "commit",
+	packObjectTree:   "tree",
+	packObjectBlob:   "blob",
+	packObjectTag:    "tag",
+}
+
+type packIndex struct {
+	fanout  [256]uint32
+	hashes  []byte // sorted, ObjectShaLength bytes per object
+	offsets []int64
+	crcs    []byte // crc32 of each packed entry, 4 bytes per object; version 2 only
+	mapping []byte // the mapped index file the tables point into, unmapped by close
+}
+
+type packFile struct {
+	path           string // without the .pack/.idx extension
+	index          packIndex
+	data           *mappedFile
+	deltaBaseCache *objectCache // materialized delta bases keyed by pack offset
+	users          int          // holders reading from it, guarded by the packsLock of the repository
+	retired        bool         // dropped by reloadPackFiles, closed once it has no holders left
+}
+
+// readPackIndex maps and checks an index: its size has to fit the object
+// count of the fan-out table, which has to be sorted, and the offsets have
+// to point into the data of a pack of packSize bytes. Damage is reported
+// through fatalCorruptIndex.
+func readPackIndex(path string, packSize int64) packIndex {
+	// version 1 format:
+	// <256 x 4-byte fan-out> <N x (4-byte offset, 20-byte sha)> <pack checksum> <idx checksum>
+	// version 2 format:
+	// "\377tOc" <4-byte version> <256 x 4-byte fan-out> <N x 20-byte sha> <N x 4-byte crc>
+	// <N x 4-byte offset> <M x 8-byte large offset> <pack checksum> <idx checksum>
+	content := mapWholeFile(path)
+	index := packIndex{mapping: content}
+	fanoutStart := 0
+	isVersion2 := bytes.HasPrefix(content, []byte("\377tOc"))
+	if isVersion2 {
+		if len(content) < 8 {
+			fatalCorruptIndex(path, "index file is too small")
+		}
+		if version := binary.BigEndian.Uint32(content[4:8]); version != 2 {
+			log.Fatalf("%s: unsupported index version %d", path, version)
+		}
+		fanoutStart = 8
+	}
+	if len(content) < fanoutStart+256*4 {
+		fatalCorruptIndex(path, "index file is too small")
+	}
+	for i := 0; i < 256; i++ {
+		index.fanout[i] = binary.BigEndian.Uint32(content[fanoutStart+i*4:])
+		if i > 0 && index.fanout[i] < index.fanout[i-1] {
+			fatalCorruptIndex(path, "non-monotonic fan-out table")
+		}
+	}
+	objectCount := int(index.fanout[255])
+	entriesStart := fanoutStart + 256*4
+	trailerSize := 2 * ObjectShaLength
+	// the largest offset an entry can start at, before the pack trailer
+	dataEnd := packSize - ObjectShaLength
+	checkOffset := func(position int, offset int64) {
+		if offset < 12 || offset >= dataEnd {
+			fatalCorruptIndex(path, fmt.Sprintf("offset %d of object %d is outside of the pack", offset, position))
+		}
+	}
+	index.offsets = make([]int64, objectCount)
+	if !isVersion2 {
+		if len(content) != entriesStart+objectCount*(4+ObjectShaLength)+trailerSize {
+			fatalCorruptIndex(path, fmt.Sprintf("index file has the wrong size for %d objects", objectCount))
+		}
+		index.hashes = make([]byte, 0, objectCount*ObjectShaLength)
+		for i := 0; i < objectCount; i++ {
+			entry := content[entriesStart+i*(4+ObjectShaLength):]
+			index.offsets[i] = int64(binary.BigEndian.Uint32(entry))
+			checkOffset(i, index.offsets[i])
+			index.hashes = append(index.hashes, entry[4:4+ObjectShaLength]...)
+		}
+		// nothing points into the mapping any more
+		index.close()
+		return index
+	}
+	crcsStart := entriesStart + objectCount*ObjectShaLength
+	offsetsStart := crcsStart + objectCount*4
+	largeOffsetsStart := offsetsStart + objectCount*4
+	largeOffsetsSize := len(content) - trailerSize - largeOffsetsStart
+	if largeOffsetsSize < 0 || largeOffsetsSize%8 != 0 || largeOffsetsSize/8 > objectCount {
+		fatalCorruptIndex(path, fmt.Sprintf("index file has the wrong size for %d objects", objectCount))
+	}
+	index.hashes = content[entriesStart:crcsStart]
+	index.crcs = content[crcsStart:offsetsStart]
+	for i := 0; i < objectCount; i++ {
+		offset := binary.BigEndian.Uint32(content[offsetsStart+i*4:])
+		if offset&0x80000000 != 0 {
+			// msb set: the rest is an index into the 8-byte large offset table
+			largeOffsetIndex := int(offset & 0x7fffffff)
+			if largeOffsetIndex >= largeOffsetsSize/8 {
+				fatalCorruptIndex(path, fmt.Sprintf("large offset %d of object %d is out of range", largeOffsetIndex, i))
+			}
+			index.offsets[i] = int64(binary.BigEndian.Uint64(content[largeOffsetsStart+largeOffsetIndex*8:]))
+		} else {
+			index.offsets[i] = int64(offset)
+		}
+		checkOffset(i, index.offsets[i])
+	}
+	return index
+}
+
+// close unmaps the index file; the tables of a version 2 index point into
+// it, so the index must not be used afterwards
+func (index *packIndex) close() {
+	if len(index.mapping) > 0 {
+		unmapRegion(index.mapping)
+	}
+	index.mapping = nil
+}
+
+func (index *packIndex) findOffset(hash string) (int64, bool) {
+	position, ok := index.findPosition(hash)
+	if !ok {
+		return 0, false
+	}
+	return index.offsets[position], true
+}
+
+// findPosition returns where an object is in the sorted tables of the index
+func (index *packIndex) findPosition(hash string) (int, bool) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil || len(hashBytes) != ObjectShaLength {
+		return 0, false
+	}
+	// the fan-out table narrows the search to objects sharing the first byte
+	low := 0
+	if hashBytes[0] > 0 {
+		low = int(index.fanout[hashBytes[0]-1])
+	}
+	high := int(index.fanout[hashBytes[0]])
+	position := low + sort.Search(high-low, func(i int) bool {
+		return bytes.Compare(index.hashAt(low+i), hashBytes) >= 0
+	})
+	if position < high && bytes.Equal(index.hashAt(position), hashBytes) {
+		return position, true
+	}
+	return 0, false
+}
+
+// hashesWithPrefix lists the objects of the index whose names start with
+// prefix, which has at least two hex digits
+func (index *packIndex) hashesWithPrefix(prefix string) []string {
+	first, err := strconv.ParseUint(prefix[:2], 16, 8)
+	if err != nil {
+		return nil
+	}
+	low := 0
+	if first > 0 {
+		low = int(index.fanout[first-1])
+	}
+	high := int(index.fanout[first])
+	position := low + sort.Search(high-low, func(i int) bool {
+		return hex.EncodeToString(index.hashAt(low+i)) >= prefix
+	})
+	hashes := make([]string, 0)
+	for ; position < high; position++ {
+		hash := hex.EncodeToString(index.hashAt(position))
+		if !strings.HasPrefix(hash, prefix) {
+			break
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func (index *packIndex) hashAt(position int) []byte {
+	return index.hashes[position*ObjectShaLength : (position+1)*ObjectShaLength]
+}
+
+// crcAt returns the crc32 the index records for the packed entry of an
+// object; ok is false for version 1 indexes, which have none
+func (index *packIndex) crcAt(position int) (uint32, bool) {
+	if index.crcs == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(index.crcs[position*4:]), true
+}
+
+func openPackFile(path string, deltaBaseCacheLimit int64, windowSize int64, limit int64) *packFile {
+	data := openMappedFile(path+".pack", windowSize, limit)
+	header := make([]byte, 12)
+	if _, err := data.ReadAt(header, 0); err != nil {
+		log.Fatal(err)
+	}
+	// header format: "PACK" <4-byte version> <4-byte object count>
+	if !bytes.HasPrefix(header, []byte("PACK")) {
+		log.Fatalf("%s.pack: bad pack signature", path)
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != 2 && version != 3 {
+		log.Fatalf("%s.pack: unsupported pack version %d", path, version)
+	}
+	index := readPackIndex(path+".idx", data.size)
+	if count := binary.BigEndian.Uint32(header[8:12]); int(count) != len(index.offsets) {
+		fatalCorruptIndex(path+".idx", fmt.Sprintf("%s.pack has %d objects while the index lists %d", path, count, len(index.offsets)))
+	}
+	return &packFile{path: path, index: index, data: data, deltaBaseCache: newObjectCache(deltaBaseCacheLimit)}
+}
+
+// close unmaps the pack and its index
+func (pack *packFile) close() {
+	pack.data.Close()
+	pack.index.close()
+}
+
+// packFiles returns the loaded packs, held for the caller until it hands
+// them to releasePacks, so that they stay open while it reads from them
+func (repo *Repository) packFiles() []*packFile {
+	repo.packsLock.Lock()
+	defer repo.packsLock.Unlock()
+	if repo.packs == nil {
+		repo.loadPackFiles()
+	}
+	for _, pack := range repo.packs {
+		pack.users++
+	}
+	return repo.packs
+}
+
+// holdPack holds a pack the caller already holds once more, for a reader
+// that outlives the caller
+func (repo *Repository) holdPack(pack *packFile) {
+	repo.packsLock.Lock()
+	defer repo.packsLock.Unlock()
+	pack.users++
+}
+
+// releasePacks lets go of packs returned by packFiles, closing those that
+// were reloaded meanwhile once their last holder is done
+func (repo *Repository) releasePacks(packs []*packFile) {
+	repo.packsLock.Lock()
+	defer repo.packsLock.Unlock()
+	for _, pack := range packs {
+		pack.users--
+		if pack.retired && pack.users == 0 {
+			pack.close()
+		}
+	}
+}
+
+func (repo *Repository) loadPackFiles() {
+	defer traceRegion("load pack indexes")()
+	repo.packs = make([]*packFile, 0)
+	windowSize := repo.config.getInt("core.packedGitWindowSize", DefaultPackedGitWindowSize)
+	limit := repo.config.getInt("core.packedGitLimit", DefaultPackedGitLimit)
+	indexPaths := make([]string, 0)
+	for _, objectDir := range repo.objectDirectories() {
+		dirIndexPaths, err := filepath.Glob(filepath.Join(objectDir, "pack", "*.idx"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		indexPaths = append(indexPaths, dirIndexPaths...)
+	}
+	for _, indexPath := range indexPaths {
+		packPath := strings.TrimSuffix(indexPath, ".idx")
+		if _, err := os.Stat(packPath + ".pack"); err != nil {
+			// an index without its pack is left over from an interrupted write
+			continue
+		}
+		repo.packs = append(repo.packs, openPackFile(packPath, repo.deltaBaseCacheLimit, windowSize, limit))
+	}
+}
+
+// reloadPackFiles forgets the loaded packs so the next lookup sees packs
+// that were written or removed since. Packs nobody holds are closed right
+// away, the others by releasePacks once the goroutines reading from them
+// are done.
+func (repo *Repository) reloadPackFiles() {
+	repo.packsLock.Lock()
+	defer repo.packsLock.Unlock()
+	for _, pack := range repo.packs {
+		pack.retired = true
+		if pack.users == 0 {
+			pack.close()
+		}
+	}
+	repo.packs = nil
+}
+
+func (repo *Repository) readPackedObject(hash string) (objectHeader, []byte, bool) {
+	packs := repo.packFiles()
+	defer repo.releasePacks(packs)
+	for _, pack := range packs {
+		if offset, ok := pack.index.findOffset(hash); ok {
+			objectType, content := pack.readVerifiedObject(repo, hash, offset)
+			return objectHeader{objectType, len(content)}, content, true
+		}
+	}
+	return objectHeader{}, nil, false
+}
+
+func (pack *packFile) readEntryHeader(offset int64) (int, int, int64) {
+	// entry format: <type-and-size varint> [<delta base>] <zlib data>
+	// the first byte holds 3 bits of type and 4 bits of size, every
+	// following byte adds 7 bits of size while its msb is set
+	buffer := make([]byte, 16)
+	readCount, err := pack.data.ReadAt(buffer, offset)
+	if err != nil && err != io.EOF {
+		panic(err)
+	}
+	buffer = buffer[:readCount]
+	if len(buffer) == 0 {
+		panic(fmt.Sprintf("entry at offset %d is out of range", offset))
+	}
+	objectType := int(buffer[0]>>4) & 7
+	size := int(buffer[0] & 0x0f)
+	shift := uint(4)
+	position := 1
+	for buffer[position-1]&0x80 != 0 {
+		if position == len(buffer) {
+			panic(fmt.Sprintf("bad entry header at offset %d", offset))
+		}
+		size |= int(buffer[position]&0x7f) << shift
+		shift += 7
+		position++
+	}
+	return objectType, size, offset + int64(position)
+}
+
+func (pack *packFile) readOfsDeltaBase(offset int64, position int64) (int64, int64) {
+	// the base offset is relative to the entry and uses a varint where
+	// every continuation adds one before shifting
+	buffer := make([]byte, 16)
+	readCount, err := pack.data.ReadAt(buffer, position)
+	if err != nil && err != io.EOF {
+		panic(err)
+	}
+	buffer = buffer[:readCount]
+	relativeOffset := int64(buffer[0] & 0x7f)
+	consumed := 1
+	for buffer[consumed-1]&0x80 != 0 {
+		relativeOffset = ((relativeOffset + 1) << 7) | int64(buffer[consumed]&0x7f)
+		consumed++
+	}
+	return offset - relativeOffset, position + int64(consumed)
+}
+
+func (pack *packFile) inflateAt(position int64, size int) []byte {
+	contentReader, err := zlib.NewReader(io.NewSectionReader(pack.data, position, 1<<62))
+	if err != nil {
+		panic(fmt.Sprintf("cannot inflate entry data at offset %d: %s", position, err))
+	}
+	defer contentReader.Close()
+	content := make([]byte, size)
+	if _, err := io.ReadFull(contentReader, content); err != nil {
+		panic(fmt.Sprintf("cannot inflate entry data at offset %d: %s", position, err))
+	}
+	return content
+}
+
+type pendingDelta struct {
+	offset int64
+	delta  []byte
+}
+
+// readObjectAt panics on damaged pack data; readVerifiedObject turns that
+// into an error report
+func (pack *packFile) readObjectAt(repo *Repository, offset int64) (string, []byte) {
+	// walk the delta chain down to a base that is either stored whole or
+	// already materialized in the cache, then apply the deltas back up
+	chain := make([]pendingDelta, 0)
+	var baseType string
+	var base []byte
+	for {
+		if header, content, ok := pack.deltaBaseCache.get(strconv.FormatInt(offset, 10)); ok {
+			baseType, base = header.objectType, content
+			break
+		}
+		objectType, size, position := pack.readEntryHeader(offset)
+		if objectType == packObjectOfsDelta {
+			baseOffset, dataPosition := pack.readOfsDeltaBase(offset, position)
+			chain = append(chain, pendingDelta{offset, pack.inflateAt(dataPosition, size)})
+			offset = baseOffset
+			continue
+		}
+		if objectType == packObjectRefDelta {
+			baseHash := make([]byte, ObjectShaLength)
+			if _, err := pack.data.ReadAt(baseHash, position); err != nil {
+				panic(err)
+			}
+			chain = append(chain, pendingDelta{offset, pack.inflateAt(position+ObjectShaLength, size)})
+			if baseOffset, ok := pack.index.findOffset(hex.EncodeToString(baseHash)); ok {
+				offset = baseOffset
+				continue
+			}
+			// the base lives outside this pack
+			header, content := repo.readObject(hex.EncodeToString(baseHash))
+			baseType, base = header.objectType, content
+			break
+		}
+		typeName, ok := packObjectTypeNames[objectType]
+		if !ok {
+			panic(fmt.Sprintf("unknown object type %d at offset %d", objectType, offset))
+		}
+		baseType, base = typeName, pack.inflateAt(position, size)
+		if len(chain) > 0 {
+			pack.deltaBaseCache.add(strconv.FormatInt(offset, 10), objectHeader{baseType, len(base)}, base)
+		}
+		break
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		base = applyDelta(base, chain[i].delta)
+		if i > 0 {
+			// intermediate results are the bases of the next link
+			pack.deltaBaseCache.add(strconv.FormatInt(chain[i].offset, 10), objectHeader{baseType, len(base)}, base)
+		}
+	}
+	return baseType, base
+}
+
+func readDeltaSize(delta []byte, position int) (int, int) {
+	// little-endian varint, 7 bits per byte
+	size := 0
+	shift := uint(0)
+	for {
+		if position >= len(delta) {
+			panic("Unexpected end of delta")
+		}
+		b := delta[position]
+		position++
+		size |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return size, position
+		}
+	}
+}
+
+func applyDelta(base []byte, delta []byte) []byte {
+	// format: <base size varint> <result size varint> <instructions>
+	// copy instruction: 1oooossss followed by the present offset/size bytes
+	// insert instruction: 0nnnnnnn followed by n literal bytes
+	baseSize, position := readDeltaSize(delta, 0)
+	if baseSize != len(base) {
+		panic(fmt.Sprintf("Delta base size mismatch: expected %d, got %d", baseSize, len(base)))
+	}
+	resultSize, position := readDeltaSize(delta, position)
+	result := make([]byte, 0, resultSize)
+	for position < len(delta) {
+		instruction := delta[position]
+		position++
+		if instruction&0x80 != 0 {
+			copyOffset, copySize := 0, 0
+			for i := uint(0); i < 4; i++ {
+				if instruction&(1<<i) != 0 {
+					copyOffset |= int(delta[position]) << (8 * i)
+					position++
+				}
+			}
+			for i := uint(0); i < 3; i++ {
+				if instruction&(0x10<<i) != 0 {
+					copySize |= int(delta[position]) << (8 * i)
+					position++
+				}
+			}
+			if copySize == 0 {
+				copySize = 0x10000
+			}
+			if copyOffset+copySize > len(base) {
+				panic("Delta copy out of base range")
+			}
+			result = append(result, base[copyOffset:copyOffset+copySize]...)
+		} else if instruction != 0 {
+			insertSize := int(instruction)
+			if position+insertSize > len(delta) {
+				panic("Unexpected end of delta")
+			}
+			result = append(result, delta[position:position+insertSize]...)
+			position += insertSize
+		} else {
+			panic("Invalid delta instruction 0")
+		}
+	}
+	if len(result) != resultSize {
+		panic(fmt.Sprintf("Delta result size mismatch: expected %d, got %d", resultSize, len(result)))
+	}
+	return result
+}
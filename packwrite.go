@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// packObject is an object to pack with the path it was reached by, whose
+// name hash brings the versions of a file together in the delta search;
+// "" when there is none to tell
+type packObject struct {
+	hash string
+	path string
+}
+
+// packObjectsFor lists objects to pack without paths
+func packObjectsFor(hashes []string) []packObject {
+	objects := make([]packObject, len(hashes))
+	for i, hash := range hashes {
+		objects[i] = packObject{hash: hash}
+	}
+	return objects
+}
+
+// packDeltaOptions tune the delta search of buildPack
+type packDeltaOptions struct {
+	window  int // how many objects before it in delta search order an object is tried against, 0 for no deltas
+	depth   int // how long chains of deltas may get
+	threads int // goroutines searching for deltas and compressing
+}
+
+// maxPackDeltaDepth is the longest delta chain git allows
+const maxPackDeltaDepth = 4095
+
+// deltaOptions reads pack.window and pack.depth, 10 and 50 by default as in
+// git, and pack.threads, 0 standing for core.threads or one per processor
+func (repo *Repository) deltaOptions() packDeltaOptions {
+	options := packDeltaOptions{
+		window:  int(repo.config.getInt("pack.window", 10)),
+		depth:   int(repo.config.getInt("pack.depth", 50)),
+		threads: repo.jobCount(int(repo.config.getInt("pack.threads", 0))),
+	}
+	return options.checked()
+}
+
+// checked keeps the window and depth within what packs can have
+func (options packDeltaOptions) checked() packDeltaOptions {
+	if options.window < 0 {
+		options.window = 0
+	}
+	if options.depth > maxPackDeltaDepth {
+		fmt.Fprintf(os.Stderr, "warning: delta chain depth %d is too deep, forcing %d\n", options.depth, maxPackDeltaDepth)
+		options.depth = maxPackDeltaDepth
+	}
+	if options.depth <= 0 {
+		options.window = 0
+	}
+	if options.threads <= 0 {
+		options.threads = 1
+	}
+	return options
+}
+
+// packedObject is the state of an object while its pack is built
+type packedObject struct {
+	packType int
+	size     int
+	nameHash uint32
+	base     int    // index of the delta base, -1 for an object stored whole
+	delta    []byte // the delta against base
+	depth    int    // of the delta chain the object ends
+	data     []byte // the compressed entry data, without header
+}
+
+// buildPack creates a pack holding the given objects in the given order.
+// Objects are stored as deltas against similar objects of the same type
+// where that is smaller: they are tried against the window of objects
+// before them sorted by type, name hash and size, biggest first, the way
+// git finds delta bases. Deltas are written after their base, which they
+// refer to by offset.
+func (repo *Repository) buildPack(objects []packObject, options packDeltaOptions, progress Progress) *packStream {
+	jobs := options.threads
+	packed := make([]packedObject, len(objects))
+	progress.Start("Counting objects", len(objects))
+	runParallel(jobs, len(objects), func(i int) {
+		header, content := repo.readOriginalObject(objects[i].hash)
+		packed[i] = packedObject{packType: packTypeFor(header.objectType), size: len(content), nameHash: packNameHash(objects[i].path), base: -1}
+		progress.Add(1, 0)
+	})
+	progress.Stop()
+
+	repo.findDeltas(objects, packed, options, progress)
+
+	// compressing is the expensive part and runs in parallel, the entries
+	// are then laid out in order
+	progress.Start("Writing objects", len(objects))
+	runParallel(jobs, len(objects), func(i int) {
+		content := packed[i].delta
+		if packed[i].base == -1 {
+			_, content = repo.readOriginalObject(objects[i].hash)
+		}
+		var compressed bytes.Buffer
+		contentWriter := zlib.NewWriter(&compressed)
+		contentWriter.Write(content)
+		contentWriter.Close()
+		packed[i].data = compressed.Bytes()
+	})
+
+	var data bytes.Buffer
+	data.WriteString("PACK")
+	binary.Write(&data, binary.BigEndian, uint32(2))
+	binary.Write(&data, binary.BigEndian, uint32(len(objects)))
+	stream := &packStream{entries: make([]packStreamEntry, 0, len(objects))}
+	offsets := make([]int64, len(objects))
+	written := make([]bool, len(objects))
+	var write func(i int)
+	write = func(i int) {
+		if written[i] {
+			return
+		}
+		object := &packed[i]
+		entry := packStreamEntry{
+			packType:   object.packType,
+			dataSize:   object.size,
+			hash:       objects[i].hash,
+			objectType: packObjectTypeNames[object.packType],
+			size:       object.size,
+		}
+		var header bytes.Buffer
+		if object.base != -1 {
+			write(object.base)
+			entry.offset = int64(data.Len())
+			entry.packType, entry.dataSize = packObjectOfsDelta, len(object.delta)
+			entry.baseOffset, entry.base, entry.depth = offsets[object.base], objects[object.base].hash, object.depth
+			header.Write(packEntryHeader(packObjectOfsDelta, len(object.delta)))
+			header.Write(encodeOfsDeltaOffset(entry.offset - entry.baseOffset))
+		} else {
+			entry.offset = int64(data.Len())
+			header.Write(packEntryHeader(object.packType, object.size))
+		}
+		entry.dataPosition = entry.offset + int64(header.Len())
+		checksum := crc32.NewIEEE()
+		checksum.Write(header.Bytes())
+		checksum.Write(object.data)
+		entry.crc = checksum.Sum32()
+		entry.packedSize = int64(header.Len() + len(object.data))
+		data.Write(header.Bytes())
+		data.Write(object.data)
+		offsets[i] = entry.offset
+		written[i] = true
+		stream.entries = append(stream.entries, entry)
+		object.data, object.delta = nil, nil
+		progress.Add(1, entry.packedSize)
+	}
+	for i := range objects {
+		write(i)
+	}
+	progress.Stop()
+	checksum := sha1.Sum(data.Bytes())
+	data.Write(checksum[:])
+	stream.data = data.Bytes()
+	return stream
+}
+
+// findDeltas picks the delta base of each object among the window of
+// objects before it in delta search order, keeping the smallest delta.
+// Only objects of the same type are tried, and no deltas are made for
+// objects too small to gain anything or too big to be read whole. With
+// several threads each searches a part of the order, cut where the name
+// hash changes so that the versions of a file stay together.
+func (repo *Repository) findDeltas(objects []packObject, packed []packedObject, options packDeltaOptions, progress Progress) {
+	const minimumDeltaSize = 50
+	if options.window == 0 {
+		return
+	}
+	threshold := repo.bigFileThreshold()
+	order := make([]int, 0, len(objects))
+	for i, object := range packed {
+		if object.size >= minimumDeltaSize && int64(object.size) <= threshold {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := packed[order[i]], packed[order[j]]
+		if a.packType != b.packType {
+			return a.packType > b.packType
+		}
+		if a.nameHash != b.nameHash {
+			return a.nameHash > b.nameHash
+		}
+		return a.size > b.size
+	})
+	segments := make([][]int, 0, options.threads)
+	// parts smaller than a couple of windows are not worth a thread
+	segmentSize := len(order) / options.threads
+	if segmentSize < 2*options.window {
+		segmentSize = 2 * options.window
+	}
+	for start := 0; start < len(order); {
+		end := start + segmentSize
+		if end >= len(order) {
+			end = len(order)
+		}
+		for end < len(order) && packed[order[end]].nameHash == packed[order[end-1]].nameHash {
+			end++
+		}
+		segments = append(segments, order[start:end])
+		start = end
+	}
+	progress.Start("Compressing objects", len(order))
+	runParallel(len(segments), len(segments), func(segment int) {
+		repo.searchDeltas(objects, packed, segments[segment], options, progress)
+	})
+	progress.Stop()
+}
+
+// searchDeltas is the delta search over one part of the delta search order
+func (repo *Repository) searchDeltas(objects []packObject, packed []packedObject, order []int, options packDeltaOptions, progress Progress) {
+	type windowEntry struct {
+		object int
+		index  *deltaIndex
+	}
+	window := make([]windowEntry, 0, options.window)
+	for _, i := range order {
+		target := &packed[i]
+		_, content := repo.readOriginalObject(objects[i].hash)
+		for _, candidate := range window {
+			base := &packed[candidate.object]
+			if base.packType != target.packType || base.depth >= options.depth {
+				continue
+			}
+			// as git does, a base must leave room for a delta worth having,
+			// less the deeper its chain already is
+			maxSize, referenceDepth := target.size/2-20, 1
+			if target.base != -1 {
+				maxSize, referenceDepth = len(target.delta), target.depth
+			}
+			maxSize = maxSize * (options.depth - base.depth) / (options.depth - referenceDepth + 1)
+			if maxSize <= 0 || target.size-base.size >= maxSize || target.size < base.size/32 {
+				continue
+			}
+			if delta, ok := candidate.index.createDelta(content, maxSize); ok && (target.base == -1 || len(delta) < len(target.delta)) {
+				target.base, target.delta, target.depth = candidate.object, delta, base.depth+1
+			}
+		}
+		if len(window) == options.window {
+			window = window[1:]
+		}
+		window = append(window, windowEntry{i, newDeltaIndex(content)})
+		progress.Add(1, 0)
+	}
+}
+
+// benchmarkPacking builds packs of what the refs reach with every
+// combination of windows and depths, without keeping them, and prints how
+// big each came out and how long it took, to help choose pack.window and
+// pack.depth
+func (repo *Repository) benchmarkPacking(windows []int, depths []int, threads int) {
+	objects := repo.refObjects()
+	fmt.Printf("%d objects\n", len(objects))
+	fmt.Printf("%6s %6s %8s %12s %8s\n", "window", "depth", "deltas", "size", "time")
+	for _, window := range windows {
+		for _, depth := range depths {
+			options := packDeltaOptions{window: window, depth: depth, threads: threads}.checked()
+			start := time.Now()
+			stream := repo.buildPack(objects, options, noProgress{})
+			elapsed := time.Since(start)
+			deltas := 0
+			for _, entry := range stream.entries {
+				if entry.isDelta() {
+					deltas++
+				}
+			}
+			fmt.Printf("%6d %6d %8d %12s %7.2fs\n", options.window, options.depth, deltas, humanSize(float64(len(stream.data))), elapsed.Seconds())
+		}
+	}
+}
+
+// packEntryHeader is the header of a pack entry: the type and the size,
+// four bits of it in the first byte and seven in each byte after
+func packEntryHeader(packType int, size int) []byte {
+	header := make([]byte, 0, 10)
+	b := byte(packType<<4) | byte(size&0x0f)
+	for size >>= 4; size > 0; size >>= 7 {
+		header = append(header, b|0x80)
+		b = byte(size & 0x7f)
+	}
+	return append(header, b)
+}
+
+// encodeOfsDeltaOffset writes how far back the base of an ofs delta is,
+// in the varint readOfsDeltaBase reads
+func encodeOfsDeltaOffset(relativeOffset int64) []byte {
+	var encoded [10]byte
+	position := len(encoded) - 1
+	encoded[position] = byte(relativeOffset & 0x7f)
+	for relativeOffset >>= 7; relativeOffset > 0; relativeOffset >>= 7 {
+		relativeOffset--
+		position--
+		encoded[position] = byte(0x80 | relativeOffset&0x7f)
+	}
+	return encoded[position:]
+}
+
+// looseObjects lists the loose objects in the repository's own object
+// directory
+func (repo *Repository) looseObjects() []string {
+	objectDir := filepath.Join(repo.gitDir, "objects")
+	hashes := make([]string, 0)
+	fanoutDirs, err := os.ReadDir(objectDir)
+	if err != nil {
+		return hashes
+	}
+	for _, fanoutDir := range fanoutDirs {
+		if !fanoutDir.IsDir() || len(fanoutDir.Name()) != 2 || !isHexString(fanoutDir.Name()) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(objectDir, fanoutDir.Name()))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if hash := fanoutDir.Name() + file.Name(); isFullHash(hash) {
+				hashes = append(hashes, strings.ToLower(hash))
+			}
+		}
+	}
+	return hashes
+}
+
+// ownPacks returns the packs in the repository's own object directory,
+// held like packFiles does; the packs of alternates are never rewritten or
+// deleted
+func (repo *Repository) ownPacks() []*packFile {
+	packDir := filepath.Join(repo.gitDir, "objects", "pack")
+	packs := make([]*packFile, 0)
+	others := make([]*packFile, 0)
+	for _, pack := range repo.packFiles() {
+		if filepath.Dir(pack.path) == packDir {
+			packs = append(packs, pack)
+		} else {
+			others = append(others, pack)
+		}
+	}
+	repo.releasePacks(others)
+	return packs
+}
+
+// objectHashes lists every object in a pack, in index order
+func (pack *packFile) objectHashes() []string {
+	hashes := make([]string, 0, len(pack.index.offsets))
+	for i := range pack.index.offsets {
+		hashes = append(hashes, hex.EncodeToString(pack.index.hashAt(i)))
+	}
+	return hashes
+}
+
+// isKept reports whether a .keep file protects the pack from repacking
+func (pack *packFile) isKept() bool {
+	_, err := os.Stat(pack.path + ".keep")
+	return err == nil
+}
+
+// removePack deletes a pack with its index and the files git derives
+// from them
+func removePack(pack *packFile) {
+	for _, extension := range []string{".idx", ".pack", ".rev", ".bitmap"} {
+		os.Remove(pack.path + extension)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+)
+
+// pagerOption is set by the global --paginate (1) and --no-pager (-1)
+// options, 0 leaves the decision to the command and the config
+var pagerOption int
+
+var pagerProcess *exec.Cmd
+
+// setupPager sends the rest of stdout through the pager when stdout is
+// a terminal. The pager comes from GIT_PAGER, pager.<command>, core.pager
+// or PAGER, in that order, and defaults to less; "cat" or an empty value
+// disable paging.
+func (repo *Repository) setupPager(command string) {
+	if pagerOption < 0 || !isTerminal(os.Stdout) || pagerProcess != nil {
+		return
+	}
+	pager, ok := os.LookupEnv("GIT_PAGER")
+	if !ok && repo != nil {
+		if value, configured := repo.config.get("pager." + command); configured {
+			switch value {
+			case "false", "no", "off", "0":
+				if pagerOption == 0 {
+					return
+				}
+			case "true", "yes", "on", "1":
+			default:
+				pager, ok = value, true
+			}
+		}
+	}
+	if !ok {
+		pager = repo.pagerCommand()
+	}
+	if pager == "" || pager == "cat" {
+		return
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	traceRunCommand([]string{"sh", "-c", pager})
+	pagerProcess = exec.Command("sh", "-c", pager)
+	pagerProcess.Stdin = reader
+	pagerProcess.Stdout = os.Stdout
+	pagerProcess.Stderr = os.Stderr
+	pagerProcess.Env = os.Environ()
+	// quit if one screen, keep colors and do not clear the screen
+	if _, set := os.LookupEnv("LESS"); !set {
+		pagerProcess.Env = append(pagerProcess.Env, "LESS=FRX")
+	}
+	if _, set := os.LookupEnv("LV"); !set {
+		pagerProcess.Env = append(pagerProcess.Env, "LV=-c")
+	}
+	if err := pagerProcess.Start(); err != nil {
+		// fall back to unpaged output like git does for a missing pager
+		pagerProcess = nil
+		reader.Close()
+		writer.Close()
+		return
+	}
+	reader.Close()
+	os.Stdout = writer
+}
+
+// pagerCommand returns the pager of commands without a pager.<command>
+// setting, from GIT_PAGER, core.pager or PAGER and else less. repo may be
+// nil outside of a repository.
+func (repo *Repository) pagerCommand() string {
+	if pager, ok := os.LookupEnv("GIT_PAGER"); ok {
+		return pager
+	}
+	if repo != nil {
+		if pager, ok := repo.config.get("core.pager"); ok {
+			return pager
+		}
+	}
+	if pager, ok := os.LookupEnv("PAGER"); ok {
+		return pager
+	}
+	return "less"
+}
+
+// finishPager closes the pipe to the pager and waits until the user
+// leaves it
+func finishPager() {
+	if pagerProcess == nil {
+		return
+	}
+	os.Stdout.Close()
+	pagerProcess.Wait()
+	pagerProcess = nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type patchIDOptions struct {
+	stable   bool // sum the ids of every file so that file order does not matter
+	verbatim bool // keep whitespace instead of ignoring it
+}
+
+// patchIDState accumulates the id of one patch: unstable ids hash the
+// whole patch, stable ones add up the hashes of each file's part
+type patchIDState struct {
+	sum    [sha1.Size]byte
+	hash   []byte
+	length int
+}
+
+func (state *patchIDState) add(line string, options patchIDOptions) {
+	if !options.verbatim {
+		line = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+				return -1
+			}
+			return r
+		}, line)
+	}
+	state.hash = append(state.hash, line...)
+	state.length += len(line)
+}
+
+// flush adds the hash of the lines since the last flush to the sum, byte
+// by byte with carry
+func (state *patchIDState) flush() {
+	digest := sha1.Sum(state.hash)
+	state.hash = state.hash[:0]
+	carry := 0
+	for i := range state.sum {
+		carry += int(state.sum[i]) + int(digest[i])
+		state.sum[i] = byte(carry)
+		carry >>= 8
+	}
+}
+
+// readPatchID computes the id of the patch starting at lines[start]. Any
+// text before the first "diff" line, such as a commit message, is skipped.
+// It stops at the next "commit <id>" or "From <id>" line and returns that
+// id, or at the end of the patch's last hunk.
+func readPatchID(lines []string, start int, options patchIDOptions) (id string, length int, next string, end int) {
+	var state patchIDState
+	before, after := -1, -1
+	isBinary := false
+	oldHash, newHash := "", ""
+	i := start
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		rest := line
+		for _, prefix := range []string{"diff-tree ", "commit ", "From "} {
+			if strings.HasPrefix(line, prefix) {
+				rest = line[len(prefix):]
+				break
+			}
+		}
+		if rest == line && strings.HasPrefix(line, "\\ ") && len(line) > 12 {
+			// "\ No newline at end of file"
+			if options.verbatim {
+				state.hash = append(state.hash, line...)
+			}
+			continue
+		}
+		if len(rest) >= 40 && isFullHash(rest[:40]) {
+			next = rest[:40]
+			i++
+			break
+		}
+		if state.length == 0 && !strings.HasPrefix(line, "diff ") {
+			continue
+		}
+
+		if before == -1 {
+			switch {
+			case strings.HasPrefix(line, "GIT binary patch"), strings.HasPrefix(line, "Binary files"):
+				isBinary = true
+				before = 0
+				state.hash = append(state.hash, oldHash+newHash...)
+				if options.stable {
+					state.flush()
+				}
+				continue
+			case strings.HasPrefix(line, "index "):
+				hashes, _, _ := strings.Cut(strings.TrimSuffix(line[len("index "):], "\n"), " ")
+				if old, new, ok := strings.Cut(hashes, ".."); ok {
+					oldHash, newHash = old, new
+				}
+				continue
+			case strings.HasPrefix(line, "--- "):
+				before, after = 1, 1
+			case line == "" || !isASCIILetter(line[0]):
+				i++
+				return state.finish(), state.length, "", i
+			}
+		}
+		if isBinary {
+			if strings.HasPrefix(line, "diff ") {
+				isBinary = false
+				before = -1
+			}
+			continue
+		}
+
+		if before == 0 && after == 0 {
+			if strings.HasPrefix(line, "@@ -") {
+				// the line numbers do not count, only the lengths
+				fields := strings.Fields(line)
+				before, after = 1, 1
+				if len(fields) > 2 {
+					_, before, _ = parseHunkRange(strings.TrimPrefix(fields[1], "-"))
+					_, after, _ = parseHunkRange(strings.TrimPrefix(fields[2], "+"))
+				}
+				continue
+			}
+			if !strings.HasPrefix(line, "diff ") {
+				i++
+				return state.finish(), state.length, "", i
+			}
+			// the header of the next file
+			if options.stable {
+				state.flush()
+			}
+			before, after = -1, -1
+		}
+
+		if line[0] == '-' || line[0] == ' ' {
+			before--
+		}
+		if line[0] == '+' || line[0] == ' ' {
+			after--
+		}
+		state.add(line, options)
+	}
+	return state.finish(), state.length, next, i
+}
+
+func (state *patchIDState) finish() string {
+	state.flush()
+	return hex.EncodeToString(state.sum[:])
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// writePatchIDs prints "<patch-id> <commit-id>" for every patch of a
+// "git log -p" or format-patch stream; the commit id is all zeros for a
+// patch without a commit line
+func writePatchIDs(w io.Writer, text string, options patchIDOptions) {
+	lines := splitLines([]byte(text))
+	commit := strings.Repeat("0", 40)
+	for i := 0; i < len(lines); {
+		id, length, next, end := readPatchID(lines, i, options)
+		if length > 0 {
+			fmt.Fprintf(w, "%s %s\n", id, commit)
+		}
+		commit = next
+		if next == "" {
+			commit = strings.Repeat("0", 40)
+		}
+		i = end
+	}
+}
+
+// patchIDOptionsFromConfig reads patchid.stable and patchid.verbatim;
+// verbatim ids are always stable
+func (repo *Repository) patchIDOptionsFromConfig() patchIDOptions {
+	options := patchIDOptions{
+		stable:   repo.config.getBool("patchid.stable", false),
+		verbatim: repo.config.getBool("patchid.verbatim", false),
+	}
+	options.stable = options.stable || options.verbatim
+	return options
+}
+
+// commitPatchID is the patch id of the change a commit makes to its first
+// parent, empty for merges
+func (repo *Repository) commitPatchID(hash string, options patchIDOptions) string {
+	commit := repo.readCommitObject(hash)
+	if len(commit.parents) > 1 {
+		return ""
+	}
+	parentTree := ""
+	if len(commit.parents) > 0 {
+		parentTree = repo.readCommitObject(commit.parents[0]).tree
+	}
+	var patch bytes.Buffer
+	for _, change := range repo.diffTrees(parentTree, commit.tree) {
+		repo.writePatch(&patch, change, diffOptions{context: DefaultDiffContext})
+	}
+	id, _, _, _ := readPatchID(splitLines(patch.Bytes()), 0, options)
+	return id
+}
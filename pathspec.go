@@ -0,0 +1,246 @@
+package main
+
+import (
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathspec is a pathspec of the command line with its path made relative
+// to the worktree root. Its magic, given as in ":(glob,icase)src/*.c" or
+// in the short forms ":/src" and ":!src", changes how it matches.
+type pathspec struct {
+	original string // as given, for messages
+	path     string // "" standing for the whole worktree
+	glob     bool   // wildcards do not match "/", "**" spanning directories
+	literal  bool   // the path has no wildcards at all
+	icase    bool
+	exclude  bool // files it matches are left out
+}
+
+// parsePathspecs reads pathspecs given relative to the current directory.
+// As in git, when all of them are exclusions they leave files out of the
+// current directory.
+func (repo *Repository) parsePathspecs(args []string) []pathspec {
+	specs := make([]pathspec, 0, len(args)+1)
+	included := false
+	for _, arg := range args {
+		spec := repo.parsePathspec(arg)
+		included = included || !spec.exclude
+		specs = append(specs, spec)
+	}
+	if len(specs) > 0 && !included {
+		specs = append(specs, pathspec{original: ".", path: repo.prefix})
+	}
+	return specs
+}
+
+// parsePathspec reads the magic of a pathspec and resolves its path from the
+// current directory, or from the worktree root with top magic
+func (repo *Repository) parsePathspec(arg string) pathspec {
+	spec := pathspec{original: arg}
+	top := false
+	element := arg
+	switch {
+	case strings.HasPrefix(arg, ":("):
+		end := strings.IndexByte(arg, ')')
+		if end == -1 {
+			log.Fatalf("fatal: Missing ')' at the end of pathspec magic in '%s'", arg)
+		}
+		for _, word := range strings.Split(arg[2:end], ",") {
+			switch strings.TrimSpace(word) {
+			case "top":
+				top = true
+			case "glob":
+				spec.glob = true
+			case "literal":
+				spec.literal = true
+			case "icase":
+				spec.icase = true
+			case "exclude":
+				spec.exclude = true
+			case "":
+			default:
+				log.Fatalf("fatal: Invalid pathspec magic '%s' in '%s'", word, arg)
+			}
+		}
+		element = arg[end+1:]
+	case strings.HasPrefix(arg, ":"):
+		// short magic runs up to a ":" or the first character that cannot
+		// be magic, such as a letter or a wildcard
+		i := 1
+		for ; i < len(arg) && arg[i] != ':' && strings.IndexByte("!\"#%&',-/;<=>@^_`~", arg[i]) != -1; i++ {
+			switch arg[i] {
+			case '/':
+				top = true
+			case '!', '^':
+				spec.exclude = true
+			default:
+				log.Fatalf("fatal: Unimplemented pathspec magic '%c' in '%s'", arg[i], arg)
+			}
+		}
+		element = strings.TrimPrefix(arg[i:], ":")
+	}
+	if spec.glob && spec.literal {
+		log.Fatalf("fatal: %s: 'literal' and 'glob' are incompatible", arg)
+	}
+	base := repo.prefix
+	if top {
+		base = ""
+	}
+	spec.path = repo.worktreeName(repo.resolvePathspecPath(element, base, arg))
+	return spec
+}
+
+// resolvePathspecPath makes the path of a pathspec, relative to base or
+// absolute, relative to the worktree root
+func (repo *Repository) resolvePathspecPath(element string, base string, arg string) string {
+	if filepath.IsAbs(element) {
+		relative, err := filepath.Rel(repo.workTree, element)
+		if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+			log.Fatalf("fatal: %s: '%s' is outside repository at '%s'", arg, arg, repo.workTree)
+		}
+		element, base = filepath.ToSlash(relative), ""
+	}
+	resolved := path.Join(base, filepath.ToSlash(element))
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		log.Fatalf("fatal: %s: '%s' is outside repository at '%s'", arg, arg, repo.workTree)
+	}
+	if resolved == "." {
+		return ""
+	}
+	return resolved
+}
+
+// literalPathspec matches a path of the worktree and the files below it
+func literalPathspec(literalPath string) pathspec {
+	return pathspec{original: literalPath, path: literalPath, literal: true}
+}
+
+// hasWildcards tells whether the path of the pathspec is a pattern
+func (spec pathspec) hasWildcards() bool {
+	return !spec.literal && strings.ContainsAny(spec.path, "*?[\\")
+}
+
+// isPlain tells whether the pathspec only matches its path and what is
+// below it, the worktree having that path when anything does
+func (spec pathspec) isPlain() bool {
+	return !spec.hasWildcards() && !spec.icase && !spec.exclude
+}
+
+// matches tells whether the pathspec selects a file: the file is its path
+// or lies below it, or the path is a pattern the file matches
+func (spec pathspec) matches(filePath string) bool {
+	pattern := spec.path
+	if spec.icase {
+		pattern, filePath = strings.ToLower(pattern), strings.ToLower(filePath)
+	}
+	if isUnderPathspec(filePath, pattern) {
+		return true
+	}
+	if !spec.hasWildcards() {
+		return false
+	}
+	if spec.glob {
+		return wildmatch(pattern, filePath, false)
+	}
+	return fnmatch(pattern, filePath)
+}
+
+// leadsInto tells whether files below a directory may match, so that it
+// has to be looked into rather than taken as a whole
+func (spec pathspec) leadsInto(dir string) bool {
+	if spec.exclude {
+		return false
+	}
+	pattern := spec.path
+	if spec.icase {
+		pattern, dir = strings.ToLower(pattern), strings.ToLower(dir)
+	}
+	if strings.HasPrefix(pattern, dir+"/") {
+		return true
+	}
+	if !spec.hasWildcards() {
+		return false
+	}
+	literal := pattern[:strings.IndexAny(pattern, "*?[\\")]
+	return strings.HasPrefix(dir+"/", literal)
+}
+
+// matchesPathspecs tells whether a file is selected by the pathspecs: one
+// that is not an exclusion has to match it and none of the exclusions may.
+// No pathspecs select every file.
+func matchesPathspecs(filePath string, specs []pathspec) bool {
+	if len(specs) == 0 {
+		return true
+	}
+	included := false
+	for _, spec := range specs {
+		if spec.matches(filePath) {
+			if spec.exclude {
+				return false
+			}
+			included = true
+		}
+	}
+	return included
+}
+
+// pathspecsLeadInto tells whether any of the pathspecs may match files
+// below a directory without matching the directory itself
+func pathspecsLeadInto(dir string, specs []pathspec) bool {
+	for _, spec := range specs {
+		if spec.leadsInto(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// fnmatch matches text against a shell glob whose wildcards match "/" as
+// well, as those of pathspecs without glob magic do
+func fnmatch(pattern string, text string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			rest := strings.TrimLeft(pattern, "*")
+			for i := 0; i <= len(text); i++ {
+				if fnmatch(rest, text[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if text == "" {
+				return false
+			}
+		case '[':
+			if text == "" {
+				return false
+			}
+			if matched, next, ok := matchCharClass(pattern, 0, text[0]); ok {
+				if !matched {
+					return false
+				}
+				pattern, text = pattern[next:], text[1:]
+				continue
+			}
+			// an unterminated class is a literal "["
+			if text[0] != '[' {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if text == "" || text[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, text = pattern[1:], text[1:]
+	}
+	return text == ""
+}
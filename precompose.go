@@ -0,0 +1,97 @@
+package main
+
+import "runtime"
+
+// precomposedLetters lists, for each combining mark, pairs of a letter and
+// the precomposed letter it makes together with the mark: the Latin letters
+// macOS filesystems hand out decomposed (NFD)
+var precomposedLetters = map[rune]string{
+	0x0300: "AÀEÈIÌOÒUÙaàeèiìoòuùÜǛüǜNǸnǹĒḔēḕŌṐōṑWẀwẁÂẦâầĂẰăằÊỀêềÔỒôồƠỜơờƯỪưừ" + // grave accent
+		"YỲyỳ",
+	0x0301: "AÁEÉIÍOÓUÚYÝaáeéiíoóuúyýCĆcćLĹlĺNŃnńRŔrŕSŚsśZŹzźÜǗüǘGǴgǵÅǺåǻÆǼæǽ" + // acute accent
+		"ØǾøǿÇḈçḉĒḖēḗÏḮïḯKḰkḱMḾmḿÕṌõṍŌṒōṓPṔpṕŨṸũṹWẂwẃÂẤâấĂẮăắÊẾêếÔỐôốƠỚơớ" +
+		"ƯỨưứ",
+	0x0302: "AÂEÊIÎOÔUÛaâeêiîoôuûCĈcĉGĜgĝHĤhĥJĴjĵSŜsŝWŴwŵYŶyŷZẐzẑẠẬạậẸỆẹệỌỘọộ", // circumflex accent
+	0x0303: "AÃNÑOÕaãnñoõIĨiĩUŨuũVṼvṽÂẪâẫĂẴăẵEẼeẽÊỄêễÔỖôỗƠỠơỡƯỮưữYỸyỹ",         // tilde
+	0x0304: "AĀaāEĒeēIĪiīOŌoōUŪuūÜǕüǖÄǞäǟȦǠȧǡÆǢæǣǪǬǫǭÖȪöȫÕȬõȭȮȰȯȱYȲyȳGḠgḡḶḸḷḹ" + // macron
+		"ṚṜṛṝ",
+	0x0306: "AĂaăEĔeĕGĞgğIĬiĭOŎoŏUŬuŭȨḜȩḝẠẶạặ", // breve
+	0x0307: "CĊcċEĖeėGĠgġIİZŻzżAȦaȧOȮoȯBḂbḃDḊdḋFḞfḟHḢhḣMṀmṁNṄnṅPṖpṗRṘrṙSṠsṡŚṤ" + // dot above
+		"śṥŠṦšṧṢṨṣṩTṪtṫWẆwẇXẊxẋYẎyẏſẛ",
+	0x0308: "AÄEËIÏOÖUÜaäeëiïoöuüyÿYŸHḦhḧÕṎõṏŪṺūṻWẄwẅXẌxẍtẗ",   // diaeresis
+	0x0309: "AẢaảÂẨâẩĂẲăẳEẺeẻÊỂêểIỈiỉOỎoỏÔỔôổƠỞơởUỦuủƯỬưửYỶyỷ", // hook above
+	0x030a: "AÅaåUŮuůwẘyẙ",                                     // ring above
+	0x030b: "OŐoőUŰuű",                                         // double acute accent
+	0x030c: "CČcčDĎdďEĚeěLĽlľNŇnňRŘrřSŠsšTŤtťZŽzžAǍaǎIǏiǐOǑoǒUǓuǔÜǙüǚGǦgǧKǨkǩ" + // caron
+		"ƷǮʒǯjǰHȞhȟ",
+	0x030f: "AȀaȁEȄeȅIȈiȉOȌoȍRȐrȑUȔuȕ", // double grave accent
+	0x0311: "AȂaȃEȆeȇIȊiȋOȎoȏRȒrȓUȖuȗ", // inverted breve
+	0x031b: "OƠoơUƯuư",                 // horn
+	0x0323: "BḄbḅDḌdḍHḤhḥKḲkḳLḶlḷMṂmṃNṆnṇRṚrṛSṢsṣTṬtṭVṾvṿWẈwẉZẒzẓAẠaạEẸeẹIỊiị" + // dot below
+		"OỌoọƠỢơợUỤuụƯỰưựYỴyỵ",
+	0x0324: "UṲuṳ",                                         // diaeresis below
+	0x0325: "AḀaḁ",                                         // ring below
+	0x0326: "SȘsșTȚtț",                                     // comma below
+	0x0327: "CÇcçGĢgģKĶkķLĻlļNŅnņRŖrŗSŞsşTŢtţEȨeȩDḐdḑHḨhḩ", // cedilla
+	0x0328: "AĄaąEĘeęIĮiįUŲuųOǪoǫ",                         // ogonek
+	0x032d: "DḒdḓEḘeḙLḼlḽNṊnṋTṰtṱUṶuṷ",                     // circumflex accent below
+	0x032e: "HḪhḫ",                                         // breve below
+	0x0330: "EḚeḛIḬiḭUṴuṵ",                                 // tilde below
+	0x0331: "BḆbḇDḎdḏKḴkḵLḺlḻNṈnṉRṞrṟTṮtṯZẔzẕhẖ",           // macron below
+}
+
+// compositions maps a letter and a combining mark to their precomposed letter
+var compositions = func() map[[2]rune]rune {
+	compositions := make(map[[2]rune]rune)
+	for mark, pairs := range precomposedLetters {
+		letters := []rune(pairs)
+		for i := 0; i+1 < len(letters); i += 2 {
+			compositions[[2]rune{letters[i], mark}] = letters[i+1]
+		}
+	}
+	return compositions
+}()
+
+// precompose turns the decomposed letters of a name back into the
+// precomposed (NFC) form that was committed, composing Latin letters with
+// their marks and Hangul syllables from their jamo
+func precompose(name string) string {
+	if isASCII(name) {
+		return name
+	}
+	composed := make([]rune, 0, len(name))
+	for _, r := range name {
+		if last := len(composed) - 1; last >= 0 {
+			previous := composed[last]
+			if letter, ok := compositions[[2]rune{previous, r}]; ok {
+				composed[last] = letter
+				continue
+			}
+			// Hangul syllables are a leading consonant, a vowel and an
+			// optional trailing consonant, numbered in that order
+			const syllableBase, leadBase, vowelBase, trailBase = 0xac00, 0x1100, 0x1161, 0x11a7
+			switch {
+			case previous >= leadBase && previous < leadBase+19 && r >= vowelBase && r < vowelBase+21:
+				composed[last] = syllableBase + ((previous-leadBase)*21+r-vowelBase)*28
+				continue
+			case previous >= syllableBase && previous < syllableBase+11172 && (previous-syllableBase)%28 == 0 && r > trailBase && r < trailBase+28:
+				composed[last] = previous + r - trailBase
+				continue
+			}
+		}
+		composed = append(composed, r)
+	}
+	return string(composed)
+}
+
+// worktreeName returns the name of a worktree file as it is compared with
+// the index and trees. On macOS with core.precomposeUnicode, which git init
+// sets there, the decomposed names the filesystem returns are precomposed
+// so that they match the names they were committed under; the filesystem
+// finds the files by either form. Elsewhere names are taken as they are.
+func (repo *Repository) worktreeName(name string) string {
+	if runtime.GOOS != "darwin" || !repo.config.getBool("core.precomposeUnicode", false) {
+		return name
+	}
+	return precompose(name)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prettyFormat is a --pretty value: one of git's presets or a string of
+// placeholders
+type prettyFormat struct {
+	preset     string // oneline, short, medium, full, fuller or raw, empty for a format string
+	format     string
+	terminator bool // whether every entry ends with a newline, rather than newlines separating them
+}
+
+var prettyPresets = map[string]bool{"oneline": true, "short": true, "medium": true, "full": true, "fuller": true, "raw": true}
+
+// parsePrettyFormat reads a --pretty or --format value: a preset,
+// "format:<string>", "tformat:<string>", or a string with a "%" taken as
+// tformat
+func parsePrettyFormat(value string) prettyFormat {
+	switch {
+	case value == "":
+		return prettyFormat{preset: "medium"}
+	case prettyPresets[value]:
+		return prettyFormat{preset: value, terminator: value == "oneline"}
+	case strings.HasPrefix(value, "format:"):
+		return prettyFormat{format: strings.TrimPrefix(value, "format:")}
+	case strings.HasPrefix(value, "tformat:"):
+		return prettyFormat{format: strings.TrimPrefix(value, "tformat:"), terminator: true}
+	case strings.Contains(value, "%"):
+		return prettyFormat{format: value, terminator: true}
+	}
+	log.Fatalf("fatal: invalid --pretty format: %s", value)
+	return prettyFormat{}
+}
+
+// prettyOptions are the settings a commit is shown with besides its format
+type prettyOptions struct {
+	color        bool
+	dateStyle    string
+	abbrevCommit bool
+	note         string // the note of the commit, empty if none
+	notesName    string // how the notes ref is shown, e.g. "Notes"
+	showNotes    bool   // show the note below preset formats, not only as %N
+	decoration   string // the refs decorating the commit, as %D shows them
+	decorate     bool   // show the decoration in preset formats, not only as %d and %D
+}
+
+// decorationSuffix is the " (<refs>)" shown after a commit name
+func (options prettyOptions) decorationSuffix() string {
+	if options.decoration == "" {
+		return ""
+	}
+	return colorize(options.color, colorYellow, " (") + options.decoration + colorize(options.color, colorYellow, ")")
+}
+
+// writePrettyCommit shows a commit in the given format, followed by a
+// newline when the format is a terminator one
+func (repo *Repository) writePrettyCommit(w io.Writer, hash string, commit commitObject, pretty prettyFormat, options prettyOptions) {
+	if pretty.preset == "" {
+		fmt.Fprint(w, expandPrettyFormat(pretty.format, hash, commit, options))
+		if pretty.terminator {
+			fmt.Fprintln(w)
+		}
+		return
+	}
+
+	name := hash
+	if options.abbrevCommit {
+		name = abbreviateHash(hash)
+	}
+	if pretty.preset == "oneline" {
+		subject, _ := splitCommitMessage(commit.commitMessage)
+		if options.decorate {
+			name = colorize(options.color, colorYellow, name) + options.decorationSuffix()
+		} else {
+			name = colorize(options.color, colorYellow, name)
+		}
+		fmt.Fprintf(w, "%s %s\n", name, subject)
+		writePrettyNote(w, "", options)
+		return
+	}
+
+	fmt.Fprint(w, colorize(options.color, colorYellow, "commit "+name))
+	if options.decorate {
+		fmt.Fprint(w, options.decorationSuffix())
+	}
+	fmt.Fprintln(w)
+	if pretty.preset == "raw" {
+		headers, _, _ := strings.Cut(string(serializeCommit(commit)), "\n\n")
+		fmt.Fprintln(w, headers)
+	} else if len(commit.parents) > 1 {
+		shortParents := make([]string, len(commit.parents))
+		for i, parent := range commit.parents {
+			shortParents[i] = abbreviateHash(parent)
+		}
+		fmt.Fprintf(w, "Merge: %s\n", strings.Join(shortParents, " "))
+	}
+	now := time.Now()
+	switch pretty.preset {
+	case "short":
+		fmt.Fprintf(w, "Author: %s\n", commit.author.nameAndEmail())
+	case "medium":
+		fmt.Fprintf(w, "Author: %s\n", commit.author.nameAndEmail())
+		fmt.Fprintf(w, "Date:   %s\n", formatDate(commit.author.when, options.dateStyle, now))
+	case "full":
+		fmt.Fprintf(w, "Author: %s\n", commit.author.nameAndEmail())
+		fmt.Fprintf(w, "Commit: %s\n", commit.committer.nameAndEmail())
+	case "fuller":
+		fmt.Fprintf(w, "Author:     %s\n", commit.author.nameAndEmail())
+		fmt.Fprintf(w, "AuthorDate: %s\n", formatDate(commit.author.when, options.dateStyle, now))
+		fmt.Fprintf(w, "Commit:     %s\n", commit.committer.nameAndEmail())
+		fmt.Fprintf(w, "CommitDate: %s\n", formatDate(commit.committer.when, options.dateStyle, now))
+	}
+
+	message := strings.Trim(commit.commitMessage, "\n")
+	if pretty.preset == "short" {
+		message, _, _ = strings.Cut(message, "\n\n")
+	}
+	if message != "" {
+		fmt.Fprintln(w)
+		for _, line := range strings.Split(message, "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+	writePrettyNote(w, "\n", options)
+}
+
+// writePrettyNote shows the note of a commit below a preset format, after
+// separator
+func writePrettyNote(w io.Writer, separator string, options prettyOptions) {
+	if !options.showNotes || options.note == "" {
+		return
+	}
+	fmt.Fprintf(w, "%s%s:\n", separator, options.notesName)
+	for _, line := range strings.Split(strings.TrimRight(options.note, "\n"), "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+}
+
+// expandPrettyFormat replaces the placeholders of a format string;
+// unknown placeholders are kept as they are, like git does
+func expandPrettyFormat(format string, hash string, commit commitObject, options prettyOptions) string {
+	var output strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			output.WriteByte(format[i])
+			continue
+		}
+		length, text := expandPlaceholder(format[i+1:], hash, commit, options)
+		if length == 0 {
+			output.WriteByte('%')
+			continue
+		}
+		output.WriteString(text)
+		i += length
+	}
+	return output.String()
+}
+
+// expandPlaceholder expands the placeholder at the start of format, the
+// text after a "%", and returns how many bytes of format it took
+func expandPlaceholder(format string, hash string, commit commitObject, options prettyOptions) (int, string) {
+	if format == "" {
+		return 0, ""
+	}
+	subject, _ := splitCommitMessage(commit.commitMessage)
+	switch format[0] {
+	case '%':
+		return 1, "%"
+	case 'n':
+		return 1, "\n"
+	case 'H':
+		return 1, hash
+	case 'h':
+		return 1, abbreviateHash(hash)
+	case 'T':
+		return 1, commit.tree
+	case 't':
+		return 1, abbreviateHash(commit.tree)
+	case 'P', 'p':
+		parents := make([]string, len(commit.parents))
+		for i, parent := range commit.parents {
+			parents[i] = parent
+			if format[0] == 'p' {
+				parents[i] = abbreviateHash(parent)
+			}
+		}
+		return 1, strings.Join(parents, " ")
+	case 's':
+		return 1, subject
+	case 'f':
+		return 1, sanitizedSubject(subject)
+	case 'b':
+		message := strings.TrimLeft(commit.commitMessage, "\n")
+		if _, body, ok := strings.Cut(message, "\n\n"); ok {
+			return 1, strings.TrimLeft(body, "\n")
+		}
+		return 1, ""
+	case 'B':
+		return 1, strings.TrimLeft(commit.commitMessage, "\n")
+	case 'N':
+		return 1, options.note
+	case 'd':
+		return 1, options.decorationSuffix()
+	case 'D':
+		return 1, options.decoration
+	case 'e':
+		for _, header := range commit.extraHeaders {
+			if header.key == "encoding" {
+				return 1, header.value
+			}
+		}
+		return 1, ""
+	case 'a', 'c':
+		if len(format) < 2 {
+			return 0, ""
+		}
+		person := commit.author
+		if format[0] == 'c' {
+			person = commit.committer
+		}
+		text, ok := formatIdentityPlaceholder(person, format[1], options.dateStyle)
+		if !ok {
+			return 0, ""
+		}
+		return 2, text
+	case 'x':
+		if len(format) < 3 {
+			return 0, ""
+		}
+		value, err := strconv.ParseUint(format[1:3], 16, 8)
+		if err != nil {
+			return 0, ""
+		}
+		return 3, string([]byte{byte(value)})
+	case 'C':
+		return expandColorPlaceholder(format, options.color)
+	}
+	return 0, ""
+}
+
+// formatIdentityPlaceholder expands the letter after %a or %c
+func formatIdentityPlaceholder(person identity, letter byte, dateStyle string) (string, bool) {
+	localPart, _, _ := strings.Cut(person.email, "@")
+	now := time.Now()
+	switch letter {
+	case 'n', 'N':
+		return person.name, true
+	case 'e', 'E':
+		return person.email, true
+	case 'l', 'L':
+		return localPart, true
+	case 'd':
+		return formatDate(person.when, dateStyle, now), true
+	case 'D':
+		return formatDate(person.when, "rfc", now), true
+	case 'r':
+		return formatDate(person.when, "relative", now), true
+	case 't':
+		return formatDate(person.when, "unix", now), true
+	case 'i':
+		return formatDate(person.when, "iso", now), true
+	case 'I':
+		return formatDate(person.when, "iso-strict", now), true
+	case 's':
+		return formatDate(person.when, "short", now), true
+	}
+	return "", false
+}
+
+// expandColorPlaceholder expands %Cred, %Cgreen, %Cblue, %Creset and
+// %C(<spec>). Colors only show when color is on, unless the spec starts
+// with "always,".
+func expandColorPlaceholder(format string, color bool) (int, string) {
+	for _, name := range []string{"red", "green", "blue", "reset"} {
+		if strings.HasPrefix(format[1:], name) {
+			code, _ := parseColorSpec(name)
+			if !color {
+				code = ""
+			}
+			return 1 + len(name), code
+		}
+	}
+	if !strings.HasPrefix(format, "C(") {
+		return 0, ""
+	}
+	end := strings.IndexByte(format, ')')
+	if end == -1 {
+		return 0, ""
+	}
+	spec := format[2:end]
+	if strings.HasPrefix(spec, "always,") {
+		spec, color = strings.TrimPrefix(spec, "always,"), true
+	} else {
+		spec = strings.TrimPrefix(spec, "auto,")
+	}
+	if spec == "auto" {
+		return end + 1, ""
+	}
+	code, ok := parseColorSpec(spec)
+	if !ok {
+		log.Fatalf("fatal: invalid color value: %s", spec)
+	}
+	if !color {
+		code = ""
+	}
+	return end + 1, code
+}
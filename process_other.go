@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// without a way to check, the process is taken to be running, leaving it
+// to the age of what it left to tell
+func processExists(pid int) bool {
+	return true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Progress receives updates from long running operations such as
+// checkout, index-pack or transfers. Add may be called concurrently from
+// worker goroutines.
+type Progress interface {
+	// Start begins a phase like "Updating files"; total is the expected
+	// number of items or zero when unknown
+	Start(title string, total int)
+	// Add reports count more items and bytes more data processed
+	Add(count int, bytes int64)
+	// Stop finishes the current phase
+	Stop()
+}
+
+// newProgress returns a terminal progress display on stderr, or one that
+// discards updates when quiet is set or stderr is not a terminal
+func newProgress(quiet bool) Progress {
+	if quiet || !isTerminal(os.Stderr) {
+		return noProgress{}
+	}
+	return &terminalProgress{}
+}
+
+type noProgress struct{}
+
+func (noProgress) Start(title string, total int) {}
+func (noProgress) Add(count int, bytes int64)    {}
+func (noProgress) Stop()                         {}
+
+const (
+	// phases finishing faster than this are never shown
+	progressDelay = time.Second
+	// minimum time between two redraws
+	progressInterval = 100 * time.Millisecond
+)
+
+type terminalProgress struct {
+	mutex    sync.Mutex
+	title    string
+	total    int
+	count    int
+	bytes    int64
+	started  time.Time
+	lastDraw time.Time
+	shown    bool
+}
+
+func (progress *terminalProgress) Start(title string, total int) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.title, progress.total = title, total
+	progress.count, progress.bytes = 0, 0
+	progress.started = time.Now()
+	progress.lastDraw = time.Time{}
+	progress.shown = false
+}
+
+func (progress *terminalProgress) Add(count int, bytes int64) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.count += count
+	progress.bytes += bytes
+	now := time.Now()
+	if now.Sub(progress.started) < progressDelay || now.Sub(progress.lastDraw) < progressInterval {
+		return
+	}
+	progress.lastDraw = now
+	progress.shown = true
+	fmt.Fprintf(os.Stderr, "%s\r", progress.line(now))
+}
+
+func (progress *terminalProgress) Stop() {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	if progress.shown {
+		fmt.Fprintf(os.Stderr, "%s, done.\n", progress.line(time.Now()))
+	}
+	progress.shown = false
+}
+
+// line renders "<title>: <percent>% (<count>/<total>)" followed by the
+// amount of data and throughput when bytes were reported
+func (progress *terminalProgress) line(now time.Time) string {
+	line := fmt.Sprintf("%s: %d", progress.title, progress.count)
+	if progress.total > 0 {
+		percent := progress.count * 100 / progress.total
+		line = fmt.Sprintf("%s: %3d%% (%d/%d)", progress.title, percent, progress.count, progress.total)
+	}
+	if progress.bytes > 0 {
+		elapsed := now.Sub(progress.started).Seconds()
+		rate := float64(progress.bytes)
+		if elapsed > 0 {
+			rate /= elapsed
+		}
+		line += fmt.Sprintf(", %s | %s/s", humanSize(float64(progress.bytes)), humanSize(rate))
+	}
+	return line
+}
+
+// humanSize formats a byte count with binary units as git does
+func humanSize(size float64) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB"}
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d bytes", int64(size))
+	}
+	return fmt.Sprintf("%.2f %s", size, units[unit])
+}
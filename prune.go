@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reachableCommits returns head and all of its ancestors
+func (repo *Repository) reachableCommits(head string) map[string]bool {
+	seen := make(map[string]bool)
+	pending := []string{head}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		pending = append(pending, repo.readCommitObject(hash).parents...)
+	}
+	return seen
+}
+
+// reachableObjects marks every object reachable from the refs, HEAD, the
+// reflogs, the index, those of the linked worktrees and the extra heads;
+// missing objects are skipped so
+// a broken ref does not get everything else pruned. prune and gc rely on
+// this to decide what to keep.
+func (repo *Repository) reachableObjects(extraHeads []string) map[string]bool {
+	pending := append([]string{}, extraHeads...)
+	if head, ok := repo.resolveRef("HEAD"); ok {
+		pending = append(pending, head)
+	}
+	for _, ref := range repo.listRefs("refs/") {
+		if hash, ok := repo.resolveRef(ref); ok {
+			pending = append(pending, hash)
+		}
+	}
+	for _, ref := range repo.listReflogs() {
+		for _, entry := range repo.readReflog(ref) {
+			pending = append(pending, entry.oldHash, entry.newHash)
+		}
+	}
+	pending = append(pending, repo.indexRoots(repo.indexPath())...)
+	pending = append(pending, repo.worktreeRoots()...)
+
+	reachable := make(map[string]bool)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[hash] || isNullHash(hash) || !repo.hasObject(hash) {
+			continue
+		}
+		reachable[hash] = true
+		header, content := repo.readOriginalObject(hash)
+		switch header.objectType {
+		case "commit":
+			commit := parseCommitObject(content)
+			pending = append(pending, commit.tree)
+			pending = append(pending, commit.parents...)
+		case "tree":
+			for _, entry := range repo.readTreeEntries(hash) {
+				switch entry.mode {
+				case "160000":
+					// submodule commits live in another repository
+				case "40000":
+					pending = append(pending, entry.hash)
+				default:
+					// blobs have no outgoing links, no need to read them
+					reachable[entry.hash] = true
+				}
+			}
+		case "tag":
+			firstLine := strings.SplitN(string(content), "\n", 2)[0]
+			pending = append(pending, strings.TrimPrefix(firstLine, "object "))
+		}
+	}
+	return reachable
+}
+
+// indexRoots returns the objects of the entries and the cache tree of an
+// index, none when it does not exist
+func (repo *Repository) indexRoots(indexPath string) []string {
+	if _, err := os.Stat(indexPath); err != nil {
+		return nil
+	}
+	index := repo.readIndexFile(indexPath)
+	roots := make([]string, 0, len(index.entries))
+	for _, entry := range index.entries {
+		roots = append(roots, entry.hash)
+	}
+	var addCacheTree func(node *cacheTree)
+	addCacheTree = func(node *cacheTree) {
+		if node.entryCount >= 0 {
+			roots = append(roots, node.hash)
+		}
+		for _, subtree := range node.subtrees {
+			addCacheTree(subtree)
+		}
+	}
+	if index.cacheTree != nil {
+		addCacheTree(index.cacheTree)
+	}
+	return roots
+}
+
+// worktreeRoots returns what the linked worktrees keep alive from their
+// administrative directories under $GIT_DIR/worktrees: the commit of
+// their HEAD, detached or not, their index and their HEAD reflog
+func (repo *Repository) worktreeRoots() []string {
+	dir := filepath.Join(repo.gitDir, "worktrees")
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	roots := make([]string, 0)
+	for _, entry := range entries {
+		adminDir := filepath.Join(dir, entry.Name())
+		if content, err := os.ReadFile(filepath.Join(adminDir, "HEAD")); err == nil {
+			head := strings.TrimSpace(string(content))
+			if target, symbolic := strings.CutPrefix(head, symbolicRefPrefix); symbolic {
+				head, _ = repo.resolveRef(target)
+			}
+			roots = append(roots, head)
+		}
+		roots = append(roots, repo.indexRoots(filepath.Join(adminDir, "index"))...)
+		if content, err := os.ReadFile(filepath.Join(adminDir, "logs", "HEAD")); err == nil {
+			for _, logEntry := range parseReflog(content) {
+				roots = append(roots, logEntry.oldHash, logEntry.newHash)
+			}
+		}
+	}
+	return roots
+}
+
+func isNullHash(hash string) bool {
+	return strings.Trim(hash, "0") == ""
+}
+
+type pruneOptions struct {
+	expire  time.Time // only unreachable objects older than this are removed
+	dryRun  bool
+	verbose bool
+}
+
+// prune deletes unreachable loose objects and loose objects that are also
+// in a pack, from the repository's own object directory only
+func (repo *Repository) prune(reachable map[string]bool, options pruneOptions) {
+	objectDir := filepath.Join(repo.gitDir, "objects")
+	fanoutDirs, err := os.ReadDir(objectDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, fanoutDir := range fanoutDirs {
+		if !fanoutDir.IsDir() || len(fanoutDir.Name()) != 2 || !isHexString(fanoutDir.Name()) {
+			continue
+		}
+		dir := filepath.Join(objectDir, fanoutDir.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, file := range files {
+			hash := fanoutDir.Name() + file.Name()
+			path := filepath.Join(dir, file.Name())
+			if !isFullHash(hash) {
+				if strings.HasPrefix(file.Name(), "tmp_obj_") {
+					repo.pruneTemporaryFile(path, options)
+				}
+				continue
+			}
+			info, err := file.Info()
+			if err != nil {
+				continue
+			}
+			if !reachable[hash] && info.ModTime().Before(options.expire) {
+				if options.dryRun || options.verbose {
+					header, _, _ := repo.readLooseObject(hash)
+					fmt.Printf("%s %s\n", hash, header.objectType)
+				}
+				if !options.dryRun {
+					if err := os.Remove(path); err != nil {
+						log.Fatal(err)
+					}
+				}
+				continue
+			}
+			if repo.isPackedObject(hash) {
+				// the same as prune-packed: the pack already has a copy
+				if options.dryRun {
+					fmt.Printf("rm -f %s\n", path)
+				} else if err := os.Remove(path); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		if !options.dryRun {
+			// only succeeds once the fan-out directory is empty
+			os.Remove(dir)
+		}
+	}
+}
+
+func (repo *Repository) pruneTemporaryFile(path string, options pruneOptions) {
+	info, err := os.Stat(path)
+	if err != nil || !info.ModTime().Before(options.expire) {
+		return
+	}
+	if options.dryRun {
+		fmt.Printf("Removing stale temporary file %s\n", path)
+		return
+	}
+	os.Remove(path)
+}
+
+func (repo *Repository) isPackedObject(hash string) bool {
+	packs := repo.packFiles()
+	defer repo.releasePacks(packs)
+	for _, pack := range packs {
+		if _, ok := pack.index.findOffset(hash); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isHexString(value string) bool {
+	return strings.Trim(strings.ToLower(value), "0123456789abcdef") == ""
+}
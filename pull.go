@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type pullOptions struct {
+	rebase    string // "true" or "false" from --rebase or --no-rebase, else pull.rebase
+	ff        string // "only", "true" or "false" from --ff-only, --ff or --no-ff, else pull.ff
+	autostash string // "true" or "false" from --autostash or --no-autostash, else the config
+	quiet     bool
+}
+
+// pull fetches the branch the current one tracks, or the one given, and
+// integrates it by rebasing or merging as pull.rebase says; pull.ff says
+// whether a merge may, must or must not be a fast-forward
+func (repo *Repository) pull(args []string, options pullOptions) {
+	if len(args) > 2 {
+		log.Fatal("fatal: pulling several branches at once is not supported")
+	}
+	branch, onBranch := repo.headBranch()
+	if !onBranch {
+		log.Fatal("fatal: You are not currently on a branch.")
+	}
+	remote, hasRemote := repo.config.get("branch." + branch + ".remote")
+	mergeRef, hasMerge := repo.config.get("branch." + branch + ".merge")
+	otherRemote := len(args) > 0 && args[0] != remote
+	if otherRemote {
+		remote, mergeRef, hasMerge = args[0], "", false
+	}
+	if len(args) > 1 {
+		mergeRef, hasMerge = args[1], true
+		if !strings.HasPrefix(mergeRef, "refs/") {
+			mergeRef = "refs/heads/" + mergeRef
+		}
+	}
+	if !hasRemote && !otherRemote {
+		remote = "origin"
+	}
+
+	ff := options.ff
+	if ff == "" {
+		if value, ok := repo.config.get("pull.ff"); ok {
+			ff = "only"
+			if strings.ToLower(value) != "only" {
+				ff = strconv.FormatBool(repo.config.getBool("pull.ff", true))
+			}
+			if ff == "only" && options.rebase != "" {
+				// --rebase and --no-rebase say how to integrate divergent
+				// branches, which pull.ff=only would refuse
+				ff = "true"
+			}
+		}
+	}
+	rebase, configured := options.rebase, options.rebase != ""
+	if !configured {
+		rebase, configured = repo.config.get("pull.rebase")
+	}
+	switch strings.ToLower(rebase) {
+	case "", "false", "no", "off", "0":
+		rebase = "false"
+	case "true", "yes", "on", "1":
+		rebase = "true"
+	default:
+		log.Fatalf("fatal: invalid value for pull.rebase: '%s'", rebase)
+	}
+	autostashKey := "merge.autoStash"
+	if rebase == "true" {
+		autostashKey = "rebase.autoStash"
+	}
+	autostash := options.autostash == "true" || options.autostash == "" && repo.config.getBool(autostashKey, false)
+	head, ok := repo.resolveRef("HEAD")
+	if !ok {
+		log.Fatal("fatal: pulling into an unborn branch is not supported")
+	}
+	if rebase == "true" && !autostash && !repo.requireCleanWorktree(repo.readIndex(), head, "pull with rebase", "please commit or stash them.") {
+		os.Exit(1)
+	}
+
+	var upstream, description string
+	if remote == "." {
+		if hasMerge {
+			if upstream, ok = repo.resolveRef(mergeRef); !ok {
+				log.Fatalf("fatal: couldn't find remote ref %s", mergeRef)
+			}
+		}
+		description = "branch '" + strings.TrimPrefix(mergeRef, "refs/heads/") + "'"
+	} else {
+		upstream = repo.fetch(remote, mergeRef, len(args) > 1, options.quiet)
+		description = "branch '" + strings.TrimPrefix(mergeRef, "refs/heads/") + "' of " + repo.remoteURL(remote)
+	}
+	if !hasMerge {
+		if otherRemote {
+			fmt.Fprintf(os.Stderr, "You asked to pull from the remote '%s', but did not specify\n", remote)
+			fmt.Fprintln(os.Stderr, "a branch. Because this is not the default configured remote")
+			fmt.Fprintln(os.Stderr, "for your current branch, you must specify a branch on the command line.")
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, strings.Join([]string{
+			"There is no tracking information for the current branch.",
+			"Please specify which branch you want to merge with.",
+			"See git-pull(1) for details.",
+			"",
+			"    git pull <remote> <branch>",
+			"",
+			"If you wish to set tracking information for this branch you can do so with:",
+			"",
+			"    git branch --set-upstream-to=<remote>/<branch> " + branch,
+			"",
+		}, "\n"))
+		os.Exit(1)
+	}
+
+	if repo.isAncestor(upstream, head) {
+		if !options.quiet {
+			fmt.Println("Already up to date.")
+		}
+		return
+	}
+	canFastForward := repo.isAncestor(head, upstream)
+	if !canFastForward && ff == "only" {
+		log.Fatal("fatal: Not possible to fast-forward, aborting.")
+	}
+	if !canFastForward && !configured && ff == "" {
+		fmt.Fprintln(os.Stderr, strings.Join([]string{
+			"hint: You have divergent branches and need to specify how to reconcile them.",
+			"hint: You can do so by running one of the following commands sometime before",
+			"hint: your next pull:",
+			"hint: ",
+			"hint:   git config pull.rebase false  # merge",
+			"hint:   git config pull.rebase true   # rebase",
+			"hint:   git config pull.ff only       # fast-forward only",
+			"hint: ",
+			"hint: You can replace \"git config\" with \"git config --global\" to set a default",
+			"hint: preference for all repositories. You can also pass --rebase, --no-rebase,",
+			"hint: or --ff-only on the command line to override the configured default per",
+			"hint: invocation.",
+		}, "\n"))
+		log.Fatal("fatal: Need to specify how to reconcile divergent branches.")
+	}
+	if rebase == "true" && ff != "only" && !canFastForward {
+		repo.rebase(upstream, rebaseOptions{autostash: autostash, quiet: options.quiet})
+		return
+	}
+	// a rebase onto a descendant is a fast-forward, so pull makes it one
+	fastForward := canFastForward && (ff != "false" || rebase == "true")
+	repo.writeOrigHead(head)
+	action := strings.TrimSpace("pull " + strings.Join(args, " "))
+	if !repo.mergeUpstream(repo.lockIndex(), head, upstream, upstream, fastForward, autostash, "Merge "+description+"\n", action, options.quiet) {
+		os.Exit(1)
+	}
+}
+
+// mergeUpstream brings the changes of upstream into the current branch,
+// moving it forward when fastForward is set and otherwise committing a
+// merge of the two with message. Local changes to files the merge does not
+// touch are kept, or with autostash put away for the merge and reapplied.
+// Files changed on both sides are merged line by line, conflicts being
+// left for commit to conclude the merge with, under name in the conflict
+// markers. The reflogs name action as what moved the branch. It reports
+// whether the merge was made.
+func (repo *Repository) mergeUpstream(index *gitIndex, head string, upstream string, name string, fastForward bool, autostash bool, message string, action string, quiet bool) bool {
+	headTree := repo.readCommitObject(head).tree
+	if fastForward && !quiet {
+		fmt.Printf("Updating %s..%s\n", head[:7], upstream[:7])
+	}
+	stash := ""
+	if autostash {
+		stash = repo.createAutostash(index)
+	}
+	merged := repo.mergeInto(index, head, upstream, name, fastForward, message, action, quiet)
+	// a merge that could not be made leaves the index as it was
+	repo.releaseIndex(index)
+	if merged != "" && !quiet {
+		repo.writeMergeStat(headTree, merged)
+	}
+	repo.applyAutostash(stash)
+	return merged != ""
+}
+
+// writeMergeStat shows what a merge changed since headTree as a diffstat
+func (repo *Repository) writeMergeStat(headTree string, merged string) {
+	changes := repo.diffTrees(headTree, repo.readCommitObject(merged).tree)
+	stats := make([]fileStat, len(changes))
+	for i, change := range changes {
+		stats[i] = repo.diffStat(change)
+	}
+	if len(stats) > 0 {
+		writeDiffStat(os.Stdout, stats, 80, repo.diffColors(repo.useColor("diff")))
+	}
+}
+
+// mergeInto does the work of mergeUpstream and returns the commit the
+// branch now points at, "" when the merge could not be made or stopped at
+// conflicts
+func (repo *Repository) mergeInto(index *gitIndex, head string, upstream string, name string, fastForward bool, message string, action string, quiet bool) string {
+	upstreamTree := repo.readCommitObject(upstream).tree
+	base := head
+	labels := mergeLabels{ours: "HEAD", theirs: name}
+	if !fastForward {
+		var ok bool
+		if base, ok = repo.mergeBase(head, upstream); !ok {
+			log.Fatal("fatal: refusing to merge unrelated histories")
+		}
+		if !repo.checkNothingStaged(index, head) {
+			return ""
+		}
+		labels.base = abbreviateHash(base)
+	}
+	return repo.mergeTreesInto(index, head, upstream, repo.readCommitObject(base).tree, upstreamTree, fastForward, labels, message, action, quiet)
+}
+
+// checkNothingStaged makes sure the index is as head has it before a
+// merge that is not a fast-forward, explaining what is in the way
+func (repo *Repository) checkNothingStaged(index *gitIndex, head string) bool {
+	staged := repo.stagedChanges(index, head)
+	if len(staged) == 0 {
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "error: Your local changes to the following files would be overwritten by merge:")
+	for _, change := range staged {
+		fmt.Fprintf(os.Stderr, "\t%s\n", change.path)
+	}
+	fmt.Fprintln(os.Stderr, "Please commit your changes or stash them before you merge.")
+	fmt.Fprintln(os.Stderr, "Aborting")
+	return false
+}
+
+// mergeTreesInto is mergeInto with the changes from baseTree to
+// upstreamTree as those merged, which for a subtree merge are the trees
+// of the commits moved into the subdirectory
+func (repo *Repository) mergeTreesInto(index *gitIndex, head string, upstream string, baseTree string, upstreamTree string, fastForward bool, labels mergeLabels, message string, action string, quiet bool) string {
+	applied, conflicted := repo.applyTreeMerge(index, baseTree, upstreamTree, fastForward, labels)
+	if !applied {
+		return ""
+	}
+	if conflicted {
+		repo.writeIndex(index)
+		repo.writeMergeHead(upstream, "", message+conflictsComment(conflictedPaths(index)))
+		repo.rerere()
+		fmt.Println("Automatic merge failed; fix conflicts and then commit the result.")
+		return ""
+	}
+	merged := upstream
+	outcome := "Fast-forward"
+	if fastForward {
+		repo.writeIndex(index)
+	} else {
+		tree := repo.writeTree(index)
+		repo.writeIndex(index)
+		merged = repo.createCommit(tree, []string{head, upstream}, message)
+		outcome = "Merge made by the 'ort' strategy."
+	}
+	if !quiet {
+		fmt.Println(outcome)
+	}
+	repo.updateHead(merged, action+": "+outcome)
+	return merged
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// quotePath quotes a path the way git does with core.quotePath enabled:
+// paths containing control characters, quotes, backslashes or non-ASCII
+// bytes are wrapped in double quotes with C-style escapes
+func quotePath(path string) string {
+	needsQuoting := false
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			needsQuoting = true
+			break
+		}
+	}
+	if !needsQuoting {
+		return path
+	}
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch c {
+		case '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case '\a':
+			quoted.WriteString(`\a`)
+		case '\b':
+			quoted.WriteString(`\b`)
+		case '\t':
+			quoted.WriteString(`\t`)
+		case '\n':
+			quoted.WriteString(`\n`)
+		case '\v':
+			quoted.WriteString(`\v`)
+		case '\f':
+			quoted.WriteString(`\f`)
+		case '\r':
+			quoted.WriteString(`\r`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&quoted, "\\%03o", c)
+			} else {
+				quoted.WriteByte(c)
+			}
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// pathPrinter writes one path-carrying record per line, or NUL-terminated
+// and unquoted for scripts when nulTerminated is set
+type pathPrinter struct {
+	nulTerminated bool
+}
+
+func (printer pathPrinter) path(path string) string {
+	if printer.nulTerminated {
+		return path
+	}
+	return quotePath(path)
+}
+
+func (printer pathPrinter) printRecord(record string) {
+	if printer.nulTerminated {
+		fmt.Printf("%s\x00", record)
+	} else {
+		fmt.Println(record)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// DefaultCreationFactor is the percentage of a patch's size it costs to
+// show it as created or dropped rather than as changed
+const DefaultCreationFactor = 60
+
+// rangeDiffCostMax is the cost of pairs that are not allowed to match
+const rangeDiffCostMax = 1 << 16
+
+// seriesPatch is a commit of a range as range-diff compares it
+type seriesPatch struct {
+	index    int // position in its range
+	hash     string
+	subject  string
+	patch    string // metadata, commit message and diff
+	diff     string // the diff part of patch
+	diffSize int
+	matching int // index of the commit in the other range, -1 if none
+	shown    bool
+}
+
+type rangeDiffOptions struct {
+	creationFactor int
+	noPatch        bool
+}
+
+// rangeDiffRanges turns the arguments into the two ranges to compare:
+// "<range1> <range2>", "<rev1>...<rev2>" or "<base> <rev1> <rev2>"
+func rangeDiffRanges(args []string) (string, string) {
+	switch len(args) {
+	case 1:
+		left, right, ok := strings.Cut(args[0], "...")
+		if !ok {
+			log.Fatalf("fatal: not a symmetric range: '%s'", args[0])
+		}
+		if left == "" {
+			left = "HEAD"
+		}
+		if right == "" {
+			right = "HEAD"
+		}
+		return right + ".." + left, left + ".." + right
+	case 2:
+		for _, arg := range args {
+			if !strings.Contains(arg, "..") {
+				log.Fatalf("fatal: no .. in range: '%s'", arg)
+			}
+		}
+		return args[0], args[1]
+	case 3:
+		return args[0] + ".." + args[1], args[0] + ".." + args[2]
+	}
+	log.Fatal("fatal: need two commit ranges")
+	return "", ""
+}
+
+// readSeriesPatches renders every commit of a range the way range-diff
+// compares them: line numbers and index lines are left out so that only
+// the change itself matters, and sections are marked with " ## <name> ##"
+func (repo *Repository) readSeriesPatches(revisionRange string) []*seriesPatch {
+	series := repo.patchSeries([]string{revisionRange}, -1)
+	patches := make([]*seriesPatch, len(series))
+	for i, hash := range series {
+		commit := repo.readCommitObject(hash)
+		var text strings.Builder
+		fmt.Fprintf(&text, " ## Metadata ##\nAuthor: %s\n\n ## Commit message ##\n", commit.author.nameAndEmail())
+		for _, line := range strings.Split(strings.TrimRight(commit.commitMessage, "\n"), "\n") {
+			if line = strings.TrimRight(line, " \t\r\n\v\f"); line != "" {
+				text.WriteString("    " + line)
+			}
+			text.WriteString("\n")
+		}
+
+		parentTree := ""
+		if len(commit.parents) > 0 {
+			parentTree = repo.readCommitObject(commit.parents[0]).tree
+		}
+		var patch bytes.Buffer
+		for _, change := range repo.diffTrees(parentTree, commit.tree) {
+			repo.writePatch(&patch, change, diffOptions{context: DefaultDiffContext})
+		}
+		diffOffset, size := 0, 0
+		lines := splitLines(patch.Bytes())
+		currentPath := ""
+		for j := 0; j < len(lines); j++ {
+			line := strings.TrimSuffix(lines[j], "\n")
+			switch {
+			case strings.HasPrefix(line, "diff --git "):
+				file, _, err := parseFilePatch(lines, j)
+				if err != nil {
+					log.Fatalf("fatal: could not parse diff of %s", hash)
+				}
+				text.WriteString("\n")
+				if diffOffset == 0 {
+					diffOffset = text.Len()
+				}
+				currentPath = file.newPath
+				switch {
+				case file.oldPath == "":
+					fmt.Fprintf(&text, " ## %s (new)", file.newPath)
+				case file.newPath == "":
+					fmt.Fprintf(&text, " ## %s (deleted)", file.oldPath)
+					currentPath = file.oldPath
+				case file.oldPath != file.newPath:
+					fmt.Fprintf(&text, " ## %s => %s", file.oldPath, file.newPath)
+				default:
+					fmt.Fprintf(&text, " ## %s", file.newPath)
+				}
+				if file.oldMode != 0 && file.newMode != 0 && file.oldMode != file.newMode {
+					fmt.Fprintf(&text, " (mode change %06o => %06o)", file.oldMode, file.newMode)
+				}
+				text.WriteString(" ##")
+				// skip the extended header up to the first hunk
+				for j+1 < len(lines) && !strings.HasPrefix(lines[j+1], "@@ ") && !strings.HasPrefix(lines[j+1], "diff --git ") && !strings.HasPrefix(lines[j+1], "Binary files ") {
+					j++
+				}
+			case strings.HasPrefix(line, "@@ "):
+				// "@@ -1,2 +1,3 @@ func" becomes "@@ path: func"
+				text.WriteString("@@")
+				if end := strings.Index(line[3:], "@@"); end != -1 {
+					if function := line[3+end+2:]; function != "" {
+						text.WriteString(" " + currentPath + ":" + function)
+					}
+				}
+			case line != "" && (line[0] == '+' || line[0] == '-' || line[0] == ' '):
+				text.WriteString(line)
+			default:
+				text.WriteString(" " + line)
+			}
+			text.WriteString("\n")
+			size++
+		}
+		subject, _ := splitCommitMessage(commit.commitMessage)
+		patches[i] = &seriesPatch{index: i, hash: hash, subject: subject, patch: text.String(), diff: text.String()[diffOffset:], diffSize: size, matching: -1}
+	}
+	return patches
+}
+
+// findExactMatches pairs the commits whose diffs are identical
+func findExactMatches(a []*seriesPatch, b []*seriesPatch) {
+	byDiff := make(map[string][]int)
+	for i, patch := range a {
+		byDiff[patch.diff] = append(byDiff[patch.diff], i)
+	}
+	for j, patch := range b {
+		candidates := byDiff[patch.diff]
+		if len(candidates) == 0 {
+			continue
+		}
+		i := candidates[len(candidates)-1]
+		byDiff[patch.diff] = candidates[:len(candidates)-1]
+		a[i].matching, patch.matching = j, i
+	}
+}
+
+// diffSize counts the lines of the diff between two patches, hunk headers
+// included
+func diffSize(old string, new string) int {
+	size := 0
+	for _, hunk := range diffLines(splitLines([]byte(old)), splitLines([]byte(new))).hunks(DefaultDiffContext) {
+		size += 1 + len(hunk.lines)
+	}
+	return size
+}
+
+// matchSeries pairs the remaining commits of both ranges at the smallest
+// total cost: a pair costs the size of the diff between the patches, and
+// leaving a commit unpaired costs creationFactor percent of its own size
+func matchSeries(a []*seriesPatch, b []*seriesPatch, creationFactor int) {
+	n := len(a) + len(b)
+	cost := make([]int, n*n)
+	for i, aPatch := range a {
+		for j, bPatch := range b {
+			c := rangeDiffCostMax
+			if aPatch.matching == j {
+				c = 0
+			} else if aPatch.matching < 0 && bPatch.matching < 0 {
+				c = diffSize(aPatch.diff, bPatch.diff)
+			}
+			cost[i+n*j] = c
+		}
+		c := rangeDiffCostMax
+		if aPatch.matching < 0 {
+			c = aPatch.diffSize * creationFactor / 100
+		}
+		for j := len(b); j < n; j++ {
+			cost[i+n*j] = c
+		}
+	}
+	for j, bPatch := range b {
+		c := rangeDiffCostMax
+		if bPatch.matching < 0 {
+			c = bPatch.diffSize * creationFactor / 100
+		}
+		for i := len(a); i < n; i++ {
+			cost[i+n*j] = c
+		}
+	}
+
+	aToB, _ := computeAssignment(n, n, cost)
+	for i := range a {
+		if j := aToB[i]; j >= 0 && j < len(b) {
+			a[i].matching, b[j].matching = j, i
+		}
+	}
+}
+
+// computeAssignment solves the linear assignment problem with the
+// Jonker-Volgenant algorithm, as git's linear-assignment.c does, so that
+// ties are broken the same way. The cost of column i in row j is at
+// cost[i+columns*j].
+func computeAssignment(columns int, rows int, cost []int) ([]int, []int) {
+	columnToRow := make([]int, columns)
+	rowToColumn := make([]int, rows)
+	if columns < 2 {
+		return columnToRow, rowToColumn
+	}
+	at := func(column, row int) int { return cost[column+columns*row] }
+	for i := range columnToRow {
+		columnToRow[i] = -1
+	}
+	for i := range rowToColumn {
+		rowToColumn[i] = -1
+	}
+	v := make([]int, columns)
+
+	// column reduction
+	for j := columns - 1; j >= 0; j-- {
+		i1 := 0
+		for i := 1; i < rows; i++ {
+			if at(j, i1) > at(j, i) {
+				i1 = i
+			}
+		}
+		v[j] = at(j, i1)
+		if rowToColumn[i1] == -1 {
+			rowToColumn[i1] = j
+			columnToRow[j] = i1
+		} else {
+			if rowToColumn[i1] >= 0 {
+				rowToColumn[i1] = -2 - rowToColumn[i1]
+			}
+			columnToRow[j] = -1
+		}
+	}
+
+	// reduction transfer
+	freeRows := make([]int, 0, rows)
+	for i := 0; i < rows; i++ {
+		j1 := rowToColumn[i]
+		switch {
+		case j1 == -1:
+			freeRows = append(freeRows, i)
+		case j1 < -1:
+			rowToColumn[i] = -2 - j1
+		default:
+			other := pick(j1 == 0, 1, 0)
+			min := at(other, i) - v[other]
+			for j := 1; j < columns; j++ {
+				if j != j1 && min > at(j, i)-v[j] {
+					min = at(j, i) - v[j]
+				}
+			}
+			v[j1] -= min
+		}
+	}
+	if len(freeRows) == pick(columns < rows, rows-columns, 0) {
+		return columnToRow, rowToColumn
+	}
+
+	// augmenting row reduction
+	for phase := 0; phase < 2; phase++ {
+		savedFree := freeRows
+		freeRows = make([]int, 0, rows)
+		for k := 0; k < len(savedFree); {
+			i := savedFree[k]
+			k++
+			j1 := 0
+			u1 := at(j1, i) - v[j1]
+			j2, u2 := -1, math.MaxInt
+			for j := 1; j < columns; j++ {
+				c := at(j, i) - v[j]
+				if u2 > c {
+					if u1 < c {
+						u2, j2 = c, j
+					} else {
+						u2, u1 = u1, c
+						j2, j1 = j1, j
+					}
+				}
+			}
+			if j2 < 0 {
+				j2, u2 = j1, u1
+			}
+			i0 := columnToRow[j1]
+			if u1 < u2 {
+				v[j1] -= u2 - u1
+			} else if i0 >= 0 {
+				j1 = j2
+				i0 = columnToRow[j1]
+			}
+			if i0 >= 0 {
+				if u1 < u2 {
+					k--
+					savedFree[k] = i0
+				} else {
+					freeRows = append(freeRows, i0)
+				}
+			}
+			rowToColumn[i] = j1
+			columnToRow[j1] = i
+		}
+	}
+
+	// augmentation
+	d := make([]int, columns)
+	pred := make([]int, columns)
+	col := make([]int, columns)
+	for _, i1 := range freeRows {
+		low, up, last := 0, 0, 0
+		var min int
+		for j := 0; j < columns; j++ {
+			d[j] = at(j, i1) - v[j]
+			pred[j] = i1
+			col[j] = j
+		}
+		j := -1
+	search:
+		for {
+			last = low
+			min = d[col[up]]
+			up++
+			for k := up; k < columns; k++ {
+				j = col[k]
+				if c := d[j]; c <= min {
+					if c < min {
+						up = low
+						min = c
+					}
+					col[k] = col[up]
+					col[up] = j
+					up++
+				}
+			}
+			// like git, this augments from the column last looked at
+			// rather than from the free one found
+			for k := low; k < up; k++ {
+				if columnToRow[col[k]] == -1 {
+					break search
+				}
+			}
+
+			// scan a row
+			for low != up {
+				j1 := col[low]
+				low++
+				i := columnToRow[j1]
+				u1 := at(j1, i) - v[j1] - min
+				for k := up; k < columns; k++ {
+					j2 := col[k]
+					c := at(j2, i) - v[j2] - u1
+					if c < d[j2] {
+						d[j2] = c
+						pred[j2] = i
+						if c == min {
+							if columnToRow[j2] == -1 {
+								j = j2
+								break search
+							}
+							col[k] = col[up]
+							col[up] = j2
+							up++
+						}
+					}
+				}
+			}
+		}
+
+		// update the column prices
+		for k := 0; k < last; k++ {
+			j1 := col[k]
+			v[j1] += d[j1] - min
+		}
+
+		for {
+			i := pred[j]
+			columnToRow[j] = i
+			j, rowToColumn[i] = rowToColumn[i], j
+			if i == i1 {
+				break
+			}
+		}
+	}
+	return columnToRow, rowToColumn
+}
+
+// rangeDiffSection matches the lines whose text names the section a hunk
+// of an interdiff is in
+var rangeDiffSection = regexp.MustCompile(`^ ## (.*) ##$|^.?@@ (.*)$`)
+
+func rangeDiffFunction(lines []string, before int) string {
+	for i := before - 1; i >= 0; i-- {
+		match := rangeDiffSection.FindStringSubmatch(strings.TrimSuffix(lines[i], "\n"))
+		if match == nil {
+			continue
+		}
+		function := match[1] + match[2]
+		if len(function) > 80 {
+			function = function[:80]
+		}
+		return strings.TrimRight(function, " \t")
+	}
+	return ""
+}
+
+// writeInterdiff writes the diff between two patches, indented, with the
+// section of each hunk in place of its line numbers
+func writeInterdiff(w io.Writer, old string, new string) {
+	oldLines := splitLines([]byte(old))
+	for _, hunk := range diffLines(oldLines, splitLines([]byte(new))).hunks(DefaultDiffContext) {
+		before := hunk.oldStart - 1
+		if hunk.oldCount == 0 {
+			before = hunk.oldStart
+		}
+		header := "@@"
+		if function := rangeDiffFunction(oldLines, before); function != "" {
+			header += " " + function
+		}
+		fmt.Fprintf(w, "    %s\n", header)
+		for _, line := range hunk.lines {
+			fmt.Fprintf(w, "    %c%s", line.op, line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				fmt.Fprint(w, "\n    \\ No newline at end of file\n")
+			}
+		}
+	}
+}
+
+// writeRangeDiffPair writes the "1:  abc1234 ! 1:  def5678 subject" line:
+// "=" for equal patches, "!" for changed ones and "<" or ">" for commits
+// only in the old or the new range
+func writeRangeDiffPair(w io.Writer, width int, old *seriesPatch, new *seriesPatch) {
+	dashes := strings.Repeat("-", len(abbreviateHash("")))
+	var status byte
+	switch {
+	case new == nil:
+		status = '<'
+	case old == nil:
+		status = '>'
+	case old.patch != new.patch:
+		status = '!'
+	default:
+		status = '='
+	}
+	if old == nil {
+		fmt.Fprintf(w, "%*s:  %s ", width, "-", dashes)
+	} else {
+		fmt.Fprintf(w, "%*d:  %s ", width, old.index+1, abbreviateHash(old.hash))
+	}
+	fmt.Fprintf(w, "%c", status)
+	if new == nil {
+		fmt.Fprintf(w, " %*s:  %s", width, "-", dashes)
+	} else {
+		fmt.Fprintf(w, " %*d:  %s", width, new.index+1, abbreviateHash(new.hash))
+	}
+	// the subject is the old one unless the commit is new
+	if old == nil {
+		old = new
+	}
+	fmt.Fprintf(w, " %s\n", old.subject)
+}
+
+// rangeDiff shows how the commits of the second range correspond to those
+// of the first. It follows the order of the second range, placing dropped
+// commits once everything before them in the first range is shown.
+func (repo *Repository) rangeDiff(w io.Writer, oldRange string, newRange string, options rangeDiffOptions) {
+	a, b := repo.readSeriesPatches(oldRange), repo.readSeriesPatches(newRange)
+	findExactMatches(a, b)
+	matchSeries(a, b, options.creationFactor)
+
+	width := decimalWidth(1 + len(a))
+	if len(b) > len(a) {
+		width = decimalWidth(1 + len(b))
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for i < len(a) && a[i].shown {
+			i++
+		}
+		if i < len(a) && a[i].matching < 0 {
+			writeRangeDiffPair(w, width, a[i], nil)
+			i++
+			continue
+		}
+		for j < len(b) && b[j].matching < 0 {
+			writeRangeDiffPair(w, width, nil, b[j])
+			j++
+		}
+		if j < len(b) {
+			old := a[b[j].matching]
+			writeRangeDiffPair(w, width, old, b[j])
+			if !options.noPatch && old.patch != b[j].patch {
+				writeInterdiff(w, old.patch, b[j].patch)
+			}
+			old.shown = true
+			j++
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+type rebaseOptions struct {
+	autostash bool // stash local changes away for the rebase and reapply them after
+	quiet     bool
+}
+
+// rebase replays the commits of the current branch that are not in
+// upstream on top of it, leaving out merges and the commits upstream
+// already has a change of. There is no conflict resolution: when a commit
+// does not apply the rebase is undone.
+func (repo *Repository) rebase(upstream string, options rebaseOptions) {
+	branch, onBranch := repo.headBranch()
+	if upstream == "" {
+		tracked, ok := "", false
+		if onBranch {
+			tracked, ok = repo.upstreamOf(branch)
+		}
+		if !ok {
+			fmt.Fprintln(os.Stderr, "There is no tracking information for the current branch.")
+			fmt.Fprintln(os.Stderr, "Please specify which branch you want to rebase against.")
+			os.Exit(1)
+		}
+		upstream = tracked
+	}
+	upstreamHash := repo.peelToCommit(repo.resolveRevision(upstream))
+	head, ok := repo.resolveRef("HEAD")
+	if !ok {
+		log.Fatal("fatal: invalid upstream 'HEAD'")
+	}
+	index := repo.lockIndex()
+	autostash := ""
+	if options.autostash {
+		autostash = repo.createAutostash(index)
+	} else if !repo.requireCleanWorktree(index, head, "rebase", "Please commit or stash them.") {
+		repo.releaseIndex(index)
+		os.Exit(1)
+	}
+
+	inHead := repo.reachableCommits(head)
+	if inHead[upstreamHash] {
+		name := branch
+		if !onBranch {
+			name = "HEAD"
+		}
+		if !options.quiet {
+			fmt.Printf("Current branch %s is up to date.\n", name)
+		}
+		repo.releaseIndex(index)
+		repo.applyAutostash(autostash)
+		return
+	}
+	picks := repo.rebasePicks(head, upstreamHash, inHead)
+	repo.writeOrigHead(head)
+
+	headTree := repo.readCommitObject(head).tree
+	current := upstreamHash
+	repo.resetToTree(index, repo.readCommitObject(current).tree)
+	for _, hash := range picks {
+		commit := repo.readCommitObject(hash)
+		subject, _ := splitCommitMessage(commit.commitMessage)
+		merge := repo.mergeTreeChanges(index, repo.readCommitObject(commit.parents[0]).tree, commit.tree, mergeLabels{ours: "HEAD", theirs: hash[:7] + " (" + subject + ")"})
+		if len(merge.conflicts) > 0 || !repo.checkTreeUpdates(index, merge.updates) {
+			if len(merge.conflicts) > 0 {
+				for _, message := range merge.messages {
+					fmt.Println(message)
+				}
+			}
+			fmt.Fprintf(os.Stderr, "error: could not apply %s... %s\n", hash[:7], subject)
+			repo.resetToTree(index, headTree)
+			repo.releaseIndex(index)
+			fmt.Fprintln(os.Stderr, "The rebase was undone, nothing was changed.")
+			repo.applyAutostash(autostash)
+			os.Exit(1)
+		}
+		index.stageTreeUpdates(merge.updates, repo.writeTreeUpdates(merge.updates))
+		tree := repo.writeTree(index)
+		repo.writeIndexKeepingLock(index)
+		if tree == repo.readCommitObject(current).tree {
+			// like git, commits that become empty are dropped
+			continue
+		}
+		current = repo.createCommitAs(commit.author, tree, []string{current}, commit.commitMessage)
+	}
+	if onBranch {
+		repo.updateRefLogged("refs/heads/"+branch, current, "rebase (finish): refs/heads/"+branch+" onto "+upstreamHash)
+		repo.logRefUpdate("HEAD", head, current, "rebase (finish): returning to refs/heads/"+branch)
+	} else {
+		repo.updateRefLogged("HEAD", current, "rebase (finish): returning to "+current)
+	}
+	repo.releaseIndex(index)
+	repo.applyAutostash(autostash)
+	if !options.quiet {
+		if onBranch {
+			fmt.Fprintf(os.Stderr, "Successfully rebased and updated refs/heads/%s.\n", branch)
+		} else {
+			fmt.Fprintln(os.Stderr, "Successfully rebased and updated detached HEAD.")
+		}
+	}
+}
+
+// rebasePicks lists, oldest first, the commits of head to replay on
+// upstream: those upstream does not have, without merges and without the
+// ones whose change an upstream commit already made
+func (repo *Repository) rebasePicks(head string, upstream string, inHead map[string]bool) []string {
+	inUpstream := repo.reachableCommits(upstream)
+	patchOptions := patchIDOptions{}
+	upstreamIDs := make(map[string]bool)
+	iter := newCommitIter(repo, []string{upstream}, commitOrderTopo, false)
+	for {
+		hash, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		if !inHead[hash] && len(commit.parents) <= 1 {
+			upstreamIDs[repo.commitPatchID(hash, patchOptions)] = true
+		}
+	}
+	picks := make([]string, 0)
+	iter = newCommitIter(repo, []string{head}, commitOrderTopo, true)
+	for {
+		hash, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		if !inUpstream[hash] && len(commit.parents) == 1 && !upstreamIDs[repo.commitPatchID(hash, patchOptions)] {
+			picks = append(picks, hash)
+		}
+	}
+	return picks
+}
+
+// requireCleanWorktree makes sure there are no local changes to tracked
+// files, explaining what is in the way of the action otherwise
+func (repo *Repository) requireCleanWorktree(index *gitIndex, head string, action string, hint string) bool {
+	unstaged := len(repo.worktreeChanges(index)) > 0
+	staged := len(repo.stagedChanges(index, head)) > 0
+	if unstaged {
+		fmt.Fprintf(os.Stderr, "error: cannot %s: You have unstaged changes.\n", action)
+	}
+	switch {
+	case staged && unstaged:
+		fmt.Fprintln(os.Stderr, "error: additionally, your index contains uncommitted changes.")
+	case staged:
+		fmt.Fprintf(os.Stderr, "error: cannot %s: Your index contains uncommitted changes.\n", action)
+	}
+	if staged || unstaged {
+		fmt.Fprintf(os.Stderr, "error: %s\n", hint)
+		return false
+	}
+	return true
+}
+
+// createAutostash stashes the local changes to tracked files away and
+// takes the index and the worktree back to HEAD; it returns the stash,
+// "" when there was nothing to stash
+func (repo *Repository) createAutostash(index *gitIndex) string {
+	stash, ok := repo.createStash(index, stashOptions{})
+	if !ok {
+		return ""
+	}
+	fmt.Printf("Created autostash: %s\n", stash.hash[:7])
+	repo.resetToTree(index, stash.headTree)
+	return stash.hash
+}
+
+// applyAutostash reapplies the changes createAutostash put away; when
+// they no longer apply they are kept in the stash list instead
+func (repo *Repository) applyAutostash(stash string) {
+	if stash == "" {
+		return
+	}
+	// conflicts a merge left are no place to apply it
+	if len(conflictedPaths(repo.readIndex())) == 0 && repo.stashApply(namedStash{name: stash, position: -1, hash: stash}, false, true) {
+		fmt.Fprintln(os.Stderr, "Applied autostash.")
+		return
+	}
+	repo.storeStash(stash, "autostash")
+	fmt.Fprintln(os.Stderr, strings.Join([]string{
+		"Applying autostash resulted in conflicts.",
+		"Your changes are safe in the stash.",
+		"You can run \"git stash pop\" or \"git stash drop\" at any time.",
+	}, "\n"))
+}
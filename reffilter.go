@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// refFilter narrows the branches and tags listed to those whose tips reach,
+// or do not reach, given commits (--contains and --no-contains) and those
+// given commits reach or do not reach (--merged and --no-merged). A tip
+// passes when it meets one of the commits of each option given.
+type refFilter struct {
+	contains   []string
+	noContains []string
+	merged     []string
+	noMerged   []string
+}
+
+// newRefFilter resolves the commits of the filter options, exiting like
+// git on names that are no commits
+func (repo *Repository) newRefFilter(contains []string, noContains []string, merged []string, noMerged []string) *refFilter {
+	resolve := func(name string) string {
+		hash, ok := repo.lookupRevision(name)
+		if !ok || !repo.hasObject(hash) {
+			fmt.Fprintf(os.Stderr, "error: malformed object name %s\n", name)
+			os.Exit(129)
+		}
+		if header, _ := repo.readObject(hash); header.objectType != "commit" && header.objectType != "tag" {
+			fmt.Fprintf(os.Stderr, "error: object %s is a %s, not a commit\n", hash, header.objectType)
+			os.Exit(129)
+		}
+		return repo.peelToCommit(hash)
+	}
+	filter := &refFilter{}
+	for _, name := range contains {
+		filter.contains = append(filter.contains, resolve(name))
+	}
+	for _, name := range noContains {
+		filter.noContains = append(filter.noContains, resolve(name))
+	}
+	for _, name := range merged {
+		filter.merged = append(filter.merged, resolve(name))
+	}
+	for _, name := range noMerged {
+		filter.noMerged = append(filter.noMerged, resolve(name))
+	}
+	return filter
+}
+
+// matchesRefFilter tells whether a ref pointing at hash is listed; a nil filter and one
+// without options pass everything, otherwise only refs leading to commits
+func (repo *Repository) matchesRefFilter(filter *refFilter, hash string) bool {
+	if filter == nil {
+		return true
+	}
+	if len(filter.contains) == 0 && len(filter.noContains) == 0 && len(filter.merged) == 0 && len(filter.noMerged) == 0 {
+		return true
+	}
+	tip, ok := repo.peelTags(hash)
+	if !ok {
+		tip = hash
+	}
+	if header, _ := repo.readObject(tip); header.objectType != "commit" {
+		return false
+	}
+	// each check is a walk cut short by generation numbers, rather than
+	// listing all the history of the tip
+	reachesAny := func(commits []string) bool {
+		for _, commit := range commits {
+			if repo.isAncestor(commit, tip) {
+				return true
+			}
+		}
+		return false
+	}
+	reachedByAny := func(commits []string) bool {
+		for _, commit := range commits {
+			if repo.isAncestor(tip, commit) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(filter.contains) > 0 && !reachesAny(filter.contains) || reachesAny(filter.noContains) {
+		return false
+	}
+	if len(filter.merged) > 0 && !reachedByAny(filter.merged) || reachedByAny(filter.noMerged) {
+		return false
+	}
+	return true
+}
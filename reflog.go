@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reflogEntry is one line of logs/<ref>:
+// <old sha> <new sha> <name> <<e-mail>> <timestamp> <timezone>\t<message>
+type reflogEntry struct {
+	oldHash   string
+	newHash   string
+	committer identity
+	message   string
+	line      string // the original line, written back unchanged when kept
+	// the update index of the entry in a reftable, 0 for reflog files
+	updateIndex uint64
+}
+
+func (repo *Repository) reflogPath(ref string) string {
+	return filepath.Join(repo.gitDir, "logs", ref)
+}
+
+func (repo *Repository) readReflog(ref string) []reflogEntry {
+	if repo.reftableStores(ref) {
+		return repo.readReftableLog(ref)
+	}
+	content, err := os.ReadFile(repo.reflogPath(ref))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return parseReflog(content)
+}
+
+// parseReflog reads the entries of a reflog file
+func parseReflog(content []byte) []reflogEntry {
+	entries := make([]reflogEntry, 0)
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if len(line) < 2*(2*ObjectShaLength+1) {
+			continue
+		}
+		entry := reflogEntry{oldHash: line[:2*ObjectShaLength], newHash: line[2*ObjectShaLength+1 : 4*ObjectShaLength+1], line: line}
+		person := line[4*ObjectShaLength+2:]
+		if tab := strings.Index(person, "\t"); tab != -1 {
+			entry.message = person[tab+1:]
+			person = person[:tab]
+		}
+		entry.committer = parseIdentity(person)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (repo *Repository) writeReflog(ref string, entries []reflogEntry) {
+	if repo.reftableStores(ref) {
+		repo.writeReftableLog(ref, entries)
+		return
+	}
+	var content strings.Builder
+	for _, entry := range entries {
+		content.WriteString(entry.line + "\n")
+	}
+	writeFileAtomically(repo.reflogPath(ref), []byte(content.String()))
+}
+
+// hasReflog tells whether ref has a reflog
+func (repo *Repository) hasReflog(ref string) bool {
+	if repo.reftableStores(ref) {
+		return len(repo.readReftableLog(ref)) > 0
+	}
+	_, err := os.Stat(repo.reflogPath(ref))
+	return err == nil
+}
+
+// deleteReflog removes the reflog of ref, if it has one
+func (repo *Repository) deleteReflog(ref string) {
+	if repo.reftableStores(ref) {
+		if repo.hasReflog(ref) {
+			repo.writeReftableLog(ref, nil)
+		}
+		return
+	}
+	if err := os.Remove(repo.reflogPath(ref)); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+}
+
+// appendReflog records an update of ref by the current committer at the
+// end of its reflog; oldHash is all zeros when the ref was created
+func (repo *Repository) appendReflog(ref string, oldHash string, newHash string, message string) {
+	committer := repo.currentIdentity("COMMITTER")
+	line := fmt.Sprintf("%s %s %s\t%s", oldHash, newHash, committer, message)
+	entry := reflogEntry{oldHash: oldHash, newHash: newHash, committer: committer, message: message, line: line}
+	if repo.reftableStores(ref) {
+		repo.appendReftableLog(ref, entry)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(repo.reflogPath(ref)), 0777); err != nil {
+		log.Fatal(err)
+	}
+	repo.writeReflog(ref, append(repo.readReflog(ref), entry))
+}
+
+// listReflogs returns the refs that have a reflog in the lexical order of
+// the walk, with HEAD last like git
+func (repo *Repository) listReflogs() []string {
+	if repo.usesReftable() {
+		return repo.listReftableLogs()
+	}
+	refs := make([]string, 0)
+	root := filepath.Join(repo.gitDir, "logs", "refs")
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".lock") {
+			return nil
+		}
+		relativePath, err := filepath.Rel(filepath.Join(repo.gitDir, "logs"), path)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, filepath.ToSlash(relativePath))
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stat(repo.reflogPath("HEAD")); err == nil {
+		refs = append(refs, "HEAD")
+	}
+	return refs
+}
+
+// parseExpiry parses the value of --expire options and gc.*Expire
+// settings: "now" and "all", "never" and "false", or any date parseDate
+// takes, such as "2.weeks.ago" or "90 days ago"
+func parseExpiry(value string, now time.Time) (time.Time, bool) {
+	switch strings.ToLower(value) {
+	case "now", "all":
+		return now, true
+	case "never", "false":
+		return time.Time{}, true
+	}
+	return parseDate(value, now)
+}
+
+// expiryOption reads an expiry from the command line or else the config,
+// falling back to defaultValue
+func (repo *Repository) expiryOption(option string, configKey string, defaultValue string, now time.Time) time.Time {
+	value := option
+	if value == "" {
+		value = defaultValue
+		if configured, ok := repo.config.get(configKey); ok {
+			value = configured
+		}
+	}
+	when, ok := parseExpiry(value, now)
+	if !ok {
+		log.Fatalf("fatal: malformed expiration date '%s'", value)
+	}
+	return when
+}
+
+type reflogExpireOptions struct {
+	expire            time.Time // entries older than this go
+	expireUnreachable time.Time // as do older ones no longer reachable from the ref
+	dryRun            bool
+	verbose           bool
+}
+
+// expireReflog drops old entries from the reflog of ref
+func (repo *Repository) expireReflog(ref string, options reflogExpireOptions) {
+	entries := repo.readReflog(ref)
+	// HEAD moves between branches, so its entries count as reachable from
+	// any ref rather than only from where HEAD is now
+	tips := []string{ref}
+	if ref == "HEAD" {
+		tips = append(tips, repo.listRefs("refs/")...)
+	}
+	reachable := make(map[string]bool)
+	for _, tipRef := range tips {
+		tip, ok := repo.resolveRef(tipRef)
+		if !ok || reachable[tip] || !repo.hasObject(tip) {
+			continue
+		}
+		if header, _ := repo.readObject(tip); header.objectType == "commit" {
+			for hash := range repo.reachableCommits(tip) {
+				reachable[hash] = true
+			}
+		}
+	}
+	isUnreachable := func(hash string) bool {
+		return !isNullHash(hash) && !reachable[hash]
+	}
+	kept := make([]reflogEntry, 0, len(entries))
+	for _, entry := range entries {
+		when := entry.committer.when
+		expired := when.Before(options.expire) ||
+			(when.Before(options.expireUnreachable) && (isUnreachable(entry.oldHash) || isUnreachable(entry.newHash)))
+		switch {
+		case !expired:
+			kept = append(kept, entry)
+			if options.verbose {
+				fmt.Printf("keep %s\n", entry.message)
+			}
+		case options.dryRun:
+			if options.verbose {
+				fmt.Printf("would prune %s\n", entry.message)
+			}
+		case options.verbose:
+			fmt.Printf("prune %s\n", entry.message)
+		}
+	}
+	if !options.dryRun && len(kept) != len(entries) {
+		repo.writeReflog(ref, kept)
+	}
+}
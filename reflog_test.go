@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func reflogMessages(repo *Repository, ref string) []string {
+	messages := make([]string, 0)
+	for _, entry := range repo.readReflog(ref) {
+		messages = append(messages, entry.message)
+	}
+	return messages
+}
+
+// TestReflogOfCommitCheckoutAndRebase checks that the commands moving
+// branches record it in their reflogs and those of HEAD, so that gc keeps
+// what a rebase replaced
+func TestReflogOfCommitCheckoutAndRebase(t *testing.T) {
+	repo := newTestRepository(t, RepositoryOptions{})
+	first := commitWorktreeFile(t, repo, "a", "a\n", "one")
+	repo.updateRef("refs/heads/topic", first)
+	repo.checkout("topic", 1, true, newProgress(true))
+	replaced := commitWorktreeFile(t, repo, "b", "b\n", "two")
+	repo.checkout("main", 1, true, newProgress(true))
+	upstream := commitWorktreeFile(t, repo, "c", "c\n", "three")
+	repo.checkout("topic", 1, true, newProgress(true))
+	repo.rebase("main", rebaseOptions{quiet: true})
+
+	if got, want := reflogMessages(repo, "HEAD"), []string{
+		"commit (initial): one",
+		"checkout: moving from main to topic",
+		"commit: two",
+		"checkout: moving from topic to main",
+		"commit: three",
+		"checkout: moving from main to topic",
+		"rebase (finish): returning to refs/heads/topic",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("HEAD reflog is %q, want %q", got, want)
+	}
+	if got, want := reflogMessages(repo, "refs/heads/topic"), []string{
+		"commit: two",
+		"rebase (finish): refs/heads/topic onto " + upstream,
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("topic reflog is %q, want %q", got, want)
+	}
+	if origHead, _ := repo.resolveRef("ORIG_HEAD"); origHead != replaced {
+		t.Errorf("ORIG_HEAD is %s, want the commit before the rebase %s", origHead, replaced)
+	}
+	repo.gc(gcOptions{quiet: true, pruneExpire: "now"})
+	if !repo.hasObject(replaced) {
+		t.Errorf("gc dropped %s, which the topic reflog still has", replaced)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+)
+
+type refFormatOptions struct {
+	allowOneLevel  bool // names without a "/" such as "HEAD"
+	refspecPattern bool // a single "*" wildcard component, for refspecs
+	normalize      bool // strip a leading "/" and collapse repeated slashes
+}
+
+// checkRefFormat applies git's ref name rules and returns the possibly
+// normalized name; ok is false for names git would refuse
+func checkRefFormat(name string, options refFormatOptions) (string, bool) {
+	if options.normalize {
+		name = strings.TrimLeft(name, "/")
+		for strings.Contains(name, "//") {
+			name = strings.ReplaceAll(name, "//", "/")
+		}
+	}
+	if name == "" || name == "@" || strings.HasSuffix(name, ".") {
+		return name, false
+	}
+	wildcards := 0
+	components := strings.Split(name, "/")
+	for _, component := range components {
+		if component == "" || component[0] == '.' || strings.HasSuffix(component, ".lock") {
+			return name, false
+		}
+		for i := 0; i < len(component); i++ {
+			c := component[i]
+			switch {
+			case c < 0x20 || c == 0x7f:
+				return name, false
+			case c == ' ' || c == '~' || c == '^' || c == ':' || c == '?' || c == '[' || c == '\\':
+				return name, false
+			case c == '.' && i+1 < len(component) && component[i+1] == '.':
+				return name, false
+			case c == '@' && i+1 < len(component) && component[i+1] == '{':
+				return name, false
+			case c == '*':
+				wildcards++
+				if !options.refspecPattern || wildcards > 1 {
+					return name, false
+				}
+			}
+		}
+	}
+	if len(components) < 2 && !options.allowOneLevel {
+		return name, false
+	}
+	return name, true
+}
+
+// isValidRefName reports whether a ref may be written: a full name below
+// refs/ or one of the all-caps pseudo refs at the top of the git dir
+func isValidRefName(name string) bool {
+	if !strings.Contains(name, "/") {
+		return name != "" && strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZ_") == "" && strings.HasSuffix(name, "HEAD")
+	}
+	_, ok := checkRefFormat(name, refFormatOptions{})
+	return ok && strings.HasPrefix(name, "refs/")
+}
+
+// isValidBranchName applies the rules git has for branch names on top of
+// those for refs: a branch may not be called HEAD nor start with a dash
+func isValidBranchName(name string) bool {
+	if name == "HEAD" || strings.HasPrefix(name, "-") {
+		return false
+	}
+	_, ok := checkRefFormat("refs/heads/"+name, refFormatOptions{})
+	return ok
+}
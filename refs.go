@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const symbolicRefPrefix = "ref: "
+
+func isFullHash(name string) bool {
+	if len(name) != 2*ObjectShaLength {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func (repo *Repository) readPackedRefs() map[string]string {
+	// format:
+	// # pack-refs with: peeled fully-peeled sorted
+	// <sha> <refname>
+	// ^<peeled sha of the annotated tag above>
+	refs := make(map[string]string)
+	file, err := os.Open(filepath.Join(repo.gitDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return refs
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	bufScanner := bufio.NewScanner(file)
+	for bufScanner.Scan() {
+		line := bufScanner.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		lineComponents := strings.SplitN(line, " ", 2)
+		if len(lineComponents) != 2 {
+			log.Fatalf("fatal: unexpected line in packed-refs: %s", line)
+		}
+		refs[lineComponents[1]] = lineComponents[0]
+	}
+	if err := bufScanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return refs
+}
+
+// readPackedRefsWithPrefix returns the packed refs starting with prefix.
+// When packed-refs is sorted, as pack-refs writes it, only the part of it
+// holding them is read: the file is mapped and the first of them found by
+// binary search, so that looking up a branch among many refs stays cheap.
+func (repo *Repository) readPackedRefsWithPrefix(prefix string) map[string]string {
+	path := filepath.Join(repo.gitDir, "packed-refs")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return make(map[string]string)
+	}
+	data := mapWholeFile(path)
+	defer unmapRegion(data)
+	lineEnd := func(position int) int {
+		if end := bytes.IndexByte(data[position:], '\n'); end >= 0 {
+			return position + end
+		}
+		return len(data)
+	}
+	header := string(data[:lineEnd(0)])
+	if !strings.HasPrefix(header, "# pack-refs with:") || !strings.Contains(header+" ", " sorted ") {
+		refs := make(map[string]string)
+		for name, hash := range repo.readPackedRefs() {
+			if strings.HasPrefix(name, prefix) {
+				refs[name] = hash
+			}
+		}
+		return refs
+	}
+	// a record is a "<sha> <refname>" line and the "^<sha>" peeled line
+	// that may follow it
+	recordStart := func(position int) int {
+		for {
+			for position > 0 && data[position-1] != '\n' {
+				position--
+			}
+			if position == 0 || data[position] != '^' {
+				return position
+			}
+			position--
+		}
+	}
+	nextRecord := func(position int) int {
+		position = lineEnd(position) + 1
+		for position < len(data) && data[position] == '^' {
+			position = lineEnd(position) + 1
+		}
+		return position
+	}
+	recordName := func(position int) string {
+		line := string(data[position:lineEnd(position)])
+		if len(line) <= 2*ObjectShaLength || line[2*ObjectShaLength] != ' ' {
+			log.Fatalf("fatal: unexpected line in packed-refs: %s", line)
+		}
+		return line[2*ObjectShaLength+1:]
+	}
+	low, high := nextRecord(0), len(data)
+	for low < high {
+		middle := recordStart(low + (high-low)/2)
+		if middle < low {
+			middle = low
+		}
+		if recordName(middle) < prefix {
+			low = nextRecord(middle)
+		} else {
+			high = middle
+		}
+	}
+	refs := make(map[string]string)
+	for position := low; position < len(data); position = nextRecord(position) {
+		name := recordName(position)
+		if !strings.HasPrefix(name, prefix) {
+			break
+		}
+		refs[name] = string(data[position : position+2*ObjectShaLength])
+	}
+	return refs
+}
+
+// readRef returns the raw value of a ref: either a sha or "ref: <target>"
+func (repo *Repository) readRef(name string) (string, bool) {
+	if repo.reftableStores(name) {
+		return repo.readReftableRef(name)
+	}
+	content, err := os.ReadFile(filepath.Join(repo.gitDir, name))
+	if err == nil {
+		return strings.TrimSpace(string(content)), true
+	}
+	if !os.IsNotExist(err) && !isDirectoryError(err) {
+		log.Fatal(err)
+	}
+	hash, ok := repo.readPackedRefsWithPrefix(name)[name]
+	return hash, ok
+}
+
+func isDirectoryError(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		info, statErr := os.Stat(pathErr.Path)
+		return statErr == nil && info.IsDir()
+	}
+	return false
+}
+
+// resolveRef follows symbolic refs down to a sha; ok is false for missing
+// refs and for symbolic refs pointing at an unborn branch
+func (repo *Repository) resolveRef(name string) (string, bool) {
+	for depth := 0; depth < 5; depth++ {
+		value, ok := repo.readRef(name)
+		if !ok {
+			return "", false
+		}
+		if !strings.HasPrefix(value, symbolicRefPrefix) {
+			return value, true
+		}
+		name = strings.TrimPrefix(value, symbolicRefPrefix)
+	}
+	log.Fatalf("fatal: symbolic ref chain too deep at %s", name)
+	return "", false
+}
+
+// headBranch returns the branch HEAD points to, ok is false when detached
+func (repo *Repository) headBranch() (string, bool) {
+	if _, ok := repo.readRef("HEAD"); !ok {
+		log.Fatal("fatal: not a git repository: HEAD is missing")
+	}
+	target, ok := repo.readSymbolicRef("HEAD")
+	if !ok || !strings.HasPrefix(target, "refs/heads/") {
+		return "", false
+	}
+	return strings.TrimPrefix(target, "refs/heads/"), true
+}
+
+func (repo *Repository) resolveRevision(name string) string {
+	hash, ok := repo.lookupRevision(name)
+	if !ok {
+		log.Fatalf("fatal: ambiguous argument '%s': unknown revision", name)
+	}
+	return hash
+}
+
+// lookupRevision is resolveRevision for callers that need to tell
+// revisions from other arguments; ok is false for unknown names. Besides
+// refs and object names, abbreviated to at least four digits when unique,
+// it takes "<rev>:<path>" and ":<path>" for what is at a path, "<rev>~<n>"
+// and "<rev>^<n>" for ancestors, "<rev>^{<type>}" for the object a tag or
+// commit leads to and "<ref>@{<n>}" for the n-th prior value of a ref.
+func (repo *Repository) lookupRevision(name string) (string, bool) {
+	if rev, entryPath, ok := splitRevisionPath(name); ok {
+		hash, _, _, found := repo.lookupRevisionPath(rev, entryPath)
+		return hash, found
+	}
+	if match := ancestrySuffix.FindStringSubmatch(name); match != nil {
+		return repo.lookupAncestor(match[1], match[2])
+	}
+	if match := peelSuffix.FindStringSubmatch(name); match != nil {
+		hash, ok := repo.lookupRevision(match[1])
+		if !ok {
+			return "", false
+		}
+		return repo.peelObject(hash, match[2])
+	}
+	if match := reflogSuffix.FindStringSubmatch(name); match != nil {
+		return repo.lookupReflogEntry(match[1], match[2])
+	}
+	if name == "@" {
+		name = "HEAD"
+	}
+	if isFullHash(name) {
+		return strings.ToLower(name), true
+	}
+	if ref, ok := repo.expandRefName(name); ok {
+		return repo.resolveRef(ref)
+	}
+	if len(name) < 4 || !isHexString(name) {
+		return "", false
+	}
+	switch hashes := repo.objectsWithPrefix(strings.ToLower(name)); len(hashes) {
+	case 0:
+		return "", false
+	case 1:
+		return hashes[0], true
+	default:
+		fmt.Fprintf(os.Stderr, "error: short object ID %s is ambiguous\n", name)
+		return "", false
+	}
+}
+
+// expandRefName finds the ref a short name stands for, in the same order
+// as git: <name>, refs/<name>, refs/tags/<name>, refs/heads/<name>,
+// refs/remotes/<name>, refs/remotes/<name>/HEAD
+func (repo *Repository) expandRefName(name string) (string, bool) {
+	candidates := []string{name, "refs/" + name, "refs/tags/" + name, "refs/heads/" + name,
+		"refs/remotes/" + name, "refs/remotes/" + name + "/HEAD"}
+	for _, candidate := range candidates {
+		if candidate != "HEAD" && !strings.HasPrefix(candidate, "refs/") {
+			continue
+		}
+		if _, ok := repo.resolveRef(candidate); ok {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// splitRevisionPath splits "<rev>:<path>" at its first colon outside of
+// braces, so that "main@{1}:file" keeps its "@{1}"
+func splitRevisionPath(name string) (string, string, bool) {
+	depth := 0
+	for i, c := range name {
+		switch {
+		case c == '{':
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+		case c == ':' && depth == 0:
+			return name[:i], name[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// peelSuffix splits "<rev>^{<type>}" and "<rev>^{}" into the revision and
+// the type
+var peelSuffix = regexp.MustCompile(`^(.+)\^\{([a-z]*)\}$`)
+
+// peelObject follows tags, and commits to their trees, from hash to an
+// object of objectType; "" peels tags only and "object" takes any object.
+// ok is false when no such object is found that way.
+func (repo *Repository) peelObject(hash string, objectType string) (string, bool) {
+	for {
+		header, content := repo.readObject(hash)
+		switch {
+		case objectType == "object" || header.objectType == objectType:
+			return hash, true
+		case header.objectType == "tag":
+			firstLine := strings.SplitN(string(content), "\n", 2)[0]
+			hash = strings.TrimPrefix(firstLine, "object ")
+		case objectType == "":
+			return hash, true
+		case header.objectType == "commit" && objectType == "tree":
+			return repo.readCommitObject(hash).tree, true
+		default:
+			return "", false
+		}
+	}
+}
+
+// reflogSuffix splits "<ref>@{<n>}" into the ref, empty for the current
+// branch, and n
+var reflogSuffix = regexp.MustCompile(`^(.*)@\{([0-9]+)\}$`)
+
+// lookupReflogEntry returns what ref pointed at n updates ago, as its
+// reflog has it
+func (repo *Repository) lookupReflogEntry(name string, count string) (string, bool) {
+	ref := "HEAD"
+	if name == "" {
+		if branch, ok := repo.headBranch(); ok {
+			ref = "refs/heads/" + branch
+		}
+	} else if expanded, ok := repo.expandRefName(name); ok {
+		ref = expanded
+	} else {
+		return "", false
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return "", false
+	}
+	entries := repo.readReflog(ref)
+	switch {
+	case n < len(entries):
+		return entries[len(entries)-1-n].newHash, true
+	case n == len(entries) && n > 0 && entries[0].oldHash != nullHash:
+		// the value before the oldest update
+		return entries[0].oldHash, true
+	}
+	return "", false
+}
+
+// ancestrySuffix splits "<rev>~<n>", "<rev>^<n>" and chains of them such
+// as "main~2^2" into the revision and its suffix
+var ancestrySuffix = regexp.MustCompile(`^(.+?)((?:[~^][0-9]*)+)$`)
+
+// lookupAncestor goes from a revision to an ancestor: "~<n>" is the n-th
+// first parent, "^<n>" the n-th parent, both 1 without a number, and "^0"
+// the commit itself; ok is false for parents that do not exist
+func (repo *Repository) lookupAncestor(name string, suffix string) (string, bool) {
+	hash, ok := repo.lookupRevision(name)
+	if !ok {
+		return "", false
+	}
+	for _, step := range ancestryStep.FindAllStringSubmatch(suffix, -1) {
+		n := 1
+		if step[2] != "" {
+			n, _ = strconv.Atoi(step[2])
+		}
+		hash = repo.peelToCommit(hash)
+		parents := repo.readCommitObject(hash).parents
+		switch {
+		case step[1] == "~":
+			for ; n > 0; n-- {
+				if len(parents) == 0 {
+					return "", false
+				}
+				hash = parents[0]
+				parents = repo.readCommitObject(hash).parents
+			}
+		case n == 0:
+		case n > len(parents):
+			return "", false
+		default:
+			hash = parents[n-1]
+		}
+	}
+	return hash, true
+}
+
+var ancestryStep = regexp.MustCompile(`([~^])([0-9]*)`)
+
+func (repo *Repository) peelToCommit(hash string) string {
+	// annotated tags point at their target through an "object <sha>" header
+	for {
+		header, content := repo.readObject(hash)
+		switch header.objectType {
+		case "commit":
+			return hash
+		case "tag":
+			firstLine := strings.SplitN(string(content), "\n", 2)[0]
+			hash = strings.TrimPrefix(firstLine, "object ")
+		default:
+			log.Fatalf("fatal: %s is a %s, not a commit", hash, header.objectType)
+		}
+	}
+}
+
+func (repo *Repository) updateRef(name string, value string) {
+	if !isValidRefName(name) {
+		log.Fatalf("fatal: '%s' is not a valid ref name", name)
+	}
+	if repo.reftableStores(name) {
+		repo.writeReftableRef(name, value)
+		return
+	}
+	path := filepath.Join(repo.gitDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		log.Fatal(err)
+	}
+	writeFileAtomically(path, []byte(value+"\n"))
+}
+
+// updateRefLogged is updateRef recording the update in the reflog of the
+// ref, when core.logAllRefUpdates has it logged, with message
+func (repo *Repository) updateRefLogged(name string, value string, message string) {
+	old, ok := repo.resolveRef(name)
+	if !ok {
+		old = nullHash
+	}
+	repo.updateRef(name, value)
+	repo.logRefUpdate(name, old, value, message)
+}
+
+// logRefUpdate appends an update of ref to its reflog as git would: by
+// default for HEAD, branches, remote-tracking branches and notes outside
+// of bare repositories, and for any ref that has a reflog already
+func (repo *Repository) logRefUpdate(name string, oldHash string, newHash string, message string) {
+	value, _ := repo.config.get("core.logAllRefUpdates")
+	logged := strings.ToLower(value) == "always" || repo.hasReflog(name)
+	if !logged && repo.config.getBool("core.logAllRefUpdates", !repo.config.getBool("core.bare", false)) {
+		logged = name == "HEAD" || strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/remotes/") || strings.HasPrefix(name, "refs/notes/")
+	}
+	if logged {
+		repo.appendReflog(name, oldHash, newHash, message)
+	}
+}
+
+// writeOrigHead saves where HEAD was before a command that moves it a
+// long way, as ORIG_HEAD
+func (repo *Repository) writeOrigHead(hash string) {
+	repo.updateRef("ORIG_HEAD", hash)
+}
+
+// listRefs returns the sorted names of all loose and packed refs starting
+// with prefix, e.g. "refs/heads/". Only the loose refs of the directory
+// the prefix is in and the part of packed-refs holding it are read.
+func (repo *Repository) listRefs(prefix string) []string {
+	if repo.usesReftable() {
+		sorted := make([]string, 0)
+		for name := range repo.reftableRefs() {
+			if strings.HasPrefix(name, "refs/") && strings.HasPrefix(name, prefix) {
+				sorted = append(sorted, name)
+			}
+		}
+		sort.Strings(sorted)
+		return sorted
+	}
+	names := make(map[string]bool)
+	for name := range repo.readPackedRefsWithPrefix(prefix) {
+		names[name] = true
+	}
+	dir := prefix[:strings.LastIndexByte(prefix, '/')+1]
+	if !strings.HasPrefix(dir, "refs/") {
+		dir = "refs/"
+	}
+	root := filepath.Join(repo.gitDir, filepath.FromSlash(dir))
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".lock") {
+			return nil
+		}
+		relativePath, err := filepath.Rel(repo.gitDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relativePath)
+		if strings.HasPrefix(name, prefix) {
+			names[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// globRefs returns the refs a --glob pattern selects, the way git reads
+// it: relative to refs/ unless it starts there, and standing for all refs
+// below it when it has no wildcards
+func (repo *Repository) globRefs(pattern string) []string {
+	if !strings.HasPrefix(pattern, "refs/") {
+		pattern = "refs/" + pattern
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return repo.listRefs(strings.TrimSuffix(pattern, "/") + "/")
+	}
+	matching := make([]string, 0)
+	for _, name := range repo.listRefs("refs/") {
+		if wildmatch(pattern, name, false) {
+			matching = append(matching, name)
+		}
+	}
+	return matching
+}
+
+// deleteRef removes a ref from both the loose files and packed-refs
+func (repo *Repository) deleteRef(name string) {
+	if repo.reftableStores(name) {
+		if _, ok := repo.readReftableRef(name); ok {
+			repo.writeReftableRef(name, "")
+		}
+		return
+	}
+	// the lock of the ref keeps it from being updated while it goes
+	path := filepath.Join(repo.gitDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		log.Fatal(err)
+	}
+	refLock := acquireLock(path)
+	defer refLock.rollback()
+	// packed-refs goes first, so that once the loose ref is gone nobody
+	// sees an older packed value of it come back, and stays locked until
+	// then, so that packRefs does not pack the loose ref meanwhile
+	packedLock := repo.deletePackedRef(name)
+	defer packedLock.rollback()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		refLock.fail(err)
+	}
+}
+
+// deletePackedRef removes a ref from packed-refs, read under its lock so
+// that a concurrent packRefs or deletion is not undone, and returns the
+// lock still held
+func (repo *Repository) deletePackedRef(name string) *lockFile {
+	packedPath := filepath.Join(repo.gitDir, "packed-refs")
+	lock := acquireLock(packedPath)
+	content, err := os.ReadFile(packedPath)
+	if os.IsNotExist(err) {
+		return lock
+	}
+	if err != nil {
+		lock.fail(err)
+	}
+	kept := make([]string, 0)
+	removed := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if strings.HasPrefix(line, "^") && removed {
+			// the peeled value belongs to the removed tag
+			continue
+		}
+		removed = strings.TrimRight(line, "\n") != "" && strings.HasSuffix(strings.TrimRight(line, "\n"), " "+name)
+		if !removed {
+			kept = append(kept, line)
+		}
+	}
+	if updated := strings.Join(kept, ""); updated != string(content) {
+		lock.replaceKeepingLock([]byte(updated))
+	}
+	return lock
+}
+
+// readSymbolicRef returns the ref a symbolic ref points to, ok is false for
+// missing refs and refs holding a sha
+func (repo *Repository) readSymbolicRef(name string) (string, bool) {
+	value, ok := repo.readRef(name)
+	if !ok || !strings.HasPrefix(value, symbolicRefPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(value, symbolicRefPrefix), true
+}
+
+// updateSymbolicRef points name at target, which may not exist yet as for
+// a HEAD on an unborn branch
+func (repo *Repository) updateSymbolicRef(name string, target string) {
+	if !strings.HasPrefix(target, "refs/") || !isValidRefName(target) {
+		log.Fatalf("fatal: refusing to point %s outside of refs/", name)
+	}
+	repo.updateRef(name, symbolicRefPrefix+target)
+}
+
+// shortRefName strips the namespace of a full ref name the way git
+// abbreviates refs, e.g. refs/heads/main becomes main
+func shortRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/", "refs/"} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return name
+}
+
+// packRefs moves loose refs into packed-refs: tags and refs that are
+// already packed by default, every ref with all. Symbolic refs stay loose.
+func (repo *Repository) packRefs(all bool, prune bool) {
+	if repo.usesReftable() {
+		repo.compactReftables()
+		return
+	}
+	// packed-refs.lock keeps other pack-refs runs and deletions out while the
+	// new file is written; each loose ref is then only removed under its own
+	// lock and if it still holds the packed value, so a concurrent updateRef
+	// either fails on the lock or survives as the newer loose value
+	lock := acquireLock(filepath.Join(repo.gitDir, "packed-refs"))
+	packed := repo.readPackedRefs()
+	loose := make(map[string]string)
+	for _, name := range repo.listRefs("refs/") {
+		content, err := os.ReadFile(filepath.Join(repo.gitDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			lock.fail(err)
+		}
+		value := strings.TrimSpace(string(content))
+		if !isFullHash(value) {
+			continue
+		}
+		_, alreadyPacked := packed[name]
+		if all || alreadyPacked || strings.HasPrefix(name, "refs/tags/") {
+			if !repo.hasObject(value) {
+				continue
+			}
+			loose[name] = value
+			packed[name] = value
+		}
+	}
+	names := make([]string, 0, len(packed))
+	for name := range packed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buffer strings.Builder
+	buffer.WriteString("# pack-refs with: peeled fully-peeled sorted \n")
+	for _, name := range names {
+		buffer.WriteString(packed[name] + " " + name + "\n")
+		if peeled, ok := repo.peelTags(packed[name]); ok {
+			buffer.WriteString("^" + peeled + "\n")
+		}
+	}
+	if _, err := lock.Write([]byte(buffer.String())); err != nil {
+		lock.fail(err)
+	}
+	lock.commit()
+	if !prune {
+		return
+	}
+	for name, value := range loose {
+		repo.pruneLooseRef(name, value)
+	}
+}
+
+// pruneLooseRef deletes a loose ref that has been packed, unless it was
+// changed since or somebody else holds its lock
+func (repo *Repository) pruneLooseRef(name string, packedValue string) {
+	path := filepath.Join(repo.gitDir, name)
+	refLock, ok := tryLock(path)
+	if !ok {
+		return
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// deleted meanwhile
+		refLock.rollback()
+		return
+	}
+	unchanged := err == nil && strings.TrimSpace(string(content)) == packedValue
+	if unchanged {
+		err = os.Remove(path)
+	}
+	refLock.rollback()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !unchanged {
+		return
+	}
+	// drop directories left empty, e.g. refs/heads/feature/ but never
+	// the top level namespaces refs/heads/ and refs/tags/
+	for dir := filepath.Dir(name); strings.Count(filepath.ToSlash(dir), "/") >= 2; dir = filepath.Dir(dir) {
+		if os.Remove(filepath.Join(repo.gitDir, dir)) != nil {
+			break
+		}
+	}
+}
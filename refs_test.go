@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestLookupRevision checks the revision syntax every command takes:
+// paths in trees and the index, abbreviated object names, loose and
+// packed, peeling to a type and prior values of refs from their reflogs
+func TestLookupRevision(t *testing.T) {
+	repo := newTestRepository(t, RepositoryOptions{})
+	first := commitWorktreeFile(t, repo, "dir/file", "first\n", "one")
+	second := commitWorktreeFile(t, repo, "dir/file", "second\n", "two")
+	writeWorktreeFile(t, repo, "dir/file", "staged\n")
+	repo.addPaths(repo.parsePathspecs([]string{"dir/file"}), 1, addOptions{})
+	firstBlob := repo.writeObject("blob", []byte("first\n"))
+	stagedBlob := repo.writeObject("blob", []byte("staged\n"))
+
+	check := func(when string) {
+		t.Helper()
+		for name, want := range map[string]string{
+			"HEAD:dir/file":        repo.writeObject("blob", []byte("second\n")),
+			"HEAD~1:dir/file":      firstBlob,
+			"main@{1}:/dir/file":   firstBlob,
+			":dir/file":            stagedBlob,
+			":0:dir/file":          stagedBlob,
+			"HEAD^{tree}":          repo.readCommitObject(second).tree,
+			"HEAD~1^{commit}":      first,
+			"HEAD:":                repo.readCommitObject(second).tree,
+			second[:7]:             second,
+			first[:4]:              first,
+			"@":                    second,
+			"@{1}":                 first,
+			"main@{0}":             second,
+			"HEAD@{1}^{tree}":      repo.readCommitObject(first).tree,
+			"main@{1}^{}":          first,
+			second[:7] + ":dir":    repo.treeAtPath(repo.readCommitObject(second).tree, "dir"),
+			second[:7] + "~1^{}":   first,
+			"refs/heads/main@{1}":  first,
+			"main@{1}:dir/file":    firstBlob,
+			"HEAD^{tree}:dir/file": repo.writeObject("blob", []byte("second\n")),
+		} {
+			if hash, ok := repo.lookupRevision(name); !ok || hash != want {
+				t.Errorf("%s: %s resolves to %q, %v, want %s", when, name, hash, ok, want)
+			}
+		}
+		for _, name := range []string{"HEAD:missing", ":missing", ":2:dir/file", "HEAD^{blob}", "main@{2}", "abc", "zzzz", "HEAD~1:dir/file/x"} {
+			if hash, ok := repo.lookupRevision(name); ok {
+				t.Errorf("%s: %s resolves to %s, want nothing", when, name, hash)
+			}
+		}
+	}
+	check("loose")
+	repo.gc(gcOptions{quiet: true, pruneExpire: "now"})
+	check("packed")
+
+	// blobs until two of them share the first four digits
+	seen := make(map[string]string)
+	for i := 0; ; i++ {
+		hash := repo.writeObject("blob", []byte(fmt.Sprintf("blob %d\n", i)))
+		if other, ok := seen[hash[:4]]; ok {
+			if found, ok := repo.lookupRevision(hash[:4]); ok {
+				t.Errorf("the ambiguous %s resolves to %s", hash[:4], found)
+			}
+			for _, name := range []string{hash, other} {
+				if found, ok := repo.lookupRevision(name[:12]); !ok || found != name {
+					t.Errorf("%s resolves to %q, %v, want %s", name[:12], found, ok, name)
+				}
+			}
+			break
+		}
+		seen[hash[:4]] = hash
+	}
+}
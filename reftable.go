@@ -0,0 +1,740 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The reftable backend (extensions.refStorage=reftable) keeps refs and
+// reflogs in a stack of tables under reftable/, listed oldest first in
+// tables.list. Each update adds a table holding only what it changed; a
+// record of a newer table replaces that of an older one, and deletions are
+// recorded as such until the stack is compacted into a single table.
+const (
+	reftableHeaderSize      = 24
+	reftableFooterSize      = 68
+	reftableBlockSize       = 4096
+	reftableRestartInterval = 16
+	// the stack is compacted into one table once it has this many
+	reftableMaxTables = 8
+)
+
+// the value types of ref and log records
+const (
+	reftableDeletion = 0
+	reftableValue    = 1 // one object id, or a log update
+	reftablePeeled   = 2 // object id and peeled id of an annotated tag
+	reftableSymref   = 3
+)
+
+// reftableRef is a ref record: value is a sha or "ref: <target>" as
+// readRef returns, "" for a deletion
+type reftableRef struct {
+	name        string
+	updateIndex uint64
+	value       string
+	peeled      string
+}
+
+// reftableLog is a log record, one reflog entry of a ref
+type reftableLog struct {
+	name        string
+	updateIndex uint64
+	deleted     bool
+	oldHash     string
+	newHash     string
+	committer   identity
+	message     string
+}
+
+type reftable struct {
+	minUpdateIndex uint64
+	maxUpdateIndex uint64
+	refs           []reftableRef
+	logs           []reftableLog
+}
+
+// usesReftable tells whether refs are stored as reftables
+func (repo *Repository) usesReftable() bool {
+	storage, _ := repo.config.get("extensions.refStorage")
+	return strings.EqualFold(storage, "reftable")
+}
+
+// reftableStores tells whether a ref lives in the reftable stack: all of
+// them with the reftable backend except FETCH_HEAD and MERGE_HEAD, which
+// git keeps as files
+func (repo *Repository) reftableStores(name string) bool {
+	return repo.usesReftable() && name != "FETCH_HEAD" && name != "MERGE_HEAD"
+}
+
+func (repo *Repository) reftableDir() string {
+	return filepath.Join(repo.gitDir, "reftable")
+}
+
+// reftableNames reads tables.list, the names of the tables oldest first
+func (repo *Repository) reftableNames() []string {
+	content, err := os.ReadFile(filepath.Join(repo.reftableDir(), "tables.list"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return strings.Fields(string(content))
+}
+
+// readReftableStack reads the names and tables of the stack. A table
+// listed may be gone when the stack was compacted meanwhile, the new list
+// is then read again.
+func (repo *Repository) readReftableStack() ([]string, []*reftable) {
+	for attempt := 0; ; attempt++ {
+		names := repo.reftableNames()
+		tables := make([]*reftable, 0, len(names))
+		for _, name := range names {
+			table, ok := readReftable(filepath.Join(repo.reftableDir(), name))
+			if !ok {
+				break
+			}
+			tables = append(tables, table)
+		}
+		if len(tables) == len(names) {
+			return names, tables
+		}
+		if attempt == 10 {
+			log.Fatalf("fatal: reftable %s is missing", names[len(tables)])
+		}
+	}
+}
+
+// reftableVarint reads the varints of reftables, those of OFS_DELTA
+// offsets in packs, returning how many bytes they took
+func reftableVarint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	value := uint64(data[0] & 0x7f)
+	length := 1
+	for data[length-1]&0x80 != 0 {
+		if length == len(data) || length > 9 {
+			return 0, 0
+		}
+		value = (value+1)<<7 | uint64(data[length]&0x7f)
+		length++
+	}
+	return value, length
+}
+
+func uint24(data []byte) int {
+	return int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+}
+
+// readReftable reads all the ref and log records of a table, going through
+// its blocks in order and skipping those of the object and index sections,
+// which only speed up lookups; ok is false when there is no such table
+func readReftable(path string) (*reftable, bool) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	corrupt := func(reason string) {
+		log.Fatalf("fatal: reftable %s is corrupt: %s", path, reason)
+	}
+	if len(data) < reftableHeaderSize+reftableFooterSize || string(data[:4]) != "REFT" {
+		corrupt("not a reftable")
+	}
+	if data[4] != 1 {
+		log.Fatalf("fatal: reftable %s has unsupported version %d", path, data[4])
+	}
+	footer := data[len(data)-reftableFooterSize:]
+	if crc32.ChecksumIEEE(footer[:reftableFooterSize-4]) != binary.BigEndian.Uint32(footer[reftableFooterSize-4:]) {
+		corrupt("bad footer checksum")
+	}
+	blockSize := uint24(data[5:])
+	table := &reftable{
+		minUpdateIndex: binary.BigEndian.Uint64(data[8:]),
+		maxUpdateIndex: binary.BigEndian.Uint64(data[16:]),
+	}
+	end := len(data) - reftableFooterSize
+	for position := 0; position < end; {
+		start := 0
+		if position == 0 {
+			start = reftableHeaderSize
+		}
+		if position+start+4 > end {
+			break
+		}
+		blockType := data[position+start]
+		blockLength := uint24(data[position+start+1:])
+		var block []byte
+		next := position + blockLength
+		switch blockType {
+		case 'g':
+			// log blocks are deflated after their type and length, which
+			// count them inflated
+			reader := bytes.NewReader(data[position+start+4 : end])
+			inflater, err := zlib.NewReader(reader)
+			if err != nil {
+				corrupt(err.Error())
+			}
+			block = make([]byte, blockLength)
+			copy(block, data[position:position+start+4])
+			if _, err := io.ReadFull(inflater, block[start+4:]); err != nil {
+				corrupt(err.Error())
+			}
+			// reading to the end of the stream takes its checksum too
+			if extra, err := io.Copy(io.Discard, inflater); err != nil || extra != 0 {
+				corrupt("bad log block length")
+			}
+			next = end - reader.Len()
+		case 'r', 'o', 'i':
+			if next > end || blockLength < start+4+2 {
+				corrupt(fmt.Sprintf("bad block at offset %d", position))
+			}
+			block = data[position:next]
+			// blocks are padded to the block size unless followed directly
+			// by the next one
+			if blockSize > 0 && next < position+blockSize && next < end && data[next] == 0 {
+				next = position + blockSize
+			}
+		default:
+			corrupt(fmt.Sprintf("unknown block type %q at offset %d", blockType, position))
+		}
+		if blockType == 'r' || blockType == 'g' {
+			if !table.readBlock(block, start, blockType) {
+				corrupt(fmt.Sprintf("bad records in block at offset %d", position))
+			}
+		}
+		position = next
+	}
+	return table, true
+}
+
+// readBlock reads the prefix-compressed records of a ref or log block,
+// which start after the block header and end at its restart offsets
+func (table *reftable) readBlock(block []byte, start int, blockType byte) bool {
+	if len(block) < start+4+2 {
+		return false
+	}
+	restartCount := int(binary.BigEndian.Uint16(block[len(block)-2:]))
+	recordsEnd := len(block) - 2 - 3*restartCount
+	if recordsEnd < start+4 {
+		return false
+	}
+	records := block[start+4 : recordsEnd]
+	var key []byte
+	for len(records) > 0 {
+		prefixLength, n := reftableVarint(records)
+		if n == 0 || prefixLength > uint64(len(key)) {
+			return false
+		}
+		records = records[n:]
+		suffixAndType, n := reftableVarint(records)
+		if n == 0 || suffixAndType>>3 > uint64(len(records)-n) {
+			return false
+		}
+		records = records[n:]
+		suffixLength, valueType := int(suffixAndType>>3), suffixAndType&7
+		key = append(key[:prefixLength:prefixLength], records[:suffixLength]...)
+		records = records[suffixLength:]
+		var ok bool
+		if blockType == 'r' {
+			records, ok = table.readRefRecord(string(key), valueType, records)
+		} else {
+			records, ok = table.readLogRecord(key, valueType, records)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (table *reftable) readRefRecord(name string, valueType uint64, records []byte) ([]byte, bool) {
+	delta, n := reftableVarint(records)
+	if n == 0 {
+		return nil, false
+	}
+	records = records[n:]
+	ref := reftableRef{name: name, updateIndex: table.minUpdateIndex + delta}
+	switch valueType {
+	case reftableDeletion:
+	case reftableValue, reftablePeeled:
+		ids := int(valueType) * ObjectShaLength
+		if len(records) < ids {
+			return nil, false
+		}
+		ref.value = hex.EncodeToString(records[:ObjectShaLength])
+		if valueType == reftablePeeled {
+			ref.peeled = hex.EncodeToString(records[ObjectShaLength:ids])
+		}
+		records = records[ids:]
+	case reftableSymref:
+		length, n := reftableVarint(records)
+		if n == 0 || length > uint64(len(records)-n) {
+			return nil, false
+		}
+		ref.value = symbolicRefPrefix + string(records[n:n+int(length)])
+		records = records[n+int(length):]
+	default:
+		return nil, false
+	}
+	table.refs = append(table.refs, ref)
+	return records, true
+}
+
+// readLogRecord reads a log record, whose key is the ref name, a NUL and
+// the update index subtracted from the largest uint64, so that the newest
+// entries of a ref come first
+func (table *reftable) readLogRecord(key []byte, valueType uint64, records []byte) ([]byte, bool) {
+	if len(key) < 9 || key[len(key)-9] != 0 {
+		return nil, false
+	}
+	entry := reftableLog{name: string(key[:len(key)-9]), updateIndex: ^binary.BigEndian.Uint64(key[len(key)-8:])}
+	if valueType == reftableDeletion {
+		entry.deleted = true
+		table.logs = append(table.logs, entry)
+		return records, true
+	}
+	if valueType != reftableValue || len(records) < 2*ObjectShaLength {
+		return nil, false
+	}
+	entry.oldHash = hex.EncodeToString(records[:ObjectShaLength])
+	entry.newHash = hex.EncodeToString(records[ObjectShaLength : 2*ObjectShaLength])
+	records = records[2*ObjectShaLength:]
+	text := func() (string, bool) {
+		length, n := reftableVarint(records)
+		if n == 0 || length > uint64(len(records)-n) {
+			return "", false
+		}
+		value := string(records[n : n+int(length)])
+		records = records[n+int(length):]
+		return value, true
+	}
+	name, ok := text()
+	email, ok2 := text()
+	seconds, n := reftableVarint(records)
+	if !ok || !ok2 || n == 0 || len(records) < n+2 {
+		return nil, false
+	}
+	// the offset is the "+hhmm" of git dates read as a number
+	offset := int(int16(binary.BigEndian.Uint16(records[n:])))
+	records = records[n+2:]
+	message, ok := text()
+	if !ok {
+		return nil, false
+	}
+	minutes := offset/100*60 + offset%100
+	zone := time.FixedZone("", minutes*60)
+	entry.committer = identity{name: name, email: email, when: time.Unix(int64(seconds), 0).In(zone)}
+	entry.message = strings.TrimSuffix(message, "\n")
+	table.logs = append(table.logs, entry)
+	return records, true
+}
+
+// reftableRefs merges the refs of the stack, deletions taken out
+func (repo *Repository) reftableRefs() map[string]reftableRef {
+	refs := make(map[string]reftableRef)
+	_, tables := repo.readReftableStack()
+	for _, table := range tables {
+		for _, ref := range table.refs {
+			refs[ref.name] = ref
+		}
+	}
+	for name, ref := range refs {
+		if ref.value == "" {
+			delete(refs, name)
+		}
+	}
+	return refs
+}
+
+// reftableLogs merges the log records of the stack into the reflog of each
+// ref, oldest entry first
+func (repo *Repository) reftableLogs(tables []*reftable) map[string][]reftableLog {
+	type logKey struct {
+		name        string
+		updateIndex uint64
+	}
+	merged := make(map[logKey]reftableLog)
+	for _, table := range tables {
+		for _, entry := range table.logs {
+			merged[logKey{entry.name, entry.updateIndex}] = entry
+		}
+	}
+	logs := make(map[string][]reftableLog)
+	for _, entry := range merged {
+		if !entry.deleted {
+			logs[entry.name] = append(logs[entry.name], entry)
+		}
+	}
+	for _, entries := range logs {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].updateIndex < entries[j].updateIndex })
+	}
+	return logs
+}
+
+func (repo *Repository) readReftableRef(name string) (string, bool) {
+	ref, ok := repo.reftableRefs()[name]
+	return ref.value, ok
+}
+
+func (repo *Repository) readReftableLog(ref string) []reflogEntry {
+	_, tables := repo.readReftableStack()
+	logs := repo.reftableLogs(tables)[ref]
+	entries := make([]reflogEntry, 0, len(logs))
+	for _, entry := range logs {
+		entries = append(entries, reflogEntry{
+			oldHash:     entry.oldHash,
+			newHash:     entry.newHash,
+			committer:   entry.committer,
+			message:     entry.message,
+			line:        fmt.Sprintf("%s %s %s\t%s", entry.oldHash, entry.newHash, entry.committer, entry.message),
+			updateIndex: entry.updateIndex,
+		})
+	}
+	return entries
+}
+
+// reftableWriter lays out the blocks of a table
+type reftableWriter struct {
+	data        bytes.Buffer
+	blockStart  int
+	block       bytes.Buffer // the records of the block being written
+	restarts    []int
+	recordCount int
+	lastKey     []byte
+	blockType   byte
+	padding     int // written only if another block follows
+}
+
+func (writer *reftableWriter) headerLength() int {
+	if writer.blockStart == 0 {
+		return reftableHeaderSize
+	}
+	return 0
+}
+
+// blockLength is how long the block would be with its restart offsets
+func (writer *reftableWriter) blockLength(extra int, restarts int) int {
+	return writer.headerLength() + 4 + writer.block.Len() + extra + 3*restarts + 2
+}
+
+// add appends a record with a key and what follows its key, starting a
+// new block when it does not fit
+func (writer *reftableWriter) add(blockType byte, key []byte, valueType int, value []byte) {
+	if writer.blockType != blockType {
+		writer.flush()
+		writer.blockType = blockType
+	}
+	for attempt := 0; ; attempt++ {
+		restart := writer.recordCount%reftableRestartInterval == 0
+		prefix := 0
+		if !restart {
+			for prefix < len(key) && prefix < len(writer.lastKey) && key[prefix] == writer.lastKey[prefix] {
+				prefix++
+			}
+		}
+		var record bytes.Buffer
+		record.Write(encodeOfsDeltaOffset(int64(prefix)))
+		record.Write(encodeOfsDeltaOffset(int64((len(key)-prefix)<<3 | valueType)))
+		record.Write(key[prefix:])
+		record.Write(value)
+		restarts := len(writer.restarts)
+		if restart {
+			restarts++
+		}
+		if writer.recordCount > 0 && writer.blockLength(record.Len(), restarts) > reftableBlockSize && attempt == 0 {
+			writer.flush()
+			writer.blockType = blockType
+			continue
+		}
+		if restart {
+			writer.restarts = append(writer.restarts, writer.headerLength()+4+writer.block.Len())
+		}
+		writer.block.Write(record.Bytes())
+		writer.recordCount++
+		writer.lastKey = append(writer.lastKey[:0], key...)
+		return
+	}
+}
+
+// flush writes out the block being written: ref blocks padded to the
+// block size, log blocks deflated
+func (writer *reftableWriter) flush() {
+	if writer.recordCount == 0 {
+		return
+	}
+	var block bytes.Buffer
+	block.Write(writer.block.Bytes())
+	for _, restart := range writer.restarts {
+		block.Write([]byte{byte(restart >> 16), byte(restart >> 8), byte(restart)})
+	}
+	binary.Write(&block, binary.BigEndian, uint16(len(writer.restarts)))
+	length := writer.headerLength() + 4 + block.Len()
+	writer.data.Write(make([]byte, writer.padding))
+	writer.data.Write([]byte{writer.blockType, byte(length >> 16), byte(length >> 8), byte(length)})
+	writer.padding = 0
+	if writer.blockType == 'g' {
+		deflater := zlib.NewWriter(&writer.data)
+		deflater.Write(block.Bytes())
+		deflater.Close()
+	} else {
+		writer.data.Write(block.Bytes())
+		writer.padding = reftableBlockSize - (writer.data.Len() - writer.blockStart)
+	}
+	writer.blockStart = writer.data.Len() + writer.padding
+	writer.block.Reset()
+	writer.restarts = writer.restarts[:0]
+	writer.recordCount = 0
+	writer.lastKey = writer.lastKey[:0]
+}
+
+// encodeReftable writes a table of version 1, for sha1 object ids, with
+// its refs and logs sorted and without the optional object and index
+// sections
+func encodeReftable(table *reftable) []byte {
+	writer := &reftableWriter{}
+	var header [reftableHeaderSize]byte
+	copy(header[:], "REFT")
+	header[4] = 1
+	header[5], header[6], header[7] = reftableBlockSize>>16, reftableBlockSize>>8&0xff, reftableBlockSize&0xff
+	binary.BigEndian.PutUint64(header[8:], table.minUpdateIndex)
+	binary.BigEndian.PutUint64(header[16:], table.maxUpdateIndex)
+	writer.data.Write(header[:])
+
+	sort.Slice(table.refs, func(i, j int) bool { return table.refs[i].name < table.refs[j].name })
+	for _, ref := range table.refs {
+		value := encodeOfsDeltaOffset(int64(ref.updateIndex - table.minUpdateIndex))
+		valueType := reftableDeletion
+		switch {
+		case strings.HasPrefix(ref.value, symbolicRefPrefix):
+			valueType = reftableSymref
+			target := strings.TrimPrefix(ref.value, symbolicRefPrefix)
+			value = append(append(value, encodeOfsDeltaOffset(int64(len(target)))...), target...)
+		case ref.value != "":
+			valueType = reftableValue
+			id, _ := hex.DecodeString(ref.value)
+			value = append(value, id...)
+			if ref.peeled != "" {
+				valueType = reftablePeeled
+				peeled, _ := hex.DecodeString(ref.peeled)
+				value = append(value, peeled...)
+			}
+		}
+		writer.add('r', []byte(ref.name), valueType, value)
+	}
+	writer.flush()
+
+	logPosition := 0
+	sort.Slice(table.logs, func(i, j int) bool {
+		if table.logs[i].name != table.logs[j].name {
+			return table.logs[i].name < table.logs[j].name
+		}
+		return table.logs[i].updateIndex > table.logs[j].updateIndex
+	})
+	for i, entry := range table.logs {
+		if i == 0 {
+			// 0 when the logs start in the first block
+			logPosition = writer.blockStart
+		}
+		key := append([]byte(entry.name), 0)
+		key = binary.BigEndian.AppendUint64(key, ^entry.updateIndex)
+		if entry.deleted {
+			writer.add('g', key, reftableDeletion, nil)
+			continue
+		}
+		var value bytes.Buffer
+		oldID, _ := hex.DecodeString(entry.oldHash)
+		newID, _ := hex.DecodeString(entry.newHash)
+		value.Write(oldID)
+		value.Write(newID)
+		for _, text := range []string{entry.committer.name, entry.committer.email} {
+			value.Write(encodeOfsDeltaOffset(int64(len(text))))
+			value.WriteString(text)
+		}
+		value.Write(encodeOfsDeltaOffset(entry.committer.when.Unix()))
+		offset, _ := strconv.Atoi(entry.committer.when.Format("-0700"))
+		binary.Write(&value, binary.BigEndian, int16(offset))
+		message := entry.message + "\n"
+		value.Write(encodeOfsDeltaOffset(int64(len(message))))
+		value.WriteString(message)
+		writer.add('g', key, reftableValue, value.Bytes())
+	}
+	writer.flush()
+
+	var footer bytes.Buffer
+	footer.Write(header[:])
+	binary.Write(&footer, binary.BigEndian, [5]uint64{0, 0, 0, uint64(logPosition), 0})
+	binary.Write(&footer, binary.BigEndian, crc32.ChecksumIEEE(footer.Bytes()))
+	writer.data.Write(footer.Bytes())
+	return writer.data.Bytes()
+}
+
+// updateReftable adds a table to the stack under the lock of tables.list,
+// with the refs and logs change returns given the update index they get.
+// With compact, or once the stack grows too high, all the tables are
+// merged into one instead, without the deletions, change then getting the
+// merged refs and logs to edit.
+func (repo *Repository) updateReftable(compact bool, change func(updateIndex uint64, merged *reftable) *reftable) {
+	dir := repo.reftableDir()
+	lock := acquireLock(filepath.Join(dir, "tables.list"))
+	names, tables := repo.readReftableStack()
+	updateIndex := uint64(1)
+	if len(tables) > 0 {
+		updateIndex = tables[len(tables)-1].maxUpdateIndex + 1
+	}
+	compact = compact || len(tables)+1 >= reftableMaxTables
+	var table *reftable
+	if compact {
+		merged := &reftable{minUpdateIndex: 1, maxUpdateIndex: updateIndex}
+		if len(tables) > 0 {
+			merged.minUpdateIndex = tables[0].minUpdateIndex
+		}
+		for _, ref := range repo.reftableRefs() {
+			merged.refs = append(merged.refs, ref)
+		}
+		for _, entries := range repo.reftableLogs(tables) {
+			merged.logs = append(merged.logs, entries...)
+		}
+		table = change(updateIndex, merged)
+		// what change added over the merged tables replaces them
+		byName := make(map[string]reftableRef, len(table.refs))
+		for _, ref := range table.refs {
+			byName[ref.name] = ref
+		}
+		table.refs = table.refs[:0]
+		for _, ref := range byName {
+			if ref.value != "" {
+				table.refs = append(table.refs, ref)
+			}
+		}
+		kept := table.logs[:0]
+		for _, entry := range table.logs {
+			if !entry.deleted {
+				kept = append(kept, entry)
+			}
+		}
+		table.logs = kept
+	} else {
+		table = change(updateIndex, &reftable{minUpdateIndex: updateIndex, maxUpdateIndex: updateIndex})
+	}
+	name := fmt.Sprintf("0x%012x-0x%012x-%08x.ref", table.minUpdateIndex, table.maxUpdateIndex, rand.Uint32())
+	if err := os.WriteFile(filepath.Join(dir, name), encodeReftable(table), 0666); err != nil {
+		lock.fail(err)
+	}
+	list := append(names, name)
+	if compact {
+		list = []string{name}
+	}
+	if _, err := lock.Write([]byte(strings.Join(list, "\n") + "\n")); err != nil {
+		lock.fail(err)
+	}
+	lock.commit()
+	if compact {
+		for _, old := range names {
+			os.Remove(filepath.Join(dir, old))
+		}
+	}
+}
+
+// writeReftableRef records a ref update, the value "" deleting it
+func (repo *Repository) writeReftableRef(name string, value string) {
+	repo.updateReftable(false, func(updateIndex uint64, table *reftable) *reftable {
+		ref := reftableRef{name: name, updateIndex: updateIndex, value: value}
+		if isFullHash(value) && repo.hasObject(value) {
+			if peeled, ok := repo.peelTags(value); ok {
+				ref.peeled = peeled
+			}
+		}
+		table.refs = append(table.refs, ref)
+		return table
+	})
+}
+
+// appendReftableLog adds a reflog entry of ref
+func (repo *Repository) appendReftableLog(ref string, entry reflogEntry) {
+	repo.updateReftable(false, func(updateIndex uint64, table *reftable) *reftable {
+		table.logs = append(table.logs, reftableLog{
+			name:        ref,
+			updateIndex: updateIndex,
+			oldHash:     entry.oldHash,
+			newHash:     entry.newHash,
+			committer:   entry.committer,
+			message:     entry.message,
+		})
+		return table
+	})
+}
+
+// writeReftableLog replaces the reflog of ref with entries, compacting the
+// stack; entries read from it keep their update index, new ones get the
+// next
+func (repo *Repository) writeReftableLog(ref string, entries []reflogEntry) {
+	repo.updateReftable(true, func(updateIndex uint64, table *reftable) *reftable {
+		logs := table.logs[:0]
+		for _, entry := range table.logs {
+			if entry.name != ref {
+				logs = append(logs, entry)
+			}
+		}
+		for _, entry := range entries {
+			index := entry.updateIndex
+			if index == 0 {
+				index = updateIndex
+			}
+			logs = append(logs, reftableLog{
+				name:        ref,
+				updateIndex: index,
+				oldHash:     entry.oldHash,
+				newHash:     entry.newHash,
+				committer:   entry.committer,
+				message:     entry.message,
+			})
+		}
+		table.logs = logs
+		return table
+	})
+}
+
+// compactReftables merges the stack into a single table, what pack-refs
+// does for the reftable backend
+func (repo *Repository) compactReftables() {
+	repo.updateReftable(true, func(updateIndex uint64, table *reftable) *reftable {
+		return table
+	})
+}
+
+// listReftableLogs returns the refs with a reflog, sorted with HEAD last
+func (repo *Repository) listReftableLogs() []string {
+	refs := make([]string, 0)
+	hasHead := false
+	_, tables := repo.readReftableStack()
+	for name := range repo.reftableLogs(tables) {
+		if name == "HEAD" {
+			hasHead = true
+		} else {
+			refs = append(refs, name)
+		}
+	}
+	sort.Strings(refs)
+	if hasHead {
+		refs = append(refs, "HEAD")
+	}
+	return refs
+}
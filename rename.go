@@ -0,0 +1,248 @@
+package main
+
+import (
+	"path"
+	"sort"
+)
+
+// maxRenameScore is the similarity of identical files; like git, scores
+// are kept in these units and shown in percent
+const maxRenameScore = 60000
+
+// defaultRenameScore is the similarity a rename needs without a value to
+// -M, 50%
+const defaultRenameScore = maxRenameScore / 2
+
+// parseRenameScore reads the value of -M and --find-renames: a percentage
+// such as "90%", or the digits of a fraction with or without its "0." so
+// that "9" and "0.9" are 90% too
+func parseRenameScore(text string) (int, bool) {
+	number, scale, dot := 0, 1, false
+	i := 0
+	for ; i < len(text); i++ {
+		c := text[i]
+		if !dot && c == '.' {
+			scale, dot = 1, true
+		} else if c == '%' {
+			if dot {
+				scale *= 100
+			} else {
+				scale = 100
+			}
+			i++
+			break
+		} else if c >= '0' && c <= '9' {
+			if scale < 100000 {
+				scale *= 10
+				number = number*10 + int(c-'0')
+			}
+		} else {
+			break
+		}
+	}
+	if i != len(text) {
+		return 0, false
+	}
+	if number >= scale {
+		return maxRenameScore, true
+	}
+	return maxRenameScore * number / scale, true
+}
+
+// similarityChunks counts the bytes of content by the hashes of its chunks,
+// lines cut after 64 bytes, the way git estimates what two files share.
+// In text CRs ending lines do not count.
+func similarityChunks(content []byte, text bool) map[uint32]int {
+	const hashBase = 107927
+	chunks := make(map[uint32]int)
+	var accumulated1, accumulated2 uint32
+	length := 0
+	for i, c := range content {
+		if text && c == '\r' && i+1 < len(content) && content[i+1] == '\n' {
+			continue
+		}
+		old1 := accumulated1
+		accumulated1 = (accumulated1 << 7) ^ (accumulated2 >> 25)
+		accumulated2 = (accumulated2 << 7) ^ (old1 >> 25)
+		accumulated1 += uint32(c)
+		length++
+		if length < 64 && c != '\n' {
+			continue
+		}
+		chunks[(accumulated1+accumulated2*0x61)%hashBase] += length
+		accumulated1, accumulated2, length = 0, 0, 0
+	}
+	if length > 0 {
+		chunks[(accumulated1+accumulated2*0x61)%hashBase] += length
+	}
+	return chunks
+}
+
+// similarityScore estimates how much of the new content was kept from the
+// old one, in maxRenameScore units; 0 when the sizes alone tell that it
+// cannot reach minimumScore
+func similarityScore(oldContent []byte, newContent []byte, text bool, minimumScore int) int {
+	maxSize, baseSize := len(oldContent), len(newContent)
+	if baseSize > maxSize {
+		maxSize, baseSize = baseSize, maxSize
+	}
+	if maxSize == 0 || maxSize*(maxRenameScore-minimumScore) < (maxSize-baseSize)*maxRenameScore {
+		return 0
+	}
+	oldChunks, newChunks := similarityChunks(oldContent, text), similarityChunks(newContent, text)
+	copied := 0
+	for hash, oldCount := range oldChunks {
+		newCount := newChunks[hash]
+		if newCount < oldCount {
+			copied += newCount
+		} else {
+			copied += oldCount
+		}
+	}
+	return copied * maxRenameScore / maxSize
+}
+
+// isRegularFileMode tells whether a mode is that of a file, executable or
+// not, rather than a symlink or gitlink
+func isRegularFileMode(mode uint32) bool {
+	return mode&0170000 == 0100000
+}
+
+// detectRenames turns the deletion of a file and the addition of another
+// into a rename of the one to the other, as git does for diff.renames:
+// files with the same content first, preferring those keeping their base
+// name, then files at least minimumScore similar, the most similar first.
+// The changes stay in the order of their new paths.
+func (repo *Repository) detectRenames(changes []fileChange, minimumScore int) []fileChange {
+	deleted, added := make([]int, 0), make([]int, 0)
+	for i, change := range changes {
+		switch change.status() {
+		case 'D':
+			deleted = append(deleted, i)
+		case 'A':
+			added = append(added, i)
+		}
+	}
+	if len(deleted) == 0 || len(added) == 0 {
+		return changes
+	}
+	renamedFrom := make(map[int]int) // added change to deleted change
+	used := make(map[int]bool)
+	sameName := func(source int, destination int) bool {
+		return path.Base(changes[source].path) == path.Base(changes[destination].path)
+	}
+	for _, destination := range added {
+		best := -1
+		for _, source := range deleted {
+			if used[source] || changes[source].oldHash != changes[destination].newHash || changes[source].oldMode&0170000 != changes[destination].newMode&0170000 || changes[source].oldMode == fileModeGitlink {
+				continue
+			}
+			if best == -1 || !sameName(best, destination) && sameName(source, destination) {
+				best = source
+			}
+		}
+		if best != -1 {
+			renamedFrom[destination] = best
+			used[best] = true
+		}
+	}
+
+	type candidate struct {
+		source, destination, score int
+		sameName                   bool
+	}
+	candidates := make([]candidate, 0)
+	contents := make(map[int][]byte)
+	content := func(i int, hash string) []byte {
+		if _, ok := contents[i]; !ok {
+			contents[i] = repo.blobContent(hash)
+		}
+		return contents[i]
+	}
+	for _, destination := range added {
+		if _, ok := renamedFrom[destination]; ok || !isRegularFileMode(changes[destination].newMode) {
+			continue
+		}
+		for _, source := range deleted {
+			if used[source] || !isRegularFileMode(changes[source].oldMode) {
+				continue
+			}
+			oldContent, newContent := content(source, changes[source].oldHash), content(destination, changes[destination].newHash)
+			text := !repo.isBinaryDiff(changes[source].path, oldContent) && !repo.isBinaryDiff(changes[destination].path, newContent)
+			if score := similarityScore(oldContent, newContent, text, minimumScore); score >= minimumScore {
+				candidates = append(candidates, candidate{source, destination, score, sameName(source, destination)})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].sameName && !candidates[j].sameName
+	})
+	scores := make(map[int]int)
+	for _, candidate := range candidates {
+		if _, ok := renamedFrom[candidate.destination]; ok || used[candidate.source] {
+			continue
+		}
+		renamedFrom[candidate.destination] = candidate.source
+		scores[candidate.destination] = candidate.score
+		used[candidate.source] = true
+	}
+
+	detected := make([]fileChange, 0, len(changes))
+	for i, change := range changes {
+		if used[i] {
+			continue
+		}
+		if source, ok := renamedFrom[i]; ok {
+			score, ok := scores[i]
+			if !ok {
+				score = maxRenameScore
+			}
+			change.oldPath, change.oldMode, change.oldHash = changes[source].path, changes[source].oldMode, changes[source].oldHash
+			change.similarity = score * 100 / maxRenameScore
+		}
+		detected = append(detected, change)
+	}
+	return detected
+}
+
+// renameDisplayName shortens "<old> => <new>" for --stat to the parts that
+// differ, with the directories both share around them, as in
+// "src/{a.c => b.c}"
+func renameDisplayName(oldPath string, newPath string) string {
+	at := func(s string, i int) byte {
+		if i == len(s) {
+			return 0
+		}
+		return s[i]
+	}
+	prefixLength := 0
+	for i := 0; i < len(oldPath) && i < len(newPath) && oldPath[i] == newPath[i]; i++ {
+		if oldPath[i] == '/' {
+			prefixLength = i + 1
+		}
+	}
+	// a shared prefix ends in a slash the suffix may start with too
+	adjust := 0
+	if prefixLength > 0 {
+		adjust = 1
+	}
+	suffixLength := 0
+	for i, j := len(oldPath), len(newPath); prefixLength-adjust <= i && prefixLength-adjust <= j && at(oldPath, i) == at(newPath, j); i, j = i-1, j-1 {
+		if at(oldPath, i) == '/' {
+			suffixLength = len(oldPath) - i
+		}
+	}
+	if prefixLength+suffixLength == 0 {
+		return oldPath + " => " + newPath
+	}
+	middle := func(s string) string {
+		if len(s)-prefixLength-suffixLength < 0 {
+			return ""
+		}
+		return s[prefixLength : len(s)-suffixLength]
+	}
+	return oldPath[:prefixLength] + "{" + middle(oldPath) + " => " + middle(newPath) + "}" + oldPath[len(oldPath)-suffixLength:]
+}
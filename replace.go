@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const replaceRefPrefix = "refs/replace/"
+
+// replacementsEnabled is false with --no-replace-objects, which sets
+// GIT_NO_REPLACE_OBJECTS for child processes as git does, or with
+// core.useReplaceRefs set to false
+func (repo *Repository) replacementsEnabled() bool {
+	if _, set := os.LookupEnv("GIT_NO_REPLACE_OBJECTS"); set {
+		return false
+	}
+	return repo.config.getBool("core.useReplaceRefs", true)
+}
+
+func (repo *Repository) loadReplacements() {
+	if !repo.replacementsEnabled() {
+		return
+	}
+	refs := repo.listRefs(replaceRefPrefix)
+	if len(refs) == 0 {
+		return
+	}
+	repo.replacements = make(map[string]string)
+	for _, ref := range refs {
+		original := strings.TrimPrefix(ref, replaceRefPrefix)
+		if replacement, ok := repo.resolveRef(ref); ok && isFullHash(original) {
+			repo.replacements[original] = replacement
+		}
+	}
+}
+
+// replacementFor returns the object standing in for hash, following
+// replacements of replacements
+func (repo *Repository) replacementFor(hash string) string {
+	repo.replaceOnce.Do(repo.loadReplacements)
+	for depth := 0; repo.replacements != nil; depth++ {
+		replacement, ok := repo.replacements[hash]
+		if !ok {
+			break
+		}
+		if depth == 5 {
+			log.Fatalf("fatal: replace depth too high for object %s", hash)
+		}
+		hash = replacement
+	}
+	return hash
+}
+
+// replaceObject makes replacement stand in for original; both must have
+// the same type
+func (repo *Repository) replaceObject(original string, replacement string, force bool) {
+	ref := replaceRefPrefix + original
+	if _, exists := repo.resolveRef(ref); exists && !force {
+		log.Fatalf("error: replace ref '%s' already exists", ref)
+	}
+	if original == replacement {
+		log.Fatalf("error: new object is the same as the old one: '%s'", original)
+	}
+	originalHeader, _ := repo.readOriginalObject(original)
+	replacementHeader, _ := repo.readOriginalObject(replacement)
+	if originalHeader.objectType != replacementHeader.objectType && !force {
+		log.Fatalf("error: Objects must be of the same type.\n'%s' points to a replaced object of type '%s'\nwhile '%s' points to a replacement object of type '%s'.",
+			original, originalHeader.objectType, replacement, replacementHeader.objectType)
+	}
+	repo.updateRef(ref, replacement)
+}
+
+func (repo *Repository) deleteReplacement(original string) {
+	ref := replaceRefPrefix + original
+	if _, exists := repo.resolveRef(ref); !exists {
+		log.Fatalf("error: replace ref '%s' not found", original)
+	}
+	repo.deleteRef(ref)
+	fmt.Printf("Deleted replace ref '%s'\n", original)
+}
+
+// listReplacements prints the replaced objects matching a glob pattern
+func (repo *Repository) listReplacements(pattern string) {
+	for _, ref := range repo.listRefs(replaceRefPrefix) {
+		original := strings.TrimPrefix(ref, replaceRefPrefix)
+		if pattern == "" || wildmatch(pattern, original, false) {
+			fmt.Println(original)
+		}
+	}
+}
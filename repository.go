@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type RepositoryOptions struct {
+	// ObjectCacheLimit is the memory budget in bytes for inflated objects,
+	// zero falls back to core.objectCacheLimit and then the default
+	ObjectCacheLimit int64
+	// DeltaBaseCacheLimit is the per-pack memory budget in bytes for
+	// materialized delta bases, zero falls back to core.deltaBaseCacheLimit
+	DeltaBaseCacheLimit int64
+	// WorkTree overrides the default worktree, core.worktree or else the
+	// parent of the git dir
+	WorkTree string
+}
+
+// Repository is safe for concurrent use by several goroutines: what it
+// loads lazily is loaded once under a lock, the caches lock themselves,
+// packs dropped by a repack stay open until their readers are done,
+// and the files it updates (the index, refs, packed-refs, reftables and
+// the config) are replaced through lock files that goroutines wait for in
+// turn. Read-modify-write updates of the index go through lockIndex.
+type Repository struct {
+	gitDir              string
+	workTree            string
+	prefix              string // current directory relative to the worktree, "" at the root
+	config              gitConfig
+	objectCache         *objectCache
+	deltaBaseCacheLimit int64
+	alternatesOnce      sync.Once
+	objectDirs          []string // own object directory first, then the alternates
+	packsLock           sync.Mutex
+	packs               []*packFile // loaded on first packed lookup, nil until then
+	replaceOnce         sync.Once
+	replacements        map[string]string // refs/replace/<original> targets, nil when disabled
+	attributesOnce      sync.Once
+	attributeMatcher    *attributeMatcher // loaded on first attribute lookup
+	commitGraphOnce     sync.Once
+	commitGraph         *commitGraph // generation numbers, loaded on first use
+}
+
+func OpenRepository(gitDir string, options RepositoryOptions) *Repository {
+	config := loadConfig(gitDir)
+	cacheLimit := options.ObjectCacheLimit
+	if cacheLimit == 0 {
+		cacheLimit = config.getInt("core.objectCacheLimit", DefaultObjectCacheLimit)
+	}
+	deltaBaseCacheLimit := options.DeltaBaseCacheLimit
+	if deltaBaseCacheLimit == 0 {
+		deltaBaseCacheLimit = config.getInt("core.deltaBaseCacheLimit", DefaultDeltaBaseCacheLimit)
+	}
+	workTree := options.WorkTree
+	if configured, ok := config.get("core.worktree"); ok && workTree == "" {
+		// submodules keep their git dir in the superproject and set this
+		workTree = configured
+		if !filepath.IsAbs(workTree) {
+			workTree = filepath.Join(gitDir, workTree)
+		}
+	}
+	if workTree == "" {
+		workTree = filepath.Dir(gitDir)
+	}
+	return &Repository{
+		gitDir:              gitDir,
+		workTree:            workTree,
+		config:              config,
+		objectCache:         newObjectCache(cacheLimit),
+		deltaBaseCacheLimit: deltaBaseCacheLimit,
+	}
+}
+
+// discoverGitDir looks for a repository in start and its parents: either a
+// ".git" directory or file next to the worktree, or a bare repository
+func discoverGitDir(start string) (string, bool) {
+	dir := start
+	for {
+		if gitDir, ok := dotGitDir(dir); ok {
+			return gitDir, true
+		}
+		if isGitDir(dir) {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// dotGitDir returns the git dir of the worktree at dir from its ".git"
+// directory or file
+func dotGitDir(dir string) (string, bool) {
+	dotGit := filepath.Join(dir, ".git")
+	info, err := os.Stat(dotGit)
+	if err != nil {
+		return "", false
+	}
+	if info.IsDir() {
+		return dotGit, true
+	}
+	// "gitdir: <path>" files are used by linked worktrees and submodules
+	if content, err := ioutil.ReadFile(dotGit); err == nil && strings.HasPrefix(string(content), "gitdir: ") {
+		target := strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir: "))
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+		return target, true
+	}
+	return "", false
+}
+
+func isGitDir(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// openRepositoryFromEnvironment finds the repository for the current
+// directory, honoring an explicit git dir and GIT_WORK_TREE, and moves to
+// the worktree root so paths can be handled relative to it
+func openRepositoryFromEnvironment(gitDir string) *Repository {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var options RepositoryOptions
+	if gitDir == "" {
+		var ok bool
+		gitDir, ok = discoverGitDir(cwd)
+		if !ok {
+			log.Fatal("fatal: not a git repository (or any of the parent directories): .git")
+		}
+	} else {
+		// an explicit git dir makes the current directory the worktree
+		options.WorkTree = cwd
+	}
+	if workTree := os.Getenv("GIT_WORK_TREE"); workTree != "" {
+		options.WorkTree = workTree
+	}
+	gitDir, err = filepath.Abs(gitDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !isGitDir(gitDir) {
+		log.Fatalf("fatal: not a git repository: '%s'", gitDir)
+	}
+	repo := OpenRepository(gitDir, options)
+	workTree, err := filepath.Abs(repo.workTree)
+	if err != nil {
+		log.Fatal(err)
+	}
+	repo.workTree = workTree
+	if prefix, err := filepath.Rel(workTree, cwd); err == nil && prefix != "." && !strings.HasPrefix(prefix, "..") {
+		repo.prefix = filepath.ToSlash(prefix)
+	}
+	if err := os.Chdir(workTree); err != nil {
+		log.Fatal(err)
+	}
+	return repo
+}
+
+// pathspecsFromPrefix makes command line paths, given relative to the
+// current directory, relative to the worktree root
+func (repo *Repository) pathspecsFromPrefix(pathspecs []string) []string {
+	cwd := filepath.Join(repo.workTree, filepath.FromSlash(repo.prefix))
+	resolved := make([]string, len(pathspecs))
+	for i, pathspec := range pathspecs {
+		absolute := pathspec
+		if !filepath.IsAbs(absolute) {
+			absolute = filepath.Join(cwd, pathspec)
+		}
+		relative, err := filepath.Rel(repo.workTree, absolute)
+		if err != nil || strings.HasPrefix(relative, "..") {
+			log.Fatalf("fatal: %s: '%s' is outside repository at '%s'", pathspec, pathspec, repo.workTree)
+		}
+		resolved[i] = filepath.ToSlash(relative)
+	}
+	return resolved
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestRepository makes an empty repository with its worktree in a
+// temporary directory
+func newTestRepository(t *testing.T, options RepositoryOptions) *Repository {
+	t.Helper()
+	for _, variable := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(variable, "A U Thor")
+	}
+	for _, variable := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(variable, "author@example.com")
+	}
+	gitDir := filepath.Join(t.TempDir(), ".git")
+	for _, dir := range []string{"objects/pack", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(filepath.Join(gitDir, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(gitDir, "HEAD"), []byte("ref: refs/heads/main\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// commands run from the top of the worktree
+	t.Chdir(filepath.Dir(gitDir))
+	return OpenRepository(gitDir, options)
+}
+
+// writeWorktreeFile writes a file of the worktree, making its directories
+func writeWorktreeFile(t *testing.T, repo *Repository, relativePath string, content string) {
+	t.Helper()
+	filePath := repo.worktreePath(relativePath)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commitWorktreeFile writes a file, adds it and commits it as commit does
+func commitWorktreeFile(t *testing.T, repo *Repository, relativePath string, content string, message string) string {
+	t.Helper()
+	writeWorktreeFile(t, repo, relativePath, content)
+	repo.addPaths(repo.parsePathspecs([]string{relativePath}), 1, addOptions{})
+	repo.commitIndex(commitOptions{messages: []string{message}, quiet: true})
+	head, _ := repo.resolveRef("HEAD")
+	return head
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// rerere remembers how conflicts were resolved. A conflict is identified
+// by hashing its hunks with the two sides in a canonical order, so the
+// same conflict is recognized whichever side is "ours". The normalized
+// conflicted file is stored as rr-cache/<id>/preimage and the resolved
+// file as postimage; MERGE_RR lists the conflicts of the merge in progress.
+
+func (repo *Repository) rerereEnabled() bool {
+	if value, ok := repo.config.get("rerere.enabled"); ok {
+		return repo.config.getBool("rerere.enabled", false) || value == ""
+	}
+	// like git, an existing rr-cache directory enables it
+	_, err := os.Stat(filepath.Join(repo.gitDir, "rr-cache"))
+	return err == nil
+}
+
+// normalizeConflicts rewrites the conflict hunks of content without labels
+// and with sorted sides, returning the normalized text, the conflict id
+// and whether there was any conflict at all
+func normalizeConflicts(content []byte) ([]byte, string, bool) {
+	const (
+		outside = iota
+		inOurs
+		inBase
+		inTheirs
+	)
+	var normalized bytes.Buffer
+	var ours, theirs bytes.Buffer
+	hash := sha1.New()
+	state := outside
+	conflicts := 0
+	isMarker := func(line []byte, marker byte) bool {
+		if len(line) < 7 || !bytes.Equal(line[:7], bytes.Repeat([]byte{marker}, 7)) {
+			return false
+		}
+		return len(line) == 7 || line[7] == ' ' || line[7] == '\n' || line[7] == '\r'
+	}
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		switch {
+		case state == outside && isMarker(line, '<'):
+			state = inOurs
+			ours.Reset()
+			theirs.Reset()
+		case state == inOurs && isMarker(line, '|'):
+			state = inBase
+		case (state == inOurs || state == inBase) && isMarker(line, '='):
+			state = inTheirs
+		case state == inTheirs && isMarker(line, '>'):
+			one, two := ours.Bytes(), theirs.Bytes()
+			if bytes.Compare(one, two) > 0 {
+				one, two = two, one
+			}
+			normalized.WriteString("<<<<<<<\n")
+			normalized.Write(one)
+			normalized.WriteString("=======\n")
+			normalized.Write(two)
+			normalized.WriteString(">>>>>>>\n")
+			// both sides are hashed with their terminating NUL
+			hash.Write(one)
+			hash.Write([]byte{0})
+			hash.Write(two)
+			hash.Write([]byte{0})
+			conflicts++
+			state = outside
+		case state == inOurs:
+			ours.Write(line)
+		case state == inTheirs:
+			theirs.Write(line)
+		case state == outside:
+			normalized.Write(line)
+		}
+	}
+	if state != outside || conflicts == 0 {
+		return nil, "", false
+	}
+	return normalized.Bytes(), hex.EncodeToString(hash.Sum(nil)), true
+}
+
+type rerereEntry struct {
+	id   string
+	path string
+}
+
+func (repo *Repository) readMergeRR() []rerereEntry {
+	// format: <id>\t<path>\0 per conflict
+	content, err := ioutil.ReadFile(filepath.Join(repo.gitDir, "MERGE_RR"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries := make([]rerereEntry, 0)
+	for _, record := range strings.Split(string(content), "\x00") {
+		if fields := strings.SplitN(record, "\t", 2); len(fields) == 2 {
+			entries = append(entries, rerereEntry{fields[0], fields[1]})
+		}
+	}
+	return entries
+}
+
+func (repo *Repository) writeMergeRR(entries []rerereEntry) {
+	path := filepath.Join(repo.gitDir, "MERGE_RR")
+	if len(entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		return
+	}
+	var content strings.Builder
+	for _, entry := range entries {
+		content.WriteString(entry.id + "\t" + entry.path + "\x00")
+	}
+	writeFileAtomically(path, []byte(content.String()))
+}
+
+func (repo *Repository) rerereImagePath(id string, image string) string {
+	return filepath.Join(repo.gitDir, "rr-cache", id, image)
+}
+
+// conflictedPaths returns the paths with unmerged index entries
+func conflictedPaths(index *gitIndex) []string {
+	paths := make([]string, 0)
+	for _, entry := range index.entries {
+		if entry.stage() != 0 && (len(paths) == 0 || paths[len(paths)-1] != entry.path) {
+			paths = append(paths, entry.path)
+		}
+	}
+	return paths
+}
+
+// rerere records the preimage of new conflicts, replays known resolutions
+// and records the resolution of conflicts that were fixed since the last
+// run. Merge and pull run it when they leave conflicts and commit when it
+// records their resolution, as git does; unless rerere is enabled it does
+// nothing.
+func (repo *Repository) rerere() {
+	if !repo.rerereEnabled() {
+		return
+	}
+	index := repo.readIndex()
+	tracked := repo.readMergeRR()
+	known := make(map[string]bool)
+	for _, entry := range tracked {
+		known[entry.path] = true
+	}
+	for _, conflictPath := range conflictedPaths(index) {
+		content, err := ioutil.ReadFile(repo.worktreePath(conflictPath))
+		if err != nil {
+			continue
+		}
+		normalized, id, ok := normalizeConflicts(content)
+		if !ok || known[conflictPath] {
+			continue
+		}
+		tracked = append(tracked, rerereEntry{id, conflictPath})
+		known[conflictPath] = true
+		postimage, err := ioutil.ReadFile(repo.rerereImagePath(id, "postimage"))
+		if err == nil {
+			// only an identical conflict can take the resolution over as is
+			preimage, _ := ioutil.ReadFile(repo.rerereImagePath(id, "preimage"))
+			if bytes.Equal(preimage, normalized) {
+				repo.writeWorktreeFile(conflictPath, postimage)
+				fmt.Fprintf(os.Stderr, "Resolved '%s' using previous resolution.\n", conflictPath)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(repo.rerereImagePath(id, "preimage")), 0777); err != nil {
+			log.Fatal(err)
+		}
+		writeFileAtomically(repo.rerereImagePath(id, "preimage"), normalized)
+		fmt.Fprintf(os.Stderr, "Recorded preimage for '%s'\n", conflictPath)
+	}
+	remaining := make([]rerereEntry, 0)
+	for _, entry := range tracked {
+		content, err := ioutil.ReadFile(repo.worktreePath(entry.path))
+		if err != nil {
+			continue
+		}
+		if _, _, conflicted := normalizeConflicts(content); conflicted {
+			remaining = append(remaining, entry)
+			continue
+		}
+		if _, err := os.Stat(repo.rerereImagePath(entry.id, "postimage")); os.IsNotExist(err) {
+			writeFileAtomically(repo.rerereImagePath(entry.id, "postimage"), content)
+			fmt.Fprintf(os.Stderr, "Recorded resolution for '%s'.\n", entry.path)
+		}
+	}
+	repo.writeMergeRR(remaining)
+}
+
+func (repo *Repository) writeWorktreeFile(relativePath string, content []byte) {
+	filePath := repo.worktreePath(relativePath)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filePath, content, info.Mode().Perm()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// rerereStatus prints the paths whose conflicts rerere is tracking
+func (repo *Repository) rerereStatus() {
+	entries := repo.readMergeRR()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	for _, entry := range entries {
+		fmt.Println(entry.path)
+	}
+}
+
+// rerereForget drops the recorded resolution of the conflicts in the
+// given paths and records their current preimage again
+func (repo *Repository) rerereForget(pathspecs []pathspec) {
+	index := repo.readIndex()
+	tracked := repo.readMergeRR()
+	for _, conflictPath := range conflictedPaths(index) {
+		if !matchesPathspecs(conflictPath, pathspecs) {
+			continue
+		}
+		content, err := ioutil.ReadFile(repo.worktreePath(conflictPath))
+		if err != nil {
+			continue
+		}
+		normalized, id, ok := normalizeConflicts(content)
+		if !ok {
+			continue
+		}
+		if err := os.Remove(repo.rerereImagePath(id, "postimage")); err == nil {
+			fmt.Fprintf(os.Stderr, "Forgot resolution for '%s'\n", conflictPath)
+		} else if !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(repo.rerereImagePath(id, "preimage")), 0777); err != nil {
+			log.Fatal(err)
+		}
+		writeFileAtomically(repo.rerereImagePath(id, "preimage"), normalized)
+		found := false
+		for _, entry := range tracked {
+			found = found || entry.path == conflictPath
+		}
+		if !found {
+			tracked = append(tracked, rerereEntry{id, conflictPath})
+		}
+	}
+	repo.writeMergeRR(tracked)
+}
+
+// rerereClear forgets the conflicts of an aborted merge, dropping the
+// preimages that never got a resolution
+func (repo *Repository) rerereClear() {
+	for _, entry := range repo.readMergeRR() {
+		if _, err := os.Stat(repo.rerereImagePath(entry.id, "postimage")); os.IsNotExist(err) {
+			if err := os.RemoveAll(filepath.Dir(repo.rerereImagePath(entry.id, "preimage"))); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	repo.writeMergeRR(nil)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// listedObject is an object rev-list --objects lists, with the path it was
+// first reached by: "" for commits and root trees, the name given for the
+// objects named on the command line and their own name for tags
+type listedObject struct {
+	hash       string
+	objectType string
+	path       string
+}
+
+// revisionWalk is what rev-list walks: the objects named, and the commits
+// whose history is left out, given as "^<commit>" or "<commit>.."
+type revisionWalk struct {
+	included []listedObject
+	excluded []string
+}
+
+// parseRevisionArgs reads the revisions of rev-list: "<rev>", "^<rev>"
+// and "<rev>..<rev>", either side of the range defaulting to HEAD
+func (repo *Repository) parseRevisionArgs(args []string) revisionWalk {
+	var walk revisionWalk
+	include := func(name string) {
+		hash := repo.resolveRevision(name)
+		header, _ := repo.readObject(hash)
+		walk.included = append(walk.included, listedObject{hash, header.objectType, name})
+	}
+	for _, arg := range args {
+		if from, to, isRange := strings.Cut(arg, ".."); isRange {
+			if from == "" {
+				from = "HEAD"
+			}
+			if to == "" {
+				to = "HEAD"
+			}
+			walk.excluded = append(walk.excluded, repo.peelToCommit(repo.resolveRevision(from)))
+			include(to)
+		} else if name, ok := strings.CutPrefix(arg, "^"); ok {
+			walk.excluded = append(walk.excluded, repo.peelToCommit(repo.resolveRevision(name)))
+		} else {
+			include(arg)
+		}
+	}
+	return walk
+}
+
+// splitRevisionArguments tells the revisions among the arguments of log
+// and diff from the paths the way git does: with "--", those before it are
+// revisions and those after it paths; without, the arguments up to the
+// first that is no revision are revisions and the rest have to be files of
+// the worktree or patterns, so that a mistyped revision is not taken for a
+// path matching nothing.
+func (repo *Repository) splitRevisionArguments(args []string) ([]string, []string) {
+	if argumentsBeforeDashDash >= 0 && argumentsBeforeDashDash <= len(args) {
+		revisions := args[:argumentsBeforeDashDash]
+		for _, revision := range revisions {
+			if !repo.isRevisionArgument(revision) {
+				log.Fatalf("fatal: bad revision '%s'", revision)
+			}
+		}
+		return revisions, args[argumentsBeforeDashDash:]
+	}
+	split := len(args)
+	for i, arg := range args {
+		if !repo.isRevisionArgument(arg) {
+			split = i
+			break
+		}
+		if repo.isWorktreePath(arg) {
+			log.Fatalf("fatal: ambiguous argument '%s': both revision and filename\n%s", arg, dashDashHint())
+		}
+	}
+	for _, arg := range args[split:] {
+		if !repo.isWorktreePath(arg) {
+			log.Fatalf("fatal: ambiguous argument '%s': unknown revision or path not in the working tree.\n%s", arg, dashDashHint())
+		}
+	}
+	return args[:split], args[split:]
+}
+
+func dashDashHint() string {
+	return fmt.Sprintf("Use '--' to separate paths from revisions, like this:\n'%s <command> [<revision>...] -- [<file>...]'", programName())
+}
+
+// isRevisionArgument tells whether an argument names revisions the way
+// parseRevisionArgs reads them
+func (repo *Repository) isRevisionArgument(arg string) bool {
+	name := strings.TrimPrefix(arg, "^")
+	if from, to, isRange := strings.Cut(name, ".."); isRange && name == arg {
+		for _, side := range []string{from, to} {
+			if _, ok := repo.lookupRevision(side); side != "" && !ok {
+				return false
+			}
+		}
+		return true
+	}
+	_, ok := repo.lookupRevision(name)
+	return ok
+}
+
+// isWorktreePath tells whether an argument is a pathspec git takes without
+// "--": a file of the worktree, or one with magic or wildcards
+func (repo *Repository) isWorktreePath(arg string) bool {
+	spec := repo.parsePathspec(arg)
+	if strings.HasPrefix(arg, ":") || spec.hasWildcards() {
+		return true
+	}
+	_, err := os.Lstat(repo.worktreePath(spec.path))
+	return err == nil
+}
+
+// listObjects lists what is reachable from the included objects but not
+// from the excluded commits the way rev-list --objects does: the commits,
+// newest first, then the tags named and the objects they point at, and
+// then the trees and blobs of the commits, each tree before its entries.
+// Paths tell which objects are versions of the same file, which is what
+// packing looks for delta bases among.
+func (repo *Repository) listObjects(walk revisionWalk, objects bool) []listedObject {
+	uninteresting := make(map[string]bool)
+	excludedCommits := newCommitIter(repo, walk.excluded, commitOrderDate, false)
+	for {
+		hash, _, ok := excludedCommits.next()
+		if !ok {
+			break
+		}
+		uninteresting[hash] = true
+	}
+	// like git, only the trees of the excluded commits named and of those
+	// at the edge of the walk are left out, not all of the history
+	edges := append([]string(nil), walk.excluded...)
+
+	listed := make([]listedObject, 0)
+	pending := make([]listedObject, 0)
+	heads := make([]string, 0, len(walk.included))
+	for _, object := range walk.included {
+		peeled := object
+		for peeled.objectType == "tag" {
+			_, content := repo.readObject(peeled.hash)
+			if objects {
+				// listed by the name the tag has for itself
+				for _, line := range strings.Split(strings.SplitN(string(content), "\n\n", 2)[0], "\n") {
+					if name, ok := strings.CutPrefix(line, "tag "); ok {
+						peeled.path = name
+					}
+				}
+				pending = append(pending, peeled)
+			}
+			peeled.hash = strings.TrimPrefix(strings.SplitN(string(content), "\n", 2)[0], "object ")
+			header, _ := repo.readObject(peeled.hash)
+			peeled.objectType = header.objectType
+		}
+		if peeled.objectType == "commit" {
+			heads = append(heads, peeled.hash)
+		} else if objects {
+			pending = append(pending, peeled)
+		}
+	}
+	follow := func(hash string, commit commitObject) []string {
+		parents := make([]string, 0, len(commit.parents))
+		for _, parent := range commit.parents {
+			if !uninteresting[parent] {
+				parents = append(parents, parent)
+			}
+		}
+		return parents
+	}
+	roots := make([]string, 0)
+	iter := newSimplifiedCommitIter(repo, heads, commitOrderDate, false, follow)
+	for {
+		hash, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		if uninteresting[hash] {
+			continue
+		}
+		listed = append(listed, listedObject{hash, "commit", ""})
+		roots = append(roots, commit.tree)
+		for _, parent := range commit.parents {
+			if uninteresting[parent] {
+				edges = append(edges, parent)
+			}
+		}
+	}
+	if !objects {
+		return listed
+	}
+	for _, edge := range edges {
+		repo.markTreeUninteresting(repo.readCommitObject(edge).tree, uninteresting)
+	}
+	for _, root := range roots {
+		pending = append(pending, listedObject{root, "tree", ""})
+	}
+	for _, object := range pending {
+		if object.objectType == "tree" {
+			listed = repo.appendTreeObjects(listed, object.hash, object.path, uninteresting)
+		} else if !uninteresting[object.hash] {
+			uninteresting[object.hash] = true
+			listed = append(listed, object)
+		}
+	}
+	return listed
+}
+
+// markTreeUninteresting marks a tree and everything below it as left out
+func (repo *Repository) markTreeUninteresting(tree string, uninteresting map[string]bool) {
+	if uninteresting[tree] {
+		return
+	}
+	uninteresting[tree] = true
+	for _, entry := range repo.readTreeEntries(tree) {
+		switch entry.mode {
+		case "40000":
+			repo.markTreeUninteresting(entry.hash, uninteresting)
+		case "160000":
+			// the commit of a submodule is not in this repository
+		default:
+			uninteresting[entry.hash] = true
+		}
+	}
+}
+
+// appendTreeObjects lists a tree at treePath and then its entries in tree
+// order, going down into subtrees as they come, leaving out what was seen
+func (repo *Repository) appendTreeObjects(listed []listedObject, tree string, treePath string, seen map[string]bool) []listedObject {
+	if seen[tree] {
+		return listed
+	}
+	seen[tree] = true
+	listed = append(listed, listedObject{tree, "tree", treePath})
+	for _, entry := range repo.readTreeEntries(tree) {
+		entryPath := entry.name
+		if treePath != "" {
+			entryPath = treePath + "/" + entry.name
+		}
+		switch entry.mode {
+		case "40000":
+			listed = repo.appendTreeObjects(listed, entry.hash, entryPath, seen)
+		case "160000":
+		default:
+			if !seen[entry.hash] {
+				seen[entry.hash] = true
+				listed = append(listed, listedObject{entry.hash, "blob", entryPath})
+			}
+		}
+	}
+	return listed
+}
+
+// packNameHash is the number git sorts objects by to find delta bases: it
+// is made of the last sixteen characters of the path that are not
+// whitespace, the last counting most, so that versions of a file come
+// together and after them files of the same kind, e.g. all the ".c" files
+func packNameHash(objectPath string) uint32 {
+	var hash uint32
+	for i := 0; i < len(objectPath); i++ {
+		c := objectPath[i]
+		switch c {
+		case ' ', '\t', '\n', '\v', '\f', '\r':
+			continue
+		}
+		hash = (hash >> 2) + uint32(c)<<24
+	}
+	return hash
+}
+
+// revList prints the commits of a walk, and with objects the trees and
+// blobs they need with their paths unless objectNames is false
+func (repo *Repository) revList(walk revisionWalk, objects bool, objectNames bool) {
+	if len(walk.included) == 0 {
+		log.Fatal("fatal: rev-list needs at least one revision")
+	}
+	for _, object := range repo.listObjects(walk, objects) {
+		if object.objectType == "commit" || !objectNames {
+			fmt.Println(object.hash)
+		} else {
+			fmt.Println(object.hash + " " + object.path)
+		}
+	}
+}
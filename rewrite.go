@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// historyRewrite says how "rewrite" changes history: which paths are kept
+// and under what name, and what becomes of messages and identities
+type historyRewrite struct {
+	removePaths  []string    // files and directories left out of every tree
+	subdirectory string      // the directory that becomes the root, "" for none
+	renames      [][2]string // path prefixes renamed, old to new
+	message      func(message string) string
+	identity     func(person identity) identity
+	keepEmpty    bool // keep commits the filters leave without changes
+}
+
+// mapPath returns the name a path has after the rewrite; ok is false when
+// the path is left out
+func (rewrite *historyRewrite) mapPath(entryPath string) (string, bool) {
+	for _, removed := range rewrite.removePaths {
+		if entryPath == removed || strings.HasPrefix(entryPath, strings.TrimSuffix(removed, "/")+"/") {
+			return "", false
+		}
+	}
+	if rewrite.subdirectory != "" {
+		prefix := strings.TrimSuffix(rewrite.subdirectory, "/") + "/"
+		if !strings.HasPrefix(entryPath, prefix) {
+			return "", false
+		}
+		entryPath = entryPath[len(prefix):]
+	}
+	for _, rename := range rewrite.renames {
+		old, new := rename[0], rename[1]
+		switch {
+		case strings.HasSuffix(old, "/") && strings.HasPrefix(entryPath, old):
+			return new + entryPath[len(old):], true
+		case entryPath == old:
+			return new, true
+		case strings.HasPrefix(entryPath, old+"/"):
+			return strings.TrimSuffix(new, "/") + entryPath[len(old):], true
+		}
+	}
+	return entryPath, true
+}
+
+// historyRewriter carries a rewrite through the commits, remembering what
+// each commit and tree became
+type historyRewriter struct {
+	repo    *Repository
+	rewrite *historyRewrite
+	commits map[string]string // old commit to new, "" for pruned roots
+	pruned  map[string]bool
+	trees   map[string]string
+}
+
+// rewriteTree returns the tree holding the entries of tree the rewrite
+// keeps, under their new paths; two paths ending up at the same place is
+// fatal
+func (rewriter *historyRewriter) rewriteTree(tree string) string {
+	if rewritten, ok := rewriter.trees[tree]; ok {
+		return rewritten
+	}
+	flat := rewriter.repo.flattenTree(tree)
+	paths := make([]string, 0, len(flat))
+	for entryPath := range flat {
+		paths = append(paths, entryPath)
+	}
+	sort.Strings(paths)
+	from := make(map[string]string)
+	dirs := make(map[string]string)
+	entries := make([]indexEntry, 0, len(flat))
+	for _, entryPath := range paths {
+		newPath, ok := rewriter.rewrite.mapPath(entryPath)
+		if !ok {
+			continue
+		}
+		if newPath == "" || strings.HasPrefix(newPath, "/") || strings.HasSuffix(newPath, "/") {
+			log.Fatalf("fatal: rewriting %s gives the invalid path '%s'", entryPath, newPath)
+		}
+		other, clash := from[newPath]
+		if !clash {
+			other, clash = dirs[newPath]
+		}
+		for dir := path.Dir(newPath); !clash && dir != "."; dir = path.Dir(dir) {
+			other, clash = from[dir]
+			dirs[dir] = entryPath
+		}
+		if clash {
+			log.Fatalf("fatal: rewriting both %s and %s gives %s", other, entryPath, newPath)
+		}
+		from[newPath] = entryPath
+		entry := flat[entryPath]
+		entries = append(entries, indexEntry{path: newPath, hash: entry.hash, mode: parseFileMode(entry.mode)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	rewritten := rewriter.repo.writeTreeLevel(entries, "", &cacheTree{entryCount: -1})
+	rewriter.trees[tree] = rewritten
+	return rewritten
+}
+
+// rewriteCommit writes the commit hash becomes once its parents were
+// rewritten. A commit the filters leave with the tree of its parent is
+// pruned, standing for its parent from then on, unless it was empty to
+// begin with or keepEmpty is set; so is a merge left with a single parent
+// and its tree, parents pruning made ancestors of the others left out.
+func (rewriter *historyRewriter) rewriteCommit(hash string, commit commitObject) {
+	repo := rewriter.repo
+	parents := make([]string, 0, len(commit.parents))
+	seen := make(map[string]bool)
+	degenerate := false
+	for _, parent := range commit.parents {
+		rewritten, ok := rewriter.commits[parent]
+		if !ok {
+			// outside of the walk, e.g. cut off by a shallow clone
+			rewritten = parent
+		}
+		degenerate = degenerate || rewriter.pruned[parent]
+		if rewritten != "" && !seen[rewritten] {
+			parents = append(parents, rewritten)
+			seen[rewritten] = true
+		}
+	}
+	if degenerate && len(parents) > 1 {
+		// pruning made a side of the merge part of the history of another
+		kept := make([]string, 0, len(parents))
+		for i, parent := range parents {
+			redundant := false
+			for j, other := range parents {
+				if i != j && repo.isAncestor(parent, other) {
+					redundant = true
+					break
+				}
+			}
+			if !redundant {
+				kept = append(kept, parent)
+			}
+		}
+		parents = kept
+	}
+	tree := rewriter.rewriteTree(commit.tree)
+	if !rewriter.rewrite.keepEmpty && len(parents) <= 1 {
+		originalParentTree, parentTree, parent := emptyTreeHash, emptyTreeHash, ""
+		if len(commit.parents) > 0 {
+			originalParentTree = repo.readCommitObject(commit.parents[0]).tree
+		}
+		if len(parents) == 1 {
+			parent = parents[0]
+			parentTree = repo.readCommitObject(parent).tree
+		}
+		if tree == parentTree && (commit.tree != originalParentTree || len(commit.parents) > 1) {
+			rewriter.commits[hash] = parent
+			rewriter.pruned[hash] = true
+			return
+		}
+	}
+	rewritten := commit
+	rewritten.tree, rewritten.parents = tree, parents
+	if rewriter.rewrite.message != nil {
+		rewritten.commitMessage = rewriter.rewrite.message(commit.commitMessage)
+	}
+	if rewriter.rewrite.identity != nil {
+		rewritten.author = rewriter.rewrite.identity(commit.author)
+		rewritten.committer = rewriter.rewrite.identity(commit.committer)
+	}
+	if rewritten.tree == commit.tree && strings.Join(parents, " ") == strings.Join(commit.parents, " ") && rewritten.commitMessage == commit.commitMessage && rewritten.author == commit.author && rewritten.committer == commit.committer {
+		rewriter.commits[hash] = hash
+		return
+	}
+	// a signature does not hold for the rewritten commit
+	rewritten.gpgSignature = ""
+	rewriter.commits[hash] = repo.writeObject("commit", serializeCommit(rewritten))
+}
+
+// rewriteTag writes a copy of an annotated tag pointing at what the
+// object it points at became, with the tagger and message rewritten and
+// without its signature; "" when that object was pruned
+func (rewriter *historyRewriter) rewriteTag(hash string) string {
+	header, content := rewriter.repo.readObject(hash)
+	if header.objectType != "tag" {
+		if rewritten, ok := rewriter.commits[hash]; ok {
+			return rewritten
+		}
+		return hash
+	}
+	headerText, message, _ := strings.Cut(string(content), "\n\n")
+	lines := strings.Split(headerText, "\n")
+	object := strings.TrimPrefix(lines[0], "object ")
+	target := rewriter.rewriteTag(object)
+	if target == "" {
+		return ""
+	}
+	lines[0] = "object " + target
+	for i, line := range lines {
+		if tagger := strings.TrimPrefix(line, "tagger "); tagger != line && rewriter.rewrite.identity != nil {
+			lines[i] = "tagger " + rewriter.rewrite.identity(parseIdentity(tagger)).String()
+		}
+	}
+	if signature := strings.Index(message, "-----BEGIN PGP SIGNATURE-----"); signature != -1 {
+		message = message[:signature]
+	}
+	if rewriter.rewrite.message != nil {
+		message = rewriter.rewrite.message(message)
+	}
+	rewritten := strings.Join(lines, "\n") + "\n\n" + message
+	if rewritten == string(content) {
+		return hash
+	}
+	return rewriter.repo.writeObject("tag", []byte(rewritten))
+}
+
+// rewriteRefs are the refs rewrite moves: all of them but notes, whose
+// trees are named by object ids, and replacements, which would then stand
+// for objects no longer in the history
+func (repo *Repository) rewriteRefs() []string {
+	refs := make([]string, 0)
+	for _, name := range repo.listRefs("refs/") {
+		if !strings.HasPrefix(name, "refs/notes/") && !strings.HasPrefix(name, "refs/replace/") {
+			refs = append(refs, name)
+		}
+	}
+	return refs
+}
+
+// rewriteHistory rewrites every commit reachable from the refs and HEAD,
+// parents first so that the rewritten commits keep the shape of the
+// history, and moves the refs to the rewritten commits. What became of
+// each commit and ref is written to rewrite/commit-map and rewrite/ref-map
+// in the git directory, pruned commits mapped to all zeros, and the index
+// and worktree are updated to the rewritten HEAD.
+func (repo *Repository) rewriteHistory(rewrite *historyRewrite) {
+	head, hasHead := repo.resolveRef("HEAD")
+	index := repo.lockIndex()
+	if hasHead && !repo.requireCleanWorktree(index, head, "rewrite history", "Please commit or stash them.") {
+		repo.releaseIndex(index)
+		os.Exit(1)
+	}
+	refs := repo.rewriteRefs()
+	values := make(map[string]string)
+	tips := make([]string, 0, len(refs)+1)
+	for _, name := range refs {
+		value, ok := repo.resolveRef(name)
+		if !ok {
+			continue
+		}
+		values[name] = value
+		peeled, _ := repo.peelTags(value)
+		if header, _ := repo.readObject(peeled); header.objectType == "commit" {
+			tips = append(tips, peeled)
+		}
+	}
+	branch, onBranch := repo.headBranch()
+	if hasHead && !onBranch {
+		tips = append(tips, head)
+	}
+
+	rewriter := &historyRewriter{
+		repo:    repo,
+		rewrite: rewrite,
+		commits: make(map[string]string),
+		pruned:  make(map[string]bool),
+		trees:   make(map[string]string),
+	}
+	iter := newCommitIter(repo, tips, commitOrderTopo, true)
+	walked := make([]string, 0)
+	for {
+		hash, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		rewriter.rewriteCommit(hash, commit)
+		walked = append(walked, hash)
+	}
+
+	nullHash := strings.Repeat("0", 40)
+	var commitMap, refMap strings.Builder
+	fmt.Fprintf(&commitMap, "%-40s %s\n", "old", "new")
+	fmt.Fprintf(&refMap, "%-40s %-40s %s\n", "old", "new", "ref")
+	rewritten := 0
+	for _, hash := range walked {
+		newHash := rewriter.commits[hash]
+		if rewriter.pruned[hash] {
+			newHash = nullHash
+		}
+		if newHash != hash {
+			rewritten++
+		}
+		fmt.Fprintf(&commitMap, "%s %s\n", hash, newHash)
+	}
+	updated := 0
+	for _, name := range refs {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		newValue := rewriter.rewriteTag(value)
+		if newValue == value {
+			continue
+		}
+		if newValue == "" {
+			repo.deleteRef(name)
+			newValue = nullHash
+		} else {
+			repo.updateRefLogged(name, newValue, "rewrite")
+			if onBranch && name == "refs/heads/"+branch {
+				repo.logRefUpdate("HEAD", value, newValue, "rewrite")
+			}
+		}
+		fmt.Fprintf(&refMap, "%s %s %s\n", value, newValue, name)
+		updated++
+	}
+	if hasHead && !onBranch {
+		if newHead := rewriter.commits[head]; newHead != "" && newHead != head {
+			repo.updateRefLogged("HEAD", newHead, "rewrite")
+			fmt.Fprintf(&refMap, "%s %s %s\n", head, newHead, "HEAD")
+			updated++
+		}
+	}
+	mapDir := filepath.Join(repo.gitDir, "rewrite")
+	if err := os.MkdirAll(mapDir, 0777); err != nil {
+		log.Fatal(err)
+	}
+	writeFileAtomically(filepath.Join(mapDir, "commit-map"), []byte(commitMap.String()))
+	writeFileAtomically(filepath.Join(mapDir, "ref-map"), []byte(refMap.String()))
+
+	if newHead, ok := repo.resolveRef("HEAD"); ok && repo.workTree != "" {
+		repo.resetToTree(index, repo.readCommitObject(newHead).tree)
+	} else if hasHead && repo.workTree != "" {
+		// the branch lost all its commits
+		repo.resetToTree(index, "")
+	}
+	repo.releaseIndex(index)
+	fmt.Printf("Rewrote %d of %d commits, %d of them pruned, and updated %d refs\n", rewritten, len(walked), len(rewriter.pruned), updated)
+}
+
+// messageReplacements reads the expressions of --replace-message, one per
+// line as git filter-repo has them: "<text>==><replacement>", with
+// "regex:" before the text for a regular expression and "***REMOVED***"
+// as the replacement when there is none
+func messageReplacements(file string) func(message string) string {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("fatal: could not read '%s': %s", file, err)
+	}
+	type replacement struct {
+		pattern     *regexp.Regexp
+		replacement string
+	}
+	replacements := make([]replacement, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		text, with, found := strings.Cut(line, "==>")
+		if !found {
+			with = "***REMOVED***"
+		}
+		var pattern *regexp.Regexp
+		if expression, ok := strings.CutPrefix(text, "regex:"); ok {
+			if pattern, err = regexp.Compile(expression); err != nil {
+				log.Fatalf("fatal: invalid regular expression '%s' in %s: %s", expression, file, err)
+			}
+		} else {
+			pattern = regexp.MustCompile(regexp.QuoteMeta(strings.TrimPrefix(text, "literal:")))
+			with = strings.ReplaceAll(with, "$", "$$")
+		}
+		replacements = append(replacements, replacement{pattern, with})
+	}
+	return func(message string) string {
+		for _, replacement := range replacements {
+			message = replacement.pattern.ReplaceAllString(message, replacement.replacement)
+		}
+		return message
+	}
+}
+
+// mailmapEntry rewrites the identities with email, and name too when it
+// is not "", to properName and properEmail, either of them kept when ""
+type mailmapEntry struct {
+	properName, properEmail string
+	name, email             string
+}
+
+// readMailmap reads a file in the format of .mailmap, whose lines are
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+//
+// and returns the identity callback mapping authors, committers and
+// taggers to their proper name and email. Emails and names match without
+// regard to case, entries with a name first.
+func readMailmap(file string) func(person identity) identity {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("fatal: could not read '%s': %s", file, err)
+	}
+	entries := make([]mailmapEntry, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		if comment := strings.IndexByte(line, '#'); comment != -1 {
+			line = line[:comment]
+		}
+		var names, emails []string
+		for {
+			open := strings.IndexByte(line, '<')
+			end := strings.IndexByte(line, '>')
+			if open == -1 || end < open {
+				break
+			}
+			names = append(names, strings.TrimSpace(line[:open]))
+			emails = append(emails, line[open+1:end])
+			line = line[end+1:]
+		}
+		switch len(emails) {
+		case 1:
+			entries = append(entries, mailmapEntry{properName: names[0], email: emails[0]})
+		case 2:
+			entries = append(entries, mailmapEntry{properName: names[0], properEmail: emails[0], name: names[1], email: emails[1]})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].name != "" && entries[j].name == "" })
+	return func(person identity) identity {
+		for _, entry := range entries {
+			if !strings.EqualFold(entry.email, person.email) || entry.name != "" && !strings.EqualFold(entry.name, person.name) {
+				continue
+			}
+			if entry.properName != "" {
+				person.name = entry.properName
+			}
+			if entry.properEmail != "" {
+				person.email = entry.properEmail
+			}
+			return person
+		}
+		return person
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sendEmailOptions struct {
+	from         string
+	to           []string
+	cc           []string
+	inReplyTo    string
+	server       string // host name, or the path of a sendmail-like program
+	port         int
+	user         string
+	password     string
+	encryption   string // "", "tls" (STARTTLS) or "ssl"
+	thread       bool
+	chainReplyTo bool
+	dryRun       bool
+	quiet        bool
+}
+
+// outgoingMail is a patch mail ready to be sent
+type outgoingMail struct {
+	headers []string // "Name: value" lines, folded lines kept together
+	body    string
+	subject string
+}
+
+// patchFiles expands directories given on the command line into the
+// patch files they contain, in name order
+func patchFiles(arguments []string) []string {
+	files := make([]string, 0)
+	for _, argument := range arguments {
+		info, err := os.Stat(argument)
+		if err != nil {
+			log.Fatalf("fatal: %s: %s", argument, err)
+		}
+		if !info.IsDir() {
+			files = append(files, argument)
+			continue
+		}
+		entries, err := os.ReadDir(argument)
+		if err != nil {
+			log.Fatal(err)
+		}
+		names := make([]string, 0)
+		for _, entry := range entries {
+			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				names = append(names, filepath.Join(argument, entry.Name()))
+			}
+		}
+		sort.Strings(names)
+		files = append(files, names...)
+	}
+	return files
+}
+
+// parseOutgoingMail splits a format-patch message into its header lines
+// and body
+func parseOutgoingMail(message string) outgoingMail {
+	var mail outgoingMail
+	headerText, body, _ := strings.Cut(message, "\n\n")
+	mail.body = body
+	for _, line := range strings.Split(headerText, "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(mail.headers) > 0 {
+			mail.headers[len(mail.headers)-1] += "\n" + line
+			continue
+		}
+		mail.headers = append(mail.headers, line)
+	}
+	mail.subject = decodeMailHeader(strings.ReplaceAll(mail.header("Subject"), "\n", ""))
+	return mail
+}
+
+func (mail *outgoingMail) header(name string) string {
+	for _, header := range mail.headers {
+		if key, value, ok := strings.Cut(header, ":"); ok && strings.EqualFold(key, name) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func (mail *outgoingMail) removeHeader(name string) {
+	kept := mail.headers[:0]
+	for _, header := range mail.headers {
+		if key, _, _ := strings.Cut(header, ":"); !strings.EqualFold(key, name) {
+			kept = append(kept, header)
+		}
+	}
+	mail.headers = kept
+}
+
+func (mail *outgoingMail) String() string {
+	return strings.Join(mail.headers, "\n") + "\n\n" + mail.body
+}
+
+// mailAddress returns the "user@host" part of "Name <user@host>"
+func mailAddress(value string) string {
+	if start, end := strings.LastIndex(value, "<"), strings.LastIndex(value, ">"); start != -1 && end > start {
+		return value[start+1 : end]
+	}
+	return strings.TrimSpace(value)
+}
+
+// messageID makes a unique Message-ID in git send-email's style
+func messageID(sender string, when time.Time, number int) string {
+	return fmt.Sprintf("<%s.%d-%d-git-send-email-%s>", when.UTC().Format("20060102150405"), os.Getpid(), number, mailAddress(sender))
+}
+
+// sendEmailConfig reads the sendemail.* settings the options default to
+func (repo *Repository) sendEmailConfig(options *sendEmailOptions) {
+	if options.from == "" {
+		if from, ok := repo.config.get("sendemail.from"); ok {
+			options.from = from
+		} else {
+			options.from = repo.currentIdentity("COMMITTER").nameAndEmail()
+		}
+	}
+	if len(options.to) == 0 {
+		options.to = repo.config.getAll("sendemail.to")
+	}
+	options.cc = append(options.cc, repo.config.getAll("sendemail.cc")...)
+	if options.server == "" {
+		options.server, _ = repo.config.get("sendemail.smtpServer")
+	}
+	if options.server == "" {
+		options.server = "localhost"
+	}
+	if options.port == 0 {
+		options.port = int(repo.config.getInt("sendemail.smtpServerPort", 0))
+	}
+	if options.user == "" {
+		options.user, _ = repo.config.get("sendemail.smtpUser")
+	}
+	if options.password == "" {
+		options.password, _ = repo.config.get("sendemail.smtpPass")
+	}
+	if options.encryption == "" {
+		options.encryption, _ = repo.config.get("sendemail.smtpEncryption")
+	}
+	if options.port == 0 {
+		switch options.encryption {
+		case "ssl":
+			options.port = 465
+		case "tls":
+			options.port = 587
+		default:
+			options.port = 25
+		}
+	}
+	options.thread = options.thread && repo.config.getBool("sendemail.thread", true)
+	options.chainReplyTo = options.chainReplyTo || repo.config.getBool("sendemail.chainReplyTo", false)
+}
+
+// sendEmails sends every patch file as a mail. Unless threading is off, the
+// mails reply to the first one, or each to the one before with
+// chainReplyTo, so that mail readers show the series as one thread.
+func (repo *Repository) sendEmails(files []string, options sendEmailOptions) {
+	if len(options.to) == 0 {
+		log.Fatal("fatal: no recipients given, use --to or sendemail.to")
+	}
+	recipients := make([]string, 0)
+	for _, address := range append(append([]string{}, options.to...), options.cc...) {
+		recipients = append(recipients, mailAddress(address))
+	}
+	now := time.Now()
+	inReplyTo, references := options.inReplyTo, options.inReplyTo
+	number := 0
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatalf("fatal: %s: %s", file, err)
+		}
+		for _, message := range splitMailbox(string(content)) {
+			mail := parseOutgoingMail(message)
+			number++
+			when := now.Add(time.Duration(number-1) * time.Second)
+			id := messageID(options.from, when, number)
+
+			// a patch by someone else keeps its author in the body
+			if author := mail.header("From"); author != "" && mailAddress(author) != mailAddress(options.from) {
+				mail.body = "From: " + decodeMailHeader(author) + "\n\n" + mail.body
+			}
+			for _, name := range []string{"From", "To", "Cc", "Date", "Message-ID", "In-Reply-To", "References", "X-Mailer"} {
+				mail.removeHeader(name)
+			}
+			headers := []string{"From: " + options.from, "To: " + strings.Join(options.to, ",\n\t")}
+			if len(options.cc) > 0 {
+				headers = append(headers, "Cc: "+strings.Join(options.cc, ",\n\t"))
+			}
+			headers = append(headers, mail.headers...)
+			headers = append(headers, "Date: "+when.Format(mailDateFormat), "Message-ID: "+id, "X-Mailer: "+DefaultPatchSignature)
+			if options.thread && inReplyTo != "" {
+				headers = append(headers, "In-Reply-To: "+inReplyTo, "References: "+references)
+			}
+			mail.headers = headers
+
+			if err := options.deliver(mailAddress(options.from), recipients, mail); err != nil {
+				log.Fatalf("fatal: failed to send %s: %s", mail.subject, err)
+			}
+			if !options.quiet {
+				status := "OK"
+				if options.dryRun {
+					status = "Dry-OK"
+				}
+				fmt.Printf("%s. Log says:\nServer: %s\nMAIL FROM:<%s>\n", status, options.server, mailAddress(options.from))
+				for _, recipient := range recipients {
+					fmt.Printf("RCPT TO:<%s>\n", recipient)
+				}
+				fmt.Printf("%s\n\nResult: OK\n", strings.Join(mail.headers, "\n"))
+			}
+
+			// shallow threads keep replying to the first mail
+			if options.thread && (options.chainReplyTo || inReplyTo == "" || number == 1) {
+				inReplyTo = id
+				if references == "" {
+					references = id
+				} else {
+					references += "\n " + id
+				}
+			}
+		}
+	}
+}
+
+// deliver hands a mail to the SMTP server, or to a sendmail compatible
+// program when the server is an absolute path
+func (options sendEmailOptions) deliver(sender string, recipients []string, mail outgoingMail) error {
+	if options.dryRun {
+		return nil
+	}
+	message := []byte(mail.String())
+	if filepath.IsAbs(options.server) {
+		sendmail := exec.Command(options.server, append([]string{"-i"}, recipients...)...)
+		sendmail.Stdin = bytes.NewReader(message)
+		sendmail.Stdout, sendmail.Stderr = os.Stderr, os.Stderr
+		traceRunCommand(sendmail.Args)
+		return sendmail.Run()
+	}
+
+	address := net.JoinHostPort(options.server, strconv.Itoa(options.port))
+	var client *smtp.Client
+	var err error
+	if options.encryption == "ssl" {
+		connection, dialErr := tls.Dial("tcp", address, &tls.Config{ServerName: options.server})
+		if dialErr != nil {
+			return dialErr
+		}
+		client, err = smtp.NewClient(connection, options.server)
+	} else {
+		client, err = smtp.Dial(address)
+	}
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if options.encryption == "tls" {
+		if err := client.StartTLS(&tls.Config{ServerName: options.server}); err != nil {
+			return err
+		}
+	}
+	if options.user != "" {
+		if err := client.Auth(smtp.PlainAuth("", options.user, options.password, options.server)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(sender); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	// the data writer turns line ends into CRLF and escapes leading dots
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
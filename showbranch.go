@@ -0,0 +1,577 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// the flags of commits in the show-branch walk, as git lays them out: two
+// for the walk, then one for each branch shown reaching the commit
+const (
+	showBranchSeen          = 1 << 0
+	showBranchUninteresting = 1 << 1
+	showBranchShift         = 2
+	showBranchMaxRevs       = 26
+)
+
+// the colors of the columns of the branches, in turn
+var showBranchColors = []string{colorRed, colorGreen, colorYellow, colorBlue, colorMagenta, colorCyan,
+	colorBoldRed, colorBoldGreen, colorBoldYellow, colorBoldBlue, colorBoldMagenta, colorBoldCyan}
+
+type showBranchOptions struct {
+	more        int // commits shown after the first common one, -1 to only list the branches
+	noName      bool
+	sha1Name    bool
+	dateOrder   bool
+	sparse      bool // also show merges reachable from a single branch
+	topics      bool // leave out the commits of the first branch
+	mergeBase   bool // only print the merge bases
+	independent bool // only print the branches no other reaches
+	color       bool
+}
+
+// showBranchRefs collects the names show-branch compares, git's way: the
+// branches of -a and -r first, sorted, then the revisions and patterns
+// given, at most showBranchMaxRevs
+type showBranchRefs struct {
+	repo  *Repository
+	names []string
+}
+
+func (refs *showBranchRefs) add(name string) {
+	for _, existing := range refs.names {
+		if existing == name {
+			return
+		}
+	}
+	if len(refs.names) >= showBranchMaxRevs {
+		fmt.Fprintf(os.Stderr, "warning: ignoring %s; cannot handle more than %d refs\n", name, showBranchMaxRevs)
+		return
+	}
+	refs.names = append(refs.names, name)
+}
+
+// addRef adds a ref by its name without prefix, unless that would name
+// something else, as a branch and a tag of the same name would
+func (refs *showBranchRefs) addRef(ref string, prefix string) {
+	hash, _ := refs.repo.resolveRef(ref)
+	name := strings.TrimPrefix(ref, prefix)
+	if resolved, ok := refs.repo.lookupRevision(name); !ok || resolved != hash {
+		name = strings.TrimPrefix(ref, "refs/")
+	}
+	refs.add(name)
+}
+
+func (refs *showBranchRefs) addAll(prefix string) {
+	start := len(refs.names)
+	for _, ref := range refs.repo.listRefs(prefix) {
+		refs.addRef(ref, prefix)
+	}
+	sortVersions(refs.names[start:])
+}
+
+// sortVersions sorts names as show-branch does, comparing runs of digits
+// by their value so that b2 comes before b10
+func sortVersions(names []string) {
+	sort.SliceStable(names, func(i, j int) bool { return compareVersions(names[i], names[j]) < 0 })
+}
+
+func compareVersions(a string, b string) int {
+	digits := func(s string) (int, string) {
+		value, end := 0, 0
+		for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			value = value*10 + int(s[end]-'0')
+			end++
+		}
+		return value, s[end:]
+	}
+	// digits compare equal to each other and before anything else, and
+	// the end of a name before all
+	at := func(s string) int {
+		if s == "" || s[0] >= '0' && s[0] <= '9' {
+			return 0
+		}
+		return int(s[0])
+	}
+	for {
+		var va, vb int
+		va, a = digits(a)
+		vb, b = digits(b)
+		if va != vb {
+			return va - vb
+		}
+		for {
+			ca, cb := at(a), at(b)
+			if ca != cb {
+				return ca - cb
+			}
+			if ca == 0 {
+				break
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a == "" && b == "" {
+			return 0
+		}
+	}
+}
+
+// addArgument adds a revision, or the refs whose last components match a
+// pattern with as many slashes: "hold/*" for the branches under
+// refs/heads/hold/ and "v1.?" for refs/tags/v1.0 and friends
+func (refs *showBranchRefs) addArgument(arg string) {
+	if _, ok := refs.repo.lookupRevision(arg); ok {
+		refs.add(arg)
+		return
+	}
+	if !strings.ContainsAny(arg, "*?[") {
+		log.Fatalf("fatal: bad sha1 reference %s", arg)
+	}
+	start := len(refs.names)
+	slashes := strings.Count(arg, "/")
+	for _, ref := range refs.repo.listRefs("refs/") {
+		components := strings.Split(ref, "/")
+		if len(components) <= slashes || !wildmatch(arg, strings.Join(components[len(components)-1-slashes:], "/"), false) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			refs.addRef(ref, "refs/heads/")
+		case strings.HasPrefix(ref, "refs/tags/"):
+			refs.add(strings.TrimPrefix(ref, "refs/"))
+		default:
+			refs.add(ref)
+		}
+	}
+	if len(refs.names) == start {
+		fmt.Fprintf(os.Stderr, "error: no matching refs with %s\n", arg)
+	}
+	sortVersions(refs.names[start:])
+}
+
+// showBranchWalk finds the commits of the branches down to those they all
+// have, recording which branches reach each
+type showBranchWalk struct {
+	repo    *Repository
+	flags   map[string]uint32
+	commits map[string]commitObject
+	seen    []string // newest first, as git's list of seen commits
+}
+
+func (walk *showBranchWalk) parse(hash string) {
+	if _, ok := walk.commits[hash]; !ok {
+		walk.commits[hash] = walk.repo.readCommitObject(hash)
+	}
+}
+
+func (walk *showBranchWalk) markSeen(hash string) bool {
+	if walk.flags[hash]&showBranchSeen != 0 {
+		return false
+	}
+	walk.flags[hash] |= showBranchSeen
+	walk.seen = append([]string{hash}, walk.seen...)
+	return true
+}
+
+func (walk *showBranchWalk) date(hash string) int64 {
+	return walk.commits[hash].committer.when.Unix()
+}
+
+// insertByDate queues a commit after those at least as recent
+func (walk *showBranchWalk) insertByDate(queue []string, hash string) []string {
+	position := 0
+	for position < len(queue) && walk.date(queue[position]) >= walk.date(hash) {
+		position++
+	}
+	return append(queue[:position], append([]string{hash}, queue[position:]...)...)
+}
+
+// join walks from the branches in date order until only commits all of
+// them reach are left, extra more after that, and then marks what those
+// reach as uninteresting
+func (walk *showBranchWalk) join(queue []string, count int, extra int) {
+	allMask := uint32(1)<<(showBranchShift+count) - 1
+	allRevs := allMask &^ (1<<showBranchShift - 1)
+	for len(queue) > 0 {
+		stillInteresting := false
+		for _, hash := range queue {
+			if walk.flags[hash]&showBranchUninteresting == 0 {
+				stillInteresting = true
+				break
+			}
+		}
+		commit := queue[0]
+		queue = queue[1:]
+		flags := walk.flags[commit] & allMask
+		if !stillInteresting && extra <= 0 {
+			break
+		}
+		walk.markSeen(commit)
+		if flags&allRevs == allRevs {
+			flags |= showBranchUninteresting
+		}
+		for _, parent := range walk.commits[commit].parents {
+			if walk.flags[parent]&flags == flags {
+				continue
+			}
+			walk.parse(parent)
+			if walk.markSeen(parent) && !stillInteresting {
+				extra--
+			}
+			walk.flags[parent] |= flags
+			queue = walk.insertByDate(queue, parent)
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, hash := range walk.seen {
+			if walk.flags[hash]&allRevs != allRevs && walk.flags[hash]&showBranchUninteresting == 0 {
+				continue
+			}
+			for _, parent := range walk.commits[hash].parents {
+				if walk.flags[parent]&showBranchUninteresting == 0 {
+					walk.flags[parent] |= showBranchUninteresting
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// sortTopologically orders the seen commits, sorted by date, so that no
+// commit comes before its children: in graph order, keeping lines of
+// history together, or with dateOrder newest first where possible
+func (walk *showBranchWalk) sortTopologically(list []string, dateOrder bool) []string {
+	indegree := make(map[string]int, len(list))
+	for _, hash := range list {
+		indegree[hash] = 1
+	}
+	for _, hash := range list {
+		for _, parent := range walk.commits[hash].parents {
+			if indegree[parent] > 0 {
+				indegree[parent]++
+			}
+		}
+	}
+	// a stack in graph order, where the first tip comes out first; with
+	// dateOrder the newest commit ready, the first queued on ties
+	var queue []string
+	pop := func() string {
+		if !dateOrder {
+			hash := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			return hash
+		}
+		newest := 0
+		for i := range queue {
+			if walk.date(queue[i]) > walk.date(queue[newest]) {
+				newest = i
+			}
+		}
+		hash := queue[newest]
+		queue = append(queue[:newest], queue[newest+1:]...)
+		return hash
+	}
+	for _, hash := range list {
+		if indegree[hash] == 1 {
+			queue = append(queue, hash)
+		}
+	}
+	if !dateOrder {
+		for i, j := 0, len(queue)-1; i < j; i, j = i+1, j-1 {
+			queue[i], queue[j] = queue[j], queue[i]
+		}
+	}
+	sorted := make([]string, 0, len(list))
+	for len(queue) > 0 {
+		hash := pop()
+		for _, parent := range walk.commits[hash].parents {
+			if indegree[parent] == 0 {
+				continue
+			}
+			indegree[parent]--
+			if indegree[parent] == 1 {
+				queue = append(queue, parent)
+			}
+		}
+		indegree[hash] = 0
+		sorted = append(sorted, hash)
+	}
+	return sorted
+}
+
+// showBranchName names a commit after a branch: its tip, "<branch>^" or
+// "<branch>~<n>" down the first parents, "^<n>" for the others
+type showBranchName struct {
+	head       string
+	generation int
+}
+
+func (name showBranchName) String() string {
+	switch name.generation {
+	case 0:
+		return name.head
+	case 1:
+		return name.head + "^"
+	}
+	return fmt.Sprintf("%s~%d", name.head, name.generation)
+}
+
+// nameCommits names the commits listed the way git does: the tips after
+// their branch, then the first parents down from named commits, then the
+// other parents of named commits, until all are named
+func (walk *showBranchWalk) nameCommits(list []string, revs []string, refNames []string) map[string]showBranchName {
+	names := make(map[string]showBranchName)
+	for _, hash := range list {
+		if _, named := names[hash]; named {
+			continue
+		}
+		for i, rev := range revs {
+			if rev == hash {
+				names[hash] = showBranchName{refNames[i], 0}
+				break
+			}
+		}
+	}
+	// parents are only known for the commits walked
+	parents := func(hash string) []string {
+		if walk.flags[hash]&showBranchSeen == 0 {
+			return nil
+		}
+		return walk.commits[hash].parents
+	}
+	nameFirstParentChain := func(hash string) int {
+		count := 0
+		for {
+			name, named := names[hash]
+			if !named || len(parents(hash)) == 0 {
+				return count
+			}
+			parent := parents(hash)[0]
+			if _, parentNamed := names[parent]; parentNamed {
+				return count
+			}
+			names[parent] = showBranchName{name.head, name.generation + 1}
+			count++
+			hash = parent
+		}
+	}
+	for {
+		count := 0
+		for _, hash := range list {
+			count += nameFirstParentChain(hash)
+		}
+		if count == 0 {
+			break
+		}
+	}
+	for {
+		count := 0
+		for _, hash := range list {
+			name, named := names[hash]
+			if !named {
+				continue
+			}
+			for nth, parent := range parents(hash) {
+				if _, parentNamed := names[parent]; parentNamed {
+					continue
+				}
+				head := name.String() + "^"
+				if nth > 0 {
+					head = fmt.Sprintf("%s^%d", name, nth+1)
+				}
+				names[parent] = showBranchName{head, 0}
+				count++
+				nameFirstParentChain(parent)
+			}
+		}
+		if count == 0 {
+			break
+		}
+	}
+	return names
+}
+
+// showBranch prints the branches of refNames side by side: a line for
+// each branch with the subject of its tip, then the commits down to the
+// first that all of them reach, each with a column per branch marking
+// whether the branch reaches it, "*" for the current branch, "+" for the
+// others and "-" for merges
+func (repo *Repository) showBranch(refNames []string, options showBranchOptions) int {
+	if len(refNames) == 0 {
+		fmt.Fprintln(os.Stderr, "No revs to be shown.")
+		return 0
+	}
+	walk := &showBranchWalk{repo: repo, flags: make(map[string]uint32), commits: make(map[string]commitObject)}
+	revs := make([]string, len(refNames))
+	masks := make([]uint32, len(refNames))
+	var queue []string
+	for i, name := range refNames {
+		hash, ok := repo.lookupRevision(name)
+		if !ok {
+			log.Fatalf("fatal: '%s' is not a valid ref.", name)
+		}
+		commit := repo.peelToCommit(hash)
+		walk.parse(commit)
+		walk.markSeen(commit)
+		flag := uint32(1) << (showBranchShift + i)
+		walk.flags[commit] |= flag
+		if walk.flags[commit] == flag|showBranchSeen {
+			queue = walk.insertByDate(queue, commit)
+		}
+		revs[i] = commit
+	}
+	for i, rev := range revs {
+		masks[i] = walk.flags[rev]
+	}
+	if options.more >= 0 {
+		walk.join(queue, len(revs), options.more)
+	}
+	seen := append([]string(nil), walk.seen...)
+	sort.SliceStable(seen, func(i, j int) bool { return walk.date(seen[i]) > walk.date(seen[j]) })
+
+	allMask := uint32(1)<<(showBranchShift+len(revs)) - 1
+	allRevs := allMask &^ (1<<showBranchShift - 1)
+	if options.mergeBase {
+		status := 1
+		for _, hash := range seen {
+			flags := walk.flags[hash] & allMask
+			if flags&showBranchUninteresting == 0 && flags&allRevs == allRevs {
+				fmt.Println(hash)
+				status = 0
+				walk.flags[hash] |= showBranchUninteresting
+			}
+		}
+		return status
+	}
+	if options.independent {
+		for i, rev := range revs {
+			if walk.flags[rev] == masks[i] {
+				fmt.Println(rev)
+			}
+			walk.flags[rev] |= showBranchUninteresting
+		}
+		return 0
+	}
+
+	column := func(i int, mark string) string {
+		return colorize(options.color, showBranchColors[i%len(showBranchColors)], mark)
+	}
+	subject := func(hash string) string {
+		subject, _ := splitCommitMessage(walk.commits[hash].commitMessage)
+		return strings.TrimPrefix(subject, "[PATCH] ")
+	}
+	head, _ := repo.readSymbolicRef("HEAD")
+	headHash, _ := repo.resolveRef("HEAD")
+	headAt := -1
+	if len(revs) > 1 || options.more < 0 {
+		for i, name := range refNames {
+			isHead := showBranchIsHead(head, name) && headHash == revs[i]
+			if isHead {
+				headAt = i
+			}
+			if options.more < 0 {
+				mark := " "
+				if isHead {
+					mark = "*"
+				}
+				fmt.Printf("%s [%s] %s\n", mark, name, subject(revs[i]))
+				continue
+			}
+			mark := "!"
+			if isHead {
+				mark = "*"
+			}
+			fmt.Printf("%s%s [%s] %s\n", strings.Repeat(" ", i), column(i, mark), name, subject(revs[i]))
+		}
+		if options.more >= 0 {
+			fmt.Println(strings.Repeat("-", len(revs)))
+		}
+	}
+	if options.more < 0 {
+		return 0
+	}
+
+	list := walk.sortTopologically(seen, options.dateOrder)
+	var names map[string]showBranchName
+	if !options.sha1Name && !options.noName {
+		names = walk.nameCommits(list, revs, refNames)
+	}
+	extra := options.more
+	shownMergePoint := false
+	for _, hash := range list {
+		flags := walk.flags[hash]
+		isMergePoint := flags&allRevs == allRevs
+		shownMergePoint = shownMergePoint || isMergePoint
+		if len(revs) > 1 {
+			isMerge := len(walk.commits[hash].parents) > 1
+			if options.topics && !isMergePoint && flags&(1<<showBranchShift) != 0 {
+				continue
+			}
+			if !options.sparse && isMerge && showBranchOmitInDense(hash, flags, revs) {
+				continue
+			}
+			var marks strings.Builder
+			for i := range revs {
+				switch {
+				case flags&(1<<(showBranchShift+i)) == 0:
+					marks.WriteString(" ")
+				case isMerge:
+					marks.WriteString(column(i, "-"))
+				case i == headAt:
+					marks.WriteString(column(i, "*"))
+				default:
+					marks.WriteString(column(i, "+"))
+				}
+			}
+			fmt.Print(marks.String() + " ")
+		}
+		if !options.noName {
+			if name, ok := names[hash]; ok {
+				fmt.Printf("[%s] ", name)
+			} else {
+				fmt.Printf("[%s] ", hash[:7])
+			}
+		}
+		fmt.Println(subject(hash))
+		if shownMergePoint {
+			if extra--; extra < 0 {
+				break
+			}
+		}
+	}
+	return 0
+}
+
+// showBranchIsHead tells whether a name given to show-branch is that of
+// the branch head points to
+func showBranchIsHead(head string, name string) bool {
+	if head == "" {
+		return false
+	}
+	head = strings.TrimPrefix(head, "refs/heads/")
+	if trimmed, ok := strings.CutPrefix(name, "refs/heads/"); ok {
+		name = trimmed
+	} else {
+		name = strings.TrimPrefix(name, "heads/")
+	}
+	return head == name
+}
+
+// showBranchOmitInDense tells a merge only one branch reaches, not worth
+// showing unless it is a tip
+func showBranchOmitInDense(hash string, flags uint32, revs []string) bool {
+	count := 0
+	for i, rev := range revs {
+		if rev == hash {
+			return false
+		}
+		if flags&(1<<(showBranchShift+i)) != 0 {
+			count++
+		}
+	}
+	return count == 1
+}
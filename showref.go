@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type showRefOptions struct {
+	heads       bool
+	tags        bool
+	head        bool
+	dereference bool
+	hashOnly    bool
+}
+
+type refEntry struct {
+	name   string
+	hash   string
+	peeled string
+}
+
+// matchesRefPattern applies show-ref's pattern rule: the pattern has to
+// match whole trailing components, so "main" matches refs/heads/main but
+// not refs/heads/domain
+func matchesRefPattern(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if name == pattern || strings.HasSuffix(name, "/"+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// peelTags follows annotated tags down to the first object that is not a
+// tag, ok is false when hash is not a tag at all
+func (repo *Repository) peelTags(hash string) (string, bool) {
+	peeled := false
+	for {
+		header, content := repo.readObject(hash)
+		if header.objectType != "tag" {
+			return hash, peeled
+		}
+		firstLine := strings.SplitN(string(content), "\n", 2)[0]
+		hash = strings.TrimPrefix(firstLine, "object ")
+		peeled = true
+	}
+}
+
+func (repo *Repository) refEntry(name string, hash string, options showRefOptions) refEntry {
+	entry := refEntry{name: name, hash: hash}
+	if options.dereference {
+		if peeled, ok := repo.peelTags(hash); ok {
+			entry.peeled = peeled
+		}
+	}
+	return entry
+}
+
+// showRefs returns the refs matching the patterns in git's order: HEAD
+// first when asked for, then everything under refs/ sorted by name
+func (repo *Repository) showRefs(patterns []string, options showRefOptions) []refEntry {
+	entries := make([]refEntry, 0)
+	if options.head {
+		if hash, ok := repo.resolveRef("HEAD"); ok {
+			entries = append(entries, repo.refEntry("HEAD", hash, options))
+		}
+	}
+	for _, name := range repo.listRefs("refs/") {
+		if options.heads || options.tags {
+			isHead := options.heads && strings.HasPrefix(name, "refs/heads/")
+			isTag := options.tags && strings.HasPrefix(name, "refs/tags/")
+			if !isHead && !isTag {
+				continue
+			}
+		}
+		if !matchesRefPattern(name, patterns) {
+			continue
+		}
+		hash, ok := repo.resolveRef(name)
+		if !ok {
+			continue
+		}
+		entries = append(entries, repo.refEntry(name, hash, options))
+	}
+	return entries
+}
+
+// verifyRefs looks up each ref by its exact name; only HEAD and full refs/
+// names are accepted, like git show-ref --verify
+func (repo *Repository) verifyRefs(names []string, options showRefOptions) ([]refEntry, string) {
+	entries := make([]refEntry, 0, len(names))
+	for _, name := range names {
+		if name != "HEAD" && !strings.HasPrefix(name, "refs/") {
+			return entries, name
+		}
+		hash, ok := repo.resolveRef(name)
+		if !ok {
+			return entries, name
+		}
+		entries = append(entries, repo.refEntry(name, hash, options))
+	}
+	return entries, ""
+}
+
+func printRefEntries(entries []refEntry, options showRefOptions) {
+	for _, entry := range entries {
+		if options.hashOnly {
+			fmt.Println(entry.hash)
+		} else {
+			fmt.Printf("%s %s\n", entry.hash, entry.name)
+		}
+		if entry.peeled == "" {
+			continue
+		}
+		if options.hashOnly {
+			fmt.Println(entry.peeled)
+		} else {
+			fmt.Printf("%s %s^{}\n", entry.peeled, entry.name)
+		}
+	}
+}
+
+type jsonRef struct {
+	Name   string `json:"name"`
+	Object string `json:"object"`
+	Peeled string `json:"peeled,omitempty"`
+}
+
+func refEntriesJSON(entries []refEntry) []jsonRef {
+	refs := make([]jsonRef, 0, len(entries))
+	for _, entry := range entries {
+		refs = append(refs, jsonRef{entry.name, entry.hash, entry.peeled})
+	}
+	return refs
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sparseCones are the directories a cone mode sparse checkout selects.
+// Besides the files at the top, it has every file below a recursive
+// directory and the files directly in each parent of one.
+type sparseCones struct {
+	recursive map[string]bool
+	parents   map[string]bool
+}
+
+func newSparseCones() *sparseCones {
+	return &sparseCones{recursive: make(map[string]bool), parents: make(map[string]bool)}
+}
+
+func (repo *Repository) sparseCheckoutPath() string {
+	return filepath.Join(repo.gitDir, "info", "sparse-checkout")
+}
+
+// readSparseCones reads the cones of the sparse checkout, ok being false
+// when the worktree is not sparse, not in cone mode or the patterns were
+// not written as cones
+func (repo *Repository) readSparseCones() (*sparseCones, bool) {
+	if !repo.config.getBool("core.sparseCheckout", false) || !repo.config.getBool("core.sparseCheckoutCone", false) {
+		return nil, false
+	}
+	return repo.readSparseConesFile()
+}
+
+// readSparseConesFile reads the cones of the patterns file whether or not
+// the sparse checkout is turned on
+func (repo *Repository) readSparseConesFile() (*sparseCones, bool) {
+	content, err := os.ReadFile(repo.sparseCheckoutPath())
+	if os.IsNotExist(err) {
+		return nil, false
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return parseSparseCones(string(content))
+}
+
+// parseSparseCones reads patterns written for cones: "/*" and "!/*/"
+// first, then "/<dir>/" for each directory, a parent being followed by
+// "!/<dir>/*/"
+func parseSparseCones(patterns string) (*sparseCones, bool) {
+	cones := newSparseCones()
+	lines := make([]string, 0)
+	for _, line := range strings.Split(patterns, "\n") {
+		if line != "" && line[0] != '#' {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 2 || lines[0] != "/*" || lines[1] != "!/*/" {
+		return nil, false
+	}
+	for _, line := range lines[2:] {
+		if dir := strings.TrimSuffix(strings.TrimPrefix(line, "!/"), "/*/"); strings.HasPrefix(line, "!/") && len(dir) == len(line)-5 && dir != "" {
+			dir = unescapeSparsePattern(dir)
+			if !cones.recursive[dir] {
+				return nil, false
+			}
+			delete(cones.recursive, dir)
+			cones.parents[dir] = true
+			continue
+		}
+		if len(line) < 3 || line[0] != '/' || line[len(line)-1] != '/' {
+			return nil, false
+		}
+		cones.recursive[unescapeSparsePattern(line[1:len(line)-1])] = true
+	}
+	return cones, true
+}
+
+// includes tells whether the file at a path is in the cones
+func (cones *sparseCones) includes(filePath string) bool {
+	dir := path.Dir(filePath)
+	if dir == "." || cones.parents[dir] {
+		return true
+	}
+	for ; dir != "."; dir = path.Dir(dir) {
+		if cones.recursive[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// add selects a directory with everything below it, dropping the
+// directories it contains and making its ancestors parents
+func (cones *sparseCones) add(dir string) {
+	for ancestor := path.Dir(dir); ancestor != "."; ancestor = path.Dir(ancestor) {
+		if cones.recursive[ancestor] {
+			return
+		}
+	}
+	for selected := range cones.recursive {
+		if strings.HasPrefix(selected, dir+"/") {
+			delete(cones.recursive, selected)
+		}
+	}
+	for parent := range cones.parents {
+		if strings.HasPrefix(parent, dir+"/") {
+			delete(cones.parents, parent)
+		}
+	}
+	cones.recursive[dir] = true
+	for ancestor := path.Dir(dir); ancestor != "."; ancestor = path.Dir(ancestor) {
+		cones.parents[ancestor] = true
+	}
+	delete(cones.parents, dir)
+}
+
+// directories lists the recursive directories in order
+func (cones *sparseCones) directories() []string {
+	dirs := make([]string, 0, len(cones.recursive))
+	for dir := range cones.recursive {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// format writes the cones as patterns the way git does, all parents first
+func (cones *sparseCones) format() string {
+	var patterns strings.Builder
+	patterns.WriteString("/*\n!/*/\n")
+	parents := make([]string, 0, len(cones.parents))
+	for dir := range cones.parents {
+		parents = append(parents, dir)
+	}
+	sort.Strings(parents)
+	for _, dir := range parents {
+		fmt.Fprintf(&patterns, "/%s/\n!/%s/*/\n", escapeSparsePattern(dir), escapeSparsePattern(dir))
+	}
+	for _, dir := range cones.directories() {
+		fmt.Fprintf(&patterns, "/%s/\n", escapeSparsePattern(dir))
+	}
+	return patterns.String()
+}
+
+// escapeSparsePattern quotes the characters a pattern would take for glob
+// ones
+func escapeSparsePattern(dir string) string {
+	var escaped strings.Builder
+	for _, c := range dir {
+		if strings.ContainsRune(`*?[\`, c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+func unescapeSparsePattern(pattern string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		unescaped.WriteByte(pattern[i])
+	}
+	return unescaped.String()
+}
+
+// normalizeSparseDirectory turns a directory given on the command line
+// into the form the cones hold, "./a/b/" becoming "a/b"
+func normalizeSparseDirectory(dir string) string {
+	dir = path.Clean(strings.TrimPrefix(filepath.ToSlash(dir), "/"))
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// initSparseCheckout turns on a cone mode sparse checkout, only the files
+// at the top being selected unless patterns were written before
+func (repo *Repository) initSparseCheckout() {
+	cones, ok := repo.readSparseConesFile()
+	if !ok {
+		cones = newSparseCones()
+	}
+	repo.writeSparseCheckout(cones)
+}
+
+// setSparseCheckout selects the given directories, adding them to those
+// selected already with add
+func (repo *Repository) setSparseCheckout(dirs []string, add bool) {
+	cones := newSparseCones()
+	if add {
+		current, ok := repo.readSparseCones()
+		if !ok {
+			log.Fatal("fatal: no sparse-checkout to add to")
+		}
+		cones = current
+	}
+	for _, dir := range dirs {
+		if dir = normalizeSparseDirectory(dir); dir != "" {
+			cones.add(dir)
+		}
+	}
+	repo.writeSparseCheckout(cones)
+}
+
+// listSparseCheckout prints the selected directories
+func (repo *Repository) listSparseCheckout(w io.Writer) {
+	cones, ok := repo.readSparseCones()
+	if !ok {
+		log.Fatal("fatal: this worktree is not sparse")
+	}
+	for _, dir := range cones.directories() {
+		fmt.Fprintln(w, dir)
+	}
+}
+
+// writeSparseCheckout writes the patterns of the cones, turns the sparse
+// checkout on and updates the worktree to match
+func (repo *Repository) writeSparseCheckout(cones *sparseCones) {
+	if err := os.MkdirAll(filepath.Dir(repo.sparseCheckoutPath()), 0777); err != nil {
+		log.Fatal(err)
+	}
+	writeFileAtomically(repo.sparseCheckoutPath(), []byte(cones.format()))
+	repo.setConfig("core.sparseCheckout", "true")
+	repo.setConfig("core.sparseCheckoutCone", "true")
+	repo.applySparseCheckout(cones)
+}
+
+// applySparseCheckout sets the skip-worktree bits of the index after the
+// cones, removing the files of the entries left out and writing those of
+// the entries brought back. Like git, files with changes are kept and
+// their entries stay in the worktree.
+func (repo *Repository) applySparseCheckout(cones *sparseCones) {
+	index := repo.lockIndex()
+	notUpToDate := make([]string, 0)
+	for i := range index.entries {
+		entry := &index.entries[i]
+		if entry.stage() != 0 || entry.mode == fileModeGitlink {
+			continue
+		}
+		included := cones.includes(entry.path)
+		switch {
+		case included && entry.skipWorktree():
+			*entry = repo.checkoutEntry(entry.path, treeEntry{mode: fmt.Sprintf("%o", entry.mode), name: path.Base(entry.path), hash: entry.hash})
+		case !included && !entry.skipWorktree():
+			if !repo.isWorktreeClean(index, *entry) {
+				notUpToDate = append(notUpToDate, entry.path)
+				continue
+			}
+			repo.removeWorktreeFile(entry.path)
+			entry.extendedFlags |= indexExtendedSkipWorktree
+		}
+	}
+	repo.writeIndex(index)
+	if len(notUpToDate) > 0 {
+		fmt.Fprintln(os.Stderr, "warning: The following paths are not up to date and were left despite sparse patterns:")
+		for _, entryPath := range notUpToDate {
+			fmt.Fprintf(os.Stderr, "\t%s\n", entryPath)
+		}
+		fmt.Fprintln(os.Stderr, "\nAfter fixing the above paths, you may want to run `git sparse-checkout reapply`.")
+	}
+}
+
+// sparsePercentage is the share of the tracked files a sparse checkout has
+// in the worktree, rounded as git does
+func sparsePercentage(index *gitIndex) int {
+	skipped := 0
+	for _, entry := range index.entries {
+		if entry.skipWorktree() {
+			skipped++
+		}
+	}
+	return 100 - 100*skipped/len(index.entries)
+}
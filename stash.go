@@ -0,0 +1,493 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// stashRef points at the latest stash, the older ones being the entries of
+// its reflog. A stash is a commit of the worktree whose parents are HEAD,
+// a commit of the index and, with untracked files, a parentless commit of
+// those.
+const stashRef = "refs/stash"
+
+type stashOptions struct {
+	keepIndex        bool // leave the staged changes in the index and the worktree
+	includeUntracked bool // stash untracked files in a third parent and remove them
+	patch            bool // pick the hunks of the worktree changes to stash
+	quiet            bool
+	message          string
+}
+
+// createdStash is a stash whose commits are written, before it is stored
+// in the stash list
+type createdStash struct {
+	hash      string
+	message   string
+	headTree  string
+	indexTree string
+	untracked []string        // the files stashed in the third parent
+	picked    []stashedChange // with --patch, what was stashed
+}
+
+// stashPush saves the local changes as a stash and takes the worktree and
+// the index back to HEAD, or with --keep-index to the index
+func (repo *Repository) stashPush(options stashOptions) {
+	index := repo.lockIndex()
+	stash, ok := repo.createStash(index, options)
+	if !ok {
+		repo.releaseIndex(index)
+		fmt.Println("No local changes to save")
+		return
+	}
+	repo.storeStash(stash.hash, stash.message)
+	if !options.quiet {
+		fmt.Printf("Saved working directory and index state %s\n", stash.message)
+	}
+
+	if options.patch {
+		for _, change := range stash.picked {
+			repo.unstashHunks(change)
+		}
+		if !options.keepIndex {
+			repo.resetIndex(index, stash.headTree)
+		}
+		repo.releaseIndex(index)
+		return
+	}
+	if options.keepIndex {
+		repo.resetToTree(index, stash.indexTree)
+	} else {
+		repo.resetToTree(index, stash.headTree)
+	}
+	repo.releaseIndex(index)
+	for _, file := range stash.untracked {
+		repo.removeWorktreeFile(file)
+	}
+}
+
+// createStash writes the commits of a stash of the local changes, leaving
+// the index and the worktree as they are; ok is false when nothing differs
+// from HEAD
+func (repo *Repository) createStash(index *gitIndex, options stashOptions) (createdStash, bool) {
+	head, ok := repo.resolveRef("HEAD")
+	if !ok {
+		fmt.Fprintln(os.Stderr, "You do not have the initial commit yet")
+		repo.releaseIndex(index)
+		os.Exit(1)
+	}
+	headCommit := repo.readCommitObject(head)
+	branch, ok := repo.headBranch()
+	if !ok {
+		branch = "(no branch)"
+	}
+	onWhat := fmt.Sprintf("%s: %s %s", branch, head[:7], strings.SplitN(headCommit.commitMessage, "\n", 2)[0])
+
+	stash := createdStash{headTree: headCommit.tree, indexTree: repo.writeTree(index)}
+	worktreeTree := repo.worktreeStashTree(index)
+	if options.includeUntracked {
+		stash.untracked = repo.stashedUntrackedFiles(index)
+	}
+	if stash.indexTree == headCommit.tree && worktreeTree == headCommit.tree && len(stash.untracked) == 0 {
+		return stash, false
+	}
+	if options.patch {
+		worktreeTree, stash.picked = repo.stashPatch(index, headCommit.tree)
+		if len(stash.picked) == 0 {
+			fmt.Fprintln(os.Stderr, "No changes selected")
+			repo.releaseIndex(index)
+			os.Exit(1)
+		}
+	}
+
+	parents := []string{head, repo.createCommit(stash.indexTree, []string{head}, "index on "+onWhat+"\n")}
+	if len(stash.untracked) > 0 {
+		untrackedIndex := &gitIndex{version: 2}
+		for _, file := range stash.untracked {
+			info, err := os.Lstat(repo.worktreePath(file))
+			if err != nil {
+				log.Fatal(err)
+			}
+			hash := repo.writeWorktreeBlob(file, info)
+			untrackedIndex.entries = append(untrackedIndex.entries, indexEntry{path: file, hash: hash, mode: worktreeFileMode(info)})
+		}
+		sort.Slice(untrackedIndex.entries, func(i, j int) bool { return untrackedIndex.entries[i].path < untrackedIndex.entries[j].path })
+		parents = append(parents, repo.createCommit(repo.writeTree(untrackedIndex), nil, "untracked files on "+onWhat+"\n"))
+	}
+	stash.message = "WIP on " + onWhat
+	if options.message != "" {
+		stash.message = "On " + branch + ": " + options.message
+	}
+	// like git, the message of the stash itself has no final newline
+	stash.hash = repo.createCommit(worktreeTree, parents, stash.message)
+	return stash, true
+}
+
+// storeStash makes a stash commit the latest entry of the stash list
+func (repo *Repository) storeStash(hash string, message string) {
+	previous, ok := repo.resolveRef(stashRef)
+	if !ok {
+		previous = nullHash
+	}
+	repo.updateRef(stashRef, hash)
+	repo.appendReflog(stashRef, previous, hash, message)
+}
+
+// worktreeStashTree writes the tree of the tracked files as they are in
+// the worktree
+func (repo *Repository) worktreeStashTree(index *gitIndex) string {
+	worktree := &gitIndex{version: index.version, entries: append([]indexEntry(nil), index.entries...)}
+	for _, change := range repo.worktreeChanges(index) {
+		if change.newMode == 0 {
+			worktree.removePath(change.path)
+			continue
+		}
+		hash := change.newHash
+		if change.newMode != fileModeGitlink {
+			_, content := repo.changeContents(change)
+			hash = repo.writeObject("blob", content)
+		}
+		worktree.addEntry(indexEntry{path: change.path, hash: hash, mode: change.newMode})
+	}
+	return repo.writeTree(worktree)
+}
+
+// stashedUntrackedFiles lists the files --include-untracked stashes: those
+// of the worktree neither tracked nor ignored
+func (repo *Repository) stashedUntrackedFiles(index *gitIndex) []string {
+	files := make([]string, 0)
+	for _, file := range repo.collectWorktreeFiles("", newIgnoreMatcher(repo)) {
+		if _, tracked := index.find(file); !tracked {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// stashedChange is a change of the worktree of which stash -p picked hunks
+type stashedChange struct {
+	change fileChange
+	result patchResult // HEAD with the picked hunks
+}
+
+// stashPatch asks which hunks of the changes between HEAD and the worktree
+// to stash and writes the tree of HEAD with them
+func (repo *Repository) stashPatch(index *gitIndex, headTree string) (string, []stashedChange) {
+	picked := make([]stashedChange, 0)
+	changes := repo.patchChanges(repo.worktreeChangesSince(headTree, index), nil)
+	repo.runPatchMode(stashPatchMode, changes, func(change fileChange, result patchResult) {
+		picked = append(picked, stashedChange{change, result})
+	})
+	stashed := repo.treeIndex(headTree)
+	for _, file := range picked {
+		if file.result.mode == 0 {
+			stashed.removePath(file.change.path)
+			continue
+		}
+		hash := repo.writeObject("blob", file.result.content)
+		stashed.addEntry(indexEntry{path: file.change.path, hash: hash, mode: file.result.mode})
+	}
+	return repo.writeTree(stashed), picked
+}
+
+// unstashHunks takes the hunks stash -p picked out of the worktree file,
+// keeping the changes that were not stashed
+func (repo *Repository) unstashHunks(file stashedChange) {
+	change := file.change
+	headContent, worktreeContent := repo.changeContents(change)
+	if file.result.mode == change.newMode && string(file.result.content) == string(worktreeContent) {
+		repo.replaceWorktreeFile(change.path, change.oldMode, headContent)
+		return
+	}
+	// the worktree less the stashed hunks is the three-way merge of the
+	// head and the worktree against the file with them
+	content, conflicts := mergeContents(file.result.content, worktreeContent, headContent, mergeLabels{}, false)
+	if conflicts > 0 {
+		log.Fatalf("error: could not remove the stashed hunks from %s", change.path)
+	}
+	mode := change.newMode
+	if file.result.mode != change.oldMode {
+		// the mode change was stashed
+		mode = change.oldMode
+	}
+	repo.replaceWorktreeFile(change.path, mode, content)
+}
+
+// treeIndex returns an index of the entries of a tree, without stat data
+func (repo *Repository) treeIndex(tree string) *gitIndex {
+	index := &gitIndex{version: 2, entries: make([]indexEntry, 0)}
+	for entryPath, entry := range repo.flattenTree(tree) {
+		index.entries = append(index.entries, indexEntry{path: entryPath, hash: entry.hash, mode: parseFileMode(entry.mode)})
+	}
+	sort.Slice(index.entries, func(i, j int) bool { return index.entries[i].path < index.entries[j].path })
+	return index
+}
+
+// resetIndex makes the index match a tree, leaving the worktree alone;
+// the entries that do not change keep their stat data. A locked index
+// stays locked for the caller to finish with.
+func (repo *Repository) resetIndex(index *gitIndex, tree string) {
+	reset := repo.treeIndex(tree)
+	for i, entry := range reset.entries {
+		if position, ok := index.find(entry.path); ok && index.entries[position].hash == entry.hash && index.entries[position].mode == entry.mode {
+			reset.entries[i] = index.entries[position]
+		}
+	}
+	index.entries = reset.entries
+	index.cacheTree = nil
+	repo.writeIndexKeepingLock(index)
+}
+
+// resetToTree makes the index and the tracked files of the worktree
+// match a tree, as "git reset --hard" does; untracked files stay. A
+// locked index stays locked for the caller to finish with.
+func (repo *Repository) resetToTree(index *gitIndex, tree string) {
+	treeEntries := repo.flattenTree(tree)
+	for _, entry := range append([]indexEntry(nil), index.entries...) {
+		if _, ok := treeEntries[entry.path]; !ok {
+			if !entry.skipWorktree() {
+				repo.removeWorktreeFile(entry.path)
+			}
+			index.removePath(entry.path)
+		}
+	}
+	paths := make([]string, 0, len(treeEntries))
+	for entryPath := range treeEntries {
+		paths = append(paths, entryPath)
+	}
+	sort.Strings(paths)
+	for _, entryPath := range paths {
+		entry := treeEntries[entryPath]
+		if position, ok := index.find(entryPath); ok {
+			existing := index.entries[position]
+			if existing.stage() == 0 && existing.hash == entry.hash && existing.mode == parseFileMode(entry.mode) && (existing.skipWorktree() || repo.worktreeFileMatches(index, existing)) {
+				continue
+			}
+		}
+		index.addEntry(repo.checkoutEntry(entryPath, entry))
+	}
+	repo.writeIndexKeepingLock(index)
+}
+
+// worktreeFileMatches reports whether the worktree file exists with the
+// content of the index entry
+func (repo *Repository) worktreeFileMatches(index *gitIndex, entry indexEntry) bool {
+	if _, err := os.Lstat(repo.worktreePath(entry.path)); err != nil {
+		return false
+	}
+	return repo.isWorktreeClean(index, entry)
+}
+
+// stashSelectorPattern matches the names of stash entries, "stash@{1}"
+var stashSelectorPattern = regexp.MustCompile(`^(refs/)?stash@\{([0-9]+)\}$`)
+
+// namedStash is a stash as a command names it
+type namedStash struct {
+	name     string // as messages show it, "refs/stash@{0}" by default
+	position int    // in the stash list, -1 for stashes named by commit
+	hash     string
+}
+
+// findStash resolves the stash an argument names: an entry of the stash
+// list as "stash@{<n>}" or "<n>", or any stash commit; none names the
+// latest stash
+func (repo *Repository) findStash(args []string) namedStash {
+	if len(args) > 1 {
+		log.Fatalf("fatal: Too many revisions specified: %s", strings.Join(args, " "))
+	}
+	entries := repo.readReflog(stashRef)
+	if len(entries) == 0 && (len(args) == 0 || stashSelectorPattern.MatchString(args[0])) {
+		fmt.Fprintln(os.Stderr, "No stash entries found.")
+		os.Exit(1)
+	}
+	stash := namedStash{name: "refs/stash@{0}"}
+	if len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil && n >= 0 {
+			stash = namedStash{name: fmt.Sprintf("refs/stash@{%d}", n), position: n}
+		} else if match := stashSelectorPattern.FindStringSubmatch(args[0]); match != nil {
+			n, _ := strconv.Atoi(match[2])
+			stash = namedStash{name: args[0], position: n}
+		} else if hash, ok := repo.lookupRevision(args[0]); ok {
+			stash = namedStash{name: args[0], position: -1, hash: hash}
+		} else {
+			fmt.Fprintf(os.Stderr, "error: %s is not a valid reference\n", args[0])
+			os.Exit(1)
+		}
+	}
+	if stash.position >= len(entries) {
+		log.Fatalf("fatal: log for 'stash' only has %d entries", len(entries))
+	}
+	if stash.position >= 0 {
+		stash.hash = entries[len(entries)-1-stash.position].newHash
+	}
+	if header, _ := repo.readObject(stash.hash); header.objectType != "commit" || len(repo.readCommitObject(stash.hash).parents) < 2 {
+		log.Fatalf("fatal: '%s' is not a stash-like commit", stash.name)
+	}
+	return stash
+}
+
+// stashList prints the stash entries, the latest first
+func (repo *Repository) stashList() {
+	entries := repo.readReflog(stashRef)
+	for i := len(entries) - 1; i >= 0; i-- {
+		fmt.Printf("stash@{%d}: %s\n", len(entries)-1-i, entries[i].message)
+	}
+}
+
+// stashShow shows the changes a stash records against the commit it was
+// made on, with untracked files as additions
+func (repo *Repository) stashShow(stash namedStash, patch bool, includeUntracked bool) {
+	commit := repo.readCommitObject(stash.hash)
+	changes := repo.diffTrees(repo.readCommitObject(commit.parents[0]).tree, commit.tree)
+	if includeUntracked && len(commit.parents) > 2 {
+		changes = append(changes, repo.diffTrees("", repo.readCommitObject(commit.parents[2]).tree)...)
+		sort.SliceStable(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	}
+	options := diffOptions{context: DefaultDiffContext, colors: repo.diffColors(repo.useColor("diff"))}
+	if patch {
+		for _, change := range changes {
+			repo.writePatch(os.Stdout, change, options)
+		}
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+	stats := make([]fileStat, len(changes))
+	for i, change := range changes {
+		stats[i] = repo.diffStat(change)
+	}
+	writeDiffStat(os.Stdout, stats, 80, options.colors)
+}
+
+// stashApply applies the changes of a stash to the worktree, keeping what
+// is staged; new files get staged. With restoreIndex the staged changes of
+// the stash are applied to the index too. Untracked files of the stash are
+// restored, none being overwritten. It reports whether all of it applied.
+func (repo *Repository) stashApply(stash namedStash, restoreIndex bool, quiet bool) bool {
+	commit := repo.readCommitObject(stash.hash)
+	baseTree := repo.readCommitObject(commit.parents[0]).tree
+	indexTree := repo.readCommitObject(commit.parents[1]).tree
+	index := repo.lockIndex()
+	for _, entry := range index.entries {
+		if entry.stage() != 0 {
+			log.Fatal("error: Cannot apply a stash in the middle of a merge")
+		}
+	}
+
+	var indexUpdates []treeUpdate
+	if restoreIndex && indexTree != baseTree {
+		merge := repo.mergeTreeChanges(index, baseTree, indexTree, mergeLabels{ours: "Updated upstream", theirs: "Stashed changes"})
+		if len(merge.conflicts) > 0 {
+			fmt.Fprintln(os.Stderr, "Conflicts in index. Try without --index.")
+			repo.releaseIndex(index)
+			os.Exit(1)
+		}
+		indexUpdates = merge.updates
+	}
+	merge := repo.mergeTreeChanges(index, baseTree, commit.tree, mergeLabels{ours: "Updated upstream", theirs: "Stashed changes"})
+	updates := merge.updates
+	if len(merge.conflicts) > 0 {
+		fmt.Fprintln(os.Stderr, "error: Your local changes to the following files conflict with the stash:")
+		for _, conflict := range merge.conflictPaths() {
+			fmt.Fprintf(os.Stderr, "\t%s\n", conflict)
+		}
+		fmt.Fprintln(os.Stderr, "Aborting")
+		repo.releaseIndex(index)
+		repo.printStashStatus(quiet)
+		return false
+	}
+	if len(updates) == 0 && !quiet {
+		fmt.Println("Already up to date.")
+	}
+	if !repo.checkTreeUpdates(index, updates) {
+		repo.releaseIndex(index)
+		repo.printStashStatus(quiet)
+		return false
+	}
+
+	written := repo.writeTreeUpdates(updates)
+	for _, update := range updates {
+		if _, tracked := index.find(update.path); !tracked && update.mode != 0 && !restoreIndex {
+			index.addEntry(written[update.path])
+		}
+	}
+	for _, update := range indexUpdates {
+		if update.mode == 0 {
+			index.removePath(update.path)
+		} else if entry, ok := written[update.path]; ok && entry.hash == update.hash && entry.mode == update.mode {
+			index.addEntry(entry)
+		} else {
+			index.addEntry(indexEntry{path: update.path, hash: update.hash, mode: update.mode})
+		}
+	}
+	repo.writeIndex(index)
+
+	restored := true
+	if len(commit.parents) > 2 {
+		untrackedEntries := repo.flattenTree(repo.readCommitObject(commit.parents[2]).tree)
+		paths := make([]string, 0, len(untrackedEntries))
+		for entryPath := range untrackedEntries {
+			if _, err := os.Lstat(repo.worktreePath(entryPath)); err == nil {
+				fmt.Fprintf(os.Stderr, "%s already exists, no checkout\n", entryPath)
+				restored = false
+			}
+			paths = append(paths, entryPath)
+		}
+		if restored {
+			sort.Strings(paths)
+			for _, entryPath := range paths {
+				repo.checkoutEntry(entryPath, untrackedEntries[entryPath])
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, "error: could not restore untracked files from stash")
+		}
+	}
+	repo.printStashStatus(quiet)
+	return restored
+}
+
+// printStashStatus shows the status after applying a stash, as git does
+// even when that failed
+func (repo *Repository) printStashStatus(quiet bool) {
+	if !quiet {
+		repo.printStatus(os.Stdout, repo.computeStatus(repo.jobCount(0)), repo.useColor("status"))
+	}
+}
+
+// stashDrop removes an entry from the stash list; refs/stash goes with
+// the last one
+func (repo *Repository) stashDrop(stash namedStash, quiet bool) {
+	if stash.position < 0 {
+		log.Fatalf("fatal: '%s' is not a stash reference", stash.name)
+	}
+	entries := repo.readReflog(stashRef)
+	dropped := len(entries) - 1 - stash.position
+	if dropped+1 < len(entries) {
+		// the next entry now follows the one before the dropped one
+		next := &entries[dropped+1]
+		next.oldHash = entries[dropped].oldHash
+		next.line = next.oldHash + next.line[2*ObjectShaLength:]
+	}
+	entries = append(entries[:dropped], entries[dropped+1:]...)
+	if len(entries) == 0 {
+		repo.stashClear()
+	} else {
+		repo.writeReflog(stashRef, entries)
+		repo.updateRef(stashRef, entries[len(entries)-1].newHash)
+	}
+	if !quiet {
+		fmt.Printf("Dropped %s (%s)\n", stash.name, stash.hash)
+	}
+}
+
+// stashClear removes all stash entries
+func (repo *Repository) stashClear() {
+	repo.deleteRef(stashRef)
+	repo.deleteReflog(stashRef)
+}
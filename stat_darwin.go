@@ -0,0 +1,21 @@
+//go:build darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func fillPlatformStat(entry *indexEntry, info os.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	entry.ctimeSeconds = uint32(stat.Ctimespec.Sec)
+	entry.ctimeNanoseconds = uint32(stat.Ctimespec.Nsec)
+	entry.dev = uint32(stat.Dev)
+	entry.ino = uint32(stat.Ino)
+	entry.uid = stat.Uid
+	entry.gid = stat.Gid
+}
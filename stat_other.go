@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"os"
+)
+
+// only mtime and size are portable, the remaining stat fields stay zero
+
+func fillPlatformStat(entry *indexEntry, info os.FileInfo) {}
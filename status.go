@@ -0,0 +1,586 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type statusChange struct {
+	path      string
+	label     string         // "new file", "modified", "deleted" or "typechange"
+	submodule submoduleState // how a worktree submodule changed
+}
+
+type repoStatus struct {
+	branch    string // empty when HEAD is detached
+	headHash  string // empty on an unborn branch
+	tracking  *trackingInfo
+	merging   bool // whether MERGE_HEAD exists
+	sparse    int  // percentage of the tracked files a sparse checkout has, -1 when not sparse
+	staged    []statusChange
+	unmerged  []statusChange // labeled after the stages the index has, e.g. "both modified"
+	unstaged  []statusChange
+	untracked []string // untracked directories carry a trailing "/"
+}
+
+// unmergedLabels name a conflict after which of the base (stage 1), ours
+// (stage 2) and theirs (stage 3) the index holds, as bits 1, 2 and 4
+var unmergedLabels = map[int]string{
+	1: "both deleted",
+	2: "added by us",
+	3: "deleted by them",
+	4: "added by them",
+	5: "deleted by us",
+	6: "both added",
+	7: "both modified",
+}
+
+// unmergedChanges lists the paths with conflict stages in the index
+func unmergedChanges(index *gitIndex) []statusChange {
+	stages := make(map[string]int)
+	paths := make([]string, 0)
+	for _, entry := range index.entries {
+		if entry.stage() == 0 {
+			continue
+		}
+		if _, ok := stages[entry.path]; !ok {
+			paths = append(paths, entry.path)
+		}
+		stages[entry.path] |= 1 << (entry.stage() - 1)
+	}
+	changes := make([]statusChange, len(paths))
+	for i, unmergedPath := range paths {
+		changes[i] = statusChange{path: unmergedPath, label: unmergedLabels[stages[unmergedPath]]}
+	}
+	return changes
+}
+
+func (repo *Repository) computeStatus(jobs int) repoStatus {
+	var status repoStatus
+	status.branch, _ = repo.headBranch()
+	status.headHash, _ = repo.resolveRef("HEAD")
+	if info, ok := repo.tracking(status.branch); ok && status.branch != "" && status.headHash != "" {
+		status.tracking = &info
+	}
+	endRegion := traceRegion("read the index")
+	// like git, status updates the index when nobody else is using it,
+	// for what the file-system monitor learnt to be kept
+	var lock *lockFile
+	locked := false
+	if repo.fsmonitorHook() != "" {
+		lock, locked = tryLock(repo.indexPath())
+	}
+	index := repo.readIndex()
+	if locked {
+		index.lock = lock
+	}
+	endRegion()
+	endRegion = traceRegion("query fsmonitor")
+	useFsmonitor := repo.queryFsmonitor(index)
+	endRegion()
+	endRegion = traceRegion("diff the index against HEAD")
+	status.staged = repo.stagedChanges(index, status.headHash)
+	endRegion()
+	status.unmerged = unmergedChanges(index)
+	status.sparse = -1
+	if repo.config.getBool("core.sparseCheckout", false) && len(index.entries) > 0 {
+		status.sparse = sparsePercentage(index)
+	}
+	if _, err := os.Stat(filepath.Join(repo.gitDir, "MERGE_HEAD")); err == nil {
+		status.merging = true
+	}
+	endRegion = traceRegion("refresh the index")
+	status.unstaged = repo.unstagedChanges(index, jobs, useFsmonitor)
+	endRegion()
+	endRegion = traceRegion("read untracked files")
+	status.untracked = repo.untrackedFiles(index, jobs)
+	endRegion()
+	if index.lock != nil && index.fsmonitor != nil && index.fsmonitor.changed {
+		repo.writeIndex(index)
+	} else {
+		repo.releaseIndex(index)
+	}
+	return status
+}
+
+// limitTo keeps the changes of the paths the pathspecs select, and the
+// untracked directories holding any
+func (status *repoStatus) limitTo(specs []pathspec) {
+	if len(specs) == 0 {
+		return
+	}
+	limit := func(changes []statusChange) []statusChange {
+		kept := make([]statusChange, 0, len(changes))
+		for _, change := range changes {
+			if matchesPathspecs(change.path, specs) {
+				kept = append(kept, change)
+			}
+		}
+		return kept
+	}
+	status.staged, status.unmerged, status.unstaged = limit(status.staged), limit(status.unmerged), limit(status.unstaged)
+	untracked := make([]string, 0, len(status.untracked))
+	for _, untrackedPath := range status.untracked {
+		trimmed := strings.TrimSuffix(untrackedPath, "/")
+		if matchesPathspecs(trimmed, specs) || trimmed != untrackedPath && pathspecsLeadInto(trimmed, specs) {
+			untracked = append(untracked, untrackedPath)
+		}
+	}
+	status.untracked = untracked
+}
+
+// stagedChanges compares the index against the HEAD tree, skipping
+// directories whose cache-tree entry already equals the HEAD subtree
+func (repo *Repository) stagedChanges(index *gitIndex, headHash string) []statusChange {
+	headTree := make(map[string]treeEntry)
+	unchangedDirs := make(map[string]bool)
+	if headHash != "" {
+		repo.collectChangedTree(repo.readCommitObject(headHash).tree, index.cacheTree, "", headTree, unchangedDirs)
+	}
+	changes := make([]statusChange, 0)
+	for _, entry := range index.entries {
+		if entry.stage() != 0 || entry.intentToAdd() || isInDirs(entry.path, unchangedDirs) {
+			continue
+		}
+		headEntry, ok := headTree[entry.path]
+		delete(headTree, entry.path)
+		if !ok {
+			changes = append(changes, statusChange{path: entry.path, label: "new file"})
+		} else if change, changed := compareModes(parseFileMode(headEntry.mode), entry.mode); changed {
+			changes = append(changes, statusChange{path: entry.path, label: change})
+		} else if headEntry.hash != entry.hash {
+			changes = append(changes, statusChange{path: entry.path, label: "modified"})
+		}
+	}
+	for headPath := range headTree {
+		if _, ok := index.find(headPath); !ok {
+			changes = append(changes, statusChange{path: headPath, label: "deleted"})
+		}
+	}
+	sortStatusChanges(changes)
+	return changes
+}
+
+func (repo *Repository) collectChangedTree(treeHash string, node *cacheTree, dir string, entries map[string]treeEntry, unchangedDirs map[string]bool) {
+	if node.isValid() && node.hash == treeHash {
+		unchangedDirs[dir] = true
+		return
+	}
+	for _, entry := range repo.readTreeEntries(treeHash) {
+		entryPath := path.Join(dir, entry.name)
+		if entry.mode == "40000" {
+			repo.collectChangedTree(entry.hash, node.subtree(entry.name), entryPath, entries, unchangedDirs)
+		} else {
+			entries[entryPath] = entry
+		}
+	}
+}
+
+// isInDirs reports whether any directory containing path is in dirs, where
+// "" stands for the root
+func isInDirs(relativePath string, dirs map[string]bool) bool {
+	if len(dirs) == 0 {
+		return false
+	}
+	for dir := path.Dir(relativePath); ; dir = path.Dir(dir) {
+		if dir == "." {
+			return dirs[""]
+		}
+		if dirs[dir] {
+			return true
+		}
+	}
+}
+
+// compareModes reports a typechange between file kinds, or a plain
+// modification when only the executable bit differs
+func compareModes(oldMode uint32, newMode uint32) (string, bool) {
+	if oldMode == newMode {
+		return "", false
+	}
+	if oldMode&0170000 != newMode&0170000 {
+		return "typechange", true
+	}
+	return "modified", true
+}
+
+func sortStatusChanges(changes []statusChange) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+}
+
+// unstagedChanges compares the worktree against the index; entries are
+// split into batches that workers lstat and, when the stat data is not
+// conclusive, re-hash. Entries the file-system monitor vouches for are
+// skipped entirely, and those found unchanged are vouched for from now on.
+func (repo *Repository) unstagedChanges(index *gitIndex, jobs int, useFsmonitor bool) []statusChange {
+	batchSize := len(index.entries)/(jobs*4) + 1
+	batchCount := (len(index.entries) + batchSize - 1) / batchSize
+	batchResults := make([][]statusChange, batchCount)
+	batchValidated := make([]bool, batchCount)
+	runParallel(jobs, batchCount, func(batch int) {
+		end := (batch + 1) * batchSize
+		if end > len(index.entries) {
+			end = len(index.entries)
+		}
+		changes := make([]statusChange, 0)
+		for i := batch * batchSize; i < end; i++ {
+			entry := &index.entries[i]
+			if entry.stage() != 0 || (useFsmonitor && entry.fsmonitorValid) {
+				continue
+			}
+			if change, changed := repo.worktreeChange(index, *entry); changed {
+				changes = append(changes, change)
+			} else if index.fsmonitor != nil && !entry.fsmonitorValid {
+				entry.fsmonitorValid = true
+				batchValidated[batch] = true
+			}
+		}
+		batchResults[batch] = changes
+	})
+	changes := make([]statusChange, 0)
+	for batch, batchChanges := range batchResults {
+		changes = append(changes, batchChanges...)
+		if batchValidated[batch] {
+			index.fsmonitor.changed = true
+		}
+	}
+	return changes
+}
+
+// worktreeChange tells how the worktree file of an index entry differs
+// from it. A submodule is modified when it has moved to other commits or
+// has changes of its own. Entries marked assume-unchanged or skip-worktree
+// never differ; the file of an intent-to-add entry is a new one.
+func (repo *Repository) worktreeChange(index *gitIndex, entry indexEntry) (statusChange, bool) {
+	change := statusChange{path: entry.path}
+	if entry.ignoresWorktree() {
+		return change, false
+	}
+	info, err := os.Lstat(repo.worktreePath(entry.path))
+	if os.IsNotExist(err) || isNotDirectoryError(err) {
+		change.label = "deleted"
+		return change, true
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if entry.intentToAdd() {
+		change.label = "new file"
+		return change, true
+	}
+	worktreeMode := index.modes.entryMode(info, entry.mode)
+	if entry.mode == fileModeGitlink && worktreeMode == fileModeGitlink {
+		state := repo.submoduleState(entry.path, entry.hash)
+		change.label, change.submodule = "modified", state
+		return change, state.changed()
+	}
+	if index.isUpToDate(entry, info) {
+		return change, false
+	}
+	if label, changed := compareModes(entry.mode, worktreeMode); changed {
+		change.label = label
+		return change, true
+	}
+	change.label = "modified"
+	if int64(entry.size) != info.Size()&0xffffffff {
+		return change, true
+	}
+	return change, repo.worktreeBlobHash(entry.path, info) != entry.hash
+}
+
+func isNotDirectoryError(err error) bool {
+	// lstat of "a/b" where "a" is now a file
+	return err != nil && strings.Contains(err.Error(), "not a directory")
+}
+
+// untrackedFiles walks the worktree with up to jobs directories being read
+// concurrently; directories without any tracked file are reported as a
+// whole, as long as they contain something that is not ignored. Fresh
+// listings from the untracked cache replace reading the directory.
+func (repo *Repository) untrackedFiles(index *gitIndex, jobs int) []string {
+	trackedFiles := make(map[string]bool)
+	trackedDirs := map[string][]string{"": nil} // directory to its tracked subdirectories
+	// the directories listed under their parent, which may be in
+	// trackedDirs already from their own subdirectories
+	registered := make(map[string]bool)
+	for _, entry := range index.entries {
+		trackedFiles[entry.path] = true
+		for dir := path.Dir(entry.path); dir != "." && !registered[dir]; dir = path.Dir(dir) {
+			registered[dir] = true
+			if _, ok := trackedDirs[dir]; !ok {
+				trackedDirs[dir] = nil
+			}
+			parent := path.Dir(dir)
+			if parent == "." {
+				parent = ""
+			}
+			trackedDirs[parent] = append(trackedDirs[parent], dir)
+		}
+	}
+	matcher := newIgnoreMatcher(repo)
+	cachedDirs := repo.cachedUntrackedDirs(index, matcher)
+	var lock sync.Mutex
+	untracked := make([]string, 0)
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, jobs)
+	var visit func(dir string, ignoreTrusted bool)
+	visit = func(dir string, ignoreTrusted bool) {
+		defer wg.Done()
+		semaphore <- struct{}{}
+		defer func() { <-semaphore }()
+		found := make([]string, 0)
+		fresh, ignoreUnchanged := false, false
+		if ignoreTrusted {
+			fresh, ignoreUnchanged = repo.checkCachedDir(index, cachedDirs[dir], dir)
+		}
+		if fresh {
+			for _, cachedName := range cachedDirs[dir].untracked {
+				name := strings.TrimSuffix(cachedName, "/")
+				entryPath := path.Join(dir, name)
+				if name == cachedName {
+					found = append(found, entryPath)
+				} else if repo.hasUntrackedContent(entryPath, matcher) {
+					// the directory's own stat data does not cover changes deeper down
+					found = append(found, entryPath+"/")
+				}
+			}
+			for _, subdir := range trackedDirs[dir] {
+				wg.Add(1)
+				go visit(subdir, ignoreUnchanged)
+			}
+		} else {
+			entries, err := os.ReadDir(repo.worktreePath(dir))
+			if os.IsNotExist(err) {
+				return
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, entry := range entries {
+				entryPath := path.Join(dir, repo.worktreeName(entry.Name()))
+				// like git, a ".git" file naming the git dir of a submodule is no content
+				if trackedFiles[entryPath] || entry.Name() == ".git" {
+					continue
+				}
+				if entry.IsDir() {
+					if matcher.isIgnored(entryPath, true) {
+						continue
+					}
+					if _, ok := trackedDirs[entryPath]; ok {
+						wg.Add(1)
+						go visit(entryPath, ignoreUnchanged)
+					} else if repo.hasUntrackedContent(entryPath, matcher) {
+						found = append(found, entryPath+"/")
+					}
+				} else if !matcher.isIgnored(entryPath, false) {
+					found = append(found, entryPath)
+				}
+			}
+		}
+		lock.Lock()
+		untracked = append(untracked, found...)
+		lock.Unlock()
+	}
+	wg.Add(1)
+	go visit("", cachedDirs != nil)
+	wg.Wait()
+	sort.Strings(untracked)
+	return untracked
+}
+
+func (repo *Repository) hasUntrackedContent(dir string, matcher *ignoreMatcher) bool {
+	if _, err := os.Lstat(repo.worktreePath(dir + "/.git")); err == nil {
+		// a nested repository always shows up
+		return true
+	}
+	entries, err := os.ReadDir(repo.worktreePath(dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, entry := range entries {
+		entryPath := path.Join(dir, repo.worktreeName(entry.Name()))
+		if matcher.isIgnored(entryPath, entry.IsDir()) {
+			continue
+		}
+		if !entry.IsDir() || repo.hasUntrackedContent(entryPath, matcher) {
+			return true
+		}
+	}
+	return false
+}
+
+func (repo *Repository) printStatus(w io.Writer, status repoStatus, color bool) {
+	if status.branch != "" {
+		fmt.Fprintf(w, "On branch %s\n", status.branch)
+	} else {
+		fmt.Fprintf(w, "HEAD detached at %s\n", status.headHash[:7])
+	}
+	if status.tracking != nil {
+		fmt.Fprintf(w, "%s\n\n", describeTracking(*status.tracking))
+	}
+	if status.headHash == "" {
+		fmt.Fprintf(w, "\nNo commits yet\n\n")
+	}
+	if len(status.unmerged) > 0 {
+		fmt.Fprintf(w, "You have unmerged paths.\n\n")
+	} else if status.merging {
+		fmt.Fprintf(w, "All conflicts fixed but you are still merging.\n\n")
+	}
+	if status.sparse != -1 {
+		fmt.Fprintf(w, "You are in a sparse checkout with %d%% of tracked files present.\n\n", status.sparse)
+	}
+	// labels are padded to the longest one of their kind
+	printChanges := func(title string, changes []statusChange, changeColor string, width int) {
+		if len(changes) == 0 {
+			return
+		}
+		fmt.Fprintln(w, title)
+		for _, change := range changes {
+			line := fmt.Sprintf("%-*s%s", width, change.label+":", quotePath(change.path))
+			if change.submodule.changed() {
+				line += " (" + change.submodule.describe() + ")"
+			}
+			fmt.Fprintf(w, "\t%s\n", colorize(color, changeColor, line))
+		}
+		fmt.Fprintln(w)
+	}
+	printChanges("Changes to be committed:", status.staged, colorGreen, len("typechange: "))
+	printChanges("Unmerged paths:", status.unmerged, colorRed, len("deleted by them: "))
+	printChanges("Changes not staged for commit:", status.unstaged, colorRed, len("typechange: "))
+	if len(status.untracked) > 0 {
+		fmt.Fprintln(w, "Untracked files:")
+		for _, untrackedPath := range status.untracked {
+			fmt.Fprintf(w, "\t%s\n", colorize(color, colorRed, quotePath(untrackedPath)))
+		}
+		fmt.Fprintln(w)
+	}
+	switch {
+	case len(status.staged) > 0:
+	case len(status.unstaged) > 0 || len(status.unmerged) > 0:
+		fmt.Fprintln(w, "no changes added to commit")
+	case len(status.untracked) > 0:
+		fmt.Fprintln(w, "nothing added to commit but untracked files present")
+	default:
+		fmt.Fprintln(w, "nothing to commit, working tree clean")
+	}
+}
+
+var shortStatusCodes = map[string]byte{
+	"new file":   'A',
+	"modified":   'M',
+	"deleted":    'D',
+	"typechange": 'T',
+}
+
+// shortSubmoduleCode is the status --short code of an unstaged change:
+// like git, a submodule with only content changes shows "m" for modified
+// and "?" for untracked content
+func shortSubmoduleCode(change statusChange) byte {
+	switch state := change.submodule; {
+	case !state.changed() || state.newCommits:
+		return shortStatusCodes[change.label]
+	case state.modified:
+		return 'm'
+	}
+	return '?'
+}
+
+// unmergedShortCodes fill both columns of status --short for conflicts
+var unmergedShortCodes = map[string][2]byte{
+	"both deleted":    {'D', 'D'},
+	"added by us":     {'A', 'U'},
+	"deleted by them": {'U', 'D'},
+	"added by them":   {'U', 'A'},
+	"deleted by us":   {'D', 'U'},
+	"both added":      {'A', 'A'},
+	"both modified":   {'U', 'U'},
+}
+
+// printShortStatus prints the "XY <path>" format of status --short, with X
+// the staged and Y the unstaged change of each path
+func (repo *Repository) printShortStatus(status repoStatus, printer pathPrinter) {
+	codes := make(map[string][2]byte)
+	paths := make([]string, 0)
+	record := func(path string, column int, code byte) {
+		entry, ok := codes[path]
+		if !ok {
+			entry = [2]byte{' ', ' '}
+			paths = append(paths, path)
+		}
+		entry[column] = code
+		codes[path] = entry
+	}
+	for _, change := range status.staged {
+		record(change.path, 0, shortStatusCodes[change.label])
+	}
+	for _, change := range status.unstaged {
+		record(change.path, 1, shortSubmoduleCode(change))
+	}
+	for _, change := range status.unmerged {
+		code := unmergedShortCodes[change.label]
+		record(change.path, 0, code[0])
+		record(change.path, 1, code[1])
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		code := codes[path]
+		printer.printRecord(fmt.Sprintf("%c%c %s", code[0], code[1], printer.path(path)))
+	}
+	for _, untrackedPath := range status.untracked {
+		printer.printRecord("?? " + printer.path(untrackedPath))
+	}
+}
+
+type jsonStatusChange struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+}
+
+type jsonTracking struct {
+	Upstream string `json:"upstream"`
+	Gone     bool   `json:"gone,omitempty"`
+	Ahead    int    `json:"ahead"`
+	Behind   int    `json:"behind"`
+}
+
+type jsonStatus struct {
+	Branch    string             `json:"branch,omitempty"`
+	Head      string             `json:"head,omitempty"`
+	Tracking  *jsonTracking      `json:"tracking,omitempty"`
+	Merging   bool               `json:"merging,omitempty"`
+	Staged    []jsonStatusChange `json:"staged"`
+	Unmerged  []jsonStatusChange `json:"unmerged"`
+	Unstaged  []jsonStatusChange `json:"unstaged"`
+	Untracked []string           `json:"untracked"`
+}
+
+func newJSONStatus(status repoStatus) jsonStatus {
+	convert := func(changes []statusChange) []jsonStatusChange {
+		converted := make([]jsonStatusChange, len(changes))
+		for i, change := range changes {
+			converted[i] = jsonStatusChange{change.path, change.label}
+		}
+		return converted
+	}
+	var tracking *jsonTracking
+	if status.tracking != nil {
+		tracking = &jsonTracking{shortRefName(status.tracking.upstream), status.tracking.gone, status.tracking.ahead, status.tracking.behind}
+	}
+	return jsonStatus{
+		Branch:    status.branch,
+		Head:      status.headHash,
+		Tracking:  tracking,
+		Merging:   status.merging,
+		Staged:    convert(status.staged),
+		Unmerged:  convert(status.unmerged),
+		Unstaged:  convert(status.unstaged),
+		Untracked: status.untracked,
+	}
+}
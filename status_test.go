@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestUntrackedFilesBelowNestedTrackedDirectory checks that a fresh
+// untracked cache listing of the root does not hide directories whose
+// tracked files are all in subdirectories
+func TestUntrackedFilesBelowNestedTrackedDirectory(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	repo := newTestRepository(t, RepositoryOptions{})
+	index := &gitIndex{version: 2, entries: make([]indexEntry, 0)}
+	for _, tracked := range []string{"a/b/f1", "top"} {
+		writeWorktreeFile(t, repo, tracked, "tracked\n")
+		index.addEntry(indexEntry{path: tracked, mode: 0100644, hash: hashObject("blob", []byte("tracked\n"))})
+	}
+	workTree, err := filepath.Abs(repo.workTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(workTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := newIgnoreMatcher(repo)
+	// the cache git would write after a status: the root has nothing untracked
+	index.untrackedCache = &untrackedCache{
+		ident:            []byte("Location " + workTree + ", system " + untrackedCacheSystemName() + "\x00"),
+		dirFlags:         untrackedCacheStatusFlags,
+		infoExcludeHash:  repo.ignoreFileHash(index, "", filepath.Join(repo.gitDir, "info", "exclude")),
+		excludesFileHash: repo.ignoreFileHash(index, "", matcher.excludesFile),
+		excludePerDir:    ".gitignore",
+		root:             &untrackedCacheDir{valid: true, stat: statData(info), excludeHash: nullHash},
+	}
+	writeWorktreeFile(t, repo, "a/b/new", "untracked\n")
+	for run := 1; run <= 2; run++ {
+		if got, want := repo.untrackedFiles(index, 2), []string{"a/b/new"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("status %d lists %q as untracked, want %q", run, got, want)
+		}
+	}
+}
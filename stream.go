@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bigFileThreshold is the size above which files are stored and checked
+// out a piece at a time instead of whole in memory, and their blobs are
+// not diffed line by line (core.bigFileThreshold, 512m by default)
+func (repo *Repository) bigFileThreshold() int64 {
+	return repo.config.getInt("core.bigFileThreshold", 512<<20)
+}
+
+// streamsFile tells whether a worktree file is streamed: it is bigger than
+// bigFileThreshold and, as not text and without a filter, stays as it is
+// between blob and file
+func (repo *Repository) streamsFile(relativePath string, size int64) bool {
+	return size > repo.bigFileThreshold() && !repo.textConversionOf(relativePath).text && repo.filterDriver(relativePath) == ""
+}
+
+// hashingWriter feeds what goes through it to a hash on its way to w
+type hashingWriter struct {
+	w      io.Writer
+	hasher hash.Hash
+}
+
+func (writer hashingWriter) Write(data []byte) (int, error) {
+	writer.hasher.Write(data)
+	return writer.w.Write(data)
+}
+
+// copyBlobFile copies the header of a blob of size bytes and then the file
+// to w, returning the id that gives; a file that is not of the size
+// announced is an error, as it changed while being read
+func copyBlobFile(w io.Writer, filePath string, size int64) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha1.New()
+	writer := hashingWriter{w, hasher}
+	fmt.Fprintf(writer, "blob %d\x00", size)
+	copied, err := io.Copy(writer, io.LimitReader(file, size+1))
+	if err != nil {
+		return "", err
+	}
+	if copied != size {
+		return "", fmt.Errorf("fatal: %s changed size while being read", filePath)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashBlobFile returns the id of the blob of a file without reading all of
+// it into memory
+func hashBlobFile(filePath string, size int64) string {
+	hash, err := copyBlobFile(io.Discard, filePath, size)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hash
+}
+
+// writeBlobFile stores a file as it is as a blob, a piece at a time: it is
+// hashed first, so that nothing is compressed for an object that is
+// already there, and hashed again while being compressed to be sure it
+// did not change in between
+func (repo *Repository) writeBlobFile(filePath string, size int64) string {
+	hash := hashBlobFile(filePath, size)
+	if _, ok := repo.looseObjectPath(hash); ok {
+		return hash
+	}
+	repo.storeLooseObject(hash, func(w io.Writer) error {
+		written, err := copyBlobFile(w, filePath, size)
+		if err == nil && written != hash {
+			err = fmt.Errorf("fatal: %s changed while being added", filePath)
+		}
+		return err
+	})
+	return hash
+}
+
+// worktreeBlobHash returns the id of the blob a worktree file would be
+// stored as, streaming files streamsFile selects
+func (repo *Repository) worktreeBlobHash(relativePath string, info os.FileInfo) string {
+	if info.Mode().IsRegular() && repo.streamsFile(relativePath, info.Size()) {
+		return hashBlobFile(repo.worktreePath(relativePath), info.Size())
+	}
+	return hashObject("blob", repo.worktreeBlob(relativePath, info))
+}
+
+// writeWorktreeBlob stores a worktree file as a blob, streaming files
+// streamsFile selects
+func (repo *Repository) writeWorktreeBlob(relativePath string, info os.FileInfo) string {
+	if info.Mode().IsRegular() && repo.streamsFile(relativePath, info.Size()) {
+		return repo.writeBlobFile(repo.worktreePath(relativePath), info.Size())
+	}
+	return repo.writeObject("blob", repo.worktreeBlob(relativePath, info))
+}
+
+// verifyingReader checks, once all of an object was read, that the content
+// has the id it was read by
+type verifyingReader struct {
+	r      io.Reader
+	closer io.Closer
+	hasher hash.Hash
+	hash   string
+	err    error // what reading a damaged object reports
+}
+
+func (reader *verifyingReader) Read(data []byte) (int, error) {
+	count, err := reader.r.Read(data)
+	reader.hasher.Write(data[:count])
+	if err == io.EOF && hex.EncodeToString(reader.hasher.Sum(nil)) != reader.hash {
+		err = reader.err
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = reader.err
+	}
+	return count, err
+}
+
+func (reader *verifyingReader) Close() error {
+	return reader.closer.Close()
+}
+
+// packReaderCloser closes a reader of a packed blob and releases its pack
+type packReaderCloser struct {
+	reader   io.Closer
+	repo     *Repository
+	pack     *packFile
+	released bool
+}
+
+func (closer *packReaderCloser) Close() error {
+	err := closer.reader.Close()
+	if !closer.released {
+		closer.released = true
+		closer.repo.releasePacks([]*packFile{closer.pack})
+	}
+	return err
+}
+
+// openBlob opens a blob for reading it a piece at a time, with its size.
+// Only blobs stored whole can be, as loose objects or undeltified in a
+// pack; ok is false for the others, which readObject reads.
+func (repo *Repository) openBlob(hash string) (io.ReadCloser, int64, bool) {
+	hash = repo.replacementFor(hash)
+	if path, ok := repo.looseObjectPath(hash); ok {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		contentReader, err := zlib.NewReader(bufio.NewReader(file))
+		if err != nil {
+			file.Close()
+			return nil, 0, false
+		}
+		buffered := bufio.NewReader(contentReader)
+		header, err := buffered.ReadString(0)
+		objectType, length, _ := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+		size, sizeErr := strconv.ParseInt(length, 10, 64)
+		if err != nil || sizeErr != nil || objectType != "blob" {
+			// readObject explains what is wrong
+			file.Close()
+			return nil, 0, false
+		}
+		hasher := sha1.New()
+		hasher.Write([]byte(header))
+		return &verifyingReader{io.LimitReader(buffered, size), file, hasher, hash, fmt.Errorf("fatal: loose object %s (stored in %s) is corrupt", hash, path)}, size, true
+	}
+	packs := repo.packFiles()
+	defer repo.releasePacks(packs)
+	for _, pack := range packs {
+		offset, ok := pack.index.findOffset(hash)
+		if !ok {
+			continue
+		}
+		objectType, size, position := pack.readEntryHeader(offset)
+		if objectType != packObjectBlob {
+			return nil, 0, false
+		}
+		contentReader, err := zlib.NewReader(io.NewSectionReader(pack.data, position, 1<<62))
+		if err != nil {
+			return nil, 0, false
+		}
+		hasher := sha1.New()
+		fmt.Fprintf(hasher, "blob %d\x00", size)
+		// the pack stays open until the reader is closed
+		repo.holdPack(pack)
+		closer := &packReaderCloser{contentReader, repo, pack, false}
+		return &verifyingReader{io.LimitReader(contentReader, int64(size)), closer, hasher, hash, fmt.Errorf("fatal: packed object %s (stored in %s.pack) is corrupt", hash, pack.path)}, int64(size), true
+	}
+	return nil, 0, false
+}
+
+// checkoutBlobStream writes a blob streamsFile selects to the worktree a
+// piece at a time; false when it is not one, to be written whole
+func (repo *Repository) checkoutBlobStream(relativePath string, mode uint32, hash string) bool {
+	if mode == fileModeSymlink {
+		return false
+	}
+	reader, size, ok := repo.openBlob(hash)
+	if !ok {
+		return false
+	}
+	defer reader.Close()
+	if !repo.streamsFile(relativePath, size) {
+		return false
+	}
+	permissions := os.FileMode(0666)
+	if mode == fileModeExecutable {
+		permissions = 0777
+	}
+	file, err := os.OpenFile(repo.worktreePath(relativePath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, permissions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writer := bufio.NewWriter(file)
+	_, err = io.Copy(writer, reader)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return true
+}
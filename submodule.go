@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// submoduleState is what a submodule checked out in the worktree has
+// changed against the commit recorded for it
+type submoduleState struct {
+	head       string // the commit checked out, empty when the submodule is not
+	newCommits bool
+	modified   bool // its index or tracked files differ from its HEAD
+	untracked  bool
+}
+
+func (state submoduleState) changed() bool {
+	return state.newCommits || state.modified || state.untracked
+}
+
+// describe lists the changes as status does after the path, e.g. "new
+// commits, modified content"
+func (state submoduleState) describe() string {
+	parts := make([]string, 0, 3)
+	if state.newCommits {
+		parts = append(parts, "new commits")
+	}
+	if state.modified {
+		parts = append(parts, "modified content")
+	}
+	if state.untracked {
+		parts = append(parts, "untracked content")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// openSubmodule opens the repository of the submodule at a path, ok being
+// false when it is not checked out
+func (repo *Repository) openSubmodule(submodulePath string) (*Repository, bool) {
+	dir := repo.worktreePath(submodulePath)
+	gitDir, ok := dotGitDir(dir)
+	if !ok || !isGitDir(gitDir) {
+		return nil, false
+	}
+	gitDir, err := filepath.Abs(gitDir)
+	if err != nil {
+		return nil, false
+	}
+	return OpenRepository(gitDir, RepositoryOptions{WorkTree: dir}), true
+}
+
+// submoduleState finds out how the submodule at a path differs from the
+// recorded commit, one that is not checked out never differing. Like git,
+// submodules of the submodule with changes make it modified.
+func (repo *Repository) submoduleState(submodulePath string, recorded string) submoduleState {
+	var state submoduleState
+	submodule, ok := repo.openSubmodule(submodulePath)
+	if !ok {
+		return state
+	}
+	state.head, ok = submodule.resolveRef("HEAD")
+	if !ok {
+		return state
+	}
+	state.newCommits = state.head != recorded
+	status := submodule.computeStatus(1)
+	state.modified = len(status.staged)+len(status.unmerged)+len(status.unstaged) > 0
+	state.untracked = len(status.untracked) > 0
+	return state
+}
+
+// gitlinkContent is what diffs show for a gitlink, "-dirty" marking a
+// worktree submodule with modified content
+func gitlinkContent(hash string, dirty bool) []byte {
+	if dirty {
+		return []byte("Subproject commit " + hash + "-dirty\n")
+	}
+	return []byte("Subproject commit " + hash + "\n")
+}
+
+// submoduleFormat reads a --submodule value, "true" standing for a bare
+// --submodule, and falls back to diff.submodule when it is empty
+func (repo *Repository) submoduleFormat(value string) string {
+	switch value {
+	case "":
+		configured, ok := repo.config.get("diff.submodule")
+		if !ok || configured == "short" || configured == "log" {
+			return configured
+		}
+		fmt.Fprintf(os.Stderr, "warning: Unknown value for 'diff.submodule' config variable: '%s'\n", configured)
+		return ""
+	case "true":
+		return "log"
+	case "short", "log":
+		return value
+	}
+	log.Fatalf("error: failed to parse --submodule option parameter: '%s'", value)
+	return ""
+}
+
+// writeSubmoduleSummary shows a submodule change as git's --submodule=log
+// does: a "Submodule <path> <old>..<new>:" header, "..." when neither
+// commit contains the other, then the subjects of the commits only the
+// old side has, marked "<", and of those only the new side has, marked
+// ">", following first parents
+func (repo *Repository) writeSubmoduleSummary(w io.Writer, change fileChange, options diffOptions) {
+	colors := options.colors
+	if change.dirty {
+		fmt.Fprintf(w, "Submodule %s contains modified content\n", change.path)
+	}
+	if change.oldHash == change.newHash {
+		return
+	}
+	message := ""
+	switch {
+	case change.oldMode == 0:
+		message = "(new submodule)"
+	case change.newMode == 0:
+		message = "(submodule deleted)"
+	}
+	submodule, ok := repo.openSubmodule(change.path)
+	summarize := ok && message == ""
+	if ok && (change.oldMode != 0 && !submodule.hasObject(change.oldHash) || change.newMode != 0 && !submodule.hasObject(change.newHash)) {
+		message, summarize = "(commits not present)", false
+	} else if !ok && message == "" {
+		message = "(commits not present)"
+	}
+	var inOld, inNew map[string]bool
+	fastForward, fastBackward := false, false
+	if summarize {
+		inOld, inNew = submodule.reachableCommits(change.oldHash), submodule.reachableCommits(change.newHash)
+		fastForward, fastBackward = inNew[change.oldHash], inOld[change.newHash]
+	}
+	dots := "..."
+	if fastForward || fastBackward {
+		dots = ".."
+	}
+	header := fmt.Sprintf("Submodule %s %s%s%s", change.path, abbreviateHash(change.oldHash), dots, abbreviateHash(change.newHash))
+	switch {
+	case message != "":
+		fmt.Fprintf(w, "%s %s\n", header, message)
+	case fastBackward:
+		fmt.Fprintf(w, "%s (rewind):\n", header)
+	default:
+		fmt.Fprintf(w, "%s:\n", header)
+	}
+	if !summarize {
+		return
+	}
+	// the first parent chains of both sides down to what both have, newest
+	// first and the old side first between commits made at the same time
+	chain := func(hash string, other map[string]bool) []string {
+		hashes := make([]string, 0)
+		for hash != "" && !other[hash] {
+			hashes = append(hashes, hash)
+			parents := submodule.readCommitObject(hash).parents
+			hash = ""
+			if len(parents) > 0 {
+				hash = parents[0]
+			}
+		}
+		return hashes
+	}
+	oldOnly, newOnly := chain(change.oldHash, inNew), chain(change.newHash, inOld)
+	for len(oldOnly) > 0 || len(newOnly) > 0 {
+		hash, mark, color := "", '<', colors.old
+		if len(newOnly) == 0 || len(oldOnly) > 0 && !submodule.readCommitObject(newOnly[0]).committer.when.After(submodule.readCommitObject(oldOnly[0]).committer.when) {
+			hash, oldOnly = oldOnly[0], oldOnly[1:]
+		} else {
+			hash, newOnly, mark, color = newOnly[0], newOnly[1:], '>', colors.new
+		}
+		subject, _ := splitCommitMessage(submodule.readCommitObject(hash).commitMessage)
+		fmt.Fprintf(w, "%s  %c %s%s\n", color, mark, subject, colors.reset)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// treeAtPath returns the tree at a directory below tree, "" when there is
+// none
+func (repo *Repository) treeAtPath(tree string, dir string) string {
+	for _, name := range strings.Split(dir, "/") {
+		found := ""
+		for _, entry := range repo.readTreeEntries(tree) {
+			if entry.name == name && entry.mode == "40000" {
+				found = entry.hash
+				break
+			}
+		}
+		if found == "" {
+			return ""
+		}
+		tree = found
+	}
+	return tree
+}
+
+// graftTree writes tree with the directory at dir replaced by subtree,
+// leaving it out when subtree is ""; the directories on the way are
+// created as needed
+func (repo *Repository) graftTree(tree string, dir string, subtree string) string {
+	name, rest, nested := strings.Cut(dir, "/")
+	entries := make([]treeEntry, 0)
+	child := ""
+	if tree != "" {
+		for _, entry := range repo.readTreeEntries(tree) {
+			if entry.name != name {
+				entries = append(entries, entry)
+			} else if entry.mode == "40000" {
+				child = entry.hash
+			}
+		}
+	}
+	if nested {
+		subtree = repo.graftTree(child, rest, subtree)
+	}
+	if subtree != "" && subtree != emptyTreeHash {
+		entries = append(entries, treeEntry{"40000", name, subtree})
+	}
+	return repo.writeObject("tree", serializeTree(entries))
+}
+
+// subtreeDirectory normalizes --prefix as git subtree does, without the
+// slashes it may end in
+func subtreeDirectory(prefix string) string {
+	if prefix == "" {
+		log.Fatal("fatal: you must provide the --prefix option.")
+	}
+	return strings.TrimRight(prefix, "/")
+}
+
+// subtreeMessage is the message of a commit adding or rejoining a subtree,
+// with the trailers split reads back: the directory, the mainline commit
+// the subtree joined and the subtree commit it joined
+func subtreeMessage(subject string, dir string, mainline string, split string) string {
+	return fmt.Sprintf("%s\n\ngit-subtree-dir: %s\ngit-subtree-mainline: %s\ngit-subtree-split: %s\n", subject, dir, mainline, split)
+}
+
+// requireCleanSubtreeWorktree stops unless the index and the worktree
+// are as HEAD has them
+func (repo *Repository) requireCleanSubtreeWorktree(index *gitIndex, head string, action string) {
+	if len(repo.worktreeChanges(index)) > 0 || len(repo.stagedChanges(index, head)) > 0 {
+		log.Fatalf("fatal: working tree has modifications.  Cannot %s.", action)
+	}
+}
+
+// subtreeAdd grafts the tree of commit into dir with a merge commit of
+// HEAD and it, keeping the history of commit. With rejoin, for split
+// --rejoin, commit is already there and the tree of HEAD is kept.
+func (repo *Repository) subtreeAdd(dir string, commit string, message string, rejoin bool) {
+	head, ok := repo.resolveRef("HEAD")
+	if !ok {
+		log.Fatal("fatal: HEAD does not point to a commit")
+	}
+	index := repo.lockIndex()
+	repo.requireCleanSubtreeWorktree(index, head, "add")
+	headTree := repo.readCommitObject(head).tree
+	tree := headTree
+	if !rejoin {
+		if _, err := os.Lstat(repo.worktreePath(dir)); err == nil {
+			log.Fatalf("fatal: prefix '%s' already exists.", dir)
+		}
+		tree = repo.graftTree(headTree, dir, repo.readCommitObject(commit).tree)
+	}
+	if message == "" {
+		message = subtreeMessage(fmt.Sprintf("Add '%s/' from commit '%s'", dir, commit), dir, head, commit)
+	} else if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	parents := []string{head, commit}
+	if head == commit {
+		parents = parents[1:]
+	}
+	subject, _ := splitCommitMessage(message)
+	repo.updateHead(repo.createCommit(tree, parents, message), "subtree add: "+subject)
+	repo.resetToTree(index, tree)
+	repo.releaseIndex(index)
+	fmt.Fprintf(os.Stderr, "Added dir '%s'\n", dir)
+}
+
+// subtreeMerge merges commit, a later commit of the history added at dir,
+// into the subtree: the changes from the merge base to commit go into dir
+func (repo *Repository) subtreeMerge(dir string, commit string, message string, quiet bool) bool {
+	head, ok := repo.resolveRef("HEAD")
+	if !ok {
+		log.Fatal("fatal: HEAD does not point to a commit")
+	}
+	index := repo.lockIndex()
+	repo.requireCleanSubtreeWorktree(index, head, "merge")
+	base, ok := repo.mergeBase(head, commit)
+	if !ok {
+		log.Fatal("fatal: refusing to merge unrelated histories")
+	}
+	if base == commit {
+		repo.releaseIndex(index)
+		if !quiet {
+			fmt.Println("Already up to date.")
+		}
+		return true
+	}
+	if message == "" {
+		message = fmt.Sprintf("Merge commit '%s'\n", commit)
+	} else if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	headTree := repo.readCommitObject(head).tree
+	baseTree := repo.graftTree(headTree, dir, repo.readCommitObject(base).tree)
+	upstreamTree := repo.graftTree(headTree, dir, repo.readCommitObject(commit).tree)
+	repo.writeOrigHead(head)
+	merged := repo.mergeTreesInto(index, head, commit, baseTree, upstreamTree, false, mergeLabels{base: abbreviateHash(base), ours: "HEAD", theirs: commit}, message, "subtree merge", quiet)
+	repo.releaseIndex(index)
+	if merged != "" && !quiet {
+		repo.writeMergeStat(headTree, merged)
+	}
+	return merged != ""
+}
+
+// subtreeSplits reads the commits add and split --rejoin made for dir in
+// the history of rev, mapping the mainline and subtree commits each one
+// joined to that subtree commit, as the history split goes on from
+func (repo *Repository) subtreeSplits(dir string, rev string) map[string]string {
+	splits := make(map[string]string)
+	iter := newCommitIter(repo, []string{rev}, commitOrderDate, false)
+	for {
+		_, commit, ok := iter.next()
+		if !ok {
+			return splits
+		}
+		mainline, split, joined := "", "", false
+		for _, line := range strings.Split(commit.commitMessage, "\n") {
+			key, value, _ := strings.Cut(line, " ")
+			switch key {
+			case "git-subtree-dir:":
+				joined = strings.TrimRight(value, "/") == dir
+			case "git-subtree-mainline:":
+				mainline = value
+			case "git-subtree-split:":
+				split = value
+			}
+		}
+		if joined && mainline != "" && split != "" && repo.hasObject(split) {
+			splits[mainline] = split
+			splits[split] = split
+		}
+	}
+}
+
+// subtreeSplit extracts the history of dir up to rev as a history of its
+// own, whose commits have the trees of dir, and returns its last commit.
+// Commits not changing dir are left out, commits already split or added
+// stand for themselves, so that splitting again gives the same commits,
+// and the commits of the added history, which have no dir, are kept.
+func (repo *Repository) subtreeSplit(dir string, rev string) (string, string) {
+	split := repo.subtreeSplits(dir, rev)
+	follow := func(hash string, commit commitObject) []string {
+		parents := make([]string, 0, len(commit.parents))
+		for _, parent := range commit.parents {
+			if _, done := split[parent]; !done {
+				parents = append(parents, parent)
+			}
+		}
+		return parents
+	}
+	latestNew, latestOld := "", ""
+	iter := newSimplifiedCommitIter(repo, []string{rev}, commitOrderTopo, true, follow)
+	for {
+		hash, commit, ok := iter.next()
+		if !ok {
+			break
+		}
+		if _, done := split[hash]; done {
+			continue
+		}
+		parents := make([]string, 0, len(commit.parents))
+		for _, parent := range commit.parents {
+			if rewritten, ok := split[parent]; ok {
+				parents = append(parents, rewritten)
+			}
+		}
+		tree := repo.treeAtPath(commit.tree, dir)
+		if tree == "" {
+			if len(parents) > 0 {
+				split[hash] = hash
+			}
+			continue
+		}
+		split[hash] = repo.copyOrSkipSplit(commit, tree, parents)
+		latestNew, latestOld = split[hash], hash
+	}
+	return latestNew, latestOld
+}
+
+// copyOrSkipSplit returns the split commit with tree on top of parents: a
+// parent with the same tree when nothing else is brought in through the
+// others, otherwise a copy of commit with its author, committer and message
+func (repo *Repository) copyOrSkipSplit(commit commitObject, tree string, parents []string) string {
+	identical, nonidentical := "", ""
+	kept := make([]string, 0, len(parents))
+	copied := false
+	for _, parent := range parents {
+		if repo.readCommitObject(parent).tree == tree {
+			if identical == "" {
+				identical = parent
+			} else if base, _ := repo.mergeBase(identical, parent); base == identical {
+				identical = parent
+			}
+		} else {
+			nonidentical = parent
+		}
+		duplicate := false
+		for _, other := range kept {
+			duplicate = duplicate || other == parent
+		}
+		if !duplicate {
+			kept = append(kept, parent)
+		}
+	}
+	if identical != "" && nonidentical != "" && !repo.isAncestor(nonidentical, identical) {
+		// the other side has history of its own to keep
+		copied = true
+	}
+	if identical != "" && !copied {
+		return identical
+	}
+	return repo.writeObject("commit", serializeCommit(commitObject{
+		tree:          tree,
+		parents:       kept,
+		author:        commit.author,
+		committer:     commit.committer,
+		commitMessage: commit.commitMessage,
+	}))
+}
+
+// subtreeSplitBranch points branch at the split commit, refusing to move
+// it anywhere but forward
+func (repo *Repository) subtreeSplitBranch(branch string, split string) {
+	ref := "refs/heads/" + branch
+	action := "Created"
+	if old, ok := repo.resolveRef(ref); ok {
+		if !repo.isAncestor(old, split) {
+			log.Fatalf("fatal: branch '%s' is not an ancestor of commit '%s'.", branch, split)
+		}
+		action = "Updated"
+	}
+	repo.updateRefLogged(ref, split, "subtree split")
+	fmt.Fprintf(os.Stderr, "%s branch '%s'\n", action, branch)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// listTags prints the names of the tags matching one of the patterns, or
+// all of them without patterns, that the filter passes
+func (repo *Repository) listTags(w io.Writer, patterns []string, filter *refFilter) {
+	for _, ref := range repo.listRefs("refs/tags/") {
+		name := strings.TrimPrefix(ref, "refs/tags/")
+		matched := len(patterns) == 0
+		for _, pattern := range patterns {
+			matched = matched || wildmatch(pattern, name, false)
+		}
+		if !matched {
+			continue
+		}
+		if hash, ok := repo.resolveRef(ref); ok && repo.matchesRefFilter(filter, hash) {
+			fmt.Fprintln(w, name)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// isTerminal falls back to the file mode, which also counts other
+// character devices such as /dev/null as terminals
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceKey is a trace destination configured by an environment variable
+// the way git does: "1", "2" or "true" trace to stderr, an absolute path
+// appends to that file, another small number names a file descriptor and
+// "0", "false" or an empty value disable it
+type traceKey struct {
+	envName string
+	once    sync.Once
+	mutex   sync.Mutex
+	out     io.Writer
+}
+
+var (
+	traceGeneral     = &traceKey{envName: "GIT_TRACE"}
+	tracePerformance = &traceKey{envName: "GIT_TRACE_PERFORMANCE"}
+	// newline-delimited JSON events for tools collecting telemetry
+	traceEvents = &traceKey{envName: "GIT_TRACE2_EVENT"}
+)
+
+var traceStart = time.Now()
+
+func (key *traceKey) writer() io.Writer {
+	key.once.Do(func() {
+		value := os.Getenv(key.envName)
+		switch strings.ToLower(value) {
+		case "", "0", "false":
+			return
+		case "1", "2", "true":
+			key.out = os.Stderr
+			return
+		}
+		if filepath.IsAbs(value) {
+			file, err := os.OpenFile(value, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: could not open '%s' for tracing: %s\n", value, err)
+				return
+			}
+			key.out = file
+			return
+		}
+		if fd, err := strconv.Atoi(value); err == nil && fd > 2 && fd < 10 {
+			key.out = os.NewFile(uintptr(fd), key.envName)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "warning: unknown trace value for '%s': %s\n", key.envName, value)
+	})
+	return key.out
+}
+
+func (key *traceKey) enabled() bool {
+	return key.writer() != nil
+}
+
+// printf writes one trace line prefixed with the time of day
+func (key *traceKey) printf(format string, args ...interface{}) {
+	out := key.writer()
+	if out == nil {
+		return
+	}
+	line := time.Now().Format("15:04:05.000000") + " trace: " + fmt.Sprintf(format, args...) + "\n"
+	key.mutex.Lock()
+	defer key.mutex.Unlock()
+	io.WriteString(out, line)
+}
+
+// traceEvent writes a JSON event with the common fields added
+func traceEvent(event string, fields map[string]interface{}) {
+	out := traceEvents.writer()
+	if out == nil {
+		return
+	}
+	fields["event"] = event
+	fields["pid"] = os.Getpid()
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	fields["t_abs"] = time.Since(traceStart).Seconds()
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	traceEvents.mutex.Lock()
+	defer traceEvents.mutex.Unlock()
+	out.Write(append(line, '\n'))
+}
+
+func trace(format string, args ...interface{}) {
+	traceGeneral.printf(format, args...)
+}
+
+// traceRunCommand records a child process about to be started
+func traceRunCommand(argv []string) {
+	trace("run_command: %s", quoteCommandLine(argv))
+	traceEvent("child_start", map[string]interface{}{"argv": argv})
+}
+
+// traceRegion starts timing a phase of a command; the returned function
+// ends it and reports the elapsed time
+func traceRegion(name string) func() {
+	if !tracePerformance.enabled() && !traceEvents.enabled() {
+		return func() {}
+	}
+	start := time.Now()
+	traceEvent("region_enter", map[string]interface{}{"label": name})
+	return func() {
+		elapsed := time.Since(start)
+		tracePerformance.printf("performance: %.9f s: %s", elapsed.Seconds(), name)
+		traceEvent("region_leave", map[string]interface{}{"label": name, "t_rel": elapsed.Seconds()})
+	}
+}
+
+// quoteCommandLine formats argv for trace output, quoting arguments that
+// contain shell metacharacters
+func quoteCommandLine(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`*?[]{}()<>|&;#~") {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		} else {
+			quoted[i] = arg
+		}
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// trailerItem is a line of a message's trailer block: a "token: value"
+// trailer, with any continuation lines in its value, or a line that is
+// not a trailer when token is empty
+type trailerItem struct {
+	token string
+	value string
+}
+
+func (item trailerItem) String() string {
+	if item.token == "" {
+		return item.value
+	}
+	return item.token + ": " + item.value
+}
+
+// messageTrailers is a message split around its trailer block
+type messageTrailers struct {
+	head  string // the message up to the trailer block
+	items []trailerItem
+	found bool   // whether the message had a trailer block
+	tail  string // blank and comment lines after the block, and the patch of a mail
+}
+
+// trailerArgument is a trailer to add with the placement rules it was
+// given with
+type trailerArgument struct {
+	item      trailerItem
+	where     string // "end", "start", "after" or "before"
+	ifExists  string // "addIfDifferentNeighbor", "addIfDifferent", "add", "replace" or "doNothing"
+	ifMissing string // "add" or "doNothing"
+}
+
+type trailerOptions struct {
+	trailers     []trailerArgument
+	trimEmpty    bool
+	onlyTrailers bool
+	onlyInput    bool
+	unfold       bool
+}
+
+// trailerSeparator returns the position of the separator after a token
+// only made of letters, digits and "-", -1 when line is no trailer
+func trailerSeparator(line string, separators string) int {
+	whitespace := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if strings.IndexByte(separators, c) != -1 {
+			return i
+		}
+		if !whitespace && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			continue
+		}
+		if i > 0 && (c == ' ' || c == '\t') {
+			whitespace = true
+			continue
+		}
+		break
+	}
+	return -1
+}
+
+// parseTrailerLine splits "token<separator>value" with both sides trimmed
+func parseTrailerLine(line string, separators string) (trailerItem, bool) {
+	separator := trailerSeparator(line, separators)
+	if separator < 1 {
+		return trailerItem{}, false
+	}
+	return trailerItem{strings.TrimSpace(line[:separator]), strings.TrimSpace(line[separator+1:])}, true
+}
+
+// isGeneratedTrailer tells trailers git itself writes, which mark a
+// paragraph as trailers even among other lines
+func isGeneratedTrailer(line string) bool {
+	return strings.HasPrefix(line, "Signed-off-by: ") || strings.HasPrefix(line, "(cherry picked from commit ")
+}
+
+func (repo *Repository) trailerSeparators() string {
+	if separators, ok := repo.config.get("trailer.separators"); ok && separators != "" {
+		return separators
+	}
+	return ":"
+}
+
+// parseTrailers finds the trailer block of a message: its last paragraph,
+// not counting the subject, when it only holds trailers, or at least a
+// quarter trailers of which one is written by git. The message ends at
+// a "---" line, and trailing blank and comment lines are not part of it.
+func (repo *Repository) parseTrailers(message string) messageTrailers {
+	separators := repo.trailerSeparators()
+	lines := strings.SplitAfter(message, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	end := len(lines)
+	for i, line := range lines {
+		if strings.HasPrefix(line, "---") && (len(line) == 3 || line[3] == ' ' || line[3] == '\t' || line[3] == '\n') {
+			end = i
+			break
+		}
+	}
+	for end > 0 && (strings.TrimSpace(lines[end-1]) == "" || strings.HasPrefix(lines[end-1], "#")) {
+		end--
+	}
+	start := end
+	for start > 0 && strings.TrimSpace(lines[start-1]) != "" {
+		start--
+	}
+
+	result := messageTrailers{head: strings.Join(lines[:end], ""), tail: strings.Join(lines[end:], "")}
+	if start == 0 {
+		// the first paragraph is the subject
+		return result
+	}
+	items := make([]trailerItem, 0)
+	trailerLines, otherLines, generated := 0, 0, false
+	for _, line := range lines[start:end] {
+		text := strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(text, "#"):
+			continue
+		case (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) && len(items) > 0 && items[len(items)-1].token != "":
+			items[len(items)-1].value += "\n" + text
+			continue
+		}
+		if isGeneratedTrailer(text) {
+			generated = true
+		}
+		if item, ok := parseTrailerLine(text, separators); ok {
+			items = append(items, item)
+			trailerLines++
+		} else {
+			items = append(items, trailerItem{value: text})
+			otherLines++
+		}
+	}
+	if trailerLines == 0 || otherLines > 0 && !(generated && trailerLines*3 >= otherLines) {
+		return result
+	}
+	result.head = strings.Join(lines[:start], "")
+	result.items = items
+	result.found = true
+	return result
+}
+
+// trailerArgumentItem reads a --trailer value, "token=value" or
+// "token: value", and renames the token after trailer.<name>.key
+func (repo *Repository) trailerArgumentItem(argument string) trailerItem {
+	item, ok := parseTrailerLine(argument, "="+repo.trailerSeparators())
+	if !ok {
+		item = trailerItem{token: strings.TrimSpace(argument)}
+	}
+	if item.token == "" {
+		log.Fatalf("fatal: empty trailer token in trailer '%s'", argument)
+	}
+	for _, entry := range repo.config.allEntries() {
+		if !strings.HasPrefix(entry.key, "trailer.") || !strings.HasSuffix(entry.key, ".key") {
+			continue
+		}
+		if name := strings.TrimSuffix(strings.TrimPrefix(entry.key, "trailer."), ".key"); strings.EqualFold(name, item.token) {
+			item.token = strings.TrimRight(strings.TrimSpace(entry.value), repo.trailerSeparators())
+		}
+	}
+	return item
+}
+
+// addTrailer applies one --trailer to the items following its where,
+// ifExists and ifMissing rules
+func addTrailer(items []trailerItem, argument trailerArgument) []trailerItem {
+	first, last := -1, -1
+	for i, item := range items {
+		if item.token != "" && strings.EqualFold(item.token, argument.item.token) {
+			if first == -1 {
+				first = i
+			}
+			last = i
+		}
+	}
+	position := len(items)
+	neighbor := len(items) - 1
+	switch argument.where {
+	case "start":
+		position, neighbor = 0, 0
+	case "after":
+		if last != -1 {
+			position, neighbor = last+1, last
+		}
+	case "before":
+		if first != -1 {
+			position, neighbor = first, first
+		} else {
+			position, neighbor = 0, 0
+		}
+	}
+	insert := func(at int) []trailerItem {
+		items = append(items, trailerItem{})
+		copy(items[at+1:], items[at:])
+		items[at] = argument.item
+		return items
+	}
+	if first == -1 {
+		if argument.ifMissing == "doNothing" {
+			return items
+		}
+		return insert(position)
+	}
+	same := func(item trailerItem) bool {
+		return strings.EqualFold(item.token, argument.item.token) && item.value == argument.item.value
+	}
+	switch argument.ifExists {
+	case "doNothing":
+		return items
+	case "addIfDifferent":
+		for _, item := range items {
+			if same(item) {
+				return items
+			}
+		}
+	case "addIfDifferentNeighbor":
+		if neighbor >= 0 && neighbor < len(items) && same(items[neighbor]) {
+			return items
+		}
+	case "replace":
+		replaced := last
+		if argument.where == "start" || argument.where == "before" {
+			replaced = first
+		}
+		items = append(items[:replaced], items[replaced+1:]...)
+		if position > replaced {
+			position--
+		}
+	}
+	return insert(position)
+}
+
+// interpretTrailers adds the trailers of options to message and formats
+// its trailer block as "git interpret-trailers" does
+func (repo *Repository) interpretTrailers(message string, options trailerOptions) string {
+	parsed := repo.parseTrailers(message)
+	items := parsed.items
+	if !options.onlyInput {
+		for _, argument := range options.trailers {
+			items = addTrailer(items, argument)
+		}
+	}
+
+	var output strings.Builder
+	if !options.onlyTrailers {
+		output.WriteString(parsed.head)
+		if !parsed.found && len(items) > 0 {
+			output.WriteString("\n")
+		}
+	}
+	for _, item := range items {
+		if item.token == "" && options.onlyTrailers {
+			continue
+		}
+		if item.token != "" && item.value == "" && options.trimEmpty {
+			continue
+		}
+		if options.unfold {
+			lines := strings.Split(item.value, "\n")
+			for i := range lines {
+				lines[i] = strings.TrimSpace(lines[i])
+			}
+			item.value = strings.Join(lines, " ")
+		}
+		fmt.Fprintln(&output, item)
+	}
+	if !options.onlyTrailers {
+		output.WriteString(parsed.tail)
+	}
+	return output.String()
+}
+
+// appendSignoff adds "Signed-off-by: <identity>" to a commit message
+// unless it already ends with that trailer
+func (repo *Repository) appendSignoff(message string) string {
+	signoff := repo.currentIdentity("COMMITTER").nameAndEmail()
+	return repo.interpretTrailers(message, trailerOptions{trailers: []trailerArgument{{
+		item:      trailerItem{token: "Signed-off-by", value: signoff},
+		where:     "end",
+		ifExists:  "addIfDifferentNeighbor",
+		ifMissing: "add",
+	}}})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	statDataLength = 36
+	// DIR_SHOW_OTHER_DIRECTORIES | DIR_HIDE_EMPTY_DIRECTORIES, the flags
+	// status scans with; caches built with other flags list other things
+	untrackedCacheStatusFlags = 0x6
+)
+
+var nullHash = strings.Repeat("0", 2*ObjectShaLength)
+
+// untrackedCache mirrors the UNTR index extension: the untracked entries
+// of each directory as of a previous scan, valid while the directory's stat
+// data and the ignore files that apply to it are unchanged
+type untrackedCache struct {
+	ident            []byte // "Location <worktree>, system <os>\0"
+	infoExcludeStat  []byte
+	excludesFileStat []byte
+	dirFlags         uint32
+	infoExcludeHash  string
+	excludesFileHash string
+	excludePerDir    string
+	root             *untrackedCacheDir
+}
+
+type untrackedCacheDir struct {
+	name        string
+	untracked   []string // directories carry a trailing "/"
+	dirs        []*untrackedCacheDir
+	valid       bool
+	checkOnly   bool
+	stat        []byte // stat data of the directory, when valid
+	excludeHash string // hash of the directory's .gitignore, nullHash when absent
+}
+
+func parseUntrackedCache(data []byte) *untrackedCache {
+	// format:
+	// <varint ident length> <ident> <stat of info/exclude> <stat of core.excludesFile>
+	// <4-byte dir flags> <hash of info/exclude> <hash of core.excludesFile>
+	// <per-dir exclude file name>\0 <varint dir count> <dir blocks, depth-first>
+	// <valid ewah> <check-only ewah> <hash-valid ewah> <stat data> <hashes> \0
+	cache := &untrackedCache{}
+	identLength, position := readVarint(data, 0)
+	cache.ident = data[position : position+identLength]
+	position += identLength
+	cache.infoExcludeStat = data[position : position+statDataLength]
+	cache.excludesFileStat = data[position+statDataLength : position+2*statDataLength]
+	position += 2 * statDataLength
+	cache.dirFlags = binary.BigEndian.Uint32(data[position:])
+	position += 4
+	cache.infoExcludeHash = hex.EncodeToString(data[position : position+ObjectShaLength])
+	cache.excludesFileHash = hex.EncodeToString(data[position+ObjectShaLength : position+2*ObjectShaLength])
+	position += 2 * ObjectShaLength
+	nameEnd := bytes.IndexByte(data[position:], 0)
+	cache.excludePerDir = string(data[position : position+nameEnd])
+	position += nameEnd + 1
+	dirCount, position := readVarint(data, position)
+	if dirCount == 0 {
+		return cache
+	}
+	dirs := make([]*untrackedCacheDir, 0, dirCount)
+	cache.root, position = parseUntrackedCacheDir(data, position, &dirs)
+	if len(dirs) != dirCount {
+		log.Fatal("fatal: index file corrupt: bad untracked cache directory count")
+	}
+	validBits, position := readEwahBitmap(data, position)
+	checkOnlyBits, position := readEwahBitmap(data, position)
+	hashValidBits, position := readEwahBitmap(data, position)
+	for _, bit := range validBits {
+		dirs[bit].valid = true
+		dirs[bit].stat = data[position : position+statDataLength]
+		position += statDataLength
+	}
+	for _, bit := range checkOnlyBits {
+		dirs[bit].checkOnly = true
+	}
+	for _, dir := range dirs {
+		dir.excludeHash = nullHash
+	}
+	for _, bit := range hashValidBits {
+		dirs[bit].excludeHash = hex.EncodeToString(data[position : position+ObjectShaLength])
+		position += ObjectShaLength
+	}
+	return cache
+}
+
+func parseUntrackedCacheDir(data []byte, position int, dirs *[]*untrackedCacheDir) (*untrackedCacheDir, int) {
+	// block format: <varint untracked count> <varint subdir count> <name>\0 <untracked names>\0...
+	dir := &untrackedCacheDir{}
+	*dirs = append(*dirs, dir)
+	untrackedCount, position := readVarint(data, position)
+	subdirCount, position := readVarint(data, position)
+	nameEnd := bytes.IndexByte(data[position:], 0)
+	dir.name = string(data[position : position+nameEnd])
+	position += nameEnd + 1
+	for i := 0; i < untrackedCount; i++ {
+		nameEnd = bytes.IndexByte(data[position:], 0)
+		dir.untracked = append(dir.untracked, string(data[position:position+nameEnd]))
+		position += nameEnd + 1
+	}
+	for i := 0; i < subdirCount; i++ {
+		var subdir *untrackedCacheDir
+		subdir, position = parseUntrackedCacheDir(data, position, dirs)
+		dir.dirs = append(dir.dirs, subdir)
+	}
+	return dir, position
+}
+
+func (cache *untrackedCache) serialize() []byte {
+	buffer := appendVarint(nil, len(cache.ident))
+	buffer = append(buffer, cache.ident...)
+	buffer = append(buffer, cache.infoExcludeStat...)
+	buffer = append(buffer, cache.excludesFileStat...)
+	buffer = binary.BigEndian.AppendUint32(buffer, cache.dirFlags)
+	for _, hash := range []string{cache.infoExcludeHash, cache.excludesFileHash} {
+		hashBytes, _ := hex.DecodeString(hash)
+		buffer = append(buffer, hashBytes...)
+	}
+	buffer = append(buffer, cache.excludePerDir...)
+	buffer = append(buffer, 0)
+	if cache.root == nil {
+		return appendVarint(buffer, 0)
+	}
+	dirs := make([]*untrackedCacheDir, 0)
+	var blocks []byte
+	var writeDir func(dir *untrackedCacheDir)
+	writeDir = func(dir *untrackedCacheDir) {
+		dirs = append(dirs, dir)
+		if !dir.valid {
+			dir.untracked = nil
+			dir.checkOnly = false
+		}
+		blocks = appendVarint(blocks, len(dir.untracked))
+		blocks = appendVarint(blocks, len(dir.dirs))
+		blocks = append(blocks, dir.name...)
+		blocks = append(blocks, 0)
+		for _, name := range dir.untracked {
+			blocks = append(blocks, name...)
+			blocks = append(blocks, 0)
+		}
+		for _, subdir := range dir.dirs {
+			writeDir(subdir)
+		}
+	}
+	writeDir(cache.root)
+	buffer = appendVarint(buffer, len(dirs))
+	buffer = append(buffer, blocks...)
+	var validBits, checkOnlyBits, hashValidBits []int
+	var stats, hashes []byte
+	for i, dir := range dirs {
+		if dir.valid {
+			validBits = append(validBits, i)
+			stats = append(stats, dir.stat...)
+		}
+		if dir.checkOnly {
+			checkOnlyBits = append(checkOnlyBits, i)
+		}
+		if dir.excludeHash != nullHash {
+			hashValidBits = append(hashValidBits, i)
+			hashBytes, _ := hex.DecodeString(dir.excludeHash)
+			hashes = append(hashes, hashBytes...)
+		}
+	}
+	buffer = appendEwahBitmap(buffer, validBits)
+	buffer = appendEwahBitmap(buffer, checkOnlyBits)
+	buffer = appendEwahBitmap(buffer, hashValidBits)
+	buffer = append(buffer, stats...)
+	buffer = append(buffer, hashes...)
+	return append(buffer, 0)
+}
+
+// invalidatePath forgets the cached lists of every directory on the way to
+// a path whose tracked state changed
+func (cache *untrackedCache) invalidatePath(components []string) {
+	dir := cache.root
+	for i := 0; dir != nil; i++ {
+		dir.valid = false
+		dir.untracked = nil
+		if i == len(components)-1 {
+			return
+		}
+		var next *untrackedCacheDir
+		for _, subdir := range dir.dirs {
+			if subdir.name == components[i] {
+				next = subdir
+			}
+		}
+		dir = next
+	}
+}
+
+func statData(info os.FileInfo) []byte {
+	var entry indexEntry
+	entry.fillStat(info)
+	data := make([]byte, 0, statDataLength)
+	for _, field := range []uint32{entry.ctimeSeconds, entry.ctimeNanoseconds, entry.mtimeSeconds,
+		entry.mtimeNanoseconds, entry.dev, entry.ino, entry.uid, entry.gid, entry.size} {
+		data = binary.BigEndian.AppendUint32(data, field)
+	}
+	return data
+}
+
+// ignoreFileHash identifies the content of an ignore file the way git
+// records it in the cache: nullHash when missing, the index hash for an
+// up-to-date tracked file, and otherwise the content with the newline git
+// appends when parsing it
+func (repo *Repository) ignoreFileHash(index *gitIndex, relativePath string, filePath string) string {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nullHash
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info.Size() == 0 {
+		return hashObject("blob", nil)
+	}
+	if relativePath != "" {
+		if position, ok := index.find(relativePath); ok && index.entries[position].stage() == 0 && index.isUpToDate(index.entries[position], info) {
+			return index.entries[position].hash
+		}
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hashObject("blob", append(content, '\n'))
+}
+
+func untrackedCacheSystemName() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "Linux"
+	case "darwin":
+		return "Darwin"
+	case "freebsd":
+		return "FreeBSD"
+	}
+	return runtime.GOOS
+}
+
+// cachedUntrackedDirs returns the cache's directories keyed by path when
+// the cache was built for this worktree with status' flags and the global
+// ignore files are unchanged; nil otherwise
+func (repo *Repository) cachedUntrackedDirs(index *gitIndex, matcher *ignoreMatcher) map[string]*untrackedCacheDir {
+	cache := index.untrackedCache
+	if cache == nil || cache.root == nil || cache.dirFlags != untrackedCacheStatusFlags || cache.excludePerDir != ".gitignore" {
+		return nil
+	}
+	workTree, err := filepath.Abs(repo.workTree)
+	if err != nil {
+		return nil
+	}
+	ident := "Location " + workTree + ", system " + untrackedCacheSystemName()
+	if string(bytes.SplitN(cache.ident, []byte{0}, 2)[0]) != ident {
+		return nil
+	}
+	if repo.ignoreFileHash(index, "", filepath.Join(repo.gitDir, "info", "exclude")) != cache.infoExcludeHash ||
+		repo.ignoreFileHash(index, "", matcher.excludesFile) != cache.excludesFileHash {
+		return nil
+	}
+	dirs := make(map[string]*untrackedCacheDir)
+	var collect func(dir *untrackedCacheDir, dirPath string)
+	collect = func(dir *untrackedCacheDir, dirPath string) {
+		dirs[dirPath] = dir
+		for _, subdir := range dir.dirs {
+			collect(subdir, path.Join(dirPath, subdir.name))
+		}
+	}
+	collect(cache.root, "")
+	return dirs
+}
+
+// checkCachedDir reports whether a cached directory listing can be used as
+// is, which needs the directory itself and its .gitignore to be unchanged;
+// ignoreUnchanged alone decides whether subdirectories may trust theirs
+func (repo *Repository) checkCachedDir(index *gitIndex, dir *untrackedCacheDir, dirPath string) (fresh bool, ignoreUnchanged bool) {
+	if dir == nil {
+		return false, false
+	}
+	ignorePath := path.Join(dirPath, ".gitignore")
+	if repo.ignoreFileHash(index, ignorePath, repo.worktreePath(ignorePath)) != dir.excludeHash {
+		return false, false
+	}
+	if !dir.valid || dir.checkOnly {
+		return false, true
+	}
+	info, err := os.Lstat(repo.worktreePath(dirPath))
+	if err != nil || !bytes.Equal(statData(info), dir.stat) {
+		return false, true
+	}
+	// a directory modified right before the index was written is racy
+	if !index.modTime.IsZero() && !info.ModTime().Before(index.modTime) {
+		return false, true
+	}
+	return true, true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// indexCacheInfo is an entry --cacheinfo stages without a worktree file
+type indexCacheInfo struct {
+	mode uint32
+	hash string
+	path string
+}
+
+type updateIndexOptions struct {
+	add         bool // let paths not in the index yet be added
+	remove      bool // drop the entries of paths gone from the worktree
+	forceRemove bool // drop the entries of paths even if they exist
+	chmod       byte // '+' or '-' to set or clear the executable bit of the paths
+	refresh     bool
+	quiet       bool // refresh without complaining about entries that need an update
+	cacheInfo   []indexCacheInfo
+
+	// '+' or '-' to set or clear the bits of the paths' entries, which are
+	// then only marked
+	assumeUnchanged byte
+	skipWorktree    byte
+}
+
+// parseIndexCacheInfo reads a --cacheinfo "<mode>,<object>,<path>" value
+func parseIndexCacheInfo(value string) (indexCacheInfo, bool) {
+	fields := strings.SplitN(value, ",", 3)
+	if len(fields) != 3 || !isFullHash(fields[1]) {
+		return indexCacheInfo{}, false
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return indexCacheInfo{}, false
+	}
+	return indexCacheInfo{canonicalIndexMode(uint32(mode)), fields[1], fields[2]}, true
+}
+
+// canonicalIndexMode turns a mode into one the index holds, as git does:
+// regular files keep only whether they are executable and directories
+// are taken for gitlinks
+func canonicalIndexMode(mode uint32) uint32 {
+	switch mode & 0170000 {
+	case fileModeSymlink:
+		return fileModeSymlink
+	case fileModeTree, fileModeGitlink:
+		return fileModeGitlink
+	}
+	if mode&0100 != 0 {
+		return fileModeExecutable
+	}
+	return fileModeRegular
+}
+
+// updateIndex stages entries and worktree paths the way git update-index
+// does: a path is hashed from the worktree, only added with --add and only
+// dropped when it is gone with --remove. The cacheinfo entries come first
+// and --refresh last; it returns 1 when refreshing found entries that need
+// an update. Paths given with --[no-]assume-unchanged or
+// --[no-]skip-worktree only have their entries marked.
+func (repo *Repository) updateIndex(w io.Writer, paths []string, options updateIndexOptions) int {
+	index := repo.lockIndex()
+	for _, info := range options.cacheInfo {
+		if !repo.isValidIndexPath(info.path) {
+			fmt.Fprintf(os.Stderr, "error: Invalid path '%s'\n", info.path)
+			log.Fatalf("fatal: git update-index: --cacheinfo cannot add %s", info.path)
+		}
+		if _, tracked := index.find(info.path); !tracked && !options.add {
+			fmt.Fprintf(os.Stderr, "error: %s: cannot add to the index - missing --add option?\n", info.path)
+			log.Fatalf("fatal: git update-index: --cacheinfo cannot add %s", info.path)
+		}
+		index.addEntry(indexEntry{path: info.path, hash: info.hash, mode: info.mode})
+	}
+	for _, updatePath := range paths {
+		if options.assumeUnchanged != 0 || options.skipWorktree != 0 {
+			position, tracked := index.find(updatePath)
+			if !tracked {
+				log.Fatalf("fatal: Unable to mark file %s", updatePath)
+			}
+			markIndexEntry(&index.entries[position], options)
+			continue
+		}
+		if err := repo.updateIndexPath(index, updatePath, options); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			log.Fatalf("fatal: Unable to process path %s", updatePath)
+		}
+		if options.chmod != 0 {
+			position, tracked := index.find(updatePath)
+			if !tracked || index.entries[position].mode&0170000 != 0100000 {
+				log.Fatalf("fatal: git update-index: cannot chmod %cx '%s'", options.chmod, updatePath)
+			}
+			index.invalidatePath(updatePath)
+			if options.chmod == '+' {
+				index.entries[position].mode = fileModeExecutable
+			} else {
+				index.entries[position].mode = fileModeRegular
+			}
+		}
+	}
+	status := 0
+	if options.refresh && !repo.refreshIndex(w, index, options.quiet) {
+		status = 1
+	}
+	repo.writeIndex(index)
+	return status
+}
+
+// markIndexEntry sets or clears the assume-unchanged and skip-worktree
+// bits of an entry
+func markIndexEntry(entry *indexEntry, options updateIndexOptions) {
+	switch options.assumeUnchanged {
+	case '+':
+		entry.flags |= indexFlagAssumeValid
+	case '-':
+		entry.flags &^= indexFlagAssumeValid
+	}
+	switch options.skipWorktree {
+	case '+':
+		entry.extendedFlags |= indexExtendedSkipWorktree
+	case '-':
+		entry.extendedFlags &^= indexExtendedSkipWorktree
+	}
+}
+
+// updateIndexPath stages the worktree file at a path, or removes its
+// entry. A directory is only staged as the commit a submodule checked out
+// there has.
+func (repo *Repository) updateIndexPath(index *gitIndex, updatePath string, options updateIndexOptions) error {
+	position, tracked := index.find(updatePath)
+	info, err := os.Lstat(repo.worktreePath(updatePath))
+	if options.forceRemove || os.IsNotExist(err) || isNotDirectoryError(err) {
+		if !options.remove && !options.forceRemove {
+			return fmt.Errorf("%s: does not exist and --remove not passed", updatePath)
+		}
+		index.removePath(updatePath)
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !tracked && !options.add {
+		return fmt.Errorf("%s: cannot add to the index - missing --add option?", updatePath)
+	}
+	if !tracked && !repo.isValidIndexPath(updatePath) {
+		return fmt.Errorf("Invalid path '%s'", updatePath)
+	}
+	trackedMode := uint32(0)
+	if tracked {
+		trackedMode = index.entries[position].mode
+	}
+	mode := index.modes.entryMode(info, trackedMode)
+	var hash string
+	if mode == fileModeGitlink {
+		submodule, ok := repo.openSubmodule(updatePath)
+		if ok {
+			hash, ok = submodule.resolveRef("HEAD")
+		}
+		if !ok {
+			return fmt.Errorf("%s: is a directory - add files inside instead", updatePath)
+		}
+	} else {
+		hash = repo.writeWorktreeBlob(updatePath, info)
+	}
+	index.addEntry(newIndexEntry(updatePath, hash, mode, info))
+	return nil
+}
+
+// refreshIndex takes in the stat data of the worktree files that still
+// have the content of their entries and reports the others as needing an
+// update, conflicts as needing a merge; entries ignoring their worktree
+// files are left as they are. It tells whether all entries were
+// up to date; quiet says nothing and pretends they were.
+func (repo *Repository) refreshIndex(w io.Writer, index *gitIndex, quiet bool) bool {
+	clean := true
+	report := func(entryPath string, problem string) {
+		clean = false
+		if !quiet {
+			fmt.Fprintf(w, "%s: %s\n", entryPath, problem)
+		}
+	}
+	for i := range index.entries {
+		entry := &index.entries[i]
+		if entry.stage() != 0 {
+			if i == 0 || index.entries[i-1].path != entry.path {
+				report(entry.path, "needs merge")
+			}
+			continue
+		}
+		if entry.ignoresWorktree() {
+			continue
+		}
+		info, err := os.Lstat(repo.worktreePath(entry.path))
+		if os.IsNotExist(err) || isNotDirectoryError(err) {
+			report(entry.path, "needs update")
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if index.isUpToDate(*entry, info) || entry.mode == fileModeGitlink {
+			continue
+		}
+		if index.modes.entryMode(info, entry.mode) != entry.mode || repo.worktreeBlobHash(entry.path, info) != entry.hash {
+			report(entry.path, "needs update")
+			continue
+		}
+		entry.fillStat(info)
+	}
+	return clean || quiet
+}
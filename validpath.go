@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// windowsReservedNames are the device names Windows refuses as file names,
+// whatever extension follows them
+var windowsReservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true, "conin$": true, "conout$": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// isValidIndexPath reports whether a path may be staged and checked out.
+// Like git it refuses empty, "." and ".." components and ".git" in every
+// spelling some filesystem takes for it: in any case, with
+// core.protectNTFS (the default) also with trailing dots or spaces, as the
+// short name "git~1" or behind a backslash, and with core.protectHFS (the
+// default on macOS) also with characters HFS+ ignores. On Windows the
+// names and characters NTFS cannot hold are refused too.
+func (repo *Repository) isValidIndexPath(entryPath string) bool {
+	protectNTFS := repo.config.getBool("core.protectNTFS", true)
+	protectHFS := repo.config.getBool("core.protectHFS", runtime.GOOS == "darwin")
+	for _, component := range strings.Split(entryPath, "/") {
+		if component == "" || component == "." || component == ".." {
+			return false
+		}
+		names := []string{component}
+		if protectNTFS {
+			// NTFS takes backslashes for separators as well
+			names = strings.Split(component, "\\")
+		}
+		for _, name := range names {
+			if strings.EqualFold(name, ".git") {
+				return false
+			}
+			if protectNTFS {
+				trimmed := strings.ToLower(strings.TrimRight(name, ". "))
+				if trimmed == ".git" || trimmed == "git~1" {
+					return false
+				}
+			}
+			if protectHFS && strings.EqualFold(strings.Map(dropHFSIgnorable, name), ".git") {
+				return false
+			}
+		}
+		if runtime.GOOS == "windows" && !isValidWindowsName(component) {
+			return false
+		}
+	}
+	return true
+}
+
+// dropHFSIgnorable drops the zero-width characters HFS+ leaves out when it
+// compares names
+func dropHFSIgnorable(r rune) rune {
+	switch {
+	case r >= 0x200c && r <= 0x200f, r >= 0x202a && r <= 0x202e, r >= 0x206a && r <= 0x206f, r == 0xfeff:
+		return -1
+	}
+	return r
+}
+
+// isValidWindowsName reports whether NTFS can hold a file of that name: no
+// device name, no trailing dot or space and none of the reserved characters
+func isValidWindowsName(name string) bool {
+	base := strings.ToLower(name)
+	if dot := strings.IndexByte(base, '.'); dot != -1 {
+		base = base[:dot]
+	}
+	if windowsReservedNames[strings.TrimRight(base, " ")] {
+		return false
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return false
+	}
+	for _, r := range name {
+		if r < 32 || strings.ContainsRune(`<>:"\|?*`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// warnCaseCollisions tells, like git clone does, which of the paths only
+// differ in case, so that on a filesystem that ignores case just one of
+// them can be in the worktree
+func warnCaseCollisions(paths []string) {
+	groups := make(map[string][]string)
+	for _, entryPath := range paths {
+		folded := strings.ToLower(entryPath)
+		groups[folded] = append(groups[folded], entryPath)
+	}
+	colliding := make([]string, 0)
+	for _, group := range groups {
+		if len(group) > 1 {
+			colliding = append(colliding, group...)
+		}
+	}
+	if len(colliding) == 0 {
+		return
+	}
+	sort.Strings(colliding)
+	fmt.Fprintln(os.Stderr, "warning: the following paths have collided (e.g. case-sensitive paths")
+	fmt.Fprintln(os.Stderr, "on a case-insensitive filesystem) and only one from the same")
+	fmt.Fprintln(os.Stderr, "colliding group is in the working tree:")
+	fmt.Fprintln(os.Stderr)
+	for _, entryPath := range colliding {
+		fmt.Fprintf(os.Stderr, "  '%s'\n", entryPath)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// logicalVariables are the variables "var" knows, in the order -l lists them
+var logicalVariables = []string{"GIT_COMMITTER_IDENT", "GIT_AUTHOR_IDENT", "GIT_EDITOR", "GIT_PAGER"}
+
+// logicalVariable returns the value git would use for one of the
+// logicalVariables, resolved from the environment and the config the way
+// the commands using it do
+func (repo *Repository) logicalVariable(name string) (string, bool) {
+	switch name {
+	case "GIT_COMMITTER_IDENT":
+		return repo.currentIdentity("COMMITTER").String(), true
+	case "GIT_AUTHOR_IDENT":
+		return repo.currentIdentity("AUTHOR").String(), true
+	case "GIT_EDITOR":
+		return repo.editorCommand(), true
+	case "GIT_PAGER":
+		return repo.pagerCommand(), true
+	}
+	return "", false
+}
+
+// listVariables prints, like "git var -l", every config variable followed
+// by the logicalVariables
+func (repo *Repository) listVariables(w io.Writer) {
+	for _, entry := range repo.config.allEntries() {
+		fmt.Fprintf(w, "%s=%s\n", entry.key, entry.value)
+	}
+	for _, name := range logicalVariables {
+		value, _ := repo.logicalVariable(name)
+		fmt.Fprintf(w, "%s=%s\n", name, value)
+	}
+}
+
+// printEnvironment prints what the repository was resolved to, one
+// "<key>=<value>" line each: the paths discovery found, the object format,
+// the config files read in increasing precedence with how many variables
+// each set, and the GIT_* environment variables changing any of it
+func (repo *Repository) printEnvironment(w io.Writer) {
+	fmt.Fprintf(w, "git-dir=%s\n", repo.gitDir)
+	fmt.Fprintf(w, "work-tree=%s\n", repo.workTree)
+	prefix := repo.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	fmt.Fprintf(w, "prefix=%s\n", prefix)
+	directories := repo.objectDirectories()
+	fmt.Fprintf(w, "object-directory=%s\n", directories[0])
+	for _, alternate := range directories[1:] {
+		fmt.Fprintf(w, "alternate-object-directory=%s\n", alternate)
+	}
+	fmt.Fprintf(w, "index-file=%s\n", repo.indexPath())
+	objectFormat, ok := repo.config.get("extensions.objectFormat")
+	if !ok {
+		objectFormat = "sha1"
+	}
+	fmt.Fprintf(w, "object-format=%s\n", objectFormat)
+
+	counts := make(map[string]int)
+	for _, entry := range repo.config.allEntries() {
+		counts[entry.source]++
+	}
+	local := filepath.Join(repo.gitDir, "config")
+	for _, path := range configFilePaths(repo.gitDir) {
+		scope := "global"
+		if path == local {
+			scope = "local"
+		}
+		state := fmt.Sprintf("%d variables", counts[path])
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			state = "missing"
+		}
+		fmt.Fprintf(w, "config-source=%s:%s (%s)\n", scope, path, state)
+	}
+
+	environment := make([]string, 0)
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, "GIT_") {
+			environment = append(environment, variable)
+		}
+	}
+	sort.Strings(environment)
+	for _, variable := range environment {
+		fmt.Fprintf(w, "env.%s\n", variable)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// verifyPack checks a pack against its index: both checksums, and that the
+// index lists exactly the objects found when reading the pack. verbose
+// lists every object, statOnly only the delta chain histogram.
+func (repo *Repository) verifyPack(path string, verbose bool, statOnly bool) bool {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".idx"), ".pack")
+	data, err := os.ReadFile(path + ".pack")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: packfile %s.pack not found.\n", path)
+		return false
+	}
+	indexContent, err := os.ReadFile(path + ".idx")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: packfile %s.pack index unavailable\n", path)
+		return false
+	}
+	if len(indexContent) < 2*ObjectShaLength {
+		fmt.Fprintf(os.Stderr, "error: %s.idx is too small\n", path)
+		return false
+	}
+	indexBody := indexContent[:len(indexContent)-ObjectShaLength]
+	if checksum := sha1.Sum(indexBody); !bytes.Equal(checksum[:], indexContent[len(indexBody):]) {
+		fmt.Fprintf(os.Stderr, "error: index file %s.idx is corrupt\n", path)
+		return false
+	}
+	stream := parsePackStream(data, noProgress{})
+	if !bytes.Equal(indexBody[len(indexBody)-ObjectShaLength:], data[len(data)-ObjectShaLength:]) {
+		fmt.Fprintf(os.Stderr, "error: packfile %s.pack does not match index\n", path)
+		return false
+	}
+	unresolved := stream.resolve(nil, nil, noProgress{})
+	if len(unresolved) > 0 {
+		fmt.Fprintf(os.Stderr, "error: packfile %s.pack has unresolved deltas\n", path)
+		return false
+	}
+	index := readPackIndex(path+".idx", int64(len(data)))
+	defer index.close()
+	valid := len(index.offsets) == len(stream.entries)
+	for _, entry := range stream.entries {
+		position, ok := index.findPosition(entry.hash)
+		if !ok || index.offsets[position] != entry.offset {
+			fmt.Fprintf(os.Stderr, "error: %s is at offset %d in %s.pack but not in its index\n", entry.hash, entry.offset, path)
+			valid = false
+			continue
+		}
+		if crc, ok := index.crcAt(position); ok && crc != entry.crc {
+			fmt.Fprintf(os.Stderr, "error: bad packed object CRC for %s\n", entry.hash)
+			valid = false
+		}
+	}
+	if !valid {
+		fmt.Fprintf(os.Stderr, "error: packfile %s.pack does not match index\n", path)
+		return false
+	}
+	if verbose || statOnly {
+		printPackContents(stream, !statOnly)
+	}
+	if verbose && !statOnly {
+		fmt.Printf("%s.pack: ok\n", path)
+	}
+	return true
+}
+
+func printPackContents(stream *packStream, listObjects bool) {
+	// format of each object, the base is only shown for deltas:
+	// <sha> <type> <size> <size-in-pack> <offset> [<depth> <base-sha>]
+	entries := make([]*packStreamEntry, len(stream.entries))
+	for i := range stream.entries {
+		entries[i] = &stream.entries[i]
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].offset < entries[j].offset })
+	chainLengths := make(map[int]int)
+	maxDepth := 0
+	for _, entry := range entries {
+		chainLengths[entry.depth]++
+		if entry.depth > maxDepth {
+			maxDepth = entry.depth
+		}
+		if !listObjects {
+			continue
+		}
+		fmt.Printf("%s %-6s %d %d %d", entry.hash, entry.objectType, entry.dataSize, entry.packedSize, entry.offset)
+		if entry.depth > 0 {
+			fmt.Printf(" %d %s", entry.depth, entry.base)
+		}
+		fmt.Println()
+	}
+	plural := func(count int) string {
+		if count == 1 {
+			return "1 object"
+		}
+		return fmt.Sprintf("%d objects", count)
+	}
+	if chainLengths[0] > 0 {
+		fmt.Printf("non delta: %s\n", plural(chainLengths[0]))
+	}
+	for depth := 1; depth <= maxDepth; depth++ {
+		if chainLengths[depth] > 0 {
+			fmt.Printf("chain length = %d: %s\n", depth, plural(chainLengths[depth]))
+		}
+	}
+}
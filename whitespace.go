@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// whitespaceRule holds the whitespace problems core.whitespace asks to
+// look for, and the tab width in its low bits
+type whitespaceRule uint32
+
+const (
+	whitespaceBlankAtEOL       whitespaceRule = 1 << 6
+	whitespaceSpaceBeforeTab   whitespaceRule = 1 << 7
+	whitespaceIndentWithNonTab whitespaceRule = 1 << 8
+	whitespaceCRAtEOL          whitespaceRule = 1 << 9
+	whitespaceBlankAtEOF       whitespaceRule = 1 << 10
+	whitespaceTabInIndent      whitespaceRule = 1 << 11
+	whitespaceTrailingSpace                   = whitespaceBlankAtEOL | whitespaceBlankAtEOF
+	whitespaceTabWidthMask     whitespaceRule = 1<<6 - 1
+
+	defaultWhitespaceRule = whitespaceTrailingSpace | whitespaceSpaceBeforeTab | 8
+)
+
+var whitespaceRuleNames = []struct {
+	name string
+	bits whitespaceRule
+}{
+	{"trailing-space", whitespaceTrailingSpace},
+	{"space-before-tab", whitespaceSpaceBeforeTab},
+	{"indent-with-non-tab", whitespaceIndentWithNonTab},
+	{"cr-at-eol", whitespaceCRAtEOL},
+	{"blank-at-eol", whitespaceBlankAtEOL},
+	{"blank-at-eof", whitespaceBlankAtEOF},
+	{"tab-in-indent", whitespaceTabInIndent},
+}
+
+// parseWhitespaceRule reads a core.whitespace value: a comma separated
+// list of rules turned on, or off with a "-" prefix, on top of the default
+// blank-at-eol, blank-at-eof and space-before-tab
+func parseWhitespaceRule(value string) whitespaceRule {
+	rule := defaultWhitespaceRule
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		negated := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		if width, ok := strings.CutPrefix(name, "tabwidth="); ok {
+			if tabWidth, err := strconv.Atoi(width); err == nil && tabWidth > 0 && tabWidth < 64 {
+				rule = rule&^whitespaceTabWidthMask | whitespaceRule(tabWidth)
+			} else {
+				fmt.Fprintf(os.Stderr, "warning: tabwidth %s out of range\n", width)
+			}
+			continue
+		}
+		for _, known := range whitespaceRuleNames {
+			if known.name != name {
+				continue
+			}
+			if negated {
+				rule &^= known.bits
+			} else {
+				rule |= known.bits
+			}
+		}
+	}
+	if rule&whitespaceTabInIndent != 0 && rule&whitespaceIndentWithNonTab != 0 {
+		log.Fatal("fatal: cannot enforce both tab-in-indent and indent-with-non-tab")
+	}
+	return rule
+}
+
+func (repo *Repository) whitespaceRule() whitespaceRule {
+	value, _ := repo.config.get("core.whitespace")
+	return parseWhitespaceRule(value)
+}
+
+func (rule whitespaceRule) tabWidth() int {
+	return int(rule & whitespaceTabWidthMask)
+}
+
+// whitespaceErrorString describes the problems found, as in "trailing
+// whitespace, space before tab in indent"
+func whitespaceErrorString(problems whitespaceRule) string {
+	errors := make([]string, 0)
+	if problems&whitespaceTrailingSpace == whitespaceTrailingSpace {
+		errors = append(errors, "trailing whitespace")
+	} else {
+		if problems&whitespaceBlankAtEOL != 0 {
+			errors = append(errors, "trailing whitespace")
+		}
+		if problems&whitespaceBlankAtEOF != 0 {
+			errors = append(errors, "new blank line at EOF")
+		}
+	}
+	if problems&whitespaceSpaceBeforeTab != 0 {
+		errors = append(errors, "space before tab in indent")
+	}
+	if problems&whitespaceIndentWithNonTab != 0 {
+		errors = append(errors, "indent with spaces")
+	}
+	if problems&whitespaceTabInIndent != 0 {
+		errors = append(errors, "tab in indent")
+	}
+	return strings.Join(errors, ", ")
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r'
+}
+
+// checkWhitespace finds the problems of one line, writing it to w with the
+// problems highlighted in color ws when w is not nil. This follows
+// ws_check_emit of git: the part of the line without problems is shown in
+// color set, the indentation before it uncolored.
+func checkWhitespace(line string, rule whitespaceRule, w io.Writer, set string, reset string, ws string) whitespaceRule {
+	var problems whitespaceRule
+	write := func(parts ...string) {
+		if w != nil {
+			for _, part := range parts {
+				io.WriteString(w, part)
+			}
+		}
+	}
+	trailingNewline, trailingCR := false, false
+	if strings.HasSuffix(line, "\n") {
+		line, trailingNewline = line[:len(line)-1], true
+	}
+	if rule&whitespaceCRAtEOL != 0 && strings.HasSuffix(line, "\r") {
+		line, trailingCR = line[:len(line)-1], true
+	}
+
+	trailingWhitespace := len(line)
+	if rule&whitespaceBlankAtEOL != 0 {
+		for trailingWhitespace > 0 && isSpaceByte(line[trailingWhitespace-1]) {
+			trailingWhitespace--
+			problems |= whitespaceBlankAtEOL
+		}
+	}
+
+	written, i := 0, 0
+	for ; i < trailingWhitespace; i++ {
+		if line[i] == ' ' {
+			continue
+		}
+		if line[i] != '\t' {
+			break
+		}
+		switch {
+		case rule&whitespaceSpaceBeforeTab != 0 && written < i:
+			problems |= whitespaceSpaceBeforeTab
+			write(ws, line[written:i], reset, line[i:i+1])
+		case rule&whitespaceTabInIndent != 0:
+			problems |= whitespaceTabInIndent
+			write(line[written:i], ws, line[i:i+1], reset)
+		default:
+			write(line[written : i+1])
+		}
+		written = i + 1
+	}
+	if rule&whitespaceIndentWithNonTab != 0 && i-written >= rule.tabWidth() {
+		problems |= whitespaceIndentWithNonTab
+		write(ws, line[written:i], reset)
+		written = i
+	}
+
+	if trailingWhitespace > written {
+		write(set, line[written:trailingWhitespace], reset)
+	}
+	if trailingWhitespace < len(line) {
+		write(ws, line[trailingWhitespace:], reset)
+	}
+	if trailingCR {
+		write("\r")
+	}
+	if trailingNewline {
+		write("\n")
+	}
+	return problems
+}
+
+// isBlankLine tells a line of nothing but whitespace
+func isBlankLine(line string) bool {
+	for i := 0; i < len(line); i++ {
+		if !isSpaceByte(line[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// countTrailingBlankLines counts the blank lines at the end of content.
+// Like git, the first line of the file is never counted.
+func countTrailingBlankLines(lines []string) int {
+	count := 0
+	for i := len(lines) - 1; i > 0 && isBlankLine(lines[i]); i-- {
+		count++
+	}
+	return count
+}
+
+// blankLinesAtEOF returns the line where the blank lines that the new
+// side added at its end start, in the old and the new side; 0 when the
+// change adds none
+func blankLinesAtEOF(oldLines []string, newLines []string) (int, int) {
+	oldBlank, newBlank := countTrailingBlankLines(oldLines), countTrailingBlankLines(newLines)
+	if newBlank <= oldBlank {
+		return 0, 0
+	}
+	return len(oldLines) - oldBlank + 1, len(newLines) - newBlank + 1
+}
+
+// isConflictMarker tells a line left over from a merge conflict: seven
+// "<", "|", "=" or ">" followed by whitespace or the end of the line
+func isConflictMarker(line string) bool {
+	if len(line) < 8 || !strings.Contains("<|=>", line[:1]) {
+		return false
+	}
+	return line[:7] == strings.Repeat(line[:1], 7) && isSpaceByte(line[7])
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// wordDiffElement is how one kind of text shows in a word diff
+type wordDiffElement struct {
+	prefix string
+	suffix string
+}
+
+// wordDiffStyle is a --word-diff mode: how removed, added and unchanged
+// text is marked, and what stands for a line end
+type wordDiffStyle struct {
+	old     wordDiffElement
+	new     wordDiffElement
+	context wordDiffElement
+	newline string
+}
+
+var wordDiffStyles = map[string]wordDiffStyle{
+	"porcelain": {wordDiffElement{"-", "\n"}, wordDiffElement{"+", "\n"}, wordDiffElement{" ", "\n"}, "~\n"},
+	"plain":     {wordDiffElement{"[-", "-]"}, wordDiffElement{"{+", "+}"}, wordDiffElement{"", ""}, "\n"},
+	"color":     {wordDiffElement{"", ""}, wordDiffElement{"", ""}, wordDiffElement{"", ""}, "\n"},
+}
+
+// parseWordDiffMode reads a --word-diff value, empty for none
+func parseWordDiffMode(value string) string {
+	switch value {
+	case "none":
+		return ""
+	case "true":
+		return "plain"
+	}
+	if _, ok := wordDiffStyles[value]; !ok {
+		log.Fatalf("fatal: bad --word-diff argument: %s", value)
+	}
+	return value
+}
+
+// compileWordRegex compiles a --word-diff-regex or diff.wordRegex value;
+// like git, "^" and "$" match at line boundaries
+func compileWordRegex(value string) *regexp.Regexp {
+	expression, err := regexp.Compile("(?m)" + value)
+	if err != nil {
+		log.Fatalf("fatal: invalid regular expression: %s", value)
+	}
+	return expression
+}
+
+// wordSpan is a word of a text, from begin to end
+type wordSpan struct {
+	begin, end int
+}
+
+// splitWords finds the words of text: the matches of regex, cut at a line
+// end, or runs of non-whitespace without one
+func splitWords(text string, regex *regexp.Regexp) []wordSpan {
+	words := make([]wordSpan, 0)
+	for i := 0; i < len(text); i++ {
+		var end int
+		if regex != nil {
+			match := regex.FindStringIndex(text[i:])
+			if match == nil {
+				break
+			}
+			end = i + match[1]
+			if newline := strings.IndexByte(text[i+match[0]:end], '\n'); newline != -1 {
+				end = i + match[0] + newline
+			}
+			i += match[0]
+			if i >= end {
+				break
+			}
+		} else {
+			for i < len(text) && isSpaceByte(text[i]) {
+				i++
+			}
+			if i >= len(text) {
+				break
+			}
+			for end = i + 1; end < len(text) && !isSpaceByte(text[end]); end++ {
+			}
+		}
+		words = append(words, wordSpan{i, end})
+		i = end - 1
+	}
+	return words
+}
+
+// writeWordDiffHunk shows a hunk as words: the removed and added lines
+// between unchanged ones are diffed word by word
+func (options diffOptions) writeWordDiffHunk(w io.Writer, hunk diffHunk) {
+	var removed, added strings.Builder
+	flush := func() {
+		if removed.Len() > 0 || added.Len() > 0 {
+			options.writeChangedWords(w, removed.String(), added.String())
+			removed.Reset()
+			added.Reset()
+		}
+	}
+	colors := options.colors
+	for _, line := range hunk.lines {
+		// as in git, a missing newline at the end of the file does not show
+		text := line.text
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		switch line.op {
+		case '-':
+			removed.WriteString(text)
+		case '+':
+			added.WriteString(text)
+		default:
+			flush()
+			if options.wordDiff == "porcelain" {
+				text = " " + text
+			}
+			end := len(text)
+			if strings.HasSuffix(text[:end], "\n") {
+				end--
+			}
+			if strings.HasSuffix(text[:end], "\r") {
+				end--
+			}
+			if end > 0 {
+				io.WriteString(w, colors.context+text[:end]+colors.reset)
+			}
+			io.WriteString(w, text[end:])
+			if options.wordDiff == "porcelain" {
+				io.WriteString(w, "~\n")
+			}
+		}
+	}
+	flush()
+}
+
+// writeChangedWords shows removed text replaced by added text, with the
+// words both have shown as context. Like git's diff_words_show, the
+// whitespace between words is taken from the added text.
+func (options diffOptions) writeChangedWords(w io.Writer, removed string, added string) {
+	style := wordDiffStyles[options.wordDiff]
+	colors := options.colors
+	if added == "" {
+		writeWords(w, style.old, colors.old, style.newline, removed)
+		return
+	}
+	removedWords, addedWords := splitWords(removed, options.wordRegex), splitWords(added, options.wordRegex)
+	tokens := func(text string, words []wordSpan) []string {
+		result := make([]string, len(words))
+		for i, word := range words {
+			result[i] = text[word.begin:word.end]
+		}
+		return result
+	}
+	// hunks number words from 1, 0 standing for the start of the text
+	bounds := func(words []wordSpan, start int, count int) (int, int) {
+		switch {
+		case count > 0:
+			return words[start-1].begin, words[start+count-2].end
+		case start > 0:
+			return words[start-1].end, words[start-1].end
+		}
+		return 0, 0
+	}
+	current := 0
+	diff := diffSequences(tokens(removed, removedWords), tokens(added, addedWords), false)
+	for _, hunk := range diff.hunks(0) {
+		removedBegin, removedEnd := bounds(removedWords, hunk.oldStart, hunk.oldCount)
+		addedBegin, addedEnd := bounds(addedWords, hunk.newStart, hunk.newCount)
+		if current != addedBegin {
+			writeWords(w, style.context, colors.context, style.newline, added[current:addedBegin])
+		}
+		if removedBegin != removedEnd {
+			writeWords(w, style.old, colors.old, style.newline, removed[removedBegin:removedEnd])
+		}
+		if addedBegin != addedEnd {
+			writeWords(w, style.new, colors.new, style.newline, added[addedBegin:addedEnd])
+		}
+		current = addedEnd
+	}
+	if current != len(added) {
+		writeWords(w, style.context, colors.context, style.newline, added[current:])
+	}
+}
+
+// writeWords writes text marked as element, line by line
+func writeWords(w io.Writer, element wordDiffElement, color string, newline string, text string) {
+	for text != "" {
+		line, rest, found := strings.Cut(text, "\n")
+		if line != "" {
+			io.WriteString(w, colorize(color != "", color, element.prefix+line+element.suffix))
+		}
+		if !found {
+			return
+		}
+		io.WriteString(w, newline)
+		text = rest
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// jobCount resolves the number of workers: an explicit --jobs value, then
+// core.threads, where zero means one per CPU
+func (repo *Repository) jobCount(requested int) int {
+	if requested <= 0 {
+		requested = int(repo.config.getInt("core.threads", 0))
+	}
+	if requested <= 0 {
+		requested = runtime.NumCPU()
+	}
+	return requested
+}
+
+// runParallel calls work for every index in [0, count) on up to jobs
+// goroutines; callers keep ordering by writing results into slots
+func runParallel(jobs int, count int, work func(i int)) {
+	if jobs > count {
+		jobs = count
+	}
+	if jobs <= 1 {
+		for i := 0; i < count; i++ {
+			work(i)
+		}
+		return
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < jobs; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				work(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// staleLockAge is how old a lock file has to be before it is reported as
+// possibly left by a crashed process. Commands can hold one longer, commit
+// the index.lock while its editor is open, so none is removed unasked.
+const staleLockAge = time.Hour
+
+type worktreePruneOptions struct {
+	expire      time.Time // only worktrees whose gitdir file is older than this are pruned
+	removeLocks bool      // remove the lock files older than staleLockAge instead of reporting them
+	dryRun      bool
+	verbose     bool
+	quiet       bool // do not report old lock files that are kept
+}
+
+// pruneWorktrees removes the administrative directories under
+// $GIT_DIR/worktrees of linked worktrees that are gone, except those
+// "worktree lock" protects. Lock files old enough to have been left by
+// crashed processes in the administrative directories are reported, or
+// with removeLocks removed.
+func (repo *Repository) pruneWorktrees(options worktreePruneOptions) {
+	dir := filepath.Join(repo.gitDir, "worktrees")
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	kept := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		reason := prunableWorktree(filepath.Join(dir, entry.Name()), options.expire)
+		if reason == "" {
+			kept = append(kept, filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if options.dryRun || options.verbose {
+			fmt.Fprintf(os.Stderr, "Removing worktrees/%s: %s\n", entry.Name(), reason)
+		}
+		if !options.dryRun {
+			if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if !options.dryRun && len(kept) == 0 {
+		// only succeeds once nothing is left in it
+		os.Remove(dir)
+	}
+	reported := false
+	for _, lockPath := range repo.staleLockFiles(kept) {
+		name, _ := filepath.Rel(repo.gitDir, lockPath)
+		if !options.removeLocks {
+			if !options.quiet {
+				fmt.Fprintf(os.Stderr, "warning: lock file %s is over an hour old and may be stale\n", filepath.ToSlash(name))
+				reported = true
+			}
+			continue
+		}
+		if options.dryRun || options.verbose {
+			fmt.Fprintf(os.Stderr, "Removing stale lock file %s\n", filepath.ToSlash(name))
+		}
+		if !options.dryRun {
+			os.Remove(lockPath)
+		}
+	}
+	if reported {
+		fmt.Fprintf(os.Stderr, "hint: once no command is using them, '%s worktree prune --force' removes them\n", programName())
+	}
+}
+
+// prunableWorktree says why the administrative directory of a linked
+// worktree can go, "" when it has to stay
+func prunableWorktree(adminDir string, expire time.Time) string {
+	info, err := os.Stat(adminDir)
+	if err != nil || !info.IsDir() {
+		return "not a valid directory"
+	}
+	if _, err := os.Stat(filepath.Join(adminDir, "locked")); err == nil {
+		return ""
+	}
+	gitdirPath := filepath.Join(adminDir, "gitdir")
+	content, err := os.ReadFile(gitdirPath)
+	if os.IsNotExist(err) {
+		return "gitdir file does not exist"
+	}
+	if err != nil {
+		return fmt.Sprintf("unable to read gitdir file (%s)", err)
+	}
+	target := strings.TrimSpace(string(content))
+	if target == "" {
+		return "invalid gitdir file"
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(adminDir, target)
+	}
+	if _, err := os.Stat(target); err == nil {
+		return ""
+	}
+	// the worktree may be on a removable disk that is not mounted right
+	// now, so give it until expire to come back
+	info, err = os.Stat(gitdirPath)
+	if err != nil || info.ModTime().After(expire) {
+		return ""
+	}
+	return "gitdir file points to non-existent location"
+}
+
+// staleLockFiles lists the lock files older than staleLockAge in the
+// administrative files of the repository and of the given worktree
+// directories: the files at the top of them, the refs and reflogs, the
+// reftables and the commit-graph
+func (repo *Repository) staleLockFiles(worktreeDirs []string) []string {
+	stale := make([]string, 0)
+	check := func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".lock") {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			stale = append(stale, path)
+		}
+		return nil
+	}
+	for _, dir := range append([]string{repo.gitDir}, worktreeDirs...) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			check(filepath.Join(dir, entry.Name()), entry, nil)
+		}
+		for _, subdir := range []string{"refs", "logs", "reftable"} {
+			filepath.WalkDir(filepath.Join(dir, subdir), check)
+		}
+	}
+	filepath.WalkDir(filepath.Join(repo.gitDir, "objects", "info"), check)
+	return stale
+}
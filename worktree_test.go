@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPruneWorktreesKeepsOldLocks checks that an old lock, which a commit
+// waiting on its editor may still hold, is only removed when asked
+func TestPruneWorktreesKeepsOldLocks(t *testing.T) {
+	repo := newTestRepository(t, RepositoryOptions{})
+	lockPath := filepath.Join(repo.gitDir, "index.lock")
+	if err := os.WriteFile(lockPath, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	repo.pruneWorktrees(worktreePruneOptions{expire: time.Now(), quiet: true})
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Fatalf("prune without removeLocks removed %s: %v", lockPath, err)
+	}
+	repo.pruneWorktrees(worktreePruneOptions{expire: time.Now(), removeLocks: true})
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Fatalf("prune with removeLocks kept %s", lockPath)
+	}
+}